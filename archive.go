@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/vaultarchive"
+)
+
+// importArchive is the "-import" type for archives created by "-export"
+const importArchive = "archive"
+
+// exportArchive implements "-export FILE". It packs CIPHERDIR into the
+// archive FILE, or writes it to stdout if FILE is "-". Everything stays
+// encrypted, so the password is not needed.
+// Does not return (calls os.Exit both on success and on error).
+func exportArchive(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-export cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args._configCustom {
+		tlog.Warn.Printf("-export: the config file %s is outside of CIPHERDIR and is not exported", args.config)
+	}
+	var out *os.File
+	var dst, tmp string
+	if args.export == "-" {
+		out = os.Stdout
+		// The archive goes to stdout
+		tlog.Info.Enabled = false
+	} else {
+		dst, _ = filepath.Abs(args.export)
+		if rel, err := filepath.Rel(args.cipherdir, dst); err == nil && !strings.HasPrefix(rel, "..") {
+			tlog.Fatal.Printf("-export: %s is inside CIPHERDIR", args.export)
+			os.Exit(exitcodes.Usage)
+		}
+		// Written under a temporary name so that an interrupted export
+		// does not leave an archive that looks complete at first sight
+		tmp = dst + ".tmp"
+		var err error
+		out, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			tlog.Fatal.Printf("-export: %v", err)
+			os.Exit(exitcodes.Archive)
+		}
+	}
+	tlog.Info.Printf("Exporting %q. The filesystem should not be mounted while this runs.", args.cipherdir)
+	w := bufio.NewWriterSize(out, 1<<20)
+	stats, err := vaultarchive.Write(w, args.cipherdir, tlog.ProgramName+" "+GitVersion)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil && tmp != "" {
+		err = out.Sync()
+	}
+	if tmp != "" {
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(tmp, dst)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-export: %v", err)
+		os.Exit(exitcodes.Archive)
+	}
+	if stats.Skipped > 0 {
+		tlog.Warn.Printf("-export: %d special files were skipped", stats.Skipped)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Exported %d files (%d bytes), %d directories and %d symlinks."+tlog.ColorReset,
+		stats.Files, stats.Bytes, stats.Dirs, stats.Symlinks)
+	os.Exit(0)
+}
+
+// openArchive opens the archive "path", or stdin if it is "-"
+func openArchive(path string) io.ReadCloser {
+	if path == "-" {
+		return io.NopCloser(os.Stdin)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Archive)
+	}
+	return f
+}
+
+// archiveFatal reports the "-import archive" or "-verify-archive" error
+// "err" and exits.
+func archiveFatal(flag string, err error) {
+	tlog.Fatal.Printf("%s: %v", flag, err)
+	if errors.Is(err, vaultarchive.ErrDamaged) {
+		tlog.Info.Printf("The archive has not been written completely, or it has been changed.")
+	}
+	os.Exit(exitcodes.Archive)
+}
+
+// importVaultArchive implements "-import archive FILE CIPHERDIR". CIPHERDIR
+// must be an empty directory. The archive is verified against its
+// manifest before anything is moved into CIPHERDIR.
+// Does not return (calls os.Exit both on success and on error).
+func importVaultArchive(args *argContainer) {
+	src := args._importSrc
+	if flagSet.Arg(0) == "-" {
+		src = "-"
+	}
+	in := openArchive(src)
+	defer in.Close()
+	stats, err := vaultarchive.Extract(bufio.NewReaderSize(in, 1<<20), args.cipherdir)
+	if err != nil {
+		archiveFatal("-import", err)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Imported %d files (%d bytes), %d directories and %d symlinks, created by %s."+tlog.ColorReset,
+		stats.Files, stats.Bytes, stats.Dirs, stats.Symlinks, stats.Creator)
+	os.Exit(0)
+}
+
+// verifyArchive implements "-verify-archive FILE". It checks the archive
+// against its manifest without the password and without unpacking it.
+// Does not return (calls os.Exit both on success and on error).
+func verifyArchive(args *argContainer) {
+	if flagSet.NArg() != 1 {
+		tlog.Fatal.Printf("Usage: %s -verify-archive FILE", tlog.ProgramName)
+		os.Exit(exitcodes.Usage)
+	}
+	in := openArchive(flagSet.Arg(0))
+	defer in.Close()
+	stats, err := vaultarchive.Verify(bufio.NewReaderSize(in, 1<<20))
+	if err != nil {
+		archiveFatal("-verify-archive", err)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"The archive is intact: %d files (%d bytes), %d directories and %d symlinks, created by %s."+tlog.ColorReset,
+		stats.Files, stats.Bytes, stats.Dirs, stats.Symlinks, stats.Creator)
+	os.Exit(0)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkNames implements "-check-names CIPHERDIR [TREE]". It prints how long
+// plaintext names can be in CIPHERDIR and, if "tree" is not empty, lists
+// the names below "tree" that are longer. Only the config file is read, the
+// password is not needed.
+// Does not return (calls os.Exit both on success and on error).
+func checkNames(args *argContainer, tree string) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	l, err := configNameLimits(cf, args.cipherdir)
+	if err != nil {
+		tlog.Fatal.Printf("-check-names: %v", err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	fmt.Printf("Longest plaintext name:  %d bytes\n", l.Max)
+	if l.Direct < l.Max {
+		fmt.Printf("Stored without hashing:  up to %d bytes, longer names need an extra gocryptfs.longname.*.name file\n", l.Direct)
+	}
+	fmt.Printf("Backing filesystem:      allows %d bytes\n", l.BackingMax)
+	if tree == "" {
+		os.Exit(0)
+	}
+	tooLong, hashed, err := scanNames(tree, l, func(path string, n int) {
+		fmt.Printf("too long (%d bytes): %s\n", n, path)
+	})
+	if err != nil {
+		tlog.Fatal.Printf("-check-names: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if hashed > 0 {
+		tlog.Info.Printf("%d names are longer than %d bytes and will be hashed", hashed, l.Direct)
+	}
+	if tooLong > 0 {
+		tlog.Fatal.Printf("%d names in %s are longer than %d bytes and cannot be stored", tooLong, tree, l.Max)
+		os.Exit(exitcodes.NameTooLong)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"All names in %s can be stored."+tlog.ColorReset, tree)
+	os.Exit(0)
+}
+
+// configNameLimits computes the name length limits of the filesystem in
+// "cipherdir" from its config file
+func configNameLimits(cf *configfile.ConfFile, cipherdir string) (ctlsock.NameLimits, error) {
+	backingMax, err := syscallcompat.NameMax(cipherdir)
+	if err != nil {
+		return ctlsock.NameLimits{}, err
+	}
+	l := ctlsock.NameLimits{BackingMax: backingMax}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		l.Max, l.Direct = nametransform.PlainNameLimits(backingMax)
+		return l, nil
+	}
+	// The lengths only depend on the feature flags, so we get away without
+	// the EME cipher and the MAC key
+	var fa *filenameauth.FilenameAuth
+	if cf.IsFeatureFlagSet(configfile.FlagFilenameAuth) {
+		fa = filenameauth.NewWithMACFunc(nil, cf.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded))
+	}
+	nt := nametransform.New(nil, cf.IsFeatureFlagSet(configfile.FlagLongNames), cf.LongNameMax,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64), nil, false, fa)
+	l.Max, l.Direct = nt.NameLimits(backingMax)
+	return l, nil
+}
+
+// scanNames walks "tree" and calls "report" for each name that is longer
+// than l.Max. Returns the number of such names, and the number of names
+// that fit but are longer than l.Direct.
+func scanNames(tree string, l ctlsock.NameLimits, report func(path string, n int)) (tooLong int, hashed int, err error) {
+	err = filepath.WalkDir(tree, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", path, err)
+			return nil
+		}
+		if path == tree {
+			return nil
+		}
+		switch n := len(d.Name()); {
+		case n > l.Max:
+			report(path, n)
+			tooLong++
+		case n > l.Direct:
+			hashed++
+		}
+		return nil
+	})
+	return tooLong, hashed, err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+)
+
+func TestConfigNameLimits(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		flags  []string
+		direct int
+	}{
+		{[]string{"LongNames", "Raw64"}, 175},
+		{[]string{"LongNames", "Raw64", "FilenameAuth", "FilenameAuthEmbedded"}, 159},
+		{[]string{"LongNames", "Raw64", "FilenameAuth"}, 143},
+		{[]string{"PlaintextNames"}, 255},
+	}
+	for _, tc := range testCases {
+		l, err := configNameLimits(&configfile.ConfFile{FeatureFlags: tc.flags}, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The test may run on a filesystem with shorter names than 255
+		// bytes, but then the limits are not what we check here
+		if l.BackingMax < 255 {
+			t.Skipf("backing filesystem only allows %d bytes", l.BackingMax)
+		}
+		if l.Max != 255 || l.Direct != tc.direct {
+			t.Errorf("%v: have %+v, want Direct=%d", tc.flags, l, tc.direct)
+		}
+	}
+}
+
+func TestScanNames(t *testing.T) {
+	tree := t.TempDir()
+	names := []string{"short", strings.Repeat("h", 60), "d/" + strings.Repeat("x", 101), "d/ok"}
+	for _, n := range names {
+		p := filepath.Join(tree, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var reported []string
+	tooLong, hashed, err := scanNames(tree, ctlsock.NameLimits{Max: 100, Direct: 50}, func(path string, n int) {
+		reported = append(reported, path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tooLong != 1 || hashed != 1 {
+		t.Errorf("tooLong=%d hashed=%d", tooLong, hashed)
+	}
+	if len(reported) != 1 || reported[0] != filepath.Join(tree, names[2]) {
+		t.Errorf("reported %q", reported)
+	}
+}
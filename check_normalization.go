@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkNormalization implements "-check-normalization CIPHERDIR". It lists
+// the names in the same directory that only differ in their Unicode
+// normalization. They look the same, but with "-nfc" or "-nfd", only one of
+// them can be opened. It also counts the names in NFC and NFD to help with
+// choosing between the two.
+// Does not return (calls os.Exit both on success and on error).
+func checkNormalization(args *argContainer) {
+	st, err := scanNormalizationTree(args, func(dir string, names []string) {
+		forms := make([]string, len(names))
+		for i, n := range names {
+			forms[i] = fmt.Sprintf("%q (%v)", n, nametransform.NormalizationOf(n))
+		}
+		fmt.Printf("same after normalization in %s: %s\n", path.Join("/", dir), strings.Join(forms, ", "))
+	})
+	if err != nil {
+		tlog.Fatal.Printf("-check-normalization: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf("%d names are in NFC (composed, as created on Linux), %d in NFD (decomposed, as created on macOS)",
+		st.nfc, st.nfd)
+	if st.conflicts > 0 {
+		tlog.Fatal.Printf("%d groups of names only differ in their normalization. Mount without -nfc and -nfd and rename all but one name of each group.",
+			st.conflicts)
+		os.Exit(exitcodes.MixedNormalization)
+	}
+	if st.nfc > 0 && st.nfd > 0 {
+		tlog.Info.Printf("Both forms are used. Mount with -nfc or -nfd to find names in either form.")
+	}
+	os.Exit(0)
+}
+
+// normalizationStats is the result of scanNormalization
+type normalizationStats struct {
+	// Names in NFC and in NFD. Names that are the same in both forms,
+	// like ASCII names, are not counted.
+	nfc, nfd int
+	// Groups of names that only differ in their normalization
+	conflicts int
+}
+
+// scanNormalizationTree decrypts the names in CIPHERDIR and scans them with
+// scanNormalization.
+func scanNormalizationTree(args *argContainer, report func(dir string, names []string)) (normalizationStats, error) {
+	raw, rootNode, wipeKeys := initRawFS(args)
+	defer wipeKeys()
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		defer x.AfterUnmount()
+	}
+	return scanNormalization(context.Background(), rawfs.New(raw, true), report)
+}
+
+// scanNormalization walks "src" and calls "report" for each group of names
+// in the same directory that only differ in their normalization.
+func scanNormalization(ctx context.Context, src *rawfs.FS, report func(dir string, names []string)) (st normalizationStats, err error) {
+	dirs := make(map[string][]string)
+	err = walkRawFS(ctx, src, "", func(name string, fi os.FileInfo) error {
+		dir := path.Dir(name)
+		dirs[dir] = append(dirs[dir], fi.Name())
+		switch nametransform.NormalizationOf(fi.Name()) {
+		case nametransform.NormalizeNFC:
+			st.nfc++
+		case nametransform.NormalizeNFD:
+			st.nfd++
+		}
+		return nil
+	})
+	if err != nil {
+		return st, err
+	}
+	sorted := make([]string, 0, len(dirs))
+	for dir := range dirs {
+		sorted = append(sorted, dir)
+	}
+	sort.Strings(sorted)
+	for _, dir := range sorted {
+		for _, names := range nametransform.NormalizationConflicts(dirs[dir]) {
+			report(dir, names)
+			st.conflicts++
+		}
+	}
+	return st, nil
+}
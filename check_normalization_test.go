@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+)
+
+func TestScanNormalization(t *testing.T) {
+	src := t.TempDir()
+	// "é" composed (NFC) and decomposed (NFD)
+	names := []string{"caf\u00e9", "d/caf\u00e9", "d/cafe\u0301", "d/plain"}
+	for _, n := range names {
+		p := filepath.Join(src, n)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := fs.NewLoopbackRoot(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []string
+	st, err := scanNormalization(context.Background(), rawfs.New(fs.NewNodeFS(root, &fs.Options{}), true),
+		func(dir string, names []string) {
+			reported = append(reported, dir)
+			if len(names) != 2 {
+				t.Errorf("%s: names=%q", dir, names)
+			}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.nfc != 2 || st.nfd != 1 || st.conflicts != 1 {
+		t.Errorf("have %+v", st)
+	}
+	if len(reported) != 1 || reported[0] != "d" {
+		t.Errorf("reported %q", reported)
+	}
+}
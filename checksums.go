@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/checksums"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// checksumSHA256 makes unkeyed manifests that anybody can check
+	checksumSHA256 = "sha256"
+	// checksumHMAC makes keyed manifests that need the password
+	checksumHMAC = "hmac"
+)
+
+// checksumKey asks for the password and returns the key for keyed
+// manifests
+func checksumKey(args *argContainer) []byte {
+	masterkey, _, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	key := cryptocore.DeriveKey(masterkey, cryptocore.KeyChecksumHMAC)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	return key
+}
+
+// exportChecksums implements "-export-checksums FILE CIPHERDIR". It writes
+// a manifest with the checksum of every ciphertext file, which checks a
+// backup of CIPHERDIR without the password (-checksum-type sha256), or
+// detects deliberate changes with it (-checksum-type hmac).
+// Does not return (calls os.Exit both on success and on error).
+func exportChecksums(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-export-checksums cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	var key []byte
+	if args.checksum_type == checksumHMAC {
+		key = checksumKey(args)
+	}
+	out := os.Stdout
+	var dst, tmp string
+	if args.export_checksums == "-" {
+		// The manifest goes to stdout
+		tlog.Info.Enabled = false
+	} else {
+		dst, _ = filepath.Abs(args.export_checksums)
+		if rel, err := filepath.Rel(args.cipherdir, dst); err == nil && !strings.HasPrefix(rel, "..") {
+			tlog.Fatal.Printf("-export-checksums: %s is inside CIPHERDIR", args.export_checksums)
+			os.Exit(exitcodes.Usage)
+		}
+		tmp = dst + ".tmp"
+		var err error
+		out, err = os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			tlog.Fatal.Printf("-export-checksums: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+	}
+	tlog.Info.Printf("Writing checksums of %q. The filesystem should not be mounted while this runs.", args.cipherdir)
+	w := bufio.NewWriter(out)
+	stats, err := checksums.Write(w, args.cipherdir, key)
+	if err == nil {
+		err = w.Flush()
+	}
+	if tmp != "" {
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+		if err == nil {
+			err = os.Rename(tmp, dst)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-export-checksums: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Wrote %s checksums of %d files (%d bytes)."+tlog.ColorReset,
+		args.checksum_type, stats.Files, stats.Bytes)
+	os.Exit(0)
+}
+
+// verifyChecksums implements "-verify-checksums FILE DIR". It checks DIR,
+// usually a backup of CIPHERDIR, against the manifest FILE and lists the
+// files that have changed, are missing or are new. Keyed manifests need the
+// password. "-checksum-type hmac" insists on a keyed manifest, so that
+// replacing it by an unkeyed one is noticed.
+// Does not return (calls os.Exit both on success and on error).
+func verifyChecksums(args *argContainer) {
+	data, err := os.ReadFile(args.verify_checksums)
+	if err != nil {
+		tlog.Fatal.Printf("-verify-checksums: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	var key []byte
+	if args.checksum_type == checksumHMAC || checksums.IsKeyed(data) {
+		key = checksumKey(args)
+	}
+	res, err := checksums.Verify(data, args.cipherdir, key)
+	for i := range key {
+		key[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-verify-checksums: %v", err)
+		os.Exit(exitcodes.VerifyFailed)
+	}
+	for _, l := range []struct {
+		label string
+		paths []string
+	}{
+		{"CHANGED", res.Changed},
+		{"MISSING", res.Missing},
+		{"NEW", res.Added},
+	} {
+		for _, p := range l.paths {
+			fmt.Printf("%-7s %s\n", l.label, p)
+		}
+	}
+	if !res.Intact() {
+		tlog.Info.Printf(tlog.ColorRed+"%d files changed, %d missing, %d new; %d files are intact."+tlog.ColorReset,
+			len(res.Changed), len(res.Missing), len(res.Added), res.Files)
+		os.Exit(exitcodes.VerifyFailed)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"All %d files (%d bytes) match the manifest."+tlog.ColorReset, res.Files, res.Bytes)
+	os.Exit(0)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// errCipherdirInUse is returned by lockCipherdir if another process holds a
+// conflicting lock on CIPHERDIR.
+var errCipherdirInUse = errors.New("CIPHERDIR is in use by another gocryptfs process")
+
+// lockCipherdir takes a flock(2) lock on the CIPHERDIR directory. Mounts
+// and other operations that go through the FUSE frontend take a shared
+// lock, operations that must be alone on CIPHERDIR, like "-shred" and
+// "-gc", an exclusive one. Does not wait, but fails with
+// errCipherdirInUse. The lock is held until "unlock" is called or the
+// process exits.
+func lockCipherdir(cipherdir string, exclusive bool) (unlock func(), err error) {
+	d, err := os.Open(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(d.Fd()), how|syscall.LOCK_NB)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err == syscall.EWOULDBLOCK {
+		d.Close()
+		return nil, errCipherdirInUse
+	} else if err != nil {
+		d.Close()
+		return nil, err
+	}
+	return func() { d.Close() }, nil
+}
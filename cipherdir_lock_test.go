@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLockCipherdir(t *testing.T) {
+	dir := t.TempDir()
+	unlock1, err := lockCipherdir(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlock2, err := lockCipherdir(dir, false)
+	if err != nil {
+		t.Fatalf("second shared lock: %v", err)
+	}
+	if _, err = lockCipherdir(dir, true); err != errCipherdirInUse {
+		t.Errorf("exclusive lock while shared: have %v, want errCipherdirInUse", err)
+	}
+	unlock1()
+	unlock2()
+	unlockEx, err := lockCipherdir(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = lockCipherdir(dir, false); err != errCipherdirInUse {
+		t.Errorf("shared lock while exclusive: have %v, want errCipherdirInUse", err)
+	}
+	unlockEx()
+	if _, err = lockCipherdir(dir+"/missing", false); err == nil {
+		t.Error("locking a missing directory succeeded")
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -18,11 +20,20 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/cpudetection"
+	"github.com/rfjakob/gocryptfs/v2/internal/crashreport"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
+	"github.com/rfjakob/gocryptfs/v2/internal/speed"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/workpool"
 )
 
 // argContainer stores the parsed CLI options and arguments
@@ -35,22 +46,127 @@ type argContainer struct {
 	xchacha, argon2id, scrypt, cpu_aware, filename_auth, no_filename_auth bool
 	blocksize                   int
 	writeback_cache, async_read bool
+	no_seccomp, seccomp_strict  bool
+	no_landlock                 bool
+	privsep, keyholder          bool
+	migrate_filenameauth        bool
+	upgrade_config              bool
+	check_names                 bool
+	check_normalization         bool
+	doctor                      bool
+	// -info output as JSON
+	json bool
+	// -init asks questions instead of using flags
+	wizard       bool
+	dir_manifest bool
+	// -upstream-compat: stay mountable by upstream gocryptfs v2.x
+	upstream_compat             bool
+	xattr_auth                  bool
+	auth_times, restore_times   bool
+	auth_links                  bool
+	header_v3                   bool
+	long_symlinks               bool
+	join_chunks                 bool
+	dedup                       bool
+	gc, dry_run                 bool
+	reverse_rw                  bool
+	case_insensitive, case_fold bool
+	nfc, nfd                    bool
+	stable_inodes               bool
+	supervise                   bool
+	watch_cipherdir             bool
+	// -daemon manages the vaults in a PROFILES file
+	daemon bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache, acl bool
+	encrypt_acl                                                       bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace, context string
+	memprofile, ko, ctlsock, fsname, force_owner, trace, context, run_as string
 	// FIDO2
 	fido2                string
 	fido2_assert_options []string
-	// -extpass, -badname, -passfile can be passed multiple times
-	extpass, badname, passfile []string
+	// -extpass, -badname, -passfile, -forbid-name, -key-escrow can be passed
+	// multiple times
+	extpass, badname, passfile, forbid_name, key_escrow []string
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
 	exclude, excludeWildcard, excludeFrom []string
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// Chunk size in MiB for reverse mode
+	chunk_size int
+	// Number of decrypted names to cache
+	namecache_size int
+	// -buffer-arena: number of preallocated ciphertext request buffers
+	buffer_arena int
+	// macOS mount backend: "macfuse" or "fskit"
+	macos_backend string
+	// -serve-webdav listen address and its options
+	serve_webdav, webdav_user, webdav_passfile, webdav_tls_cert, webdav_tls_key string
+	// -serve-9p listen address
+	serve_9p string
+	// -import source type ("encfs", "cryfs" or "fscrypt") and password file
+	import_type, import_passfile string
+	// -export-fscrypt target directory, and the fscrypt key file for it and
+	// for "-import fscrypt"
+	export_fscrypt, fscrypt_key string
+	// -export archive file
+	export         string
+	verify_archive bool
+	// -export-checksums and -verify-checksums manifest files, and
+	// -checksum-type ("sha256" or "hmac")
+	export_checksums, verify_checksums, checksum_type string
+	// -selftest-vectors action, "generate" or "verify"
+	selftest_vectors string
+	// -metrics-addr listen address of the Prometheus exporter
+	metrics_addr string
+	// Snapshot names for -snapshot and -from-snapshot
+	snapshot, from_snapshot string
+	// Number of snapshots -prune-snapshots keeps
+	prune_snapshots int
+	// -shred plaintext path
+	shred string
+	// -share plaintext path, output file, recipient public key and
+	// password file
+	share, share_out, share_to, share_passfile string
+	// -trash retention period, like "7d"
+	trash string
+	// -scrub interval, like "7d"
+	scrub string
+	// -scrub-bw: scrubber bandwidth limit in MiB/s
+	scrub_bw int
+	// -access-policy file
+	access_policy string
+	// -io-engine
+	io_engine string
+	// -direct-io policy
+	direct_io string
+	// -statfs reporting, "raw" or "adjusted"
+	statfs string
+	// -verify-on-mount, "quick" or "full"
+	verify_on_mount string
+	// Parallel crypto tuning
+	crypto_workers, crypto_parallel_threshold int
+	no_parallel_crypto                        bool
+	// -on-corruption action and the number of failures that trigger it
+	on_corruption    string
+	corruption_limit int
+	// -cipher: AES-GCM implementation, "auto" or "optimized"
+	cipher string
+	// -nonce-prefetch: "static", "adaptive" or a buffer size in bytes
+	nonce_prefetch string
+	// -speed output format and benchmark selection
+	format, run string
+	// -op-workers
+	op_workers string
+	// -xattr-allow and -xattr-deny pattern lists
+	xattr_allow, xattr_deny string
 	// Idle time before autounmount
 	idle time.Duration
+	// -negative-timeout
+	negative_timeout time.Duration
+	// -adaptive-timeout
+	adaptive_timeout time.Duration
 	// -longnamemax (hash encrypted names that are longer than this)
 	longnamemax uint8
 	// Helper variables that are NOT cli options all start with an underscore
@@ -58,10 +174,54 @@ type argContainer struct {
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlsockSrv serves _ctlsockFd after the filesystem has been set up
+	_ctlsockSrv *ctlsocksrv.Server
+	// -ctlsock-max-conns and -ctlsock-timeout
+	ctlsock_max_conns int
+	ctlsock_timeout   time.Duration
+	// -log-format, -log-target, -log-level, -logfile and -logfile-max-size
+	log_format, log_target, log_level, logfile string
+	logfile_max_size                           int
+	// -crash-dir
+	crash_dir string
+	// -duress-passwd and -duress-remove
+	duress_passwd, duress_remove bool
+	// -throttle
+	throttle string
+	// _throttle is the parsed "-throttle" setting, nil for "off"
+	_throttle *configfile.ThrottleParams
+	// _crash catches the panics of the FUSE request handlers
+	_crash *crashreport.Handler
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _runAs is, if non-nil, the looked-up "-run-as" user
+	_runAs *runAsUser
+	// _trash is the parsed "-trash" retention period
+	_trash time.Duration
+	// _scrub is the parsed "-scrub" interval
+	_scrub time.Duration
+	// _negativeTimeoutSet is true when the user passed "-negative-timeout"
+	_negativeTimeoutSet bool
+	// _accessPolicy is the loaded "-access-policy" file
+	_accessPolicy *accesspolicy.Policy
+	// _normalization is the form selected by "-nfc" or "-nfd"
+	_normalization nametransform.Normalization
+	// _opWorkers is the parsed "-op-workers" list
+	_opWorkers map[string]int
+	// _xattrAllow and _xattrDeny are the parsed "-xattr-allow" and
+	// "-xattr-deny" patterns
+	_xattrAllow, _xattrDeny []string
+	// _noncePrefetchSize is the buffer size from "-nonce-prefetch SIZE"
+	_noncePrefetchSize int
+	// _importSrc is the absolute path of the "-import" source volume
+	_importSrc string
+	// _run is the compiled "-run" regular expression
+	_run *regexp.Regexp
+	// _password is the password a "-daemon" client has sent with the
+	// mount request
+	_password []byte
 }
 
 var flagSet *flag.FlagSet
@@ -165,6 +325,9 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	// Tri-state true/false/auto
 	flagSet.StringVar(&opensslAuto, "openssl", "auto", "Use OpenSSL instead of built-in Go crypto")
 	flagSet.BoolVar(&args.passwd, "passwd", false, "Change password")
+	flagSet.BoolVar(&args.duress_passwd, "duress-passwd", false, "Set a duress password that destroys the master key when it is entered")
+	flagSet.BoolVar(&args.duress_remove, "duress-remove", false, "Remove the duress password")
+	flagSet.StringVar(&args.throttle, "throttle", "", "Rate-limit unlock attempts, best-effort: on, off, or ATTEMPTS/DURATION to also lock out")
 	flagSet.BoolVar(&args.fg, "f", false, "")
 	flagSet.BoolVar(&args.fg, "fg", false, "Stay in the foreground")
 	flagSet.BoolVar(&args.version, "version", false, "Print version and exit")
@@ -187,8 +350,41 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.json, "json", false, "Print the -info or -gc output as JSON")
+	flagSet.BoolVar(&args.wizard, "wizard", false, "Ask for the -init settings interactively")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.migrate_filenameauth, "migrate-filenameauth", false,
+		"Enable filename authentication on CIPHERDIR, or convert it to the new format")
+	flagSet.BoolVar(&args.upgrade_config, "upgrade-config", false,
+		"Upgrade the config file of CIPHERDIR to the current format version")
+	flagSet.BoolVar(&args.check_names, "check-names", false,
+		"Show how long plaintext names can be in CIPHERDIR, and list the names in an optional TREE that are too long")
+	flagSet.BoolVar(&args.check_normalization, "check-normalization", false,
+		"List the names in CIPHERDIR that only differ in their Unicode normalization")
+	flagSet.BoolVar(&args.doctor, "doctor", false,
+		"Check the system, the config file and the directory tree of CIPHERDIR, and print a report")
+	flagSet.BoolVar(&args.join_chunks, "join-chunks", false, "Join the chunk files created by -chunk-size in CIPHERDIR")
+	flagSet.BoolVar(&args.dedup, "dedup", false, "Deduplicate the file contents in CIPHERDIR and collect garbage")
+	flagSet.BoolVar(&args.gc, "gc", false, "Remove orphaned and temporary files from CIPHERDIR")
+	flagSet.BoolVar(&args.dry_run, "dry-run", false, "Only list what -gc would remove")
+	flagSet.StringVar(&args.snapshot, "snapshot", "", "Create a snapshot of CIPHERDIR with this name")
+	flagSet.StringVar(&args.from_snapshot, "from-snapshot", "", "Use the snapshot with this name, read-only")
+	flagSet.IntVar(&args.prune_snapshots, "prune-snapshots", -1, "Delete all but this many of the newest snapshots of CIPHERDIR")
+	flagSet.StringVar(&args.share, "share", "", "Export this file with its own key, for gocryptfs-share")
+	flagSet.StringVar(&args.share_out, "share-out", "", "Write the file exported by -share here, and its token to FILE.token")
+	flagSet.StringVar(&args.share_to, "share-to", "", "Wrap the -share key for this public key of gocryptfs-share -keygen, instead of a password")
+	flagSet.StringVar(&args.share_passfile, "share-passfile", "", "Read the password for the -share recipient from this file")
+	flagSet.StringVar(&args.shred, "shred", "", "Destroy the data key of this file and delete it (needs -header-v3)")
+	flagSet.BoolVar(&args.reverse_rw, "reverse-rw", false, "Allow writes to the encrypted view of a reverse mount")
+	flagSet.BoolVar(&args.case_insensitive, "case-insensitive", false, "Ignore case when looking up names, preserve it for new names")
+	flagSet.BoolVar(&args.case_fold, "case-fold", false, "Ignore case when looking up names, create new names in lower case")
+	flagSet.BoolVar(&args.nfc, "nfc", false, "Convert names to Unicode NFC (composed, like Linux) when looking them up or creating them")
+	flagSet.BoolVar(&args.nfd, "nfd", false, "Convert names to Unicode NFD (decomposed, like macOS) when looking them up or creating them")
+	flagSet.BoolVar(&args.supervise, "supervise", false, "Pause the mount while CIPHERDIR is unavailable and resume when it is back")
+	flagSet.BoolVar(&args.watch_cipherdir, "watch-cipherdir", false, "Watch CIPHERDIR for changes made by other programs and drop them from the kernel cache")
+	flagSet.BoolVar(&args.stable_inodes, "stable-inodes", false, "Derive inode numbers from backing file handles, for re-exporting over NFS or Samba")
+	flagSet.BoolVar(&args.daemon, "daemon", false, "Mount and unmount the vaults in PROFILES as requested on the -ctlsock control socket")
 	flagSet.BoolVar(&args.one_file_system, "one-file-system", false, "Don't cross filesystem boundaries")
 	flagSet.BoolVar(&args.deterministic_names, "deterministic-names", false, "Disable diriv file name randomisation")
 	flagSet.BoolVar(&args.xchacha, "xchacha", false, "Use XChaCha20-Poly1305 file content encryption")
@@ -197,9 +393,22 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.cpu_aware, "cpu-aware", false, "Automatically select encryption backend based on CPU capabilities")
 	flagSet.BoolVar(&args.filename_auth, "filename-auth", true, "Enable filename authentication with MAC to detect tampering (default: enabled)")
 	flagSet.BoolVar(&args.no_filename_auth, "no-filename-auth", false, "Disable filename authentication (overrides --filename-auth)")
+	flagSet.BoolVar(&args.upstream_compat, "upstream-compat", false, "Create, or only accept, filesystems that upstream gocryptfs v2.x can mount")
+	flagSet.BoolVar(&args.dir_manifest, "dir-manifest", false, "Keep an authenticated list of entries in each directory (with -init)")
+	flagSet.BoolVar(&args.xattr_auth, "xattr-auth", false, "Bind encrypted xattr values to their file (with -init)")
+	flagSet.BoolVar(&args.long_symlinks, "long-symlinks", false, "Store symlink targets that are too long once encrypted in a separate file (with -init)")
+	flagSet.BoolVar(&args.auth_times, "auth-times", false, "Keep an authenticated copy of the mtime of each file (with -init, implies -xattr-auth)")
+	flagSet.BoolVar(&args.auth_links, "auth-links", false, "Keep an authenticated link count of each file (with -init, implies -xattr-auth), or keep hard links in -reverse mode")
+	flagSet.BoolVar(&args.restore_times, "restore-times", false, "Restore mtimes that were changed behind our back from the authenticated copy")
+	flagSet.BoolVar(&args.header_v3, "header-v3", false, "Give new files version 3 headers with a per-file data key (with -init)")
 	flagSet.IntVar(&args.blocksize, "blocksize", 4096, "Block size in bytes (4096, 16384, 32768, 65536)")
-	flagSet.BoolVar(&args.writeback_cache, "writeback-cache", false, "Enable FUSE writeback cache for better write performance")
+	flagSet.BoolVar(&args.writeback_cache, "writeback-cache", false, "Ignored, the FUSE writeback cache is not supported")
 	flagSet.BoolVar(&args.async_read, "async-read", false, "Enable FUSE async read for better read performance")
+	flagSet.BoolVar(&args.no_seccomp, "no-seccomp", false, "Do not restrict the daemon to an allowlist of syscalls after mounting")
+	flagSet.BoolVar(&args.no_landlock, "no-landlock", false, "Do not confine the daemon to CIPHERDIR, the mountpoint, the control socket and the config file using Landlock")
+	flagSet.BoolVar(&args.privsep, "privsep", false, "Keep the encryption keys in a separate key-holder process")
+	flagSet.BoolVar(&args.keyholder, "keyholder", false, "Run as the key-holder process on fd 3 - used internally for -privsep")
+	flagSet.BoolVar(&args.seccomp_strict, "seccomp-strict", false, "Kill the daemon on syscalls outside the allowlist (like ptrace) instead of failing them with EPERM")
 
 	// Mount options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -212,18 +421,39 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
 	flagSet.BoolVar(&args.kernel_cache, "kernel_cache", false, "Enable the FUSE kernel_cache option")
 	flagSet.BoolVar(&args.acl, "acl", false, "Enforce ACLs")
+	flagSet.BoolVar(&args.encrypt_acl, "encrypt-acl", false, "Encrypt ACLs and security.capability like other xattrs. Implies -acl")
+	flagSet.StringVar(&args.xattr_allow, "xattr-allow", "", "Only allow these xattrs, like \"user.*,security.selinux\"; takes precedence over -xattr-deny")
+	flagSet.StringVar(&args.xattr_deny, "xattr-deny", "", "Block these xattrs, like \"user.*\"")
 
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
 	flagSet.StringVar(&args.memprofile, "memprofile", "", "Write memory profile to specified file")
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
-	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path, abstract socket @NAME, or systemd[:NAME]")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
+	flagSet.StringVar(&args.run_as, "run-as", "", "Switch to this user after mounting (requires root)")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
-	flagSet.StringVar(&args.context, "context", "", "Set SELinux context (see mount(8) for details)")
+	flagSet.StringVar(&args.context, "context", "", "Set SELinux context (see mount(8) for details), or \"mountpoint\" for the label of MOUNTPOINT")
+	flagSet.StringVar(&args.serve_webdav, "serve-webdav", "", "Serve the filesystem over WebDAV on this address instead of mounting it")
+	flagSet.StringVar(&args.webdav_user, "webdav-user", "", "Require HTTP basic authentication with this user name for -serve-webdav")
+	flagSet.StringVar(&args.webdav_passfile, "webdav-passfile", "", "Read the password for -webdav-user from this file")
+	flagSet.StringVar(&args.webdav_tls_cert, "webdav-tls-cert", "", "Serve HTTPS using this certificate file")
+	flagSet.StringVar(&args.webdav_tls_key, "webdav-tls-key", "", "Private key file for -webdav-tls-cert")
+	flagSet.StringVar(&args.import_type, "import", "", "Import an EncFS, CryFS or fscrypt volume, or an -export archive: -import encfs|cryfs|fscrypt|archive SRC CIPHERDIR")
+	flagSet.StringVar(&args.export, "export", "", "Pack CIPHERDIR into this archive file, \"-\" for stdout")
+	flagSet.BoolVar(&args.verify_archive, "verify-archive", false, "Check the -export archive FILE without the password: -verify-archive FILE")
+	flagSet.StringVar(&args.export_checksums, "export-checksums", "", "Write the checksums of all ciphertext files to this manifest file, \"-\" for stdout")
+	flagSet.StringVar(&args.verify_checksums, "verify-checksums", "", "Check CIPHERDIR, or a backup of it, against this -export-checksums manifest")
+	flagSet.StringVar(&args.checksum_type, "checksum-type", checksumSHA256, "Checksums for -export-checksums: sha256 (no password needed to verify) or hmac (keyed)")
+	flagSet.StringVar(&args.selftest_vectors, "selftest-vectors", "", "Write known-answer test vectors to FILE, or check this build against them: -selftest-vectors generate|verify FILE")
+	flagSet.StringVar(&args.import_passfile, "import-passfile", "", "Read the password of the -import source volume from this file")
+	flagSet.StringVar(&args.export_fscrypt, "export-fscrypt", "", "Copy the filesystem into this directory, encrypted with fscrypt")
+	flagSet.StringVar(&args.fscrypt_key, "fscrypt-key", "", "Raw 64-byte fscrypt key file for -export-fscrypt and -import fscrypt")
+	flagSet.StringVar(&args.serve_9p, "serve-9p", "", "Serve the filesystem over 9P2000.L on this address or unix socket instead of mounting it")
+	flagSet.StringVar(&args.macos_backend, "macos-backend", "macfuse", "macOS mount backend: macfuse or fskit")
 	flagSet.StringArrayVar(&args.fido2_assert_options, "fido2-assert-option", nil, "Options to be passed with `fido2-assert -t`")
 
 	// Exclusion options
@@ -231,21 +461,60 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.StringArrayVar(&args.exclude, "exclude", nil, "Exclude relative path from reverse view")
 	flagSet.StringArrayVar(&args.excludeWildcard, "ew", nil, "Alias for -exclude-wildcard")
 	flagSet.StringArrayVar(&args.excludeWildcard, "exclude-wildcard", nil, "Exclude path from reverse view, supporting wildcards")
-	flagSet.StringArrayVar(&args.excludeFrom, "exclude-from", nil, "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.StringArrayVar(&args.excludeFrom, "exclude-from", nil, "File from which to read exclusion patterns (with -exclude-wildcard syntax). Re-read on SIGHUP")
 
 	// multipleStrings options ([]string)
 	flagSet.StringArrayVar(&args.extpass, "extpass", nil, "Use external program for the password prompt")
 	flagSet.StringArrayVar(&args.badname, "badname", nil, "Glob pattern invalid file names that should be shown")
 	flagSet.StringArrayVar(&args.passfile, "passfile", nil, "Read password from file")
+	flagSet.StringArrayVar(&args.forbid_name, "forbid-name", nil, "Glob pattern of file names that cannot be created")
+	flagSet.StringArrayVar(&args.key_escrow, "key-escrow", nil, "Encrypt a copy of the master key to this age public key or OpenPGP key file (with -init)")
 
 	flagSet.Uint8Var(&args.longnamemax, "longnamemax", 255, "Hash encrypted names that are longer than this")
 
+	flagSet.IntVar(&args.chunk_size, "chunk-size", 0, "Split files into chunks of this many MiB (reverse mode only)")
+	flagSet.IntVar(&args.namecache_size, "namecache-size", nametransform.DefaultNameCacheSize,
+		"Cache this many decrypted file names for directory listings. 0 disables the cache")
+	flagSet.IntVar(&args.buffer_arena, "buffer-arena", 0, "Preallocate this many ciphertext request buffers in a "+
+		"locked, huge-page-backed arena. 0 disables the arena")
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
 	const scryptn = "scryptn"
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 
+	flagSet.StringVar(&args.trash, "trash", "", "Move deleted files to the trash and purge them after this time, like \"7d\"")
+	flagSet.StringVar(&args.scrub, "scrub", "", "Check all of CIPHERDIR for damage in the background, with this much time between the passes, like \"7d\"")
+	flagSet.IntVar(&args.scrub_bw, "scrub-bw", 8, "Read at most this many MiB/s for -scrub. 0 means no limit")
+	flagSet.StringVar(&args.access_policy, "access-policy", "", "Restrict access to plaintext paths by UID and GID as specified in this file")
+	flagSet.StringVar(&args.op_workers, "op-workers", "", "Serve expensive operations by this many workers each, like \"read=4,fsync=1,listxattr=2\"")
+	flagSet.StringVar(&args.metrics_addr, "metrics-addr", "", "Serve runtime statistics for Prometheus at http://ADDR/metrics")
+	flagSet.StringVar(&args.cipher, "cipher", "auto", "AES-GCM implementation: \"auto\" (see -openssl) or \"optimized\"")
+	flagSet.StringVar(&args.nonce_prefetch, "nonce-prefetch", "static", "How to prefetch random nonces: \"static\", \"adaptive\" or a buffer size in bytes")
+	flagSet.StringVar(&args.format, "format", speed.FormatText, "Output format of -speed: \"text\", \"json\" or \"csv\"")
+	flagSet.StringVar(&args.run, "run", "", "Only run the -speed benchmarks whose name matches this regular expression")
+	flagSet.StringVar(&args.io_engine, "io-engine", "pread", "How to read and write CIPHERDIR: \"pread\" or the experimental \"uring\"")
+	flagSet.StringVar(&args.direct_io, "direct-io", "auto", "When to bypass the page cache: \"always\", \"never\" or \"auto\" (for O_DIRECT opens)")
+	flagSet.StringVar(&args.verify_on_mount, "verify-on-mount", "", "Check CIPHERDIR for damage before mounting: \"quick\" (a sample of the files) or \"full\"")
+	flagSet.StringVar(&args.statfs, "statfs", "adjusted", "How to report free space: \"adjusted\" (plaintext bytes) or \"raw\" (as in CIPHERDIR)")
+	flagSet.IntVar(&args.crypto_workers, "crypto-workers", 0, "Encrypt and decrypt with at most this many parallel workers. 0 means depending on the number of CPUs")
+	flagSet.IntVar(&args.crypto_parallel_threshold, "crypto-parallel-threshold", parallelcrypto.ParallelThreshold, "Minimum number of blocks that are encrypted or decrypted in parallel")
+	flagSet.BoolVar(&args.no_parallel_crypto, "no-parallel-crypto", false, "Encrypt and decrypt on the goroutine that serves the request")
+	flagSet.StringVar(&args.on_corruption, "on-corruption", "continue", "What to do after -corruption-limit integrity failures: \"continue\", \"ro\" or \"unmount\"")
+	flagSet.IntVar(&args.corruption_limit, "corruption-limit", 3, "Number of integrity failures that trigger -on-corruption")
+	flagSet.IntVar(&args.ctlsock_max_conns, "ctlsock-max-conns", ctlsocksrv.DefaultMaxConns, "Maximum number of concurrent -ctlsock connections")
+	flagSet.DurationVar(&args.ctlsock_timeout, "ctlsock-timeout", ctlsocksrv.DefaultRequestTimeout, "How long a -ctlsock request may take, like \"30s\"")
+	flagSet.StringVar(&args.log_format, "log-format", "text", "Log message format: \"text\" or \"json\"")
+	flagSet.StringVar(&args.log_target, "log-target", logTargetAuto, "Where log messages go: \"auto\", \"console\", \"syslog\" or \"journald\"")
+	flagSet.StringVar(&args.log_level, "log-level", "", "Log levels per subsystem, like \"fusefrontend=debug,default=warn\"")
+	flagSet.StringVar(&args.logfile, "logfile", "", "Write log messages to this file")
+	flagSet.IntVar(&args.logfile_max_size, "logfile-max-size", 10, "Rotate -logfile when it reaches this size in MiB. 0 disables rotation")
+	flagSet.StringVar(&args.crash_dir, "crash-dir", os.TempDir(), "Write a report to this directory when a request handler crashes")
+	const negativeTimeout = "negative-timeout"
+	flagSet.DurationVar(&args.negative_timeout, negativeTimeout, 0, "Cache failed lookups for this long, like \"5s\". 0 disables caching. "+
+		"Default: the kernel caches them for 1s")
+	flagSet.DurationVar(&args.adaptive_timeout, "adaptive-timeout", 0, "Let the kernel cache entries of quiet directories for up to this long, "+
+		"and not at all for directories that just changed. 0 means a fixed 1s")
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
@@ -275,6 +544,10 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	if isFlagPassed(flagSet, scryptn) {
 		args._explicitScryptn = true
 	}
+	// Without -negative-timeout, the kernel default applies
+	if isFlagPassed(flagSet, negativeTimeout) {
+		args._negativeTimeoutSet = true
+	}
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		if args.xchacha {
@@ -336,12 +609,168 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	if args.no_filename_auth {
 		args.filename_auth = false
 	}
+	if args.dir_manifest && (!args.filename_auth || args.plaintextnames || args.deterministic_names || args.reverse) {
+		tlog.Fatal.Printf("-dir-manifest cannot be combined with -no-filename-auth, -plaintextnames, -deterministic-names or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.auth_times || args.auth_links && !args.reverse {
+		args.xattr_auth = true
+	}
+	if args.xattr_auth && (args.plaintextnames || args.deterministic_names || args.reverse) {
+		tlog.Fatal.Printf("-xattr-auth cannot be combined with -plaintextnames, -deterministic-names or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.header_v3 && args.reverse {
+		tlog.Fatal.Printf("-header-v3 cannot be combined with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.long_symlinks && (args.plaintextnames || args.reverse) {
+		tlog.Fatal.Printf("-long-symlinks cannot be combined with -plaintextnames or -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.namecache_size < 0 {
+		tlog.Fatal.Printf("-namecache-size: value %d is negative", args.namecache_size)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.chunk_size < 0 {
+		tlog.Fatal.Printf("-chunk-size: value %d is negative", args.chunk_size)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.chunk_size > 0 && (!args.reverse || args.plaintextnames) {
+		tlog.Fatal.Printf("-chunk-size only works in reverse mode and cannot be combined with -plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse_rw && (!args.reverse || args.chunk_size > 0 || args.ro) {
+		tlog.Fatal.Printf("-reverse-rw needs -reverse and cannot be combined with -chunk-size or -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.webdav_user == "") != (args.webdav_passfile == "") {
+		tlog.Fatal.Printf("-webdav-user and -webdav-passfile must be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.webdav_tls_cert == "") != (args.webdav_tls_key == "") {
+		tlog.Fatal.Printf("-webdav-tls-cert and -webdav-tls-key must be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.throttle != "" {
+		var err error
+		if args._throttle, err = parseThrottle(args.throttle); err != nil {
+			tlog.Fatal.Printf("-throttle: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.from_snapshot != "" && (args.reverse || args.init || args.passwd || args.duress_passwd || args.duress_remove || args.throttle != "" || args.migrate_filenameauth ||
+		args.upgrade_config || args.check_names || args.check_normalization || args.join_chunks || args.dedup || args.gc || args.snapshot != "" || args.prune_snapshots >= 0 || args.shred != "" || args.share != "") {
+		tlog.Fatal.Printf("-from-snapshot only works for mounting, -fsck, -info, -serve-webdav and -serve-9p")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.import_type != "" {
+		if _, ok := importSources[args.import_type]; !ok && args.import_type != importArchive {
+			tlog.Fatal.Printf("-import: unknown type %q, must be \"encfs\", \"cryfs\", \"fscrypt\" or \"archive\"", args.import_type)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse || args.ro || args.from_snapshot != "" {
+			tlog.Fatal.Printf("-import cannot be combined with -reverse, -ro or -from-snapshot")
+			os.Exit(exitcodes.Usage)
+		}
+	} else if args.import_passfile != "" {
+		tlog.Fatal.Printf("-import-passfile only works with -import")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.check_names && args.reverse {
+		tlog.Fatal.Printf("-check-names cannot be combined with -reverse, plaintext names are stored as they are")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.check_normalization && args.reverse {
+		tlog.Fatal.Printf("-check-normalization cannot be combined with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.export_fscrypt != "" && (args.reverse || args.from_snapshot != "") {
+		tlog.Fatal.Printf("-export-fscrypt cannot be combined with -reverse or -from-snapshot")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.export_fscrypt != "" || args.import_type == "fscrypt") != (args.fscrypt_key != "") {
+		tlog.Fatal.Printf("-export-fscrypt and -import fscrypt need -fscrypt-key, and -fscrypt-key only works with them")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.checksum_type != checksumSHA256 && args.checksum_type != checksumHMAC {
+		tlog.Fatal.Printf("-checksum-type: unknown type %q, must be \"sha256\" or \"hmac\"", args.checksum_type)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.checksum_type != checksumSHA256 && args.export_checksums == "" && args.verify_checksums == "" {
+		tlog.Fatal.Printf("-checksum-type only works with -export-checksums and -verify-checksums")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.serve_webdav == "" && (args.webdav_user != "" || args.webdav_tls_cert != "") {
+		tlog.Fatal.Printf("-webdav-* options only work with -serve-webdav")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.macos_backend {
+	case "macfuse", "fskit":
+	case "nfs":
+		tlog.Fatal.Printf("-macos-backend: nfs is not supported, go-fuse cannot talk to an NFS loopback backend like FUSE-T")
+		os.Exit(exitcodes.Usage)
+	default:
+		tlog.Fatal.Printf("-macos-backend: invalid value %q, must be macfuse or fskit", args.macos_backend)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.macos_backend != "macfuse" && runtime.GOOS != "darwin" {
+		tlog.Fatal.Printf("-macos-backend only works on macOS")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.encrypt_acl {
+		if args.reverse {
+			tlog.Fatal.Printf("-encrypt-acl cannot be combined with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		// The kernel only asks us for the ACLs if ACL support is enabled
+		args.acl = true
+	}
 
 	// Handle mutual exclusivity between --argon2id and --scrypt
 	if args.scrypt {
 		// If --scrypt is specified, disable argon2id
 		args.argon2id = false
 	}
+	if args.upstream_compat && args.init {
+		// Upstream only knows scrypt and unauthenticated names. Turn off
+		// these defaults, but refuse options that ask for fork features.
+		var fork []string
+		if isFlagPassed(flagSet, "argon2id") && args.argon2id {
+			fork = append(fork, "-argon2id")
+		}
+		if isFlagPassed(flagSet, "filename-auth") && args.filename_auth {
+			fork = append(fork, "-filename-auth")
+		}
+		if args.dir_manifest {
+			fork = append(fork, "-dir-manifest")
+		}
+		if args.auth_times {
+			fork = append(fork, "-auth-times")
+		}
+		if args.auth_links && !args.reverse {
+			fork = append(fork, "-auth-links")
+		}
+		if args.xattr_auth && !args.auth_times && !args.auth_links {
+			fork = append(fork, "-xattr-auth")
+		}
+		if args.long_symlinks {
+			fork = append(fork, "-long-symlinks")
+		}
+		if args.header_v3 {
+			fork = append(fork, "-header-v3")
+		}
+		if args.blocksize != 4096 {
+			fork = append(fork, "-blocksize")
+		}
+		if len(fork) > 0 {
+			tlog.Fatal.Printf("-upstream-compat: %s cannot be used, upstream gocryptfs does not support it",
+				strings.Join(fork, ", "))
+			os.Exit(exitcodes.Usage)
+		}
+		args.argon2id = false
+		args.filename_auth = false
+	}
 	if len(args.extpass) > 0 && len(args.passfile) != 0 {
 		tlog.Fatal.Printf("The options -extpass and -passfile cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
@@ -358,10 +787,204 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 		tlog.Fatal.Printf("The options -extpass and -fido2 cannot be used at the same time")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.io_engine != "pread" && args.io_engine != "uring" {
+		tlog.Fatal.Printf("-io-engine: unknown engine %q, must be \"pread\" or \"uring\"", args.io_engine)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.direct_io != "always" && args.direct_io != "never" && args.direct_io != "auto" {
+		tlog.Fatal.Printf("-direct-io: unknown policy %q, must be \"always\", \"never\" or \"auto\"", args.direct_io)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlsock_max_conns < 1 || args.ctlsock_timeout <= 0 {
+		tlog.Fatal.Printf("-ctlsock-max-conns must be at least 1, -ctlsock-timeout must be positive")
+		os.Exit(exitcodes.Usage)
+	}
+	if err := checkLogArgs(&args); err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.crypto_workers < 0 || args.crypto_parallel_threshold < 1 {
+		tlog.Fatal.Printf("-crypto-workers cannot be less than 0, -crypto-parallel-threshold cannot be less than 1")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.statfs != "adjusted" && args.statfs != "raw" {
+		tlog.Fatal.Printf("-statfs: unknown mode %q, must be \"adjusted\" or \"raw\"", args.statfs)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.verify_on_mount != "" {
+		if args.verify_on_mount != verifyQuick && args.verify_on_mount != verifyFull {
+			tlog.Fatal.Printf("-verify-on-mount: unknown mode %q, must be \"quick\" or \"full\"", args.verify_on_mount)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-verify-on-mount cannot be combined with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.cipher != "auto" && args.cipher != "optimized" {
+		tlog.Fatal.Printf("-cipher: unknown implementation %q, must be \"auto\" or \"optimized\"", args.cipher)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.format != speed.FormatText && args.format != speed.FormatJSON && args.format != speed.FormatCSV {
+		tlog.Fatal.Printf("-format: unknown format %q, must be \"text\", \"json\" or \"csv\"", args.format)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.selftest_vectors != "" && args.selftest_vectors != vectorsGenerate && args.selftest_vectors != vectorsVerify {
+		tlog.Fatal.Printf("-selftest-vectors: unknown action %q, must be \"generate\" or \"verify\"", args.selftest_vectors)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.json && !args.info && !args.gc {
+		tlog.Fatal.Printf("-json only works with -info and -gc")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dry_run && !args.gc {
+		tlog.Fatal.Printf("-dry-run only works with -gc")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.wizard && !args.init {
+		tlog.Fatal.Printf("-wizard only works with -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if len(args.key_escrow) > 0 && !args.init {
+		tlog.Fatal.Printf("-key-escrow only works with -init")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.run != "" {
+		// Case-insensitive, so "-run xchacha" finds "XChaCha20-Poly1305-Go"
+		if args._run, err = regexp.Compile("(?i)" + args.run); err != nil {
+			tlog.Fatal.Printf("-run: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.nonce_prefetch != "static" && args.nonce_prefetch != "adaptive" {
+		n, err := strconv.Atoi(args.nonce_prefetch)
+		if err != nil || n < cryptocore.MinPrefetchSize || n > cryptocore.MaxPrefetchSize {
+			tlog.Fatal.Printf("-nonce-prefetch: must be \"static\", \"adaptive\" or a size between %d and %d bytes, got %q",
+				cryptocore.MinPrefetchSize, cryptocore.MaxPrefetchSize, args.nonce_prefetch)
+			os.Exit(exitcodes.Usage)
+		}
+		args._noncePrefetchSize = n
+	}
 	if args.idle < 0 {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.buffer_arena < 0 {
+		tlog.Fatal.Printf("-buffer-arena cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.negative_timeout < 0 {
+		tlog.Fatal.Printf("-negative-timeout cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.adaptive_timeout < 0 {
+		tlog.Fatal.Printf("-adaptive-timeout cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.adaptive_timeout > 0 && args.sharedstorage {
+		tlog.Fatal.Printf("-adaptive-timeout cannot be used with -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.negative_timeout > 0 && (args.case_insensitive || args.case_fold || args.nfc || args.nfd) {
+		tlog.Fatal.Printf("-negative-timeout cannot be used with -case-insensitive, -case-fold, -nfc or -nfd")
+		os.Exit(exitcodes.Usage)
+	}
+	if args._opWorkers, err = workpool.ParseLimits(args.op_workers); err != nil {
+		tlog.Fatal.Printf("-op-workers: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args._xattrAllow, err = fusefrontend.ParseXattrPatterns(args.xattr_allow); err != nil {
+		tlog.Fatal.Printf("-xattr-allow: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if args._xattrDeny, err = fusefrontend.ParseXattrPatterns(args.xattr_deny); err != nil {
+		tlog.Fatal.Printf("-xattr-deny: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.xattr_allow != "" || args.xattr_deny != "") && args.reverse {
+		tlog.Fatal.Printf("-xattr-allow and -xattr-deny cannot be combined with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.trash != "" {
+		args._trash, err = parseRetention(args.trash)
+		if err != nil {
+			tlog.Fatal.Printf("-trash: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-trash cannot be used with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.scrub != "" {
+		args._scrub, err = parseRetention(args.scrub)
+		if err != nil {
+			tlog.Fatal.Printf("-scrub: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("-scrub cannot be used with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.scrub_bw < 0 {
+		tlog.Fatal.Printf("-scrub-bw cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.case_insensitive || args.case_fold) && args.reverse {
+		tlog.Fatal.Printf("-case-insensitive and -case-fold cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nfc && args.nfd {
+		tlog.Fatal.Printf("-nfc and -nfd cannot be used together")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.nfc {
+		args._normalization = nametransform.NormalizeNFC
+	} else if args.nfd {
+		args._normalization = nametransform.NormalizeNFD
+	}
+	if args._normalization != nametransform.NormalizeNone && args.reverse {
+		tlog.Fatal.Printf("-nfc and -nfd cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.stable_inodes && (args.reverse || args.sharedstorage) {
+		tlog.Fatal.Printf("-stable-inodes cannot be used with -reverse or -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.supervise && args.reverse {
+		tlog.Fatal.Printf("-supervise cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.watch_cipherdir && args.reverse {
+		tlog.Fatal.Printf("-watch-cipherdir cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.on_corruption {
+	case "continue", "ro", "unmount":
+	default:
+		tlog.Fatal.Printf("-on-corruption: unknown action %q, must be \"continue\", \"ro\" or \"unmount\"", args.on_corruption)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.corruption_limit < 1 {
+		tlog.Fatal.Printf("-corruption-limit must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.on_corruption != "continue" && args.reverse {
+		tlog.Fatal.Printf("-on-corruption cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.access_policy != "" {
+		if args.reverse {
+			tlog.Fatal.Printf("-access-policy cannot be used with -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		args._accessPolicy, err = accesspolicy.Load(args.access_policy)
+		if err != nil {
+			tlog.Fatal.Printf("-access-policy: %v", err)
+			os.Exit(exitcodes.AccessPolicy)
+		}
+	}
 	// Make sure all badname patterns are valid
 	for _, pattern := range args.badname {
 		_, err := filepath.Match(pattern, "")
@@ -370,6 +993,18 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	// Same for -forbid-name
+	for _, pattern := range args.forbid_name {
+		_, err := filepath.Match(pattern, "")
+		if err != nil || pattern == "" || strings.Contains(pattern, "/") {
+			tlog.Fatal.Printf("-forbid-name: invalid pattern %q supplied", pattern)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if len(args.forbid_name) > 0 && args.reverse {
+		tlog.Fatal.Printf("-forbid-name cannot be combined with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
 	if args.longnamemax > 0 && args.longnamemax < 62 {
 		tlog.Fatal.Printf("-longnamemax: value %d is outside allowed range 62 ... 255", args.longnamemax)
 		os.Exit(exitcodes.Usage)
@@ -378,6 +1013,28 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	return args
 }
 
+// parseRetention parses a duration like time.ParseDuration, but also
+// accepts whole days like "7d".
+func parseRetention(s string) (time.Duration, error) {
+	var d time.Duration
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseUint(strings.TrimSuffix(s, "d"), 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", s)
+	}
+	return d, nil
+}
+
 // prettyArgs pretty-prints the command-line arguments.
 func prettyArgs() string {
 	pa := fmt.Sprintf("%q", os.Args)
@@ -395,12 +1052,78 @@ func countOpFlags(args *argContainer) int {
 	if args.passwd {
 		count++
 	}
+	if args.duress_passwd {
+		count++
+	}
+	if args.duress_remove {
+		count++
+	}
+	if args.throttle != "" {
+		count++
+	}
 	if args.init {
 		count++
 	}
 	if args.fsck {
 		count++
 	}
+	if args.migrate_filenameauth {
+		count++
+	}
+	if args.upgrade_config {
+		count++
+	}
+	if args.check_names {
+		count++
+	}
+	if args.check_normalization {
+		count++
+	}
+	if args.doctor {
+		count++
+	}
+	if args.import_type != "" {
+		count++
+	}
+	if args.export_fscrypt != "" {
+		count++
+	}
+	if args.join_chunks {
+		count++
+	}
+	if args.dedup {
+		count++
+	}
+	if args.gc {
+		count++
+	}
+	if args.export != "" {
+		count++
+	}
+	if args.export_checksums != "" {
+		count++
+	}
+	if args.verify_checksums != "" {
+		count++
+	}
+	if args.snapshot != "" {
+		count++
+	}
+	if args.prune_snapshots >= 0 {
+		count++
+	}
+	if args.shred != "" {
+		count++
+	}
+	if args.share != "" {
+		count++
+	}
+	if args.serve_webdav != "" {
+		count++
+	}
+	if args.serve_9p != "" {
+		count++
+	}
 	return count
 }
 
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"os"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 )
 
@@ -122,6 +127,31 @@ func TestParseCliOpts(t *testing.T) {
 		hkdf:        true,
 		openssl:     stupidgcm.PreferOpenSSLAES256GCM(), // depends on CPU and build flags
 		scryptn:     17,
+		argon2id:    true,
+		blocksize:   4096,
+
+		filename_auth:             true,
+		macos_backend:             "macfuse",
+		prune_snapshots:           -1,
+		namecache_size:            nametransform.DefaultNameCacheSize,
+		cipher:                    "auto",
+		nonce_prefetch:            "static",
+		format:                    "text",
+		io_engine:                 "pread",
+		direct_io:                 "auto",
+		statfs:                    "adjusted",
+		crypto_parallel_threshold: parallelcrypto.ParallelThreshold,
+		on_corruption:             "continue",
+		corruption_limit:          3,
+		ctlsock_max_conns:         16,
+		ctlsock_timeout:           time.Minute,
+		log_format:                "text",
+		log_target:                logTargetAuto,
+		logfile_max_size:          10,
+		crash_dir:                 os.TempDir(),
+		scrub_bw:                  8,
+		checksum_type:             "sha256",
+		_opWorkers:                map[string]int{},
 	}
 
 	type testcaseContainer struct {
@@ -178,3 +208,52 @@ func TestParseCliOpts(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRetention(t *testing.T) {
+	testcases := []struct {
+		in   string
+		want time.Duration
+	}{
+		{"7d", 7 * 24 * time.Hour},
+		{"36h", 36 * time.Hour},
+		{"90s", 90 * time.Second},
+		{"0d", 0},
+		{"-1h", 0},
+		{"d", 0},
+		{"1.5d", 0},
+		{"1w", 0},
+	}
+	for _, tc := range testcases {
+		have, err := parseRetention(tc.in)
+		if tc.want == 0 {
+			if err == nil {
+				t.Errorf("%q: no error", tc.in)
+			}
+		} else if err != nil || have != tc.want {
+			t.Errorf("%q: have %v, %v", tc.in, have, err)
+		}
+	}
+}
+
+func TestParseThrottle(t *testing.T) {
+	testcases := []struct {
+		in   string
+		want *configfile.ThrottleParams
+		err  bool
+	}{
+		{"off", nil, false},
+		{"on", &configfile.ThrottleParams{}, false},
+		{"10/1h", &configfile.ThrottleParams{LockoutAttempts: 10, LockoutSeconds: 3600}, false},
+		{"5/2d", &configfile.ThrottleParams{LockoutAttempts: 5, LockoutSeconds: 2 * 86400}, false},
+		{"yes", nil, true},
+		{"0/1h", nil, true},
+		{"10/", nil, true},
+		{"10/100ms", nil, true},
+	}
+	for _, tc := range testcases {
+		have, err := parseThrottle(tc.in)
+		if (err != nil) != tc.err || !reflect.DeepEqual(have, tc.want) {
+			t.Errorf("%q: have %v, %v", tc.in, have, err)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/crashreport"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// crashSecretFields are the argContainer fields that can hold a secret
+// and must not end up in a crash report. "-extpass" commands like
+// "echo PASSWORD" are not unheard of.
+var crashSecretFields = map[string]bool{
+	"masterkey": true,
+	"extpass":   true,
+}
+
+// newCrashHandler returns the crash handler for the filesystem described
+// by "args". OnCrash must be set by the caller.
+func newCrashHandler(args *argContainer) *crashreport.Handler {
+	return &crashreport.Handler{
+		Dir:    args.crash_dir,
+		Config: crashConfig(args),
+	}
+}
+
+// crashConfig describes "args" for a crash report, one "name: value" line
+// per field. Secrets are redacted, and the helper fields (starting with an
+// underscore) are left out.
+func crashConfig(args *argContainer) []string {
+	lines := []string{fmt.Sprintf("version: %s %s", tlog.ProgramName, GitVersion)}
+	v := reflect.ValueOf(args).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		if strings.HasPrefix(name, "_") {
+			continue
+		}
+		val := fmt.Sprintf("%v", v.Field(i))
+		if crashSecretFields[name] && !v.Field(i).IsZero() {
+			val = "(redacted)"
+		}
+		lines = append(lines, name+": "+val)
+	}
+	return lines
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCrashConfigRedacted(t *testing.T) {
+	args := argContainer{
+		masterkey: "00000000-11111111-22222222-33333333",
+		extpass:   []string{"echo secretpassword"},
+		cipherdir: "/cipher",
+	}
+	config := strings.Join(crashConfig(&args), "\n")
+	for _, secret := range []string{"11111111", "secretpassword"} {
+		if strings.Contains(config, secret) {
+			t.Errorf("crash config contains %q:\n%s", secret, config)
+		}
+	}
+	if !strings.Contains(config, "cipherdir: /cipher") || !strings.Contains(config, "masterkey: (redacted)") {
+		t.Errorf("unexpected crash config:\n%s", config)
+	}
+}
@@ -31,3 +31,6 @@ time GOOS=darwin GOARCH=amd64 compile_tests
 
 # MacOS on Apple Silicon M1.
 GOOS=darwin GOARCH=arm64 build
+
+# Windows: only the packages that implement the on-disk format
+GOOS=windows GOARCH=amd64 go build -tags without_openssl ./internal/cryptocore ./internal/contentenc ./internal/configfile
@@ -0,0 +1,335 @@
+package ctlsock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Client is a typed client for the control socket. It is safe for
+// concurrent use. Requests are pipelined on one connection: a request is
+// sent without waiting for the responses to the earlier ones. When the
+// server has closed the connection, for example after its idle timeout,
+// the next request reconnects.
+type Client struct {
+	*clientConn
+	// vault is the "-daemon" vault that the path requests go to
+	vault string
+}
+
+// clientConn is the connection shared by a Client and its InVault copies
+type clientConn struct {
+	socketPath string
+	// Timeout is used for requests whose context has no deadline
+	Timeout time.Duration
+
+	mu sync.Mutex
+	// conn is nil when not connected
+	conn net.Conn
+	// pending are the requests on "conn" that wait for their response, in
+	// the order they have been sent
+	pending []chan result
+}
+
+type result struct {
+	resp *ResponseStruct
+	err  error
+}
+
+// errConnLost is returned when the connection broke before the response
+// arrived
+var errConnLost = errors.New("ctlsock: connection lost")
+
+// Connect connects to the control socket at "socketPath".
+func Connect(ctx context.Context, socketPath string) (*Client, error) {
+	cc := &clientConn{
+		socketPath: socketPath,
+		Timeout:    ctlsockTimeout,
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if err := cc.dial(ctx); err != nil {
+		return nil, err
+	}
+	return &Client{clientConn: cc}, nil
+}
+
+// InVault returns a client for vault "name" of "gocryptfs -daemon". It
+// shares the connection with "c".
+func (c *Client) InVault(name string) *Client {
+	return &Client{clientConn: c.clientConn, vault: name}
+}
+
+// dial connects and starts the goroutine that reads the responses. Caller
+// must hold cc.mu.
+func (cc *clientConn) dial(ctx context.Context) error {
+	d := net.Dialer{Timeout: cc.Timeout}
+	conn, err := d.DialContext(ctx, "unix", cc.socketPath)
+	if err != nil {
+		return err
+	}
+	cc.conn = conn
+	go cc.readLoop(conn)
+	return nil
+}
+
+// readLoop hands the responses on "conn" to the waiting requests until the
+// connection breaks
+func (cc *clientConn) readLoop(conn net.Conn) {
+	dec := json.NewDecoder(conn)
+	for {
+		var resp ResponseStruct
+		err := dec.Decode(&resp)
+		cc.mu.Lock()
+		if err != nil {
+			cc.drop(conn, err)
+			cc.mu.Unlock()
+			return
+		}
+		if cc.conn != conn || len(cc.pending) == 0 {
+			// Nobody asked for this
+			cc.drop(conn, errors.New("ctlsock: unexpected response"))
+			cc.mu.Unlock()
+			return
+		}
+		ch := cc.pending[0]
+		cc.pending = cc.pending[1:]
+		cc.mu.Unlock()
+		ch <- result{resp: &resp}
+	}
+}
+
+// drop closes "conn" and fails the requests that wait on it. Caller must
+// hold cc.mu.
+func (cc *clientConn) drop(conn net.Conn, err error) {
+	conn.Close()
+	if cc.conn != conn {
+		return
+	}
+	if err == io.EOF || errors.Is(err, net.ErrClosed) {
+		err = errConnLost
+	}
+	for _, ch := range cc.pending {
+		ch <- result{err: err}
+	}
+	cc.pending = nil
+	cc.conn = nil
+}
+
+// send writes "req" and returns the channel that gets the response
+func (cc *clientConn) send(ctx context.Context, req *RequestStruct) (chan result, error) {
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.conn == nil {
+		if err = cc.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	conn := cc.conn
+	conn.SetWriteDeadline(time.Now().Add(cc.Timeout))
+	if _, err = conn.Write(msg); err != nil {
+		cc.drop(conn, err)
+		return nil, errConnLost
+	}
+	ch := make(chan result, 1)
+	cc.pending = append(cc.pending, ch)
+	return ch, nil
+}
+
+// retryable returns true if "req" can be sent again when the connection
+// was lost: it is harmless if the server has already handled it.
+func retryable(req *RequestStruct) bool {
+	return req.VaultMount == "" && req.VaultUnmount == "" && req.VaultLock == "" &&
+		req.VaultPasswd == "" && req.TrashRestore == "" && req.Shred == "" && req.CryptoConfig == nil
+}
+
+// Do sends "req" and waits for the response. An error response from the
+// server is returned as a *ResponseStruct error. When the server had closed
+// the connection, Do reconnects and, for requests that do not change
+// anything, tries again once.
+func (c *Client) Do(ctx context.Context, req *RequestStruct) (*ResponseStruct, error) {
+	if c.vault != "" && !isDaemonRequest(req) {
+		r := *req
+		r.Vault = c.vault
+		req = &r
+	}
+	resp, err := c.do(ctx, req)
+	if err == errConnLost && retryable(req) {
+		resp, err = c.do(ctx, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.ErrNo != 0 {
+		return nil, resp
+	}
+	return resp, nil
+}
+
+func (c *Client) do(ctx context.Context, req *RequestStruct) (*ResponseStruct, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	ch, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case r := <-ch:
+		return r.resp, r.err
+	case <-ctx.Done():
+		// The response would go to the wrong request if we waited for
+		// the next one on this connection. Start over with a new one.
+		c.mu.Lock()
+		if c.conn != nil {
+			c.drop(c.conn, errConnLost)
+		}
+		c.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// isDaemonRequest returns true if "req" goes to "gocryptfs -daemon" itself
+// instead of to a vault. The log levels and profiles are process-wide.
+func isDaemonRequest(req *RequestStruct) bool {
+	return req.LogLevels != nil || req.Profile != nil || req.VaultList || req.VaultStatus != "" || req.VaultMount != "" || req.VaultUnmount != "" ||
+		req.VaultLock != "" || req.VaultPasswd != ""
+}
+
+// Handshake asks the server for its protocol version and the requests it
+// supports. Like CtlSock.Handshake, it returns ProtocolVersion 0 for
+// servers that do not know the Handshake request.
+func (c *Client) Handshake(ctx context.Context) (*Handshake, error) {
+	resp, err := c.Do(ctx, &RequestStruct{Handshake: true})
+	if _, ok := err.(*ResponseStruct); ok || (err == nil && resp.Handshake == nil) {
+		h := legacyHandshake
+		return &h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.Handshake, nil
+}
+
+// EncryptPath returns the encrypted path of "plainPath".
+func (c *Client) EncryptPath(ctx context.Context, plainPath string) (string, error) {
+	resp, err := c.Do(ctx, &RequestStruct{EncryptPath: plainPath})
+	if err != nil {
+		return "", err
+	}
+	return resp.Result, nil
+}
+
+// DecryptPath returns the plaintext path of "cipherPath".
+func (c *Client) DecryptPath(ctx context.Context, cipherPath string) (string, error) {
+	resp, err := c.Do(ctx, &RequestStruct{DecryptPath: cipherPath})
+	if err != nil {
+		return "", err
+	}
+	return resp.Result, nil
+}
+
+// LogLevels changes the log levels of the server to "levels", see
+// LogLevels.Levels, and returns the resulting levels. With nil, the levels
+// are not changed.
+func (c *Client) LogLevels(ctx context.Context, levels map[string]string) (map[string]string, error) {
+	resp, err := c.Do(ctx, &RequestStruct{LogLevels: &LogLevels{Levels: levels}})
+	if err != nil {
+		return nil, err
+	}
+	if resp.LogLevels == nil {
+		return nil, errors.New("ctlsock: LogLevels response without levels")
+	}
+	return resp.LogLevels.Levels, nil
+}
+
+// Profile captures a profile of type "typ", one of the Profile* constants,
+// and returns it. The cpu, block, mutex and trace profiles record for
+// "seconds", 0 means DefaultProfileSeconds. If "ctx" has no deadline, the
+// recording time is added to Timeout.
+func (c *Client) Profile(ctx context.Context, typ string, seconds int) ([]byte, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		d := time.Duration(seconds) * time.Second
+		if seconds == 0 {
+			d = DefaultProfileSeconds * time.Second
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout+d)
+		defer cancel()
+	}
+	resp, err := c.Do(ctx, &RequestStruct{Profile: &ProfileRequest{Type: typ, Seconds: seconds}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Profile, nil
+}
+
+// Scrub returns the status of the background scrubber. Use Handshake to
+// check if the server supports it ("Scrub").
+func (c *Client) Scrub(ctx context.Context) (*ScrubStatus, error) {
+	resp, err := c.Do(ctx, &RequestStruct{Scrub: true})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Scrub == nil {
+		return nil, errors.New("ctlsock: Scrub response without status")
+	}
+	return resp.Scrub, nil
+}
+
+// Shred destroys the data key of the file "plainPath" and deletes it. Use
+// Handshake to check if the server supports it ("Shred").
+func (c *Client) Shred(ctx context.Context, plainPath string) error {
+	_, err := c.Do(ctx, &RequestStruct{Shred: plainPath})
+	return err
+}
+
+// Stat returns the status of vault "name" of "gocryptfs -daemon".
+func (c *Client) Stat(ctx context.Context, name string) (*VaultStatus, error) {
+	resp, err := c.Do(ctx, &RequestStruct{VaultStatus: name})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Vaults) != 1 {
+		return nil, errors.New("ctlsock: VaultStatus response without status")
+	}
+	return &resp.Vaults[0], nil
+}
+
+// Lock unmounts vault "name" of "gocryptfs -daemon", even if it is in use.
+func (c *Client) Lock(ctx context.Context, name string) error {
+	_, err := c.Do(ctx, &RequestStruct{VaultLock: name})
+	return err
+}
+
+// ChangePassword changes the password of vault "name" of
+// "gocryptfs -daemon" from "oldPassword" to "newPassword". Use Handshake to
+// check if the daemon supports it ("VaultPasswd").
+func (c *Client) ChangePassword(ctx context.Context, name string, oldPassword, newPassword []byte) error {
+	_, err := c.Do(ctx, &RequestStruct{
+		VaultPasswd: name,
+		Password:    string(oldPassword),
+		NewPassword: string(newPassword),
+	})
+	return err
+}
+
+// Close closes the connection. Requests that wait for their response fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	c.drop(c.conn, net.ErrClosed)
+	return nil
+}
@@ -0,0 +1,100 @@
+package ctlsock
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoServer answers EncryptPath requests with the path prefixed by "c/",
+// and closes each connection after "perConn" responses
+func echoServer(t *testing.T, perConn int) string {
+	sockPath := filepath.Join(t.TempDir(), "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sock.Close() })
+	go func() {
+		for {
+			conn, err := sock.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dec := json.NewDecoder(conn)
+				enc := json.NewEncoder(conn)
+				for i := 0; i < perConn; i++ {
+					var req RequestStruct
+					if dec.Decode(&req) != nil {
+						return
+					}
+					if req.EncryptPath == "slow" {
+						time.Sleep(time.Second)
+					}
+					enc.Encode(ResponseStruct{Result: "c/" + req.EncryptPath})
+				}
+			}()
+		}
+	}()
+	return sockPath
+}
+
+func TestClientPipelining(t *testing.T) {
+	c, err := Connect(context.Background(), echoServer(t, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p := fmt.Sprintf("f%d", i)
+			have, err := c.EncryptPath(context.Background(), p)
+			if err != nil {
+				t.Error(err)
+			} else if want := "c/" + p; have != want {
+				t.Errorf("have %q, want %q", have, want)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClientReconnect(t *testing.T) {
+	c, err := Connect(context.Background(), echoServer(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for i := 0; i < 5; i++ {
+		if have, err := c.EncryptPath(context.Background(), "f"); err != nil || have != "c/f" {
+			t.Fatalf("request %d: %q, %v", i, have, err)
+		}
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	c, err := Connect(context.Background(), echoServer(t, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = c.EncryptPath(ctx, "slow"); err != context.DeadlineExceeded {
+		t.Errorf("have %v", err)
+	}
+	// The next request gets a new connection and the right response
+	if have, err := c.EncryptPath(context.Background(), "f"); err != nil || have != "c/f" {
+		t.Errorf("have %q, %v", have, err)
+	}
+}
@@ -2,7 +2,7 @@
 // gocryptfs control socket interface. This interface can be
 // activated by passing `-ctlsock /tmp/my.sock` to gocryptfs on the
 // command line.
-// See gocryptfs-xray for a usage example.
+// Use Connect to get a Client.
 package ctlsock
 
 import (
@@ -17,6 +17,9 @@ func (r *ResponseStruct) Error() string {
 }
 
 // CtlSock encapsulates a control socket
+//
+// Deprecated: Use Client, which can be used concurrently, reconnects and
+// supports contexts.
 type CtlSock struct {
 	Conn net.Conn
 }
@@ -45,20 +48,46 @@ func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, 5000)
-	n, err := c.Conn.Read(buf)
-	if err != nil {
+	// Decode instead of a single Read, as a TrashList response can be
+	// big and arrive in pieces
+	var resp ResponseStruct
+	if err = json.NewDecoder(c.Conn).Decode(&resp); err != nil {
 		return nil, err
 	}
-	buf = buf[:n]
-	var resp ResponseStruct
-	json.Unmarshal(buf, &resp)
 	if resp.ErrNo != 0 {
 		return nil, &resp
 	}
 	return &resp, nil
 }
 
+// legacyHandshake describes the servers that do not know the Handshake
+// request. Encrypting and decrypting paths is all that upstream gocryptfs
+// supports.
+var legacyHandshake = Handshake{
+	ProtocolVersion: 0,
+	Verbs:           []string{"EncryptPath", "DecryptPath"},
+}
+
+// Handshake asks the server for its protocol version and the requests it
+// supports. Servers that do not know the Handshake request ignore it and
+// return an error or an empty response. For them, Handshake returns
+// ProtocolVersion 0 with only EncryptPath and DecryptPath, so that callers
+// can check for the requests they need in the same way.
+func (c *CtlSock) Handshake() (*Handshake, error) {
+	resp, err := c.Query(&RequestStruct{Handshake: true})
+	if _, ok := err.(*ResponseStruct); ok {
+		h := legacyHandshake
+		return &h, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if resp.Handshake == nil {
+		h := legacyHandshake
+		return &h, nil
+	}
+	return resp.Handshake, nil
+}
+
 // Close closes the socket
 func (c *CtlSock) Close() {
 	c.Conn.Close()
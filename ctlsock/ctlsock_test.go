@@ -0,0 +1,42 @@
+package ctlsock
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// TestHandshakeLegacy checks the answer of servers that do not know the
+// Handshake request, like upstream gocryptfs
+func TestHandshakeLegacy(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go func() {
+		conn, err := sock.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 5000)
+		conn.Read(buf)
+		// This is what upstream gocryptfs v2.4 sends
+		conn.Write([]byte(`{"Result":"","ErrNo":-1,"ErrText":"empty input","WarnText":""}` + "\n"))
+	}()
+	c, err := Connect(context.Background(), sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.Handshake(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ProtocolVersion != 0 || !h.Supports("EncryptPath") || !h.Supports("DecryptPath") || h.Supports("TrashList") {
+		t.Errorf("have %+v", h)
+	}
+}
@@ -1,18 +1,110 @@
 package ctlsock
 
+// ProtocolVersion is the version of the control socket protocol that this
+// package speaks. It is incremented when requests are added or change.
+// Servers that do not know the Handshake request, like upstream gocryptfs,
+// have version 0.
+const ProtocolVersion = 5
+
+// Features that a server can report in its Handshake response
+const (
+	// FeatureDaemon means that the socket belongs to "gocryptfs -daemon".
+	// The mount requests need "Vault" set.
+	FeatureDaemon = "daemon"
+	// FeatureReverse means that the socket belongs to a "-reverse" mount.
+	FeatureReverse = "reverse"
+	// FeatureTrash means that "-trash" is enabled.
+	FeatureTrash = "trash"
+	// FeatureScrub means that "-scrub" is enabled.
+	FeatureScrub = "scrub"
+	// FeatureShred means that files have their own data keys (see
+	// "-header-v3"), so that Shred can destroy them.
+	FeatureShred = "shred"
+)
+
 // RequestStruct is sent by a client (encoded as JSON).
-// You cannot perform both encryption and decryption in the same request.
+// Only one of the fields may be set. Vault and Password are the exception,
+// they accompany another request.
 type RequestStruct struct {
 	// EncryptPath is the path that should be encrypted.
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// TrashList requests the list of files in the trash (see "-trash").
+	TrashList bool `json:",omitempty"`
+	// TrashRestore is the ID, or the original path, of a file in the trash
+	// that should be moved back. For a path, the most recently deleted
+	// file is restored.
+	TrashRestore string `json:",omitempty"`
+	// Handshake requests the protocol version and the requests that the
+	// server supports.
+	Handshake bool `json:",omitempty"`
+	// Metrics requests the runtime statistics of the filesystem.
+	Metrics bool `json:",omitempty"`
+	// NameLimits requests how long plaintext file names can be.
+	NameLimits bool `json:",omitempty"`
+	// CryptoConfig changes the parallel crypto configuration. The fields
+	// that are nil are not changed, so an empty CryptoConfig only requests
+	// the current configuration.
+	CryptoConfig *CryptoConfig `json:",omitempty"`
+	// LogLevels changes the log levels of subsystems. An empty LogLevels
+	// only requests the current levels. Added in ProtocolVersion 2.
+	LogLevels *LogLevels `json:",omitempty"`
+	// Profile captures a profile of the server process. Added in
+	// ProtocolVersion 3.
+	Profile *ProfileRequest `json:",omitempty"`
+	// Scrub requests the progress and the findings of the background
+	// scrubber (see "-scrub"). Added in ProtocolVersion 4.
+	Scrub bool `json:",omitempty"`
+	// Shred is the path of a file whose data key should be destroyed
+	// before it is deleted, so that its content cannot be recovered from
+	// copies of its blocks. Added in ProtocolVersion 5.
+	Shred string `json:",omitempty"`
+
+	// The requests below are served by "gocryptfs -daemon".
+	//
+	// Vault is the name of the vault that the requests above go to.
+	Vault string `json:",omitempty"`
+	// VaultList requests the status of all vaults.
+	VaultList bool `json:",omitempty"`
+	// VaultStatus is the name of a vault whose status is requested.
+	VaultStatus string `json:",omitempty"`
+	// VaultMount is the name of a vault that should be mounted.
+	VaultMount string `json:",omitempty"`
+	// Password unlocks the vault for VaultMount. If it is empty, the
+	// -passfile, -extpass or -fido2 option from the vault profile is used.
+	// For VaultPasswd, it is the current password.
+	Password string `json:",omitempty"`
+	// VaultUnmount is the name of a vault that should be unmounted. Fails
+	// with EBUSY if the vault is in use.
+	VaultUnmount string `json:",omitempty"`
+	// VaultLock is the name of a vault that should be unmounted even if it
+	// is in use (lazy unmount).
+	VaultLock string `json:",omitempty"`
+	// VaultPasswd is the name of a vault whose password should be changed
+	// from Password to NewPassword, like "-passwd". The vault can be
+	// mounted.
+	VaultPasswd string `json:",omitempty"`
+	// NewPassword is the new password for VaultPasswd.
+	NewPassword string `json:",omitempty"`
+}
+
+// TrashEntry describes a file in the trash.
+type TrashEntry struct {
+	// ID identifies the file in the trash.
+	ID string
+	// Path is the plaintext path the file was deleted from.
+	Path string
+	// Deleted is the time of deletion in seconds since the epoch.
+	Deleted int64
 }
 
 // ResponseStruct is sent by the server in response to a request
 // (encoded as JSON).
 type ResponseStruct struct {
-	// Result is the resulting decrypted or encrypted path. Empty on error.
+	// Result is the resulting decrypted or encrypted path, the path of
+	// the restored file for TrashRestore, or the path of the shredded file
+	// for Shred. Empty on error.
 	Result string
 	// ErrNo is the error number as defined in errno.h.
 	// 0 means success and -1 means that the error number is not known
@@ -23,4 +115,190 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Trash is the result of TrashList.
+	Trash []TrashEntry `json:",omitempty"`
+	// Metrics is the result of a Metrics request, keyed by metric name.
+	Metrics map[string]int64 `json:",omitempty"`
+	// NameLimits is the result of a NameLimits request.
+	NameLimits *NameLimits `json:",omitempty"`
+	// CryptoConfig is the result of a CryptoConfig request, with all
+	// fields set.
+	CryptoConfig *CryptoConfig `json:",omitempty"`
+	// LogLevels is the result of a LogLevels request, with the levels of
+	// all subsystems that have one, and "default".
+	LogLevels *LogLevels `json:",omitempty"`
+	// Profile is the result of a Profile request: a pprof protobuf that
+	// "go tool pprof" reads, or for ProfileTrace, an execution trace for
+	// "go tool trace".
+	Profile []byte `json:",omitempty"`
+	// Vaults is the result of VaultList and VaultStatus.
+	Vaults []VaultStatus `json:",omitempty"`
+	// Handshake is the result of a Handshake request.
+	Handshake *Handshake `json:",omitempty"`
+	// Scrub is the result of a Scrub request.
+	Scrub *ScrubStatus `json:",omitempty"`
+}
+
+// Handshake describes what a server supports.
+type Handshake struct {
+	// ProtocolVersion is the ProtocolVersion of the server.
+	ProtocolVersion int
+	// Verbs are the names of the RequestStruct fields that the server
+	// handles, like "EncryptPath" or "TrashList".
+	Verbs []string
+	// Features are the Feature* constants that apply to the server.
+	Features []string `json:",omitempty"`
+}
+
+// Supports returns true if the server handles the request "verb", which is
+// the name of a RequestStruct field.
+func (h *Handshake) Supports(verb string) bool {
+	for _, v := range h.Verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFeature returns true if the server reported "feature".
+func (h *Handshake) HasFeature(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// VaultStatus describes a vault managed by "gocryptfs -daemon".
+type VaultStatus struct {
+	// Name identifies the vault in requests.
+	Name string
+	// Cipherdir and Mountpoint are absolute paths.
+	Cipherdir  string
+	Mountpoint string
+	// State is "unmounted", "mounting" or "mounted".
+	State string
+	// Mounted is the time of the mount in seconds since the epoch, 0 if
+	// the vault is not mounted.
+	Mounted int64
+	// LastError is the error of the last failed mount, or of an unmount
+	// that has failed since.
+	LastError string `json:",omitempty"`
+	// Scrub is the status of the background scrubber of a mounted vault
+	// with "-scrub" in its profile.
+	Scrub *ScrubStatus `json:",omitempty"`
+}
+
+// Scrub states for ScrubStatus.State
+const (
+	// ScrubRunning means that a pass is checking files
+	ScrubRunning = "running"
+	// ScrubPaused means that a pass waits for the filesystem to become
+	// quiet
+	ScrubPaused = "paused"
+	// ScrubWaiting means that the scrubber waits for the next pass
+	ScrubWaiting = "waiting"
+)
+
+// ScrubStatus describes the background scrubber of a mount, which reads
+// all of CIPHERDIR and checks the authentication tags.
+type ScrubStatus struct {
+	// State is one of the Scrub* constants
+	State string
+	// Passes is the number of completed passes
+	Passes int
+	// Started is the start of the current or the last pass, and Finished
+	// the end of the last completed pass, in seconds since the epoch. 0
+	// means never.
+	Started  int64
+	Finished int64
+	// Files and Bytes are the files and the ciphertext bytes that the
+	// current pass, or the last one if none is running, has checked
+	Files int64
+	Bytes int64
+	// Damaged is the number of damaged files and directories that the
+	// current or the last pass has found
+	Damaged int
+	// Findings are the first damaged files and directories of Damaged
+	Findings []ScrubFinding `json:",omitempty"`
+}
+
+// ScrubFinding is a damaged file or directory
+type ScrubFinding struct {
+	// CipherPath is the path relative to CIPHERDIR
+	CipherPath string
+	// Path is the plaintext path, if it could be decrypted
+	Path string `json:",omitempty"`
+	// Error describes the damage
+	Error string
+	// Found is the time of the discovery in seconds since the epoch
+	Found int64
+}
+
+// NameLimits describes how long plaintext file names can be, in bytes. The
+// encrypted names are longer, by how much depends on the feature flags.
+type NameLimits struct {
+	// Max is the longest plaintext name that can be stored.
+	Max int
+	// Direct is the longest plaintext name whose encrypted name is stored
+	// as-is. Longer names are hashed and need an extra
+	// "gocryptfs.longname.*.name" file.
+	Direct int
+	// BackingMax is the longest name the filesystem that holds CIPHERDIR
+	// allows.
+	BackingMax int
+}
+
+// CryptoConfig is the configuration of the parallel encryption and
+// decryption of a mount, see the -crypto-workers,
+// -crypto-parallel-threshold and -no-parallel-crypto options.
+type CryptoConfig struct {
+	// Workers is the maximum number of parallel workers. 0 means that it
+	// depends on the number of CPUs.
+	Workers *int `json:",omitempty"`
+	// ParallelThreshold is the minimum number of blocks in a request that
+	// are processed in parallel. 0 restores the default.
+	ParallelThreshold *int `json:",omitempty"`
+	// Parallel is false if all blocks are processed sequentially.
+	Parallel *bool `json:",omitempty"`
+}
+
+// LogLevels are the log levels of a server.
+type LogLevels struct {
+	// Levels maps a subsystem, which is the Go package that logs, like
+	// "fusefrontend" or "ctlsocksrv", to its level: "debug", "info",
+	// "warn" or "fatal". In a request, an empty level removes the level of
+	// the subsystem, and "default" sets the level of all other subsystems.
+	Levels map[string]string `json:",omitempty"`
 }
+
+// Profile types for ProfileRequest.Type
+const (
+	// ProfileCPU samples where the CPU time is spent
+	ProfileCPU = "cpu"
+	// ProfileHeap is a snapshot of the allocated memory
+	ProfileHeap = "heap"
+	// ProfileBlock records where goroutines wait on channels and locks
+	ProfileBlock = "block"
+	// ProfileMutex records where goroutines wait for contended mutexes
+	ProfileMutex = "mutex"
+	// ProfileGoroutine is a snapshot of the stacks of all goroutines
+	ProfileGoroutine = "goroutine"
+	// ProfileTrace is an execution trace
+	ProfileTrace = "trace"
+)
+
+// ProfileRequest asks for a profile of the server process.
+type ProfileRequest struct {
+	// Type is one of the Profile* constants.
+	Type string
+	// Seconds is how long the cpu, block, mutex and trace profiles record.
+	// 0 means DefaultProfileSeconds. The heap and goroutine profiles are
+	// snapshots and ignore it.
+	Seconds int `json:",omitempty"`
+}
+
+// DefaultProfileSeconds is the duration of a ProfileRequest without Seconds
+const DefaultProfileSeconds = 10
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// daemonProfiles is the PROFILES file of "-daemon"
+type daemonProfiles struct {
+	Vaults []vaultProfile
+}
+
+// vaultProfile describes one vault managed by "-daemon"
+type vaultProfile struct {
+	// Name identifies the vault in ctlsock requests
+	Name       string
+	Cipherdir  string
+	Mountpoint string
+	// Options are mount options like on the command line, for example
+	// ["-ro", "-passfile", "/home/me/pw"]
+	Options []string
+	// AutoMount mounts the vault when the daemon starts
+	AutoMount bool
+}
+
+// Vault states as reported in ctlsock.VaultStatus
+const (
+	vaultUnmounted = "unmounted"
+	vaultMounting  = "mounting"
+	vaultMounted   = "mounted"
+)
+
+// managedVault is a vault and its mount state. The state fields are
+// protected by mountManager.mu.
+type managedVault struct {
+	profile vaultProfile
+	// args are the parsed profile options. Every mount works on a copy.
+	args      *argContainer
+	state     string
+	srv       *fuse.Server
+	rootNode  fs.InodeEmbedder
+	mounted   time.Time
+	lastError string
+}
+
+// mountManager mounts and unmounts the vaults of "-daemon". It implements
+// ctlsocksrv.DaemonInterface.
+type mountManager struct {
+	mu     sync.Mutex
+	vaults []*managedVault
+}
+
+// runDaemon implements "-daemon -ctlsock SOCKET PROFILES". It serves
+// requests on the control socket until it gets SIGINT or SIGTERM.
+// Does not return (calls os.Exit).
+func runDaemon(args *argContainer) {
+	if flagSet.NArg() != 1 || args.ctlsock == "" {
+		tlog.Fatal.Printf("Usage: %s -daemon -ctlsock SOCKET PROFILES", tlog.ProgramName)
+		os.Exit(exitcodes.Usage)
+	}
+	if countOpFlags(args) > 0 {
+		tlog.Fatal.Printf("-daemon cannot be combined with -info, -init, -passwd, -fsck and the other operations")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.quiet {
+		tlog.Info.Enabled = false
+	}
+	m, err := loadProfiles(flagSet.Arg(0))
+	if err != nil {
+		tlog.Fatal.Printf("-daemon: %v", err)
+		os.Exit(exitcodes.Profiles)
+	}
+	sock, err := listenCtlsock(args)
+	if err != nil {
+		tlog.Fatal.Printf("ctlsock: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	setOpenFileLimit()
+	// Unmount everything on SIGINT and SIGTERM, like handleSigint does for
+	// a single mount
+	srv := ctlsocksrv.NewDaemonServer(sock, m, ctlsockOptions(args))
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		m.unmountAll()
+		// Shutdown also deletes the socket file
+		srv.Shutdown(ctlsockDrainTimeout)
+		os.Exit(exitcodes.SigInt)
+	}()
+	for _, v := range m.vaults {
+		if v.profile.AutoMount {
+			// The error is in the vault status
+			m.VaultMount(v.profile.Name, nil)
+		}
+	}
+	tlog.Info.Printf("Managing %d vaults, control socket at %s", len(m.vaults), args.ctlsock)
+	if srv.Serve() == ctlsocksrv.ErrServerClosed {
+		// The signal handler exits when the requests are drained
+		select {}
+	}
+	os.Exit(exitcodes.CtlSock)
+}
+
+// loadProfiles reads the PROFILES file and parses the options of each vault.
+// Invalid options make parseCliOpts exit, like on the command line.
+func loadProfiles(filename string) (*mountManager, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var p daemonProfiles
+	if err = json.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	if len(p.Vaults) == 0 {
+		return nil, fmt.Errorf("%s: no vaults", filename)
+	}
+	m := &mountManager{}
+	names := make(map[string]bool)
+	mountpoints := make(map[string]bool)
+	for _, vp := range p.Vaults {
+		if vp.Name == "" || names[vp.Name] {
+			return nil, fmt.Errorf("vault names must be unique and not empty, have %q", vp.Name)
+		}
+		names[vp.Name] = true
+		args, err := profileArgs(vp)
+		if err != nil {
+			return nil, fmt.Errorf("vault %q: %v", vp.Name, err)
+		}
+		if mountpoints[args.mountpoint] {
+			return nil, fmt.Errorf("vault %q: mountpoint %s is used twice", vp.Name, args.mountpoint)
+		}
+		mountpoints[args.mountpoint] = true
+		m.vaults = append(m.vaults, &managedVault{profile: vp, args: args, state: vaultUnmounted})
+	}
+	return m, nil
+}
+
+// profileArgs turns a vault profile into the argContainer that a mount
+// from the command line would use
+func profileArgs(vp vaultProfile) (*argContainer, error) {
+	if vp.Cipherdir == "" || vp.Mountpoint == "" {
+		return nil, fmt.Errorf("Cipherdir and Mountpoint must be set")
+	}
+	tlog.Debug.Printf("vault %q: options %q", vp.Name, vp.Options)
+	args := parseCliOpts(append([]string{tlog.ProgramName}, vp.Options...))
+	if flagSet.NArg() > 0 {
+		return nil, fmt.Errorf("Options must not contain paths, have %q", flagSet.Args())
+	}
+	if countOpFlags(&args) > 0 || args.daemon {
+		return nil, fmt.Errorf("Options can only contain mount options")
+	}
+	// These are process-wide settings, or need the terminal
+	for _, o := range []struct {
+		set  bool
+		name string
+	}{
+		{args.ctlsock != "", "-ctlsock"},
+		{args.idle > 0, "-idle"},
+		{args.masterkey != "", "-masterkey"},
+		{args.privsep, "-privsep"},
+		{args.run_as != "", "-run-as"},
+		{args.wizard, "-wizard"},
+		{args.from_snapshot != "", "-from-snapshot"},
+		{args.metrics_addr != "", "-metrics-addr"},
+		{args.logfile != "" || args.log_level != "" || args.log_format != "text" || args.log_target != logTargetAuto,
+			"-logfile, -log-level, -log-format and -log-target"},
+		{args.cpuprofile != "" || args.memprofile != "" || args.trace != "", "-cpuprofile, -memprofile and -trace"},
+	} {
+		if o.set {
+			return nil, fmt.Errorf("%s is not supported in a vault profile", o.name)
+		}
+	}
+	args.cipherdir, _ = filepath.Abs(vp.Cipherdir)
+	if err := isDir(args.cipherdir); err != nil {
+		return nil, fmt.Errorf("Invalid cipherdir: %v", err)
+	}
+	args.mountpoint, _ = filepath.Abs(vp.Mountpoint)
+	if err := completeArgs(&args); err != nil {
+		return nil, err
+	}
+	return &args, nil
+}
+
+// vault returns the vault called "name"
+func (m *mountManager) vault(name string) (*managedVault, error) {
+	for _, v := range m.vaults {
+		if v.profile.Name == name {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("no vault called %q", name)
+}
+
+// status returns the status of "v". Caller must hold m.mu.
+func (v *managedVault) status() ctlsock.VaultStatus {
+	st := ctlsock.VaultStatus{
+		Name:       v.profile.Name,
+		Cipherdir:  v.args.cipherdir,
+		Mountpoint: v.args.mountpoint,
+		State:      v.state,
+		LastError:  v.lastError,
+	}
+	if v.state == vaultMounted {
+		st.Mounted = v.mounted.Unix()
+		if sc, ok := v.rootNode.(ctlsocksrv.ScrubInterface); ok {
+			if scrub, err := sc.ScrubStatus(); err == nil {
+				st.Scrub = &scrub
+			}
+		}
+	}
+	return st
+}
+
+// VaultList returns the status of all vaults, in PROFILES order
+func (m *mountManager) VaultList() []ctlsock.VaultStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	list := make([]ctlsock.VaultStatus, len(m.vaults))
+	for i, v := range m.vaults {
+		list[i] = v.status()
+	}
+	return list
+}
+
+// VaultStatus returns the status of vault "name"
+func (m *mountManager) VaultStatus(name string) (ctlsock.VaultStatus, error) {
+	v, err := m.vault(name)
+	if err != nil {
+		return ctlsock.VaultStatus{}, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return v.status(), nil
+}
+
+// VaultMount mounts vault "name", unlocked by "password" or, if it is nil,
+// by the password source in the profile
+func (m *mountManager) VaultMount(name string, password []byte) error {
+	v, err := m.vault(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if v.state != vaultUnmounted {
+		m.mu.Unlock()
+		return fmt.Errorf("vault %q is %s", name, v.state)
+	}
+	v.state = vaultMounting
+	m.mu.Unlock()
+
+	// Mounting takes a while because of the key derivation. Do it without
+	// holding the lock so the other vaults can be queried meanwhile.
+	srv, rootNode, wipeKeys, err := mountVault(v.args, password)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		v.state = vaultUnmounted
+		v.lastError = err.Error()
+		tlog.Warn.Printf("vault %q: mount failed: %v", name, err)
+		return err
+	}
+	v.state = vaultMounted
+	v.srv = srv
+	v.rootNode = rootNode
+	v.mounted = time.Now()
+	v.lastError = ""
+	go m.serveVault(v, srv, rootNode, wipeKeys)
+	tlog.Info.Printf("vault %q: mounted at %s", name, v.args.mountpoint)
+	return nil
+}
+
+// mountVault mounts the vault described by "profile". The FUSE server runs
+// in the background, "wipeKeys" must be called after it has exited.
+func mountVault(profile *argContainer, password []byte) (srv *fuse.Server, rootNode fs.InodeEmbedder, wipeKeys func(), err error) {
+	args := *profile
+	args._password = password
+	if password == nil && len(args.extpass) == 0 && len(args.passfile) == 0 && args.fido2 == "" && !args.zerokey {
+		// We must not prompt on the terminal of the daemon
+		return nil, nil, nil, exitcodes.NewErr("no password: send one with the request, "+
+			"or put -passfile, -extpass or -fido2 into the vault profile", exitcodes.ReadPassword)
+	}
+	if err = checkMountpoint(&args); err != nil {
+		return nil, nil, nil, exitcodes.NewErr(err.Error(), exitcodes.MountPoint)
+	}
+	rootNode, wipeKeys, err = newFuseFrontend(&args)
+	if err != nil {
+		return nil, nil, nil, describeErr(err)
+	}
+	srv, err = newGoFuse(rootNode, &args)
+	if err != nil {
+		wipeKeys()
+		return nil, nil, nil, describeErr(err)
+	}
+	// Return the memory used by the key derivation to the OS
+	debug.FreeOSMemory()
+	return srv, rootNode, wipeKeys, nil
+}
+
+// describeErr makes sure the error has a message. Some errors from the
+// command line code are only logged and carry just the exit code.
+func describeErr(err error) error {
+	if err.Error() != "" {
+		return err
+	}
+	if e, ok := err.(exitcodes.Err); ok {
+		return exitcodes.NewErr(fmt.Sprintf("failed with exit code %d, see the log", e.Code()), e.Code())
+	}
+	return fmt.Errorf("failed, see the log")
+}
+
+// serveVault waits until vault "v" is unmounted and then wipes its keys
+func (m *mountManager) serveVault(v *managedVault, srv *fuse.Server, rootNode fs.InodeEmbedder, wipeKeys func()) {
+	srv.Wait()
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		x.AfterUnmount()
+	}
+	wipeKeys()
+	m.mu.Lock()
+	v.state = vaultUnmounted
+	v.srv = nil
+	v.rootNode = nil
+	m.mu.Unlock()
+	tlog.Info.Printf("vault %q: unmounted", v.profile.Name)
+}
+
+// VaultUnmount unmounts vault "name". Without "lazy", this fails with
+// EBUSY while the vault is in use. With "lazy", the vault disappears from
+// the mountpoint at once, and the keys are wiped when the last open file
+// has been closed.
+func (m *mountManager) VaultUnmount(name string, lazy bool) error {
+	v, err := m.vault(name)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	srv := v.srv
+	state := v.state
+	m.mu.Unlock()
+	if state != vaultMounted || srv == nil {
+		return fmt.Errorf("vault %q is %s", name, state)
+	}
+	if lazy {
+		unmount(srv, v.args.mountpoint)
+		return nil
+	}
+	err = srvUnmount(srv, false)
+	if err != nil {
+		m.mu.Lock()
+		v.lastError = err.Error()
+		m.mu.Unlock()
+	}
+	return err
+}
+
+// VaultPasswd changes the password of vault "name" from "oldPw" to "newPw",
+// like "-passwd". Mounted vaults keep running, the new password is needed
+// for the next mount.
+func (m *mountManager) VaultPasswd(name string, oldPw, newPw []byte) error {
+	v, err := m.vault(name)
+	if err != nil {
+		return err
+	}
+	cf, err := configfile.Load(v.args.config)
+	if err != nil {
+		return err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return exitcodes.NewErr("Password change is not supported on FIDO2-enabled filesystems.", exitcodes.Usage)
+	}
+	masterkey, err := cf.DecryptMasterKey(oldPw)
+	if err != nil {
+		return describeErr(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagArgon2id) {
+		cf.EncryptKeyWithArgon2id(masterkey, newPw)
+	} else {
+		logN := cf.ScryptObject.LogN()
+		if v.args._explicitScryptn {
+			logN = v.args.scryptn
+		}
+		cf.EncryptKey(masterkey, newPw, logN)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err = cf.WriteFile(); err != nil {
+		return err
+	}
+	tlog.Info.Printf("vault %q: password changed", name)
+	return nil
+}
+
+// VaultFS returns the root node of the mounted vault "name" for the path
+// and trash requests
+func (m *mountManager) VaultFS(name string) (ctlsocksrv.Interface, error) {
+	v, err := m.vault(name)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if v.state != vaultMounted {
+		return nil, fmt.Errorf("vault %q is %s", name, v.state)
+	}
+	return v.rootNode.(ctlsocksrv.Interface), nil
+}
+
+// unmountAll unmounts all mounted vaults, lazily if they are busy
+func (m *mountManager) unmountAll() {
+	m.mu.Lock()
+	var mounted []*managedVault
+	var servers []*fuse.Server
+	for _, v := range m.vaults {
+		if v.state == vaultMounted {
+			mounted = append(mounted, v)
+			servers = append(servers, v.srv)
+		}
+	}
+	m.mu.Unlock()
+	for i, v := range mounted {
+		tlog.Info.Printf("vault %q: unmounting", v.profile.Name)
+		unmount(servers[i], v.args.mountpoint)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+func writeProfiles(t *testing.T, json string) string {
+	f := filepath.Join(t.TempDir(), "profiles.json")
+	if err := os.WriteFile(f, []byte(json), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestLoadProfiles(t *testing.T) {
+	dir := t.TempDir()
+	f := writeProfiles(t, `{"Vaults": [
+		{"Name": "a", "Cipherdir": "`+dir+`", "Mountpoint": "`+dir+`.a", "Options": ["-ro", "-force_owner", "10:20"]},
+		{"Name": "b", "Cipherdir": "`+dir+`", "Mountpoint": "`+dir+`.b", "Options": ["-reverse"], "AutoMount": true}
+	]}`)
+	m, err := loadProfiles(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := m.vaults[0].args, m.vaults[1].args
+	if !a.ro || a._forceOwner == nil || a._forceOwner.Gid != 20 || a.config != filepath.Join(dir, configfile.ConfDefaultName) {
+		t.Errorf("vault a: %+v", a)
+	}
+	if !b.aessiv || b.config != filepath.Join(dir, configfile.ConfReverseName) || !m.vaults[1].profile.AutoMount {
+		t.Errorf("vault b: %+v", b)
+	}
+	list := m.VaultList()
+	if len(list) != 2 || list[1].Name != "b" || list[1].State != vaultUnmounted || list[1].Mountpoint != dir+".b" {
+		t.Errorf("VaultList: %+v", list)
+	}
+	if _, err := m.VaultStatus("c"); err == nil {
+		t.Error("VaultStatus of an unknown vault should fail")
+	}
+}
+
+func TestLoadProfilesInvalid(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		json string
+		want string
+	}{
+		{`{"Vaults": []}`, "no vaults"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `"}]}`, "must be set"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `", "Mountpoint": "/x"}, ` +
+			`{"Name": "a", "Cipherdir": "` + dir + `", "Mountpoint": "/y"}]}`, "unique"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `", "Mountpoint": "/x"}, ` +
+			`{"Name": "b", "Cipherdir": "` + dir + `", "Mountpoint": "/x"}]}`, "used twice"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `", "Mountpoint": "/x", "Options": ["-ctlsock", "/s"]}]}`, "-ctlsock"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `", "Mountpoint": "/x", "Options": ["-fsck"]}]}`, "mount options"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `", "Mountpoint": "/x", "Options": ["/y"]}]}`, "paths"},
+		{`{"Vaults": [{"Name": "a", "Cipherdir": "` + dir + `/nonexistent", "Mountpoint": "/x"}]}`, "Invalid cipherdir"},
+	}
+	for _, tc := range testCases {
+		_, err := loadProfiles(writeProfiles(t, tc.json))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: want error containing %q, have %v", tc.json, tc.want, err)
+		}
+	}
+}
+
+// A vault without a password source must not prompt on the terminal of the
+// daemon
+func TestVaultMountNoPassword(t *testing.T) {
+	dir := t.TempDir()
+	m, err := loadProfiles(writeProfiles(t, `{"Vaults": [{"Name": "a", "Cipherdir": "`+dir+`", "Mountpoint": "`+dir+`.mnt"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.VaultMount("a", nil)
+	if e, ok := err.(exitcodes.Err); !ok || e.Code() != exitcodes.ReadPassword {
+		t.Fatalf("want a ReadPassword error, have %v", err)
+	}
+	if st, _ := m.VaultStatus("a"); st.State != vaultUnmounted || st.LastError == "" {
+		t.Errorf("status after failed mount: %+v", st)
+	}
+	if err = m.VaultUnmount("a", false); err == nil {
+		t.Error("unmounting an unmounted vault should fail")
+	}
+}
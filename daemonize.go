@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -41,6 +42,11 @@ func forkChild() int {
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
+	// Pass the sockets from systemd socket activation on, at the same
+	// file descriptor numbers
+	for i := 0; i < ctlsocksrv.SystemdFds(os.Getpid()); i++ {
+		c.ExtraFiles = append(c.ExtraFiles, os.NewFile(uintptr(3+i), "systemd socket"))
+	}
 	exitOnUsr1()
 	err = c.Start()
 	if err != nil {
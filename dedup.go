@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+)
+
+// dedupRun holds the state of "gocryptfs -dedup".
+type dedupRun struct {
+	store *dedup.Store
+	cEnc  *contentenc.ContentEnc
+	// live contains the chunks referenced by recipes and recovery copies
+	live map[dedup.ID]struct{}
+	// recovery contains the hex file IDs of the recovery copies that have
+	// not been matched with a file yet
+	recovery map[string]bool
+	// Statistics
+	converted, recipes, restored, skipped, errors int
+	// plainBytes is the size of the file contents stored in recipes
+	plainBytes uint64
+}
+
+// runDedup implements "-dedup". It converts all regular files in CIPHERDIR
+// to recipes that reference their content in the chunk store, and deletes
+// chunks that are no longer referenced. Files that were changed while
+// mounted, and have been converted back to regular files, are converted
+// again.
+// Does not return (calls os.Exit both on success and on error).
+func runDedup(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-dedup cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagHeaderV3) {
+		tlog.Fatal.Printf("-dedup cannot be used on a filesystem with version 3 file headers")
+		os.Exit(exitcodes.Usage)
+	}
+	cryptoBackend, err := cf.ContentEncryption()
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.DeprecatedFS)
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, cryptoBackend.NonceSize*8,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF))
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	d := dedupRun{
+		store:    dedup.New(masterkey, args.cipherdir, cEnc),
+		cEnc:     cEnc,
+		live:     make(map[dedup.ID]struct{}),
+		recovery: make(map[string]bool),
+	}
+	defer cCore.Wipe()
+	defer d.store.Wipe()
+	// Set the feature flag first. Older versions of gocryptfs would
+	// otherwise mount the filesystem and report the recipes as corrupt.
+	if !cf.IsFeatureFlagSet(configfile.FlagDedup) {
+		leaveUpstream(args, cf, "-dedup")
+		cf.SetFeatureFlag(configfile.FlagDedup)
+		cf.UpdateFeatureFlagsMAC(masterkey)
+		if err = cf.WriteFile(); err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.WriteConf)
+		}
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	tlog.Info.Printf("Deduplicating %q. The filesystem must not be mounted while this runs.",
+		args.cipherdir)
+	fileIDs, err := d.store.ListRecovery()
+	if err != nil {
+		tlog.Fatal.Printf("dedup: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	for _, id := range fileIDs {
+		d.recovery[hex.EncodeToString(id)] = true
+	}
+	err = filepath.Walk(args.cipherdir, d.walkFn(filepath.Clean(args.cipherdir)))
+	if err != nil {
+		tlog.Fatal.Printf("dedup: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	// Recovery copies whose file we did not find. Maybe the file has been
+	// deleted, but we cannot be sure, so we keep them.
+	for h := range d.recovery {
+		id, _ := hex.DecodeString(h)
+		buf, err := d.store.LoadRecovery(id)
+		if err == nil {
+			var r *dedup.Recipe
+			r, err = d.store.ParseRecipe(buf)
+			if err == nil {
+				d.markLive(r)
+			}
+		}
+		if err != nil {
+			tlog.Warn.Printf("dedup: recovery copy %s: %v", h, err)
+			d.errors++
+			continue
+		}
+		tlog.Warn.Printf("dedup: no file found for recovery copy %s. Delete it if the file was deleted.", h)
+	}
+	if d.errors > 0 {
+		// We may not have seen all recipes, so we cannot know which chunks
+		// are still needed
+		tlog.Fatal.Printf("dedup: %d errors, skipping garbage collection. Fix the errors and run again.", d.errors)
+		os.Exit(exitcodes.Other)
+	}
+	deleted, freed, err := d.store.GC(d.live)
+	if err != nil {
+		tlog.Fatal.Printf("dedup: garbage collection: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	var stored int64
+	err = d.store.WalkChunks(func(path string, id dedup.ID, ok bool) error {
+		fi, err := os.Lstat(path)
+		if err == nil {
+			stored += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		tlog.Warn.Printf("dedup: %v", err)
+	}
+	tlog.Info.Printf("dedup: %d files converted, %d restored, %d skipped. %d chunks deleted (%d bytes).",
+		d.converted, d.restored, d.skipped, deleted, freed)
+	tlog.Info.Printf(tlog.ColorGreen+"%d recipes reference %d bytes, stored in %d chunks using %d bytes."+tlog.ColorReset,
+		d.recipes, d.plainBytes, len(d.live), stored)
+	os.Exit(0)
+}
+
+// isDedupSpecial returns true for the files in CIPHERDIR that are not file
+// contents, like gocryptfs.diriv. The content files of long names are
+// named "gocryptfs.longname.*" and are not special.
+func isDedupSpecial(name string) bool {
+	return strings.HasPrefix(name, "gocryptfs.") &&
+		nametransform.NameType(name) != nametransform.LongNameContent
+}
+
+func (d *dedupRun) walkFn(root string) filepath.WalkFunc {
+	return func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", path, err)
+			d.errors++
+			return nil
+		}
+		if path == d.store.Dir() || path == filepath.Join(root, snapshot.DirName) {
+			// Snapshots have their own chunk store
+			return filepath.SkipDir
+		}
+		if path == filepath.Join(root, nametransform.JournalDirName) ||
+			path == filepath.Join(root, nametransform.LongSymlinkDirName) ||
+			path == filepath.Join(root, configfile.MetaDirName) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() || filepath.Dir(path) == root &&
+			(info.Name() == configfile.ConfDefaultName || configfile.IsBackupName(info.Name()) ||
+				tuning.IsStateFile(info.Name())) {
+			return nil
+		}
+		if isDedupSpecial(info.Name()) {
+			return nil
+		}
+		if filepath.Dir(path) == filepath.Join(root, nametransform.TrashDirName) &&
+			strings.HasSuffix(info.Name(), nametransform.TrashPathSuffix) {
+			// Encrypted original path of a file in the trash
+			return nil
+		}
+		if err := d.file(path); err != nil {
+			tlog.Warn.Printf("%s: %v", path, err)
+			d.errors++
+		}
+		return nil
+	}
+}
+
+// markLive adds the chunks of "r" to the live set.
+func (d *dedupRun) markLive(r *dedup.Recipe) {
+	for _, c := range r.Chunks {
+		d.live[c.ID] = struct{}{}
+	}
+}
+
+// file converts the file at "path" to a recipe, or checks the recipe that
+// is already there.
+func (d *dedupRun) file(path string) error {
+	writable := true
+	f, err := os.OpenFile(path, os.O_RDWR|syscall.O_NOFOLLOW, 0)
+	if os.IsPermission(err) {
+		writable = false
+		f, err = os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(st.Size())
+	if size < contentenc.HeaderLen {
+		// Empty file
+		return nil
+	}
+	hdr := make([]byte, contentenc.HeaderLen)
+	if _, err = f.ReadAt(hdr, 0); err != nil {
+		return err
+	}
+	fileID := hdr[2:]
+	if h := hex.EncodeToString(fileID); d.recovery[h] {
+		delete(d.recovery, h)
+		if err = d.recover(f, fileID, writable); err != nil {
+			return err
+		}
+		if st, err = f.Stat(); err != nil {
+			return err
+		}
+		size = uint64(st.Size())
+	}
+	if dedup.IsRecipeSize(d.cEnc, size) {
+		r, err := d.readRecipe(f, size)
+		if err != nil {
+			return err
+		}
+		for _, c := range r.Chunks {
+			if !d.store.Has(c.ID) {
+				return fmt.Errorf("chunk %s is missing", c.ID)
+			}
+		}
+		d.markLive(r)
+		d.recipes++
+		d.plainBytes += r.Size
+		return nil
+	}
+	if size == contentenc.HeaderLen {
+		// Header-only file, also empty
+		return nil
+	}
+	if !writable {
+		tlog.Info.Printf("%s: skipping, no write permission", path)
+		d.skipped++
+		return nil
+	}
+	if _, err = contentenc.ParseHeader(hdr); err != nil {
+		return err
+	}
+	r := dedup.NewRecipe(fileID)
+	c := d.store.NewChunker(&plainReader{f: f, cEnc: d.cEnc, fileID: fileID})
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		ref, err := d.store.Put(chunk)
+		if err != nil {
+			return err
+		}
+		r.Append(ref)
+	}
+	if err = d.store.Replace(f, r); err != nil {
+		return fmt.Errorf("replacing the file failed, run -dedup again to restore it: %w", err)
+	}
+	// Keep the mtime, the content has not changed
+	mtime := st.ModTime()
+	if err = syscallcompat.FutimesNano(int(f.Fd()), nil, &mtime); err != nil {
+		tlog.Warn.Printf("%s: %v", path, err)
+	}
+	tlog.Debug.Printf("%s: %d bytes in %d chunks", path, r.Size, len(r.Chunks))
+	d.markLive(r)
+	d.converted++
+	d.recipes++
+	d.plainBytes += r.Size
+	return nil
+}
+
+// readRecipe reads and parses the recipe file "f" of size "size".
+func (d *dedupRun) readRecipe(f *os.File, size uint64) (*dedup.Recipe, error) {
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return nil, err
+	}
+	return d.store.ParseRecipe(buf)
+}
+
+// recover handles a file whose recovery copy still exists, because
+// Materialize or Replace were interrupted. If the file is incomplete, it
+// is restored from the recovery copy.
+func (d *dedupRun) recover(f *os.File, fileID []byte, writable bool) error {
+	buf, err := d.store.LoadRecovery(fileID)
+	if err != nil {
+		return err
+	}
+	r, err := d.store.ParseRecipe(buf)
+	if err != nil {
+		return fmt.Errorf("recovery copy: %w", err)
+	}
+	// The chunks must survive until the file is fixed
+	d.markLive(r)
+	if d.complete(f) {
+		tlog.Info.Printf("%s: file is complete, deleting the recovery copy", f.Name())
+		return d.store.RemoveRecovery(fileID)
+	}
+	if !writable {
+		return fmt.Errorf("incomplete file, cannot restore it without write permission")
+	}
+	tlog.Info.Printf("%s: restoring incomplete file from recovery copy", f.Name())
+	if err = d.store.Replace(f, r); err != nil {
+		return err
+	}
+	d.restored++
+	return nil
+}
+
+// complete returns true if "f" is a valid recipe, or a regular file that
+// decrypts without errors.
+func (d *dedupRun) complete(f *os.File) bool {
+	st, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	if dedup.IsRecipeSize(d.cEnc, uint64(st.Size())) {
+		_, err = d.readRecipe(f, uint64(st.Size()))
+		return err == nil
+	}
+	hdr := make([]byte, contentenc.HeaderLen)
+	if _, err = f.ReadAt(hdr, 0); err != nil {
+		return false
+	}
+	if _, err = contentenc.ParseHeader(hdr); err != nil {
+		return false
+	}
+	_, err = io.Copy(io.Discard, &plainReader{f: f, cEnc: d.cEnc, fileID: hdr[2:]})
+	return err == nil
+}
+
+// plainReader decrypts a regular ciphertext file sequentially.
+type plainReader struct {
+	f       *os.File
+	cEnc    *contentenc.ContentEnc
+	fileID  []byte
+	blockNo uint64
+	// buf is decrypted data that has not been returned yet
+	buf []byte
+	eof bool
+}
+
+func (p *plainReader) Read(b []byte) (int, error) {
+	if len(p.buf) == 0 {
+		if p.eof {
+			return 0, io.EOF
+		}
+		ciphertext := make([]byte, contentenc.MaxKernelWrite/p.cEnc.PlainBS()*p.cEnc.CipherBS())
+		n, err := p.f.ReadAt(ciphertext, int64(p.cEnc.BlockNoToCipherOff(p.blockNo)))
+		if err == io.EOF {
+			p.eof = true
+		} else if err != nil {
+			return 0, err
+		}
+		plaintext, err := p.cEnc.DecryptBlocks(ciphertext[:n], p.blockNo, p.fileID)
+		if err != nil {
+			return 0, err
+		}
+		p.blockNo += uint64(n) / p.cEnc.CipherBS()
+		p.buf = plaintext
+		if len(p.buf) == 0 {
+			p.eof = true
+			return 0, io.EOF
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
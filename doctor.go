@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/doctor"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// doctorListMax is the number of paths that a finding lists at most
+const doctorListMax = 5
+
+// doctorCipherdir returns the directory whose backing filesystem the
+// doctor checks. In reverse mode, CIPHERDIR holds the plaintext, and the
+// encrypted view does not touch the disk.
+func doctorCipherdir(args *argContainer) string {
+	if args.reverse {
+		return ""
+	}
+	return args.cipherdir
+}
+
+// runDoctor implements "-doctor CIPHERDIR". It checks the system, the
+// config file and the directory tree of CIPHERDIR, and prints what it found,
+// errors first, together with advice how to fix them. Only the config file
+// is read, the password is not needed.
+// Does not return (calls os.Exit both on success and on error).
+func runDoctor(args *argContainer) {
+	findings := doctor.Environment(doctorCipherdir(args))
+	findings = append(findings, doctorVolume(args)...)
+	doctor.Sort(findings)
+	var nErr, nWarn int
+	for _, f := range findings {
+		color := ""
+		switch f.Severity {
+		case doctor.Error:
+			color = tlog.ColorRed
+			nErr++
+		case doctor.Warning:
+			color = tlog.ColorYellow
+			nWarn++
+		}
+		fmt.Printf("%s%-7s%s %s: %s\n", color, strings.ToUpper(f.Severity.String()), tlog.ColorReset, f.Check, f.Message)
+		if f.Advice != "" {
+			fmt.Printf("        %s\n", f.Advice)
+		}
+	}
+	if doctor.Worst(findings) > doctor.Info {
+		tlog.Info.Printf("%d errors, %d warnings", nErr, nWarn)
+		os.Exit(exitcodes.Doctor)
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "No problems found." + tlog.ColorReset)
+	os.Exit(0)
+}
+
+// doctorVolume checks the config file, the feature flags and the directory
+// tree of CIPHERDIR
+func doctorVolume(args *argContainer) (out []doctor.Finding) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		return append(out, doctor.Finding{
+			Severity: doctor.Error,
+			Check:    "config",
+			Message:  fmt.Sprintf("Cannot load %s: %v.", args.config, err),
+			Advice:   "Restore the config file from a backup, or mount with -masterkey.",
+		})
+	}
+	if cf.NeedsRepair() {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Error,
+			Check:    "config",
+			Message:  fmt.Sprintf("%s is damaged or has been modified, the backup copy %s works.", args.config, cf.LoadedFrom()),
+			Advice:   "Unlock the filesystem, gocryptfs offers to restore the config file from the backup copy.",
+		})
+	}
+	if missing := cf.MissingCopies(); len(missing) > 0 && !cf.NeedsRepair() {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Warning,
+			Check:    "config",
+			Message:  fmt.Sprintf("Backup copies are missing or damaged: %s.", strings.Join(missing, ", ")),
+			Advice:   "They are recreated the next time the config file is written, for example by -passwd.",
+		})
+	}
+	out = append(out, doctor.Finding{Severity: doctor.Info, Check: "config",
+		Message: fmt.Sprintf("Config file version %d, feature flags %s.", cf.SchemaVersion(), strings.Join(cf.FeatureFlags, " "))})
+	if len(cf.PendingMigrations()) > 0 {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Info,
+			Check:    "feature flags",
+			Message:  fmt.Sprintf("The config file can be upgraded to version %d.", configfile.ConfigVersionCurrent),
+			Advice:   "Run \"gocryptfs -upgrade-config\".",
+		})
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFilenameAuth) && !cf.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded) {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Info,
+			Check:    "feature flags",
+			Message:  "The filesystem uses the old filename authentication format.",
+			Advice:   "Run \"gocryptfs -migrate-filenameauth\".",
+		})
+	}
+	if args.reverse {
+		// CIPHERDIR is the plaintext directory
+		return out
+	}
+	out = append(out, doctorTree(args.cipherdir, cf)...)
+	if l, err := configNameLimits(cf, args.cipherdir); err == nil {
+		f := doctor.Finding{Severity: doctor.Info, Check: "names",
+			Message: fmt.Sprintf("Plaintext names can be %d bytes long, %d bytes without hashing; the backing filesystem allows %d bytes.",
+				l.Max, l.Direct, l.BackingMax)}
+		if l.Max < nametransform.NameMax {
+			f.Severity = doctor.Warning
+			f.Advice = "Programs expect 255 bytes. Check a tree with \"gocryptfs -check-names CIPHERDIR TREE\" before copying it in."
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// doctorTree walks CIPHERDIR and checks that every directory has a
+// gocryptfs.diriv file, if the feature flags call for it, and that there
+// are no long name files if they do not
+func doctorTree(cipherdir string, cf *configfile.ConfFile) (out []doctor.Finding) {
+	needDirIV := cf.IsFeatureFlagSet(configfile.FlagDirIV)
+	longNames := cf.IsFeatureFlagSet(configfile.FlagLongNames)
+	var noDirIV, badLongNames []string
+	err := filepath.WalkDir(cipherdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := d.Name()
+		if !d.IsDir() {
+			if !longNames && nametransform.NameType(name) != nametransform.LongNameNone {
+				badLongNames = append(badLongNames, path)
+			}
+			return nil
+		}
+		if filepath.Dir(path) == cipherdir && isSpecialDir(name) {
+			return filepath.SkipDir
+		}
+		if needDirIV {
+			if _, err := os.Lstat(filepath.Join(path, nametransform.DirIVFilename)); err != nil {
+				noDirIV = append(noDirIV, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Error,
+			Check:    "tree",
+			Message:  fmt.Sprintf("Cannot walk %s: %v.", cipherdir, err),
+			Advice:   "Check the permissions of CIPHERDIR.",
+		})
+	}
+	if len(noDirIV) > 0 {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Error,
+			Check:    "diriv",
+			Message: fmt.Sprintf("Directories without %s, whose entries cannot be decrypted (%d): %s.",
+				nametransform.DirIVFilename, len(noDirIV), doctorList(noDirIV)),
+			Advice: "Restore the files from a backup. \"gocryptfs -fsck\" lists the affected files.",
+		})
+	}
+	if len(badLongNames) > 0 {
+		out = append(out, doctor.Finding{
+			Severity: doctor.Error,
+			Check:    "feature flags",
+			Message: fmt.Sprintf("The LongNames feature flag is not set, but there are long name files (%d): %s.",
+				len(badLongNames), doctorList(badLongNames)),
+			Advice: "The config file belongs to another filesystem, or has been modified. Restore it from a backup.",
+		})
+	}
+	return out
+}
+
+// doctorList joins the first doctorListMax paths in "paths"
+func doctorList(paths []string) string {
+	if len(paths) <= doctorListMax {
+		return strings.Join(paths, ", ")
+	}
+	return strings.Join(paths[:doctorListMax], ", ") + ", ..."
+}
+
+// doctorWarn runs the doctor checks for settings that put the master key or
+// plaintext at risk at mount time, and prints what they found. The checks
+// run before Landlock restricts access to /proc and /sys.
+func doctorWarn(args *argContainer) {
+	for _, f := range doctor.Run(doctorCipherdir(args)) {
+		tlog.Info.Printf(tlog.ColorYellow+"Warning: %s Run \"gocryptfs -doctor\" for advice."+tlog.ColorReset, f.Message)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/doctor"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+)
+
+func TestDoctorTree(t *testing.T) {
+	dir := t.TempDir()
+	for _, p := range []string{
+		nametransform.DirIVFilename,
+		"ok/" + nametransform.DirIVFilename,
+		"ok/gocryptfs.longname.aaa",
+		"bad/x",
+		// Snapshots are skipped
+		snapshot.DirName + "/daily/x",
+	} {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Flags match the tree except for "bad"
+	cf := &configfile.ConfFile{FeatureFlags: []string{"DirIV", "LongNames"}}
+	out := doctorTree(dir, cf)
+	if len(out) != 1 || out[0].Check != "diriv" || out[0].Severity != doctor.Error ||
+		!strings.Contains(out[0].Message, filepath.Join(dir, "bad")) {
+		t.Fatalf("have %v", out)
+	}
+	// Without LongNames, the long name file does not belong there
+	cf = &configfile.ConfFile{FeatureFlags: []string{"DirIV"}}
+	out = doctorTree(dir, cf)
+	if len(out) != 2 || out[1].Check != "feature flags" || !strings.Contains(out[1].Message, "gocryptfs.longname.aaa") {
+		t.Fatalf("have %v", out)
+	}
+	// Without DirIV, no gocryptfs.diriv files are needed
+	cf = &configfile.ConfFile{FeatureFlags: []string{"LongNames"}}
+	if out = doctorTree(dir, cf); len(out) != 0 {
+		t.Fatalf("have %v", out)
+	}
+}
+
+func TestDoctorList(t *testing.T) {
+	if have := doctorList([]string{"a", "b"}); have != "a, b" {
+		t.Errorf("have %q", have)
+	}
+	if have := doctorList([]string{"a", "b", "c", "d", "e", "f"}); have != "a, b, c, d, e, ..." {
+		t.Errorf("have %q", have)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// duressWarning is shown before "-duress-passwd" asks for the password
+const duressWarning = `WARNING: You are about to set a duress password.
+Entering the duress password instead of your password, when mounting or for
+any other operation, DESTROYS THE MASTER KEY in gocryptfs.conf, its backup
+copies and the snapshots, and then fails like a wrong password does.
+Your password will no longer work. Without the master key that was printed
+when the filesystem was created ("-masterkey"), ALL DATA WILL BE LOST.
+Anybody who can read gocryptfs.conf can see that a duress password is set,
+and copies of gocryptfs.conf elsewhere, like in backups, are not destroyed.`
+
+// changeDuress implements "-duress-passwd" and "-duress-remove"
+func changeDuress(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		tlog.Fatal.Printf("A duress password is not supported on FIDO2-enabled filesystems.")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.duress_remove {
+		if confFile.Duress == nil {
+			tlog.Info.Printf("No duress password is set.")
+			return
+		}
+		confFile.RemoveDuressPassword()
+		writeDuressConfig(confFile)
+		tlog.Info.Printf(tlog.ColorGreen + "Duress password removed." + tlog.ColorReset)
+		return
+	}
+	tlog.Warn.Printf(tlog.ColorRed + duressWarning + tlog.ColorReset)
+	if !readpassword.Confirm("Set a duress password?") {
+		tlog.Fatal.Printf("Aborted. -duress-passwd must be confirmed on a terminal.")
+		os.Exit(exitcodes.Usage)
+	}
+	tlog.Info.Println("Please enter the duress password.")
+	pw, err := readpassword.Twice(nil, nil)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	logN := confFile.ScryptObject.LogN()
+	if args._explicitScryptn {
+		logN = args.scryptn
+	}
+	err = confFile.SetDuressPassword(pw, logN)
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Usage)
+	}
+	writeDuressConfig(confFile)
+	tlog.Info.Printf(tlog.ColorYellow + "Duress password set. Keep the master key in a safe place." + tlog.ColorReset)
+}
+
+// writeDuressConfig writes "cf", or exits
+func writeDuressConfig(cf *configfile.ConfFile) {
+	if err := cf.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+}
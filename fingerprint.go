@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkCipherdirFingerprint compares the fingerprint of "masterkey" with
+// the one stored in CIPHERDIR, which catches a "-config" or "-masterkey"
+// that belongs to a different filesystem before it causes a flood of
+// decryption errors. A CIPHERDIR without a fingerprint gets one, unless it
+// is mounted read-only.
+func checkCipherdirFingerprint(args *argContainer, masterkey []byte) error {
+	if args.reverse {
+		// CIPHERDIR is the plaintext directory
+		return nil
+	}
+	fp := configfile.KeyFingerprint(masterkey)
+	stored := nametransform.ReadRootFingerprint(args.cipherdir)
+	if stored == nil {
+		if !args.ro {
+			storeCipherdirFingerprint(args.cipherdir, fp)
+		}
+		return nil
+	}
+	if !bytes.Equal(stored, fp) {
+		return fatalErr(exitcodes.KeyMismatch, "The master key has the fingerprint %x, but %s belongs to %x. "+
+			"Is the master key, or the config file, from a different filesystem?", fp, args.cipherdir, stored)
+	}
+	return nil
+}
+
+// storeCipherdirFingerprint stores "fp" in "cipherdir". Filesystems without
+// gocryptfs.diriv in the root, and backing filesystems without xattrs, do
+// without.
+func storeCipherdirFingerprint(cipherdir string, fp []byte) {
+	err := nametransform.WriteRootFingerprint(cipherdir, fp)
+	if err != nil && !errors.Is(err, syscall.ENOENT) {
+		tlog.Debug.Printf("Could not store the master key fingerprint in %s: %v", cipherdir, err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+func TestCheckCipherdirFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	args := &argContainer{cipherdir: dir}
+	key1 := bytes.Repeat([]byte{1}, cryptocore.KeyLen)
+	key2 := bytes.Repeat([]byte{2}, cryptocore.KeyLen)
+	// Without gocryptfs.diriv there is nothing to check
+	if err := checkCipherdirFingerprint(args, key1); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, nametransform.DirIVFilename), cryptocore.RandBytes(16), 0400); err != nil {
+		t.Fatal(err)
+	}
+	// Read-only mounts do not store the fingerprint
+	args.ro = true
+	if err := checkCipherdirFingerprint(args, key1); err != nil {
+		t.Fatal(err)
+	}
+	if fp := nametransform.ReadRootFingerprint(dir); fp != nil {
+		t.Fatalf("fingerprint stored on a read-only mount: %x", fp)
+	}
+	args.ro = false
+	if err := checkCipherdirFingerprint(args, key1); err != nil {
+		t.Fatal(err)
+	}
+	if nametransform.ReadRootFingerprint(dir) == nil {
+		t.Skip("xattrs are not supported on " + dir)
+	}
+	if err := checkCipherdirFingerprint(args, key1); err != nil {
+		t.Errorf("same key: %v", err)
+	}
+	err := checkCipherdirFingerprint(args, key2)
+	if e, ok := err.(exitcodes.Err); !ok || e.Code() != exitcodes.KeyMismatch {
+		t.Errorf("other key: %v", err)
+	}
+}
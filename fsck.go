@@ -4,19 +4,25 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
 )
 
 type fsckObj struct {
@@ -168,6 +174,10 @@ func (ck *fsckObj) file(relPath string) {
 		ck.seenInodes[st.Ino] = struct{}{}
 	}
 	ck.xattrs(relPath)
+	// Open() checks the authenticated mtime, and Read() goes through the
+	// whole file. Catch transparently mitigated corruptions of both.
+	go ck.watchMitigatedCorruptionsRead(relPath)
+	defer func() { ck.watchDone <- struct{}{} }()
 	f, err := os.Open(ck.abs(relPath))
 	if err != nil {
 		fmt.Printf("fsck: error opening file %q: %v\n", relPath, err)
@@ -183,9 +193,6 @@ func (ck *fsckObj) file(relPath string) {
 	allZero := make([]byte, fuse.MAX_KERNEL_WRITE)
 	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
 	var off int64
-	// Read() through the whole file and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsRead(relPath)
-	defer func() { ck.watchDone <- struct{}{} }()
 	for {
 		if ck.abort {
 			return
@@ -306,12 +313,15 @@ func fsck(args *argContainer) (exitcode int) {
 	// Recursively check the root dir
 	tlog.Info.Println(tlog.ColorGreen + "Checking filesystem..." + tlog.ColorReset)
 	ck.dir("")
+	ck.dedupRecovery()
+	ck.longSymlinks(args.cipherdir)
 	// Report results
 	wipeKeys()
 	if ck.abort {
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
 	}
+	saveFsckResult(args, len(ck.corruptList), len(ck.skippedList))
 	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
 		tlog.Info.Printf("fsck summary: no problems found\n")
 		return 0
@@ -323,6 +333,95 @@ func fsck(args *argContainer) (exitcode int) {
 	return exitcodes.FsckErrors
 }
 
+// saveFsckResult records the result of the check in the tuning state file,
+// where "-info" shows it. -fsck runs with -ro, so this does not go through
+// saveTuningState. Snapshots are not modified.
+func saveFsckResult(args *argContainer, corrupt int, skipped int) {
+	if args.from_snapshot != "" {
+		return
+	}
+	st := loadTuningState(args)
+	st.LastFsck = &tuning.FsckResult{
+		Time:    time.Now(),
+		Corrupt: corrupt,
+		Skipped: skipped,
+	}
+	if err := st.Save(args.cipherdir); err != nil {
+		// CIPHERDIR may be on read-only media
+		tlog.Debug.Printf("Could not save %s: %v", tuning.FileName, err)
+	}
+}
+
+// dedupRecovery reports files whose conversion to or from a dedup recipe
+// was interrupted. The files themselves are reported as corrupt by
+// ck.file if they are incomplete.
+func (ck *fsckObj) dedupRecovery() {
+	s := ck.rootNode.Dedup()
+	if s == nil {
+		return
+	}
+	fileIDs, err := s.ListRecovery()
+	if err != nil {
+		fmt.Printf("fsck: error listing dedup recovery copies: %v\n", err)
+		ck.markCorrupt(dedup.DirName)
+		return
+	}
+	for _, id := range fileIDs {
+		fmt.Printf("fsck: interrupted dedup conversion of file ID %x, run \"gocryptfs -dedup\" to finish it\n", id)
+		ck.markCorrupt(fmt.Sprintf("%s: file ID %x", dedup.DirName, id))
+	}
+}
+
+// longSymlinks checks the files that hold the targets of long symlinks
+// (see -long-symlinks). A symlink whose target file is missing or damaged
+// is reported by ck.symlink, because it cannot be read. A damaged file is
+// also reported here, and a file that no symlink refers to is listed, but
+// is not an error.
+func (ck *fsckObj) longSymlinks(cipherdir string) {
+	if !ck.rootNode.LongSymlinks() {
+		return
+	}
+	names, err := readNames(filepath.Join(cipherdir, nametransform.LongSymlinkDirName))
+	if err != nil {
+		fmt.Printf("fsck: error listing long symlink targets: %v\n", err)
+		ck.markCorrupt(nametransform.LongSymlinkDirName)
+		return
+	}
+	if len(names) == 0 {
+		return
+	}
+	// The symlinks in the directory tree and in the trash refer to targets
+	refs := make(map[string]bool)
+	filepath.WalkDir(cipherdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() && filepath.Dir(path) == cipherdir && isSpecialDir(name) && name != nametransform.TrashDirName {
+			return filepath.SkipDir
+		}
+		if d.Type() == fs.ModeSymlink {
+			if target, err := os.Readlink(path); err == nil && nametransform.IsLongSymlinkRef(target) {
+				refs[target] = true
+			}
+		}
+		return nil
+	})
+	sort.Strings(names)
+	for _, n := range names {
+		if strings.HasSuffix(n, ".tmp") {
+			continue
+		}
+		ref := nametransform.LongSymlinkPrefix + n
+		if _, err := nametransform.ReadLongSymlink(cipherdir, ref); err != nil {
+			fmt.Printf("fsck: corrupt long symlink target: %v\n", err)
+			ck.markCorrupt(filepath.Join(nametransform.LongSymlinkDirName, n))
+		} else if !refs[ref] {
+			fmt.Printf("fsck: long symlink target %s is not used by any symlink, \"gocryptfs -gc\" removes it\n", n)
+		}
+	}
+}
+
 func inum(f *os.File) uint64 {
 	var st syscall.Stat_t
 	err := syscall.Fstat(int(f.Fd()), &st)
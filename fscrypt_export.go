@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fscrypt"
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// unlockFscrypt adds the key from "-fscrypt-key" to the filesystem that
+// contains "dir" and returns its identifier. Exits on error.
+func unlockFscrypt(args *argContainer, dir string) fscrypt.Identifier {
+	key, err := fscrypt.ReadKeyFile(args.fscrypt_key)
+	if err != nil {
+		tlog.Fatal.Printf("-fscrypt-key: %v", err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	id, err := fscrypt.AddKey(dir, key)
+	for i := range key {
+		key[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Adding the fscrypt key to %s failed: %v", dir, err)
+		os.Exit(exitcodes.Import)
+	}
+	return id
+}
+
+// lockFscrypt removes the key "id" again, see unlockFscrypt
+func lockFscrypt(dir string, id fscrypt.Identifier) {
+	if err := fscrypt.RemoveKey(dir, id); err != nil {
+		tlog.Warn.Printf("Removing fscrypt key %s failed: %v", id, err)
+	}
+}
+
+// openFscryptImport implements importSource.open for "-import fscrypt". The
+// plaintext of an fscrypt directory is readable in place once its key has
+// been added.
+func openFscryptImport(args *argContainer) (string, func()) {
+	dir := args._importSrc
+	id := unlockFscrypt(args, dir)
+	have, err := fscrypt.GetPolicy(dir)
+	if err == nil && have != id {
+		err = fmt.Errorf("it is encrypted with key %s, but -fscrypt-key has key %s", have, id)
+	}
+	if err != nil {
+		lockFscrypt(dir, id)
+		tlog.Fatal.Printf("Cannot import %s: %v", dir, err)
+		os.Exit(exitcodes.Import)
+	}
+	tlog.Info.Printf("Unlocked the fscrypt directory %s with key %s", dir, id)
+	return dir, func() { lockFscrypt(dir, id) }
+}
+
+// exportFscrypt implements "-export-fscrypt DIR". It copies the plaintext
+// of CIPHERDIR into DIR, which is encrypted by the kernel with the key from
+// "-fscrypt-key". DIR must be empty or have been encrypted with the same
+// key by an earlier, interrupted export, which is resumed. The key is
+// removed from the kernel again at the end.
+// Does not return (calls os.Exit both on success and on error).
+func exportFscrypt(args *argContainer) {
+	dir, _ := filepath.Abs(args.export_fscrypt)
+	if err := isDir(dir); err != nil {
+		tlog.Fatal.Printf("-export-fscrypt: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	id := unlockFscrypt(args, dir)
+	have, err := fscrypt.GetPolicy(dir)
+	if err == fscrypt.ErrNotEncrypted {
+		if err = isEmptyDir(dir); err == nil {
+			err = fscrypt.SetPolicy(dir, id)
+		}
+	} else if err == nil && have != id {
+		err = fmt.Errorf("it is encrypted with key %s, but -fscrypt-key has key %s", have, id)
+	}
+	if err != nil {
+		lockFscrypt(dir, id)
+		tlog.Fatal.Printf("Cannot export to %s: %v", dir, err)
+		os.Exit(exitcodes.Import)
+	}
+	tlog.Info.Printf("Exporting to %s, encrypted with fscrypt key %s", dir, id)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	nErrors, err := exportTree(ctx, args, dir)
+	cancel()
+	lockFscrypt(dir, id)
+	if err != nil {
+		tlog.Fatal.Printf("-export-fscrypt: %v", err)
+		if ctx.Err() != nil {
+			tlog.Info.Printf("Run the same command again to resume the export.")
+		}
+		os.Exit(exitcodes.Import)
+	}
+	if nErrors > 0 {
+		tlog.Fatal.Printf("-export-fscrypt: %d files could not be exported, see the messages above", nErrors)
+		os.Exit(exitcodes.Import)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"The filesystem has been exported to %s."+tlog.ColorReset, dir)
+	os.Exit(0)
+}
+
+// exportTree copies the plaintext of CIPHERDIR into "dst". Returns the
+// number of files that could not be exported.
+func exportTree(ctx context.Context, args *argContainer, dst string) (int, error) {
+	raw, rootNode, wipeKeys := initRawFS(args)
+	defer wipeKeys()
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		defer x.AfterUnmount()
+	}
+	ex := &exporter{
+		src:          rawfs.New(raw, true),
+		copyProgress: copyProgress{verb: "Exported", report: tlog.Info.Printf},
+	}
+	if err := ex.scan(ctx); err != nil {
+		return 0, err
+	}
+	err := ex.run(ctx, dst)
+	ex.progress(true)
+	return ex.errors, err
+}
+
+// exporter copies a gocryptfs filesystem into a plaintext directory tree.
+// It is the counterpart of importer and keeps the same attributes.
+type exporter struct {
+	src *rawfs.FS
+	copyProgress
+}
+
+// walk calls "fn" for everything below the directory "name" in ex.src,
+// see walkRawFS.
+func (ex *exporter) walk(ctx context.Context, name string, fn func(name string, fi os.FileInfo) error) error {
+	return walkRawFS(ctx, ex.src, name, fn)
+}
+
+// walkRawFS calls "fn" for everything below the directory "name" in "src",
+// parents first and in lexical order. Directories are not descended into
+// if "fn" returns fs.SkipDir for them.
+func walkRawFS(ctx context.Context, src *rawfs.FS, name string, fn func(name string, fi os.FileInfo) error) error {
+	d, err := src.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	fis, err := d.Readdir(-1)
+	d.Close()
+	if err != nil {
+		return err
+	}
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	for _, fi := range fis {
+		child := path.Join(name, fi.Name())
+		err := fn(child, fi)
+		if err == fs.SkipDir {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err := walkRawFS(ctx, src, child, fn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scan counts the files and bytes in ex.src for the progress report
+func (ex *exporter) scan(ctx context.Context) error {
+	return ex.walk(ctx, "", func(name string, fi os.FileInfo) error {
+		ex.totalFiles++
+		if fi.Mode().IsRegular() {
+			ex.totalBytes += fi.Size()
+		}
+		return nil
+	})
+}
+
+// run copies ex.src into the directory "dst". Stops early with an error if
+// "ctx" is canceled. Errors on individual files are counted in ex.errors.
+func (ex *exporter) run(ctx context.Context, dst string) error {
+	// The directories get their permissions and times after their
+	// contents have been written
+	var dirs []string
+	err := ex.walk(ctx, "", func(name string, fi os.FileInfo) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		dstPath := filepath.Join(dst, filepath.FromSlash(name))
+		var err error
+		switch t := fi.Mode(); {
+		case t.IsDir():
+			err = os.Mkdir(dstPath, 0700)
+			if os.IsExist(err) {
+				err = nil
+			}
+			if err == nil {
+				dirs = append(dirs, name)
+			}
+		case t.IsRegular():
+			err = ex.copyFile(ctx, name, fi, dstPath)
+		case t&os.ModeSymlink != 0:
+			err = ex.copySymlink(ctx, name, dstPath)
+		default:
+			tlog.Warn.Printf("%s: skipping %s, only files, directories and symlinks are exported", name, t.Type())
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", name, err)
+			ex.errors++
+			if fi.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		ex.files++
+		ex.progress(false)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		fi, err := ex.src.Stat(ctx, dirs[i])
+		if err == nil {
+			err = ex.copyAttrs(ctx, dirs[i], fi, filepath.Join(dst, filepath.FromSlash(dirs[i])))
+		}
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", dirs[i], err)
+			ex.errors++
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file "name" to "dstPath"
+func (ex *exporter) copyFile(ctx context.Context, name string, fi os.FileInfo, dstPath string) error {
+	if have, err := os.Lstat(dstPath); err == nil && have.Mode().IsRegular() &&
+		have.Size() == fi.Size() && have.ModTime().Equal(fi.ModTime()) {
+		// Exported by an earlier run
+		ex.bytes += fi.Size()
+		return nil
+	}
+	in, err := ex.src.OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Writable for us until copyAttrs sets the real permissions
+	out, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := ex.copyData(ctx, out, in); err != nil {
+		// The modification time has not been set yet, so the next run
+		// copies the file again
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return ex.copyAttrs(ctx, name, fi, dstPath)
+}
+
+// copySymlink copies the symlink "name" to "dstPath"
+func (ex *exporter) copySymlink(ctx context.Context, name string, dstPath string) error {
+	target, err := ex.src.Readlink(ctx, name)
+	if err != nil {
+		return err
+	}
+	if have, err := os.Readlink(dstPath); err == nil && have == target {
+		return nil
+	} else if err == nil {
+		// Left over from an earlier run, but the target has changed
+		if err := os.Remove(dstPath); err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, dstPath)
+}
+
+// copyAttrs copies the "user." extended attributes, the permissions and the
+// modification time of "name" to "dstPath". The modification time is set last,
+// it marks a file as completely exported.
+func (ex *exporter) copyAttrs(ctx context.Context, name string, fi os.FileInfo, dstPath string) error {
+	attrs, err := ex.src.Listxattr(ctx, name)
+	if err != nil && err != syscall.ENOTSUP {
+		return fmt.Errorf("listing xattrs: %w", err)
+	}
+	for _, a := range attrs {
+		if !strings.HasPrefix(a, "user.") {
+			continue
+		}
+		val, err := ex.src.Getxattr(ctx, name, a)
+		if err != nil {
+			return fmt.Errorf("reading xattr %s: %w", a, err)
+		}
+		if err := unix.Lsetxattr(dstPath, a, val, 0); err != nil {
+			return fmt.Errorf("writing xattr %s: %w", a, err)
+		}
+	}
+	if err := os.Chmod(dstPath, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dstPath, time.Now(), fi.ModTime())
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// newTestExporter returns an exporter that reads "src" through go-fuse's
+// loopback node tree
+func newTestExporter(t *testing.T, src string) *exporter {
+	root, err := fs.NewLoopbackRoot(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &exporter{
+		src:          rawfs.New(fs.NewNodeFS(root, &fs.Options{}), true),
+		copyProgress: copyProgress{verb: "Exported", report: t.Logf},
+	}
+}
+
+func TestExportTree(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := bytes.Repeat([]byte("x"), 300000)
+	if err := os.MkdirAll(src+"/d/e", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src+"/d/f", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d/f", src+"/l"); err != nil {
+		t.Fatal(err)
+	}
+	xattr := unix.Lsetxattr(src+"/d/f", "user.foo", []byte("bar"), 0) == nil
+	for _, p := range []string{"/d/f", "/d/e", "/d"} {
+		if err := os.Chtimes(src+p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := t.TempDir()
+	ex := newTestExporter(t, src)
+	if err := ex.scan(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ex.totalFiles != 4 || ex.totalBytes != int64(len(content)) {
+		t.Errorf("totalFiles=%d totalBytes=%d", ex.totalFiles, ex.totalBytes)
+	}
+	if err := ex.run(context.Background(), dst); err != nil || ex.errors != 0 {
+		t.Fatalf("err=%v errors=%d", err, ex.errors)
+	}
+	have, err := os.ReadFile(dst + "/d/f")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("err=%v len=%d", err, len(have))
+	}
+	for p, mode := range map[string]os.FileMode{"/d": 0750, "/d/e": 0750, "/d/f": 0640} {
+		fi, err := os.Stat(dst + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mode=%v mtime=%v", p, fi.Mode(), fi.ModTime())
+		}
+	}
+	if target, err := os.Readlink(dst + "/l"); err != nil || target != "d/f" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+	if xattr {
+		if val, err := syscallcompat.Lgetxattr(dst+"/d/f", "user.foo"); err != nil || string(val) != "bar" {
+			t.Errorf("xattr: val=%q err=%v", val, err)
+		}
+	}
+	// Resume: a file with the same size and mtime is not copied again
+	marker := bytes.Repeat([]byte("y"), len(content))
+	if err := os.WriteFile(dst+"/d/f", marker, 0640); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(dst+"/d/f", mtime, mtime)
+	ex = newTestExporter(t, src)
+	if err := ex.run(context.Background(), dst); err != nil || ex.errors != 0 {
+		t.Fatalf("err=%v errors=%d", err, ex.errors)
+	}
+	if have, _ = os.ReadFile(dst + "/d/f"); !bytes.Equal(have, marker) {
+		t.Error("exported file has been copied again")
+	}
+}
+
+func TestExportCanceled(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(src+"/f", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	ex := newTestExporter(t, src)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := ex.run(ctx, dst); err == nil {
+		t.Error("canceled export should fail")
+	}
+	if _, err := os.Stat(dst + "/f"); !os.IsNotExist(err) {
+		t.Errorf("file was exported anyway: %v", err)
+	}
+}
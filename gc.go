@@ -0,0 +1,477 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+)
+
+// Kinds of artifacts that "-gc" removes
+const (
+	// gcOrphanedLongName is a "gocryptfs.longname.*.name" file without
+	// its content file
+	gcOrphanedLongName = "orphaned_longname"
+	// gcTemporary is a temporary file or directory left behind by an
+	// interrupted write
+	gcTemporary = "temporary"
+	// gcTrashOrphan is a file in the trash without its ".path" file, or
+	// the other way round
+	gcTrashOrphan = "trash_orphan"
+	// gcTrashExpired is a file in the trash, or its ".path" file, whose
+	// "-trash" retention period is over
+	gcTrashExpired = "trash_expired"
+	// gcJournal is a record in the long name journal
+	gcJournal = "journal"
+	// gcOrphanedLongSymlink is a file in "gocryptfs.longsymlinks" that no
+	// symlink refers to
+	gcOrphanedLongSymlink = "orphaned_longsymlink"
+	// gcOrphanedKeyShare is a key share in "gocryptfs.keys" whose file has
+	// been deleted
+	gcOrphanedKeyShare = "orphaned_keyshare"
+)
+
+// gcItem is an artifact that "-gc" has found
+type gcItem struct {
+	// Path is relative to CIPHERDIR
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`
+	Bytes   int64  `json:"bytes"`
+	Removed bool   `json:"removed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// gcReport is the result of "-gc", printed by "-gc -json"
+type gcReport struct {
+	DryRun     bool     `json:"dry_run"`
+	Items      []gcItem `json:"items"`
+	Removed    int      `json:"removed"`
+	FreedBytes int64    `json:"freed_bytes"`
+	Errors     int      `json:"errors"`
+}
+
+// gcRun holds the state of "gocryptfs -gc".
+type gcRun struct {
+	cipherdir string
+	// longNames is false with "-plaintextnames", where
+	// "gocryptfs.longname.*" are ordinary names
+	longNames bool
+	// manifests is set when "gocryptfs.manifest.tmp" is a reserved name
+	manifests bool
+	// longSymlinks is set with the LongSymlinks feature flag
+	longSymlinks bool
+	// symlinkRefs are the long symlink targets that walkFn has found
+	// references to
+	symlinkRefs map[string]bool
+	// keyShares is set with the HeaderV3 feature flag
+	keyShares bool
+	// fileIDs are the file IDs (in hex) of the files that walkFn has
+	// found, and fileIDsIncomplete is set if a file could not be read
+	fileIDs           map[string]bool
+	fileIDsIncomplete bool
+	// trash is the "-trash" retention period, or 0
+	trash  time.Duration
+	now    time.Time
+	dryRun bool
+	report gcReport
+}
+
+// runGC implements "-gc". It removes orphaned long name files, temporary
+// files of interrupted writes, broken or (with "-trash") expired trash
+// entries and leftover long name journal records. Only the config file is
+// read, the password is not needed.
+// Does not return (calls os.Exit both on success and on error).
+func runGC(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-gc cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	unlock, err := lockCipherdir(args.cipherdir, true)
+	if err == errCipherdirInUse {
+		tlog.Fatal.Printf("-gc: %s is mounted or in use", args.cipherdir)
+		os.Exit(exitcodes.CipherDir)
+	} else if err != nil {
+		tlog.Fatal.Printf("Cannot lock %s: %v", args.cipherdir, err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	defer unlock()
+	g := gcRun{
+		cipherdir:    args.cipherdir,
+		longNames:    !cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		manifests:    cf.IsFeatureFlagSet(configfile.FlagDirManifest),
+		longSymlinks: cf.IsFeatureFlagSet(configfile.FlagLongSymlinks),
+		keyShares:    cf.IsFeatureFlagSet(configfile.FlagHeaderV3),
+		trash:        args._trash,
+		now:          time.Now(),
+		dryRun:       args.dry_run,
+	}
+	if args.json {
+		// Only the report goes to stdout
+		tlog.Info.Enabled = false
+	}
+	tlog.Info.Printf("Collecting garbage in %q.", args.cipherdir)
+	err = g.run()
+	if args.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(g.report)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-gc: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	r := g.report
+	if g.dryRun {
+		tlog.Info.Printf("Dry run: would remove %d items.", len(r.Items))
+	} else {
+		tlog.Info.Printf(tlog.ColorGreen+"Removed %d items, %d bytes freed."+tlog.ColorReset,
+			r.Removed, r.FreedBytes)
+	}
+	if r.Errors > 0 {
+		tlog.Fatal.Printf("-gc: %d items could not be removed", r.Errors)
+		os.Exit(exitcodes.Other)
+	}
+	os.Exit(0)
+}
+
+// run finds, and unless dryRun is set, removes the garbage.
+func (g *gcRun) run() error {
+	g.report.DryRun = g.dryRun
+	if err := filepath.WalkDir(g.cipherdir, g.walkFn); err != nil {
+		return err
+	}
+	if err := g.metaDir(); err != nil {
+		return err
+	}
+	if err := g.dedupStore(); err != nil {
+		return err
+	}
+	leftovers, err := snapshot.Leftovers(g.cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, p := range leftovers {
+		g.removeWith(p, gcTemporary, snapshot.RemoveLeftover)
+	}
+	if err = g.trashDir(); err != nil {
+		return err
+	}
+	if err = g.longSymlinkDir(); err != nil {
+		return err
+	}
+	if err = g.keyStoreDir(); err != nil {
+		return err
+	}
+	return g.journal()
+}
+
+// walkFn checks the entries of the directory tree. The special directories
+// in the root are handled separately.
+func (g *gcRun) walkFn(path string, d fs.DirEntry, err error) error {
+	if err != nil {
+		return err
+	}
+	name := d.Name()
+	inRoot := filepath.Dir(path) == g.cipherdir
+	if d.IsDir() {
+		if inRoot && isSpecialDir(name) {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	if d.Type() == fs.ModeSymlink {
+		g.addSymlinkRef(path)
+		return nil
+	}
+	if d.Type().IsRegular() {
+		g.addFileID(path)
+	}
+	switch {
+	case inRoot && (configfile.IsTmpName(name) || tuning.IsStateFile(name) && name != tuning.FileName):
+		g.remove(path, gcTemporary)
+	case g.manifests && name == nametransform.ManifestTmpName:
+		g.remove(path, gcTemporary)
+	case g.longNames && nametransform.NameType(name) == nametransform.LongNameFilename:
+		content := strings.TrimSuffix(path, nametransform.LongNameSuffix)
+		if _, err := os.Lstat(content); os.IsNotExist(err) {
+			g.remove(path, gcOrphanedLongName)
+		}
+	}
+	return nil
+}
+
+// isSpecialDir returns true if "name" is one of the directories in the
+// CIPHERDIR root that gocryptfs keeps its own data in, as opposed to the
+// encrypted directory tree
+func isSpecialDir(name string) bool {
+	switch name {
+	case snapshot.DirName, dedup.DirName, nametransform.TrashDirName,
+		nametransform.JournalDirName, nametransform.LongSymlinkDirName, configfile.MetaDirName,
+		keystore.DirName:
+		return true
+	}
+	return false
+}
+
+// metaDir checks the directory that holds a backup copy of the config file
+func (g *gcRun) metaDir() error {
+	dir := filepath.Join(g.cipherdir, configfile.MetaDirName)
+	names, err := readNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if configfile.IsTmpName(n) {
+			g.remove(filepath.Join(dir, n), gcTemporary)
+		}
+	}
+	return nil
+}
+
+// dedupStore checks the chunk store for the temporary files of interrupted
+// chunk and recovery copy writes.
+func (g *gcRun) dedupStore() error {
+	err := filepath.WalkDir(filepath.Join(g.cipherdir, dedup.DirName), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".tmp") {
+			g.remove(path, gcTemporary)
+		}
+		return nil
+	})
+	return err
+}
+
+// trashDir checks the "-trash" directory. Every file in the trash must have
+// a ".path" file, and the other way round. Without "-trash", the retention
+// period is unknown and no file is expired.
+func (g *gcRun) trashDir() error {
+	dir := filepath.Join(g.cipherdir, nametransform.TrashDirName)
+	names, err := readNames(dir)
+	if err != nil {
+		return err
+	}
+	have := make(map[string]bool, len(names))
+	for _, n := range names {
+		have[n] = true
+	}
+	for _, n := range names {
+		id := strings.TrimSuffix(n, nametransform.TrashPathSuffix)
+		deleted, ok := fusefrontend.ParseTrashID(id)
+		if !ok {
+			continue
+		}
+		partner := id + nametransform.TrashPathSuffix
+		if n == partner {
+			partner = id
+		}
+		p := filepath.Join(dir, n)
+		if !have[partner] {
+			g.remove(p, gcTrashOrphan)
+		} else if g.trash > 0 && g.now.Sub(deleted) >= g.trash {
+			g.remove(p, gcTrashExpired)
+		}
+	}
+	return nil
+}
+
+// addSymlinkRef records the long symlink target that the symlink "path"
+// refers to, if any
+func (g *gcRun) addSymlinkRef(path string) {
+	if !g.longSymlinks {
+		return
+	}
+	target, err := os.Readlink(path)
+	if err != nil || !nametransform.IsLongSymlinkRef(target) {
+		return
+	}
+	if g.symlinkRefs == nil {
+		g.symlinkRefs = make(map[string]bool)
+	}
+	g.symlinkRefs[target] = true
+}
+
+// longSymlinkDir checks the directory that holds the long symlink targets.
+// Targets that no symlink refers to, also none in the trash, are left
+// behind when a symlink is deleted or could not be created.
+func (g *gcRun) longSymlinkDir() error {
+	if !g.longSymlinks {
+		return nil
+	}
+	names, err := readNames(filepath.Join(g.cipherdir, nametransform.TrashDirName))
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		g.addSymlinkRef(filepath.Join(g.cipherdir, nametransform.TrashDirName, n))
+	}
+	dir := filepath.Join(g.cipherdir, nametransform.LongSymlinkDirName)
+	if names, err = readNames(dir); err != nil {
+		return err
+	}
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if strings.HasSuffix(n, ".tmp") {
+			g.remove(p, gcTemporary)
+		} else if !g.symlinkRefs[nametransform.LongSymlinkPrefix+n] {
+			g.remove(p, gcOrphanedLongSymlink)
+		}
+	}
+	return nil
+}
+
+// addFileID records the file ID of the regular file "path", if it has a
+// version 3 header
+func (g *gcRun) addFileID(path string) {
+	if !g.keyShares {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		tlog.Warn.Printf("-gc: %v", err)
+		g.fileIDsIncomplete = true
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLenV3)
+	if n, _ := f.ReadAt(buf, 0); n != len(buf) {
+		return
+	}
+	h, err := contentenc.ParseHeaderV3(buf)
+	if err != nil {
+		return
+	}
+	if g.fileIDs == nil {
+		g.fileIDs = make(map[string]bool)
+	}
+	g.fileIDs[hex.EncodeToString(h.ID)] = true
+}
+
+// keyStoreDir checks the key store. Key shares of deleted files, also none
+// in the trash, stay behind until they are collected here. If a file could
+// not be read, no key share is removed, as it may be the share of that file.
+func (g *gcRun) keyStoreDir() error {
+	if !g.keyShares {
+		return nil
+	}
+	dir := filepath.Join(g.cipherdir, keystore.DirName)
+	names, err := readNames(dir)
+	if err != nil || len(names) == 0 {
+		return err
+	}
+	trash, err := readNames(filepath.Join(g.cipherdir, nametransform.TrashDirName))
+	if err != nil {
+		return err
+	}
+	for _, n := range trash {
+		g.addFileID(filepath.Join(g.cipherdir, nametransform.TrashDirName, n))
+	}
+	if g.fileIDsIncomplete {
+		tlog.Warn.Printf("-gc: not all files could be read, keeping all key shares")
+	}
+	for _, n := range names {
+		p := filepath.Join(dir, n)
+		if id, ok := keystore.FileID(n); !ok {
+			if strings.HasSuffix(n, ".tmp") {
+				g.remove(p, gcTemporary)
+			}
+		} else if !g.fileIDsIncomplete && !g.fileIDs[hex.EncodeToString(id)] {
+			g.remove(p, gcOrphanedKeyShare)
+		}
+	}
+	return nil
+}
+
+// journal removes the records of the long name journal. walkFn has already
+// removed the ".name" files that the journal would have cleaned up.
+func (g *gcRun) journal() error {
+	dir := filepath.Join(g.cipherdir, nametransform.JournalDirName)
+	names, err := readNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		g.remove(filepath.Join(dir, n), gcJournal)
+	}
+	if g.dryRun || len(names) == 0 {
+		return nil
+	}
+	// Removes the directory if it is empty now
+	return nametransform.NewLongNameJournal(g.cipherdir).Close()
+}
+
+// remove adds "path" to the report and removes it, unless dryRun is set.
+func (g *gcRun) remove(path string, kind string) {
+	g.removeWith(path, kind, os.Remove)
+}
+
+// removeWith is like remove, but calls "removeFn" to remove "path".
+func (g *gcRun) removeWith(path string, kind string, removeFn func(string) error) {
+	rel, _ := filepath.Rel(g.cipherdir, path)
+	item := gcItem{Path: rel, Kind: kind, Bytes: diskUsage(path)}
+	if g.dryRun {
+		tlog.Info.Printf("would remove %s: %s", kind, rel)
+		g.report.Items = append(g.report.Items, item)
+		return
+	}
+	err := removeFn(path)
+	if err != nil {
+		tlog.Warn.Printf("-gc: %v", err)
+		item.Error = err.Error()
+		g.report.Errors++
+	} else {
+		tlog.Info.Printf("removed %s: %s", kind, rel)
+		item.Removed = true
+		g.report.Removed++
+		g.report.FreedBytes += item.Bytes
+	}
+	g.report.Items = append(g.report.Items, item)
+}
+
+// diskUsage returns the size of "path" and, if it is a directory, of
+// everything below it.
+func diskUsage(path string) (size int64) {
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// readNames returns the names in directory "dir", or nothing if it does not
+// exist.
+func readNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
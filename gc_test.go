@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+)
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Unix(1700000000, 0)
+	old := "1000000000000000000-0011223344556677"
+	recent := "1699999999000000000-8899aabbccddeeff"
+	trash := nametransform.TrashDirName
+	keep := []string{
+		configfile.ConfDefaultName,
+		tuning.FileName,
+		"d/gocryptfs.longname.aaa",
+		"d/gocryptfs.longname.aaa.name",
+		filepath.Join(trash, recent),
+		filepath.Join(trash, recent+nametransform.TrashPathSuffix),
+		filepath.Join(snapshot.DirName, "daily", configfile.ConfDefaultName),
+	}
+	garbage := map[string]string{
+		configfile.ConfDefaultName + ".tmp":                             gcTemporary,
+		tuning.FileName + ".tmp":                                        gcTemporary,
+		"d/" + nametransform.ManifestTmpName:                            gcTemporary,
+		"d/gocryptfs.longname.bbb.name":                                 gcOrphanedLongName,
+		filepath.Join(dedup.DirName, "ab", "cdef.123.tmp"):              gcTemporary,
+		filepath.Join(snapshot.DirName, ".weekly.tmp"):                  gcTemporary,
+		filepath.Join(trash, old):                                       gcTrashExpired,
+		filepath.Join(trash, old+nametransform.TrashPathSuffix):         gcTrashExpired,
+		filepath.Join(trash, "1699999999000000000-ffff.path"):           gcTrashOrphan,
+		filepath.Join(nametransform.JournalDirName, "0123456789abcdef"): gcJournal,
+	}
+	create := func(p string) {
+		p = filepath.Join(dir, p)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range keep {
+		create(p)
+	}
+	for p := range garbage {
+		if filepath.Base(p) == ".weekly.tmp" {
+			create(filepath.Join(p, configfile.ConfDefaultName))
+		} else {
+			create(p)
+		}
+	}
+	g := gcRun{cipherdir: dir, longNames: true, manifests: true, trash: 24 * time.Hour, now: now, dryRun: true}
+	if err := g.run(); err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, item := range g.report.Items {
+		if item.Kind != garbage[item.Path] {
+			t.Errorf("%s: have kind %q, want %q", item.Path, item.Kind, garbage[item.Path])
+		}
+		if item.Removed {
+			t.Errorf("%s: removed in dry run", item.Path)
+		}
+		found = append(found, item.Path)
+	}
+	if len(found) != len(garbage) {
+		sort.Strings(found)
+		t.Fatalf("found %d items, want %d: %v", len(found), len(garbage), found)
+	}
+	for p := range garbage {
+		if _, err := os.Lstat(filepath.Join(dir, p)); err != nil {
+			t.Errorf("dry run: %v", err)
+		}
+	}
+
+	g = gcRun{cipherdir: dir, longNames: true, manifests: true, trash: 24 * time.Hour, now: now}
+	if err := g.run(); err != nil {
+		t.Fatal(err)
+	}
+	if g.report.Removed != len(garbage) || g.report.Errors != 0 {
+		t.Errorf("have %+v", g.report)
+	}
+	for p := range garbage {
+		if _, err := os.Lstat(filepath.Join(dir, p)); !os.IsNotExist(err) {
+			t.Errorf("%s has not been removed: %v", p, err)
+		}
+	}
+	for _, p := range keep {
+		if _, err := os.Lstat(filepath.Join(dir, p)); err != nil {
+			t.Error(err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dir, nametransform.JournalDirName)); !os.IsNotExist(err) {
+		t.Errorf("journal directory has not been removed: %v", err)
+	}
+}
+
+func TestGCLongSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	used, err := nametransform.WriteLongSymlink(dir, "used")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trashed, err := nametransform.WriteLongSymlink(dir, "trashed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphan, err := nametransform.WriteLongSymlink(dir, "orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "d"), 0700)
+	os.MkdirAll(filepath.Join(dir, nametransform.TrashDirName), 0700)
+	if err = os.Symlink(used, filepath.Join(dir, "d", "link")); err != nil {
+		t.Fatal(err)
+	}
+	trashEntry := filepath.Join(dir, nametransform.TrashDirName, "1699999999000000000-8899aabbccddeeff")
+	if err = os.Symlink(trashed, trashEntry); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(trashEntry+nametransform.TrashPathSuffix, []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tmp := nametransform.LongSymlinkPath(dir, used) + ".0011223344556677.tmp"
+	if err = os.WriteFile(tmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	g := gcRun{cipherdir: dir, longNames: true, longSymlinks: true, now: time.Unix(1700000000, 0)}
+	if err = g.run(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		tmp: gcTemporary,
+		nametransform.LongSymlinkPath(dir, orphan): gcOrphanedLongSymlink,
+	}
+	for _, item := range g.report.Items {
+		p := filepath.Join(dir, item.Path)
+		if want[p] != item.Kind {
+			t.Errorf("%s: have kind %q, want %q", item.Path, item.Kind, want[p])
+		}
+		delete(want, p)
+	}
+	if len(want) > 0 {
+		t.Errorf("not found: %v", want)
+	}
+	for _, ref := range []string{used, trashed} {
+		if _, err = nametransform.ReadLongSymlink(dir, ref); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestGCKeyShares(t *testing.T) {
+	dir := t.TempDir()
+	ks := keystore.New(dir)
+	header := func(id byte) []byte {
+		h := contentenc.FileHeader{Version: contentenc.HeaderVersion3, Suite: 1,
+			ID: bytes.Repeat([]byte{id}, 16), WrappedKey: bytes.Repeat([]byte{1}, contentenc.WrappedKeyLen)}
+		return h.Pack()
+	}
+	for id := byte(1); id <= 3; id++ {
+		if err := ks.Put(bytes.Repeat([]byte{id}, 16), make([]byte, keystore.ShareLen)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(dir, "d"), 0700)
+	os.MkdirAll(filepath.Join(dir, nametransform.TrashDirName), 0700)
+	if err := os.WriteFile(filepath.Join(dir, "d", "file"), header(1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	trashEntry := filepath.Join(dir, nametransform.TrashDirName, "1699999999000000000-8899aabbccddeeff")
+	if err := os.WriteFile(trashEntry, header(2), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(trashEntry+nametransform.TrashPathSuffix, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(ks.Dir(), "0011.tmp")
+	if err := os.WriteFile(tmp, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(ks.Dir(), hex.EncodeToString(bytes.Repeat([]byte{3}, 16)))
+	// A file that cannot be read may hold any file ID
+	unreadable := filepath.Join(dir, "d", "unreadable")
+	if err := os.WriteFile(unreadable, header(4), 0000); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() != 0 {
+		g := gcRun{cipherdir: dir, keyShares: true, now: time.Unix(1700000000, 0), dryRun: true}
+		if err := g.run(); err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range g.report.Items {
+			if item.Kind == gcOrphanedKeyShare {
+				t.Errorf("%s removed although a file could not be read", item.Path)
+			}
+		}
+	}
+	os.Remove(unreadable)
+	g := gcRun{cipherdir: dir, keyShares: true, now: time.Unix(1700000000, 0)}
+	if err := g.run(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		tmp:    gcTemporary,
+		orphan: gcOrphanedKeyShare,
+	}
+	for _, item := range g.report.Items {
+		p := filepath.Join(dir, item.Path)
+		if want[p] != item.Kind {
+			t.Errorf("%s: have kind %q, want %q", item.Path, item.Kind, want[p])
+		}
+		delete(want, p)
+	}
+	if len(want) > 0 {
+		t.Errorf("not found: %v", want)
+	}
+	for id := byte(1); id <= 2; id++ {
+		if _, err := ks.Get(bytes.Repeat([]byte{id}, 16)); err != nil {
+			t.Error(err)
+		}
+	}
+}
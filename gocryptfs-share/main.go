@@ -0,0 +1,156 @@
+// gocryptfs-share opens a file that was exported with "gocryptfs -share",
+// and creates the key pairs for "gocryptfs -share -share-to".
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/share"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage:
+  gocryptfs-share [-key PRIVATEKEY] [-passfile FILE] FILE OUT
+      Decrypt FILE, exported with "gocryptfs -share", into OUT ("-" for
+      stdout). The token is read from FILE%s. Password tokens prompt for
+      the password.
+  gocryptfs-share -keygen PRIVATEKEY
+      Write a new private key to PRIVATEKEY and print the public key for
+      "gocryptfs -share -share-to".
+
+Options:
+`, share.TokenSuffix)
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
+func fatal(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "gocryptfs-share: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+func main() {
+	keygen := flag.String("keygen", "", "Create a key pair and write the private key to this file")
+	keyFile := flag.String("key", "", "Private key file for tokens created with -share-to")
+	passfile := flag.String("passfile", "", "Read the password from this file")
+	tokenFile := flag.String("token", "", "Token file (default FILE"+share.TokenSuffix+")")
+	flag.Usage = usage
+	flag.Parse()
+	if *keygen != "" {
+		if flag.NArg() != 0 {
+			usage()
+		}
+		generateKey(*keygen)
+		return
+	}
+	if flag.NArg() != 2 {
+		usage()
+	}
+	in, out := flag.Arg(0), flag.Arg(1)
+	if *tokenFile == "" {
+		*tokenFile = in + share.TokenSuffix
+	}
+	key := unwrapKey(*tokenFile, *keyFile, *passfile)
+	if err := decryptFile(in, out, key); err != nil {
+		fatal("%s: %v", in, err)
+	}
+}
+
+// generateKey writes a new private key to "path" and prints the public key
+func generateKey(path string) {
+	priv, pub := share.NewKeyPair()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		fatal("%v", err)
+	}
+	_, err = fmt.Fprintln(f, share.FormatKey(share.PrivateKeyPrefix, priv))
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(path)
+		fatal("%v", err)
+	}
+	fmt.Println(share.FormatKey(share.PublicKeyPrefix, pub))
+}
+
+// unwrapKey returns the file key from the token "tokenFile", with the
+// private key from "keyFile" or the password
+func unwrapKey(tokenFile string, keyFile string, passfile string) []byte {
+	js, err := os.ReadFile(tokenFile)
+	if err != nil {
+		fatal("%v", err)
+	}
+	token, err := share.ParseToken(js)
+	if err != nil {
+		fatal("%s: %v", tokenFile, err)
+	}
+	var key []byte
+	switch token.Recipient {
+	case share.RecipientX25519:
+		if keyFile == "" {
+			fatal("%s is for a private key, pass it with -key", tokenFile)
+		}
+		buf, err := os.ReadFile(keyFile)
+		if err != nil {
+			fatal("%v", err)
+		}
+		priv, err := share.ParseKey(share.PrivateKeyPrefix, string(buf))
+		if err != nil {
+			fatal("%s: %v", keyFile, err)
+		}
+		key, err = token.UnwrapX25519(priv)
+		if err != nil {
+			fatal("%s: %v", tokenFile, err)
+		}
+	case share.RecipientPassword:
+		var pf []string
+		if passfile != "" {
+			pf = []string{passfile}
+		}
+		pw, err := readpassword.Once(nil, pf, "")
+		if err != nil {
+			fatal("%v", err)
+		}
+		key, err = token.UnwrapPassword(pw)
+		if err != nil {
+			fatal("%s: %v", tokenFile, err)
+		}
+	default:
+		fatal("%s: unknown recipient %q", tokenFile, token.Recipient)
+	}
+	return key
+}
+
+// decryptFile decrypts "in" into "out". A partly written "out" is removed
+// on error.
+func decryptFile(in string, out string, key []byte) error {
+	src, err := os.Open(in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	var dst io.WriteCloser = os.Stdout
+	if out != "-" {
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		dst = f
+	}
+	err = share.Decrypt(dst, src, key)
+	if out == "-" {
+		return err
+	}
+	if err2 := dst.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(out)
+	}
+	return err
+}
@@ -8,7 +8,12 @@ import (
 
 const tUsage = "" +
 	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
-	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
+	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n" +
+	"  or   " + tlog.ProgramName + " -serve-webdav|-serve-9p ADDR [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -import encfs|cryfs|fscrypt|archive [OPTIONS] SRC CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -export FILE [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -export-fscrypt DIR -fscrypt-key KEYFILE [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -daemon -ctlsock SOCKET [OPTIONS] PROFILES\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
 func helpShort() {
@@ -17,30 +22,71 @@ func helpShort() {
 	fmt.Print(tUsage)
 	fmt.Printf(`
 Common Options (use -hh to show all):
+  -access-policy     Restrict access to plaintext paths by UID and GID
   -aessiv            Use AES-SIV encryption (with -init)
   -allow_other       Allow other users to access the mount
   -i, -idle          Unmount automatically after specified idle duration
+  -case-insensitive  Ignore case when looking up file names
+  -check-names       Show how long plaintext names can be, and check a tree
+  -check-normalization List names that only differ in their Unicode normalization
   -config            Custom path to config file
+  -crash-dir         Write crash reports to this directory
   -ctlsock           Create control socket at location
+  -ctlsock-max-conns Serve at most N control socket connections at a time
+  -ctlsock-timeout   Close control socket connections whose request takes longer
+  -daemon            Mount and unmount the vaults in PROFILES on -ctlsock requests
+  -dedup             Deduplicate file contents and collect garbage
+  -doctor            Check the system and CIPHERDIR and print a health report
+  -duress-passwd     Set a duress password that destroys the master key
+  -duress-remove     Remove the duress password
+  -export            Pack the encrypted directory into a single archive file
+  -export-checksums  Write the checksums of all encrypted files to a manifest
+  -export-fscrypt    Copy the plaintext into a directory encrypted with fscrypt
   -extpass           Call external program to prompt for the password
   -fg                Stay in the foreground
+  -from-snapshot     Mount a snapshot read-only
   -fsck              Check filesystem integrity
   -fusedebug         Debug FUSE calls
+  -gc                Remove orphaned and temporary files from CIPHERDIR
   -h, -help          This short help text
   -hh                Long help text with all options
+  -import            Import an EncFS, CryFS or fscrypt volume or an archive into CIPHERDIR
   -init              Initialize encrypted directory
   -info              Display information about encrypted directory
+  -join-chunks       Join the chunk files created by -reverse -chunk-size
+  -key-escrow        Encrypt a copy of the master key to an age or OpenPGP key (with -init)
+  -log-format        Log as "text" (default) or "json"
+  -log-level         Set log levels per subsystem, like fusefrontend=debug
+  -log-target        Log to "auto" (default), "console", "syslog" or "journald"
+  -logfile           Write log messages to this file
+  -logfile-max-size  Rotate -logfile after this many MiB
   -masterkey         Mount with explicit master key instead of password
+  -migrate-filenameauth Enable filename authentication or convert to the new format
+  -nfc, -nfd         Convert file names to Unicode NFC or NFD
   -nonempty          Allow mounting over non-empty directory
   -nosyslog          Do not redirect log messages to syslog
   -passfile          Read password from plain text file(s)
   -passwd            Change password
   -plaintextnames    Do not encrypt file names (with -init)
+  -prune-snapshots   Delete all but the newest N snapshots
   -q, -quiet         Silence informational messages
   -reverse           Enable reverse mode
   -ro                Mount read-only
+  -scrub             Check CIPHERDIR for damage in the background, every 7d for example
+  -selftest-vectors  Write known-answer test vectors, or check this build against them
+  -serve-9p          Serve the plaintext view over 9P2000.L instead of mounting
+  -serve-webdav      Serve the plaintext view over WebDAV instead of mounting
+  -share             Export a single file for a recipient without the password
+  -shred             Destroy the data key of a file and delete it
+  -snapshot          Create a snapshot of the encrypted directory
   -speed             Run crypto speed test
+  -throttle          Rate-limit unlock attempts, best-effort: on, off, ATTEMPTS/DURATION
+  -trash             Keep deleted files in the trash for this long, like 7d
+  -upstream-compat   Stay mountable by upstream gocryptfs v2.x
   -speed-enhanced    Run enhanced crypto speed test with decryption and block size scaling
+  -verify-archive    Check an -export archive without the password
+  -verify-checksums  Check CIPHERDIR or a backup against an -export-checksums manifest
+  -verify-on-mount   Check CIPHERDIR for damage before mounting: quick or full
   -version           Print version information
   --                 Stop option parsing
 `)
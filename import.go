@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// importSource describes a filesystem that "-import" can read
+type importSource struct {
+	// name is shown to the user
+	name string
+	// args returns the arguments that mount "src" at "mnt" read-only using
+	// the program of the filesystem. The program reads the password from
+	// stdin and goes into the background once the volume is mounted.
+	args func(src, mnt string) []string
+	// env is appended to our environment
+	env []string
+	// open is set for filesystems that are not mounted by a program. It
+	// makes the plaintext of the volume readable and returns the
+	// plaintext directory and a function that locks the volume again.
+	// Exits on error.
+	open func(args *argContainer) (dir string, lock func())
+}
+
+// importSources are the filesystems "-import" can read, indexed by the
+// program that mounts them or the "-import" argument
+var importSources = map[string]importSource{
+	"encfs": {
+		name: "EncFS",
+		args: func(src, mnt string) []string {
+			return []string{"--stdinpass", src, mnt, "--", "-o", "ro"}
+		},
+	},
+	"cryfs": {
+		name: "CryFS",
+		args: func(src, mnt string) []string {
+			return []string{src, mnt, "--", "-o", "ro"}
+		},
+		// Read the password from stdin and do not ask questions
+		env: []string{"CRYFS_FRONTEND=noninteractive", "CRYFS_NO_UPDATE_CHECK=true"},
+	},
+	"fscrypt": {
+		name: "fscrypt",
+		open: openFscryptImport,
+	},
+}
+
+// importFS implements "-import TYPE SRC CIPHERDIR". It makes the plaintext
+// of the EncFS, CryFS or fscrypt volume "SRC" readable and copies it into
+// CIPHERDIR, which must have been created with "-init". EncFS and CryFS
+// volumes are mounted read-only at a private temporary directory. The
+// plaintext is never written to disk unencrypted.
+// Does not return (calls os.Exit both on success and on error).
+func importFS(args *argContainer) {
+	src := importSources[args.import_type]
+	open := src.open
+	if open == nil {
+		open = src.mount
+	}
+	dir, lock := open(args)
+	// Lock the volume on Ctrl-C as well
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	nErrors, err := importTree(ctx, args, dir)
+	cancel()
+	lock()
+	if err != nil {
+		tlog.Fatal.Printf("-import: %v", err)
+		if ctx.Err() != nil {
+			tlog.Info.Printf("Run the same command again to resume the import.")
+		}
+		os.Exit(exitcodes.Import)
+	}
+	if nErrors > 0 {
+		tlog.Fatal.Printf("-import: %d files could not be imported, see the messages above", nErrors)
+		os.Exit(exitcodes.Import)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"The %s volume has been imported."+tlog.ColorReset, src.name)
+	os.Exit(0)
+}
+
+// mount mounts the volume args._importSrc read-only at a private temporary
+// directory using the program args.import_type. Returns the mountpoint and
+// a function that unmounts it. Exits on error.
+func (s importSource) mount(args *argContainer) (string, func()) {
+	if _, err := exec.LookPath(args.import_type); err != nil {
+		tlog.Fatal.Printf("-import %s needs the %q program: %v", args.import_type, args.import_type, err)
+		os.Exit(exitcodes.Import)
+	}
+	var passfile []string
+	if args.import_passfile != "" {
+		passfile = []string{args.import_passfile}
+	}
+	pw, err := readpassword.Once(nil, passfile, "Password for the "+s.name+" volume")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.ReadPassword)
+	}
+	mnt, err := os.MkdirTemp("", "gocryptfs-import-")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.Import)
+	}
+	tlog.Info.Printf("Mounting the %s volume %s read-only at %s", s.name, args._importSrc, mnt)
+	cmd := exec.Command(args.import_type, s.args(args._importSrc, mnt)...)
+	cmd.Env = append(os.Environ(), s.env...)
+	cmd.Stdin = strings.NewReader(string(pw) + "\n")
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		os.Remove(mnt)
+		tlog.Fatal.Printf("Mounting the %s volume failed: %v", s.name, err)
+		os.Exit(exitcodes.Import)
+	}
+	return mnt, func() {
+		if err := unmountImportSource(mnt); err != nil {
+			tlog.Warn.Printf("Unmounting %s failed: %v", mnt, err)
+			return
+		}
+		os.Remove(mnt)
+	}
+}
+
+// importTree copies the plaintext tree "src" into CIPHERDIR. The
+// filesystem is accessed through rawfs, so it does not have to be mounted.
+// Returns the number of files that could not be imported.
+func importTree(ctx context.Context, args *argContainer, src string) (int, error) {
+	raw, rootNode, wipeKeys := initRawFS(args)
+	defer wipeKeys()
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		defer x.AfterUnmount()
+	}
+	im := &importer{
+		dst:          rawfs.New(raw, false),
+		copyProgress: copyProgress{verb: "Imported", report: tlog.Info.Printf},
+	}
+	if err := im.scan(src); err != nil {
+		return 0, err
+	}
+	err := im.run(ctx, src)
+	im.progress(true)
+	return im.errors, err
+}
+
+// unmountImportSource unmounts the source volume at "mnt"
+func unmountImportSource(mnt string) error {
+	var cmds [][]string
+	if runtime.GOOS == "linux" {
+		cmds = append(cmds, []string{"fusermount", "-u", mnt}, []string{"fusermount3", "-u", mnt})
+	}
+	cmds = append(cmds, []string{"umount", mnt})
+	var err error
+	for _, c := range cmds {
+		if err = exec.Command(c[0], c[1:]...).Run(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// importer copies a plaintext directory tree into a gocryptfs filesystem,
+// keeping permissions, modification times and "user." extended attributes.
+// Files that have been imported already, as far as their size and
+// modification time tell, are skipped, so an interrupted import can resume
+// where it stopped.
+type importer struct {
+	dst *rawfs.FS
+	copyProgress
+}
+
+// copyProgress counts the files and bytes that -import and -export-fscrypt
+// have copied
+type copyProgress struct {
+	// verb starts the progress message, like "Imported"
+	verb string
+	// report prints the progress
+	report func(format string, v ...interface{})
+	// Totals found by scan
+	totalFiles int
+	totalBytes int64
+	// Progress
+	files  int
+	bytes  int64
+	errors int
+	// lastReport is when the progress was last printed
+	lastReport time.Time
+}
+
+// scan counts the files and bytes in "src" for the progress report
+func (im *importer) scan(src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || path == src {
+			// Reported by run
+			return nil
+		}
+		im.totalFiles++
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				im.totalBytes += fi.Size()
+			}
+		}
+		return nil
+	})
+}
+
+// run copies "src" into the root directory of im.dst. Stops early with an
+// error if "ctx" is canceled. Errors on individual files are counted in
+// im.errors.
+func (im *importer) run(ctx context.Context, src string) error {
+	// The directories get their permissions and times after their
+	// contents have been written. The root directory is left alone, it is
+	// CIPHERDIR.
+	var dirs []string
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		rel, _ := filepath.Rel(src, path)
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", rel, err)
+			im.errors++
+			return nil
+		}
+		if path == src {
+			return nil
+		}
+		name := filepath.ToSlash(rel)
+		switch t := d.Type(); {
+		case t.IsDir():
+			err = im.dst.Mkdir(ctx, name, 0700)
+			if os.IsExist(err) {
+				err = nil
+			}
+			if err == nil {
+				dirs = append(dirs, name)
+			}
+		case t.IsRegular():
+			err = im.copyFile(ctx, path, name)
+		case t&fs.ModeSymlink != 0:
+			err = im.copySymlink(ctx, path, name)
+		default:
+			tlog.Warn.Printf("%s: skipping %s, only files, directories and symlinks are imported", name, t.Type())
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", name, err)
+			im.errors++
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		im.files++
+		im.progress(false)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := im.copyAttrs(ctx, filepath.Join(src, dirs[i]), dirs[i]); err != nil {
+			tlog.Warn.Printf("%s: %v", dirs[i], err)
+			im.errors++
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file "path" to "name"
+func (im *importer) copyFile(ctx context.Context, path string, name string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if have, err := im.dst.Stat(ctx, name); err == nil && have.Mode().IsRegular() &&
+		have.Size() == fi.Size() && have.ModTime().Equal(fi.ModTime()) {
+		// Imported by an earlier run
+		im.bytes += fi.Size()
+		return nil
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Writable for us until copyAttrs sets the real permissions
+	out, err := im.dst.OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := im.copyData(ctx, out, in); err != nil {
+		// The modification time has not been set yet, so the next run
+		// copies the file again
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return im.copyAttrs(ctx, path, name)
+}
+
+// copySymlink copies the symlink "path" to "name"
+func (im *importer) copySymlink(ctx context.Context, path string, name string) error {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return err
+	}
+	if have, err := im.dst.Readlink(ctx, name); err == nil && have == target {
+		return nil
+	} else if err == nil {
+		// Left over from an earlier run, but the target has changed
+		if err := im.dst.Remove(ctx, name); err != nil {
+			return err
+		}
+	}
+	return im.dst.Symlink(ctx, target, name)
+}
+
+// copyAttrs copies the "user." extended attributes, the permissions and the
+// modification time of "path" to "name". The modification time is set last, it marks
+// a file as completely imported.
+func (im *importer) copyAttrs(ctx context.Context, path string, name string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	attrs, err := syscallcompat.Llistxattr(path)
+	if err != nil && err != syscall.ENOTSUP {
+		return fmt.Errorf("listing xattrs: %w", err)
+	}
+	for _, a := range attrs {
+		if !strings.HasPrefix(a, "user.") {
+			continue
+		}
+		val, err := syscallcompat.Lgetxattr(path, a)
+		if err != nil {
+			return fmt.Errorf("reading xattr %s: %w", a, err)
+		}
+		if err := im.dst.Setxattr(ctx, name, a, val); err != nil {
+			return fmt.Errorf("writing xattr %s: %w", a, err)
+		}
+	}
+	if err := im.dst.Chmod(ctx, name, fi.Mode()); err != nil {
+		return err
+	}
+	return im.dst.Chtimes(ctx, name, time.Now(), fi.ModTime())
+}
+
+// copyData copies "in" to "out" and counts the bytes. Stops with an error
+// if "ctx" is canceled.
+func (p *copyProgress) copyData(ctx context.Context, out io.Writer, in io.Reader) error {
+	buf := make([]byte, 128*1024)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			p.bytes += int64(n)
+			p.progress(false)
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
+
+// progress prints how far the copy is, at most once a second unless
+// "final" is set.
+func (p *copyProgress) progress(final bool) {
+	if !final && time.Since(p.lastReport) < time.Second {
+		return
+	}
+	p.lastReport = time.Now()
+	pct := 100
+	if p.totalBytes > 0 {
+		pct = int(p.bytes * 100 / p.totalBytes)
+	}
+	p.report("%s %d/%d files, %d/%d MiB (%d%%)",
+		p.verb, p.files, p.totalFiles, p.bytes>>20, p.totalBytes>>20, pct)
+}
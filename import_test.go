@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// newTestImporter returns an importer that writes to "dst" through
+// go-fuse's loopback node tree
+func newTestImporter(t *testing.T, dst string) *importer {
+	root, err := fs.NewLoopbackRoot(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &importer{
+		dst:          rawfs.New(fs.NewNodeFS(root, &fs.Options{}), false),
+		copyProgress: copyProgress{verb: "Imported", report: t.Logf},
+	}
+}
+
+func TestImportTree(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	content := bytes.Repeat([]byte("x"), 300000)
+	if err := os.MkdirAll(src+"/d/e", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src+"/d/f", content, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("d/f", src+"/l"); err != nil {
+		t.Fatal(err)
+	}
+	xattr := unix.Lsetxattr(src+"/d/f", "user.foo", []byte("bar"), 0) == nil
+	for _, p := range []string{"/d/f", "/d/e", "/d"} {
+		if err := os.Chtimes(src+p, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := t.TempDir()
+	im := newTestImporter(t, dst)
+	if err := im.scan(src); err != nil {
+		t.Fatal(err)
+	}
+	if im.totalFiles != 4 || im.totalBytes != int64(len(content)) {
+		t.Errorf("totalFiles=%d totalBytes=%d", im.totalFiles, im.totalBytes)
+	}
+	if err := im.run(context.Background(), src); err != nil || im.errors != 0 {
+		t.Fatalf("err=%v errors=%d", err, im.errors)
+	}
+	have, err := os.ReadFile(dst + "/d/f")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("err=%v len=%d", err, len(have))
+	}
+	for p, mode := range map[string]os.FileMode{"/d": 0750, "/d/e": 0750, "/d/f": 0640} {
+		fi, err := os.Stat(dst + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode || !fi.ModTime().Equal(mtime) {
+			t.Errorf("%s: mode=%v mtime=%v", p, fi.Mode(), fi.ModTime())
+		}
+	}
+	if target, err := os.Readlink(dst + "/l"); err != nil || target != "d/f" {
+		t.Errorf("symlink: target=%q err=%v", target, err)
+	}
+	if xattr {
+		if val, err := syscallcompat.Lgetxattr(dst+"/d/f", "user.foo"); err != nil || string(val) != "bar" {
+			t.Errorf("xattr: val=%q err=%v", val, err)
+		}
+	}
+	// Resume: a file with the same size and mtime is not copied again
+	marker := bytes.Repeat([]byte("y"), len(content))
+	if err := os.WriteFile(dst+"/d/f", marker, 0640); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(dst+"/d/f", mtime, mtime)
+	im = newTestImporter(t, dst)
+	if err := im.run(context.Background(), src); err != nil || im.errors != 0 {
+		t.Fatalf("err=%v errors=%d", err, im.errors)
+	}
+	if have, _ = os.ReadFile(dst + "/d/f"); !bytes.Equal(have, marker) {
+		t.Error("imported file has been copied again")
+	}
+	// ... but a partially copied one is
+	os.Chtimes(dst+"/d/f", time.Now(), time.Now())
+	im = newTestImporter(t, dst)
+	if err := im.run(context.Background(), src); err != nil || im.errors != 0 {
+		t.Fatalf("err=%v errors=%d", err, im.errors)
+	}
+	if have, _ = os.ReadFile(dst + "/d/f"); !bytes.Equal(have, content) {
+		t.Error("partially imported file has not been copied again")
+	}
+}
+
+func TestImportCanceled(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "f"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	im := newTestImporter(t, dst)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := im.run(ctx, src); err == nil {
+		t.Error("canceled import should fail")
+	}
+	if _, err := os.Stat(filepath.Join(dst, "f")); !os.IsNotExist(err) {
+		t.Errorf("file was imported anyway: %v", err)
+	}
+}
@@ -1,30 +1,242 @@
 package main
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
 )
 
-// info pretty-prints the contents of the config file at "filename" for human
-// consumption, stripping out sensitive data.
+// infoOutput is the output of "-info -json". Like the text output, it
+// contains no sensitive data: salts and the encrypted master key are
+// reduced to their length.
+type infoOutput struct {
+	Creator           string   `json:"creator"`
+	ConfigVersion     int      `json:"config_version"`
+	FeatureFlags      []string `json:"feature_flags"`
+	EncryptedKeyBytes int      `json:"encrypted_key_bytes"`
+	// KeyFingerprint is the hex fingerprint of the master key, empty for
+	// config files that were written before fingerprints existed
+	KeyFingerprint    string `json:"key_fingerprint"`
+	ContentEncryption string `json:"content_encryption"`
+	BlockSize         int    `json:"block_size"`
+	// FilenameAuth is "off", "legacy" (MAC appended to the encrypted name)
+	// or "embedded"
+	FilenameAuth    string `json:"filename_auth"`
+	DirManifest     bool   `json:"dir_manifest"`
+	DirIVAuth       bool   `json:"diriv_auth"`
+	XattrAuth       bool   `json:"xattr_auth"`
+	AuthTimes       bool   `json:"auth_times"`
+	LongSymlinks    bool   `json:"long_symlinks"`
+	AuthLinks       bool   `json:"auth_links"`
+	HeaderV3        bool   `json:"header_v3"`
+	FeatureFlagsMAC bool   `json:"feature_flags_mac"`
+	ConfigHMAC      bool   `json:"config_hmac"`
+	Dedup           bool   `json:"dedup"`
+	// Compression is always "none", gocryptfs does not compress
+	Compression string        `json:"compression"`
+	Keyslots    []infoKeyslot `json:"keyslots"`
+	// Throttle is nil if unlock attempts are not throttled
+	Throttle *infoThrottle `json:"throttle"`
+	// LastFsck is nil if -fsck has never completed on this filesystem
+	LastFsck *infoFsck `json:"last_fsck"`
+	// UpstreamCompatible is true if upstream gocryptfs v2.x can mount the
+	// filesystem. ForkFeatureFlags are the flags that prevent it.
+	UpstreamCompatible bool     `json:"upstream_compatible"`
+	ForkFeatureFlags   []string `json:"fork_feature_flags"`
+}
+
+// infoKeyslot describes one way to unlock the master key: the password, or
+// the FIDO2 token, or a "-key-escrow" copy. The "-duress-passwd" slot
+// destroys it instead.
+type infoKeyslot struct {
+	// Type is "password", "fido2", "escrow" or "duress"
+	Type string `json:"type"`
+	// KDF is "scrypt" or "argon2id", or "age" or "openpgp" for "escrow"
+	KDF      string        `json:"kdf"`
+	Scrypt   *infoScrypt   `json:"scrypt,omitempty"`
+	Argon2id *infoArgon2id `json:"argon2id,omitempty"`
+	// Recipient is the public key of an "escrow" slot
+	Recipient string `json:"recipient,omitempty"`
+}
+
+type infoScrypt struct {
+	SaltBytes int `json:"salt_bytes"`
+	N         int `json:"n"`
+	R         int `json:"r"`
+	P         int `json:"p"`
+	KeyLen    int `json:"key_len"`
+}
+
+type infoArgon2id struct {
+	SaltBytes int `json:"salt_bytes"`
+	// MemoryKiB is the memory usage in KiB
+	MemoryKiB   uint32 `json:"memory_kib"`
+	Iterations  uint32 `json:"iterations"`
+	Parallelism uint8  `json:"parallelism"`
+	KeyLen      uint32 `json:"key_len"`
+}
+
+// infoThrottle is the "-throttle" setting. The lockout is disabled if
+// LockoutAttempts is 0.
+type infoThrottle struct {
+	LockoutAttempts int `json:"lockout_attempts"`
+	LockoutSeconds  int `json:"lockout_seconds"`
+}
+
+type infoFsck struct {
+	Time         time.Time `json:"time"`
+	CorruptFiles int       `json:"corrupt_files"`
+	SkippedFiles int       `json:"skipped_files"`
+}
+
+// info pretty-prints the contents of the config file at "args.config" for
+// human consumption, stripping out sensitive data, or prints them as JSON
+// if "-json" is passed.
 // This is called when you pass the "-info" option.
-func info(filename string) {
-	cf, err := configfile.Load(filename)
+func info(args *argContainer) {
+	cf, err := configfile.Load(args.config)
 	if err != nil {
 		fmt.Printf("Loading config file failed: %v\n", err)
 		os.Exit(exitcodes.LoadConf)
 	}
+	out := newInfoOutput(cf, loadTuningState(args))
+	if args.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(out)
+		return
+	}
 	s := cf.ScryptObject
-	algo, _ := cf.ContentEncryption()
 	// Pretty-print
 	fmt.Printf("Creator:           %s\n", cf.Creator)
 	fmt.Printf("FeatureFlags:      %s\n", strings.Join(cf.FeatureFlags, " "))
 	fmt.Printf("EncryptedKey:      %dB\n", len(cf.EncryptedKey))
+	if cf.KeyFingerprint != nil {
+		fmt.Printf("KeyFingerprint:    %x\n", cf.KeyFingerprint)
+	}
 	fmt.Printf("ScryptObject:      Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
 		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
-	fmt.Printf("contentEncryption: %s\n", algo.Algo) // lowercase because not in JSON
+	if a := cf.Argon2idObject; a != nil {
+		fmt.Printf("Argon2idObject:    Salt=%dB Memory=%dKiB Iterations=%d Parallelism=%d KeyLen=%d\n",
+			len(a.Salt), a.Memory, a.Iterations, a.Parallelism, a.KeyLen)
+	}
+	// lowercase because not in JSON
+	fmt.Printf("contentEncryption: %s\n", out.ContentEncryption)
+	fmt.Printf("configVersion:     %d\n", out.ConfigVersion)
+	fmt.Printf("blockSize:         %d\n", out.BlockSize)
+	fmt.Printf("filenameAuth:      %s\n", out.FilenameAuth)
+	fmt.Printf("dedup:             %s\n", yesNo(out.Dedup))
+	fmt.Printf("compression:       %s\n", out.Compression)
+	if t := cf.Throttle; t != nil {
+		fmt.Printf("throttle:          %s\n", t)
+	} else {
+		fmt.Printf("throttle:          off\n")
+	}
+	if err := cf.UpstreamCompatible(); err != nil {
+		fmt.Printf("upstream:          no, %v\n", err)
+	} else {
+		fmt.Printf("upstream:          yes\n")
+	}
+	for _, k := range out.Keyslots {
+		if k.Recipient != "" {
+			fmt.Printf("keyslot:           %s, %s %s\n", k.Type, k.KDF, k.Recipient)
+			continue
+		}
+		fmt.Printf("keyslot:           %s, %s\n", k.Type, k.KDF)
+	}
+	if f := out.LastFsck; f != nil {
+		fmt.Printf("lastFsck:          %s, %d corrupt files, %d files skipped\n",
+			f.Time.Format(time.RFC3339), f.CorruptFiles, f.SkippedFiles)
+	} else {
+		fmt.Printf("lastFsck:          never\n")
+	}
+}
+
+// newInfoOutput collects the information that "-info" prints
+func newInfoOutput(cf *configfile.ConfFile, st *tuning.State) *infoOutput {
+	algo, _ := cf.ContentEncryption()
+	out := &infoOutput{
+		Creator:           cf.Creator,
+		ConfigVersion:     cf.SchemaVersion(),
+		FeatureFlags:      cf.FeatureFlags,
+		EncryptedKeyBytes: len(cf.EncryptedKey),
+		KeyFingerprint:    hex.EncodeToString(cf.KeyFingerprint),
+		ContentEncryption: algo.Algo,
+		BlockSize:         contentenc.DefaultBS,
+		FilenameAuth:      "off",
+		DirManifest:       cf.IsFeatureFlagSet(configfile.FlagDirManifest),
+		DirIVAuth:         cf.IsFeatureFlagSet(configfile.FlagDirIVAuth),
+		XattrAuth:         cf.IsFeatureFlagSet(configfile.FlagXattrAuth),
+		AuthTimes:         cf.IsFeatureFlagSet(configfile.FlagAuthTimes),
+		LongSymlinks:      cf.IsFeatureFlagSet(configfile.FlagLongSymlinks),
+		AuthLinks:         cf.IsFeatureFlagSet(configfile.FlagAuthLinks),
+		HeaderV3:          cf.IsFeatureFlagSet(configfile.FlagHeaderV3),
+		FeatureFlagsMAC:   cf.IsFeatureFlagSet(configfile.FlagFeatureFlagsMAC),
+		ConfigHMAC:        cf.IsFeatureFlagSet(configfile.FlagConfigHMAC),
+		Dedup:             cf.IsFeatureFlagSet(configfile.FlagDedup),
+		Compression:       "none",
+		// Not nil, so that it is "[]" in JSON
+		ForkFeatureFlags:   append([]string{}, cf.ForkFeatureFlags()...),
+		UpstreamCompatible: cf.UpstreamCompatible() == nil,
+	}
+	if out.FeatureFlags == nil {
+		out.FeatureFlags = []string{}
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagConfigurableBlockSize) {
+		out.BlockSize = cf.BlockSize
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded) {
+		out.FilenameAuth = "embedded"
+	} else if cf.IsFeatureFlagSet(configfile.FlagFilenameAuth) {
+		out.FilenameAuth = "legacy"
+	}
+	k := infoKeyslot{Type: "password", KDF: "scrypt"}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		k.Type = "fido2"
+	}
+	if a := cf.Argon2idObject; cf.IsFeatureFlagSet(configfile.FlagArgon2id) && a != nil {
+		k.KDF = "argon2id"
+		k.Argon2id = &infoArgon2id{
+			SaltBytes:   len(a.Salt),
+			MemoryKiB:   a.Memory,
+			Iterations:  a.Iterations,
+			Parallelism: a.Parallelism,
+			KeyLen:      a.KeyLen,
+		}
+	} else {
+		s := cf.ScryptObject
+		k.Scrypt = &infoScrypt{SaltBytes: len(s.Salt), N: s.N, R: s.R, P: s.P, KeyLen: s.KeyLen}
+	}
+	out.Keyslots = []infoKeyslot{k}
+	for _, e := range cf.KeyEscrow {
+		out.Keyslots = append(out.Keyslots, infoKeyslot{Type: "escrow", KDF: e.Type, Recipient: e.Recipient})
+	}
+	if d := cf.Duress; d != nil {
+		s := d.ScryptObject
+		out.Keyslots = append(out.Keyslots, infoKeyslot{Type: "duress", KDF: "scrypt",
+			Scrypt: &infoScrypt{SaltBytes: len(s.Salt), N: s.N, R: s.R, P: s.P, KeyLen: s.KeyLen}})
+	}
+	if t := cf.Throttle; t != nil {
+		out.Throttle = &infoThrottle{LockoutAttempts: t.LockoutAttempts, LockoutSeconds: t.LockoutSeconds}
+	}
+	if f := st.LastFsck; f != nil {
+		out.LastFsck = &infoFsck{Time: f.Time, CorruptFiles: f.Corrupt, SkippedFiles: f.Skipped}
+	}
+	return out
+}
+
+// yesNo returns "yes" or "no"
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
 }
@@ -9,8 +9,10 @@ import (
 
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/escrow"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
@@ -55,6 +57,11 @@ func isDir(dir string) error {
 // not need to be empty.
 func initDir(args *argContainer) {
 	var err error
+	// Only set when we need the key after creating the config file
+	var masterkey []byte
+	// Authenticated gocryptfs.diriv files are the default when we have
+	// filename authentication and gocryptfs.diriv files
+	dirIVAuth := args.filename_auth && !args.plaintextnames && !args.reverse && !args.deterministic_names
 	if args.reverse {
 		_, err = os.Stat(args.config)
 		if err == nil {
@@ -78,6 +85,16 @@ func initDir(args *argContainer) {
 				tlog.ColorReset)
 		}
 	}
+	// Parse the -key-escrow recipients before asking for the password
+	var escrowRecipients []configfile.EscrowRecipient
+	for _, s := range args.key_escrow {
+		r, err := escrow.ParseRecipient(s)
+		if err != nil {
+			tlog.Fatal.Printf("-key-escrow: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		escrowRecipients = append(escrowRecipients, r)
+	}
 	// Choose password for config file
 	if len(args.extpass) == 0 && args.fido2 == "" {
 		tlog.Info.Printf("Choose a password for protecting your files.")
@@ -100,6 +117,12 @@ func initDir(args *argContainer) {
 			fido2HmacSalt = nil
 		}
 		creator := tlog.ProgramName + " " + GitVersion
+		masterkey = handleArgsMasterkey(args)
+		if (dirIVAuth || args.dir_manifest) && masterkey == nil {
+			// We need the key to write gocryptfs.diriv and gocryptfs.manifest
+			// in the root directory
+			masterkey = cryptocore.RandBytes(cryptocore.KeyLen)
+		}
 		err = configfile.Create(&configfile.CreateArgs{
 			Filename:           args.config,
 			Password:           password,
@@ -113,10 +136,21 @@ func initDir(args *argContainer) {
 			DeterministicNames: args.deterministic_names,
 			XChaCha20Poly1305:  args.xchacha,
 			LongNameMax:        args.longnamemax,
-			Masterkey:          handleArgsMasterkey(args),
+			Masterkey:          append([]byte(nil), masterkey...), // Create wipes the key
 			Argon2id:           args.argon2id,
 			FilenameAuth:       args.filename_auth,
+			DirManifest:        args.dir_manifest,
+			DirIVAuth:          dirIVAuth,
+			XattrAuth:          args.xattr_auth,
+			AuthTimes:          args.auth_times,
+			LongSymlinks:       args.long_symlinks,
+			AuthLinks:          args.auth_links && !args.reverse,
+			HeaderV3:           args.header_v3,
 			BlockSize:          args.blocksize,
+			KeyEscrow:          escrowRecipients,
+			// Backup copies only make sense in the CIPHERDIR
+			ConfigHMAC: !args.reverse && !args._configCustom && !args.upstream_compat,
+			Upstream:   args.upstream_compat,
 		})
 		if err != nil {
 			tlog.Fatal.Println(err)
@@ -133,13 +167,19 @@ func initDir(args *argContainer) {
 		// Open cipherdir (following symlinks)
 		dirfd, err := syscall.Open(args.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		if err == nil {
-			err = nametransform.WriteDirIVAt(dirfd)
+			err = writeRootDirIV(dirfd, masterkey, dirIVAuth, args.dir_manifest)
 			syscall.Close(dirfd)
 		}
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.Init)
 		}
+		if cf, err := configfile.Load(args.config); err == nil && cf.KeyFingerprint != nil {
+			storeCipherdirFingerprint(args.cipherdir, cf.KeyFingerprint)
+		}
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
 	}
 	mountArgs := ""
 	fsName := "gocryptfs"
@@ -162,3 +202,28 @@ func initDir(args *argContainer) {
 	tlog.Info.Printf(tlog.ColorGrey+"You can now mount it using: %s%s %s MOUNTPOINT"+tlog.ColorReset,
 		tlog.ProgramName, mountArgs, friendlyPath)
 }
+
+// writeRootDirIV creates the gocryptfs.diriv file in the root directory
+// opened at "dirfd", and, if "dirManifest" is set, the empty
+// gocryptfs.manifest file. "masterkey" is only needed if "dirIVAuth" or
+// "dirManifest" is set.
+func writeRootDirIV(dirfd int, masterkey []byte, dirIVAuth bool, dirManifest bool) error {
+	if !dirIVAuth && !dirManifest {
+		return nametransform.WriteDirIVAt(dirfd)
+	}
+	fa := filenameauth.NewEmbedded(masterkey)
+	defer fa.Wipe()
+	n := nametransform.New(nil, true, 0, true, nil, false, fa)
+	if dirIVAuth {
+		n.EnableDirIVAuth()
+	}
+	err := n.CreateDirIVAt(dirfd, nametransform.RootDirCName)
+	if err != nil || !dirManifest {
+		return err
+	}
+	iv, err := n.ReadDirIVAt(dirfd)
+	if err != nil {
+		return err
+	}
+	return nametransform.WriteManifestAt(dirfd, fa, iv, nametransform.NewManifest())
+}
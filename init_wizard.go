@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cpudetection"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/speed"
+	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// wizardScryptLogN are the scrypt cost parameters the wizard offers.
+// logN=19 already needs 512 MiB of memory.
+var wizardScryptLogN = []int{16, 17, 18, 19}
+
+// wizardUnlockTarget is the unlock time the scrypt calibration aims for
+const wizardUnlockTarget = time.Second
+
+// wizardBlockSizes are the block sizes "-blocksize" accepts
+var wizardBlockSizes = []int{4096, 16384, 32768, 65536}
+
+// wizard asks the questions of "-init -wizard". It reads the answers line by
+// line from "in" and prints the questions to "out".
+type wizard struct {
+	in  io.Reader
+	out io.Writer
+	// The live measurements. Replaced by the tests, the real ones take
+	// several seconds.
+	cipherSpeed  func() speed.QuickResult
+	scryptTime   func(logN int) time.Duration
+	argon2idTime func() time.Duration
+}
+
+// initWizard implements "-init -wizard". It asks the user how the new
+// filesystem should be set up and stores the answers in "args", so initDir
+// creates the same config file as with the equivalent flags. The flags that
+// were passed on the command line are the default answers.
+// Exits if stdin is not a terminal or the user does not confirm.
+func initWizard(args *argContainer) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		tlog.Fatal.Printf("-wizard needs a terminal to ask questions")
+		os.Exit(exitcodes.Usage)
+	}
+	w := &wizard{
+		in:  os.Stdin,
+		out: os.Stderr,
+		cipherSpeed: func() speed.QuickResult {
+			return speed.Quick(200 * time.Millisecond)
+		},
+		scryptTime:   speed.ScryptUnlockTime,
+		argon2idTime: speed.Argon2idUnlockTime,
+	}
+	ok, err := w.run(args)
+	if err != nil {
+		tlog.Fatal.Printf("-wizard: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if !ok {
+		tlog.Info.Printf("Aborted, nothing has been created.")
+		os.Exit(exitcodes.Init)
+	}
+}
+
+// run asks all questions and stores the answers in "args". Returns false if
+// the user does not confirm the summary.
+func (w *wizard) run(args *argContainer) (bool, error) {
+	fmt.Fprintf(w.out, "This wizard sets up a new gocryptfs filesystem. Press Enter to accept the default answer (*).\n")
+	// Reverse mode has to come first, it implies AES-SIV
+	if !args.reverse && !args.dir_manifest && !args.xattr_auth && !args.auth_times && !args.auth_links && !args.encrypt_acl {
+		i, err := w.choose("Which mode should the filesystem use?", []string{
+			"forward: files written to the mountpoint are stored encrypted in CIPHERDIR",
+			"reverse: the mountpoint shows an encrypted view of the plaintext files in CIPHERDIR, for backups",
+		}, 0)
+		if err != nil {
+			return false, err
+		}
+		args.reverse = i == 1
+	}
+	if err := w.askCipher(args); err != nil {
+		return false, err
+	}
+	if err := w.askKDF(args); err != nil {
+		return false, err
+	}
+	// -dir-manifest needs filename authentication, and there is nothing to
+	// authenticate with -plaintextnames
+	if !args.plaintextnames && !args.dir_manifest {
+		auth, err := w.yesNo("Authenticate file names? This detects renamed, swapped or deleted files and costs a little speed.",
+			args.filename_auth)
+		if err != nil {
+			return false, err
+		}
+		args.filename_auth = auth
+		args.no_filename_auth = !auth
+	}
+	if err := w.askBlockSize(args); err != nil {
+		return false, err
+	}
+	fmt.Fprintf(w.out, "\nSummary: %s\n", wizardSummary(args))
+	if flags := wizardFlags(args); len(flags) > 0 {
+		fmt.Fprintf(w.out, "Equivalent options: %s\n", strings.Join(flags, " "))
+	}
+	return w.yesNo("Create the filesystem?", true)
+}
+
+// askCipher asks for the content encryption and shows how fast each cipher
+// is on this machine. Reverse mode always uses AES-SIV.
+func (w *wizard) askCipher(args *argContainer) error {
+	if args.reverse {
+		fmt.Fprintf(w.out, "\nReverse mode encrypts file contents with AES-SIV.\n")
+		args.aessiv = true
+		args.xchacha = false
+		return nil
+	}
+	fmt.Fprintf(w.out, "\nMeasuring cipher speed...\n")
+	s := w.cipherSpeed()
+	def := 0
+	if args.xchacha {
+		def = 1
+	} else if args.aessiv {
+		def = 2
+	} else if !stupidgcm.HasAESGCMHardwareSupport() {
+		def = 1
+	}
+	cd := cpudetection.New()
+	fmt.Fprintf(w.out, "CPU: %s\nHint: %s\n", cd.String(), cd.GetPerformanceHint())
+	i, err := w.choose("Which cipher should encrypt the file contents?", []string{
+		fmt.Sprintf("AES-256-GCM, %.0f MB/s", s.AESGCM),
+		fmt.Sprintf("XChaCha20-Poly1305, %.0f MB/s, fast without AES acceleration", s.XChaCha20Poly1305),
+		fmt.Sprintf("AES-SIV, %.0f MB/s, deterministic, mainly for reverse mode", s.AESSIV),
+	}, def)
+	if err != nil {
+		return err
+	}
+	args.xchacha = i == 1
+	args.aessiv = i == 2
+	return nil
+}
+
+// askKDF asks for the key derivation function. For scrypt, it measures the
+// cost parameters and proposes the strongest one that unlocks within
+// wizardUnlockTarget.
+func (w *wizard) askKDF(args *argContainer) error {
+	fmt.Fprintf(w.out, "\nMeasuring key derivation time...\n")
+	def := 0
+	if !args.argon2id {
+		def = 1
+	}
+	i, err := w.choose("Which function should derive the key from the password? It slows down password guessing.", []string{
+		fmt.Sprintf("Argon2id, unlocking takes %d ms", w.argon2idTime().Milliseconds()),
+		"scrypt, with a cost parameter calibrated on this machine",
+	}, def)
+	if err != nil {
+		return err
+	}
+	args.argon2id = i == 0
+	args.scrypt = i == 1
+	if args.argon2id {
+		return nil
+	}
+	fmt.Fprintf(w.out, "\nCalibrating scrypt...\n")
+	var choices []string
+	def = 0
+	for j, logN := range wizardScryptLogN {
+		d := w.scryptTime(logN)
+		// scrypt needs 128 * r * N bytes with r=8
+		choices = append(choices, fmt.Sprintf("logN=%d, %d MiB, unlocking takes %d ms",
+			logN, (1<<logN)/1024, d.Milliseconds()))
+		if d > wizardUnlockTarget {
+			// The next ones would only take longer
+			break
+		}
+		def = j
+	}
+	if args._explicitScryptn {
+		for j := range choices {
+			if wizardScryptLogN[j] == args.scryptn {
+				def = j
+			}
+		}
+	}
+	i, err = w.choose("Which scrypt cost parameter? Higher is slower to guess, but also slower to unlock.", choices, def)
+	if err != nil {
+		return err
+	}
+	args.scryptn = wizardScryptLogN[i]
+	args._explicitScryptn = true
+	return nil
+}
+
+// askBlockSize asks for the plaintext block size
+func (w *wizard) askBlockSize(args *argContainer) error {
+	def := 0
+	var choices []string
+	for i, bs := range wizardBlockSizes {
+		c := fmt.Sprintf("%d bytes", bs)
+		switch i {
+		case 0:
+			c += ", best for small files and random access, compatible with older gocryptfs versions"
+		case len(wizardBlockSizes) - 1:
+			c += ", best throughput for large files that are read and written sequentially"
+		}
+		choices = append(choices, c)
+		if bs == args.blocksize {
+			def = i
+		}
+	}
+	i, err := w.choose("Which block size should file contents be encrypted in?", choices, def)
+	if err != nil {
+		return err
+	}
+	args.blocksize = wizardBlockSizes[i]
+	return nil
+}
+
+// choose asks "question" and returns the index of the choice the user
+// picked. An empty answer picks "def".
+func (w *wizard) choose(question string, choices []string, def int) (int, error) {
+	fmt.Fprintf(w.out, "\n%s\n", question)
+	for i, c := range choices {
+		mark := " "
+		if i == def {
+			mark = "*"
+		}
+		fmt.Fprintf(w.out, " %s%d) %s\n", mark, i+1, c)
+	}
+	for {
+		fmt.Fprintf(w.out, "Choice [%d]: ", def+1)
+		l, err := w.readLine()
+		if err != nil {
+			return 0, err
+		}
+		if l == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(l)
+		if err == nil && n >= 1 && n <= len(choices) {
+			return n - 1, nil
+		}
+		fmt.Fprintf(w.out, "Please enter a number between 1 and %d.\n", len(choices))
+	}
+}
+
+// yesNo asks "question" and returns the answer. An empty answer picks "def".
+func (w *wizard) yesNo(question string, def bool) (bool, error) {
+	hint := "[y/N]"
+	if def {
+		hint = "[Y/n]"
+	}
+	for {
+		fmt.Fprintf(w.out, "\n%s %s ", question, hint)
+		l, err := w.readLine()
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(l) {
+		case "":
+			return def, nil
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+		fmt.Fprintf(w.out, "Please answer y or n.\n")
+	}
+}
+
+// readLine reads one line. It reads byte by byte, so nothing that comes
+// after the line is consumed. The password prompt reads from the same
+// terminal afterwards.
+func (w *wizard) readLine() (string, error) {
+	var l []byte
+	b := make([]byte, 1)
+	for {
+		n, err := w.in.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			l = append(l, b[0])
+		}
+		if err == io.EOF {
+			if len(l) == 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			break
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return strings.TrimSpace(string(l)), nil
+}
+
+// wizardSummary describes the settings in "args" that the wizard asks for
+func wizardSummary(args *argContainer) string {
+	parts := []string{"forward mode"}
+	if args.reverse {
+		parts[0] = "reverse mode"
+	}
+	switch {
+	case args.aessiv:
+		parts = append(parts, "AES-SIV")
+	case args.xchacha:
+		parts = append(parts, "XChaCha20-Poly1305")
+	default:
+		parts = append(parts, "AES-256-GCM")
+	}
+	if args.argon2id {
+		parts = append(parts, "Argon2id")
+	} else {
+		parts = append(parts, fmt.Sprintf("scrypt logN=%d", args.scryptn))
+	}
+	if args.plaintextnames {
+		parts = append(parts, "plaintext file names")
+	} else if args.filename_auth {
+		parts = append(parts, "authenticated file names")
+	} else {
+		parts = append(parts, "unauthenticated file names")
+	}
+	parts = append(parts, fmt.Sprintf("%d-byte blocks", args.blocksize))
+	return strings.Join(parts, ", ")
+}
+
+// wizardFlags returns the command-line flags that create the same
+// filesystem as the wizard answers in "args". Defaults are left out.
+func wizardFlags(args *argContainer) (flags []string) {
+	if args.reverse {
+		flags = append(flags, "-reverse")
+	} else if args.aessiv {
+		flags = append(flags, "-aessiv")
+	} else if args.xchacha {
+		flags = append(flags, "-xchacha")
+	}
+	if !args.argon2id {
+		flags = append(flags, "-scrypt")
+		if args.scryptn != configfile.ScryptDefaultLogN {
+			flags = append(flags, fmt.Sprintf("-scryptn=%d", args.scryptn))
+		}
+	}
+	if !args.filename_auth && !args.plaintextnames {
+		flags = append(flags, "-no-filename-auth")
+	}
+	if args.blocksize != 4096 {
+		flags = append(flags, fmt.Sprintf("-blocksize=%d", args.blocksize))
+	}
+	return flags
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/speed"
+)
+
+// wizardTestArgs returns the defaults of the flags the wizard asks about
+func wizardTestArgs() argContainer {
+	return argContainer{
+		argon2id:      true,
+		filename_auth: true,
+		blocksize:     4096,
+		scryptn:       configfile.ScryptDefaultLogN,
+	}
+}
+
+// testWizard returns a wizard that reads "answers" and uses fake
+// measurements
+func testWizard(answers string) (*wizard, *bytes.Buffer) {
+	var out bytes.Buffer
+	w := &wizard{
+		in:  strings.NewReader(answers),
+		out: &out,
+		cipherSpeed: func() speed.QuickResult {
+			return speed.QuickResult{AESGCM: 1000, AESSIV: 300, XChaCha20Poly1305: 800}
+		},
+		// logN=18 is the last one that unlocks within wizardUnlockTarget
+		scryptTime: func(logN int) time.Duration {
+			return time.Duration(1<<logN) * 3 * time.Microsecond
+		},
+		argon2idTime: func() time.Duration { return 100 * time.Millisecond },
+	}
+	return w, &out
+}
+
+func TestWizardDefaults(t *testing.T) {
+	args := wizardTestArgs()
+	w, _ := testWizard("\n\n\n\n\n\n")
+	ok, err := w.run(&args)
+	if err != nil || !ok {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	// Without AES acceleration, XChaCha20-Poly1305 is the default
+	if flags := wizardFlags(&args); len(flags) != 0 && !reflect.DeepEqual(flags, []string{"-xchacha"}) {
+		t.Errorf("defaults should not need flags, got %q", flags)
+	}
+}
+
+func TestWizardAnswers(t *testing.T) {
+	args := wizardTestArgs()
+	// forward, invalid answer then XChaCha20-Poly1305, scrypt with the
+	// calibrated default, no filename auth, 64 KiB blocks, confirm
+	w, out := testWizard("1\n9\n2\n2\n\nn\n4\ny\n")
+	ok, err := w.run(&args)
+	if err != nil || !ok {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	want := []string{"-xchacha", "-scrypt", "-scryptn=18", "-no-filename-auth", "-blocksize=65536"}
+	if flags := wizardFlags(&args); !reflect.DeepEqual(flags, want) {
+		t.Errorf("want %q, got %q", want, flags)
+	}
+	if !strings.Contains(out.String(), "Please enter a number between 1 and 3.") {
+		t.Errorf("invalid answer was not rejected:\n%s", out.String())
+	}
+	if args.argon2id || !args.scrypt || !args._explicitScryptn {
+		t.Errorf("argon2id=%v scrypt=%v _explicitScryptn=%v", args.argon2id, args.scrypt, args._explicitScryptn)
+	}
+}
+
+func TestWizardReverse(t *testing.T) {
+	args := wizardTestArgs()
+	// reverse, Argon2id, filename auth, 4 KiB blocks, do not confirm
+	w, _ := testWizard("2\n\n\n\nn\n")
+	ok, err := w.run(&args)
+	if err != nil || ok {
+		t.Fatalf("ok=%v err=%v", ok, err)
+	}
+	if !args.reverse || !args.aessiv {
+		t.Errorf("reverse=%v aessiv=%v", args.reverse, args.aessiv)
+	}
+}
+
+// Running out of answers must not silently pick the defaults
+func TestWizardEOF(t *testing.T) {
+	args := wizardTestArgs()
+	w, _ := testWizard("\n")
+	if _, err := w.run(&args); err == nil {
+		t.Error("should have failed")
+	}
+}
@@ -0,0 +1,247 @@
+// Package accesspolicy restricts which users and groups may read or write
+// plaintext subtrees of a mounted filesystem, see "-access-policy".
+//
+// A policy file contains one rule per line:
+//
+//	PATH ACCESS PRINCIPAL...
+//
+// PATH is a plaintext path relative to the mountpoint. ACCESS is "rw", "r" or
+// "none". A PRINCIPAL is "uid:N", "gid:N", "user:NAME", "group:NAME" or "*"
+// for everybody. Empty lines and lines starting with "#" are ignored.
+//
+// The rules of the longest PATH that is a prefix of (or equal to) the accessed
+// path govern the access. The caller gets the union of the access of all of
+// these rules that match one of its principals, and no access if none
+// matches. Paths not below any PATH are not restricted. The root user is not
+// exempt.
+package accesspolicy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Access is a bitmap of access rights.
+type Access uint8
+
+const (
+	// Read allows to open files for reading, list directories, look up names
+	// and read symlinks and xattrs.
+	Read Access = 1 << iota
+	// Write allows to modify files and directories.
+	Write
+
+	// None is no access
+	None Access = 0
+)
+
+// String returns "rw", "r", "w" or "none"
+func (a Access) String() string {
+	switch a {
+	case Read | Write:
+		return "rw"
+	case Read:
+		return "r"
+	case Write:
+		return "w"
+	}
+	return "none"
+}
+
+func parseAccess(s string) (Access, bool) {
+	switch s {
+	case "rw":
+		return Read | Write, true
+	case "r":
+		return Read, true
+	case "none":
+		return None, true
+	}
+	return None, false
+}
+
+// principal matches a uid, a gid, or everybody.
+type principal struct {
+	everybody bool
+	isGroup   bool
+	id        uint32
+}
+
+func parsePrincipal(s string) (principal, error) {
+	if s == "*" {
+		return principal{everybody: true}, nil
+	}
+	kind, val, ok := strings.Cut(s, ":")
+	if !ok || val == "" {
+		return principal{}, fmt.Errorf("invalid principal %q", s)
+	}
+	var id string
+	switch kind {
+	case "uid", "gid":
+		id = val
+	case "user":
+		u, err := user.Lookup(val)
+		if err != nil {
+			return principal{}, err
+		}
+		id = u.Uid
+	case "group":
+		g, err := user.LookupGroup(val)
+		if err != nil {
+			return principal{}, err
+		}
+		id = g.Gid
+	default:
+		return principal{}, fmt.Errorf("invalid principal %q", s)
+	}
+	n, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return principal{}, fmt.Errorf("invalid principal %q: %v", s, err)
+	}
+	return principal{isGroup: kind == "gid" || kind == "group", id: uint32(n)}, nil
+}
+
+type rule struct {
+	access     Access
+	principals []principal
+}
+
+// Policy is a parsed policy file. It is immutable and safe for concurrent
+// use.
+type Policy struct {
+	// rules maps cleaned paths ("" is the root) to their rules
+	rules map[string][]rule
+}
+
+// Load reads the policy file "filename".
+func Load(filename string) (*Policy, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	p, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return p, nil
+}
+
+// Parse reads a policy from "r".
+func Parse(r io.Reader) (*Policy, error) {
+	p := &Policy{rules: make(map[string][]rule)}
+	s := bufio.NewScanner(r)
+	for lineNo := 1; s.Scan(); lineNo++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: want PATH ACCESS PRINCIPAL...", lineNo)
+		}
+		access, ok := parseAccess(fields[1])
+		if !ok {
+			return nil, fmt.Errorf("line %d: invalid access %q", lineNo, fields[1])
+		}
+		ru := rule{access: access}
+		for _, f := range fields[2:] {
+			pr, err := parsePrincipal(f)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			ru.principals = append(ru.principals, pr)
+		}
+		key := cleanPath(fields[0])
+		p.rules[key] = append(p.rules[key], ru)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// cleanPath turns "p" into the form returned by fusefrontend.Node.Path():
+// relative to the root, without leading or trailing slashes.
+func cleanPath(p string) string {
+	p = path.Clean("/" + p)
+	return strings.TrimPrefix(p, "/")
+}
+
+// governing returns the longest prefix of "plainPath" that has rules, and
+// its rules.
+func (p *Policy) governing(plainPath string) (string, []rule, bool) {
+	for {
+		if r, ok := p.rules[plainPath]; ok {
+			return plainPath, r, true
+		}
+		if plainPath == "" {
+			return "", nil, false
+		}
+		i := strings.LastIndexByte(plainPath, '/')
+		if i < 0 {
+			plainPath = ""
+		} else {
+			plainPath = plainPath[:i]
+		}
+	}
+}
+
+// Allowed returns whether the user "uid" may access "plainPath" (relative to
+// the root, as returned by fusefrontend.Node.Path()) with "want".
+// "groups" returns the groups of the user. It is only called when a rule
+// refers to a group.
+func (p *Policy) Allowed(plainPath string, uid uint32, groups func() []uint32, want Access) bool {
+	_, rules, ok := p.governing(plainPath)
+	if !ok {
+		return true
+	}
+	var have Access
+	var gids []uint32
+	haveGids := false
+	for _, r := range rules {
+		for _, pr := range r.principals {
+			match := pr.everybody || !pr.isGroup && pr.id == uid
+			if !match && pr.isGroup {
+				if !haveGids {
+					gids = groups()
+					haveGids = true
+				}
+				for _, g := range gids {
+					if g == pr.id {
+						match = true
+						break
+					}
+				}
+			}
+			if match {
+				have |= r.access
+				break
+			}
+		}
+	}
+	return have&want == want
+}
+
+// Governing returns the PATH whose rules govern "plainPath", and false if
+// "plainPath" is not restricted.
+func (p *Policy) Governing(plainPath string) (string, bool) {
+	key, _, ok := p.governing(plainPath)
+	return key, ok
+}
+
+// HasRulesBelow returns whether a PATH is at or below "plainPath". Renaming
+// "plainPath" would take the files under that PATH away from its rules.
+func (p *Policy) HasRulesBelow(plainPath string) bool {
+	for key := range p.rules {
+		if plainPath == "" || key == plainPath || strings.HasPrefix(key, plainPath+"/") {
+			return true
+		}
+	}
+	return false
+}
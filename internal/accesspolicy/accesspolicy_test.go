@@ -0,0 +1,93 @@
+package accesspolicy
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	p, err := Parse(strings.NewReader(`
+# shared vault
+/finance        rw   uid:1000
+/finance        r    gid:100
+finance/2024/   none *
+/finance/2024   r    uid:1000
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	groups := func(gids ...uint32) func() []uint32 {
+		return func() []uint32 { return gids }
+	}
+	testCases := []struct {
+		path string
+		uid  uint32
+		gids []uint32
+		want Access
+		ok   bool
+	}{
+		{"other", 1001, nil, Read | Write, true},
+		{"", 1001, nil, Read | Write, true},
+		{"finance", 1000, nil, Read | Write, true},
+		{"finance/a/b", 1000, nil, Write, true},
+		{"finance/a", 1001, []uint32{100}, Read, true},
+		{"finance/a", 1001, []uint32{100}, Write, false},
+		{"finance/a", 1001, []uint32{5, 100}, Read, true},
+		{"finance/a", 1001, nil, Read, false},
+		{"financeX", 1001, nil, Read, true},
+		{"finance/2024/x", 1000, nil, Read, true},
+		{"finance/2024/x", 1000, nil, Write, false},
+		{"finance/2024", 1001, []uint32{100}, Read, false},
+		{"finance/2024", 0, nil, Read, false},
+	}
+	for _, tc := range testCases {
+		if ok := p.Allowed(tc.path, tc.uid, groups(tc.gids...), tc.want); ok != tc.ok {
+			t.Errorf("%q uid=%d gids=%v want=%d: have %v", tc.path, tc.uid, tc.gids, tc.want, ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"/a rw",
+		"/a rwx *",
+		"/a r uid:x",
+		"/a r foo:1",
+		"/a r uid:",
+	} {
+		if _, err := Parse(strings.NewReader(in)); err == nil {
+			t.Errorf("%q: no error", in)
+		}
+	}
+}
+
+func TestGoverningHasRulesBelow(t *testing.T) {
+	p, err := Parse(strings.NewReader("/finance rw *\n/finance/salary none *\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		"finance":          "finance",
+		"finance/a":        "finance",
+		"finance/salary":   "finance/salary",
+		"finance/salary/x": "finance/salary",
+		"other":            "",
+	} {
+		if have, ok := p.Governing(path); have != want || ok != (want != "") {
+			t.Errorf("Governing(%q) = %q, %v, want %q", path, have, ok, want)
+		}
+	}
+	for path, want := range map[string]bool{
+		"":                 true,
+		"finance":          true,
+		"finance/salary":   true,
+		"finance/a":        false,
+		"finance/salary/x": false,
+		"financeX":         false,
+		"other":            false,
+	} {
+		if have := p.HasRulesBelow(path); have != want {
+			t.Errorf("HasRulesBelow(%q) = %v, want %v", path, have, want)
+		}
+	}
+}
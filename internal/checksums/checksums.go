@@ -0,0 +1,306 @@
+// Package checksums implements "gocryptfs -export-checksums" and
+// "-verify-checksums": a manifest with a checksum of every file in
+// CIPHERDIR, which checks a backup of the ciphertext without mounting it.
+//
+// The manifest is a text file in the BSD tag format of sha256sum:
+//
+//	# gocryptfs checksums v1
+//	SHA256 (gocryptfs.conf) = 5c0a...
+//	SHA256 (gocryptfs.diriv) = 9f1e...
+//
+// Paths are relative to CIPHERDIR. Unkeyed manifests can be checked by
+// anybody, also with "sha256sum -c" in the backup directory. They detect
+// accidental damage, but whoever can change the backup can also update the
+// manifest. Keyed manifests use HMAC-SHA256 with a key derived from the
+// master key instead, and end in a MAC over the whole manifest, so that
+// files cannot be changed, dropped or added without it being noticed. They
+// need the password to be written and checked.
+package checksums
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+)
+
+const (
+	// AlgoSHA256 is the tag of unkeyed checksums
+	AlgoSHA256 = "SHA256"
+	// AlgoHMAC is the tag of keyed checksums
+	AlgoHMAC = "HMAC-SHA256"
+
+	header = "# gocryptfs checksums v1\n"
+	// trailerPrefix starts the last line of a keyed manifest, which holds
+	// the MAC of all lines before it
+	trailerPrefix = "# " + AlgoHMAC + " manifest = "
+)
+
+// ErrNeedKey is returned by Verify for a keyed manifest without a key
+var ErrNeedKey = errors.New("the manifest is keyed, the password is needed to check it")
+
+// ErrNotKeyed is returned by Verify if it gets a key for an unkeyed
+// manifest. A keyed manifest may have been replaced by an unkeyed one.
+var ErrNotKeyed = errors.New("the manifest is not keyed")
+
+// ErrModified is returned by Verify if the MAC of a keyed manifest does not
+// match
+var ErrModified = errors.New("the manifest has been modified, or belongs to another filesystem")
+
+// Stats counts the files in a manifest
+type Stats struct {
+	Files int
+	// Bytes is the total size of the files
+	Bytes int64
+}
+
+// Result is what Verify has found. The paths are relative to the
+// directory that was checked.
+type Result struct {
+	Stats
+	// Keyed is true for a keyed manifest
+	Keyed bool
+	// Changed are the files whose content does not match, or that cannot
+	// be read
+	Changed []string
+	// Missing are the files in the manifest that do not exist
+	Missing []string
+	// Added are the files that are not in the manifest
+	Added []string
+}
+
+// Intact returns true if the directory matches the manifest
+func (r *Result) Intact() bool {
+	return len(r.Changed) == 0 && len(r.Missing) == 0 && len(r.Added) == 0
+}
+
+// excluded returns true for the entries in the CIPHERDIR root that are not
+// in the manifest: the snapshots, which are complete copies, the long name
+// journal, which only has content while mounted, and the tuning state,
+// which changes on every mount.
+func excluded(rel string) bool {
+	return rel == snapshot.DirName || rel == nametransform.JournalDirName || tuning.IsStateFile(rel)
+}
+
+// walk calls "fn" for every regular file in "dir" that goes into the
+// manifest, in lexical order, with the path relative to "dir"
+func walk(dir string, fn func(rel string, path string) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if excluded(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return fn(filepath.ToSlash(rel), path)
+	})
+}
+
+// newHash returns SHA-256, or HMAC-SHA256 with "key" if it is not nil
+func newHash(key []byte) hash.Hash {
+	if key == nil {
+		return sha256.New()
+	}
+	return hmac.New(sha256.New, key)
+}
+
+// sum returns the checksum of the file "path" and its size
+func sum(path string, key []byte) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := newHash(key)
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// escaper and unescaper handle names with backslashes and line breaks like
+// sha256sum does: the line starts with a backslash, and they are escaped.
+var (
+	escaper   = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+	unescaper = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r")
+)
+
+// formatLine returns the manifest line for the file "rel"
+func formatLine(algo string, rel string, sum string) string {
+	if strings.ContainsAny(rel, "\\\n\r") {
+		return fmt.Sprintf("\\%s (%s) = %s\n", algo, escaper.Replace(rel), sum)
+	}
+	return fmt.Sprintf("%s (%s) = %s\n", algo, rel, sum)
+}
+
+// parseLine parses a manifest line without the line break
+func parseLine(line string) (algo string, rel string, sum string, err error) {
+	escaped := strings.HasPrefix(line, `\`)
+	if escaped {
+		line = line[1:]
+	}
+	i := strings.Index(line, " (")
+	j := strings.LastIndex(line, ") = ")
+	if i <= 0 || j < i+2 {
+		return "", "", "", fmt.Errorf("invalid line %q", line)
+	}
+	algo, rel, sum = line[:i], line[i+2:j], line[j+4:]
+	if escaped {
+		rel = unescaper.Replace(rel)
+	}
+	if algo != AlgoSHA256 && algo != AlgoHMAC {
+		return "", "", "", fmt.Errorf("unknown checksum type %q", algo)
+	}
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+		return "", "", "", fmt.Errorf("invalid checksum %q", sum)
+	}
+	return algo, rel, sum, nil
+}
+
+// Write writes the manifest of "dir" to "w". With a nil "key", the
+// checksums are SHA-256, otherwise HMAC-SHA256 with "key".
+func Write(w io.Writer, dir string, key []byte) (Stats, error) {
+	var stats Stats
+	algo := AlgoSHA256
+	var mac hash.Hash
+	out := w
+	if key != nil {
+		algo = AlgoHMAC
+		mac = hmac.New(sha256.New, key)
+		w = io.MultiWriter(w, mac)
+	}
+	if _, err := io.WriteString(w, header); err != nil {
+		return stats, err
+	}
+	err := walk(dir, func(rel string, path string) error {
+		s, n, err := sum(path, key)
+		if err != nil {
+			return err
+		}
+		stats.Files++
+		stats.Bytes += n
+		_, err = io.WriteString(w, formatLine(algo, rel, s))
+		return err
+	})
+	if err != nil {
+		return stats, err
+	}
+	if mac != nil {
+		trailer := trailerPrefix + hex.EncodeToString(mac.Sum(nil)) + "\n"
+		if _, err := io.WriteString(out, trailer); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// IsKeyed returns true if the manifest "data" is keyed. The entries follow
+// the header, so they all start after a line break.
+func IsKeyed(data []byte) bool {
+	for _, marker := range []string{"\n" + trailerPrefix, "\n" + AlgoHMAC + " (", "\n\\" + AlgoHMAC + " ("} {
+		if bytes.Contains(data, []byte(marker)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify checks "dir" against the manifest "data". A keyed manifest needs
+// "key", otherwise Verify returns ErrNeedKey, and an unkeyed one must not
+// get a key (ErrNotKeyed).
+func Verify(data []byte, dir string, key []byte) (*Result, error) {
+	res := &Result{Keyed: IsKeyed(data)}
+	if res.Keyed && key == nil {
+		return nil, ErrNeedKey
+	} else if !res.Keyed && key != nil {
+		return nil, ErrNotKeyed
+	}
+	if res.Keyed {
+		i := bytes.LastIndex(data, []byte(trailerPrefix))
+		if i < 0 || (i > 0 && data[i-1] != '\n') {
+			return nil, ErrModified
+		}
+		want, err := hex.DecodeString(strings.TrimSpace(string(data[i+len(trailerPrefix):])))
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data[:i])
+		if err != nil || !hmac.Equal(mac.Sum(nil), want) {
+			return nil, ErrModified
+		}
+		data = data[:i]
+	}
+	want := make(map[string]string)
+	var order []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		algo, rel, s, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if (algo == AlgoHMAC) != res.Keyed {
+			return nil, fmt.Errorf("mixed checksum types in the manifest")
+		}
+		if _, ok := want[rel]; ok {
+			return nil, fmt.Errorf("%q is in the manifest twice", rel)
+		}
+		want[rel] = s
+		order = append(order, rel)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	err := walk(dir, func(rel string, path string) error {
+		seen[rel] = true
+		s, ok := want[rel]
+		if !ok {
+			res.Added = append(res.Added, rel)
+			return nil
+		}
+		have, n, err := sum(path, key)
+		if err != nil || have != s {
+			res.Changed = append(res.Changed, rel)
+			return nil
+		}
+		res.Files++
+		res.Bytes += n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range order {
+		if !seen[rel] {
+			res.Missing = append(res.Missing, rel)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,133 @@
+package checksums
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// testDir creates a directory with a few files, a symlink, and a long name
+// journal that is not checked
+func testDir(t *testing.T) string {
+	dir := t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	os.Mkdir(filepath.Join(dir, nametransform.JournalDirName), 0700)
+	for name, content := range map[string]string{
+		"gocryptfs.conf":      "{}",
+		"a":                   "aaa",
+		"sub/b":               "bbb",
+		"sub/back\\slash":     "ccc",
+		"sub/line\nbreak":     "ddd",
+		"gocryptfs.journal/x": "eee",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Symlink("a", filepath.Join(dir, "link"))
+	return dir
+}
+
+func write(t *testing.T, dir string, key []byte) []byte {
+	var b bytes.Buffer
+	stats, err := Write(&b, dir, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 5 || stats.Bytes != 14 {
+		t.Errorf("stats %+v", stats)
+	}
+	return b.Bytes()
+}
+
+func TestRoundtrip(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	for _, k := range [][]byte{nil, key} {
+		dir := testDir(t)
+		m := write(t, dir, k)
+		if IsKeyed(m) != (k != nil) {
+			t.Errorf("IsKeyed=%v", IsKeyed(m))
+		}
+		res, err := Verify(m, dir, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Intact() || res.Files != 5 || res.Keyed != (k != nil) {
+			t.Errorf("have %+v", res)
+		}
+		// Change, delete and add files
+		os.WriteFile(filepath.Join(dir, "a"), []byte("AAA"), 0600)
+		os.Remove(filepath.Join(dir, "sub", "line\nbreak"))
+		os.WriteFile(filepath.Join(dir, "sub", "new"), nil, 0600)
+		res, err = Verify(m, dir, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(res.Changed, []string{"a"}) || !reflect.DeepEqual(res.Missing, []string{"sub/line\nbreak"}) ||
+			!reflect.DeepEqual(res.Added, []string{"sub/new"}) || res.Files != 3 {
+			t.Errorf("have %+v", res)
+		}
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	key := bytes.Repeat([]byte{1}, 32)
+	dir := testDir(t)
+	m := write(t, dir, key)
+	if _, err := Verify(m, dir, nil); err != ErrNeedKey {
+		t.Errorf("no key: have %v", err)
+	}
+	if _, err := Verify(m, dir, bytes.Repeat([]byte{2}, 32)); err != ErrModified {
+		t.Errorf("wrong key: have %v", err)
+	}
+	// Dropping a line is detected
+	lines := strings.SplitAfter(string(m), "\n")
+	dropped := strings.Join(append(lines[:2:2], lines[3:]...), "")
+	if _, err := Verify([]byte(dropped), dir, key); err != ErrModified {
+		t.Errorf("dropped line: have %v", err)
+	}
+	// ... and so is the replacement by an unkeyed manifest
+	if _, err := Verify(write(t, dir, nil), dir, key); err != ErrNotKeyed {
+		t.Errorf("unkeyed: have %v", err)
+	}
+}
+
+// TestSha256sum checks that "sha256sum -c" understands unkeyed manifests
+func TestSha256sum(t *testing.T) {
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		t.Skip(err)
+	}
+	dir := testDir(t)
+	m := filepath.Join(t.TempDir(), "SHA256SUMS")
+	os.WriteFile(m, write(t, dir, nil), 0600)
+	cmd := exec.Command("sha256sum", "--strict", "-c", m)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Errorf("%v: %s", err, out)
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	for _, line := range []string{
+		"",
+		"SHA256 (a)",
+		"MD5 (a) = d41d8cd98f00b204e9800998ecf8427e",
+		"SHA256 (a) = 1234",
+		"SHA256 (a) = " + strings.Repeat("x", 64),
+	} {
+		if _, _, _, err := parseLine(line); err == nil {
+			t.Errorf("%q: no error", line)
+		}
+	}
+	sum := strings.Repeat("0", 64)
+	algo, rel, s, err := parseLine(`\SHA256 (a) = (b\\c\nd) = ` + sum)
+	if err != nil || algo != AlgoSHA256 || rel != "a) = (b\\c\nd" || s != sum {
+		t.Errorf("have %q %q %q %v", algo, rel, s, err)
+	}
+}
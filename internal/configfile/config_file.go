@@ -7,7 +7,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"syscall"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
@@ -65,11 +65,17 @@ type ConfFile struct {
 	Argon2idObject *Argon2idKDF `json:",omitempty"`
 	// Version is the On-Disk-Format version this filesystem uses
 	Version uint16
+	// ConfigVersion is the format version of the config file itself, see
+	// SchemaVersion. Not set in version 2 config files.
+	ConfigVersion uint16 `json:",omitempty"`
 	// FeatureFlags is a list of feature flags this filesystem has enabled.
 	// If gocryptfs encounters a feature flag it does not support, it will refuse
 	// mounting. This mechanism is analogous to the ext4 feature flags that are
 	// stored in the superblock.
 	FeatureFlags []string
+	// FeatureFlagsMAC authenticates FeatureFlags with a key derived from
+	// the master key. Only used when FlagFeatureFlagsMAC is set.
+	FeatureFlagsMAC []byte `json:",omitempty"`
 	// BlockSize is the plaintext block size in bytes (4096, 16384, 32768, 65536)
 	// Only used when FlagConfigurableBlockSize is set
 	BlockSize int `json:",omitempty"`
@@ -77,8 +83,33 @@ type ConfFile struct {
 	FIDO2 *FIDO2Params `json:",omitempty"`
 	// LongNameMax corresponds to the -longnamemax flag
 	LongNameMax uint8 `json:",omitempty"`
+	// Duress is set by "-duress-passwd"
+	Duress *DuressSlot `json:",omitempty"`
+	// Throttle is set by "-throttle"
+	Throttle *ThrottleParams `json:",omitempty"`
+	// KeyFingerprint is the fingerprint of the master key, see
+	// KeyFingerprint(). Set whenever the master key is encrypted.
+	KeyFingerprint []byte `json:",omitempty"`
+	// KeyEscrow is set by "-key-escrow"
+	KeyEscrow []KeyEscrow `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
+	// loadedFrom is the copy of the config file that was loaded. It differs
+	// from filename if a backup copy had to be used.
+	loadedFrom string
+	// raw is the content of loadedFrom, rawHMAC its HMAC
+	raw     []byte
+	rawHMAC []byte
+	// hmacKey signs the config file when FlagConfigHMAC is set. Derived from
+	// the password.
+	hmacKey []byte
+	// needsRepair is set if a backup copy had to be used
+	needsRepair bool
+	// notRegular is set if loadedFrom is not a regular file, like the pipe
+	// of "-config <(cat gocryptfs.conf)"
+	notRegular bool
+	// keepBackup is set by KeepBackup
+	keepBackup bool
 }
 
 // CreateArgs exists because the argument list to Create became too long.
@@ -98,7 +129,22 @@ type CreateArgs struct {
 	Masterkey          []byte
 	Argon2id           bool
 	FilenameAuth       bool
+	DirManifest        bool
+	DirIVAuth          bool
+	XattrAuth          bool
+	AuthTimes          bool
+	LongSymlinks       bool
+	AuthLinks          bool
+	HeaderV3           bool
 	BlockSize          int
+	// KeyEscrow gets a copy of the master key each, see "-key-escrow"
+	KeyEscrow []EscrowRecipient
+	// ConfigHMAC signs the config file and keeps backup copies next to it
+	ConfigHMAC bool
+	// Upstream creates a filesystem that upstream gocryptfs v2.x can mount:
+	// a version 2 config file without FlagFeatureFlagsMAC. Create fails if
+	// any other option needs a feature flag that upstream does not know.
+	Upstream bool
 }
 
 // Create - create a new config with a random key encrypted with
@@ -106,12 +152,18 @@ type CreateArgs struct {
 // Uses scrypt with cost parameter "LogN".
 func Create(args *CreateArgs) error {
 	cf := ConfFile{
-		filename: args.Filename,
-		Creator:  args.Creator,
-		Version:  contentenc.CurrentVersion,
+		filename:      args.Filename,
+		Creator:       args.Creator,
+		Version:       contentenc.CurrentVersion,
+		ConfigVersion: ConfigVersionCurrent,
 	}
 	// Feature flags
 	cf.setFeatureFlag(FlagHKDF)
+	if args.Upstream {
+		cf.ConfigVersion = 0
+	} else {
+		cf.setFeatureFlag(FlagFeatureFlagsMAC)
+	}
 	if args.XChaCha20Poly1305 {
 		cf.setFeatureFlag(FlagXChaCha20Poly1305)
 	} else {
@@ -151,16 +203,46 @@ func Create(args *CreateArgs) error {
 	}
 	if args.FilenameAuth {
 		cf.setFeatureFlag(FlagFilenameAuth)
+		cf.setFeatureFlag(FlagFilenameAuthEmbedded)
+	}
+	if args.DirManifest {
+		cf.setFeatureFlag(FlagDirManifest)
+	}
+	if args.DirIVAuth {
+		cf.setFeatureFlag(FlagDirIVAuth)
+	}
+	if args.XattrAuth {
+		cf.setFeatureFlag(FlagXattrAuth)
+	}
+	if args.AuthTimes {
+		cf.setFeatureFlag(FlagAuthTimes)
+	}
+	if args.LongSymlinks {
+		cf.setFeatureFlag(FlagLongSymlinks)
+	}
+	if args.AuthLinks {
+		cf.setFeatureFlag(FlagAuthLinks)
+	}
+	if args.HeaderV3 {
+		cf.setFeatureFlag(FlagHeaderV3)
 	}
 	if args.BlockSize != 4096 {
 		cf.setFeatureFlag(FlagConfigurableBlockSize)
 		cf.BlockSize = args.BlockSize
 	}
+	if args.ConfigHMAC {
+		cf.setFeatureFlag(FlagConfigHMAC)
+	}
 	// Catch bugs and invalid cli flag combinations early
 	cf.ScryptObject = NewScryptKDF(args.LogN)
 	if err := cf.Validate(); err != nil {
 		return err
 	}
+	if args.Upstream {
+		if err := cf.UpstreamCompatible(); err != nil {
+			return err
+		}
+	}
 	{
 		key := args.Masterkey
 		if key == nil {
@@ -176,10 +258,15 @@ func Create(args *CreateArgs) error {
 		} else {
 			cf.EncryptKey(key, args.Password, args.LogN)
 		}
+		cf.UpdateFeatureFlagsMAC(key)
+		err := cf.addKeyEscrow(key, args.KeyEscrow)
 		for i := range key {
 			key[i] = 0
 		}
 		// key runs out of scope here
+		if err != nil {
+			return err
+		}
 	}
 	// Write file to disk
 	return cf.WriteFile()
@@ -213,13 +300,34 @@ func LoadAndDecrypt(filename string, password []byte) ([]byte, *ConfFile, error)
 	return key, cf, err
 }
 
-// Load loads and parses the config file at "filename".
+// Load loads and parses the config file at "filename". If it cannot be
+// read or is invalid, the signed backup copies are tried.
 func Load(filename string) (*ConfFile, error) {
+	cf, err := loadCopy(filename, filename)
+	if err == nil {
+		return cf, nil
+	}
+	for _, path := range copyPaths(filename)[1:] {
+		backup, err2 := loadCopy(filename, path)
+		if err2 != nil || !backup.IsFeatureFlagSet(FlagConfigHMAC) {
+			continue
+		}
+		tlog.Warn.Printf("Config file %s is unusable (%v), using backup copy %s", filename, err, path)
+		backup.needsRepair = true
+		return backup, nil
+	}
+	return nil, err
+}
+
+// loadCopy loads and parses the copy at "path" of the config file
+// "filename".
+func loadCopy(filename string, path string) (*ConfFile, error) {
 	var cf ConfFile
 	cf.filename = filename
+	cf.loadedFrom = path
 
 	// Read from disk
-	js, err := os.ReadFile(filename)
+	js, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
@@ -237,11 +345,25 @@ func Load(filename string) (*ConfFile, error) {
 	if err := cf.Validate(); err != nil {
 		return nil, exitcodes.NewErr(err.Error(), exitcodes.DeprecatedFS)
 	}
+	cf.raw = js
+	if cf.IsFeatureFlagSet(FlagConfigHMAC) {
+		cf.rawHMAC = readHMAC(path)
+		if fi, err := os.Stat(path); err == nil && !fi.Mode().IsRegular() {
+			cf.notRegular = true
+		}
+	}
 
 	// All good
 	return &cf, nil
 }
 
+// SetFeatureFlag enables the feature flag "flag". Used when upgrading a
+// filesystem to a new format, like "-migrate-filenameauth" does.
+// Call UpdateFeatureFlagsMAC before writing the config file.
+func (cf *ConfFile) SetFeatureFlag(flag flagIota) {
+	cf.setFeatureFlag(flag)
+}
+
 func (cf *ConfFile) setFeatureFlag(flag flagIota) {
 	if cf.IsFeatureFlagSet(flag) {
 		// Already set, ignore
@@ -251,8 +373,29 @@ func (cf *ConfFile) setFeatureFlag(flag flagIota) {
 }
 
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
-// password.
+// password. If that fails, the signed backup copies are tried. If password
+// is the duress password, the master key is destroyed in all copies of the
+// config file, and the error is the same as for a wrong password.
+// If throttling is enabled, an attempt that comes too early after failed
+// ones is refused with exit code Throttled.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
+	if err = cf.throttleBegin(time.Now()); err != nil {
+		return nil, err
+	}
+	defer func() { cf.throttleEnd(err) }()
+	masterkey, err = cf.decryptMasterKey(password)
+	if err != nil {
+		if mk := cf.decryptBackup(password, err); mk != nil {
+			return mk, nil
+		}
+		cf.checkDuress(password, err)
+	}
+	return masterkey, err
+}
+
+// decryptMasterKey decrypts the masterkey of the copy that was loaded and
+// verifies the feature flags and the HMAC.
+func (cf *ConfFile) decryptMasterKey(password []byte) (masterkey []byte, err error) {
 	// Generate derived key from password
 	var derivedKey []byte
 	if cf.IsFeatureFlagSet(FlagArgon2id) {
@@ -272,8 +415,20 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	ce := getKeyEncrypter(derivedKey, useHKDF)
 
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
+	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, cf.keyAD())
+	stripped := false
+	if err != nil && cf.keyAD() == nil {
+		// Was the key encrypted for a config file that had
+		// FlagFeatureFlagsMAC?
+		if mk, err2 := ce.DecryptBlock(cf.EncryptedKey, 0, encryptedKeyAD); err2 == nil {
+			memProtect.SecureWipe(mk)
+			stripped = true
+		}
+	}
 	tlog.Warn.Enabled = true
+	if err == nil {
+		cf.setHMACKey(derivedKey)
+	}
 
 	// Purge derived key with memory protection
 	memProtect.SecureWipe(derivedKey)
@@ -281,13 +436,32 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	ce.Wipe()
 	ce = nil
 
+	if stripped {
+		return nil, exitcodes.NewErr(fmt.Sprintf("The %s feature flag has been removed from %s",
+			knownFlags[FlagFeatureFlagsMAC], cf.filename), exitcodes.ConfTampered)
+	}
 	if err != nil {
 		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
 		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
 	}
-
-	// Lock master key in memory
-	memProtect.LockMemory(masterkey)
+	// Move the master key between guard pages, which also locks it in
+	// memory. Callers release it with WipeKey.
+	guarded := memProtect.AllocateKey(len(masterkey))
+	copy(guarded, masterkey)
+	memProtect.SecureWipe(masterkey)
+	masterkey = guarded
+	if err = cf.VerifyFeatureFlags(masterkey); err != nil {
+		memProtect.WipeKey(masterkey)
+		return nil, err
+	}
+	if err = cf.verifyHMAC(); err != nil {
+		memProtect.WipeKey(masterkey)
+		return nil, err
+	}
+	if err = cf.VerifyKeyFingerprint(masterkey); err != nil {
+		memProtect.WipeKey(masterkey)
+		return nil, err
+	}
 
 	// Use process hardening to protect key buffer
 	processHardening.KeepAlive(masterkey)
@@ -313,7 +487,9 @@ func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	cf.EncryptedKey = ce.EncryptBlock(key, 0, cf.keyAD())
+	cf.KeyFingerprint = KeyFingerprint(key)
+	cf.setHMACKey(scryptHash)
 
 	// Purge scrypt-derived key with memory protection
 	memProtect.SecureWipe(scryptHash)
@@ -341,7 +517,9 @@ func (cf *ConfFile) EncryptKeyWithArgon2id(key []byte, password []byte) {
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(argon2idHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	cf.EncryptedKey = ce.EncryptBlock(key, 0, cf.keyAD())
+	cf.KeyFingerprint = KeyFingerprint(key)
+	cf.setHMACKey(argon2idHash)
 
 	// Purge Argon2id-derived key with memory protection
 	memProtect.SecureWipe(argon2idHash)
@@ -353,23 +531,33 @@ func (cf *ConfFile) EncryptKeyWithArgon2id(key []byte, password []byte) {
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
+// If FlagConfigHMAC is set, the HMAC and the backup copies are written as
+// well.
 func (cf *ConfFile) WriteFile() error {
 	if err := cf.Validate(); err != nil {
 		return err
 	}
-	tmp := cf.filename + ".tmp"
-	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
-	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
-	if err != nil {
-		return err
-	}
 	js, err := json.MarshalIndent(cf, "", "\t")
 	if err != nil {
 		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	js = append(js, '\n')
-	_, err = fd.Write(js)
+	if cf.IsFeatureFlagSet(FlagConfigHMAC) {
+		return cf.writeSigned(js)
+	}
+	return writeAtomic(cf.filename, js)
+}
+
+// writeAtomic writes "data" to "filename.tmp" then renames over "filename".
+func writeAtomic(filename string, data []byte) error {
+	tmp := filename + tmpSuffix
+	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
+	fd, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
 	if err != nil {
 		return err
 	}
@@ -379,13 +567,13 @@ func (cf *ConfFile) WriteFile() error {
 		// "operation not supported": https://github.com/rfjakob/gocryptfs/issues/390
 		tlog.Warn.Printf("Warning: fsync failed: %v", err)
 		// Try sync instead
-		syscall.Sync()
+		syncAll()
 	}
 	err = fd.Close()
 	if err != nil {
 		return err
 	}
-	err = os.Rename(tmp, cf.filename)
+	err = os.Rename(tmp, filename)
 	if err != nil {
 		return err
 	}
@@ -393,7 +581,7 @@ func (cf *ConfFile) WriteFile() error {
 	// Sync the parent directory to ensure the rename operation is persisted to disk.
 	// This is critical for crash safety - without this, a crash between rename and
 	// directory sync could result in the config file being lost.
-	parentDir := filepath.Dir(cf.filename)
+	parentDir := filepath.Dir(filename)
 	parentFd, err := os.Open(parentDir)
 	if err != nil {
 		// If we can't open the parent directory, log a warning but don't fail
@@ -0,0 +1,227 @@
+package configfile
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// HMACSuffix is appended to the name of each copy of the config file to
+	// get the name of the file that holds its HMAC.
+	HMACSuffix = ".hmac"
+	// BackupSuffix is appended to the config file name to get the name of
+	// the backup copy next to it.
+	BackupSuffix = ".bak"
+	// MetaDirName is the directory next to the config file that holds
+	// another backup copy.
+	MetaDirName = ".gocryptfs-meta"
+	// SnapshotDirName is the directory in the CIPHERDIR that holds the
+	// snapshots, each with a copy of the config file. Defined here rather
+	// than in package snapshot, which does not build on Windows.
+	SnapshotDirName = "gocryptfs.snapshots"
+	// tmpSuffix is appended to the file name by writeAtomic while the new
+	// content is written
+	tmpSuffix = ".tmp"
+)
+
+// IsBackupName returns true if "name" is one of the entries in the
+// CIPHERDIR root that hold the HMAC and the backup copies of gocryptfs.conf,
+// or its failed unlock attempts.
+func IsBackupName(name string) bool {
+	switch name {
+	case ConfDefaultName + HMACSuffix, ConfDefaultName + BackupSuffix,
+		ConfDefaultName + BackupSuffix + HMACSuffix, MetaDirName,
+		ConfDefaultName + AttemptsSuffix:
+		return true
+	}
+	return false
+}
+
+// IsTmpName returns true if "name" is a temporary file in the CIPHERDIR
+// root that an interrupted WriteFile has left behind.
+func IsTmpName(name string) bool {
+	base := strings.TrimSuffix(name, tmpSuffix)
+	return base != name && (base == ConfDefaultName || IsBackupName(base))
+}
+
+// copyPaths returns the paths of all copies of the config file "filename",
+// in the order they are tried: the file itself, the copy in MetaDirName and
+// the ".bak" copy.
+func copyPaths(filename string) []string {
+	return []string{
+		filename,
+		filepath.Join(filepath.Dir(filename), MetaDirName, filepath.Base(filename)),
+		filename + BackupSuffix,
+	}
+}
+
+// readHMAC reads the HMAC of the copy at "path". Returns nil if the HMAC
+// file is missing or invalid.
+func readHMAC(path string) []byte {
+	data, err := os.ReadFile(path + HMACSuffix)
+	if err != nil {
+		return nil
+	}
+	mac, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil
+	}
+	return mac
+}
+
+// setHMACKey derives the HMAC key from "kek", the password-derived key that
+// encrypts the master key. Does nothing if FlagConfigHMAC is not set.
+func (cf *ConfFile) setHMACKey(kek []byte) {
+	if !cf.IsFeatureFlagSet(FlagConfigHMAC) {
+		return
+	}
+	cf.hmacKey = cryptocore.DeriveKeyGuarded(kek, cryptocore.KeyConfigHMAC)
+}
+
+// configHMAC returns the HMAC of the config file content "js"
+func (cf *ConfFile) configHMAC(js []byte) []byte {
+	h := hmac.New(sha256.New, cf.hmacKey)
+	h.Write(js)
+	return h.Sum(nil)
+}
+
+// verifyHMAC checks the HMAC of the copy that was loaded. Returns an error
+// with exit code ConfTampered if it is missing or does not match. A config
+// file that is not a regular file, like a pipe, has no HMAC file next to
+// it; the check is skipped with a warning.
+func (cf *ConfFile) verifyHMAC() error {
+	if !cf.IsFeatureFlagSet(FlagConfigHMAC) {
+		return nil
+	}
+	if cf.rawHMAC == nil && cf.notRegular {
+		tlog.Warn.Printf("%s is not a regular file, its HMAC cannot be checked", cf.loadedFrom)
+		return nil
+	}
+	if cf.rawHMAC == nil {
+		return exitcodes.NewErr(fmt.Sprintf("%s is missing or invalid", cf.loadedFrom+HMACSuffix),
+			exitcodes.ConfTampered)
+	}
+	if !hmac.Equal(cf.rawHMAC, cf.configHMAC(cf.raw)) {
+		return exitcodes.NewErr(fmt.Sprintf("The HMAC of %s does not match, the file has been modified",
+			cf.loadedFrom), exitcodes.ConfTampered)
+	}
+	return nil
+}
+
+// decryptBackup tries the copies of the config file other than the one that
+// was loaded, after the loaded one could not be unlocked because of "cause".
+// The first signed copy that unlocks with "password" replaces the content of
+// "cf".
+func (cf *ConfFile) decryptBackup(password []byte, cause error) []byte {
+	for _, path := range copyPaths(cf.filename) {
+		if path == cf.loadedFrom {
+			continue
+		}
+		other, err := loadCopy(cf.filename, path)
+		if err != nil || !other.IsFeatureFlagSet(FlagConfigHMAC) {
+			continue
+		}
+		if bytes.Equal(other.raw, cf.raw) && bytes.Equal(other.rawHMAC, cf.rawHMAC) {
+			// Would fail the same way
+			continue
+		}
+		masterkey, err := other.decryptMasterKey(password)
+		if err != nil {
+			continue
+		}
+		tlog.Warn.Printf("Using backup copy %s: %v", path, cause)
+		other.needsRepair = true
+		*cf = *other
+		return masterkey
+	}
+	return nil
+}
+
+// NeedsRepair returns true if the config file was missing, damaged or
+// modified, and a backup copy has been used instead. WriteFile repairs it.
+func (cf *ConfFile) NeedsRepair() bool {
+	return cf.needsRepair
+}
+
+// LoadedFrom returns the path of the copy of the config file that was used.
+func (cf *ConfFile) LoadedFrom() string {
+	return cf.loadedFrom
+}
+
+// MissingCopies returns the copies of a signed config file, or their HMAC
+// files, that are missing or cannot be parsed. The HMACs themselves can
+// only be checked with the password. WriteFile recreates the copies.
+func (cf *ConfFile) MissingCopies() (missing []string) {
+	if !cf.IsFeatureFlagSet(FlagConfigHMAC) {
+		return nil
+	}
+	for _, path := range copyPaths(cf.filename) {
+		other, err := loadCopy(cf.filename, path)
+		if err != nil {
+			missing = append(missing, path)
+		} else if other.rawHMAC == nil {
+			missing = append(missing, path+HMACSuffix)
+		}
+	}
+	return missing
+}
+
+// KeepBackup makes the next WriteFile leave the config file content that
+// was loaded in the ".bak" copy instead of updating it. Used when the
+// password is reset with "-masterkey".
+func (cf *ConfFile) KeepBackup() {
+	cf.keepBackup = true
+}
+
+// writeSigned writes "js" and its HMAC to all copies of the config file.
+// The copy in MetaDirName is written first, so a crash while writing the
+// main copy leaves an intact copy behind.
+func (cf *ConfFile) writeSigned(js []byte) error {
+	if cf.hmacKey == nil {
+		return fmt.Errorf("%s is signed with a key derived from the password and cannot be written without it",
+			cf.filename)
+	}
+	sum := cf.configHMAC(js)
+	mac := []byte(hex.EncodeToString(sum) + "\n")
+	paths := copyPaths(cf.filename)
+	if err := os.Mkdir(filepath.Dir(paths[1]), 0700); err != nil && !os.IsExist(err) {
+		tlog.Warn.Printf("Could not create backup directory: %v", err)
+	} else if err := writeCopy(paths[1], js, mac); err != nil {
+		tlog.Warn.Printf("Could not write backup copy: %v", err)
+	}
+	if err := writeCopy(paths[0], js, mac); err != nil {
+		return err
+	}
+	if cf.keepBackup && cf.raw != nil {
+		// The old content is kept in the ".bak" copy
+		if err := writeCopy(paths[2], cf.raw, []byte(hex.EncodeToString(cf.rawHMAC)+"\n")); err != nil {
+			tlog.Warn.Printf("Could not write backup copy: %v", err)
+		}
+	} else if err := writeCopy(paths[2], js, mac); err != nil {
+		tlog.Warn.Printf("Could not write backup copy: %v", err)
+	}
+	cf.raw = js
+	cf.rawHMAC = sum
+	cf.loadedFrom = cf.filename
+	cf.needsRepair = false
+	cf.keepBackup = false
+	return nil
+}
+
+// writeCopy writes the config file copy "path" and its HMAC file
+func writeCopy(path string, js []byte, mac []byte) error {
+	if err := writeAtomic(path, js); err != nil {
+		return err
+	}
+	return writeAtomic(path+HMACSuffix, mac)
+}
@@ -0,0 +1,208 @@
+package configfile
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// createSigned creates a signed config file and returns its path
+func createSigned(t *testing.T) string {
+	fn := filepath.Join(t.TempDir(), ConfDefaultName)
+	err := Create(&CreateArgs{
+		Filename:   fn,
+		Password:   testPw,
+		LogN:       10,
+		Creator:    "test",
+		BlockSize:  4096,
+		ConfigHMAC: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// overwrite replaces the content of the read-only file "path"
+func overwrite(t *testing.T, path string, data []byte) {
+	os.Remove(path)
+	if err := os.WriteFile(path, data, 0400); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// exitCode returns the exit code carried by "err", or -1
+func exitCode(err error) int {
+	var e exitcodes.Err
+	if errors.As(err, &e) {
+		return e.Code()
+	}
+	return -1
+}
+
+func TestConfigHMACCopies(t *testing.T) {
+	fn := createSigned(t)
+	primary, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := os.ReadFile(fn + HMACSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range copyPaths(fn)[1:] {
+		c, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := os.ReadFile(path + HMACSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c, primary) || !bytes.Equal(m, mac) {
+			t.Errorf("%s differs from the config file", path)
+		}
+	}
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagConfigHMAC) || cf.NeedsRepair() || cf.LoadedFrom() != fn {
+		t.Errorf("flags=%v NeedsRepair=%v LoadedFrom=%q", cf.FeatureFlags, cf.NeedsRepair(), cf.LoadedFrom())
+	}
+}
+
+// The Creator field is not covered by any other check
+func TestConfigHMACTampered(t *testing.T) {
+	fn := createSigned(t)
+	js, _ := os.ReadFile(fn)
+	overwrite(t, fn, bytes.Replace(js, []byte(`"test"`), []byte(`"evil"`), 1))
+
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.NeedsRepair() || cf.LoadedFrom() == fn || cf.Creator != "test" {
+		t.Fatalf("NeedsRepair=%v LoadedFrom=%q Creator=%q", cf.NeedsRepair(), cf.LoadedFrom(), cf.Creator)
+	}
+	// Repair
+	if err := cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err = LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.NeedsRepair() || cf.Creator != "test" {
+		t.Errorf("repair failed: NeedsRepair=%v Creator=%q", cf.NeedsRepair(), cf.Creator)
+	}
+}
+
+func TestConfigHMACAllTampered(t *testing.T) {
+	fn := createSigned(t)
+	for _, path := range copyPaths(fn) {
+		js, _ := os.ReadFile(path)
+		overwrite(t, path, bytes.Replace(js, []byte(`"test"`), []byte(`"evil"`), 1))
+	}
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	_, _, err := LoadAndDecrypt(fn, testPw)
+	if code := exitCode(err); code != exitcodes.ConfTampered {
+		t.Errorf("want exit code %d, have %d (%v)", exitcodes.ConfTampered, code, err)
+	}
+	// A wrong password is still reported as such
+	_, _, err = LoadAndDecrypt(fn, []byte("wrong"))
+	if code := exitCode(err); code != exitcodes.PasswordIncorrect {
+		t.Errorf("want exit code %d, have %d (%v)", exitcodes.PasswordIncorrect, code, err)
+	}
+}
+
+func TestConfigHMACMissing(t *testing.T) {
+	fn := createSigned(t)
+	os.Remove(fn + HMACSuffix)
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.NeedsRepair() {
+		t.Error("missing HMAC file not detected")
+	}
+}
+
+func TestConfigHMACCorrupt(t *testing.T) {
+	fn := createSigned(t)
+	overwrite(t, fn, []byte("garbage"))
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	cf, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.NeedsRepair() || cf.LoadedFrom() != copyPaths(fn)[1] {
+		t.Errorf("NeedsRepair=%v LoadedFrom=%q", cf.NeedsRepair(), cf.LoadedFrom())
+	}
+	// Without the password, the file cannot be signed
+	if err := cf.WriteFile(); err == nil {
+		t.Error("WriteFile without HMAC key should have failed")
+	}
+}
+
+func TestMissingCopies(t *testing.T) {
+	fn := createSigned(t)
+	cf, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := cf.MissingCopies(); m != nil {
+		t.Errorf("fresh config file: %v", m)
+	}
+	paths := copyPaths(fn)
+	os.Remove(paths[1])
+	os.Remove(paths[2] + HMACSuffix)
+	m := cf.MissingCopies()
+	if len(m) != 2 || m[0] != paths[1] || m[1] != paths[2]+HMACSuffix {
+		t.Errorf("have %v", m)
+	}
+}
+
+func TestConfigHMACKeepBackup(t *testing.T) {
+	fn := createSigned(t)
+	key, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPw := []byte("new")
+	cf.EncryptKey(key, newPw, 10)
+	cf.KeepBackup()
+	if err := cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadAndDecrypt(fn, newPw); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadAndDecrypt(fn+BackupSuffix, testPw); err != nil {
+		t.Errorf("old config not kept in %s: %v", fn+BackupSuffix, err)
+	}
+}
+
+func TestIsBackupName(t *testing.T) {
+	for _, n := range []string{"gocryptfs.conf.hmac", "gocryptfs.conf.bak", "gocryptfs.conf.bak.hmac", ".gocryptfs-meta"} {
+		if !IsBackupName(n) {
+			t.Errorf("%q not recognized", n)
+		}
+	}
+	for _, n := range []string{ConfDefaultName, "gocryptfs.diriv", "foo.bak"} {
+		if IsBackupName(n) {
+			t.Errorf("%q misrecognized", n)
+		}
+	}
+}
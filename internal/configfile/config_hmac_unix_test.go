@@ -0,0 +1,37 @@
+//go:build !windows
+// +build !windows
+
+package configfile
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// "-config <(cat gocryptfs.conf)" passes the config file through a pipe,
+// which has no HMAC file next to it
+func TestConfigHMACPipe(t *testing.T) {
+	fn := createSigned(t)
+	js, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fifo := filepath.Join(t.TempDir(), "pipe")
+	if err = syscall.Mkfifo(fifo, 0600); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := os.WriteFile(fifo, js, 0600); err != nil {
+			t.Error(err)
+		}
+	}()
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	if _, _, err = LoadAndDecrypt(fifo, testPw); err != nil {
+		t.Errorf("have %v, want success", err)
+	}
+}
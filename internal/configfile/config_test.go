@@ -1,6 +1,7 @@
 package configfile
 
 import (
+	"encoding/hex"
 	"fmt"
 	"testing"
 	"time"
@@ -155,6 +156,39 @@ func TestCreateConfLongNameMax(t *testing.T) {
 	}
 }
 
+// testEscrow "encrypts" by prefixing the plaintext with its name
+type testEscrow string
+
+func (e testEscrow) Escrow(plaintext []byte) (KeyEscrow, error) {
+	return KeyEscrow{Type: "test", Recipient: string(e), Blob: string(e) + ":" + string(plaintext)}, nil
+}
+
+func TestCreateConfKeyEscrow(t *testing.T) {
+	args := &CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		KeyEscrow: []EscrowRecipient{testEscrow("a"), testEscrow("b")},
+	}
+	if err := Create(args); err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.KeyEscrow) != 2 {
+		t.Fatalf("have %d KeyEscrow entries", len(c.KeyEscrow))
+	}
+	for i, name := range []string{"a", "b"} {
+		want := name + ":" + hex.EncodeToString(key) + "\n"
+		if e := c.KeyEscrow[i]; e.Recipient != name || e.Blob != want {
+			t.Errorf("entry %d: have %+v, want Blob=%q", i, e, want)
+		}
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
@@ -165,13 +199,13 @@ func TestIsFeatureFlagKnown(t *testing.T) {
 	}
 
 	for _, f := range testKnownFlags {
-		if !isFeatureFlagKnown(f) {
+		if !IsFeatureFlagKnown(f) {
 			t.Errorf("flag %q should be known", f)
 		}
 	}
 
 	f := "StrangeFeatureFlag"
-	if isFeatureFlagKnown(f) {
+	if IsFeatureFlagKnown(f) {
 		t.Errorf("flag %q should be NOT known", f)
 	}
 }
@@ -0,0 +1,141 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+// DuressSlot recognizes the duress password. Unlike EncryptedKey, it cannot
+// unlock the master key: when DecryptMasterKey gets the duress password,
+// it destroys the master key in the config file instead.
+type DuressSlot struct {
+	// ScryptObject stores the parameters for deriving the verifier
+	ScryptObject ScryptKDF
+	// Verifier is derived from the duress password with ScryptObject
+	Verifier []byte
+}
+
+// verifier derives the verifier of "password"
+func (d *DuressSlot) verifier(password []byte) []byte {
+	k := d.ScryptObject.DeriveKey(password)
+	v := cryptocore.DeriveKey(k, cryptocore.KeyDuressVerifier)
+	memProtect.SecureWipe(k)
+	return v
+}
+
+// validate checks the parameters that come from the config file
+func (d *DuressSlot) validate() error {
+	if len(d.Verifier) != sha256.Size {
+		return fmt.Errorf("duress slot: invalid verifier length %d", len(d.Verifier))
+	}
+	return d.ScryptObject.validateParams()
+}
+
+// SetDuressPassword adds the duress slot for "password", or replaces it.
+// The master key must have been decrypted, so the config file can be
+// written. Fails if "password" unlocks the master key.
+func (cf *ConfFile) SetDuressPassword(password []byte, logN int) error {
+	if mk, err := cf.decryptMasterKey(password); err == nil {
+		memProtect.SecureWipe(mk)
+		return fmt.Errorf("the duress password must differ from the password")
+	}
+	d := &DuressSlot{ScryptObject: NewScryptKDF(logN)}
+	d.Verifier = d.verifier(password)
+	cf.Duress = d
+	return nil
+}
+
+// RemoveDuressPassword removes the duress slot.
+func (cf *ConfFile) RemoveDuressPassword() {
+	cf.Duress = nil
+}
+
+// checkDuress destroys the master key if "password", which could not
+// unlock it because of "err", is the duress password. Nothing is logged, and
+// the caller returns "err" in any case, so the failure looks like a wrong
+// password.
+func (cf *ConfFile) checkDuress(password []byte, err error) {
+	if cf.Duress == nil {
+		return
+	}
+	if e, ok := err.(exitcodes.Err); !ok || e.Code() != exitcodes.PasswordIncorrect {
+		return
+	}
+	v := cf.Duress.verifier(password)
+	if hmac.Equal(v, cf.Duress.Verifier) {
+		cf.DestroyKeys()
+	}
+}
+
+// DestroyKeys makes the master key unrecoverable from all copies of the
+// config file, including those in the snapshots of the CIPHERDIR:
+// EncryptedKey is replaced by random bytes, so every password looks wrong
+// from then on, and the KeyEscrow copies are removed. Each copy is replaced atomically, and then its old content
+// is overwritten in place. Copies on other disks or in backups, and the old
+// blocks on copy-on-write filesystems and SSDs, are out of reach.
+func (cf *ConfFile) DestroyKeys() error {
+	files := []string{cf.filename}
+	if filepath.Base(cf.filename) == ConfDefaultName {
+		snapshots, _ := filepath.Glob(filepath.Join(filepath.Dir(cf.filename), SnapshotDirName, "*", ConfDefaultName))
+		files = append(files, snapshots...)
+	}
+	var firstErr error
+	for _, filename := range files {
+		for _, path := range copyPaths(filename) {
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				continue
+			}
+			if err := destroyCopy(filename, path); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	cf.EncryptedKey = cryptocore.RandBytes(len(cf.EncryptedKey))
+	cf.KeyEscrow = nil
+	return firstErr
+}
+
+// destroyCopy destroys the key in the copy "path" of the config file
+// "filename"
+func destroyCopy(filename string, path string) error {
+	// The config file is read-only, and we need a file descriptor for the
+	// old content after the new file has been renamed over it
+	if err := os.Chmod(path, 0600); err != nil {
+		return err
+	}
+	old, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	fi, err := old.Stat()
+	if err != nil {
+		return err
+	}
+	c, err := loadCopy(filename, path)
+	if err == nil {
+		c.EncryptedKey = cryptocore.RandBytes(len(c.EncryptedKey))
+		c.KeyEscrow = nil
+		var js []byte
+		js, err = json.MarshalIndent(c, "", "\t")
+		if err == nil {
+			err = writeAtomic(path, append(js, '\n'))
+		}
+	}
+	// Even if the copy could not be replaced, overwriting it in place
+	// destroys the key
+	if _, err2 := old.WriteAt(cryptocore.RandBytes(int(fi.Size())), 0); err2 != nil {
+		return err2
+	}
+	if err2 := old.Sync(); err2 != nil {
+		return err2
+	}
+	return err
+}
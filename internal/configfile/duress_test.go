@@ -0,0 +1,100 @@
+package configfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// setDuress adds the duress password "duress" and a KeyEscrow entry to the
+// config file "fn"
+func setDuress(t *testing.T, fn string) {
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.KeyEscrow = []KeyEscrow{{Type: "age", Recipient: "age1test", Blob: "blob"}}
+	if err = cf.SetDuressPassword(testPw, 10); err == nil {
+		t.Error("the password must not be accepted as duress password")
+	}
+	if err = cf.SetDuressPassword([]byte("duress"), 10); err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDuress(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	fn := createSigned(t)
+	setDuress(t, fn)
+	// A snapshot has its own copy of the config file
+	snap := filepath.Join(filepath.Dir(fn), "gocryptfs.snapshots", "s1", ConfDefaultName)
+	if err := os.MkdirAll(filepath.Dir(snap), 0700); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(fn)
+	if err := os.WriteFile(snap, data, 0400); err != nil {
+		t.Fatal(err)
+	}
+	// A wrong password changes nothing
+	if _, _, err := LoadAndDecrypt(fn, []byte("wrong")); exitCode(err) != exitcodes.PasswordIncorrect {
+		t.Fatalf("wrong password: %v", err)
+	}
+	if _, _, err := LoadAndDecrypt(fn, testPw); err != nil {
+		t.Fatal(err)
+	}
+	// The duress password fails like a wrong password...
+	if _, _, err := LoadAndDecrypt(fn, []byte("duress")); exitCode(err) != exitcodes.PasswordIncorrect {
+		t.Fatalf("duress password: %v", err)
+	}
+	// ...and the password no longer works, not even with the backup copies
+	// and the snapshot
+	for _, f := range []string{fn, snap} {
+		if _, _, err := LoadAndDecrypt(f, testPw); exitCode(err) != exitcodes.PasswordIncorrect {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+	for _, path := range copyPaths(fn) {
+		c, err := loadCopy(fn, path)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if _, err = c.decryptMasterKey(testPw); err == nil {
+			t.Errorf("%s can still be unlocked", path)
+		}
+		if len(c.KeyEscrow) != 0 {
+			t.Errorf("%s still has the KeyEscrow copies", path)
+		}
+		// The copies are still read-only
+		if fi, _ := os.Stat(path); fi.Mode().Perm() != 0400 {
+			t.Errorf("%s has mode %v", path, fi.Mode())
+		}
+	}
+}
+
+func TestDuressRemove(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	fn := createSigned(t)
+	setDuress(t, fn)
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.RemoveDuressPassword()
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	LoadAndDecrypt(fn, []byte("duress"))
+	if _, _, err = LoadAndDecrypt(fn, testPw); err != nil {
+		t.Errorf("the removed duress password has destroyed the key: %v", err)
+	}
+}
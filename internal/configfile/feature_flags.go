@@ -40,6 +40,49 @@ const (
 	FlagFilenameAuth
 	// FlagConfigurableBlockSize means we support configurable block sizes (16-64KB)
 	FlagConfigurableBlockSize
+	// FlagFilenameAuthEmbedded means that the filename MAC is embedded into
+	// the EME plaintext instead of being appended to the encrypted name.
+	// Requires FlagFilenameAuth.
+	FlagFilenameAuthEmbedded
+	// FlagDirManifest means that each directory has a gocryptfs.manifest
+	// file that lists its entries. Requires FlagFilenameAuth and FlagDirIV.
+	FlagDirManifest
+	// FlagDirIVAuth means that gocryptfs.diriv files carry a MAC and a
+	// generation counter. Requires FlagFilenameAuth and FlagDirIV.
+	FlagDirIVAuth
+	// FlagXattrAuth means that encrypted xattr values are bound to the file
+	// ID or directory IV of their file. Requires FlagDirIV.
+	FlagXattrAuth
+	// FlagDedup means that "gocryptfs -dedup" has stored the content of some
+	// files in the chunk store gocryptfs.dedup.
+	FlagDedup
+	// FlagFeatureFlagsMAC means that the feature flags are authenticated by
+	// ConfFile.FeatureFlagsMAC, and that the master key is encrypted with
+	// associated data. Removing any feature flag, including this one, makes
+	// unlocking fail.
+	FlagFeatureFlagsMAC
+	// FlagConfigHMAC means that the config file is signed with a key derived
+	// from the password. The HMAC is stored in a separate ".hmac" file, and
+	// signed backup copies are kept in gocryptfs.conf.bak and
+	// .gocryptfs-meta/gocryptfs.conf.
+	FlagConfigHMAC
+	// FlagAuthTimes means that the mtime of each regular file is stored
+	// encrypted in an xattr, so changes behind our back can be detected.
+	// Requires FlagXattrAuth.
+	FlagAuthTimes
+	// FlagLongSymlinks means that symlink targets that are too long for the
+	// backing filesystem once encrypted are stored in
+	// gocryptfs.longsymlinks. Cannot be combined with FlagPlaintextNames.
+	FlagLongSymlinks
+	// FlagAuthLinks means that the link count of each regular file is stored
+	// encrypted in an xattr, so hard links that were split or merged behind
+	// our back can be detected. Requires FlagXattrAuth.
+	FlagAuthLinks
+	// FlagHeaderV3 means that new files get version 3 headers with a cipher
+	// suite identifier and a per-file data key, see
+	// contentenc.ContentEnc.UseHeaderV3. Requires FlagHKDF, cannot be
+	// combined with FlagDedup.
+	FlagHeaderV3
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -58,10 +101,21 @@ var knownFlags = map[flagIota]string{
 	FlagArgon2id:              "Argon2id",
 	FlagFilenameAuth:          "FilenameAuth",
 	FlagConfigurableBlockSize: "ConfigurableBlockSize",
+	FlagFilenameAuthEmbedded:  "FilenameAuthEmbedded",
+	FlagDirManifest:           "DirManifest",
+	FlagDirIVAuth:             "DirIVAuth",
+	FlagXattrAuth:             "XattrAuth",
+	FlagDedup:                 "Dedup",
+	FlagFeatureFlagsMAC:       "FeatureFlagsMAC",
+	FlagConfigHMAC:            "ConfigHMAC",
+	FlagAuthTimes:             "AuthTimes",
+	FlagLongSymlinks:          "LongSymlinks",
+	FlagAuthLinks:             "AuthLinks",
+	FlagHeaderV3:              "HeaderV3",
 }
 
-// isFeatureFlagKnown verifies that we understand a feature flag.
-func isFeatureFlagKnown(flag string) bool {
+// IsFeatureFlagKnown verifies that we understand a feature flag.
+func IsFeatureFlagKnown(flag string) bool {
 	for _, knownFlag := range knownFlags {
 		if knownFlag == flag {
 			return true
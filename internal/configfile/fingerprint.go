@@ -0,0 +1,31 @@
+package configfile
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+// KeyFingerprint returns the fingerprint of "masterkey". It tells
+// filesystems apart, but reveals nothing about the key, so it can be
+// stored in the clear.
+func KeyFingerprint(masterkey []byte) []byte {
+	return cryptocore.DeriveKey(masterkey, cryptocore.KeyFingerprint)
+}
+
+// VerifyKeyFingerprint returns an error with exit code KeyMismatch if
+// "masterkey" does not match cf.KeyFingerprint. Config files that were
+// written before the fingerprint existed have none, they match any key.
+func (cf *ConfFile) VerifyKeyFingerprint(masterkey []byte) error {
+	if len(cf.KeyFingerprint) == 0 {
+		return nil
+	}
+	if fp := KeyFingerprint(masterkey); !bytes.Equal(fp, cf.KeyFingerprint) {
+		return exitcodes.NewErr(fmt.Sprintf("The master key has the fingerprint %x, but %s expects %x. "+
+			"Is the master key, or the config file, from a different filesystem?",
+			fp, cf.filename, cf.KeyFingerprint), exitcodes.KeyMismatch)
+	}
+	return nil
+}
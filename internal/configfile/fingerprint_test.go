@@ -0,0 +1,35 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	fn := createSigned(t)
+	masterkey, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cf.KeyFingerprint, KeyFingerprint(masterkey)) {
+		t.Fatalf("fingerprint %x does not match the master key", cf.KeyFingerprint)
+	}
+	other := bytes.Repeat([]byte{1}, cryptocore.KeyLen)
+	if err = cf.VerifyKeyFingerprint(other); exitCode(err) != exitcodes.KeyMismatch {
+		t.Errorf("other key: %v", err)
+	}
+	// A config file with the fingerprint of another filesystem is rejected
+	// even if the password is right
+	cf.KeyFingerprint = KeyFingerprint(other)
+	if _, err = cf.decryptMasterKey(testPw); exitCode(err) != exitcodes.KeyMismatch {
+		t.Errorf("wrong fingerprint: %v", err)
+	}
+	// Old config files have no fingerprint
+	cf.KeyFingerprint = nil
+	if err = cf.VerifyKeyFingerprint(other); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,65 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+)
+
+// encryptedKeyAD is the associated data the master key is encrypted with
+// when FlagFeatureFlagsMAC is set. Without it, an attacker could remove the
+// flag together with FeatureFlagsMAC and the config file would still be
+// accepted. It is passed in place of the 16-byte file ID.
+var encryptedKeyAD = func() []byte {
+	h := sha256.Sum256([]byte("gocryptfs.conf " + knownFlags[FlagFeatureFlagsMAC]))
+	return h[:16]
+}()
+
+// keyAD returns the associated data for the encryption of the master key
+func (cf *ConfFile) keyAD() []byte {
+	if cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) {
+		return encryptedKeyAD
+	}
+	return nil
+}
+
+// featureFlagsMAC returns the MAC of cf.FeatureFlags. The flags are sorted
+// first, so the order in the file does not matter.
+func (cf *ConfFile) featureFlagsMAC(masterkey []byte) []byte {
+	key := cryptocore.DeriveKey(masterkey, cryptocore.KeyFeatureFlagsMAC)
+	flags := append([]string(nil), cf.FeatureFlags...)
+	sort.Strings(flags)
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(strings.Join(flags, "\n")))
+	for i := range key {
+		key[i] = 0
+	}
+	return h.Sum(nil)
+}
+
+// UpdateFeatureFlagsMAC recomputes FeatureFlagsMAC after the feature flags
+// have changed. Does nothing if FlagFeatureFlagsMAC is not set.
+func (cf *ConfFile) UpdateFeatureFlagsMAC(masterkey []byte) {
+	if !cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) {
+		return
+	}
+	cf.FeatureFlagsMAC = cf.featureFlagsMAC(masterkey)
+}
+
+// VerifyFeatureFlags checks FeatureFlagsMAC. Returns an error with exit
+// code ConfTampered if the feature flags have been modified.
+func (cf *ConfFile) VerifyFeatureFlags(masterkey []byte) error {
+	if !cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) {
+		return nil
+	}
+	if !hmac.Equal(cf.FeatureFlagsMAC, cf.featureFlagsMAC(masterkey)) {
+		return exitcodes.NewErr(fmt.Sprintf("The feature flags in %s have been tampered with: %v",
+			cf.filename, cf.FeatureFlags), exitcodes.ConfTampered)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package configfile
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// createFlagsMAC creates a config file with filename authentication and
+// returns its path
+func createFlagsMAC(t *testing.T) string {
+	fn := filepath.Join(t.TempDir(), "gocryptfs.conf")
+	err := Create(&CreateArgs{
+		Filename:     fn,
+		Password:     testPw,
+		LogN:         10,
+		Creator:      "test",
+		FilenameAuth: true,
+		BlockSize:    4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fn
+}
+
+// modify loads "fn", applies "f" and writes the file back like an attacker
+// would, bypassing Validate.
+func modify(t *testing.T, fn string, f func(cf *ConfFile)) {
+	cf, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f(cf)
+	if err := cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// removeFlag removes "flag" from cf.FeatureFlags
+func removeFlag(cf *ConfFile, flag flagIota) {
+	var out []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[flag] {
+			out = append(out, f)
+		}
+	}
+	cf.FeatureFlags = out
+}
+
+func TestFeatureFlagsMAC(t *testing.T) {
+	fn := createFlagsMAC(t)
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) || len(cf.FeatureFlagsMAC) != 32 {
+		t.Fatalf("new config has no FeatureFlagsMAC: %v %x", cf.FeatureFlags, cf.FeatureFlagsMAC)
+	}
+	// The order of the flags does not matter
+	modify(t, fn, func(cf *ConfFile) {
+		ff := cf.FeatureFlags
+		for i, j := 0, len(ff)-1; i < j; i, j = i+1, j-1 {
+			ff[i], ff[j] = ff[j], ff[i]
+		}
+	})
+	if _, _, err = LoadAndDecrypt(fn, testPw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeatureFlagsMACTampered(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+		defer func() { tlog.Warn.Enabled = true }()
+	}
+	testCases := []struct {
+		name string
+		f    func(cf *ConfFile)
+	}{
+		{"remove FilenameAuth", func(cf *ConfFile) {
+			removeFlag(cf, FlagFilenameAuthEmbedded)
+			removeFlag(cf, FlagFilenameAuth)
+		}},
+		{"remove FeatureFlagsMAC", func(cf *ConfFile) {
+			removeFlag(cf, FlagFeatureFlagsMAC)
+			cf.FeatureFlagsMAC = nil
+			// Make it look like a version 2 config file
+			cf.ConfigVersion = 0
+		}},
+		{"remove FeatureFlagsMAC and FilenameAuth", func(cf *ConfFile) {
+			removeFlag(cf, FlagFeatureFlagsMAC)
+			removeFlag(cf, FlagFilenameAuthEmbedded)
+			removeFlag(cf, FlagFilenameAuth)
+			cf.FeatureFlagsMAC = nil
+			// Make it look like a version 2 config file
+			cf.ConfigVersion = 0
+		}},
+		{"add Dedup", func(cf *ConfFile) {
+			cf.setFeatureFlag(FlagDedup)
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fn := createFlagsMAC(t)
+			modify(t, fn, tc.f)
+			_, _, err := LoadAndDecrypt(fn, testPw)
+			var e exitcodes.Err
+			if !errors.As(err, &e) || e.Code() != exitcodes.ConfTampered {
+				t.Errorf("want ConfTampered, got %v", err)
+			}
+		})
+	}
+}
+
+// Upgrades like "-dedup" must update the MAC
+func TestUpdateFeatureFlagsMAC(t *testing.T) {
+	fn := createFlagsMAC(t)
+	key, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.SetFeatureFlag(FlagDedup)
+	cf.UpdateFeatureFlagsMAC(key)
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = LoadAndDecrypt(fn, testPw); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,42 @@
+package configfile
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// KeyEscrow is a copy of the master key, encrypted to a public key with
+// "-init -key-escrow". Decrypting Blob gives the master key in hex, the
+// format that "-masterkey" takes.
+type KeyEscrow struct {
+	// Type is "age" or "openpgp"
+	Type string
+	// Recipient is the age public key or the OpenPGP key fingerprints
+	Recipient string
+	// Blob is the armored age file or OpenPGP message
+	Blob string
+}
+
+// EscrowRecipient encrypts the copies of the master key in KeyEscrow.
+// Implemented by escrow.Recipient.
+type EscrowRecipient interface {
+	Escrow(plaintext []byte) (KeyEscrow, error)
+}
+
+// addKeyEscrow encrypts "key" to each of "recipients" and stores the copies
+// in cf.KeyEscrow
+func (cf *ConfFile) addKeyEscrow(key []byte, recipients []EscrowRecipient) error {
+	if len(recipients) == 0 {
+		return nil
+	}
+	plaintext := []byte(hex.EncodeToString(key) + "\n")
+	defer memProtect.SecureWipe(plaintext)
+	for _, r := range recipients {
+		e, err := r.Escrow(plaintext)
+		if err != nil {
+			return fmt.Errorf("key escrow: %v", err)
+		}
+		cf.KeyEscrow = append(cf.KeyEscrow, e)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package configfile
+
+import (
+	"fmt"
+)
+
+const (
+	// ConfigVersionLegacy is the config file format version of config files
+	// without a ConfigVersion field. They were written before the config
+	// file format had a version of its own.
+	ConfigVersionLegacy = 2
+	// ConfigVersionCurrent is the config file format version that Create
+	// writes and that Upgrade upgrades to.
+	ConfigVersionCurrent = 3
+)
+
+// UpgradeArgs are the arguments to Upgrade.
+type UpgradeArgs struct {
+	// Masterkey is the decrypted master key
+	Masterkey []byte
+	// Password unlocks the master key. Migrations may re-encrypt the master
+	// key with it.
+	Password []byte
+	// ConfigHMAC signs the config file and keeps backup copies next to it,
+	// like CreateArgs.ConfigHMAC
+	ConfigHMAC bool
+}
+
+// migration upgrades a config file from version "from" to version from+1
+type migration struct {
+	from int
+	// description is shown to the user
+	description string
+	apply       func(cf *ConfFile, args *UpgradeArgs)
+}
+
+// migrations lists all migrations in order. A new config file format version
+// is introduced by bumping ConfigVersionCurrent and appending a migration.
+var migrations = []migration{
+	{
+		from:        2,
+		description: "authenticate the feature flags and sign the config file",
+		apply:       migrateV2toV3,
+	},
+}
+
+// migrateV2toV3 enables FlagFeatureFlagsMAC, which all version 3 config
+// files have, and FlagConfigHMAC if requested. The master key is
+// re-encrypted because FlagFeatureFlagsMAC changes its associated data.
+func migrateV2toV3(cf *ConfFile, args *UpgradeArgs) {
+	cf.setFeatureFlag(FlagFeatureFlagsMAC)
+	if args.ConfigHMAC {
+		cf.setFeatureFlag(FlagConfigHMAC)
+	}
+	// Note: this looks at the FeatureFlags, so call it AFTER setting them.
+	if cf.IsFeatureFlagSet(FlagArgon2id) {
+		cf.EncryptKeyWithArgon2id(args.Masterkey, args.Password)
+	} else {
+		cf.EncryptKey(args.Masterkey, args.Password, cf.ScryptObject.LogN())
+	}
+	cf.UpdateFeatureFlagsMAC(args.Masterkey)
+}
+
+// SchemaVersion returns the config file format version.
+func (cf *ConfFile) SchemaVersion() int {
+	if cf.ConfigVersion == 0 {
+		return ConfigVersionLegacy
+	}
+	return int(cf.ConfigVersion)
+}
+
+// PendingMigrations returns the descriptions of the migrations that Upgrade
+// would apply.
+func (cf *ConfFile) PendingMigrations() (out []string) {
+	for _, m := range migrations {
+		if m.from >= cf.SchemaVersion() {
+			out = append(out, fmt.Sprintf("v%d to v%d: %s", m.from, m.from+1, m.description))
+		}
+	}
+	return out
+}
+
+// Upgrade applies all pending migrations and returns their descriptions. The
+// config file is not written, call WriteFile for that.
+func (cf *ConfFile) Upgrade(args *UpgradeArgs) (applied []string, err error) {
+	if len(args.Masterkey) == 0 || len(args.Password) == 0 {
+		return nil, fmt.Errorf("upgrading the config file needs the master key and the password")
+	}
+	applied = cf.PendingMigrations()
+	for _, m := range migrations {
+		if m.from < cf.SchemaVersion() {
+			continue
+		}
+		m.apply(cf, args)
+		cf.ConfigVersion = uint16(m.from + 1)
+	}
+	if err := cf.Validate(); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
@@ -0,0 +1,90 @@
+package configfile
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpgradeV2(t *testing.T) {
+	js, err := os.ReadFile("config_test/v2.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(t.TempDir(), ConfDefaultName)
+	if err := os.WriteFile(fn, js, 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.SchemaVersion() != ConfigVersionLegacy || len(cf.PendingMigrations()) != 1 {
+		t.Fatalf("SchemaVersion=%d PendingMigrations=%q", cf.SchemaVersion(), cf.PendingMigrations())
+	}
+	oldKey := append([]byte(nil), key...)
+	applied, err := cf.Upgrade(&UpgradeArgs{Masterkey: key, Password: testPw, ConfigHMAC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 1 {
+		t.Errorf("applied=%q", applied)
+	}
+	if err := cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	key2, cf2, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(oldKey, key2) {
+		t.Error("master key has changed")
+	}
+	if cf2.SchemaVersion() != ConfigVersionCurrent || len(cf2.PendingMigrations()) != 0 {
+		t.Errorf("SchemaVersion=%d PendingMigrations=%q", cf2.SchemaVersion(), cf2.PendingMigrations())
+	}
+	if !cf2.IsFeatureFlagSet(FlagFeatureFlagsMAC) || !cf2.IsFeatureFlagSet(FlagConfigHMAC) {
+		t.Errorf("flags=%v", cf2.FeatureFlags)
+	}
+	if _, err := os.Stat(fn + HMACSuffix); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpgradeNeedsPassword(t *testing.T) {
+	cf, err := Load("config_test/v2.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cf.Upgrade(&UpgradeArgs{Masterkey: make([]byte, 32)}); err == nil {
+		t.Error("Upgrade without password should have failed")
+	}
+}
+
+func TestCreateCurrentVersion(t *testing.T) {
+	fn := createSigned(t)
+	cf, err := Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.ConfigVersion != ConfigVersionCurrent || len(cf.PendingMigrations()) != 0 {
+		t.Errorf("ConfigVersion=%d PendingMigrations=%q", cf.ConfigVersion, cf.PendingMigrations())
+	}
+}
+
+func TestValidateConfigVersion(t *testing.T) {
+	cf, err := Load(createSigned(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.ConfigVersion = ConfigVersionCurrent + 1
+	if cf.Validate() == nil {
+		t.Error("unknown config file version accepted")
+	}
+	cf.ConfigVersion = ConfigVersionCurrent
+	removeFlag(cf, FlagFeatureFlagsMAC)
+	if cf.Validate() == nil {
+		t.Error("version 3 config file without FeatureFlagsMAC accepted")
+	}
+}
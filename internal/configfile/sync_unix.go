@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package configfile
+
+import "syscall"
+
+// syncAll flushes all filesystem buffers. It is the fallback when fsync on
+// the config file fails.
+func syncAll() {
+	syscall.Sync()
+}
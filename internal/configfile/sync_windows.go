@@ -0,0 +1,4 @@
+package configfile
+
+// syncAll is a no-op on Windows, which has no equivalent of sync(2).
+func syncAll() {}
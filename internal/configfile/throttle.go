@@ -0,0 +1,214 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// AttemptsSuffix is appended to the config file name to get the name of
+	// the file that counts the failed unlock attempts.
+	AttemptsSuffix = ".attempts"
+	// ThrottleFreeAttempts is the number of failed attempts that are not
+	// followed by a delay, so typos do not hurt.
+	ThrottleFreeAttempts = 3
+	// ThrottleBaseDelay is the delay after the first failed attempt that is
+	// not free. It doubles with every further failed attempt.
+	ThrottleBaseDelay = 2 * time.Second
+	// ThrottleMaxDelay is the longest delay between two attempts.
+	ThrottleMaxDelay = 15 * time.Minute
+	// throttleTamperedFailures is the failure count that is assumed when
+	// the attempts file is invalid
+	throttleTamperedFailures = 10
+)
+
+// ThrottleParams is set by "-throttle". Unlock attempts are always delayed
+// exponentially after ThrottleFreeAttempts consecutive failures.
+type ThrottleParams struct {
+	// LockoutAttempts consecutive failed attempts block unlocking for
+	// LockoutSeconds. 0 disables the lockout.
+	LockoutAttempts int `json:",omitempty"`
+	LockoutSeconds  int `json:",omitempty"`
+}
+
+// validate checks the parameters that come from the config file
+func (t *ThrottleParams) validate() error {
+	if t.LockoutAttempts < 0 || t.LockoutSeconds < 0 {
+		return fmt.Errorf("throttle: negative lockout parameters")
+	}
+	if (t.LockoutAttempts == 0) != (t.LockoutSeconds == 0) {
+		return fmt.Errorf("throttle: LockoutAttempts and LockoutSeconds must be set together")
+	}
+	return nil
+}
+
+// String returns a description of "t" for humans
+func (t *ThrottleParams) String() string {
+	s := "exponential backoff"
+	if t.LockoutAttempts > 0 {
+		s += fmt.Sprintf(", lockout for %v after %d failed attempts",
+			time.Duration(t.LockoutSeconds)*time.Second, t.LockoutAttempts)
+	}
+	return s
+}
+
+// attempts is the content of the attempts file
+type attempts struct {
+	// Failures counts the consecutive unlock attempts that did not succeed.
+	// It is incremented before the attempt, so killing gocryptfs during the
+	// key derivation does not help.
+	Failures int
+	// Last is the time of the last attempt, in seconds since the epoch
+	Last int64
+	// MAC ties Failures and Last to the config file. It is not keyed with
+	// a secret, see attemptsMAC.
+	MAC []byte
+}
+
+// ThrottleDelay returns how long to wait after "failures" consecutive
+// failed attempts before the next attempt is allowed. The lockout is not
+// included.
+func ThrottleDelay(failures int) time.Duration {
+	if failures < ThrottleFreeAttempts {
+		return 0
+	}
+	d := ThrottleBaseDelay
+	for i := ThrottleFreeAttempts; i < failures && d < ThrottleMaxDelay; i++ {
+		d *= 2
+	}
+	if d > ThrottleMaxDelay {
+		d = ThrottleMaxDelay
+	}
+	return d
+}
+
+// attemptsPath returns the path of the attempts file
+func (cf *ConfFile) attemptsPath() string {
+	return cf.filename + AttemptsSuffix
+}
+
+// attemptsMAC returns the MAC of "a". The key is derived from EncryptedKey,
+// so a counter that was copied from another config file or edited by hand
+// is detected. It is not a secret: anybody who can read the config file can
+// compute it and forge the counter, and deleting the attempts file resets
+// it. There is no secret to key it with before the password has been
+// checked, so throttling is best-effort local rate limiting.
+func (cf *ConfFile) attemptsMAC(a *attempts) []byte {
+	key := cryptocore.DeriveKey(cf.EncryptedKey, cryptocore.KeyUnlockAttempts)
+	h := hmac.New(sha256.New, key)
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[:8], uint64(a.Failures))
+	binary.BigEndian.PutUint64(buf[8:], uint64(a.Last))
+	h.Write(buf[:])
+	return h.Sum(nil)
+}
+
+// readAttempts reads the attempts file. A missing file means no failed
+// attempts. An invalid one is treated as throttleTamperedFailures failed
+// attempts, the last one at its modification time.
+func (cf *ConfFile) readAttempts() attempts {
+	var a attempts
+	path := cf.attemptsPath()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &a)
+	}
+	if err == nil && a.Failures >= 0 && hmac.Equal(a.MAC, cf.attemptsMAC(&a)) {
+		return a
+	}
+	tlog.Warn.Printf("%s is invalid, assuming %d failed unlock attempts", path, throttleTamperedFailures)
+	a = attempts{Failures: throttleTamperedFailures, Last: time.Now().Unix()}
+	if fi, err := os.Stat(path); err == nil {
+		a.Last = fi.ModTime().Unix()
+	}
+	return a
+}
+
+// writeAttempts writes "a" to the attempts file
+func (cf *ConfFile) writeAttempts(a attempts) error {
+	a.MAC = cf.attemptsMAC(&a)
+	js, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(cf.attemptsPath(), append(js, '\n'))
+}
+
+// throttleCheck returns an error with exit code Throttled if the attempts
+// "a" do not allow another attempt at "now"
+func (cf *ConfFile) throttleCheck(a attempts, now time.Time) error {
+	t := cf.Throttle
+	last := time.Unix(a.Last, 0)
+	next := last.Add(ThrottleDelay(a.Failures))
+	if t.LockoutAttempts > 0 && a.Failures >= t.LockoutAttempts {
+		if lockout := last.Add(time.Duration(t.LockoutSeconds) * time.Second); lockout.After(next) {
+			next = lockout
+		}
+	}
+	if now.Before(next) {
+		return exitcodes.NewErr(fmt.Sprintf("%d failed unlock attempts, try again in %v",
+			a.Failures, next.Sub(now).Round(time.Second)), exitcodes.Throttled)
+	}
+	return nil
+}
+
+// ThrottleCheck returns the error that DecryptMasterKey would return right
+// away because of failed attempts, so the caller does not have to ask for
+// the password in vain. Returns nil if throttling is disabled.
+func (cf *ConfFile) ThrottleCheck() error {
+	if cf.Throttle == nil {
+		return nil
+	}
+	return cf.throttleCheck(cf.readAttempts(), time.Now())
+}
+
+// throttleBegin is called before an unlock attempt. If it is too early for
+// another attempt, it returns an error with exit code Throttled. Otherwise
+// it counts the attempt as failed until throttleEnd says otherwise.
+// Does nothing if cf.Throttle is not set.
+func (cf *ConfFile) throttleBegin(now time.Time) error {
+	if cf.Throttle == nil {
+		return nil
+	}
+	a := cf.readAttempts()
+	if err := cf.throttleCheck(a, now); err != nil {
+		return err
+	}
+	a.Failures++
+	a.Last = now.Unix()
+	if err := cf.writeAttempts(a); err != nil {
+		// Do not lock out users of read-only media
+		tlog.Warn.Printf("Could not count the unlock attempt: %v", err)
+	}
+	return nil
+}
+
+// throttleEnd is called after an unlock attempt. A successful attempt
+// resets the counter.
+func (cf *ConfFile) throttleEnd(err error) {
+	if cf.Throttle == nil || err != nil {
+		return
+	}
+	if err := os.Remove(cf.attemptsPath()); err != nil && !os.IsNotExist(err) {
+		tlog.Warn.Printf("Could not reset the failed unlock attempts: %v", err)
+	}
+}
+
+// SetThrottle enables unlock attempt throttling with the parameters "t", or
+// disables it if "t" is nil. The master key must have been decrypted, so
+// the config file can be written.
+func (cf *ConfFile) SetThrottle(t *ThrottleParams) {
+	cf.Throttle = t
+}
@@ -0,0 +1,99 @@
+package configfile
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+func TestThrottleDelay(t *testing.T) {
+	testcases := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{ThrottleFreeAttempts - 1, 0},
+		{ThrottleFreeAttempts, ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 1, 2 * ThrottleBaseDelay},
+		{ThrottleFreeAttempts + 3, 8 * ThrottleBaseDelay},
+		{1000, ThrottleMaxDelay},
+	}
+	for _, tc := range testcases {
+		if have := ThrottleDelay(tc.failures); have != tc.want {
+			t.Errorf("%d failures: have %v, want %v", tc.failures, have, tc.want)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	fn := createSigned(t)
+	_, cf, err := LoadAndDecrypt(fn, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.SetThrottle(&ThrottleParams{LockoutAttempts: 2, LockoutSeconds: 3600})
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	cf, err = Load(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err = cf.DecryptMasterKey([]byte("wrong")); exitCode(err) != exitcodes.PasswordIncorrect {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	// Locked out, even with the right password
+	if err = cf.ThrottleCheck(); exitCode(err) != exitcodes.Throttled {
+		t.Errorf("ThrottleCheck: %v", err)
+	}
+	if _, err = cf.DecryptMasterKey(testPw); exitCode(err) != exitcodes.Throttled {
+		t.Fatalf("locked out: %v", err)
+	}
+	// Editing the counter makes it worse
+	a := cf.readAttempts()
+	if a.Failures != 2 {
+		t.Errorf("have %d failures", a.Failures)
+	}
+	if err = os.WriteFile(cf.attemptsPath(), []byte(`{"Failures":0,"Last":0,"MAC":null}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if a = cf.readAttempts(); a.Failures != throttleTamperedFailures {
+		t.Errorf("tampered file: have %d failures", a.Failures)
+	}
+	// After the lockout, the right password works and resets the counter
+	a.Failures = 2
+	a.Last = time.Now().Add(-2 * time.Hour).Unix()
+	if err = cf.writeAttempts(a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cf.DecryptMasterKey(testPw); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(cf.attemptsPath()); !os.IsNotExist(err) {
+		t.Errorf("attempts file was not removed: %v", err)
+	}
+}
+
+func TestThrottleBackoff(t *testing.T) {
+	cf := &ConfFile{Throttle: &ThrottleParams{}}
+	now := time.Now()
+	a := attempts{Failures: ThrottleFreeAttempts - 1, Last: now.Unix()}
+	if err := cf.throttleCheck(a, now); err != nil {
+		t.Errorf("free attempt: %v", err)
+	}
+	a.Failures = ThrottleFreeAttempts
+	if err := cf.throttleCheck(a, now); exitCode(err) != exitcodes.Throttled {
+		t.Errorf("too early: %v", err)
+	}
+	if err := cf.throttleCheck(a, now.Add(ThrottleBaseDelay)); err != nil {
+		t.Errorf("after the delay: %v", err)
+	}
+}
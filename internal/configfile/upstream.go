@@ -0,0 +1,79 @@
+package configfile
+
+import (
+	"fmt"
+	"strings"
+)
+
+// upstreamFlags are the feature flags that upstream gocryptfs v2.x
+// (github.com/rfjakob/gocryptfs) knows. Upstream refuses to mount
+// filesystems with any other flag.
+var upstreamFlags = map[flagIota]bool{
+	FlagPlaintextNames:    true,
+	FlagDirIV:             true,
+	FlagEMENames:          true,
+	FlagGCMIV128:          true,
+	FlagLongNames:         true,
+	FlagLongNameMax:       true,
+	FlagAESSIV:            true,
+	FlagRaw64:             true,
+	FlagHKDF:              true,
+	FlagFIDO2:             true,
+	FlagXChaCha20Poly1305: true,
+}
+
+// UpstreamError is returned by UpstreamCompatible if upstream gocryptfs
+// cannot mount a filesystem.
+type UpstreamError struct {
+	// ForkFlags are the feature flags that upstream does not know
+	ForkFlags []string
+	// ConfigVersion is the config file version if it is not
+	// ConfigVersionLegacy, and 0 otherwise
+	ConfigVersion int
+}
+
+func (e *UpstreamError) Error() string {
+	var reasons []string
+	if len(e.ForkFlags) > 0 {
+		reasons = append(reasons, "feature flags "+strings.Join(e.ForkFlags, ", "))
+	}
+	if e.ConfigVersion != 0 {
+		reasons = append(reasons, fmt.Sprintf("config file version %d", e.ConfigVersion))
+	}
+	return "upstream gocryptfs v2.x cannot mount this filesystem: it does not support " +
+		strings.Join(reasons, " and ")
+}
+
+// ForkFeatureFlags returns the feature flags of "cf" that upstream gocryptfs
+// v2.x does not know, in the order they appear in the config file.
+func (cf *ConfFile) ForkFeatureFlags() (fork []string) {
+	for _, flag := range cf.FeatureFlags {
+		upstream := false
+		for f := range upstreamFlags {
+			if knownFlags[f] == flag {
+				upstream = true
+				break
+			}
+		}
+		if !upstream {
+			fork = append(fork, flag)
+		}
+	}
+	return fork
+}
+
+// UpstreamCompatible returns nil if upstream gocryptfs v2.x can mount the
+// filesystem read-write, and an *UpstreamError otherwise. Upstream needs a
+// version 2 config file that only has the feature flags it knows. Files
+// that gocryptfs creates in CIPHERDIR for optional features, like
+// snapshots and the trash, are ignored by upstream.
+func (cf *ConfFile) UpstreamCompatible() error {
+	e := &UpstreamError{ForkFlags: cf.ForkFeatureFlags()}
+	if v := cf.SchemaVersion(); v != ConfigVersionLegacy {
+		e.ConfigVersion = v
+	}
+	if len(e.ForkFlags) > 0 || e.ConfigVersion != 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package configfile
+
+import (
+	"errors"
+	"testing"
+)
+
+// The example filesystems were created by upstream gocryptfs
+func TestUpstreamCompatibleExamples(t *testing.T) {
+	for _, name := range []string{"v1.1-aessiv", "v1.3", "v2.2-deterministic-names", "v2.2-xchacha", "v2.2-xchacha-deterministic-names"} {
+		cf, err := Load("../../tests/example_filesystems/" + name + "/gocryptfs.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cf.UpstreamCompatible(); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestUpstreamCreate(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		BlockSize: 4096,
+		Upstream:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cf, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.UpstreamCompatible(); err != nil {
+		t.Error(err)
+	}
+	if cf.ConfigVersion != 0 || cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) {
+		t.Errorf("ConfigVersion=%d FeatureFlags=%v", cf.ConfigVersion, cf.FeatureFlags)
+	}
+	if len(cf.PendingMigrations()) == 0 {
+		t.Error("the config file should be upgradable")
+	}
+
+	// The defaults are not compatible
+	err = Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		BlockSize: 4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err = Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ue *UpstreamError
+	if err = cf.UpstreamCompatible(); !errors.As(err, &ue) {
+		t.Fatalf("have %v", err)
+	}
+	if len(ue.ForkFlags) != 1 || ue.ForkFlags[0] != "FeatureFlagsMAC" || ue.ConfigVersion != ConfigVersionCurrent {
+		t.Errorf("have %+v", ue)
+	}
+
+	// Fork-only options cannot be combined with Upstream
+	err = Create(&CreateArgs{
+		Filename:     "config_test/tmp.conf",
+		Password:     testPw,
+		LogN:         10,
+		Creator:      "test",
+		BlockSize:    4096,
+		Upstream:     true,
+		FilenameAuth: true,
+	})
+	if !errors.As(err, &ue) || ue.ForkFlags[0] != "FilenameAuth" {
+		t.Errorf("have %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 )
 
 // Validate that the combination of settings makes sense and is supported
@@ -11,13 +12,36 @@ func (cf *ConfFile) Validate() error {
 	if cf.Version != contentenc.CurrentVersion {
 		return fmt.Errorf("unsupported on-disk format %d", cf.Version)
 	}
+	switch cf.ConfigVersion {
+	case 0:
+		// Version 2 config file
+	case ConfigVersionCurrent:
+		if !cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) {
+			return fmt.Errorf("config file version %d requires the FeatureFlagsMAC feature flag", cf.ConfigVersion)
+		}
+	default:
+		return fmt.Errorf("unsupported config file version %d", cf.ConfigVersion)
+	}
 	// scrypt params ok?
 	if err := cf.ScryptObject.validateParams(); err != nil {
 		return err
 	}
+	if cf.Duress != nil {
+		if err := cf.Duress.validate(); err != nil {
+			return err
+		}
+	}
+	if n := len(cf.KeyFingerprint); n != 0 && n != cryptocore.FingerprintLen {
+		return fmt.Errorf("invalid KeyFingerprint length %d", n)
+	}
+	if cf.Throttle != nil {
+		if err := cf.Throttle.validate(); err != nil {
+			return err
+		}
+	}
 	// All feature flags that are in the config file are known?
 	for _, flag := range cf.FeatureFlags {
-		if !isFeatureFlagKnown(flag) {
+		if !IsFeatureFlagKnown(flag) {
 			return fmt.Errorf("unknown feature flag %q", flag)
 		}
 	}
@@ -67,6 +91,45 @@ func (cf *ConfFile) Validate() error {
 		if cf.IsFeatureFlagSet(FlagEMENames) {
 			// All combinations of DirIV, LongNames, Raw64 allowed
 		}
+		if cf.IsFeatureFlagSet(FlagFilenameAuthEmbedded) && !cf.IsFeatureFlagSet(FlagFilenameAuth) {
+			return fmt.Errorf("FilenameAuthEmbedded requires FilenameAuth feature flag")
+		}
+		if cf.IsFeatureFlagSet(FlagDirManifest) {
+			if !cf.IsFeatureFlagSet(FlagFilenameAuth) {
+				return fmt.Errorf("DirManifest requires FilenameAuth feature flag")
+			}
+			if !cf.IsFeatureFlagSet(FlagDirIV) {
+				return fmt.Errorf("DirManifest requires DirIV feature flag")
+			}
+		}
+		if cf.IsFeatureFlagSet(FlagDirIVAuth) {
+			if !cf.IsFeatureFlagSet(FlagFilenameAuth) {
+				return fmt.Errorf("DirIVAuth requires FilenameAuth feature flag")
+			}
+			if !cf.IsFeatureFlagSet(FlagDirIV) {
+				return fmt.Errorf("DirIVAuth requires DirIV feature flag")
+			}
+		}
+		if cf.IsFeatureFlagSet(FlagXattrAuth) && !cf.IsFeatureFlagSet(FlagDirIV) {
+			return fmt.Errorf("XattrAuth requires DirIV feature flag")
+		}
+		if cf.IsFeatureFlagSet(FlagAuthTimes) && !cf.IsFeatureFlagSet(FlagXattrAuth) {
+			return fmt.Errorf("AuthTimes requires XattrAuth feature flag")
+		}
+		if cf.IsFeatureFlagSet(FlagAuthLinks) && !cf.IsFeatureFlagSet(FlagXattrAuth) {
+			return fmt.Errorf("AuthLinks requires XattrAuth feature flag")
+		}
+		if cf.IsFeatureFlagSet(FlagHeaderV3) {
+			if !cf.IsFeatureFlagSet(FlagHKDF) {
+				return fmt.Errorf("HeaderV3 requires HKDF feature flag")
+			}
+			if cf.IsFeatureFlagSet(FlagDedup) {
+				return fmt.Errorf("HeaderV3 cannot be combined with the Dedup feature flag")
+			}
+		}
+		if cf.IsFeatureFlagSet(FlagLongSymlinks) && cf.IsFeatureFlagSet(FlagPlaintextNames) {
+			return fmt.Errorf("LongSymlinks cannot be combined with the PlaintextNames feature flag")
+		}
 		if cf.LongNameMax != 0 && !cf.IsFeatureFlagSet(FlagLongNameMax) {
 			return fmt.Errorf("LongNameMax=%d but the LongNameMax feature flag is NOT set", cf.LongNameMax)
 		}
@@ -74,5 +137,9 @@ func (cf *ConfFile) Validate() error {
 			return fmt.Errorf("LongNameMax=0 but the LongNameMax feature flag IS set")
 		}
 	}
+	// FeatureFlagsMAC is checked against the flags in DecryptMasterKey
+	if len(cf.FeatureFlagsMAC) != 0 && !cf.IsFeatureFlagSet(FlagFeatureFlagsMAC) {
+		return fmt.Errorf("FeatureFlagsMAC is present but the FeatureFlagsMAC feature flag is NOT set")
+	}
 	return nil
 }
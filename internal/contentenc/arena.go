@@ -0,0 +1,44 @@
+package contentenc
+
+import (
+	"github.com/rfjakob/gocryptfs/v2/internal/memprotect"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+)
+
+// UseArena makes CReqPool hand out buffers from a preallocated memory arena
+// of "slots" buffers. The arena is backed by huge pages and locked into
+// memory if the system allows it. When the arena is exhausted, the pool
+// falls back to the Go heap. Must be called before the pool is used.
+//
+// PReqPool keeps using the heap, as DecryptBlocks hands its buffers to the
+// caller, which never puts them back.
+func (be *ContentEnc) UseArena(slots int) error {
+	a, err := memprotect.NewArena(be.CReqPool.sliceLen, slots)
+	if err != nil {
+		return err
+	}
+	be.CReqPool.arena = a
+	return nil
+}
+
+// RegisterStats registers the statistics of the CPU workers, of the
+// CReqPool arena (if UseArena has been called) and of the crypto backend
+// in "r".
+func (be *ContentEnc) RegisterStats(r *stats.Registry) {
+	be.parallelCrypto.RegisterStats(r)
+	be.cryptoCore.RegisterStats(r)
+	a := be.CReqPool.arena
+	if a == nil {
+		return
+	}
+	r.Func("bpool_creq_arena_slots", stats.KindGauge, "Buffers in the ciphertext request arena",
+		func() int64 { return int64(a.Stats().Slots) })
+	r.Func("bpool_creq_arena_free", stats.KindGauge, "Free buffers in the ciphertext request arena",
+		func() int64 { return int64(a.Stats().Free) })
+	r.Func("bpool_creq_arena_misses_total", stats.KindCounter, "Buffers taken from the heap because the arena was exhausted",
+		func() int64 { return int64(a.Stats().Misses) })
+	r.Func("bpool_creq_arena_hugepages", stats.KindGauge, "The arena is backed by huge pages",
+		func() int64 { return stats.Bool(a.Stats().HugePages) })
+	r.Func("bpool_creq_arena_locked", stats.KindGauge, "The arena is locked into memory",
+		func() int64 { return stats.Bool(a.Stats().Locked) })
+}
@@ -3,16 +3,20 @@ package contentenc
 import (
 	"log"
 	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/memprotect"
 )
 
 // bPool is a byte slice pool
 type bPool struct {
 	sync.Pool
 	sliceLen int
+	// arena, if set, is tried before the sync.Pool (see UseArena)
+	arena *memprotect.Arena
 }
 
-func newBPool(sliceLen int) bPool {
-	return bPool{
+func newBPool(sliceLen int) *bPool {
+	return &bPool{
 		Pool: sync.Pool{
 			New: func() interface{} { return make([]byte, sliceLen) },
 		},
@@ -22,6 +26,10 @@ func newBPool(sliceLen int) bPool {
 
 // Put grows the slice "s" to its maximum capacity and puts it into the pool.
 func (b *bPool) Put(s []byte) {
+	if b.arena != nil && b.arena.Owns(s) {
+		b.arena.Put(s)
+		return
+	}
 	s = s[:cap(s)]
 	if len(s) != b.sliceLen {
 		log.Panicf("wrong len=%d, want=%d", len(s), b.sliceLen)
@@ -32,6 +40,12 @@ func (b *bPool) Put(s []byte) {
 
 // Get returns a byte slice from the pool.
 func (b *bPool) Get() (s []byte) {
+	if b.arena != nil {
+		// Arena slots are rounded up to the page size
+		if s = b.arena.Get(); s != nil {
+			return s[:b.sliceLen]
+		}
+	}
 	s = b.Pool.Get().([]byte)
 	if len(s) != b.sliceLen {
 		log.Panicf("wrong len=%d, want=%d", len(s), b.sliceLen)
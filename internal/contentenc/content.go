@@ -6,12 +6,11 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
 	"runtime"
 	"sync"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
-
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -25,6 +24,10 @@ const (
 	// master key in the config file is encrypted with a 96-bit IV for
 	// gocryptfs v1.2 and earlier. v1.3 switched to 128 bit.
 	DefaultIVBits = 128
+	// MaxKernelWrite is the largest read or write request we get from the
+	// kernel. Same value as fuse.MAX_KERNEL_WRITE, duplicated here so that
+	// this package does not depend on go-fuse and builds on Windows.
+	MaxKernelWrite = 1024 * 1024
 )
 
 // ContentEnc is used to encipher and decipher file content.
@@ -41,46 +44,54 @@ type ContentEnc struct {
 	allZeroBlock []byte
 	// All-zero block of size IVBitLen/8, for fast compares
 	allZeroNonce []byte
+	// headerVersion is the version of new file headers, and headerLen the
+	// length of the headers of all files. See UseHeaderV3.
+	headerVersion uint16
+	headerLen     uint64
+	// keyStore holds the key shares of files with version 3 headers
+	keyStore KeyStore
 
 	// Enhanced parallel crypto processing
 	parallelCrypto *parallelcrypto.ParallelCrypto
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
-	cBlockPool bPool
+	cBlockPool *bPool
 	// Plaintext block pool. Always returns plainBS-sized byte slices
 	// (usually 4096 bytes).
-	pBlockPool bPool
+	pBlockPool *bPool
 	// Ciphertext request data pool. Always returns byte slices of size
-	// fuse.MAX_KERNEL_WRITE + encryption overhead.
+	// MaxKernelWrite + encryption overhead.
 	// Used by Read() to temporarily store the ciphertext as it is read from
 	// disk.
-	CReqPool bPool
-	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
-	PReqPool bPool
+	CReqPool *bPool
+	// Plaintext request data pool. Slice have size MaxKernelWrite.
+	PReqPool *bPool
 }
 
 // New returns an initialized ContentEnc instance.
 func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
 	tlog.Debug.Printf("contentenc.New: plainBS=%d", plainBS)
 
-	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
-		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
+	if MaxKernelWrite%plainBS != 0 {
+		log.Panicf("unaligned MaxKernelWrite=%d", MaxKernelWrite)
 	}
 	cipherBS := plainBS + uint64(cc.IVLen) + cryptocore.AuthTagLen
 	// Take IV and GHASH overhead into account.
-	cReqSize := int(fuse.MAX_KERNEL_WRITE / plainBS * cipherBS)
+	cReqSize := int(MaxKernelWrite / plainBS * cipherBS)
 	// Unaligned reads (happens during fsck, could also happen with O_DIRECT?)
 	// touch one additional ciphertext and plaintext block. Reserve space for the
 	// extra block.
 	cReqSize += int(cipherBS)
-	pReqSize := fuse.MAX_KERNEL_WRITE + int(plainBS)
+	pReqSize := MaxKernelWrite + int(plainBS)
 	c := &ContentEnc{
 		cryptoCore:     cc,
 		plainBS:        plainBS,
 		cipherBS:       cipherBS,
 		allZeroBlock:   make([]byte, cipherBS),
 		allZeroNonce:   make([]byte, cc.IVLen),
+		headerVersion:  CurrentVersion,
+		headerLen:      HeaderLen,
 		parallelCrypto: parallelcrypto.New(),
 		cBlockPool:     newBPool(int(cipherBS)),
 		CReqPool:       newBPool(cReqSize),
@@ -90,6 +101,12 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64) *ContentEnc {
 	return c
 }
 
+// ParallelCrypto returns the worker pool that is used to process blocks in
+// parallel.
+func (be *ContentEnc) ParallelCrypto() *parallelcrypto.ParallelCrypto {
+	return be.parallelCrypto
+}
+
 // PlainBS returns the plaintext block size
 func (be *ContentEnc) PlainBS() uint64 {
 	return be.plainBS
@@ -100,10 +117,11 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
-// DecryptBlocks decrypts a number of blocks
+// DecryptBlocks decrypts a number of blocks. If a block fails to decrypt,
+// it returns the plaintext of the blocks before it and a *BlockError.
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
-	// Calculate number of blocks
-	blockCount := len(ciphertext) / int(be.cipherBS)
+	// Calculate number of blocks. The last block may be incomplete.
+	blockCount := (len(ciphertext) + int(be.cipherBS) - 1) / int(be.cipherBS)
 	if blockCount == 0 {
 		return []byte{}, nil
 	}
@@ -130,6 +148,7 @@ func (be *ContentEnc) decryptBlocksSequential(ciphertext []byte, firstBlockNo ui
 		var pBlock []byte
 		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
 		if err != nil {
+			err = be.blockError(blockNo, err)
 			break
 		}
 		pBuf.Write(pBlock)
@@ -142,115 +161,58 @@ func (be *ContentEnc) decryptBlocksSequential(ciphertext []byte, firstBlockNo ui
 
 // decryptBlocksParallel performs parallel decryption for large block counts
 func (be *ContentEnc) decryptBlocksParallel(ciphertext []byte, firstBlockNo uint64, fileID []byte, blockCount int) ([]byte, error) {
-	// Split ciphertext into blocks
-	cipherBlocks := make([][]byte, blockCount)
-	for i := 0; i < blockCount; i++ {
-		start := i * int(be.cipherBS)
-		end := start + int(be.cipherBS)
-		cipherBlocks[i] = ciphertext[start:end]
-	}
-
-	// Decrypt blocks in parallel
-	plainBlocks := make([][]byte, blockCount)
-	var decryptErr error
-	var mu sync.Mutex
-
-	be.parallelCrypto.ProcessBlocksParallel(blockCount, func(startIdx, endIdx int) {
-		for i := startIdx; i < endIdx; i++ {
-			blockNo := firstBlockNo + uint64(i)
-			plainBlock, err := be.DecryptBlock(cipherBlocks[i], blockNo, fileID)
-
-			mu.Lock()
-			if err != nil && decryptErr == nil {
-				decryptErr = err
-			}
-			plainBlocks[i] = plainBlock
-			mu.Unlock()
-		}
-	})
-
-	if decryptErr != nil {
-		// Clean up allocated blocks on error
-		for _, block := range plainBlocks {
-			if block != nil {
-				be.pBlockPool.Put(block)
-			}
-		}
-		return nil, decryptErr
-	}
-
-	// Pre-calculate total size for better memory allocation
-	totalSize := 0
-	for _, block := range plainBlocks {
-		totalSize += len(block)
-	}
-
-	// Concatenate plaintext blocks with pre-allocated capacity
-	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
-	pBuf.Grow(totalSize) // Pre-allocate capacity for better performance
-
-	for _, block := range plainBlocks {
-		pBuf.Write(block)
-		be.pBlockPool.Put(block)
-	}
-
-	return pBuf.Bytes(), nil
+	return be.decryptBlocksSplit(ciphertext, firstBlockNo, fileID, blockCount, be.parallelCrypto.ProcessBlocksParallel)
 }
 
 // decryptBlocksBatch performs batch decryption for medium-sized operations
 func (be *ContentEnc) decryptBlocksBatch(ciphertext []byte, firstBlockNo uint64, fileID []byte, blockCount int) ([]byte, error) {
-	// Split ciphertext into blocks
-	cipherBlocks := make([][]byte, blockCount)
-	for i := 0; i < blockCount; i++ {
-		start := i * int(be.cipherBS)
-		end := start + int(be.cipherBS)
-		cipherBlocks[i] = ciphertext[start:end]
-	}
+	return be.decryptBlocksSplit(ciphertext, firstBlockNo, fileID, blockCount, be.parallelCrypto.ProcessBlocksBatch)
+}
 
-	// Decrypt blocks in batches for better cache locality
+// decryptBlocksSplit decrypts the blocks in "ciphertext" in the index ranges
+// that "process" hands out. Each range only writes its own entries of the
+// plaintext and error slices, so the workers do not need a lock. Like
+// decryptBlocksSequential, it returns the plaintext of the blocks before the
+// first corrupt one, and a *BlockError for that one.
+func (be *ContentEnc) decryptBlocksSplit(ciphertext []byte, firstBlockNo uint64, fileID []byte, blockCount int,
+	process func(blockCount int, processFunc func(startIdx, endIdx int))) ([]byte, error) {
+	cBS := int(be.cipherBS)
 	plainBlocks := make([][]byte, blockCount)
-	var decryptErr error
-	var mu sync.Mutex
-
-	be.parallelCrypto.ProcessBlocksBatch(blockCount, func(startIdx, endIdx int) {
+	errs := make([]error, blockCount)
+	process(blockCount, func(startIdx, endIdx int) {
 		for i := startIdx; i < endIdx; i++ {
-			blockNo := firstBlockNo + uint64(i)
-			plainBlock, err := be.DecryptBlock(cipherBlocks[i], blockNo, fileID)
-
-			mu.Lock()
-			if err != nil && decryptErr == nil {
-				decryptErr = err
+			end := (i + 1) * cBS
+			if end > len(ciphertext) {
+				end = len(ciphertext)
 			}
-			plainBlocks[i] = plainBlock
-			mu.Unlock()
+			plainBlocks[i], errs[i] = be.DecryptBlock(ciphertext[i*cBS:end], firstBlockNo+uint64(i), fileID)
 		}
 	})
 
-	if decryptErr != nil {
-		// Clean up allocated blocks on error
-		for _, block := range plainBlocks {
-			if block != nil {
-				be.pBlockPool.Put(block)
-			}
+	good := blockCount
+	for i, err := range errs {
+		if err != nil {
+			good = i
+			break
 		}
-		return nil, decryptErr
 	}
-
-	// Pre-calculate total size for better memory allocation
 	totalSize := 0
-	for _, block := range plainBlocks {
+	for _, block := range plainBlocks[:good] {
 		totalSize += len(block)
 	}
-
-	// Concatenate plaintext blocks with pre-allocated capacity
 	pBuf := bytes.NewBuffer(be.PReqPool.Get()[:0])
-	pBuf.Grow(totalSize) // Pre-allocate capacity for better performance
-
-	for _, block := range plainBlocks {
-		pBuf.Write(block)
-		be.pBlockPool.Put(block)
+	pBuf.Grow(totalSize)
+	for i, block := range plainBlocks {
+		if i < good {
+			pBuf.Write(block)
+		}
+		if block != nil {
+			be.pBlockPool.Put(block)
+		}
+	}
+	if good < blockCount {
+		return pBuf.Bytes(), be.blockError(firstBlockNo+uint64(good), errs[good])
 	}
-
 	return pBuf.Bytes(), nil
 }
 
@@ -271,6 +233,37 @@ func concatAD(blockNo uint64, fileID []byte) (aData []byte) {
 	return aData
 }
 
+// BlockError is returned by DecryptBlocks when a block fails to decrypt. It
+// identifies the corrupt block so that it can be logged precisely.
+type BlockError struct {
+	// BlockNo is the number of the first block that failed to decrypt
+	BlockNo uint64
+	// PlainOff is the plaintext offset of the block
+	PlainOff uint64
+	// CipherOff is the offset of the block in the ciphertext file
+	CipherOff uint64
+	// Err is the error DecryptBlock returned
+	Err error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block #%d (plaintext offset %d, ciphertext offset %d): %v",
+		e.BlockNo, e.PlainOff, e.CipherOff, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+func (be *ContentEnc) blockError(blockNo uint64, err error) *BlockError {
+	return &BlockError{
+		BlockNo:   blockNo,
+		PlainOff:  be.BlockNoToPlainOff(blockNo),
+		CipherOff: be.BlockNoToCipherOff(blockNo),
+		Err:       err,
+	}
+}
+
 // DecryptBlock - Verify and decrypt GCM block
 //
 // Corner case: A full-sized block of all-zero ciphertext bytes is translated
@@ -357,14 +350,7 @@ func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertext
 // Returns a byte slice from CReqPool - so don't forget to return it
 // to the pool.
 func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
-	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
-
-	// Use optimized parallel encryption with CPU-aware processing
-	be.parallelCrypto.ProcessBlocksOptimized(len(plaintextBlocks), func(startIdx, endIdx int) {
-		for i := startIdx; i < endIdx; i++ {
-			ciphertextBlocks[i] = be.EncryptBlock(plaintextBlocks[i], firstBlockNo+uint64(i), fileID)
-		}
-	})
+	ciphertextBlocks := be.EncryptBlocksVec(plaintextBlocks, firstBlockNo, fileID)
 
 	// Pre-calculate total size for better memory allocation
 	totalSize := 0
@@ -379,12 +365,34 @@ func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint6
 
 	for _, v := range ciphertextBlocks {
 		out.Write(v)
-		// Return the memory to cBlockPool
-		be.cBlockPool.Put(v)
 	}
+	be.PutBlocks(ciphertextBlocks)
 	return out.Bytes()
 }
 
+// EncryptBlocksVec is like EncryptBlocks, but returns the ciphertext blocks
+// separately instead of copying them into one buffer. Meant for writing
+// with pwritev(2). The blocks come from an internal pool - return them with
+// PutBlocks when done.
+func (be *ContentEnc) EncryptBlocksVec(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) [][]byte {
+	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
+
+	// Use optimized parallel encryption with CPU-aware processing
+	be.parallelCrypto.ProcessBlocksOptimized(len(plaintextBlocks), func(startIdx, endIdx int) {
+		for i := startIdx; i < endIdx; i++ {
+			ciphertextBlocks[i] = be.EncryptBlock(plaintextBlocks[i], firstBlockNo+uint64(i), fileID)
+		}
+	})
+	return ciphertextBlocks
+}
+
+// PutBlocks returns ciphertext blocks from EncryptBlocksVec to the pool.
+func (be *ContentEnc) PutBlocks(ciphertextBlocks [][]byte) {
+	for _, v := range ciphertextBlocks {
+		be.cBlockPool.Put(v)
+	}
+}
+
 // doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
 func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
 	for i, v := range in {
@@ -425,13 +433,18 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 	}
 	// Block is authenticated with block number and file ID
 	aData := concatAD(blockNo, fileID)
-	// Get a cipherBS-sized block of memory, copy the nonce into it and truncate to
-	// nonce length
-	cBlock := be.cBlockPool.Get()
-	copy(cBlock, nonce)
-	cBlock = cBlock[0:len(nonce)]
+	// Get a cipherBS-sized block of memory
+	return be.sealBlock(be.cBlockPool.Get(), plaintext, nonce, aData)
+}
+
+// sealBlock encrypts "plaintext" into "dst", which must have room for the
+// ciphertext block, and returns the block: nonce + ciphertext + tag.
+func (be *ContentEnc) sealBlock(dst []byte, plaintext []byte, nonce []byte, aData []byte) []byte {
+	// Copy the nonce into dst and truncate to nonce length
+	copy(dst, nonce)
+	dst = dst[0:len(nonce)]
 	// Encrypt plaintext and append to nonce
-	ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, plaintext, aData)
+	ciphertext := be.cryptoCore.AEADCipher.Seal(dst, nonce, plaintext, aData)
 	overhead := int(be.BlockOverhead())
 	if len(plaintext)+overhead != len(ciphertext) {
 		log.Panicf("unexpected ciphertext length: plaintext=%d, overhead=%d, ciphertext=%d",
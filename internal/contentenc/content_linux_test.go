@@ -0,0 +1,14 @@
+package contentenc
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// MaxKernelWrite must stay in sync with go-fuse
+func TestMaxKernelWrite(t *testing.T) {
+	if MaxKernelWrite != fuse.MAX_KERNEL_WRITE {
+		t.Errorf("MaxKernelWrite=%d, fuse.MAX_KERNEL_WRITE=%d", MaxKernelWrite, fuse.MAX_KERNEL_WRITE)
+	}
+}
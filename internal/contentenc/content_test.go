@@ -1,9 +1,12 @@
 package contentenc
 
 import (
+	"bytes"
+	"errors"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 )
 
 type testRange struct {
@@ -94,3 +97,133 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// DecryptBlocks used to drop an incomplete last block in the batch and
+// parallel code paths, which writes at unaligned offsets hit. Each path is
+// called directly, so the test does not depend on the thresholds.
+func TestDecryptBlocksPartialLastBlock(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	fileID := make([]byte, 16)
+	paths := map[string]func(ciphertext []byte, blockCount int) ([]byte, error){
+		"DecryptBlocks": func(c []byte, _ int) ([]byte, error) { return f.DecryptBlocks(c, 0, fileID) },
+		"sequential":    func(c []byte, _ int) ([]byte, error) { return f.decryptBlocksSequential(c, 0, fileID) },
+		"batch":         func(c []byte, n int) ([]byte, error) { return f.decryptBlocksBatch(c, 0, fileID, n) },
+		"parallel":      func(c []byte, n int) ([]byte, error) { return f.decryptBlocksParallel(c, 0, fileID, n) },
+	}
+	for _, n := range []int{1, 4095, 4097, 10000, 20000} {
+		plaintext := make([]byte, n)
+		for i := range plaintext {
+			plaintext[i] = byte(i)
+		}
+		var blocks [][]byte
+		for p := plaintext; len(p) > 0; {
+			l := len(p)
+			if l > DefaultBS {
+				l = DefaultBS
+			}
+			blocks = append(blocks, p[:l])
+			p = p[l:]
+		}
+		ciphertext := f.EncryptBlocks(blocks, 0, fileID)
+		for name, decrypt := range paths {
+			have, err := decrypt(ciphertext, len(blocks))
+			if err != nil {
+				t.Fatalf("%s n=%d: %v", name, n, err)
+			}
+			if !bytes.Equal(have, plaintext) {
+				t.Errorf("%s n=%d: have %d bytes, want %d", name, n, len(have), n)
+			}
+		}
+	}
+}
+
+// With an arena, the request pools hand out arena buffers until it is
+// exhausted, then fall back to the heap, and take both kinds back.
+func TestUseArena(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	if err := f.UseArena(1); err != nil {
+		t.Skipf("arena not available: %v", err)
+	}
+	a := f.CReqPool.Get()
+	b := f.CReqPool.Get()
+	if len(a) != f.CReqPool.sliceLen || len(b) != f.CReqPool.sliceLen {
+		t.Fatalf("wrong lengths %d, %d", len(a), len(b))
+	}
+	if !f.CReqPool.arena.Owns(a) || f.CReqPool.arena.Owns(b) {
+		t.Error("first buffer should come from the arena, second from the heap")
+	}
+	r := stats.New()
+	f.RegisterStats(r)
+	m := r.Map()
+	if m["bpool_creq_arena_free"] != 0 || m["bpool_creq_arena_misses_total"] != 1 {
+		t.Errorf("wrong stats: %v", m)
+	}
+	f.CReqPool.Put(a[:10])
+	f.CReqPool.Put(b)
+	if r.Map()["bpool_creq_arena_free"] != 1 {
+		t.Error("arena buffer was not returned")
+	}
+}
+
+// EncryptBlocksVec must produce blocks that decrypt like the output of
+// EncryptBlocks.
+func TestEncryptBlocksVec(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	fileID := make([]byte, 16)
+	blocks := [][]byte{bytes.Repeat([]byte{1}, DefaultBS), bytes.Repeat([]byte{2}, 100)}
+	cBlocks := f.EncryptBlocksVec(blocks, 5, fileID)
+	defer f.PutBlocks(cBlocks)
+	if len(cBlocks) != 2 || len(cBlocks[0]) != int(f.CipherBS()) {
+		t.Fatalf("wrong blocks: %d", len(cBlocks))
+	}
+	have, err := f.DecryptBlocks(bytes.Join(cBlocks, nil), 5, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, bytes.Join(blocks, nil)) {
+		t.Error("content mismatch")
+	}
+}
+
+// A corrupt block in the middle must be reported as a *BlockError with its
+// number and offsets, and the blocks before it must be returned, no matter
+// if the sequential, batch or parallel code path is used.
+func TestDecryptBlocksCorrupt(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	f := New(cc, DefaultBS)
+	fileID := make([]byte, 16)
+	var blocks [][]byte
+	for i := 0; i < 20; i++ {
+		blocks = append(blocks, bytes.Repeat([]byte{byte(i)}, DefaultBS))
+	}
+	ciphertext := f.EncryptBlocks(blocks, 100, fileID)
+	ciphertext[13*int(f.CipherBS())+100] ^= 1
+	for _, path := range []string{"parallel", "batch", "sequential"} {
+		switch path {
+		case "parallel":
+			f.parallelCrypto.SetWorkers(2)
+		case "batch":
+			f.parallelCrypto.SetWorkers(1)
+		case "sequential":
+			f.parallelCrypto.Disable()
+		}
+		have, err := f.DecryptBlocks(ciphertext, 100, fileID)
+		var be *BlockError
+		if !errors.As(err, &be) {
+			t.Fatalf("%s: have error %v, want a *BlockError", path, err)
+		}
+		if be.BlockNo != 113 || be.PlainOff != 113*DefaultBS || be.CipherOff != f.BlockNoToCipherOff(113) {
+			t.Errorf("%s: wrong location: %v", path, be)
+		}
+		if !bytes.Equal(have, bytes.Join(blocks[:13], nil)) {
+			t.Errorf("%s: have %d bytes of plaintext, want %d", path, len(have), 13*DefaultBS)
+		}
+	}
+}
@@ -3,6 +3,9 @@ package contentenc
 // Per-file header
 //
 // Format: [ "Version" uint16 big endian ] [ "Id" 16 random bytes ]
+//
+// Version 3 (HeaderV3 feature flag) adds a cipher suite and a wrapped data key:
+// [ "Version" uint16 ] [ "Suite" uint16 ] [ "Id" 16 bytes ] [ "WrappedKey" 60 bytes ]
 
 import (
 	"bytes"
@@ -22,19 +25,39 @@ const (
 	headerIDLen      = 16 // 128 bit random file id
 	// HeaderLen is the total header length
 	HeaderLen = headerVersionLen + headerIDLen
+
+	// HeaderVersion3 is the header version of filesystems with the
+	// HeaderV3 feature flag
+	HeaderVersion3 = 3
+	headerSuiteLen = 2 // uint16
+	// WrappedKeyLen is the length of the wrapped per-file data key: AES-GCM
+	// nonce, key and tag. All-zero if the file has no data key.
+	WrappedKeyLen = 12 + cryptocore.KeyLen + cryptocore.AuthTagLen
+	// HeaderLenV3 is the total length of a version 3 header
+	HeaderLenV3 = headerVersionLen + headerSuiteLen + headerIDLen + WrappedKeyLen
 )
 
 // FileHeader represents the header stored on each non-empty file.
 type FileHeader struct {
 	Version uint16
 	ID      []byte
+	// Suite is the cipher suite of the content, see cryptocore.SuiteID.
+	// Version 3 only.
+	Suite uint16
+	// WrappedKey is the per-file data key, encrypted with
+	// cryptocore.CryptoCore.KeyWrap. nil if the file is encrypted with the
+	// key of the filesystem. Version 3 only.
+	WrappedKey []byte
 }
 
 // Pack - serialize fileHeader object
 func (h *FileHeader) Pack() []byte {
-	if len(h.ID) != headerIDLen || h.Version != CurrentVersion {
+	if len(h.ID) != headerIDLen || (h.Version != CurrentVersion && h.Version != HeaderVersion3) {
 		log.Panic("FileHeader object not properly initialized")
 	}
+	if h.Version == HeaderVersion3 {
+		return h.packV3()
+	}
 	buf := make([]byte, HeaderLen)
 	binary.BigEndian.PutUint16(buf[0:headerVersionLen], h.Version)
 	copy(buf[headerVersionLen:], h.ID)
@@ -42,6 +65,19 @@ func (h *FileHeader) Pack() []byte {
 
 }
 
+// packV3 serializes a version 3 header
+func (h *FileHeader) packV3() []byte {
+	if h.WrappedKey != nil && len(h.WrappedKey) != WrappedKeyLen {
+		log.Panic("FileHeader: wrapped key has the wrong length")
+	}
+	buf := make([]byte, HeaderLenV3)
+	binary.BigEndian.PutUint16(buf, h.Version)
+	binary.BigEndian.PutUint16(buf[headerVersionLen:], h.Suite)
+	copy(buf[headerVersionLen+headerSuiteLen:], h.ID)
+	copy(buf[headerVersionLen+headerSuiteLen+headerIDLen:], h.WrappedKey)
+	return buf
+}
+
 // allZeroFileID is preallocated to quickly check if the data read from disk is all zero
 var allZeroFileID = make([]byte, headerIDLen)
 var allZeroHeader = make([]byte, HeaderLen)
@@ -68,6 +104,33 @@ func ParseHeader(buf []byte) (*FileHeader, error) {
 	return &h, nil
 }
 
+var allZeroWrappedKey = make([]byte, WrappedKeyLen)
+
+// ParseHeaderV3 parses a version 3 header. The suite is not checked, and
+// the data key is not unwrapped, see ContentEnc.OpenHeader.
+func ParseHeaderV3(buf []byte) (*FileHeader, error) {
+	if len(buf) != HeaderLenV3 {
+		return nil, fmt.Errorf("ParseHeader: invalid length, want=%d have=%d", HeaderLenV3, len(buf))
+	}
+	var h FileHeader
+	h.Version = binary.BigEndian.Uint16(buf)
+	if h.Version != HeaderVersion3 {
+		return nil, fmt.Errorf("ParseHeader: invalid version, want=%d have=%d. Header hexdump: %s",
+			HeaderVersion3, h.Version, hex.EncodeToString(buf))
+	}
+	h.Suite = binary.BigEndian.Uint16(buf[headerVersionLen:])
+	off := headerVersionLen + headerSuiteLen
+	h.ID = buf[off : off+headerIDLen]
+	if bytes.Equal(h.ID, allZeroFileID) {
+		return nil, fmt.Errorf("ParseHeader: file id is all-zero. Header hexdump: %s",
+			hex.EncodeToString(buf))
+	}
+	if k := buf[off+headerIDLen:]; !bytes.Equal(k, allZeroWrappedKey) {
+		h.WrappedKey = k
+	}
+	return &h, nil
+}
+
 // RandomHeader - create new fileHeader object with random Id
 func RandomHeader() *FileHeader {
 	var h FileHeader
@@ -0,0 +1,137 @@
+package contentenc
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// FileCtx is the encryption context of an open file. Unlike the ContentEnc
+// methods, which allocate the nonce and the associated data of every block,
+// it keeps these in scratch buffers that are reused across calls, and only
+// rewrites the file ID part of the associated data when the file ID changes.
+//
+// A FileCtx must not be used concurrently. fusefrontend only uses it while
+// holding the exclusive ContentLock of the file.
+type FileCtx struct {
+	be *ContentEnc
+	// fileID is the file ID that "ad" has been prepared for
+	fileID []byte
+	// nonces holds the nonces of the current call, back to back
+	nonces []byte
+	// ad holds the associated data of the current call, adLen bytes per block
+	ad    []byte
+	adLen int
+	// cBlocks is returned by EncryptBlocksVec
+	cBlocks [][]byte
+	// offs holds the offset of each block in the output of EncryptBlocks
+	offs []int
+}
+
+// NewFileCtx returns a new, empty encryption context.
+func (be *ContentEnc) NewFileCtx() *FileCtx {
+	return &FileCtx{be: be}
+}
+
+// ContentEnc returns the ContentEnc that the context encrypts with
+func (c *FileCtx) ContentEnc() *ContentEnc {
+	return c.be
+}
+
+// prepare fills the scratch buffers for "n" blocks starting at "firstBlockNo"
+func (c *FileCtx) prepare(n int, firstBlockNo uint64, fileID []byte) {
+	ivLen := c.be.cryptoCore.IVLen
+	adLen := 8 + len(fileID)
+	if cap(c.nonces) < n*ivLen {
+		c.nonces = make([]byte, n*ivLen)
+	}
+	c.nonces = c.nonces[:n*ivLen]
+	c.be.cryptoCore.IVGenerator.Fill(c.nonces)
+	if cap(c.ad) < n*adLen || adLen != c.adLen || !bytes.Equal(fileID, c.fileID) {
+		// Rewrite the file ID in every slot
+		c.ad = make([]byte, n*adLen)
+		c.adLen = adLen
+		c.fileID = append(c.fileID[:0], fileID...)
+		for i := 0; i < n; i++ {
+			copy(c.ad[i*adLen+8:], fileID)
+		}
+	}
+	c.ad = c.ad[:cap(c.ad)]
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint64(c.ad[i*adLen:], firstBlockNo+uint64(i))
+	}
+}
+
+// nonce returns the nonce of block "i" of the current call
+func (c *FileCtx) nonce(i int) []byte {
+	ivLen := c.be.cryptoCore.IVLen
+	return c.nonces[i*ivLen : (i+1)*ivLen]
+}
+
+// aData returns the associated data of block "i" of the current call
+func (c *FileCtx) aData(i int) []byte {
+	return c.ad[i*c.adLen : (i+1)*c.adLen]
+}
+
+// EncryptBlocks is like ContentEnc.EncryptBlocks, but encrypts the blocks
+// directly into the output buffer. Returns a byte slice from CReqPool - so
+// don't forget to return it to the pool.
+func (c *FileCtx) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
+	be := c.be
+	n := len(plaintextBlocks)
+	c.prepare(n, firstBlockNo, fileID)
+	if cap(c.offs) < n+1 {
+		c.offs = make([]int, n+1)
+	}
+	c.offs = c.offs[:n+1]
+	overhead := int(be.BlockOverhead())
+	c.offs[0] = 0
+	for i, p := range plaintextBlocks {
+		l := 0
+		// Empty blocks stay empty, like in doEncryptBlock
+		if len(p) > 0 {
+			l = len(p) + overhead
+		}
+		c.offs[i+1] = c.offs[i] + l
+	}
+	out := be.CReqPool.Get()
+	be.parallelCrypto.ProcessBlocksOptimized(n, func(startIdx, endIdx int) {
+		for i := startIdx; i < endIdx; i++ {
+			if len(plaintextBlocks[i]) == 0 {
+				continue
+			}
+			be.sealBlock(out[c.offs[i]:c.offs[i+1]], plaintextBlocks[i], c.nonce(i), c.aData(i))
+		}
+	})
+	return out[:c.offs[n]]
+}
+
+// EncryptBlocksVec is like ContentEnc.EncryptBlocksVec. The returned slice
+// is only valid until the next call; return the blocks with
+// ContentEnc.PutBlocks.
+func (c *FileCtx) EncryptBlocksVec(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) [][]byte {
+	be := c.be
+	n := len(plaintextBlocks)
+	c.prepare(n, firstBlockNo, fileID)
+	if cap(c.cBlocks) < n {
+		c.cBlocks = make([][]byte, n)
+	}
+	c.cBlocks = c.cBlocks[:n]
+	be.parallelCrypto.ProcessBlocksOptimized(n, func(startIdx, endIdx int) {
+		for i := startIdx; i < endIdx; i++ {
+			if len(plaintextBlocks[i]) == 0 {
+				c.cBlocks[i] = plaintextBlocks[i]
+				continue
+			}
+			c.cBlocks[i] = be.sealBlock(be.cBlockPool.Get(), plaintextBlocks[i], c.nonce(i), c.aData(i))
+		}
+	})
+	return c.cBlocks
+}
+
+// EncryptBlocksPipelined is like ContentEnc.EncryptBlocksPipelined.
+func (c *FileCtx) EncryptBlocksPipelined(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte,
+	write func(ciphertext []byte, off int) error) error {
+	return c.be.encryptBlocksPipelined(plaintextBlocks, firstBlockNo, write, func(blocks [][]byte, blockNo uint64) []byte {
+		return c.EncryptBlocks(blocks, blockNo, fileID)
+	})
+}
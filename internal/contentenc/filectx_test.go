@@ -0,0 +1,67 @@
+package contentenc
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FileCtx must produce ciphertext that decrypts like the ContentEnc
+// functions, also after the file ID changed and with fewer blocks than in
+// the call before.
+func TestFileCtx(t *testing.T) {
+	f := newTestContentEnc()
+	c := f.NewFileCtx()
+	for i, n := range []int{10, 3, 40} {
+		fileID := bytes.Repeat([]byte{byte(i)}, DefaultIVBits/8)
+		blocks := testBlocks(n)
+		ciphertext := c.EncryptBlocks(blocks, 5, fileID)
+		plaintext, err := f.DecryptBlocks(ciphertext, 5, fileID)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if !bytes.Equal(plaintext, bytes.Join(blocks, nil)) {
+			t.Errorf("n=%d: content mismatch", n)
+		}
+		f.CReqPool.Put(ciphertext)
+
+		cBlocks := c.EncryptBlocksVec(blocks, 5, fileID)
+		plaintext, err = f.DecryptBlocks(bytes.Join(cBlocks, nil), 5, fileID)
+		if err != nil {
+			t.Fatalf("n=%d: vec: %v", n, err)
+		}
+		if !bytes.Equal(plaintext, bytes.Join(blocks, nil)) {
+			t.Errorf("n=%d: vec: content mismatch", n)
+		}
+		f.PutBlocks(cBlocks)
+	}
+}
+
+// benchmarkEncrypt128k encrypts 128 KiB writes, the usual FUSE write size.
+// Run with -benchmem to see the allocations.
+func benchmarkEncrypt128k(b *testing.B, useCtx bool) {
+	f := newTestContentEnc()
+	c := f.NewFileCtx()
+	fileID := make([]byte, DefaultIVBits/8)
+	blocks := testBlocks(128 * 1024 / DefaultBS)
+	blocks[len(blocks)-1] = blocks[0]
+	b.SetBytes(128 * 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var out []byte
+		if useCtx {
+			out = c.EncryptBlocks(blocks, 0, fileID)
+		} else {
+			out = f.EncryptBlocks(blocks, 0, fileID)
+		}
+		f.CReqPool.Put(out)
+	}
+}
+
+func BenchmarkEncrypt128k(b *testing.B) {
+	benchmarkEncrypt128k(b, false)
+}
+
+func BenchmarkEncrypt128kFileCtx(b *testing.B) {
+	benchmarkEncrypt128k(b, true)
+}
@@ -0,0 +1,150 @@
+package contentenc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// keyWrapNonceLen is the length of the AES-GCM nonce at the start of
+// FileHeader.WrappedKey
+const keyWrapNonceLen = 12
+
+// KeyStore holds a random share of the data key of each file with a
+// version 3 header, outside of the file. Implemented by keystore.Store.
+type KeyStore interface {
+	// Put stores the share of "fileID" durably
+	Put(fileID []byte, share []byte) error
+	// Get returns the share of "fileID"
+	Get(fileID []byte) ([]byte, error)
+	// Destroy deletes the share of "fileID" for good
+	Destroy(fileID []byte) error
+}
+
+// UseHeaderV3 switches to version 3 file headers, for filesystems with the
+// HeaderV3 feature flag. Each new file gets a random data key that encrypts
+// its content. The data key is split in two: the header stores one part,
+// wrapped with cryptocore.CryptoCore.KeyWrap, and "ks" the other, the key
+// share. Destroying the share makes the file unrecoverable, even from
+// copies that have the header. Must be called before any file is accessed.
+func (be *ContentEnc) UseHeaderV3(ks KeyStore) error {
+	if be.cryptoCore.KeyWrap == nil {
+		return errors.New("version 3 file headers need HKDF and the master key in this process")
+	}
+	if be.cryptoCore.AEADBackend.SuiteID() == 0 {
+		return fmt.Errorf("%s has no cipher suite identifier", be.cryptoCore.AEADBackend.Algo)
+	}
+	be.headerVersion = HeaderVersion3
+	be.headerLen = HeaderLenV3
+	be.keyStore = ks
+	return nil
+}
+
+// HeaderLen returns the length of the file headers, HeaderLen or
+// HeaderLenV3
+func (be *ContentEnc) HeaderLen() uint64 {
+	return be.headerLen
+}
+
+// HeaderVersion returns the version of the file headers of new files,
+// CurrentVersion or HeaderVersion3
+func (be *ContentEnc) HeaderVersion() uint16 {
+	return be.headerVersion
+}
+
+// NewHeader returns a new file header with a random ID, and the ContentEnc
+// that encrypts the content of the file. With version 3 headers, that is a
+// new per-file data key, and its key share is in the key store when
+// NewHeader returns. Otherwise it is "be" itself. Only fails if the key
+// share cannot be stored, and returns the error of KeyStore.Put.
+func (be *ContentEnc) NewHeader() (*FileHeader, *ContentEnc, error) {
+	if be.headerVersion != HeaderVersion3 {
+		return RandomHeader(), be, nil
+	}
+	h := &FileHeader{
+		Version: HeaderVersion3,
+		ID:      cryptocore.RandBytes(headerIDLen),
+		Suite:   be.cryptoCore.AEADBackend.SuiteID(),
+	}
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	share := cryptocore.RandBytes(cryptocore.KeyLen)
+	if err := be.keyStore.Put(h.ID, share); err != nil {
+		return nil, nil, err
+	}
+	nonce := cryptocore.RandBytes(keyWrapNonceLen)
+	h.WrappedKey = be.cryptoCore.KeyWrap.Seal(nonce, nonce, key, keyWrapAD(h))
+	return h, be.forKey(joinShare(key, share)), nil
+}
+
+// OpenHeader parses the file header "buf", which is HeaderLen() bytes long,
+// and returns the ContentEnc that decrypts the content of the file. Fails
+// if the header is corrupt, if its cipher suite is not the one of the
+// filesystem, or if the data key does not decrypt or has no key share.
+func (be *ContentEnc) OpenHeader(buf []byte) (*FileHeader, *ContentEnc, error) {
+	if be.headerVersion != HeaderVersion3 {
+		h, err := ParseHeader(buf)
+		return h, be, err
+	}
+	h, err := ParseHeaderV3(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if suite := be.cryptoCore.AEADBackend.SuiteID(); h.Suite != suite {
+		return nil, nil, fmt.Errorf("OpenHeader: cipher suite %d is not supported, the filesystem uses suite %d",
+			h.Suite, suite)
+	}
+	if h.WrappedKey == nil {
+		return h, be, nil
+	}
+	nonce := h.WrappedKey[:keyWrapNonceLen]
+	key, err := be.cryptoCore.KeyWrap.Open(nil, nonce, h.WrappedKey[keyWrapNonceLen:], keyWrapAD(h))
+	if err != nil {
+		return nil, nil, fmt.Errorf("OpenHeader: data key: %v", err)
+	}
+	share, err := be.keyStore.Get(h.ID)
+	if err == nil && len(share) != len(key) {
+		err = fmt.Errorf("key share has %d bytes", len(share))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("OpenHeader: data key: %v", err)
+	}
+	return h, be.forKey(joinShare(key, share)), nil
+}
+
+// DestroyKeyShare destroys the key share of the file "fileID", after which
+// its content cannot be decrypted anymore. Needs version 3 headers.
+func (be *ContentEnc) DestroyKeyShare(fileID []byte) error {
+	if be.keyStore == nil {
+		return errors.New("DestroyKeyShare: no key store")
+	}
+	return be.keyStore.Destroy(fileID)
+}
+
+// joinShare combines the key from the header with the key share from the
+// key store into the data key, in place in "key". "share" is wiped.
+func joinShare(key []byte, share []byte) []byte {
+	for i := range key {
+		key[i] ^= share[i]
+		share[i] = 0
+	}
+	return key
+}
+
+// keyWrapAD binds the wrapped data key to the version, suite and ID of the
+// header, so it cannot be copied into the header of another file
+func keyWrapAD(h *FileHeader) []byte {
+	return h.packV3()[:HeaderLenV3-WrappedKeyLen]
+}
+
+// forKey returns a ContentEnc that encrypts with the data key "key" and
+// shares the block size, buffer pools and workers with "be". "key" is
+// wiped.
+func (be *ContentEnc) forKey(key []byte) *ContentEnc {
+	fe := *be
+	fe.cryptoCore = be.cryptoCore.FileCore(key)
+	for i := range key {
+		key[i] = 0
+	}
+	return &fe
+}
@@ -0,0 +1,108 @@
+package contentenc
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// mapKeyStore is a KeyStore in memory
+type mapKeyStore map[string][]byte
+
+func (m mapKeyStore) Put(fileID []byte, share []byte) error {
+	m[hex.EncodeToString(fileID)] = append([]byte{}, share...)
+	return nil
+}
+
+func (m mapKeyStore) Get(fileID []byte) ([]byte, error) {
+	share, ok := m[hex.EncodeToString(fileID)]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return append([]byte{}, share...), nil
+}
+
+func (m mapKeyStore) Destroy(fileID []byte) error {
+	delete(m, hex.EncodeToString(fileID))
+	return nil
+}
+
+func TestHeaderV3(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	be := New(cc, DefaultBS)
+	ks := mapKeyStore{}
+	if err := be.UseHeaderV3(ks); err != nil {
+		t.Fatal(err)
+	}
+	if be.HeaderLen() != HeaderLenV3 || be.BlockNoToCipherOff(0) != HeaderLenV3 {
+		t.Fatalf("wrong header length %d", be.HeaderLen())
+	}
+	h, fe, err := be.NewHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fe == be {
+		t.Fatal("no per-file data key")
+	}
+	buf := h.Pack()
+	if len(buf) != HeaderLenV3 {
+		t.Fatalf("packed %d bytes", len(buf))
+	}
+	ciphertext := fe.EncryptBlock([]byte("hello"), 0, h.ID)
+	if _, err := be.DecryptBlock(ciphertext, 0, h.ID); err == nil {
+		t.Error("the filesystem key decrypted a block of the data key")
+	}
+	if len(ks) != 1 {
+		t.Fatalf("%d key shares", len(ks))
+	}
+	h2, fe2, err := be.OpenHeader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h2.ID, h.ID) || h2.Suite != cryptocore.SuiteAESGCM {
+		t.Errorf("header changed: %+v", h2)
+	}
+	plaintext, err := fe2.DecryptBlock(ciphertext, 0, h.ID)
+	if err != nil || string(plaintext) != "hello" {
+		t.Errorf("have %q, %v", plaintext, err)
+	}
+	// The wrapped key is bound to the ID
+	buf[5] ^= 1
+	if _, _, err = be.OpenHeader(buf); err == nil {
+		t.Error("data key of another file ID was accepted")
+	}
+	buf[5] ^= 1
+	// Suites other than the one of the filesystem are rejected
+	buf[3] = byte(cryptocore.SuiteXChaCha20Poly1305)
+	if _, _, err = be.OpenHeader(buf); err == nil {
+		t.Error("wrong suite was accepted")
+	}
+	buf[3] = byte(cryptocore.SuiteAESGCM)
+	// The header alone does not give the data key
+	share := ks[hex.EncodeToString(h.ID)]
+	if err = be.DestroyKeyShare(h.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = be.OpenHeader(buf); err == nil {
+		t.Error("header without key share was accepted")
+	}
+	ks[hex.EncodeToString(h.ID)] = make([]byte, len(share))
+	if _, fe4, err := be.OpenHeader(buf); err == nil {
+		if _, err = fe4.DecryptBlock(ciphertext, 0, h.ID); err == nil {
+			t.Error("wrong key share decrypted the content")
+		}
+	}
+	// Without a data key, the file uses the filesystem key
+	copy(buf[HeaderLenV3-WrappedKeyLen:], make([]byte, WrappedKeyLen))
+	if _, fe3, err := be.OpenHeader(buf); err != nil || fe3 != be {
+		t.Errorf("header without data key: %v", err)
+	}
+	// Version 2 headers are rejected
+	if _, _, err = be.OpenHeader(RandomHeader().Pack()); err == nil {
+		t.Error("version 2 header was accepted")
+	}
+}
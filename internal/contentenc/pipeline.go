@@ -0,0 +1,70 @@
+package contentenc
+
+// EncryptAheadSegment is the number of blocks that EncryptBlocksPipelined
+// encrypts and hands to the writer at a time.
+const EncryptAheadSegment = 32
+
+// encryptAheadDepth is the number of encrypted segments that may wait for
+// the writer. When the queue is full, encryption pauses.
+const encryptAheadDepth = 2
+
+// encryptedSegment is an entry of the encrypt-ahead queue
+type encryptedSegment struct {
+	ciphertext []byte
+	// off is the offset of the segment relative to the ciphertext of the
+	// first block
+	off int
+}
+
+// EncryptBlocksPipelined is like EncryptBlocks, but for large writes. A
+// background goroutine encrypts the blocks in segments of
+// EncryptAheadSegment blocks and queues them, while "write" writes out the
+// segments before. This overlaps encryption with the disk writes.
+//
+// "write" is called in order with the ciphertext of each segment and its
+// offset relative to the ciphertext of the first block. The ciphertext is
+// only valid until "write" returns. Stops at the first error that "write"
+// returns, and returns that error.
+func (be *ContentEnc) EncryptBlocksPipelined(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte,
+	write func(ciphertext []byte, off int) error) error {
+	return be.encryptBlocksPipelined(plaintextBlocks, firstBlockNo, write, func(blocks [][]byte, blockNo uint64) []byte {
+		return be.EncryptBlocks(blocks, blockNo, fileID)
+	})
+}
+
+// encryptBlocksPipelined implements EncryptBlocksPipelined with "encrypt"
+// doing the encryption of each segment.
+func (be *ContentEnc) encryptBlocksPipelined(plaintextBlocks [][]byte, firstBlockNo uint64,
+	write func(ciphertext []byte, off int) error, encrypt func(blocks [][]byte, blockNo uint64) []byte) error {
+	queue := make(chan encryptedSegment, encryptAheadDepth)
+	stop := make(chan struct{})
+	go func() {
+		defer close(queue)
+		off := 0
+		for low := 0; low < len(plaintextBlocks); low += EncryptAheadSegment {
+			high := low + EncryptAheadSegment
+			if high > len(plaintextBlocks) {
+				high = len(plaintextBlocks)
+			}
+			c := encrypt(plaintextBlocks[low:high], firstBlockNo+uint64(low))
+			select {
+			case queue <- encryptedSegment{ciphertext: c, off: off}:
+			case <-stop:
+				be.CReqPool.Put(c)
+				return
+			}
+			off += len(c)
+		}
+	}()
+	var err error
+	for s := range queue {
+		if err == nil {
+			err = write(s.ciphertext, s.off)
+			if err != nil {
+				close(stop)
+			}
+		}
+		be.CReqPool.Put(s.ciphertext)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+package contentenc
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+func newTestContentEnc() *ContentEnc {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true)
+	return New(cc, DefaultBS)
+}
+
+// testBlocks returns "n" plaintext blocks, the last one partial
+func testBlocks(n int) [][]byte {
+	blocks := make([][]byte, n)
+	for i := range blocks {
+		blocks[i] = bytes.Repeat([]byte{byte(i)}, DefaultBS)
+	}
+	blocks[n-1] = blocks[n-1][:100]
+	return blocks
+}
+
+func TestEncryptBlocksPipelined(t *testing.T) {
+	f := newTestContentEnc()
+	fileID := make([]byte, DefaultIVBits/8)
+	blocks := testBlocks(3*EncryptAheadSegment + 5)
+	var out []byte
+	err := f.EncryptBlocksPipelined(blocks, 7, fileID, func(c []byte, off int) error {
+		if off != len(out) {
+			t.Fatalf("segment at %d, want %d", off, len(out))
+		}
+		out = append(out, c...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := f.DecryptBlocks(out, 7, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, bytes.Join(blocks, nil)) {
+		t.Error("content mismatch")
+	}
+	// The first error stops the pipeline
+	calls := 0
+	myErr := errors.New("disk full")
+	err = f.EncryptBlocksPipelined(blocks, 0, fileID, func([]byte, int) error {
+		calls++
+		return myErr
+	})
+	if err != myErr || calls != 1 {
+		t.Errorf("err=%v calls=%d", err, calls)
+	}
+}
+
+// benchmarkEncryptWrite encrypts 1 MiB writes and writes them to a file,
+// like doWrite does for a large FUSE write request.
+func benchmarkEncryptWrite(b *testing.B, pipelined bool) {
+	f := newTestContentEnc()
+	fileID := make([]byte, DefaultIVBits/8)
+	blocks := testBlocks(MaxKernelWrite / DefaultBS)
+	blocks[len(blocks)-1] = blocks[0]
+	fd, err := os.CreateTemp(b.TempDir(), "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer fd.Close()
+	b.SetBytes(MaxKernelWrite)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if pipelined {
+			err = f.EncryptBlocksPipelined(blocks, 0, fileID, func(c []byte, off int) error {
+				_, err := fd.WriteAt(c, int64(off))
+				return err
+			})
+		} else {
+			c := f.EncryptBlocks(blocks, 0, fileID)
+			_, err = fd.WriteAt(c, 0)
+			f.CReqPool.Put(c)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptWriteSerial(b *testing.B) {
+	benchmarkEncryptWrite(b, false)
+}
+
+func BenchmarkEncryptWritePipelined(b *testing.B) {
+	benchmarkEncryptWrite(b, true)
+}
@@ -0,0 +1,127 @@
+// Package crashreport catches panics in the FUSE request handlers. Instead
+// of taking the whole process down and leaving a hung mountpoint behind
+// ("Transport endpoint is not connected"), the failing request gets EIO, a
+// diagnostics report is written, and the filesystem is unmounted cleanly.
+package crashreport
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Handler writes the report for the first panic and calls OnCrash.
+type Handler struct {
+	// Dir is where the reports are written. os.TempDir() if empty.
+	Dir string
+	// Config describes the program and its configuration in the report.
+	// The caller must have removed all secrets.
+	Config []string
+	// OnCrash is called in a new goroutine after the first panic, with
+	// the path of the report. It should unmount the filesystem.
+	OnCrash func(report string)
+
+	once    sync.Once
+	crashed atomic.Bool
+}
+
+// Crashed returns true if a request handler has panicked.
+func (h *Handler) Crashed() bool {
+	if h == nil {
+		return false
+	}
+	return h.crashed.Load()
+}
+
+// recover must be deferred by each request handler. It turns a panic into
+// the error "code".
+func (h *Handler) recover(op string, code *fuse.Status) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if code != nil {
+		*code = fuse.EIO
+	}
+	stack := debug.Stack()
+	if h.crashed.Swap(true) {
+		// The filesystem is already being unmounted, one report is enough
+		tlog.Warn.Printf("crashreport: %s: another panic: %v", op, v)
+		return
+	}
+	h.once.Do(func() {
+		path, err := h.write(op, v, stack)
+		if err != nil {
+			tlog.Warn.Printf("crashreport: could not write the report: %v", err)
+			// Better than nothing
+			tlog.Warn.Printf("%s: panic: %v\n%s", op, v, stack)
+		}
+		tlog.Fatal.Printf("%s: panic: %v. Report: %s. Unmounting.", op, v, path)
+		if h.OnCrash != nil {
+			go h.OnCrash(path)
+		}
+	})
+}
+
+// write creates the report file and returns its path
+func (h *Handler) write(op string, v interface{}, stack []byte) (string, error) {
+	dir := h.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	// CreateTemp uses O_EXCL and mode 0600, so this is safe in /tmp
+	f, err := os.CreateTemp(dir, tlog.ProgramName+"-crash-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	_, err = f.WriteString(Format(op, v, stack, h.Config))
+	if err != nil {
+		return f.Name(), err
+	}
+	return f.Name(), f.Sync()
+}
+
+// Format returns the report for panic "v" in request "op". The report holds
+// the stack of the panicking goroutine, the configuration, the runtime
+// statistics and the stacks of all goroutines. It contains no file names or
+// file contents, but the stacks contain pointers and the numbers the
+// functions have been called with.
+func Format(op string, v interface{}, stack []byte, config []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s crash report\n", tlog.ProgramName)
+	fmt.Fprintf(&b, "Time:      %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&b, "Go:        %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "Operation: %s\n", op)
+	fmt.Fprintf(&b, "Panic:     %v\n", v)
+	fmt.Fprintf(&b, "\n=== Stack\n%s\n", stack)
+	fmt.Fprintf(&b, "=== Configuration\n")
+	for _, l := range config {
+		fmt.Fprintf(&b, "%s\n", l)
+	}
+	fmt.Fprintf(&b, "\n=== Statistics\n%s\n", stats.Default)
+	fmt.Fprintf(&b, "=== All goroutines\n%s", allStacks())
+	return b.String()
+}
+
+// allStacks returns the stacks of all goroutines
+func allStacks() []byte {
+	buf := make([]byte, 64*1024)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
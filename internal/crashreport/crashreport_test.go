@@ -0,0 +1,77 @@
+package crashreport
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// panicFS panics in Lookup and GetAttr
+type panicFS struct {
+	fuse.RawFileSystem
+}
+
+func (fs *panicFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	panic("lookup bug")
+}
+
+func (fs *panicFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	panic("getattr bug")
+}
+
+func TestCrash(t *testing.T) {
+	reports := make(chan string, 2)
+	h := &Handler{
+		Dir:     t.TempDir(),
+		Config:  []string{"config line"},
+		OnCrash: func(report string) { reports <- report },
+	}
+	raw := h.Wrap(&panicFS{fuse.NewDefaultRawFileSystem()})
+	// Requests that do not panic are passed on
+	if code := raw.Access(nil, &fuse.AccessIn{}); code != fuse.ENOSYS {
+		t.Errorf("Access: %v", code)
+	}
+	if h.Crashed() {
+		t.Fatal("no crash yet")
+	}
+	if code := raw.Lookup(nil, &fuse.InHeader{}, "foo", &fuse.EntryOut{}); code != fuse.EIO {
+		t.Errorf("Lookup: %v", code)
+	}
+	if !h.Crashed() {
+		t.Error("should have crashed")
+	}
+	var report string
+	select {
+	case report = <-reports:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnCrash was not called")
+	}
+	if filepath.Dir(report) != h.Dir {
+		t.Errorf("report %q is not in %q", report, h.Dir)
+	}
+	content, err := os.ReadFile(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Operation: Lookup", "Panic:     lookup bug", "config line", "panicFS).Lookup", "=== All goroutines"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("report does not contain %q:\n%s", want, content)
+		}
+	}
+	// Only the first panic gets a report and an OnCrash call
+	if code := raw.GetAttr(nil, &fuse.GetAttrIn{}, &fuse.AttrOut{}); code != fuse.EIO {
+		t.Errorf("GetAttr: %v", code)
+	}
+	select {
+	case r := <-reports:
+		t.Errorf("second OnCrash call with %q", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if files, _ := os.ReadDir(h.Dir); len(files) != 1 {
+		t.Errorf("have %d reports", len(files))
+	}
+}
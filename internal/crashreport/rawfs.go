@@ -0,0 +1,218 @@
+package crashreport
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Wrap returns "raw" with a recover in front of every request handler.
+func (h *Handler) Wrap(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &rawFS{RawFileSystem: raw, h: h}
+}
+
+// rawFS passes all requests on to the embedded RawFileSystem. Methods that
+// are not overridden here, like String and SetDebug, are not request
+// handlers.
+type rawFS struct {
+	fuse.RawFileSystem
+	h *Handler
+}
+
+func (r *rawFS) Init(s *fuse.Server) {
+	defer r.h.recover("Init", nil)
+	r.RawFileSystem.Init(s)
+}
+
+func (r *rawFS) OnUnmount() {
+	defer r.h.recover("OnUnmount", nil)
+	r.RawFileSystem.OnUnmount()
+}
+
+func (r *rawFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) (code fuse.Status) {
+	defer r.h.recover("Lookup", &code)
+	return r.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (r *rawFS) Forget(nodeid, nlookup uint64) {
+	defer r.h.recover("Forget", nil)
+	r.RawFileSystem.Forget(nodeid, nlookup)
+}
+
+func (r *rawFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
+	defer r.h.recover("GetAttr", &code)
+	return r.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (r *rawFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
+	defer r.h.recover("SetAttr", &code)
+	return r.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (r *rawFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
+	defer r.h.recover("Mknod", &code)
+	return r.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (r *rawFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) (code fuse.Status) {
+	defer r.h.recover("Mkdir", &code)
+	return r.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (r *rawFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
+	defer r.h.recover("Unlink", &code)
+	return r.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (r *rawFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
+	defer r.h.recover("Rmdir", &code)
+	return r.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (r *rawFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
+	defer r.h.recover("Rename", &code)
+	return r.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (r *rawFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) (code fuse.Status) {
+	defer r.h.recover("Link", &code)
+	return r.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (r *rawFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) (code fuse.Status) {
+	defer r.h.recover("Symlink", &code)
+	return r.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (r *rawFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, code fuse.Status) {
+	defer r.h.recover("Readlink", &code)
+	return r.RawFileSystem.Readlink(cancel, header)
+}
+
+func (r *rawFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) (code fuse.Status) {
+	defer r.h.recover("Access", &code)
+	return r.RawFileSystem.Access(cancel, input)
+}
+
+func (r *rawFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (sz uint32, code fuse.Status) {
+	defer r.h.recover("GetXAttr", &code)
+	return r.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (r *rawFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (sz uint32, code fuse.Status) {
+	defer r.h.recover("ListXAttr", &code)
+	return r.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (r *rawFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) (code fuse.Status) {
+	defer r.h.recover("SetXAttr", &code)
+	return r.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (r *rawFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) (code fuse.Status) {
+	defer r.h.recover("RemoveXAttr", &code)
+	return r.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (r *rawFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) (code fuse.Status) {
+	defer r.h.recover("Create", &code)
+	return r.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (r *rawFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (code fuse.Status) {
+	defer r.h.recover("Open", &code)
+	return r.RawFileSystem.Open(cancel, input, out)
+}
+
+func (r *rawFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (res fuse.ReadResult, code fuse.Status) {
+	defer r.h.recover("Read", &code)
+	return r.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (r *rawFS) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut) (code fuse.Status) {
+	defer r.h.recover("Lseek", &code)
+	return r.RawFileSystem.Lseek(cancel, in, out)
+}
+
+func (r *rawFS) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) (code fuse.Status) {
+	defer r.h.recover("GetLk", &code)
+	return r.RawFileSystem.GetLk(cancel, input, out)
+}
+
+func (r *rawFS) SetLk(cancel <-chan struct{}, input *fuse.LkIn) (code fuse.Status) {
+	defer r.h.recover("SetLk", &code)
+	return r.RawFileSystem.SetLk(cancel, input)
+}
+
+func (r *rawFS) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) (code fuse.Status) {
+	defer r.h.recover("SetLkw", &code)
+	return r.RawFileSystem.SetLkw(cancel, input)
+}
+
+func (r *rawFS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	defer r.h.recover("Release", nil)
+	r.RawFileSystem.Release(cancel, input)
+}
+
+func (r *rawFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (written uint32, code fuse.Status) {
+	defer r.h.recover("Write", &code)
+	return r.RawFileSystem.Write(cancel, input, data)
+}
+
+func (r *rawFS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (written uint32, code fuse.Status) {
+	defer r.h.recover("CopyFileRange", &code)
+	return r.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (r *rawFS) Ioctl(cancel <-chan struct{}, input *fuse.IoctlIn, inbuf []byte, output *fuse.IoctlOut, outbuf []byte) (code fuse.Status) {
+	defer r.h.recover("Ioctl", &code)
+	return r.RawFileSystem.Ioctl(cancel, input, inbuf, output, outbuf)
+}
+
+func (r *rawFS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) (code fuse.Status) {
+	defer r.h.recover("Flush", &code)
+	return r.RawFileSystem.Flush(cancel, input)
+}
+
+func (r *rawFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
+	defer r.h.recover("Fsync", &code)
+	return r.RawFileSystem.Fsync(cancel, input)
+}
+
+func (r *rawFS) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) (code fuse.Status) {
+	defer r.h.recover("Fallocate", &code)
+	return r.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (r *rawFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) (code fuse.Status) {
+	defer r.h.recover("OpenDir", &code)
+	return r.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (r *rawFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (code fuse.Status) {
+	defer r.h.recover("ReadDir", &code)
+	return r.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (r *rawFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) (code fuse.Status) {
+	defer r.h.recover("ReadDirPlus", &code)
+	return r.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (r *rawFS) ReleaseDir(input *fuse.ReleaseIn) {
+	defer r.h.recover("ReleaseDir", nil)
+	r.RawFileSystem.ReleaseDir(input)
+}
+
+func (r *rawFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
+	defer r.h.recover("FsyncDir", &code)
+	return r.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (r *rawFS) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) (code fuse.Status) {
+	defer r.h.recover("StatFs", &code)
+	return r.RawFileSystem.StatFs(cancel, input, out)
+}
+
+func (r *rawFS) Statx(cancel <-chan struct{}, input *fuse.StatxIn, out *fuse.StatxOut) (code fuse.Status) {
+	defer r.h.recover("Statx", &code)
+	return r.RawFileSystem.Statx(cancel, input, out)
+}
@@ -4,13 +4,15 @@ package cryptocore
 
 import (
 	"bytes"
-	"fmt"
+	"crypto/rand"
 	"log"
 	"runtime"
 	"sync"
 	"sync/atomic"
-	"testing"
 	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 const (
@@ -26,39 +28,55 @@ const (
 	HighThroughputThreshold = 1000 // requests per second
 )
 
-// AdaptivePrefetcher provides adaptive RNG prefetch buffer size optimization
+// AdaptivePrefetcher provides adaptive RNG prefetch buffer size optimization.
+//
+// Random data is generated on demand: whenever Read takes a fresh chunk, the
+// refill worker is asked to prepare exactly one more. An idle prefetcher
+// does not consume any CPU or entropy.
 type AdaptivePrefetcher struct {
 	// Current prefetch size
 	prefetchSize int32
-	// Request counter for profiling
+	// Request counter for profiling, reset every profiling window
 	requestCount int64
-	// Last profiling time
+	// Total number of requests
+	requestsTotal stats.Counter
+	// Profiling enabled flag (0 or 1)
+	profilingEnabled int32
+	// Last profiling time, only accessed by profilingWorker
 	lastProfileTime time.Time
-	// Mutex for thread safety
-	mutex sync.RWMutex
+	// Mutex protects buf
+	mutex sync.Mutex
 	// Buffer for random data
 	buf bytes.Buffer
-	// Channel for refill requests
+	// want asks the refill worker for one chunk
+	want chan struct{}
+	// refill hands a prepared chunk to Read
 	refill chan []byte
 	// Stop channel for graceful shutdown
-	stop chan struct{}
-	// Profiling enabled flag
-	profilingEnabled bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	// wg tracks the worker goroutines
+	wg sync.WaitGroup
 }
 
-// NewAdaptivePrefetcher creates a new adaptive prefetcher
-func NewAdaptivePrefetcher() *AdaptivePrefetcher {
+// NewAdaptivePrefetcher creates a new adaptive prefetcher that starts with
+// "size" bytes (clamped to [MinPrefetchSize, MaxPrefetchSize]). If
+// "profiling" is set, the size is adjusted to the request rate every
+// ProfilingWindow. Call Close to stop the worker goroutines.
+func NewAdaptivePrefetcher(size int, profiling bool) *AdaptivePrefetcher {
 	ap := &AdaptivePrefetcher{
-		prefetchSize:     DefaultPrefetchSize,
-		refill:           make(chan []byte, 2), // Buffer for 2 refills
-		stop:             make(chan struct{}),
-		profilingEnabled: true,
+		lastProfileTime: time.Now(),
+		want:            make(chan struct{}, 1),
+		refill:          make(chan []byte, 1),
+		stop:            make(chan struct{}),
 	}
+	ap.SetPrefetchSize(size)
+	ap.EnableProfiling(profiling)
+	// Prepare the first chunk
+	ap.want <- struct{}{}
 
-	// Start the refill worker
+	ap.wg.Add(2)
 	go ap.refillWorker()
-
-	// Start the profiling worker
 	go ap.profilingWorker()
 
 	return ap
@@ -66,28 +84,49 @@ func NewAdaptivePrefetcher() *AdaptivePrefetcher {
 
 // Read reads the requested number of random bytes
 func (ap *AdaptivePrefetcher) Read(want int) []byte {
-	// Increment request counter for profiling
-	if ap.profilingEnabled {
-		atomic.AddInt64(&ap.requestCount, 1)
-	}
-
 	out := make([]byte, want)
+	ap.ReadInto(out)
+	return out
+}
+
+// ReadInto fills "out" with random bytes. Requests larger than the prefetch
+// buffer go to crypto/rand directly.
+func (ap *AdaptivePrefetcher) ReadInto(out []byte) {
+	atomic.AddInt64(&ap.requestCount, 1)
+	ap.requestsTotal.Inc()
+
+	want := len(out)
+	if want > int(atomic.LoadInt32(&ap.prefetchSize)) {
+		readRand(out)
+		return
+	}
 	ap.mutex.Lock()
 	defer ap.mutex.Unlock()
 
 	// Try to read from buffer
 	have, err := ap.buf.Read(out)
 	if have == want && err == nil {
-		return out
+		return
 	}
 
 	// Buffer was empty or insufficient -> re-fill
-	fresh := <-ap.refill
-	if len(fresh) != int(atomic.LoadInt32(&ap.prefetchSize)) {
-		log.Panicf("AdaptivePrefetcher: refill: got %d bytes instead of %d",
-			len(fresh), atomic.LoadInt32(&ap.prefetchSize))
+	var fresh []byte
+	select {
+	case fresh = <-ap.refill:
+		// Ask for the next chunk
+		select {
+		case ap.want <- struct{}{}:
+		default:
+		}
+	case <-ap.stop:
+		// Closed: keep working, but without prefetching
+		fresh = RandBytes(int(atomic.LoadInt32(&ap.prefetchSize)))
+	}
+	if len(fresh) < want {
+		// The prefetch size was lowered while the chunk was prepared
+		readRand(out)
+		return
 	}
-
 	ap.buf.Reset()
 	ap.buf.Write(fresh)
 	have, err = ap.buf.Read(out)
@@ -95,25 +134,36 @@ func (ap *AdaptivePrefetcher) Read(want int) []byte {
 		log.Panicf("AdaptivePrefetcher could not satisfy read: have=%d want=%d err=%v",
 			have, want, err)
 	}
+}
 
-	return out
+// readRand fills "out" from crypto/rand or panics
+func readRand(out []byte) {
+	if _, err := rand.Read(out); err != nil {
+		log.Panic("Failed to read random bytes: " + err.Error())
+	}
 }
 
-// refillWorker continuously refills the buffer
+// refillWorker prepares one chunk of random data each time it is asked to
 func (ap *AdaptivePrefetcher) refillWorker() {
+	defer ap.wg.Done()
 	for {
 		select {
 		case <-ap.stop:
 			return
-		default:
-			size := int(atomic.LoadInt32(&ap.prefetchSize))
-			ap.refill <- RandBytes(size)
+		case <-ap.want:
+		}
+		size := int(atomic.LoadInt32(&ap.prefetchSize))
+		select {
+		case ap.refill <- RandBytes(size):
+		case <-ap.stop:
+			return
 		}
 	}
 }
 
 // profilingWorker monitors usage patterns and adjusts prefetch size
 func (ap *AdaptivePrefetcher) profilingWorker() {
+	defer ap.wg.Done()
 	ticker := time.NewTicker(ProfilingWindow)
 	defer ticker.Stop()
 
@@ -129,12 +179,12 @@ func (ap *AdaptivePrefetcher) profilingWorker() {
 
 // adjustPrefetchSize adjusts the prefetch size based on usage patterns
 func (ap *AdaptivePrefetcher) adjustPrefetchSize() {
-	if !ap.profilingEnabled {
-		return
-	}
-
 	now := time.Now()
 	requests := atomic.SwapInt64(&ap.requestCount, 0)
+	if atomic.LoadInt32(&ap.profilingEnabled) == 0 {
+		ap.lastProfileTime = now
+		return
+	}
 
 	// Calculate requests per second
 	elapsed := now.Sub(ap.lastProfileTime)
@@ -166,7 +216,7 @@ func (ap *AdaptivePrefetcher) adjustPrefetchSize() {
 	// Update prefetch size if changed
 	if newSize != currentSize {
 		atomic.StoreInt32(&ap.prefetchSize, int32(newSize))
-		log.Printf("AdaptivePrefetcher: adjusted prefetch size from %d to %d (%.1f req/s)",
+		tlog.Debug.Printf("AdaptivePrefetcher: adjusted prefetch size from %d to %d (%.1f req/s)",
 			currentSize, newSize, requestsPerSecond)
 	}
 }
@@ -189,44 +239,24 @@ func (ap *AdaptivePrefetcher) SetPrefetchSize(size int) {
 
 // EnableProfiling enables or disables adaptive profiling
 func (ap *AdaptivePrefetcher) EnableProfiling(enabled bool) {
-	ap.mutex.Lock()
-	defer ap.mutex.Unlock()
-	ap.profilingEnabled = enabled
+	atomic.StoreInt32(&ap.profilingEnabled, int32(stats.Bool(enabled)))
 }
 
-// GetStats returns statistics about the adaptive prefetcher
-func (ap *AdaptivePrefetcher) GetStats() map[string]interface{} {
-	stats := make(map[string]interface{})
-	stats["prefetch_size"] = ap.GetPrefetchSize()
-	stats["profiling_enabled"] = ap.profilingEnabled
-	stats["request_count"] = atomic.LoadInt64(&ap.requestCount)
-	return stats
+// RegisterStats registers the statistics of the adaptive prefetcher in "r".
+func (ap *AdaptivePrefetcher) RegisterStats(r *stats.Registry) {
+	r.Func("prefetch_size_bytes", stats.KindGauge, "Current random prefetch buffer size",
+		func() int64 { return int64(ap.GetPrefetchSize()) })
+	r.Func("prefetch_profiling_enabled", stats.KindGauge, "Prefetch size adaption is enabled",
+		func() int64 { return int64(atomic.LoadInt32(&ap.profilingEnabled)) })
+	r.Counter("prefetch_requests_total", "Random data requests", &ap.requestsTotal)
 }
 
-// Close gracefully shuts down the adaptive prefetcher
+// Close stops the worker goroutines and waits for them to exit. Reads after
+// Close still work, but are not prefetched anymore. Close may be called
+// more than once.
 func (ap *AdaptivePrefetcher) Close() {
-	close(ap.stop)
-}
-
-// Global adaptive prefetcher instance
-var adaptivePrefetcher *AdaptivePrefetcher
-
-// InitAdaptivePrefetcher initializes the global adaptive prefetcher
-func InitAdaptivePrefetcher() {
-	adaptivePrefetcher = NewAdaptivePrefetcher()
-}
-
-// GetAdaptivePrefetcher returns the global adaptive prefetcher
-func GetAdaptivePrefetcher() *AdaptivePrefetcher {
-	if adaptivePrefetcher == nil {
-		InitAdaptivePrefetcher()
-	}
-	return adaptivePrefetcher
-}
-
-// AdaptiveRead reads random bytes using the adaptive prefetcher
-func AdaptiveRead(want int) []byte {
-	return GetAdaptivePrefetcher().Read(want)
+	ap.stopOnce.Do(func() { close(ap.stop) })
+	ap.wg.Wait()
 }
 
 // GetOptimalPrefetchSize returns the optimal prefetch size based on system characteristics
@@ -246,32 +276,3 @@ func GetOptimalPrefetchSize() int {
 		return 256
 	}
 }
-
-// BenchmarkAdaptivePrefetch benchmarks the adaptive prefetcher
-func BenchmarkAdaptivePrefetch(b *testing.B) {
-	ap := NewAdaptivePrefetcher()
-	defer ap.Close()
-
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		ap.Read(16)
-	}
-}
-
-// BenchmarkAdaptivePrefetchSizes benchmarks different prefetch sizes
-func BenchmarkAdaptivePrefetchSizes(b *testing.B) {
-	sizes := []int{256, 512, 1024, 2048, 4096}
-
-	for _, size := range sizes {
-		b.Run(fmt.Sprintf("size_%d", size), func(b *testing.B) {
-			ap := NewAdaptivePrefetcher()
-			ap.SetPrefetchSize(size)
-			defer ap.Close()
-
-			b.ResetTimer()
-			for i := 0; i < b.N; i++ {
-				ap.Read(16)
-			}
-		})
-	}
-}
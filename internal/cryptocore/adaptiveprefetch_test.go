@@ -1,12 +1,17 @@
 package cryptocore
 
 import (
+	"bytes"
 	"fmt"
+	"runtime"
 	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 )
 
 func TestAdaptivePrefetcher(t *testing.T) {
-	ap := NewAdaptivePrefetcher()
+	ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 	defer ap.Close()
 
 	// Test basic functionality
@@ -32,7 +37,7 @@ func TestAdaptivePrefetcher(t *testing.T) {
 }
 
 func TestAdaptivePrefetcherSizeAdjustment(t *testing.T) {
-	ap := NewAdaptivePrefetcher()
+	ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 	defer ap.Close()
 
 	// Set initial size
@@ -54,7 +59,7 @@ func TestAdaptivePrefetcherSizeAdjustment(t *testing.T) {
 }
 
 func TestAdaptivePrefetcherProfiling(t *testing.T) {
-	ap := NewAdaptivePrefetcher()
+	ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 	defer ap.Close()
 
 	// Enable profiling
@@ -66,15 +71,15 @@ func TestAdaptivePrefetcherProfiling(t *testing.T) {
 	}
 
 	// Check stats
-	stats := ap.GetStats()
-	if stats["profiling_enabled"] != true {
+	r := stats.New()
+	ap.RegisterStats(r)
+	if r.Map()["prefetch_profiling_enabled"] != 1 {
 		t.Error("Profiling should be enabled")
 	}
 
 	// Disable profiling
 	ap.EnableProfiling(false)
-	stats = ap.GetStats()
-	if stats["profiling_enabled"] != false {
+	if r.Map()["prefetch_profiling_enabled"] != 0 {
 		t.Error("Profiling should be disabled")
 	}
 }
@@ -87,22 +92,70 @@ func TestGetOptimalPrefetchSize(t *testing.T) {
 	}
 }
 
-func TestGlobalAdaptivePrefetcher(t *testing.T) {
-	// Test global prefetcher
-	ap := GetAdaptivePrefetcher()
-	if ap == nil {
-		t.Fatal("Global adaptive prefetcher should not be nil")
+// Idle prefetchers must not generate random data in the background, and
+// Close must stop all worker goroutines.
+func TestAdaptivePrefetcherIdleAndClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
+	ap.Read(16)
+	time.Sleep(10 * time.Millisecond)
+	// One chunk is prepared ahead, and not more
+	if n := len(ap.refill); n > 1 {
+		t.Errorf("%d chunks queued", n)
+	}
+	if len(ap.want) != 0 {
+		t.Error("refill worker did not pick up the request")
+	}
+	ap.Close()
+	ap.Close()
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutine leak: %d before, %d after Close", before, after)
+	}
+	// Reads still work after Close
+	for i := 0; i < 100; i++ {
+		if data := ap.Read(32); len(data) != 32 {
+			t.Fatalf("Expected 32 bytes, got %d", len(data))
+		}
 	}
+}
 
-	// Test adaptive read
-	data := AdaptiveRead(16)
-	if len(data) != 16 {
-		t.Errorf("Expected 16 bytes, got %d", len(data))
+// Requests larger than the prefetch buffer bypass it
+func TestAdaptivePrefetcherLargeRead(t *testing.T) {
+	ap := NewAdaptivePrefetcher(MinPrefetchSize, false)
+	defer ap.Close()
+	data := ap.Read(MinPrefetchSize + 1)
+	if bytes.Equal(data, make([]byte, len(data))) {
+		t.Error("got all-zero data")
+	}
+}
+
+// The IVGenerator uses the adaptive prefetcher after UseAdaptivePrefetcher,
+// and Wipe stops it.
+func TestUseAdaptivePrefetcher(t *testing.T) {
+	c := New(make([]byte, KeyLen), BackendGoGCM, 128, true)
+	c.UseAdaptivePrefetcher(1024, false)
+	ap := c.IVGenerator.prefetcher
+	r := stats.New()
+	c.RegisterStats(r)
+	n1 := c.IVGenerator.Get()
+	n2 := c.IVGenerator.Get()
+	if len(n1) != c.IVLen || bytes.Equal(n1, n2) {
+		t.Errorf("bad nonces %x %x", n1, n2)
+	}
+	m := r.Map()
+	if m["prefetch_requests_total"] != 2 || m["prefetch_size_bytes"] != 1024 {
+		t.Errorf("wrong stats: %v", m)
+	}
+	c.Wipe()
+	select {
+	case <-ap.stop:
+	default:
+		t.Error("Wipe did not stop the prefetcher")
 	}
 }
 
 func BenchmarkAdaptivePrefetcher(b *testing.B) {
-	ap := NewAdaptivePrefetcher()
+	ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 	defer ap.Close()
 
 	b.ResetTimer()
@@ -116,7 +169,7 @@ func BenchmarkAdaptivePrefetcherSizes(b *testing.B) {
 
 	for _, size := range sizes {
 		b.Run(fmt.Sprintf("size_%d", size), func(b *testing.B) {
-			ap := NewAdaptivePrefetcher()
+			ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 			ap.SetPrefetchSize(size)
 			defer ap.Close()
 
@@ -131,7 +184,7 @@ func BenchmarkAdaptivePrefetcherSizes(b *testing.B) {
 func BenchmarkAdaptivePrefetcherVsOriginal(b *testing.B) {
 	// Benchmark adaptive prefetcher
 	b.Run("adaptive", func(b *testing.B) {
-		ap := NewAdaptivePrefetcher()
+		ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 		defer ap.Close()
 
 		b.ResetTimer()
@@ -150,7 +203,7 @@ func BenchmarkAdaptivePrefetcherVsOriginal(b *testing.B) {
 }
 
 func TestAdaptivePrefetcherConcurrency(t *testing.T) {
-	ap := NewAdaptivePrefetcher()
+	ap := NewAdaptivePrefetcher(DefaultPrefetchSize, true)
 	defer ap.Close()
 
 	// Test concurrent access
@@ -13,11 +13,16 @@ import (
 
 	"github.com/rfjakob/eme"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/memprotect"
 	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
+// memProtect allocates the keys that New derives, see DeriveKeyGuarded
+var memProtect = memprotect.New()
+
 const (
 	// KeyLen is the cipher key length in bytes. All backends use 32 bytes.
 	KeyLen = 32
@@ -30,7 +35,8 @@ const (
 type AEADTypeEnum struct {
 	// Algo is the encryption algorithm. Example: "AES-GCM-256"
 	Algo string
-	// Lib is the library where Algo is implemented. Either "Go" or "OpenSSL".
+	// Lib is the library where Algo is implemented: "Go", "OpenSSL" or
+	// "Go-optimized".
 	Lib       string
 	NonceSize int
 }
@@ -48,6 +54,11 @@ var BackendOpenSSL = AEADTypeEnum{"AES-GCM-256", "OpenSSL", 16}
 // "AES-GCM-256-Go" in gocryptfs -speed.
 var BackendGoGCM = AEADTypeEnum{"AES-GCM-256", "Go", 16}
 
+// BackendOptimized specifies the OptimizedBackend AES-256-GCM implementation.
+// Same ciphertext format as BackendGoGCM.
+// "AES-GCM-256-Go-optimized" in gocryptfs -speed.
+var BackendOptimized = AEADTypeEnum{"AES-GCM-256", "Go-optimized", 16}
+
 // BackendAESSIV specifies an AESSIV backend.
 // "AES-SIV-512-Go" in gocryptfs -speed.
 var BackendAESSIV = AEADTypeEnum{"AES-SIV-512", "Go", siv_aead.NonceSize}
@@ -59,10 +70,17 @@ var BackendXChaCha20Poly1305 = AEADTypeEnum{"XChaCha20-Poly1305", "Go", chacha20
 // BackendXChaCha20Poly1305OpenSSL specifies XChaCha20-Poly1305-OpenSSL.
 var BackendXChaCha20Poly1305OpenSSL = AEADTypeEnum{"XChaCha20-Poly1305", "OpenSSL", chacha20poly1305.NonceSizeX}
 
+// EME is the interface of *eme.EMECipher. The "-privsep" key-holder proxy
+// implements it as well.
+type EME interface {
+	Encrypt(tweak []byte, inputData []byte) []byte
+	Decrypt(tweak []byte, inputData []byte) []byte
+}
+
 // CryptoCore is the low level crypto implementation.
 type CryptoCore struct {
 	// EME is used for filename encryption.
-	EMECipher *eme.EMECipher
+	EMECipher EME
 	// GCM or AES-SIV. This is used for content encryption.
 	AEADCipher cipher.AEAD
 	// Which backend is behind AEADCipher?
@@ -71,6 +89,32 @@ type CryptoCore struct {
 	IVGenerator *nonceGenerator
 	// IVLen in bytes
 	IVLen int
+	// KeyWrap encrypts the per-file data keys of version 3 file headers.
+	// AES-256-GCM with a key derived from the master key. nil without
+	// HKDF, and with "-privsep".
+	KeyWrap cipher.AEAD
+}
+
+// Cipher suite identifiers in version 3 file headers. They name the content
+// cipher, independent of the library that implements it.
+const (
+	SuiteAESGCM            uint16 = 1
+	SuiteAESSIV            uint16 = 2
+	SuiteXChaCha20Poly1305 uint16 = 3
+)
+
+// SuiteID returns the cipher suite identifier of the content cipher, or 0
+// if it has none
+func (a AEADTypeEnum) SuiteID() uint16 {
+	switch a.Algo {
+	case BackendGoGCM.Algo:
+		return SuiteAESGCM
+	case BackendAESSIV.Algo:
+		return SuiteAESSIV
+	case BackendXChaCha20Poly1305.Algo:
+		return SuiteXChaCha20Poly1305
+	}
+	return 0
 }
 
 // New returns a new CryptoCore object or panics.
@@ -98,11 +142,9 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 	{
 		var emeBlockCipher cipher.Block
 		if useHKDF {
-			emeKey := hkdfDerive(key, hkdfInfoEMENames, KeyLen)
+			emeKey := DeriveKeyGuarded(key, KeyEMENames)
 			emeBlockCipher, err = aes.NewCipher(emeKey)
-			for i := range emeKey {
-				emeKey[i] = 0
-			}
+			memProtect.WipeKey(emeKey)
 		} else {
 			emeBlockCipher, err = aes.NewCipher(key)
 		}
@@ -114,14 +156,15 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 
 	// Initialize an AEAD cipher for file content encryption.
 	var aeadCipher cipher.AEAD
-	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM {
+	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM || aeadType == BackendOptimized {
 		var gcmKey []byte
 		if useHKDF {
-			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
+			gcmKey = DeriveKeyGuarded(key, KeyGCMContent)
 		} else {
 			// Filesystems created by gocryptfs v0.7 through v1.2 don't use HKDF.
 			// Example: tests/example_filesystems/v0.9
-			gcmKey = append([]byte{}, key...)
+			gcmKey = memProtect.AllocateKey(len(key))
+			copy(gcmKey, key)
 		}
 		switch aeadType {
 		case BackendOpenSSL:
@@ -138,12 +181,15 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 			if err != nil {
 				log.Panic(err)
 			}
+		case BackendOptimized:
+			aeadCipher, err = NewOptimizedBackend(gcmKey, IVBitLen/8)
+			if err != nil {
+				log.Panic(err)
+			}
 		default:
 			log.Panicf("BUG: unhandled case: %v", aeadType)
 		}
-		for i := range gcmKey {
-			gcmKey[i] = 0
-		}
+		memProtect.WipeKey(gcmKey)
 	} else if aeadType == BackendAESSIV {
 		if IVBitLen != 128 {
 			// SIV supports any nonce size, but we only use 128.
@@ -155,15 +201,14 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		// SHA256.
 		var key64 []byte
 		if useHKDF {
-			key64 = hkdfDerive(key, hkdfInfoSIVContent, siv_aead.KeyLen)
+			key64 = DeriveKeyGuarded(key, KeySIVContent)
 		} else {
-			s := sha512.Sum512(key)
-			key64 = s[:]
+			h := sha512.New()
+			h.Write(key)
+			key64 = h.Sum(memProtect.AllocateKey(sha512.Size)[:0])
 		}
 		aeadCipher = siv_aead.New(key64)
-		for i := range key64 {
-			key64[i] = 0
-		}
+		memProtect.WipeKey(key64)
 	} else if aeadType == BackendXChaCha20Poly1305 || aeadType == BackendXChaCha20Poly1305OpenSSL {
 		// We don't support legacy modes with XChaCha20-Poly1305
 		if IVBitLen != chacha20poly1305.NonceSizeX*8 {
@@ -172,7 +217,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		if !useHKDF {
 			log.Panic("XChaCha20-Poly1305 must use HKDF, but it is disabled")
 		}
-		derivedKey := hkdfDerive(key, hkdfInfoXChaChaPoly1305Content, chacha20poly1305.KeySize)
+		derivedKey := DeriveKeyGuarded(key, KeyXChaCha20Poly1305Content)
 		if aeadType == BackendXChaCha20Poly1305 {
 			aeadCipher, err = chacha20poly1305.NewX(derivedKey)
 		} else if aeadType == BackendXChaCha20Poly1305OpenSSL {
@@ -180,6 +225,7 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 		} else {
 			log.Panicf("BUG: unhandled case: %v", aeadType)
 		}
+		memProtect.WipeKey(derivedKey)
 		if err != nil {
 			log.Panic(err)
 		}
@@ -192,15 +238,76 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool) *CryptoC
 			aeadCipher.NonceSize()*8, IVBitLen)
 	}
 
+	var keyWrap cipher.AEAD
+	if useHKDF {
+		wrapKey := DeriveKeyGuarded(key, KeyFileKeyWrap)
+		wrapBlockCipher, err := aes.NewCipher(wrapKey)
+		memProtect.WipeKey(wrapKey)
+		if err != nil {
+			log.Panic(err)
+		}
+		keyWrap, err = cipher.NewGCM(wrapBlockCipher)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+
 	return &CryptoCore{
 		EMECipher:   emeCipher,
 		AEADCipher:  aeadCipher,
 		AEADBackend: aeadType,
 		IVGenerator: &nonceGenerator{nonceLen: IVBitLen / 8},
 		IVLen:       IVBitLen / 8,
+		KeyWrap:     keyWrap,
+	}
+}
+
+// FileCore returns a CryptoCore that encrypts file content with the
+// per-file data key "key", using the same backend and IV generator as "c".
+// It has no EME cipher and no KeyWrap.
+func (c *CryptoCore) FileCore(key []byte) *CryptoCore {
+	fc := New(key, c.AEADBackend, c.IVLen*8, true)
+	fc.EMECipher = nil
+	fc.KeyWrap = nil
+	fc.IVGenerator = c.IVGenerator
+	return fc
+}
+
+// NewWithCiphers returns a CryptoCore object that uses already-initialized
+// ciphers. This is used by "-privsep", where the ciphers are proxies that
+// forward all operations to the key-holder process.
+func NewWithCiphers(emeCipher EME, aeadCipher cipher.AEAD, aeadType AEADTypeEnum) *CryptoCore {
+	nonceLen := aeadCipher.NonceSize()
+	return &CryptoCore{
+		EMECipher:   emeCipher,
+		AEADCipher:  aeadCipher,
+		AEADBackend: aeadType,
+		IVGenerator: &nonceGenerator{nonceLen: nonceLen},
+		IVLen:       nonceLen,
+	}
+}
+
+// RegisterStats registers the statistics of the content cipher in "r", if
+// it has any.
+func (c *CryptoCore) RegisterStats(r *stats.Registry) {
+	if ob, ok := c.AEADCipher.(*OptimizedBackend); ok {
+		ob.RegisterStats(r)
+	}
+	if ap := c.IVGenerator.prefetcher; ap != nil {
+		ap.RegisterStats(r)
 	}
 }
 
+// UseAdaptivePrefetcher makes the IVGenerator draw its nonces from an
+// AdaptivePrefetcher with an initial buffer size of "size" bytes instead of
+// the fixed-size global prefetcher. With "profiling", the buffer size
+// follows the nonce request rate. Must be called before the first nonce is
+// generated. The prefetcher is stopped by Wipe.
+func (c *CryptoCore) UseAdaptivePrefetcher(size int, profiling bool) *AdaptivePrefetcher {
+	c.IVGenerator.prefetcher = NewAdaptivePrefetcher(size, profiling)
+	return c.IVGenerator.prefetcher
+}
+
 type wiper interface {
 	Wipe()
 }
@@ -225,5 +332,9 @@ func (c *CryptoCore) Wipe() {
 	// Go stdlib. Best we can is to nil the references and force a GC.
 	c.AEADCipher = nil
 	c.EMECipher = nil
+	c.KeyWrap = nil
+	if ap := c.IVGenerator.prefetcher; ap != nil {
+		ap.Close()
+	}
 	runtime.GC()
 }
@@ -1,6 +1,7 @@
 package cryptocore
 
 import (
+	"bytes"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
@@ -18,6 +19,10 @@ func TestCryptoCoreNew(t *testing.T) {
 		if c.IVLen != 16 {
 			t.Fail()
 		}
+		c = New(key, BackendOptimized, 128, useHKDF)
+		if c.IVLen != 16 {
+			t.Fail()
+		}
 		if stupidgcm.BuiltWithoutOpenssl {
 			continue
 		}
@@ -39,3 +44,29 @@ func TestNewPanic(t *testing.T) {
 	key := make([]byte, 16)
 	New(key, BackendOpenSSL, 128, true)
 }
+
+// BackendOptimized must be interchangeable with BackendGoGCM, for small
+// blocks as well as for the large ones that take the SIMD path.
+func TestOptimizedCompat(t *testing.T) {
+	key := make([]byte, 32)
+	goGCM := New(key, BackendGoGCM, 128, true).AEADCipher
+	opt := New(key, BackendOptimized, 128, true).AEADCipher
+	nonce := RandBytes(16)
+	ad := []byte("associated data")
+	for _, n := range []int{0, 100, 4096} {
+		plaintext := RandBytes(n)
+		c1 := goGCM.Seal(nil, nonce, plaintext, ad)
+		c2 := opt.Seal(nil, nonce, plaintext, ad)
+		if !bytes.Equal(c1, c2) {
+			t.Errorf("n=%d: ciphertext differs", n)
+		}
+		p, err := opt.Open(nil, nonce, c1, ad)
+		if err != nil || !bytes.Equal(p, plaintext) {
+			t.Errorf("n=%d: Open failed: %v", n, err)
+		}
+		c1[len(c1)-1]++
+		if _, err = opt.Open(nil, nonce, c1, ad); err == nil {
+			t.Errorf("n=%d: Open accepted corrupt ciphertext", n)
+		}
+	}
+}
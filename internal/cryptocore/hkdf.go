@@ -7,29 +7,27 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-const (
-	// "info" data that HKDF mixes into the generated key to make it unique.
-	// For convenience, we use a readable string.
-	hkdfInfoEMENames               = "EME filename encryption"
-	hkdfInfoGCMContent             = "AES-GCM file content encryption"
-	hkdfInfoSIVContent             = "AES-SIV file content encryption"
-	hkdfInfoXChaChaPoly1305Content = "XChaCha20-Poly1305 file content encryption"
-)
-
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
-// HKDF-SHA256 (RFC 5869).
+// HKDF-SHA256 (RFC 5869). "info" is the label that HKDF mixes into the
+// generated key to make it unique, see keySchedule.
 // It returns the derived bytes or panics.
 func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
-	h := hkdf.New(sha256.New, masterkey, nil, []byte(info))
+	return hkdfDeriveSalt(masterkey, nil, info, outLen)
+}
+
+// hkdfDeriveSalt is hkdfDerive with an HKDF salt
+func hkdfDeriveSalt(masterkey []byte, salt []byte, info string, outLen int) (out []byte) {
 	out = make([]byte, outLen)
-	n, err := h.Read(out)
-	if n != outLen || err != nil {
-		log.Panicf("hkdfDerive: hkdf read failed, got %d bytes, error: %v", n, err)
-	}
+	hkdfDeriveInto(masterkey, salt, info, out)
 	return out
 }
 
-// HKDFDerive is a public wrapper for hkdfDerive
-func HKDFDerive(masterkey []byte, info []byte, outLen int) []byte {
-	return hkdfDerive(masterkey, string(info), outLen)
+// hkdfDeriveInto is hkdfDeriveSalt writing to "out", which may be memory
+// that the caller has allocated for key material
+func hkdfDeriveInto(masterkey []byte, salt []byte, info string, out []byte) {
+	h := hkdf.New(sha256.New, masterkey, salt, []byte(info))
+	n, err := h.Read(out)
+	if n != len(out) || err != nil {
+		log.Panicf("hkdfDerive: hkdf read failed, got %d bytes, error: %v", n, err)
+	}
 }
@@ -24,13 +24,13 @@ func TestHkdfDerive(t *testing.T) {
 
 	testCases := []hkdfTestCase{
 		{master0, "EME filename encryption", out1},
-		{master0, hkdfInfoEMENames, out1},
+		{master0, label(KeyEMENames), out1},
 		{master1, "EME filename encryption", out2},
-		{master1, hkdfInfoEMENames, out2},
+		{master1, label(KeyEMENames), out2},
 		{master1, "AES-GCM file content encryption", out3},
-		{master1, hkdfInfoGCMContent, out3},
+		{master1, label(KeyGCMContent), out3},
 		{master1, "AES-SIV file content encryption", out4},
-		{master1, hkdfInfoSIVContent, out4},
+		{master1, label(KeySIVContent), out4},
 	}
 
 	for i, v := range testCases {
@@ -0,0 +1,175 @@
+package cryptocore
+
+import (
+	"fmt"
+	"log"
+)
+
+// KeyPurpose identifies a key that is derived from another key with HKDF.
+// Every purpose has its own HKDF "info" label in keySchedule, which keeps
+// the derived keys independent of each other.
+//
+// The labels are part of the on-disk format and must never change. To
+// derive a key differently, add a new purpose with the next version of the
+// label, and keep the old one for existing filesystems.
+type KeyPurpose int
+
+const (
+	// KeyEMENames encrypts file names with EME
+	KeyEMENames KeyPurpose = iota + 1
+	// KeyGCMContent encrypts file contents with AES-GCM
+	KeyGCMContent
+	// KeySIVContent encrypts file contents with AES-SIV
+	KeySIVContent
+	// KeyXChaCha20Poly1305Content encrypts file contents with
+	// XChaCha20-Poly1305
+	KeyXChaCha20Poly1305Content
+	// KeyFilenameAuth authenticates file names, directory manifests and
+	// extended attributes
+	KeyFilenameAuth
+	// KeyFeatureFlagsMAC authenticates the feature flags in gocryptfs.conf
+	KeyFeatureFlagsMAC
+	// KeyConfigHMAC signs gocryptfs.conf. Derived from the password key.
+	KeyConfigHMAC
+	// KeyDuressVerifier recognizes the duress password. Derived from the
+	// duress password key.
+	KeyDuressVerifier
+	// KeyUnlockAttempts checksums the failed unlock attempts counter.
+	// Derived from the encrypted master key, which is not secret, so the
+	// counter can be forged.
+	KeyUnlockAttempts
+	// KeyDedupChunkID names the chunks of the dedup store
+	KeyDedupChunkID
+	// KeyDedupChunkEnc encrypts the chunks of the dedup store with AES-SIV
+	KeyDedupChunkEnc
+	// KeyDedupGear is the gear table of the dedup chunker
+	KeyDedupGear
+	// KeyFingerprint is the public fingerprint of the master key, which
+	// tells filesystems apart without revealing anything about the key
+	KeyFingerprint
+	// KeyChecksumHMAC authenticates the manifests of "-export-checksums
+	// -checksum-type hmac"
+	KeyChecksumHMAC
+	// KeyFileKeyWrap encrypts the per-file data keys in version 3 file
+	// headers with AES-GCM
+	KeyFileKeyWrap
+	// KeyShareX25519 wraps the file key of a "-share -share-to" token.
+	// Derived from the X25519 shared secret, with both public keys as the
+	// salt, see DeriveKeySalt.
+	KeyShareX25519
+	// keyPurposeEnd must stay last
+	keyPurposeEnd
+)
+
+// FingerprintLen is the length of the KeyFingerprint key
+const FingerprintLen = 16
+
+// keyInput is the kind of key that a KeyPurpose is derived from
+type keyInput int
+
+const (
+	// inputMasterKey is the master key
+	inputMasterKey keyInput = iota + 1
+	// inputPasswordKey is the key that scrypt or Argon2id derive from a
+	// password
+	inputPasswordKey
+	// inputPublic is data from the config file that anybody who can read
+	// it knows
+	inputPublic
+	// inputSharedSecret is an X25519 shared secret
+	inputSharedSecret
+)
+
+// keyLabel describes how the key for a KeyPurpose is derived
+type keyLabel struct {
+	// name identifies the key in the label
+	name string
+	// version is part of the label. It starts at 1.
+	version int
+	// legacyInfo is the label of the keys that were derived before
+	// keySchedule existed. It is used instead of the versioned label.
+	legacyInfo string
+	input      keyInput
+	// length is the number of bytes to derive
+	length int
+}
+
+// info returns the HKDF "info" string
+func (l *keyLabel) info() string {
+	if l.legacyInfo != "" {
+		return l.legacyInfo
+	}
+	return fmt.Sprintf("gocryptfs key schedule: %s v%d", l.name, l.version)
+}
+
+// keySchedule lists all keys that gocryptfs derives with HKDF. Keys added
+// from now on get a name and a version, but no legacyInfo.
+var keySchedule = map[KeyPurpose]keyLabel{
+	KeyEMENames: {name: "EME names", version: 1, legacyInfo: "EME filename encryption",
+		input: inputMasterKey, length: KeyLen},
+	KeyGCMContent: {name: "AES-GCM content", version: 1, legacyInfo: "AES-GCM file content encryption",
+		input: inputMasterKey, length: KeyLen},
+	// AES-SIV uses 1/2 of the key for authentication, 1/2 for encryption
+	KeySIVContent: {name: "AES-SIV content", version: 1, legacyInfo: "AES-SIV file content encryption",
+		input: inputMasterKey, length: 2 * KeyLen},
+	KeyXChaCha20Poly1305Content: {name: "XChaCha20-Poly1305 content", version: 1,
+		legacyInfo: "XChaCha20-Poly1305 file content encryption", input: inputMasterKey, length: KeyLen},
+	KeyFilenameAuth: {name: "filename auth", version: 1, legacyInfo: "gocryptfs-filename-auth-v1",
+		input: inputMasterKey, length: 32},
+	KeyFeatureFlagsMAC: {name: "feature flags MAC", version: 1, legacyInfo: "gocryptfs.conf feature flags MAC",
+		input: inputMasterKey, length: 32},
+	KeyConfigHMAC: {name: "config HMAC", version: 1, legacyInfo: "gocryptfs.conf HMAC",
+		input: inputPasswordKey, length: 32},
+	KeyDuressVerifier: {name: "duress verifier", version: 1, legacyInfo: "gocryptfs duress password",
+		input: inputPasswordKey, length: 32},
+	KeyUnlockAttempts: {name: "unlock attempts", version: 1, legacyInfo: "gocryptfs unlock attempts",
+		input: inputPublic, length: 32},
+	KeyDedupChunkID: {name: "dedup chunk ID", version: 1, legacyInfo: "gocryptfs dedup chunk ID",
+		input: inputMasterKey, length: 32},
+	KeyDedupChunkEnc: {name: "dedup chunk encryption", version: 1, legacyInfo: "gocryptfs dedup AES-SIV chunk encryption",
+		input: inputMasterKey, length: 2 * KeyLen},
+	// 256 uint64 values
+	KeyDedupGear: {name: "dedup gear table", version: 1, legacyInfo: "gocryptfs dedup gear table",
+		input: inputMasterKey, length: 256 * 8},
+	KeyFingerprint:  {name: "master key fingerprint", version: 1, input: inputMasterKey, length: FingerprintLen},
+	KeyChecksumHMAC: {name: "checksum manifest HMAC", version: 1, input: inputMasterKey, length: 32},
+	KeyFileKeyWrap:  {name: "file key wrap", version: 1, input: inputMasterKey, length: KeyLen},
+	KeyShareX25519:  {name: "share X25519 key wrap", version: 1, input: inputSharedSecret, length: KeyLen},
+}
+
+// DeriveKey derives the key for "purpose" from "key" using HKDF-SHA256.
+// The length of the result depends on "purpose". Panics if "purpose" is
+// not in keySchedule, or if a master key has the wrong length.
+func DeriveKey(key []byte, purpose KeyPurpose) []byte {
+	return DeriveKeySalt(key, nil, purpose)
+}
+
+// DeriveKeyGuarded is DeriveKey for keys that should not sit in ordinary
+// heap memory. The key is allocated between guard pages (see
+// memprotect.AllocateKey) and must be released with
+// memprotect.MemoryProtection.WipeKey.
+func DeriveKeyGuarded(key []byte, purpose KeyPurpose) []byte {
+	l, ok := keySchedule[purpose]
+	if !ok {
+		log.Panicf("DeriveKeyGuarded: unknown key purpose %d", purpose)
+	}
+	if l.input == inputMasterKey && len(key) != KeyLen {
+		log.Panicf("DeriveKeyGuarded: %s needs a %d-byte master key, have %d bytes", l.name, KeyLen, len(key))
+	}
+	out := memProtect.AllocateKey(l.length)
+	hkdfDeriveInto(key, nil, l.info(), out)
+	return out
+}
+
+// DeriveKeySalt is DeriveKey with an HKDF salt, for keys that are bound to
+// public values, like the public keys of a key exchange.
+func DeriveKeySalt(key []byte, salt []byte, purpose KeyPurpose) []byte {
+	l, ok := keySchedule[purpose]
+	if !ok {
+		log.Panicf("DeriveKey: unknown key purpose %d", purpose)
+	}
+	if l.input == inputMasterKey && len(key) != KeyLen {
+		log.Panicf("DeriveKey: %s needs a %d-byte master key, have %d bytes", l.name, KeyLen, len(key))
+	}
+	return hkdfDeriveSalt(key, salt, l.info(), l.length)
+}
@@ -0,0 +1,135 @@
+package cryptocore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"regexp"
+	"testing"
+)
+
+// label returns the HKDF "info" string of "p"
+func label(p KeyPurpose) string {
+	l := keySchedule[p]
+	return l.info()
+}
+
+// TestKeyScheduleComplete checks that every KeyPurpose is registered
+func TestKeyScheduleComplete(t *testing.T) {
+	for p := KeyPurpose(1); p < keyPurposeEnd; p++ {
+		l, ok := keySchedule[p]
+		if !ok {
+			t.Errorf("purpose %d is not in keySchedule", p)
+			continue
+		}
+		if l.name == "" || l.version < 1 || l.length <= 0 || l.input == 0 {
+			t.Errorf("purpose %d: incomplete entry %+v", p, l)
+		}
+	}
+	if len(keySchedule) != int(keyPurposeEnd)-1 {
+		t.Errorf("keySchedule has %d entries, want %d", len(keySchedule), keyPurposeEnd-1)
+	}
+}
+
+// TestKeyScheduleUnique checks that no two purposes share a label, or a
+// name and version, so no two derived keys can be the same.
+func TestKeyScheduleUnique(t *testing.T) {
+	infos := make(map[string]KeyPurpose)
+	names := make(map[string]KeyPurpose)
+	versioned := regexp.MustCompile(`^gocryptfs key schedule: .+ v[1-9][0-9]*$`)
+	for p, l := range keySchedule {
+		info := l.info()
+		if other, ok := infos[info]; ok {
+			t.Errorf("purposes %d and %d have the same label %q", p, other, info)
+		}
+		infos[info] = p
+		// The generated labels must not collide with legacy labels either
+		generated := (&keyLabel{name: l.name, version: l.version}).info()
+		if !versioned.MatchString(generated) {
+			t.Errorf("purpose %d: invalid generated label %q", p, generated)
+		}
+		if other, ok := names[generated]; ok {
+			t.Errorf("purposes %d and %d have the same name and version %q", p, other, generated)
+		}
+		names[generated] = p
+	}
+	for info, p := range infos {
+		if other, ok := names[info]; ok && other != p {
+			t.Errorf("label %q of purpose %d collides with purpose %d", info, p, other)
+		}
+	}
+}
+
+// TestDeriveKeyVectors verifies the derived keys against fixed vectors, the
+// SHA256 of the key that is derived from a master key of 32 0x01 bytes.
+// They must not change because this would change the on-disk format.
+func TestDeriveKeyVectors(t *testing.T) {
+	vectors := map[KeyPurpose]string{
+		KeyEMENames:                 "65c3dfb95cac832ecb9602f86bda5f322d035eb5483ada8cf64b88a675368c98",
+		KeyGCMContent:               "84008082e1bec59d2f2f4499ef7746654eac84fff8b5c0b5e07c4709f0d6b4db",
+		KeySIVContent:               "bf822e6e32e942461698d3d822a516d71c9396c9b590ece50173b35e4fd9db2f",
+		KeyXChaCha20Poly1305Content: "157ca24f364e3e3ca9303bcb0d4d08d331ce5c55af3d39c4be00c6e9a830e197",
+		KeyFilenameAuth:             "de25463ec95f32c5d1e52c7f942af05a9debad86d3486f03159980e35b2ff8bd",
+		KeyFeatureFlagsMAC:          "b51a6cd3b7d06ba146f327a36c6cba1a42a6a819f53ed8c18e89e28d83550a49",
+		KeyConfigHMAC:               "ffa5d70966987f54afa3d2140b1937ecbd90f677550e4b0b919632ceddfbc4ad",
+		KeyDuressVerifier:           "bbcc55d1da93a9cd0e14122e3b8dc2de3e35ba19c3bfe9f81f0d1ebdafefba66",
+		KeyUnlockAttempts:           "7d3dfb00f0e0dcde1f800c64359328f7675a2f374c721e540f28e96227191b91",
+		KeyDedupChunkID:             "7aebf801cc52a7c5cea5c43f9ac9117c78f7f68eb17bccdd2716832559a85c7e",
+		KeyDedupChunkEnc:            "587aa7db30b9d752d05dc4aca27d38a47000ca930771e8cda584fd6434cd8386",
+		KeyDedupGear:                "821c57ab3d6321923113c925f34a727d36cb8c97fc4a83f6eff8eb0640f51268",
+		KeyFingerprint:              "110f8094a42631181a6e8b660071e8528e8eafc0f265ad29b8f9ab4dc7f4f50f",
+		KeyChecksumHMAC:             "d66ef6f5a57b53eb7fc52ca5565449536fd3130d48c15d87f3fec99f65a9ed76",
+		KeyFileKeyWrap:              "ecf116dcb9ab25f26c0c6b04291b8f12bf647a4d6589c5f13a1d504f3efaa8ee",
+		KeyShareX25519:              "b6f8cbf4b5e06aade8c6dabf2b7105413e97605a7b8cc0b34d04ada34aad00ab",
+	}
+	master1 := bytes.Repeat([]byte{0x01}, KeyLen)
+	for p := KeyPurpose(1); p < keyPurposeEnd; p++ {
+		want, ok := vectors[p]
+		if !ok {
+			t.Errorf("purpose %d: no test vector", p)
+			continue
+		}
+		key := DeriveKey(master1, p)
+		if len(key) != keySchedule[p].length {
+			t.Errorf("purpose %d: have %d bytes", p, len(key))
+		}
+		h := sha256.Sum256(key)
+		if have := hex.EncodeToString(h[:]); have != want {
+			t.Errorf("purpose %d (%q):\nwant=%s\nhave=%s", p, label(p), want, have)
+		}
+	}
+}
+
+// TestDeriveKeySaltVector verifies a key that is derived with a salt: from
+// 32 0x01 bytes, with 64 0x02 bytes (two public keys) as the salt.
+func TestDeriveKeySaltVector(t *testing.T) {
+	const want = "fe61505cc8f1fec09f13ebb91a742d65c1409be903360a66d960f364b6c3782f"
+	key := DeriveKeySalt(bytes.Repeat([]byte{0x01}, 32), bytes.Repeat([]byte{0x02}, 64), KeyShareX25519)
+	if have := hex.EncodeToString(key); have != want {
+		t.Errorf("\nwant=%s\nhave=%s", want, have)
+	}
+	if bytes.Equal(key, DeriveKey(bytes.Repeat([]byte{0x01}, 32), KeyShareX25519)) {
+		t.Error("the salt is ignored")
+	}
+}
+
+func TestDeriveKeyPanics(t *testing.T) {
+	for _, tc := range []struct {
+		key     []byte
+		purpose KeyPurpose
+	}{
+		{make([]byte, KeyLen), keyPurposeEnd},
+		{make([]byte, 16), KeyEMENames},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("purpose %d with a %d-byte key did not panic", tc.purpose, len(tc.key))
+				}
+			}()
+			DeriveKey(tc.key, tc.purpose)
+		}()
+	}
+	// Keys that are not derived from the master key can have any length
+	DeriveKey(make([]byte, 64), KeyUnlockAttempts)
+}
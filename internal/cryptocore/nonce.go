@@ -26,9 +26,24 @@ func RandUint64() uint64 {
 
 type nonceGenerator struct {
 	nonceLen int // bytes
+	// prefetcher replaces the global randPrefetcher if set.
+	// See CryptoCore.UseAdaptivePrefetcher.
+	prefetcher *AdaptivePrefetcher
 }
 
 // Get a random "nonceLen"-byte nonce
 func (n *nonceGenerator) Get() []byte {
-	return randPrefetcher.read(n.nonceLen)
+	out := make([]byte, n.nonceLen)
+	n.Fill(out)
+	return out
+}
+
+// Fill fills "dst" with random nonces. len(dst) should be a multiple of
+// "nonceLen". Saves the allocation that Get does for each nonce.
+func (n *nonceGenerator) Fill(dst []byte) {
+	if n.prefetcher != nil {
+		n.prefetcher.ReadInto(dst)
+		return
+	}
+	randPrefetcher.readInto(dst)
 }
@@ -5,44 +5,44 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"runtime"
-	"sync"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
-// OptimizedBackend provides high-performance crypto operations
+// OptimizedBackend is an AES-256-GCM cipher.AEAD that picks the
+// implementation by block size and CPU features, and can process batches of
+// blocks. It produces the same ciphertext as BackendGoGCM, so a filesystem
+// can be mounted with either. Selected by "-cipher optimized".
 type OptimizedBackend struct {
 	// Core crypto components
 	block     cipher.Block
 	gcm       cipher.AEAD
 	simdGCM   *SIMDOptimizedGCM
 	batchProc *BatchProcessor
-	memPool   *MemoryPool
 
 	// Performance optimizations
 	hasAVX2  bool
 	hasAESNI bool
 	cpuCount int
-
-	// Thread-safe pools for different buffer sizes
-	smallPool  sync.Pool // 4KB buffers
-	mediumPool sync.Pool // 16KB buffers
-	largePool  sync.Pool // 64KB+ buffers
 }
 
-// NewOptimizedBackend creates a new optimized crypto backend
-func NewOptimizedBackend(key []byte) (*OptimizedBackend, error) {
+var _ cipher.AEAD = &OptimizedBackend{} // Verify that interface is implemented.
+
+// NewOptimizedBackend creates a new optimized crypto backend with
+// "nonceSize"-byte nonces
+func NewOptimizedBackend(key []byte, nonceSize int) (*OptimizedBackend, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := cipher.NewGCMWithNonceSize(block, nonceSize)
 	if err != nil {
 		return nil, err
 	}
 
-	simdGCM, err := NewSIMDOptimizedGCM(key)
+	simdGCM, err := NewSIMDOptimizedGCM(key, nonceSize)
 	if err != nil {
 		return nil, err
 	}
@@ -54,75 +54,17 @@ func NewOptimizedBackend(key []byte) (*OptimizedBackend, error) {
 		cpuCount: runtime.NumCPU(),
 		hasAVX2:  detectAVX2(),
 		hasAESNI: detectAESNI(),
-		memPool:  NewMemoryPool(),
 	}
 
 	// Initialize batch processor
 	ob.batchProc = NewBatchProcessor(ob.simdGCM)
 
-	// Initialize memory pools
-	ob.initializePools()
-
 	tlog.Debug.Printf("OptimizedBackend: CPUs=%d, AVX2=%v, AESNI=%v",
 		ob.cpuCount, ob.hasAVX2, ob.hasAESNI)
 
 	return ob, nil
 }
 
-// initializePools sets up memory pools for different buffer sizes
-func (ob *OptimizedBackend) initializePools() {
-	// Small pool for 4KB blocks
-	ob.smallPool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 0, 4096)
-		},
-	}
-
-	// Medium pool for 16KB buffers
-	ob.mediumPool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 0, 16384)
-		},
-	}
-
-	// Large pool for 64KB+ buffers
-	ob.largePool = sync.Pool{
-		New: func() interface{} {
-			return make([]byte, 0, 65536)
-		},
-	}
-}
-
-// GetBuffer returns an appropriately sized buffer from the pool
-func (ob *OptimizedBackend) GetBuffer(size int) []byte {
-	if size <= 4096 {
-		buf := ob.smallPool.Get().([]byte)
-		return buf[:0]
-	} else if size <= 16384 {
-		buf := ob.mediumPool.Get().([]byte)
-		return buf[:0]
-	} else {
-		buf := ob.largePool.Get().([]byte)
-		return buf[:0]
-	}
-}
-
-// PutBuffer returns a buffer to the appropriate pool
-func (ob *OptimizedBackend) PutBuffer(buf []byte) {
-	if buf == nil {
-		return
-	}
-
-	capacity := cap(buf)
-	if capacity <= 4096 {
-		ob.smallPool.Put(buf)
-	} else if capacity <= 16384 {
-		ob.mediumPool.Put(buf)
-	} else {
-		ob.largePool.Put(buf)
-	}
-}
-
 // NonceSize returns the nonce size
 func (ob *OptimizedBackend) NonceSize() int {
 	return ob.gcm.NonceSize()
@@ -140,15 +82,6 @@ func (ob *OptimizedBackend) Seal(dst, nonce, plaintext, additionalData []byte) [
 		// Use SIMD-optimized path for large blocks
 		return ob.simdGCM.Seal(dst, nonce, plaintext, additionalData)
 	}
-
-	// Use standard GCM for smaller blocks
-	// Handle nonce size conversion if needed
-	if len(nonce) == 16 && ob.gcm.NonceSize() == 12 {
-		// Convert 16-byte nonce to 12-byte for standard GCM
-		nonce12 := nonce[:12]
-		return ob.gcm.Seal(dst, nonce12, plaintext, additionalData)
-	}
-
 	return ob.gcm.Seal(dst, nonce, plaintext, additionalData)
 }
 
@@ -159,15 +92,6 @@ func (ob *OptimizedBackend) Open(dst, nonce, ciphertext, additionalData []byte)
 		// Use SIMD-optimized path for large blocks
 		return ob.simdGCM.Open(dst, nonce, ciphertext, additionalData)
 	}
-
-	// Use standard GCM for smaller blocks
-	// Handle nonce size conversion if needed
-	if len(nonce) == 16 && ob.gcm.NonceSize() == 12 {
-		// Convert 16-byte nonce to 12-byte for standard GCM
-		nonce12 := nonce[:12]
-		return ob.gcm.Open(dst, nonce12, ciphertext, additionalData)
-	}
-
 	return ob.gcm.Open(dst, nonce, ciphertext, additionalData)
 }
 
@@ -222,20 +146,14 @@ func (ob *OptimizedBackend) GetOptimalWorkerCount(blockCount int) int {
 	return workers
 }
 
-// GetPerformanceStats returns performance statistics
-func (ob *OptimizedBackend) GetPerformanceStats() map[string]interface{} {
-	stats := make(map[string]interface{})
-	stats["cpu_count"] = ob.cpuCount
-	stats["has_avx2"] = ob.hasAVX2
-	stats["has_aesni"] = ob.hasAESNI
-	stats["nonce_size"] = ob.NonceSize()
-	stats["overhead"] = ob.Overhead()
-
-	// Example optimal worker count
-	stats["optimal_workers_100_blocks"] = ob.GetOptimalWorkerCount(100)
-	stats["optimal_workers_1000_blocks"] = ob.GetOptimalWorkerCount(1000)
-
-	return stats
+// RegisterStats registers the CPU features the backend uses in "r".
+func (ob *OptimizedBackend) RegisterStats(r *stats.Registry) {
+	r.Func("optimized_cpu_count", stats.KindGauge, "Number of CPUs",
+		func() int64 { return int64(ob.cpuCount) })
+	r.Func("optimized_has_avx2", stats.KindGauge, "CPU supports AVX2",
+		func() int64 { return stats.Bool(ob.hasAVX2) })
+	r.Func("optimized_has_aesni", stats.KindGauge, "CPU supports AES-NI",
+		func() int64 { return stats.Bool(ob.hasAESNI) })
 }
 
 // Wipe securely clears sensitive data
@@ -251,5 +169,4 @@ func (ob *OptimizedBackend) Wipe() {
 	ob.gcm = nil
 	ob.simdGCM = nil
 	ob.batchProc = nil
-	ob.memPool = nil
 }
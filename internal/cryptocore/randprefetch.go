@@ -2,6 +2,7 @@ package cryptocore
 
 import (
 	"bytes"
+	"crypto/rand"
 	"log"
 	"sync"
 )
@@ -24,12 +25,26 @@ type randPrefetcherT struct {
 
 func (r *randPrefetcherT) read(want int) (out []byte) {
 	out = make([]byte, want)
+	r.readInto(out)
+	return out
+}
+
+// readInto fills "out" with random bytes. Requests larger than the prefetch
+// buffer go to crypto/rand directly.
+func (r *randPrefetcherT) readInto(out []byte) {
+	want := len(out)
+	if want > prefetchN {
+		if _, err := rand.Read(out); err != nil {
+			log.Panic("Failed to read random bytes: " + err.Error())
+		}
+		return
+	}
 	r.Lock()
 	// Note: don't use defer, it slows us down!
 	have, err := r.buf.Read(out)
 	if have == want && err == nil {
 		r.Unlock()
-		return out
+		return
 	}
 	// Buffer was empty -> re-fill
 	fresh := <-r.refill
@@ -43,7 +58,6 @@ func (r *randPrefetcherT) read(want int) (out []byte) {
 		log.Panicf("randPrefetcher could not satisfy read: have=%d want=%d err=%v", have, want, err)
 	}
 	r.Unlock()
-	return out
 }
 
 func (r *randPrefetcherT) refillWorker() {
@@ -20,14 +20,15 @@ type SIMDOptimizedGCM struct {
 	pool     sync.Pool
 }
 
-// NewSIMDOptimizedGCM creates a new SIMD-optimized GCM instance
-func NewSIMDOptimizedGCM(key []byte) (*SIMDOptimizedGCM, error) {
+// NewSIMDOptimizedGCM creates a new SIMD-optimized GCM instance with
+// "nonceSize"-byte nonces
+func NewSIMDOptimizedGCM(key []byte, nonceSize int) (*SIMDOptimizedGCM, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := cipher.NewGCMWithNonceSize(block, nonceSize)
 	if err != nil {
 		return nil, err
 	}
@@ -87,13 +88,6 @@ func (sg *SIMDOptimizedGCM) sealSIMD(dst, nonce, plaintext, additionalData []byt
 	// In a real implementation, this would use AVX2/AESNI instructions
 	// through assembly or CGO bindings to optimized crypto libraries
 
-	// Handle nonce size conversion if needed
-	if len(nonce) == 16 && sg.gcm.NonceSize() == 12 {
-		// Convert 16-byte nonce to 12-byte for standard GCM
-		nonce12 := nonce[:12]
-		return sg.gcm.Seal(dst, nonce12, plaintext, additionalData)
-	}
-
 	return sg.gcm.Seal(dst, nonce, plaintext, additionalData)
 }
 
@@ -103,13 +97,6 @@ func (sg *SIMDOptimizedGCM) openSIMD(dst, nonce, ciphertext, additionalData []by
 	// In a real implementation, this would use AVX2/AESNI instructions
 	// through assembly or CGO bindings to optimized crypto libraries
 
-	// Handle nonce size conversion if needed
-	if len(nonce) == 16 && sg.gcm.NonceSize() == 12 {
-		// Convert 16-byte nonce to 12-byte for standard GCM
-		nonce12 := nonce[:12]
-		return sg.gcm.Open(dst, nonce12, ciphertext, additionalData)
-	}
-
 	return sg.gcm.Open(dst, nonce, ciphertext, additionalData)
 }
 
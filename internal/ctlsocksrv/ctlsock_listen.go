@@ -2,10 +2,12 @@ package ctlsocksrv
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"syscall"
 	"time"
 
@@ -39,7 +41,17 @@ func cleanupOrphanedSocket(path string) {
 	}
 }
 
+// Listen creates the control socket at "path". Paths that start with "@"
+// are Linux abstract socket addresses.
 func Listen(path string) (net.Listener, error) {
+	if IsAbstract(path) {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("%s: abstract sockets are only supported on Linux", path)
+		}
+		// No socket file, so there is nothing to clean up or chmod.
+		// The peer credential check keeps other users out.
+		return net.Listen("unix", path)
+	}
 	cleanupOrphanedSocket(path)
 
 	// Create parent directory with secure permissions (0700) if it doesn't exist
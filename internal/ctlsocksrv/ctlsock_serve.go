@@ -9,11 +9,12 @@ import (
 	"io"
 	"net"
 	"os"
-	"sync"
 	"syscall"
 	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -23,58 +24,60 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
-type ctlSockHandler struct {
-	fs     Interface
-	socket *net.UnixListener
-	// Rate limiting
-	rateLimiter map[string]*rateLimitEntry
-	rateMutex   sync.RWMutex
+// TrashInterface is implemented by fusefrontend to serve the TrashList and
+// TrashRestore requests
+type TrashInterface interface {
+	TrashList() ([]ctlsock.TrashEntry, error)
+	TrashRestore(string) (string, error)
 }
 
-type rateLimitEntry struct {
-	lastRequest  time.Time
-	requestCount int
+// NameLimitsInterface is implemented by fusefrontend to serve the
+// NameLimits request
+type NameLimitsInterface interface {
+	NameLimits() (ctlsock.NameLimits, error)
 }
 
-// Rate limiting constants
-const (
-	maxRequestsPerMinute = 60
-	rateLimitWindow      = time.Minute
-	connectionTimeout    = 30 * time.Second
-	readTimeout          = 5 * time.Second
-)
+// CryptoConfigInterface is implemented by fusefrontend[_reverse] to serve
+// the CryptoConfig request
+type CryptoConfigInterface interface {
+	ParallelCrypto() *parallelcrypto.ParallelCrypto
+}
 
-// Serve serves incoming connections on "sock". This call blocks so you
-// probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
-	handler := ctlSockHandler{
-		fs:          fs,
-		socket:      sock.(*net.UnixListener),
-		rateLimiter: make(map[string]*rateLimitEntry),
-	}
-	handler.acceptLoop()
+// FeaturesInterface is implemented by fusefrontend[_reverse] to report the
+// ctlsock.Feature* constants that apply to the mount in the Handshake
+// response
+type FeaturesInterface interface {
+	CtlsockFeatures() []string
 }
 
-func (ch *ctlSockHandler) acceptLoop() {
-	for {
-		conn, err := ch.socket.Accept()
-		if err != nil {
-			// This can trigger on program exit with "use of closed network connection".
-			// Special-casing this is hard due to https://github.com/golang/go/issues/4373
-			// so just don't use tlog.Warn to not cause panics in the tests.
-			tlog.Info.Printf("ctlsock: Accept error: %v", err)
-			break
-		}
-		go ch.handleConnection(conn.(*net.UnixConn))
-	}
+// ScrubInterface is implemented by fusefrontend to serve the Scrub request.
+// ScrubStatus fails with ENOTSUP without "-scrub".
+type ScrubInterface interface {
+	ScrubStatus() (ctlsock.ScrubStatus, error)
+}
+
+// ShredInterface is implemented by fusefrontend to serve the Shred request.
+// Shred fails with ENOTSUP without version 3 file headers.
+type ShredInterface interface {
+	Shred(string) error
+}
+
+type ctlSockHandler struct {
+	fs Interface
+	// daemon is set instead of "fs" for "-daemon"
+	daemon      DaemonInterface
+	rateLimiter *rateLimiter
+	// requestTimeout is Options.RequestTimeout
+	requestTimeout time.Duration
 }
 
-// checkPeerCredentials verifies that the connecting peer has the same UID as the server
-func (ch *ctlSockHandler) checkPeerCredentials(conn *net.UnixConn) error {
+// checkPeerCredentials verifies that the connecting peer has the same UID as
+// the server, and returns its credentials
+func (ch *ctlSockHandler) checkPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
 	// Get peer credentials
 	cred, err := getPeerCredentials(conn)
 	if err != nil {
-		return fmt.Errorf("failed to get peer credentials: %v", err)
+		return nil, fmt.Errorf("failed to get peer credentials: %v", err)
 	}
 
 	// Get our own UID
@@ -82,50 +85,13 @@ func (ch *ctlSockHandler) checkPeerCredentials(conn *net.UnixConn) error {
 
 	// Check if UIDs match
 	if cred.UID != ourUID {
-		return fmt.Errorf("peer UID %d does not match server UID %d", cred.UID, ourUID)
-	}
-
-	return nil
-}
-
-// checkRateLimit verifies that the client is not exceeding rate limits
-func (ch *ctlSockHandler) checkRateLimit(clientID string) error {
-	ch.rateMutex.Lock()
-	defer ch.rateMutex.Unlock()
-
-	now := time.Now()
-	entry, exists := ch.rateLimiter[clientID]
-
-	if !exists {
-		// First request from this client
-		ch.rateLimiter[clientID] = &rateLimitEntry{
-			lastRequest:  now,
-			requestCount: 1,
-		}
-		return nil
-	}
-
-	// Check if we're still within the rate limit window
-	if now.Sub(entry.lastRequest) > rateLimitWindow {
-		// Reset the counter
-		entry.lastRequest = now
-		entry.requestCount = 1
-		return nil
-	}
-
-	// Check if we've exceeded the rate limit
-	if entry.requestCount >= maxRequestsPerMinute {
-		return fmt.Errorf("rate limit exceeded: %d requests per minute", maxRequestsPerMinute)
+		return nil, fmt.Errorf("peer UID %d does not match server UID %d", cred.UID, ourUID)
 	}
 
-	// Increment the counter
-	entry.requestCount++
-	entry.lastRequest = now
-
-	return nil
+	return cred, nil
 }
 
-// ReadBufSize is the size of the request read buffer.
+// ReadBufSize is the maximum size of a request.
 // The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
 // 5000 bytes should be enough to hold the whole JSON request. This
 // assumes that the path does not contain too many characters that had to be
@@ -133,63 +99,77 @@ func (ch *ctlSockHandler) checkRateLimit(clientID string) error {
 // We abort the connection if the request is bigger than this.
 const ReadBufSize = 5000
 
-// handleConnection reads and parses JSON requests from "conn"
-func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
-	defer conn.Close()
+var errRequestTooBig = errors.New("request too big")
 
-	// Set connection timeout
-	conn.SetDeadline(time.Now().Add(connectionTimeout))
+// requestReader limits how much the JSON decoder can read from the
+// connection for one request
+type requestReader struct {
+	r    io.Reader
+	left int
+}
 
-	// Check peer credentials (same UID requirement)
-	if err := ch.checkPeerCredentials(conn); err != nil {
-		tlog.Warn.Printf("ctlsock: peer credential check failed: %v", err)
-		return
+func (rr *requestReader) Read(p []byte) (int, error) {
+	if rr.left <= 0 {
+		return 0, errRequestTooBig
 	}
-
-	// Get client identifier for rate limiting
-	clientID := getClientIdentifier(conn)
-
-	buf := make([]byte, ReadBufSize)
-	for {
-		// Set read timeout for each request
-		conn.SetReadDeadline(time.Now().Add(readTimeout))
-
-		n, err := conn.Read(buf)
-		if err == io.EOF {
-			return
-		} else if err != nil {
-			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
-			return
-		}
-		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
-			return
-		}
-
-		// Check rate limit
-		if err := ch.checkRateLimit(clientID); err != nil {
-			tlog.Warn.Printf("ctlsock: rate limit exceeded for client %s: %v", clientID, err)
-			sendResponse(conn, err, "", "")
-			return
-		}
-
-		data := buf[:n]
-		var in ctlsock.RequestStruct
-		err = json.Unmarshal(data, &in)
-		if err != nil {
-			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
-			err = errors.New("JSON Unmarshal error: " + err.Error())
-			sendResponse(conn, err, "", "")
-			continue
-		}
-		ch.handleRequest(&in, conn)
+	if len(p) > rr.left {
+		p = p[:rr.left]
 	}
+	n, err := rr.r.Read(p)
+	rr.left -= n
+	return n, err
 }
 
 // handleRequest handles an already-unmarshaled JSON request
 func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
+	if in.LogLevels != nil {
+		// Logging is process-wide, also with "-daemon"
+		ch.handleLogLevelsRequest(in, conn)
+		return
+	}
+	if in.Profile != nil {
+		ch.handleProfileRequest(in, conn)
+		return
+	}
+	if ch.daemon != nil {
+		ch.handleDaemonRequest(in, conn)
+		return
+	}
+	if isVaultRequest(in) || in.Password != "" {
+		// Only "-daemon" manages vaults
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	if in.Handshake {
+		ch.handleHandshakeRequest(in, conn)
+		return
+	}
+	if in.TrashList || in.TrashRestore != "" {
+		ch.handleTrashRequest(in, conn)
+		return
+	}
+	if in.Metrics {
+		ch.handleMetricsRequest(in, conn)
+		return
+	}
+	if in.NameLimits {
+		ch.handleNameLimitsRequest(in, conn)
+		return
+	}
+	if in.Scrub {
+		ch.handleScrubRequest(in, conn)
+		return
+	}
+	if in.CryptoConfig != nil {
+		ch.handleCryptoConfigRequest(in, conn)
+		return
+	}
+	if in.Shred != "" {
+		ch.handleShredRequest(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
 		err = errors.New("Ambiguous")
@@ -228,12 +208,206 @@ func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.Uni
 	sendResponse(conn, err, outPath, warnText)
 }
 
+// handleTrashRequest handles the TrashList and TrashRestore requests
+func (ch *ctlSockHandler) handleTrashRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" || (in.TrashList && in.TrashRestore != "") {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	t, ok := ch.fs.(TrashInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	if in.TrashList {
+		list, err := t.TrashList()
+		sendResponseStruct(conn, err, ctlsock.ResponseStruct{Trash: list})
+		return
+	}
+	var warnText string
+	clean := SanitizePath(in.TrashRestore)
+	if clean != in.TrashRestore {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in.TrashRestore, clean)
+	}
+	restored, err := t.TrashRestore(clean)
+	sendResponse(conn, err, restored, warnText)
+}
+
+// handleHandshakeRequest handles the Handshake request
+func (ch *ctlSockHandler) handleHandshakeRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	h := &ctlsock.Handshake{
+		ProtocolVersion: ctlsock.ProtocolVersion,
+		Verbs:           []string{"Handshake", "EncryptPath", "DecryptPath", "Metrics", "LogLevels", "Profile"},
+	}
+	if f, ok := ch.fs.(FeaturesInterface); ok {
+		h.Features = f.CtlsockFeatures()
+	}
+	// TrashList and TrashRestore fail with ENOTSUP without "-trash"
+	if _, ok := ch.fs.(TrashInterface); ok && h.HasFeature(ctlsock.FeatureTrash) {
+		h.Verbs = append(h.Verbs, "TrashList", "TrashRestore")
+	}
+	if _, ok := ch.fs.(NameLimitsInterface); ok {
+		h.Verbs = append(h.Verbs, "NameLimits")
+	}
+	// Scrub fails with ENOTSUP without "-scrub"
+	if _, ok := ch.fs.(ScrubInterface); ok && h.HasFeature(ctlsock.FeatureScrub) {
+		h.Verbs = append(h.Verbs, "Scrub")
+	}
+	if _, ok := ch.fs.(CryptoConfigInterface); ok {
+		h.Verbs = append(h.Verbs, "CryptoConfig")
+	}
+	// Shred fails with ENOTSUP without version 3 file headers
+	if _, ok := ch.fs.(ShredInterface); ok && h.HasFeature(ctlsock.FeatureShred) {
+		h.Verbs = append(h.Verbs, "Shred")
+	}
+	sendResponseStruct(conn, nil, ctlsock.ResponseStruct{Handshake: h})
+}
+
+// handleMetricsRequest handles the Metrics request by returning the
+// variables in stats.Default
+func (ch *ctlSockHandler) handleMetricsRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	sendResponseStruct(conn, nil, ctlsock.ResponseStruct{Metrics: stats.Default.Map()})
+}
+
+// handleLogLevelsRequest handles the LogLevels request
+func (ch *ctlSockHandler) handleLogLevelsRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" || in.Vault != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	if len(in.LogLevels.Levels) > 0 {
+		if err := tlog.SetLevels(in.LogLevels.Levels); err != nil {
+			sendResponse(conn, err, "", "")
+			return
+		}
+		tlog.Info.Printf("ctlsock: log levels: %s", tlog.FormatLevels(tlog.Levels()))
+	}
+	sendResponseStruct(conn, nil, ctlsock.ResponseStruct{LogLevels: &ctlsock.LogLevels{Levels: tlog.Levels()}})
+}
+
+// handleNameLimitsRequest handles the NameLimits request
+func (ch *ctlSockHandler) handleNameLimitsRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	n, ok := ch.fs.(NameLimitsInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	limits, err := n.NameLimits()
+	sendResponseStruct(conn, err, ctlsock.ResponseStruct{NameLimits: &limits})
+}
+
+// handleScrubRequest handles the Scrub request
+func (ch *ctlSockHandler) handleScrubRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	sc, ok := ch.fs.(ScrubInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	st, err := sc.ScrubStatus()
+	if err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	sendResponseStruct(conn, nil, ctlsock.ResponseStruct{Scrub: &st})
+}
+
+// handleShredRequest handles the Shred request
+func (ch *ctlSockHandler) handleShredRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	s, ok := ch.fs.(ShredInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	var warnText string
+	clean := SanitizePath(in.Shred)
+	if clean != in.Shred {
+		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in.Shred, clean)
+	}
+	if clean == "" {
+		sendResponse(conn, errors.New("empty input after canonicalization"), "", warnText)
+		return
+	}
+	err := s.Shred(clean)
+	if err != nil {
+		sendResponse(conn, err, "", warnText)
+		return
+	}
+	sendResponse(conn, nil, clean, warnText)
+}
+
+// handleCryptoConfigRequest handles the CryptoConfig request
+func (ch *ctlSockHandler) handleCryptoConfigRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	c, ok := ch.fs.(CryptoConfigInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	pc := c.ParallelCrypto()
+	req := in.CryptoConfig
+	if (req.Workers != nil && *req.Workers < 0) || (req.ParallelThreshold != nil && *req.ParallelThreshold < 0) {
+		sendResponse(conn, syscall.EINVAL, "", "")
+		return
+	}
+	if req.Workers != nil {
+		pc.SetWorkers(*req.Workers)
+	}
+	if req.ParallelThreshold != nil {
+		pc.SetThreshold(*req.ParallelThreshold)
+	}
+	if req.Parallel != nil {
+		if *req.Parallel {
+			pc.Enable()
+		} else {
+			pc.Disable()
+		}
+	}
+	if req.Workers != nil || req.ParallelThreshold != nil || req.Parallel != nil {
+		tlog.Info.Printf("ctlsock: parallel crypto: enabled=%v workers=%d threshold=%d",
+			pc.IsEnabled(), pc.Workers(), pc.Threshold())
+	}
+	workers, threshold, parallel := pc.Workers(), pc.Threshold(), pc.IsEnabled()
+	sendResponseStruct(conn, nil, ctlsock.ResponseStruct{CryptoConfig: &ctlsock.CryptoConfig{
+		Workers:           &workers,
+		ParallelThreshold: &threshold,
+		Parallel:          &parallel,
+	}})
+}
+
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
-	msg := ctlsock.ResponseStruct{
+	sendResponseStruct(conn, err, ctlsock.ResponseStruct{
 		Result:   result,
 		WarnText: warnText,
-	}
+	})
+}
+
+// sendResponseStruct sends "msg" after filling in the error fields from
+// "err"
+func sendResponseStruct(conn *net.UnixConn, err error, msg ctlsock.ResponseStruct) {
 	if err != nil {
 		msg.ErrText = err.Error()
 		msg.ErrNo = -1
@@ -242,8 +416,8 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
 			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		} else if se, ok := err.(syscall.Errno); ok {
+			msg.ErrNo = int32(se)
 		}
 	}
 	jsonMsg, err := json.Marshal(msg)
@@ -270,14 +444,3 @@ type PeerCredentials struct {
 // - peer_credentials_linux.go for Linux
 // - peer_credentials_darwin.go for macOS
 // - peer_credentials_other.go for other platforms
-
-// getClientIdentifier returns a unique identifier for the client connection
-func getClientIdentifier(conn *net.UnixConn) string {
-	// Use the remote address as a simple client identifier
-	// In a more sophisticated implementation, you might use peer credentials
-	remoteAddr := conn.RemoteAddr()
-	if remoteAddr != nil {
-		return remoteAddr.String()
-	}
-	return "unknown"
-}
@@ -0,0 +1,86 @@
+package ctlsocksrv
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// TestPipelining sends several requests in one write. Each gets its
+// response, in order.
+func TestPipelining(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go Serve(sock, &testFS{})
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte(`{"EncryptPath":"a"}{"DecryptPath":"b"}` + "\n" + `{"Handshake":true}`)); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(conn)
+	for _, want := range []string{"a", "b", ""} {
+		var resp ctlsock.ResponseStruct
+		if err = dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Result != want || resp.ErrNo != 0 {
+			t.Errorf("have %+v, want Result=%q", resp, want)
+		}
+	}
+
+	// Requests that are too big close the connection
+	if _, err = conn.Write([]byte(`{"EncryptPath":"` + strings.Repeat("x", ReadBufSize) + `"}`)); err != nil {
+		t.Fatal(err)
+	}
+	var resp ctlsock.ResponseStruct
+	if err = dec.Decode(&resp); err == nil {
+		t.Errorf("have response %+v", resp)
+	}
+}
+
+// TestLogLevels changes the level of a subsystem and resets it
+func TestLogLevels(t *testing.T) {
+	_, sockPath := startServer(t, &testFS{}, Options{})
+	c, err := ctlsock.Connect(context.Background(), sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	defer tlog.SetLevels(map[string]string{"fusefrontend": ""})
+	levels, err := c.LogLevels(context.Background(), map[string]string{"fusefrontend": "debug"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if levels["fusefrontend"] != "debug" || levels[tlog.DefaultSubsystem] == "" {
+		t.Errorf("have %v", levels)
+	}
+	// Invalid levels are rejected and change nothing
+	if _, err = c.LogLevels(context.Background(), map[string]string{"fusefrontend": "loud"}); err == nil {
+		t.Error("invalid level should fail")
+	}
+	levels, err = c.LogLevels(context.Background(), map[string]string{"fusefrontend": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := levels["fusefrontend"]; ok {
+		t.Errorf("have %v", levels)
+	}
+	// A LogLevels request cannot be combined with another request
+	_, err = c.Do(context.Background(), &ctlsock.RequestStruct{LogLevels: &ctlsock.LogLevels{}, EncryptPath: "foo"})
+	if err == nil {
+		t.Error("ambiguous request should fail")
+	}
+}
@@ -0,0 +1,103 @@
+package ctlsocksrv
+
+import (
+	"errors"
+	"net"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// DaemonInterface is implemented by the mount manager of "-daemon"
+type DaemonInterface interface {
+	VaultList() []ctlsock.VaultStatus
+	VaultStatus(name string) (ctlsock.VaultStatus, error)
+	// VaultMount mounts vault "name". "password" is nil if the request
+	// did not contain one.
+	VaultMount(name string, password []byte) error
+	// VaultUnmount unmounts vault "name". With "lazy", a busy vault is
+	// unmounted as well.
+	VaultUnmount(name string, lazy bool) error
+	// VaultPasswd changes the password of vault "name"
+	VaultPasswd(name string, oldPassword, newPassword []byte) error
+	// VaultFS returns the root node of vault "name", which must be mounted
+	VaultFS(name string) (Interface, error)
+}
+
+// NewDaemonServer is NewServer for "-daemon". The vault requests go to
+// "d", all other requests to the vault named in RequestStruct.Vault.
+func NewDaemonServer(sock net.Listener, d DaemonInterface, opts Options) *Server {
+	return newServer(sock, nil, d, opts)
+}
+
+// ServeDaemon is Serve for "-daemon".
+func ServeDaemon(sock net.Listener, d DaemonInterface) {
+	NewDaemonServer(sock, d, Options{}).Serve()
+}
+
+// isVaultRequest returns true if "in" is meant for "-daemon"
+func isVaultRequest(in *ctlsock.RequestStruct) bool {
+	return in.Vault != "" || in.VaultList || in.VaultStatus != "" || in.VaultMount != "" ||
+		in.VaultUnmount != "" || in.VaultLock != "" || in.VaultPasswd != "" || in.NewPassword != ""
+}
+
+// handleDaemonRequest handles a request on the control socket of "-daemon"
+func (ch *ctlSockHandler) handleDaemonRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	n := 0
+	for _, set := range []bool{in.Vault != "", in.VaultList, in.VaultStatus != "", in.VaultMount != "",
+		in.VaultUnmount != "", in.VaultLock != "", in.VaultPasswd != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 || (in.Password != "" && in.VaultMount == "" && in.VaultPasswd == "") ||
+		(in.NewPassword != "" && in.VaultPasswd == "") {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	switch {
+	case in.VaultList:
+		sendResponseStruct(conn, nil, ctlsock.ResponseStruct{Vaults: ch.daemon.VaultList()})
+	case in.VaultStatus != "":
+		st, err := ch.daemon.VaultStatus(in.VaultStatus)
+		msg := ctlsock.ResponseStruct{}
+		if err == nil {
+			msg.Vaults = []ctlsock.VaultStatus{st}
+		}
+		sendResponseStruct(conn, err, msg)
+	case in.VaultMount != "":
+		var pw []byte
+		if in.Password != "" {
+			pw = []byte(in.Password)
+		}
+		sendResponse(conn, ch.daemon.VaultMount(in.VaultMount, pw), "", "")
+	case in.VaultUnmount != "":
+		sendResponse(conn, ch.daemon.VaultUnmount(in.VaultUnmount, false), "", "")
+	case in.VaultLock != "":
+		sendResponse(conn, ch.daemon.VaultUnmount(in.VaultLock, true), "", "")
+	case in.VaultPasswd != "":
+		if in.Password == "" || in.NewPassword == "" {
+			sendResponse(conn, errors.New("VaultPasswd needs Password and NewPassword"), "", "")
+			return
+		}
+		sendResponse(conn, ch.daemon.VaultPasswd(in.VaultPasswd, []byte(in.Password), []byte(in.NewPassword)), "", "")
+	case in.Vault != "":
+		fs, err := ch.daemon.VaultFS(in.Vault)
+		if err != nil {
+			sendResponse(conn, err, "", "")
+			return
+		}
+		vh := ctlSockHandler{fs: fs}
+		sub := *in
+		sub.Vault = ""
+		vh.handleRequest(&sub, conn)
+	case in.Handshake:
+		sendResponseStruct(conn, nil, ctlsock.ResponseStruct{Handshake: &ctlsock.Handshake{
+			ProtocolVersion: ctlsock.ProtocolVersion,
+			Verbs: []string{"Handshake", "LogLevels", "Profile", "Vault", "VaultList", "VaultStatus", "VaultMount", "Password",
+				"VaultUnmount", "VaultLock", "VaultPasswd", "NewPassword"},
+			Features: []string{ctlsock.FeatureDaemon},
+		}})
+	default:
+		sendResponse(conn, errors.New("no vault given, set \"Vault\""), "", "")
+	}
+}
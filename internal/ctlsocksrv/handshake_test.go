@@ -0,0 +1,77 @@
+package ctlsocksrv
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+type testFS struct {
+	features []string
+}
+
+func (fs *testFS) EncryptPath(p string) (string, error) { return p, nil }
+func (fs *testFS) DecryptPath(p string) (string, error) { return p, nil }
+func (fs *testFS) CtlsockFeatures() []string            { return fs.features }
+
+func (fs *testFS) TrashList() ([]ctlsock.TrashEntry, error) { return nil, nil }
+func (fs *testFS) TrashRestore(string) (string, error)      { return "", nil }
+
+func (fs *testFS) Shred(string) error { return nil }
+
+func (fs *testFS) ScrubStatus() (ctlsock.ScrubStatus, error) {
+	return ctlsock.ScrubStatus{State: ctlsock.ScrubWaiting}, nil
+}
+
+func handshake(t *testing.T, fs Interface) *ctlsock.Handshake {
+	sockPath := filepath.Join(t.TempDir(), "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+	go Serve(sock, fs)
+	c, err := ctlsock.Connect(context.Background(), sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	h, err := c.Handshake(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestHandshake(t *testing.T) {
+	h := handshake(t, &testFS{})
+	if h.ProtocolVersion != ctlsock.ProtocolVersion {
+		t.Errorf("ProtocolVersion=%d", h.ProtocolVersion)
+	}
+	want := []string{"Handshake", "EncryptPath", "DecryptPath", "Metrics", "LogLevels", "Profile"}
+	if !reflect.DeepEqual(h.Verbs, want) || len(h.Features) != 0 {
+		t.Errorf("have %+v", h)
+	}
+	// The trash requests are only listed with "-trash"
+	h = handshake(t, &testFS{features: []string{ctlsock.FeatureTrash}})
+	if !h.Supports("TrashList") || !h.Supports("TrashRestore") || !h.HasFeature(ctlsock.FeatureTrash) {
+		t.Errorf("have %+v", h)
+	}
+	if h.Supports("NameLimits") || h.Supports("Scrub") || h.HasFeature(ctlsock.FeatureDaemon) {
+		t.Errorf("have %+v", h)
+	}
+	// Same for Scrub and "-scrub"
+	h = handshake(t, &testFS{features: []string{ctlsock.FeatureScrub}})
+	if !h.Supports("Scrub") || h.Supports("TrashList") || h.Supports("Shred") {
+		t.Errorf("have %+v", h)
+	}
+	// And for Shred and "-header-v3"
+	h = handshake(t, &testFS{features: []string{ctlsock.FeatureShred}})
+	if !h.Supports("Shred") || h.Supports("Scrub") {
+		t.Errorf("have %+v", h)
+	}
+}
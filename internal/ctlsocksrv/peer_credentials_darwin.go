@@ -24,28 +24,32 @@ const (
 
 // getPeerCredentials retrieves the credentials of the peer connected to the Unix socket on macOS
 func getPeerCredentials(conn *net.UnixConn) (*PeerCredentials, error) {
-	// Get the file descriptor
-	file, err := conn.File()
+	// Get the file descriptor. conn.File() would switch the socket to
+	// blocking mode, and then read deadlines no longer work.
+	rc, err := conn.SyscallConn()
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	fd := int(file.Fd())
 
 	// Use LOCAL_PEERCRED to get peer credentials on macOS
 	var cred Xucred
 	credSize := unsafe.Sizeof(cred)
 
-	_, _, errno := syscall.Syscall6(
-		syscall.SYS_GETSOCKOPT,
-		uintptr(fd),
-		SOL_LOCAL,
-		LOCAL_PEERCRED,
-		uintptr(unsafe.Pointer(&cred)),
-		uintptr(unsafe.Pointer(&credSize)),
-		0,
-	)
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT,
+			fd,
+			SOL_LOCAL,
+			LOCAL_PEERCRED,
+			uintptr(unsafe.Pointer(&cred)),
+			uintptr(unsafe.Pointer(&credSize)),
+			0,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	if errno != 0 {
 		// If peer credential checking fails, fall back to assuming same UID
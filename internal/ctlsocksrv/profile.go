@@ -0,0 +1,117 @@
+package ctlsocksrv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// MaxProfileSeconds is the longest profile a Profile request can ask for.
+// The request must also finish within Options.RequestTimeout.
+const MaxProfileSeconds = 300
+
+// profileMu makes sure that only one profile runs at a time. The CPU
+// profile and the execution trace can only be started once per process,
+// and the block and mutex profile rates are process-wide.
+var profileMu sync.Mutex
+
+// handleProfileRequest handles the Profile request
+func (ch *ctlSockHandler) handleProfileRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	if in.EncryptPath != "" || in.DecryptPath != "" || in.Vault != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	var d time.Duration
+	switch in.Profile.Type {
+	case ctlsock.ProfileCPU, ctlsock.ProfileTrace, ctlsock.ProfileBlock, ctlsock.ProfileMutex:
+		seconds := in.Profile.Seconds
+		if seconds == 0 {
+			seconds = ctlsock.DefaultProfileSeconds
+		}
+		if seconds < 0 || seconds > MaxProfileSeconds {
+			sendResponse(conn, fmt.Errorf("Seconds must be between 1 and %d", MaxProfileSeconds), "", "")
+			return
+		}
+		d = time.Duration(seconds) * time.Second
+		// Leave some time to send the response
+		if d > ch.requestTimeout*9/10 {
+			sendResponse(conn, fmt.Errorf("%v is too close to the -ctlsock-timeout of %v", d, ch.requestTimeout), "", "")
+			return
+		}
+	case ctlsock.ProfileHeap, ctlsock.ProfileGoroutine:
+	default:
+		sendResponse(conn, fmt.Errorf("unknown profile type %q", in.Profile.Type), "", "")
+		return
+	}
+	if !profileMu.TryLock() {
+		sendResponse(conn, syscall.EBUSY, "", "another profile is running")
+		return
+	}
+	defer profileMu.Unlock()
+	tlog.Info.Printf("ctlsock: capturing %s profile", in.Profile.Type)
+	p, err := captureProfile(in.Profile.Type, d)
+	sendResponseStruct(conn, err, ctlsock.ResponseStruct{Profile: p})
+}
+
+// captureProfile records a profile of type "typ". The cpu, block, mutex and
+// trace profiles record for "d". Caller must hold profileMu.
+func captureProfile(typ string, d time.Duration) ([]byte, error) {
+	var buf bytes.Buffer
+	switch typ {
+	case ctlsock.ProfileCPU:
+		// Fails if "-cpuprofile" is running
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			return nil, err
+		}
+		time.Sleep(d)
+		pprof.StopCPUProfile()
+	case ctlsock.ProfileTrace:
+		// Fails if "-trace" is running
+		if err := trace.Start(&buf); err != nil {
+			return nil, err
+		}
+		time.Sleep(d)
+		trace.Stop()
+	case ctlsock.ProfileBlock:
+		// Only the events from now on are recorded. There is no way to
+		// read the old rate, it is 0 unless profiling has been enabled.
+		runtime.SetBlockProfileRate(1)
+		time.Sleep(d)
+		err := pprof.Lookup("block").WriteTo(&buf, 0)
+		runtime.SetBlockProfileRate(0)
+		if err != nil {
+			return nil, err
+		}
+	case ctlsock.ProfileMutex:
+		old := runtime.SetMutexProfileFraction(1)
+		time.Sleep(d)
+		err := pprof.Lookup("mutex").WriteTo(&buf, 0)
+		runtime.SetMutexProfileFraction(old)
+		if err != nil {
+			return nil, err
+		}
+	case ctlsock.ProfileHeap:
+		// Like net/http/pprof with "gc=1": get up-to-date statistics
+		runtime.GC()
+		if err := pprof.Lookup("heap").WriteTo(&buf, 0); err != nil {
+			return nil, err
+		}
+	case ctlsock.ProfileGoroutine:
+		if err := pprof.Lookup("goroutine").WriteTo(&buf, 0); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown profile type %q", typ)
+	}
+	return buf.Bytes(), nil
+}
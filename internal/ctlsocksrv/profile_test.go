@@ -0,0 +1,53 @@
+package ctlsocksrv
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+func TestProfile(t *testing.T) {
+	_, sockPath := startServer(t, &testFS{}, Options{RequestTimeout: 5 * time.Second})
+	c, err := ctlsock.Connect(context.Background(), sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	// pprof protobufs are gzip compressed, traces start with "go 1.xx trace"
+	for typ, magic := range map[string][]byte{
+		ctlsock.ProfileHeap:      {0x1f, 0x8b},
+		ctlsock.ProfileGoroutine: {0x1f, 0x8b},
+		ctlsock.ProfileCPU:       {0x1f, 0x8b},
+		ctlsock.ProfileMutex:     {0x1f, 0x8b},
+		ctlsock.ProfileTrace:     []byte("go 1."),
+	} {
+		p, err := c.Profile(context.Background(), typ, 1)
+		if err != nil {
+			t.Errorf("%s: %v", typ, err)
+			continue
+		}
+		if !bytes.HasPrefix(p, magic) {
+			t.Errorf("%s: unexpected start %q", typ, p[:len(magic)])
+		}
+	}
+	for _, typ := range []string{"foo", ""} {
+		if _, err = c.Profile(context.Background(), typ, 1); err == nil {
+			t.Errorf("profile type %q should fail", typ)
+		}
+	}
+	// Profiles that would run into the request timeout are rejected
+	if _, err = c.Profile(context.Background(), ctlsock.ProfileCPU, 5); err == nil {
+		t.Error("a profile longer than the request timeout should fail")
+	}
+	// Only one profile at a time
+	profileMu.Lock()
+	_, err = c.Profile(context.Background(), ctlsock.ProfileHeap, 0)
+	profileMu.Unlock()
+	if resp, ok := err.(*ctlsock.ResponseStruct); !ok || resp.ErrNo != int32(syscall.EBUSY) {
+		t.Errorf("want EBUSY, have %v", err)
+	}
+}
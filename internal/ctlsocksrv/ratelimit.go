@@ -0,0 +1,84 @@
+package ctlsocksrv
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Rate limiting constants
+const (
+	maxRequestsPerMinute = 60
+	rateLimitWindow      = time.Minute
+)
+
+// clientKey identifies a client process. On unix sockets, the remote
+// address is empty for all clients, so we use the peer credentials.
+// Platforms that do not report the PID put all processes of a user into
+// one bucket.
+type clientKey struct {
+	UID int
+	PID int
+}
+
+type rateLimitEntry struct {
+	// windowStart is the time of the first request in the current window
+	windowStart  time.Time
+	requestCount int
+}
+
+// rateLimiter allows maxRequestsPerMinute requests per client process
+type rateLimiter struct {
+	mu      sync.Mutex
+	entries map[clientKey]*rateLimitEntry
+	// ownerPID is the process that started gocryptfs. It is not limited.
+	ownerPID int
+	// lastSweep is when expired entries have last been deleted
+	lastSweep time.Time
+}
+
+func newRateLimiter(ownerPID int) *rateLimiter {
+	return &rateLimiter{
+		entries:   make(map[clientKey]*rateLimitEntry),
+		ownerPID:  ownerPID,
+		lastSweep: time.Now(),
+	}
+}
+
+// check verifies that the client "cred" is not exceeding the rate limit
+func (rl *rateLimiter) check(cred *PeerCredentials) error {
+	if rl.ownerPID != 0 && cred.PID == rl.ownerPID {
+		return nil
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+	key := clientKey{UID: cred.UID, PID: cred.PID}
+	entry := rl.entries[key]
+	if entry == nil || now.Sub(entry.windowStart) > rateLimitWindow {
+		// First request from this client, or the window is over
+		rl.entries[key] = &rateLimitEntry{windowStart: now, requestCount: 1}
+		return nil
+	}
+	if entry.requestCount >= maxRequestsPerMinute {
+		return fmt.Errorf("rate limit exceeded: %d requests per minute", maxRequestsPerMinute)
+	}
+	entry.requestCount++
+	return nil
+}
+
+// sweep deletes the entries whose window is over, at most once per window,
+// so clients that have exited do not pile up. Caller must hold rl.mu.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateLimitWindow {
+		return
+	}
+	for key, entry := range rl.entries {
+		if now.Sub(entry.windowStart) > rateLimitWindow {
+			delete(rl.entries, key)
+		}
+	}
+	rl.lastSweep = now
+}
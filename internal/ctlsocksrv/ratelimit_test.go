@@ -0,0 +1,55 @@
+package ctlsocksrv
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(100)
+	a := &PeerCredentials{UID: 1000, PID: 1}
+	b := &PeerCredentials{UID: 1000, PID: 2}
+	for i := 0; i < maxRequestsPerMinute; i++ {
+		if err := rl.check(a); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if err := rl.check(a); err == nil {
+		t.Error("request over the limit should fail")
+	}
+	// Other processes of the same user have their own bucket
+	if err := rl.check(b); err != nil {
+		t.Error(err)
+	}
+	// The owner is not limited
+	owner := &PeerCredentials{UID: 1000, PID: 100}
+	for i := 0; i < 2*maxRequestsPerMinute; i++ {
+		if err := rl.check(owner); err != nil {
+			t.Fatalf("owner request %d: %v", i, err)
+		}
+	}
+	// A new window starts after a minute
+	rl.entries[clientKey{1000, 1}].windowStart = time.Now().Add(-2 * rateLimitWindow)
+	if err := rl.check(a); err != nil {
+		t.Error(err)
+	}
+}
+
+// Entries of clients that are gone are deleted
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newRateLimiter(0)
+	for pid := 1; pid <= 100; pid++ {
+		rl.check(&PeerCredentials{UID: 1000, PID: pid})
+	}
+	if len(rl.entries) != 100 {
+		t.Fatalf("have %d entries", len(rl.entries))
+	}
+	for _, e := range rl.entries {
+		e.windowStart = time.Now().Add(-2 * rateLimitWindow)
+	}
+	rl.lastSweep = time.Now().Add(-2 * rateLimitWindow)
+	rl.check(&PeerCredentials{UID: 1000, PID: 1})
+	if len(rl.entries) != 1 {
+		t.Errorf("have %d entries after the sweep, want 1", len(rl.entries))
+	}
+}
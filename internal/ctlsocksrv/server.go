@@ -0,0 +1,294 @@
+package ctlsocksrv
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Defaults for the Options fields
+const (
+	DefaultMaxConns       = 16
+	DefaultRequestTimeout = time.Minute
+	DefaultIdleTimeout    = 5 * time.Second
+)
+
+// ErrServerClosed is returned by Server.Serve after Shutdown has been called
+var ErrServerClosed = errors.New("ctlsock: server closed")
+
+// Options are the limits of a Server. Fields that are zero get the
+// defaults.
+type Options struct {
+	// MaxConns is the number of connections that are served at the same
+	// time. Further connections get an EBUSY error response and are
+	// closed.
+	MaxConns int
+	// RequestTimeout is how long handling a request may take. After that,
+	// the connection is closed without a response.
+	RequestTimeout time.Duration
+	// IdleTimeout is how long the server waits for the next request. The
+	// whole request must have arrived by then, so clients that send
+	// very slowly cannot hold on to a connection.
+	IdleTimeout time.Duration
+	// OwnerPID is the process that started gocryptfs, for example a GUI.
+	// Its requests are not rate limited. 0 means none.
+	OwnerPID int
+}
+
+// Server serves the control socket.
+type Server struct {
+	handler ctlSockHandler
+	socket  *net.UnixListener
+	opts    Options
+	// slots limits the number of connections
+	slots chan struct{}
+
+	mu sync.Mutex
+	// conns are the open connections. The value is true while a request
+	// is handled.
+	conns map[*net.UnixConn]bool
+	// closing is set by Shutdown
+	closing bool
+	// wg counts the open connections
+	wg sync.WaitGroup
+}
+
+// NewServer returns a server for the filesystem "fs" that accepts
+// connections on "sock". Call Serve to start it.
+func NewServer(sock net.Listener, fs Interface, opts Options) *Server {
+	return newServer(sock, fs, nil, opts)
+}
+
+// newServer returns a server for "fs", or for "d" if it is not nil
+func newServer(sock net.Listener, fs Interface, d DaemonInterface, opts Options) *Server {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = DefaultMaxConns
+	}
+	if opts.RequestTimeout <= 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Server{
+		handler: ctlSockHandler{
+			fs:             fs,
+			daemon:         d,
+			rateLimiter:    newRateLimiter(opts.OwnerPID),
+			requestTimeout: opts.RequestTimeout,
+		},
+		socket: sock.(*net.UnixListener),
+		opts:   opts,
+		slots:  make(chan struct{}, opts.MaxConns),
+		conns:  make(map[*net.UnixConn]bool),
+	}
+}
+
+// Serve serves incoming connections on "sock" with the default Options.
+// This call blocks so you probably want to run it in a new goroutine.
+func Serve(sock net.Listener, fs Interface) {
+	NewServer(sock, fs, Options{}).Serve()
+}
+
+// Serve accepts connections until the socket is closed, or until Shutdown
+// is called. Then it returns ErrServerClosed, or the Accept error. This call
+// blocks so you probably want to run it in a new goroutine.
+func (s *Server) Serve() error {
+	for {
+		conn, err := s.socket.Accept()
+		if s.isClosing() {
+			if err == nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		} else if err != nil {
+			// This can trigger on program exit with "use of closed network connection".
+			// Special-casing this is hard due to https://github.com/golang/go/issues/4373
+			// so just don't use tlog.Warn to not cause panics in the tests.
+			tlog.Info.Printf("ctlsock: Accept error: %v", err)
+			return err
+		}
+		uc := conn.(*net.UnixConn)
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			tlog.Warn.Printf("ctlsock: more than %d connections, rejecting", s.opts.MaxConns)
+			uc.SetWriteDeadline(time.Now().Add(s.opts.IdleTimeout))
+			sendResponse(uc, syscall.EBUSY, "", "")
+			uc.Close()
+			continue
+		}
+		if !s.track(uc) {
+			<-s.slots
+			uc.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer func() { <-s.slots }()
+			defer s.untrack(uc)
+			s.handleConnection(uc)
+		}()
+	}
+}
+
+// track adds "conn" to the open connections. Returns false if the server
+// is shutting down.
+func (s *Server) track(conn *net.UnixConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = false
+	s.wg.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn *net.UnixConn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+	s.wg.Done()
+}
+
+// setBusy marks "conn" as handling a request, or as idle. Returns false if
+// the server is shutting down and the connection should be closed instead.
+func (s *Server) setBusy(conn *net.UnixConn, busy bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = busy
+	return true
+}
+
+// isClosing returns true after Shutdown has been called
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// Shutdown stops accepting connections and closes the socket, which also
+// deletes the socket file. Idle connections are closed at once. Requests
+// that are being handled can finish and get their response, until
+// "timeout" has passed. Then the remaining connections are closed.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.mu.Lock()
+	s.closing = true
+	for conn, busy := range s.conns {
+		if !busy {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	err := s.socket.Close()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		s.mu.Lock()
+		tlog.Warn.Printf("ctlsock: closing %d connections that are still busy", len(s.conns))
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// handleConnection reads and parses JSON requests from "conn". Clients can
+// send the next request before they have the response to the previous one,
+// the responses are sent in order.
+func (s *Server) handleConnection(conn *net.UnixConn) {
+	ch := &s.handler
+	// Check peer credentials (same UID requirement)
+	cred, err := ch.checkPeerCredentials(conn)
+	if err != nil {
+		tlog.Warn.Printf("ctlsock: peer credential check failed: %v", err)
+		return
+	}
+
+	rr := &requestReader{r: conn}
+	dec := json.NewDecoder(rr)
+	for {
+		// The request must arrive completely within the idle timeout
+		conn.SetReadDeadline(time.Now().Add(s.opts.IdleTimeout))
+		// The decoder may already have read (part of) the next request
+		rr.left = ReadBufSize
+		start := dec.InputOffset()
+
+		var in ctlsock.RequestStruct
+		err := dec.Decode(&in)
+		if err == io.EOF || (err != nil && s.isClosing()) {
+			return
+		} else if errors.Is(err, errRequestTooBig) || dec.InputOffset()-start >= ReadBufSize {
+			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
+			return
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// Idle connection, or a client that sends too slowly
+			return
+		} else if _, ok := err.(net.Error); ok {
+			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
+			return
+		} else if err != nil {
+			// The rest of the stream cannot be parsed after an error
+			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
+			err = errors.New("JSON Unmarshal error: " + err.Error())
+			sendResponse(conn, err, "", "")
+			return
+		}
+
+		// Check rate limit
+		if err := ch.rateLimiter.check(cred); err != nil {
+			tlog.Warn.Printf("ctlsock: rate limit exceeded for uid %d pid %d: %v", cred.UID, cred.PID, err)
+			sendResponse(conn, err, "", "")
+			return
+		}
+		if !s.setBusy(conn, true) {
+			return
+		}
+		if !s.handleWithTimeout(&in, conn) {
+			return
+		}
+		if !s.setBusy(conn, false) {
+			return
+		}
+	}
+}
+
+// handleWithTimeout handles "in" and returns true if that finished within
+// the request timeout. Otherwise, the connection is closed and the request
+// keeps running in the background; its response is lost.
+func (s *Server) handleWithTimeout(in *ctlsock.RequestStruct, conn *net.UnixConn) bool {
+	conn.SetWriteDeadline(time.Now().Add(s.opts.RequestTimeout))
+	done := make(chan struct{})
+	go func() {
+		s.handler.handleRequest(in, conn)
+		close(done)
+	}()
+	t := time.NewTimer(s.opts.RequestTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		tlog.Warn.Printf("ctlsock: request took longer than %v, closing the connection", s.opts.RequestTimeout)
+		conn.Close()
+		return false
+	}
+}
@@ -0,0 +1,136 @@
+package ctlsocksrv
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// slowFS blocks EncryptPath until "release" is closed
+type slowFS struct {
+	testFS
+	started chan struct{}
+	release chan struct{}
+}
+
+func newSlowFS() *slowFS {
+	return &slowFS{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (fs *slowFS) EncryptPath(p string) (string, error) {
+	fs.started <- struct{}{}
+	<-fs.release
+	return p, nil
+}
+
+// startServer starts a server for "fs" and returns it with its socket path
+func startServer(t *testing.T, fs Interface, opts Options) (*Server, string) {
+	sockPath := filepath.Join(t.TempDir(), "sock")
+	sock, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(sock, fs, opts)
+	go s.Serve()
+	t.Cleanup(func() { s.Shutdown(time.Second) })
+	return s, sockPath
+}
+
+// request connects to "sockPath" and sends "req" without waiting for the
+// response
+func request(t *testing.T, sockPath string, req string) net.Conn {
+	conn, err := net.Dial("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err = conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readResponse reads one response from "conn". Returns nil if the
+// connection has been closed.
+func readResponse(t *testing.T, conn net.Conn) *ctlsock.ResponseStruct {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var resp ctlsock.ResponseStruct
+	err := json.NewDecoder(conn).Decode(&resp)
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return &resp
+}
+
+// Connections over the limit get EBUSY
+func TestMaxConns(t *testing.T) {
+	fs := newSlowFS()
+	defer close(fs.release)
+	_, sockPath := startServer(t, fs, Options{MaxConns: 1})
+	request(t, sockPath, `{"EncryptPath":"a"}`)
+	<-fs.started
+	resp := readResponse(t, request(t, sockPath, `{"DecryptPath":"b"}`))
+	if resp == nil || resp.ErrNo != int32(syscall.EBUSY) {
+		t.Errorf("want EBUSY, have %+v", resp)
+	}
+}
+
+// A request that takes too long closes the connection without a response
+func TestRequestTimeout(t *testing.T) {
+	fs := newSlowFS()
+	defer close(fs.release)
+	_, sockPath := startServer(t, fs, Options{RequestTimeout: 100 * time.Millisecond})
+	if resp := readResponse(t, request(t, sockPath, `{"EncryptPath":"a"}`)); resp != nil {
+		t.Errorf("have response %+v", resp)
+	}
+}
+
+// A client that does not send a complete request in time is disconnected
+func TestIdleTimeout(t *testing.T) {
+	_, sockPath := startServer(t, &testFS{}, Options{IdleTimeout: 100 * time.Millisecond})
+	if resp := readResponse(t, request(t, sockPath, `{"EncryptPath":`)); resp != nil {
+		t.Errorf("have response %+v", resp)
+	}
+}
+
+// Shutdown closes idle connections at once and lets running requests finish
+func TestShutdown(t *testing.T) {
+	fs := newSlowFS()
+	s, sockPath := startServer(t, fs, Options{})
+	busy := request(t, sockPath, `{"EncryptPath":"a"}`)
+	<-fs.started
+	idle := request(t, sockPath, `{"DecryptPath":"b"}`)
+	if resp := readResponse(t, idle); resp == nil || resp.Result != "b" {
+		t.Fatalf("have %+v", resp)
+	}
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(5 * time.Second) }()
+	if resp := readResponse(t, idle); resp != nil {
+		t.Errorf("idle connection: have response %+v", resp)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the request finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(fs.release)
+	if resp := readResponse(t, busy); resp == nil || resp.Result != "a" {
+		t.Errorf("busy connection: have %+v", resp)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
+		t.Errorf("socket file has not been deleted: %v", err)
+	}
+}
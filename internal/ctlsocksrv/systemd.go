@@ -0,0 +1,94 @@
+package ctlsocksrv
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SystemdPrefix is the "-ctlsock" value that selects a socket passed by
+// systemd socket activation. "systemd" takes the first socket,
+// "systemd:NAME" the one with FileDescriptorName=NAME.
+const SystemdPrefix = "systemd"
+
+// sdListenFdsStart is the first file descriptor that systemd passes
+const sdListenFdsStart = 3
+
+// IsSystemd returns true if the "-ctlsock" value "path" selects a socket
+// passed by systemd.
+func IsSystemd(path string) bool {
+	return path == SystemdPrefix || strings.HasPrefix(path, SystemdPrefix+":")
+}
+
+// IsAbstract returns true if "path" is a Linux abstract socket address like
+// "@gocryptfs-vault1". Abstract sockets have no socket file.
+func IsAbstract(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+// SystemdFds returns the number of sockets that systemd has passed to
+// process "pid", like sd_listen_fds(3).
+func SystemdFds(pid int) int {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return 0
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// ListenSystemd returns the socket that systemd has passed to us and that
+// "path" selects (see SystemdPrefix). The sockets must be for this process,
+// or for "parentPid" if it is not 0: gocryptfs passes them on to the child
+// that it forks into the background.
+// The LISTEN_* environment variables are removed, so programs that we start
+// do not use the sockets.
+func ListenSystemd(path string, parentPid int) (net.Listener, error) {
+	return listenSystemd(path, parentPid, sdListenFdsStart)
+}
+
+func listenSystemd(path string, parentPid int, firstFd int) (net.Listener, error) {
+	n := SystemdFds(os.Getpid())
+	if n == 0 && parentPid != 0 {
+		n = SystemdFds(parentPid)
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s: no sockets have been passed by systemd (LISTEN_PID, LISTEN_FDS)", path)
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	i := 0
+	if name := strings.TrimPrefix(path, SystemdPrefix+":"); name != path {
+		for i = 0; i < n; i++ {
+			if i < len(names) && names[i] == name {
+				break
+			}
+		}
+		if i == n {
+			return nil, fmt.Errorf("%s: systemd has not passed a socket named %q (LISTEN_FDNAMES=%q)",
+				path, name, strings.Join(names, ":"))
+		}
+	}
+	fd := firstFd + i
+	syscall.CloseOnExec(fd)
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("systemd socket %d", i))
+	// FileListener duplicates the file descriptor
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if _, ok := ln.(*net.UnixListener); !ok {
+		ln.Close()
+		return nil, fmt.Errorf("%s: socket %d is not a unix stream socket", path, i)
+	}
+	return ln, nil
+}
@@ -0,0 +1,111 @@
+package ctlsocksrv
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// systemdSocket creates a socket like systemd socket activation does and
+// returns its path and file descriptor
+func systemdSocket(t *testing.T, names string) (string, int) {
+	sockPath := filepath.Join(t.TempDir(), "sock")
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	f, err := ln.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", names)
+	return sockPath, fd
+}
+
+// query sends a request to "sockPath" through the typed client
+func query(t *testing.T, sockPath string) {
+	c, err := ctlsock.Connect(context.Background(), sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if p, err := c.EncryptPath(context.Background(), "foo"); err != nil || p != "foo" {
+		t.Errorf("have %q, %v", p, err)
+	}
+}
+
+func TestListenSystemd(t *testing.T) {
+	sockPath, fd := systemdSocket(t, "ctl")
+	ln, err := listenSystemd("systemd:ctl", 0, fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS has not been removed")
+	}
+	s := NewServer(ln, &testFS{}, Options{})
+	go s.Serve()
+	defer s.Shutdown(0)
+	query(t, sockPath)
+}
+
+func TestListenSystemdErrors(t *testing.T) {
+	_, fd := systemdSocket(t, "ctl")
+	defer syscall.Close(fd)
+	if _, err := listenSystemd("systemd:other", 0, fd); err == nil {
+		t.Error("socket with the wrong name should fail")
+	}
+	// The environment has been removed
+	if _, err := listenSystemd("systemd", 0, fd); err == nil {
+		t.Error("should fail without LISTEN_FDS")
+	}
+	// Sockets for another process
+	_, fd2 := systemdSocket(t, "")
+	defer syscall.Close(fd2)
+	t.Setenv("LISTEN_PID", "1")
+	if _, err := listenSystemd("systemd", 0, fd2); err == nil {
+		t.Error("should fail with the LISTEN_PID of another process")
+	}
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	ln, err := listenSystemd("systemd", 1, fd2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+}
+
+func TestListenAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux-only")
+	}
+	sockPath := fmt.Sprintf("@gocryptfs-test-%d", os.Getpid())
+	ln, err := Listen(sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(ln, &testFS{}, Options{})
+	go s.Serve()
+	defer s.Shutdown(0)
+	query(t, sockPath)
+	if _, err := os.Stat(sockPath); !os.IsNotExist(err) {
+		t.Errorf("abstract socket has created a file: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package dedup
+
+import (
+	"io"
+)
+
+const (
+	// MinChunkSize is the smallest chunk the Chunker cuts, except for the
+	// last chunk of a file.
+	MinChunkSize = 16 * 1024
+	// MaxChunkSize is the largest chunk the Chunker cuts.
+	MaxChunkSize = 256 * 1024
+	// cutMask has 16 bits set, which gives an average chunk size of
+	// MinChunkSize + 64 KiB. We use the top bits because they depend on the
+	// last 64 bytes, while the low bits only depend on the last few bytes.
+	cutMask = uint64(0xffff) << 48
+	// hashWindow is the number of bytes that influence the rolling hash.
+	hashWindow = 64
+)
+
+// Chunker splits a stream into content-defined chunks using a gear rolling
+// hash (like FastCDC). A cut point only depends on the 64 bytes in front
+// of it, so inserting or deleting data only changes the chunks around
+// the modification, and the chunks after it are found again.
+type Chunker struct {
+	r    io.Reader
+	gear *[256]uint64
+	buf  []byte
+	// buf[start:end] is the data that has not been returned yet
+	start, end int
+	// err is the error returned by r, or io.EOF
+	err error
+}
+
+// NewChunker returns a Chunker that reads from "r". The chunk boundaries
+// depend on the keys of the Store.
+func (s *Store) NewChunker(r io.Reader) *Chunker {
+	return &Chunker{
+		r:    r,
+		gear: &s.gear,
+		buf:  make([]byte, 2*MaxChunkSize),
+	}
+}
+
+// fill reads until at least MaxChunkSize bytes are buffered or the reader
+// is exhausted.
+func (c *Chunker) fill() {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for c.end < MaxChunkSize && c.err == nil {
+		var n int
+		n, c.err = c.r.Read(c.buf[c.end:])
+		c.end += n
+	}
+}
+
+// Next returns the next chunk. The returned slice is only valid until the
+// next call. At the end of the stream, Next returns io.EOF, or the error
+// returned by the reader.
+func (c *Chunker) Next() ([]byte, error) {
+	if c.end-c.start < MaxChunkSize && c.err == nil {
+		c.fill()
+	}
+	n := c.end - c.start
+	if n == 0 {
+		return nil, c.err
+	}
+	if c.err != nil && c.err != io.EOF {
+		return nil, c.err
+	}
+	cut := n
+	if n > MinChunkSize {
+		data := c.buf[c.start:c.end]
+		if n > MaxChunkSize {
+			data = data[:MaxChunkSize]
+		}
+		cut = len(data)
+		var h uint64
+		for i := MinChunkSize - hashWindow; i < len(data); i++ {
+			h = h<<1 + c.gear[data[i]]
+			if i >= MinChunkSize && h&cutMask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+	chunk := c.buf[c.start : c.start+cut]
+	c.start += cut
+	return chunk, nil
+}
@@ -0,0 +1,257 @@
+// Package dedup implements the chunk store of the "Dedup" feature flag.
+//
+// "gocryptfs -dedup" splits the contents of regular files into chunks using
+// content-defined chunking (see Chunker) and replaces each file with a
+// small "recipe" (see Recipe) that lists the chunks by their ID. Identical
+// chunks are stored only once, in CIPHERDIR/gocryptfs.dedup.
+//
+// Chunks are encrypted convergently: the chunk ID is an HMAC-SHA256 of the
+// plaintext under a key derived from the master key, and the chunk is
+// encrypted with AES-SIV using the chunk ID as the nonce. Equal plaintext
+// gives equal ciphertext, which is what makes deduplication work, but only
+// for holders of the master key. An attacker who can read the CIPHERDIR
+// learns which files share chunks. See the man page for details.
+package dedup
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
+)
+
+const (
+	// DirName is the name of the chunk store directory in the CIPHERDIR.
+	DirName = "gocryptfs.dedup"
+	// IDLen is the length of a chunk ID in bytes.
+	IDLen = sha256.Size
+	// recoveryDirName is the subdirectory that holds copies of recipes
+	// that are being materialized, see SaveRecovery.
+	recoveryDirName = "recovery"
+	// cacheChunks is the number of decrypted chunks that Store keeps in
+	// memory for ReadAt.
+	cacheChunks = 8
+)
+
+// ErrCorrupt is returned when a chunk or a recipe fails authentication.
+var ErrCorrupt = errors.New("dedup: corrupt chunk or recipe")
+
+// ID identifies a chunk. It is the MAC of the plaintext of the chunk.
+type ID [IDLen]byte
+
+// String returns the ID in hex, like it is used for the file name of the
+// chunk.
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Store is the chunk store of a CIPHERDIR. It is safe for concurrent use.
+type Store struct {
+	// dir is CIPHERDIR/gocryptfs.dedup
+	dir string
+	// idKey is the HMAC key for chunk IDs
+	idKey []byte
+	// aead encrypts the chunks
+	aead cipher.AEAD
+	// gear is the rolling hash table of the Chunker. It is derived from the
+	// master key so the chunk boundaries do not leak plaintext.
+	gear [256]uint64
+	// cEnc encrypts the recipes like file contents
+	cEnc *contentenc.ContentEnc
+
+	// cacheLock protects cache and cacheNext
+	cacheLock sync.Mutex
+	cache     [cacheChunks]cachedChunk
+	cacheNext int
+}
+
+type cachedChunk struct {
+	id   ID
+	data []byte
+}
+
+// New returns the chunk store of "cipherdir". The keys are derived from
+// "masterkey", which the caller can wipe afterwards. "cEnc" must be set up
+// like for the file contents of the filesystem.
+func New(masterkey []byte, cipherdir string, cEnc *contentenc.ContentEnc) *Store {
+	s := &Store{
+		dir:   filepath.Join(cipherdir, DirName),
+		idKey: cryptocore.DeriveKey(masterkey, cryptocore.KeyDedupChunkID),
+		cEnc:  cEnc,
+	}
+	sivKey := cryptocore.DeriveKey(masterkey, cryptocore.KeyDedupChunkEnc)
+	s.aead = siv_aead.New(sivKey)
+	for i := range sivKey {
+		sivKey[i] = 0
+	}
+	gear := cryptocore.DeriveKey(masterkey, cryptocore.KeyDedupGear)
+	for i := range s.gear {
+		s.gear[i] = binary.LittleEndian.Uint64(gear[i*8:])
+	}
+	for i := range gear {
+		gear[i] = 0
+	}
+	return s
+}
+
+// Wipe overwrites the keys and the chunk cache. The Store cannot be used
+// afterwards.
+func (s *Store) Wipe() {
+	for i := range s.idKey {
+		s.idKey[i] = 0
+	}
+	s.idKey = nil
+	if w, ok := s.aead.(interface{ Wipe() }); ok {
+		w.Wipe()
+	}
+	s.aead = nil
+	for i := range s.gear {
+		s.gear[i] = 0
+	}
+	s.cacheLock.Lock()
+	for i := range s.cache {
+		for j := range s.cache[i].data {
+			s.cache[i].data[j] = 0
+		}
+		s.cache[i] = cachedChunk{}
+	}
+	s.cacheLock.Unlock()
+}
+
+// Dir returns the path of the chunk store directory.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// ChunkID computes the ID of a chunk with plaintext "data".
+func (s *Store) ChunkID(data []byte) (id ID) {
+	m := hmac.New(sha256.New, s.idKey)
+	m.Write(data)
+	copy(id[:], m.Sum(nil))
+	return id
+}
+
+// chunkPath returns the path of chunk "id". Chunks are spread over 256
+// subdirectories named after the first byte of the ID.
+func (s *Store) chunkPath(id ID) string {
+	h := id.String()
+	return filepath.Join(s.dir, h[:2], h[2:])
+}
+
+// Put stores the chunk "data" unless a chunk with the same ID already
+// exists, and returns the reference to it.
+func (s *Store) Put(data []byte) (ChunkRef, error) {
+	ref := ChunkRef{ID: s.ChunkID(data), Len: uint32(len(data))}
+	p := s.chunkPath(ref.ID)
+	if _, err := os.Lstat(p); err == nil {
+		return ref, nil
+	}
+	// Nonce and authenticated data are the chunk ID. As the ID is a MAC of
+	// the plaintext, AES-SIV is deterministic here, and the ciphertext is
+	// bound to its file name.
+	ciphertext := s.aead.Seal(nil, ref.ID[:siv_aead.NonceSize], data, ref.ID[:])
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return ref, err
+	}
+	return ref, writeFileAtomic(p, ciphertext)
+}
+
+// Has returns true if chunk "id" is present in the store. It does not
+// check the content.
+func (s *Store) Has(id ID) bool {
+	_, err := os.Lstat(s.chunkPath(id))
+	return err == nil
+}
+
+// Get returns the plaintext of chunk "ref". It returns ErrCorrupt if the
+// chunk does not decrypt or does not match the reference.
+func (s *Store) Get(ref ChunkRef) ([]byte, error) {
+	ciphertext, err := os.ReadFile(s.chunkPath(ref.ID))
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.aead.Open(nil, ref.ID[:siv_aead.NonceSize], ciphertext, ref.ID[:])
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s: %w", ref.ID, ErrCorrupt)
+	}
+	if uint32(len(data)) != ref.Len || s.ChunkID(data) != ref.ID {
+		return nil, fmt.Errorf("chunk %s: %w", ref.ID, ErrCorrupt)
+	}
+	return data, nil
+}
+
+// getCached is like Get but keeps the last few chunks in memory. The
+// returned slice must not be modified.
+func (s *Store) getCached(ref ChunkRef) ([]byte, error) {
+	s.cacheLock.Lock()
+	for _, c := range s.cache {
+		if c.data != nil && c.id == ref.ID {
+			s.cacheLock.Unlock()
+			return c.data, nil
+		}
+	}
+	s.cacheLock.Unlock()
+	data, err := s.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheLock.Lock()
+	s.cache[s.cacheNext] = cachedChunk{id: ref.ID, data: data}
+	s.cacheNext = (s.cacheNext + 1) % cacheChunks
+	s.cacheLock.Unlock()
+	return data, nil
+}
+
+// ReadAt reads the plaintext of the file described by recipe "r" into "p",
+// starting at offset "off". Like io.ReaderAt, it returns n < len(p) only
+// together with an error, which is io.EOF at the end of the file.
+func (s *Store) ReadAt(r *Recipe, p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		i, chunkOff, ok := r.find(uint64(off) + uint64(n))
+		if !ok {
+			return n, io.EOF
+		}
+		data, err := s.getCached(r.Chunks[i])
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[chunkOff:])
+	}
+	return n, nil
+}
+
+// writeFileAtomic writes "data" to "path" through a temporary file, so that
+// "path" either does not exist or is complete, even after a crash.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%d.tmp", path, os.Getpid())
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
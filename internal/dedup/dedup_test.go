@@ -0,0 +1,192 @@
+package dedup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+func newTestStore(t *testing.T) *Store {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
+	return New(key, t.TempDir(), contentenc.New(cc, contentenc.DefaultBS))
+}
+
+func randomData(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// chunkAll splits "data" and returns the IDs of the chunks.
+func chunkAll(t *testing.T, s *Store, data []byte) (ids []ID) {
+	c := s.NewChunker(bytes.NewReader(data))
+	total := 0
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > MaxChunkSize {
+			t.Fatalf("chunk too big: %d", len(chunk))
+		}
+		total += len(chunk)
+		ids = append(ids, s.ChunkID(chunk))
+	}
+	if total != len(data) {
+		t.Fatalf("chunks add up to %d, want %d", total, len(data))
+	}
+	return ids
+}
+
+// Inserting data at the start must not change most of the chunks after it.
+func TestChunkerShift(t *testing.T) {
+	s := newTestStore(t)
+	data := randomData(1, 4<<20)
+	a := chunkAll(t, s, data)
+	b := chunkAll(t, s, append([]byte("inserted"), data...))
+	if len(a) < 20 {
+		t.Fatalf("only %d chunks for 4 MiB", len(a))
+	}
+	seen := make(map[ID]bool)
+	for _, id := range a {
+		seen[id] = true
+	}
+	common := 0
+	for _, id := range b {
+		if seen[id] {
+			common++
+		}
+	}
+	if common < len(a)-2 {
+		t.Errorf("only %d of %d chunks survived the shift", common, len(a))
+	}
+}
+
+func TestRecipeRoundtrip(t *testing.T) {
+	s := newTestStore(t)
+	fileID := bytes.Repeat([]byte{7}, 16)
+	// Big enough for a multi-block body
+	for _, n := range []int{0, 1, 200, 2000} {
+		r := NewRecipe(fileID)
+		for i := 0; i < n; i++ {
+			r.Append(ChunkRef{ID: ID{byte(i)}, Len: uint32(i + 1)})
+		}
+		buf := s.MarshalRecipe(r)
+		if !IsRecipeSize(s.cEnc, uint64(len(buf))) {
+			t.Fatalf("n=%d: size %d is not recognized", n, len(buf))
+		}
+		if size, ok := RecipeSize(buf); !ok || size != r.Size {
+			t.Errorf("n=%d: RecipeSize=%d,%v", n, size, ok)
+		}
+		r2, err := s.ParseRecipe(buf)
+		if err != nil {
+			t.Fatalf("n=%d: %v", n, err)
+		}
+		if r2.Size != r.Size || len(r2.Chunks) != n || !bytes.Equal(r2.FileID, fileID) {
+			t.Errorf("n=%d: have size=%d chunks=%d", n, r2.Size, len(r2.Chunks))
+		}
+		// Tampering with the unauthenticated size is detected
+		buf[20] ^= 1
+		if _, err = s.ParseRecipe(buf); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("n=%d: tampered size: have %v", n, err)
+		}
+	}
+	// Regular ciphertext files are never mistaken for recipes
+	for size := uint64(0); size < 100000; size++ {
+		c := s.cEnc.PlainSizeToCipherSize(size)
+		if IsRecipeSize(s.cEnc, c) {
+			t.Fatalf("plain size %d: cipher size %d looks like a recipe", size, c)
+		}
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	s := newTestStore(t)
+	data := randomData(2, 100000)
+	ref, err := s.Put(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same data, same chunk
+	if ref2, err := s.Put(data); err != nil || ref2 != ref {
+		t.Fatalf("second Put: %v %v", ref2, err)
+	}
+	have, err := s.Get(ref)
+	if err != nil || !bytes.Equal(have, data) {
+		t.Fatalf("Get: %v", err)
+	}
+	p := s.chunkPath(ref.ID)
+	c, _ := os.ReadFile(p)
+	c[100] ^= 1
+	os.Chmod(p, 0600)
+	if err = os.WriteFile(p, c, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Get(ref); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("tampered chunk: have %v", err)
+	}
+}
+
+func TestReadAtMaterializeGC(t *testing.T) {
+	s := newTestStore(t)
+	data := randomData(3, 1<<20+12345)
+	r := NewRecipe(bytes.Repeat([]byte{1}, 16))
+	c := s.NewChunker(bytes.NewReader(data))
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		ref, err := s.Put(chunk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Append(ref)
+	}
+	buf := make([]byte, 100000)
+	n, err := s.ReadAt(r, buf, 500000)
+	if n != len(buf) || err != nil || !bytes.Equal(buf, data[500000:600000]) {
+		t.Errorf("ReadAt: n=%d err=%v", n, err)
+	}
+	n, err = s.ReadAt(r, buf, int64(len(data))-10)
+	if n != 10 || err != io.EOF {
+		t.Errorf("ReadAt at the end: n=%d err=%v", n, err)
+	}
+
+	f, err := os.Create(filepath.Join(t.TempDir(), "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = s.Materialize(f, r); err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := os.ReadFile(f.Name())
+	plaintext, err := s.cEnc.DecryptBlocks(ciphertext[contentenc.HeaderLen:], 0, r.FileID)
+	if err != nil || !bytes.Equal(plaintext, data) {
+		t.Errorf("Materialize: err=%v", err)
+	}
+
+	// Keep everything but the first chunk
+	live := make(map[ID]struct{})
+	for _, ref := range r.Chunks[1:] {
+		live[ref.ID] = struct{}{}
+	}
+	deleted, _, err := s.GC(live)
+	if err != nil || deleted != 1 {
+		t.Errorf("GC: deleted=%d err=%v", deleted, err)
+	}
+	if s.Has(r.Chunks[0].ID) || !s.Has(r.Chunks[1].ID) {
+		t.Error("GC deleted the wrong chunks")
+	}
+}
@@ -0,0 +1,78 @@
+package dedup
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readDirNames returns the names in directory "dir".
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// WalkChunks calls "fn" for every chunk in the store, and for leftover
+// temporary files with ok=false.
+func (s *Store) WalkChunks(fn func(path string, id ID, ok bool) error) error {
+	subdirs, err := readDirNames(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, sub := range subdirs {
+		if len(sub) != 2 {
+			// recovery directory
+			continue
+		}
+		names, err := readDirNames(filepath.Join(s.dir, sub))
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			var id ID
+			raw, err := hex.DecodeString(sub + n)
+			ok := err == nil && len(raw) == IDLen && !strings.HasSuffix(n, ".tmp")
+			copy(id[:], raw)
+			if err := fn(filepath.Join(s.dir, sub, n), id, ok); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// GC deletes all chunks whose ID is not in "live", and leftover temporary
+// files. Returns the number of deleted chunks and the bytes freed.
+//
+// The chunks referenced by recovery copies (see SaveRecovery) must be in
+// "live". The filesystem must not be mounted, as a concurrent materialize
+// would otherwise still need the chunks.
+func (s *Store) GC(live map[ID]struct{}) (deleted int, freed int64, err error) {
+	err = s.WalkChunks(func(path string, id ID, ok bool) error {
+		if ok {
+			if _, keep := live[id]; keep {
+				return nil
+			}
+		}
+		st, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if ok {
+			deleted++
+		}
+		freed += st.Size()
+		return nil
+	})
+	return deleted, freed, err
+}
@@ -0,0 +1,322 @@
+package dedup
+
+// Recipe file format
+//
+//	[ version uint16 = 0xdd01 ] [ file ID 16 bytes ] [ size uint64 ]
+//	[ body length uint32 ] [ encrypted body ] [ zero padding ]
+//
+// All integers are big endian. The body is encrypted like file contents,
+// using the file ID, and consists of
+//
+//	[ size uint64 ] [ count uint32 ] count * ( [ chunk ID 32 bytes ] [ length uint32 ] )
+//
+// The size is stored in the clear so that stat() does not need to decrypt
+// anything. It is authenticated through the copy in the body.
+//
+// The padding makes the total size one that a regular ciphertext file can
+// never have (see IsRecipeSize), so recipes can be told apart with a
+// stat() call. The different version number means that a recipe that is
+// read as a regular file fails with an error instead of returning garbage.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+)
+
+const (
+	// RecipeVersion replaces contentenc.CurrentVersion in the header of a
+	// recipe.
+	RecipeVersion = 0xdd01
+	// RecipeHeaderLen is the length of the unencrypted part of a recipe.
+	RecipeHeaderLen = 2 + fileIDLen + 8 + 4
+	fileIDLen       = contentenc.HeaderLen - 2
+	bodyHeaderLen   = 8 + 4
+	chunkRefLen     = IDLen + 4
+)
+
+// ChunkRef references a chunk in the Store.
+type ChunkRef struct {
+	ID ID
+	// Len is the plaintext length of the chunk
+	Len uint32
+}
+
+// Recipe describes a file whose content is stored in chunks.
+type Recipe struct {
+	// FileID is the file ID of the file. It is kept when the file is
+	// converted back to a regular file, see Materialize.
+	FileID []byte
+	// Size is the plaintext size
+	Size uint64
+	// Chunks is the content of the file in order
+	Chunks []ChunkRef
+	// ends[i] is the plaintext offset after Chunks[i], for find()
+	ends []uint64
+}
+
+// NewRecipe returns an empty Recipe for a file with ID "fileID".
+func NewRecipe(fileID []byte) *Recipe {
+	return &Recipe{FileID: fileID}
+}
+
+// Append adds a chunk to the end of the file.
+func (r *Recipe) Append(ref ChunkRef) {
+	r.Chunks = append(r.Chunks, ref)
+	r.Size += uint64(ref.Len)
+	r.ends = append(r.ends, r.Size)
+}
+
+// find returns the index of the chunk that contains plaintext offset "off"
+// and the offset inside the chunk.
+func (r *Recipe) find(off uint64) (i int, chunkOff uint64, ok bool) {
+	if off >= r.Size {
+		return 0, 0, false
+	}
+	i = sort.Search(len(r.ends), func(j int) bool { return r.ends[j] > off })
+	return i, off - (r.ends[i] - uint64(r.Chunks[i].Len)), true
+}
+
+// IsRecipeSize returns true if "size" is the size of a recipe file. All
+// other sizes are regular ciphertext files, which can never have an
+// incomplete last block of 1 to BlockOverhead() bytes.
+func IsRecipeSize(cEnc *contentenc.ContentEnc, size uint64) bool {
+	if size < RecipeHeaderLen {
+		return false
+	}
+	rest := (size - contentenc.HeaderLen) % cEnc.CipherBS()
+	return rest > 0 && rest <= cEnc.BlockOverhead()
+}
+
+// RecipeSize returns the plaintext size from the first RecipeHeaderLen
+// bytes of a recipe. It is not authenticated.
+func RecipeSize(hdr []byte) (uint64, bool) {
+	if len(hdr) < RecipeHeaderLen || binary.BigEndian.Uint16(hdr) != RecipeVersion {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(hdr[2+fileIDLen:]), true
+}
+
+// encryptBody encrypts "body" like file contents, in batches so we do not
+// exceed the size of contentenc's buffer pool.
+func (s *Store) encryptBody(body []byte, fileID []byte) []byte {
+	bs := int(s.cEnc.PlainBS())
+	batch := contentenc.MaxKernelWrite / bs
+	var out []byte
+	var blocks [][]byte
+	blockNo := uint64(0)
+	for len(body) > 0 {
+		n := bs
+		if n > len(body) {
+			n = len(body)
+		}
+		blocks = append(blocks, body[:n])
+		body = body[n:]
+		if len(blocks) == batch || len(body) == 0 {
+			c := s.cEnc.EncryptBlocks(blocks, blockNo, fileID)
+			out = append(out, c...)
+			s.cEnc.CReqPool.Put(c)
+			blockNo += uint64(len(blocks))
+			blocks = blocks[:0]
+		}
+	}
+	return out
+}
+
+// MarshalRecipe returns the content of the recipe file for "r".
+func (s *Store) MarshalRecipe(r *Recipe) []byte {
+	body := make([]byte, bodyHeaderLen, bodyHeaderLen+len(r.Chunks)*chunkRefLen)
+	binary.BigEndian.PutUint64(body, r.Size)
+	binary.BigEndian.PutUint32(body[8:], uint32(len(r.Chunks)))
+	for _, c := range r.Chunks {
+		body = append(body, c.ID[:]...)
+		body = binary.BigEndian.AppendUint32(body, c.Len)
+	}
+	out := make([]byte, RecipeHeaderLen)
+	binary.BigEndian.PutUint16(out, RecipeVersion)
+	copy(out[2:], r.FileID)
+	binary.BigEndian.PutUint64(out[2+fileIDLen:], r.Size)
+	binary.BigEndian.PutUint32(out[2+fileIDLen+8:], uint32(len(body)))
+	out = append(out, s.encryptBody(body, r.FileID)...)
+	// Pad to a size that IsRecipeSize recognizes
+	rest := (uint64(len(out)) - contentenc.HeaderLen) % s.cEnc.CipherBS()
+	if rest == 0 {
+		out = append(out, 0)
+	} else if rest > s.cEnc.BlockOverhead() {
+		out = append(out, make([]byte, s.cEnc.CipherBS()-rest+1)...)
+	}
+	return out
+}
+
+// ParseRecipe decrypts and checks the recipe file content "buf".
+func (s *Store) ParseRecipe(buf []byte) (*Recipe, error) {
+	size, ok := RecipeSize(buf)
+	if !ok || !IsRecipeSize(s.cEnc, uint64(len(buf))) {
+		return nil, fmt.Errorf("not a recipe: %w", ErrCorrupt)
+	}
+	fileID := append([]byte{}, buf[2:2+fileIDLen]...)
+	bodyLen := uint64(binary.BigEndian.Uint32(buf[2+fileIDLen+8:]))
+	cipherLen := s.cEnc.PlainSizeToCipherSize(bodyLen) - contentenc.HeaderLen
+	if bodyLen < bodyHeaderLen || (bodyLen-bodyHeaderLen)%chunkRefLen != 0 ||
+		uint64(len(buf)) < RecipeHeaderLen+cipherLen {
+		return nil, fmt.Errorf("recipe %s: bad body length %d: %w", hex.EncodeToString(fileID), bodyLen, ErrCorrupt)
+	}
+	ciphertext := buf[RecipeHeaderLen : RecipeHeaderLen+cipherLen]
+	padding := buf[RecipeHeaderLen+cipherLen:]
+	if uint64(len(padding)) > s.cEnc.CipherBS() || !bytes.Equal(padding, make([]byte, len(padding))) {
+		return nil, fmt.Errorf("recipe %s: bad padding: %w", hex.EncodeToString(fileID), ErrCorrupt)
+	}
+	body, err := s.cEnc.DecryptBlocks(ciphertext, 0, fileID)
+	if err != nil || uint64(len(body)) != bodyLen {
+		return nil, fmt.Errorf("recipe %s: %v: %w", hex.EncodeToString(fileID), err, ErrCorrupt)
+	}
+	count := binary.BigEndian.Uint32(body[8:])
+	if binary.BigEndian.Uint64(body) != size || uint64(count) != (bodyLen-bodyHeaderLen)/chunkRefLen {
+		return nil, fmt.Errorf("recipe %s: header does not match body: %w", hex.EncodeToString(fileID), ErrCorrupt)
+	}
+	r := NewRecipe(fileID)
+	r.Chunks = make([]ChunkRef, 0, count)
+	r.ends = make([]uint64, 0, count)
+	for b := body[bodyHeaderLen:]; len(b) > 0; b = b[chunkRefLen:] {
+		var ref ChunkRef
+		copy(ref.ID[:], b)
+		ref.Len = binary.BigEndian.Uint32(b[IDLen:])
+		r.Append(ref)
+	}
+	if r.Size != size {
+		return nil, fmt.Errorf("recipe %s: chunks do not add up to the size: %w", hex.EncodeToString(fileID), ErrCorrupt)
+	}
+	return r, nil
+}
+
+// Materialize converts the recipe file open in "f" back into a regular
+// ciphertext file with the same file ID, in place. "f" must be open
+// read-write. A recovery copy of the recipe is kept until the file is
+// complete, see SaveRecovery.
+func (s *Store) Materialize(f *os.File, r *Recipe) error {
+	if err := s.SaveRecovery(s.MarshalRecipe(r)); err != nil {
+		return err
+	}
+	// The header has the same file ID as the recipe, so the file can be
+	// matched with the recovery copy whenever we crash.
+	// Also write the header for empty files so the file ID is kept.
+	h := contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: r.FileID}
+	if _, err := f.WriteAt(h.Pack(), 0); err != nil {
+		return err
+	}
+	// Re-encrypt in batches of MaxKernelWrite, like the Write path does
+	buf := make([]byte, contentenc.MaxKernelWrite)
+	bs := s.cEnc.PlainBS()
+	for off := uint64(0); off < r.Size; off += uint64(len(buf)) {
+		n, err := s.ReadAt(r, buf, int64(off))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var blocks [][]byte
+		for b := buf[:n]; len(b) > 0; {
+			l := bs
+			if l > uint64(len(b)) {
+				l = uint64(len(b))
+			}
+			blocks = append(blocks, b[:l])
+			b = b[l:]
+		}
+		blockNo := s.cEnc.PlainOffToBlockNo(off)
+		c := s.cEnc.EncryptBlocks(blocks, blockNo, r.FileID)
+		_, err = f.WriteAt(c, int64(s.cEnc.BlockNoToCipherOff(blockNo)))
+		s.cEnc.CReqPool.Put(c)
+		if err != nil {
+			return err
+		}
+	}
+	cipherSize := s.cEnc.PlainSizeToCipherSize(r.Size)
+	if cipherSize < contentenc.HeaderLen {
+		cipherSize = contentenc.HeaderLen
+	}
+	return s.finish(f, int64(cipherSize), r.FileID)
+}
+
+// Replace writes recipe "r" over the regular ciphertext file open in "f",
+// in place. "f" must be open read-write, and "r" must have the file ID of
+// the file. A recovery copy of the recipe is kept until the file is
+// complete, see SaveRecovery.
+func (s *Store) Replace(f *os.File, r *Recipe) error {
+	buf := s.MarshalRecipe(r)
+	if err := s.SaveRecovery(buf); err != nil {
+		return err
+	}
+	// Bytes 2 to 18 are the file ID both in the old header and in the
+	// recipe, so the file can be matched with the recovery copy whenever we
+	// crash.
+	if _, err := f.WriteAt(buf, 0); err != nil {
+		return err
+	}
+	return s.finish(f, int64(len(buf)), r.FileID)
+}
+
+// finish truncates "f" to "size", syncs it and deletes the recovery copy.
+func (s *Store) finish(f *os.File, size int64, fileID []byte) error {
+	if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return s.RemoveRecovery(fileID)
+}
+
+// recoveryPath returns the path of the recovery copy for file ID "fileID".
+func (s *Store) recoveryPath(fileID []byte) string {
+	return filepath.Join(s.dir, recoveryDirName, hex.EncodeToString(fileID))
+}
+
+// SaveRecovery stores a copy of the recipe file content "buf" before a
+// file is rewritten in place by Materialize or Replace. If we crash in the
+// middle, the next "gocryptfs -dedup" run restores the file from this copy,
+// and the chunks it references are not garbage-collected.
+func (s *Store) SaveRecovery(buf []byte) error {
+	if _, ok := RecipeSize(buf); !ok {
+		return fmt.Errorf("not a recipe: %w", ErrCorrupt)
+	}
+	p := s.recoveryPath(buf[2 : 2+fileIDLen])
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, buf)
+}
+
+// RemoveRecovery deletes the recovery copy for "fileID".
+func (s *Store) RemoveRecovery(fileID []byte) error {
+	return os.Remove(s.recoveryPath(fileID))
+}
+
+// LoadRecovery returns the recovery copy for "fileID", or an error
+// satisfying os.IsNotExist if there is none.
+func (s *Store) LoadRecovery(fileID []byte) ([]byte, error) {
+	return os.ReadFile(s.recoveryPath(fileID))
+}
+
+// ListRecovery returns the file IDs of all recovery copies.
+func (s *Store) ListRecovery() (fileIDs [][]byte, err error) {
+	names, err := readDirNames(filepath.Join(s.dir, recoveryDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		id, err := hex.DecodeString(n)
+		if err != nil || len(id) != fileIDLen {
+			continue
+		}
+		fileIDs = append(fileIDs, id)
+	}
+	return fileIDs, nil
+}
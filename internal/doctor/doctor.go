@@ -0,0 +1,137 @@
+// Package doctor looks for system settings that can leak the master key
+// or plaintext to disk, for backing filesystems with problematic
+// semantics, and reports on FUSE, crypto acceleration and MAC confinement. It backs
+// "gocryptfs -doctor" and the check at mount time.
+package doctor
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/maclabel"
+	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
+)
+
+// Severity says how urgent a Finding is
+type Severity int
+
+const (
+	// Info is a fact about the system or the filesystem
+	Info Severity = iota
+	// Warning is a risk, or a problem that gocryptfs can live with
+	Warning
+	// Error is a problem that keeps gocryptfs from working correctly
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// Finding is something that the checks have found
+type Finding struct {
+	Severity Severity
+	// Check is the name of the check, like "swap" or "filesystem"
+	Check string
+	// Message says what was found
+	Message string
+	// Advice says how to fix it. Empty for Info.
+	Advice string
+}
+
+func (f Finding) String() string {
+	return strings.TrimSpace(fmt.Sprintf("%s: %s: %s %s", f.Severity, f.Check, f.Message, f.Advice))
+}
+
+// Run runs the checks for settings that put the master key or plaintext at
+// risk, which are cheap enough to run on every mount. "cipherdir" is the
+// directory that holds the encrypted files, or "" to skip the filesystem
+// check.
+func Run(cipherdir string) []Finding {
+	var out []Finding
+	out = append(out, checkSwap()...)
+	out = append(out, checkCoreDumps()...)
+	if cipherdir != "" {
+		out = append(out, checkFilesystem(cipherdir)...)
+	}
+	return out
+}
+
+// Environment runs the checks of Run, and also reports on FUSE, OpenSSL
+// and crypto acceleration
+func Environment(cipherdir string) []Finding {
+	out := Run(cipherdir)
+	out = append(out, checkFuse()...)
+	out = append(out, checkCrypto()...)
+	out = append(out, checkConfinement(maclabel.Current())...)
+	return out
+}
+
+// Sort orders "findings" by severity, errors first. Findings with the same
+// severity keep their order.
+func Sort(findings []Finding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+}
+
+// Worst returns the highest severity in "findings", or Info if there are
+// none
+func Worst(findings []Finding) Severity {
+	worst := Info
+	for _, f := range findings {
+		if f.Severity > worst {
+			worst = f.Severity
+		}
+	}
+	return worst
+}
+
+func checkCrypto() []Finding {
+	var out []Finding
+	if stupidgcm.BuiltWithoutOpenssl {
+		out = append(out, Finding{Severity: Info, Check: "openssl",
+			Message: "Built without OpenSSL, all ciphers use the Go implementation."})
+	} else {
+		out = append(out, Finding{Severity: Info, Check: "openssl",
+			Message: fmt.Sprintf("Linked against %s.", stupidgcm.OpenSSLVersion())})
+	}
+	if stupidgcm.HasAESGCMHardwareSupport() {
+		out = append(out, Finding{Severity: Info, Check: "cpu",
+			Message: "The CPU accelerates AES-GCM."})
+	} else {
+		out = append(out, Finding{Severity: Warning, Check: "cpu",
+			Message: "The CPU does not accelerate AES-GCM, so AES-GCM and AES-SIV filesystems are slow.",
+			Advice:  "Create new filesystems with -xchacha, and compare with \"gocryptfs -speed\"."})
+	}
+	return out
+}
+
+// checkConfinement reports whether SELinux or AppArmor confine gocryptfs
+func checkConfinement(c maclabel.Confinement) []Finding {
+	var mac string
+	switch {
+	case c.SELinux != "":
+		mac = "SELinux (" + c.SELinux + ")"
+	case c.AppArmor:
+		mac = "AppArmor"
+	default:
+		return nil
+	}
+	if c.Confined() {
+		return []Finding{{Severity: Info, Check: "confinement",
+			Message: fmt.Sprintf("Confined by %s as %q.", mac, c.Context)}}
+	}
+	return []Finding{{Severity: Info, Check: "confinement",
+		Message: fmt.Sprintf("%s is enabled, but gocryptfs runs unconfined.", mac),
+		Advice:  "The policies in contrib/selinux and contrib/apparmor confine it, see \"make install-selinux\" and \"make install-apparmor\"."}}
+}
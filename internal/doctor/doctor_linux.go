@@ -0,0 +1,277 @@
+package doctor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Magic numbers from statfs(2)
+const (
+	ecryptfsSuperMagic = 0xf15f
+	nfsSuperMagic      = 0x6969
+	smbSuperMagic      = 0x517b
+	cifsSuperMagic     = 0xff534d42
+	smb2SuperMagic     = 0xfe534d42
+)
+
+// sysDir is where sysfs is mounted. Tests point it at a fake tree.
+var sysDir = "/sys"
+
+// swapEntry is a line of /proc/swaps
+type swapEntry struct {
+	path string
+	// "partition" or "file"
+	kind string
+}
+
+// parseSwaps parses the contents of /proc/swaps
+func parseSwaps(r io.Reader) []swapEntry {
+	var out []swapEntry
+	sc := bufio.NewScanner(r)
+	// Skip the header
+	sc.Scan()
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		// The kernel escapes blanks in the path like "\040"
+		path := strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`).Replace(fields[0])
+		out = append(out, swapEntry{path: path, kind: fields[1]})
+	}
+	return out
+}
+
+// blockDevEncrypted finds out if the block device "name" (like "dm-0" or
+// "sda2") keeps its data off the disk or encrypts it: zram lives in RAM,
+// dm-crypt encrypts, and other device mapper targets, like LVM, are
+// encrypted if all devices below them are.
+func blockDevEncrypted(name string) bool {
+	if strings.HasPrefix(name, "zram") {
+		return true
+	}
+	if !strings.HasPrefix(name, "dm-") {
+		return false
+	}
+	dir := filepath.Join(sysDir, "block", name)
+	uuid, _ := os.ReadFile(filepath.Join(dir, "dm", "uuid"))
+	if strings.HasPrefix(string(uuid), "CRYPT-") {
+		return true
+	}
+	slaves, _ := os.ReadDir(filepath.Join(dir, "slaves"))
+	if len(slaves) == 0 {
+		return false
+	}
+	for _, s := range slaves {
+		if !blockDevEncrypted(s.Name()) {
+			return false
+		}
+	}
+	return true
+}
+
+// devName returns the name of the block device "dev" in /sys/block, like
+// "dm-0", or "" if it has none
+func devName(dev uint64) string {
+	link, err := os.Readlink(filepath.Join(sysDir, "dev", "block",
+		fmt.Sprintf("%d:%d", unix.Major(dev), unix.Minor(dev))))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(link)
+}
+
+// swapEncrypted finds out if swap entry "e" is encrypted. A swap file is
+// as safe as the block device of the filesystem it is on.
+func swapEncrypted(e swapEntry) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(e.path, &st); err != nil {
+		return false
+	}
+	dev := st.Dev
+	if e.kind == "partition" {
+		dev = st.Rdev
+	}
+	return blockDevEncrypted(devName(dev))
+}
+
+// unencryptedSwap returns the swap devices and files that are not
+// encrypted
+func unencryptedSwap() []string {
+	f, err := os.Open("/proc/swaps")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var out []string
+	for _, e := range parseSwaps(f) {
+		if !swapEncrypted(e) {
+			out = append(out, e.path)
+		}
+	}
+	return out
+}
+
+// mlockError tries to lock a page of memory. gocryptfs locks its keys into
+// memory, which fails if RLIMIT_MEMLOCK is too low.
+func mlockError() error {
+	buf := make([]byte, os.Getpagesize())
+	if err := unix.Mlock(buf); err != nil {
+		return err
+	}
+	return unix.Munlock(buf)
+}
+
+// hibernationEnabled finds out if the kernel can hibernate, which writes
+// all of the memory, locked or not, to swap
+func hibernationEnabled() bool {
+	state, err := os.ReadFile(filepath.Join(sysDir, "power", "state"))
+	if err != nil || !strings.Contains(string(state), "disk") {
+		return false
+	}
+	mode, err := os.ReadFile(filepath.Join(sysDir, "power", "disk"))
+	if err != nil {
+		return false
+	}
+	return !strings.Contains(string(mode), "[disabled]")
+}
+
+func checkSwap() []Finding {
+	swaps := unencryptedSwap()
+	if len(swaps) == 0 {
+		return nil
+	}
+	list := strings.Join(swaps, ", ")
+	var out []Finding
+	if err := mlockError(); err != nil {
+		out = append(out, Finding{
+			Severity: Warning,
+			Check:    "swap",
+			Message: fmt.Sprintf("The swap on %s is not encrypted, and memory locking is not available (%v). "+
+				"The master key can be written to disk in the clear.", list, err),
+			Advice: "Encrypt the swap, use zram, or raise the memory lock limit (\"ulimit -l\", LimitMEMLOCK= in systemd units).",
+		})
+	}
+	if hibernationEnabled() {
+		out = append(out, Finding{
+			Severity: Warning,
+			Check:    "hibernation",
+			Message: fmt.Sprintf("Hibernation is enabled, and the swap on %s is not encrypted. "+
+				"Hibernating writes the master key and cached plaintext to disk in the clear.", list),
+			Advice: "Encrypt the swap, or disable hibernation (\"systemctl mask hibernate.target hybrid-sleep.target\").",
+		})
+	}
+	return out
+}
+
+func checkCoreDumps() []Finding {
+	var out []Finding
+	var lim unix.Rlimit
+	dumpable, err := unix.PrctlRetInt(unix.PR_GET_DUMPABLE, 0, 0, 0, 0)
+	if err == nil && dumpable != 0 && unix.Getrlimit(unix.RLIMIT_CORE, &lim) == nil && lim.Cur != 0 {
+		out = append(out, Finding{
+			Severity: Warning,
+			Check:    "core dumps",
+			Message:  "Core dumps of gocryptfs are enabled. A crash writes the master key and cached plaintext to disk in the clear.",
+			Advice:   "Disable core dumps (\"ulimit -c 0\", LimitCORE=0 in systemd units).",
+		})
+	}
+	// With suid_dumpable=2, processes that marked themselves as not
+	// dumpable, like gocryptfs does, are dumped anyway
+	mode, err := os.ReadFile("/proc/sys/fs/suid_dumpable")
+	if err == nil && strings.TrimSpace(string(mode)) == "2" {
+		out = append(out, Finding{
+			Severity: Warning,
+			Check:    "core dumps",
+			Message: "fs.suid_dumpable is 2, so the kernel writes core dumps of gocryptfs although it disables them. " +
+				"A crash writes the master key and cached plaintext to disk in the clear.",
+			Advice: "Set fs.suid_dumpable to 0 (\"sysctl fs.suid_dumpable=0\").",
+		})
+	}
+	return out
+}
+
+func checkFilesystem(cipherdir string) []Finding {
+	var st unix.Statfs_t
+	if err := unix.Statfs(cipherdir, &st); err != nil {
+		return nil
+	}
+	switch uint32(st.Type) {
+	case ecryptfsSuperMagic:
+		return []Finding{{
+			Severity: Warning,
+			Check:    "filesystem",
+			Message: fmt.Sprintf("%s is on eCryptfs. eCryptfs limits names to 143 bytes, which makes long plaintext "+
+				"names need extra gocryptfs.longname files, and every file is encrypted twice.", cipherdir),
+			Advice: "Move CIPHERDIR out of the eCryptfs directory, for example from your home directory to /home/.gocryptfs.",
+		}}
+	case nfsSuperMagic:
+		return []Finding{{
+			Severity: Warning,
+			Check:    "filesystem",
+			Message: fmt.Sprintf("%s is on NFS. NFS servers differ in how they handle extended attributes, "+
+				"locking and inode numbers, and other clients change files behind the back of gocryptfs.", cipherdir),
+			Advice: "Use -sharedstorage if other clients access CIPHERDIR, and check with -fsck after server problems.",
+		}}
+	case smbSuperMagic, cifsSuperMagic, smb2SuperMagic:
+		return []Finding{{
+			Severity: Warning,
+			Check:    "filesystem",
+			Message: fmt.Sprintf("%s is on SMB/CIFS. Depending on the server, names are case-insensitive, "+
+				"hard links and extended attributes are missing, and inode numbers are not stable.", cipherdir),
+			Advice: "Use -sharedstorage, and check with -check-names that the server allows long enough names.",
+		}}
+	}
+	return nil
+}
+
+// checkFuse checks that /dev/fuse can be opened, and reports the version of
+// fusermount, which mounts the filesystem for users other than root
+func checkFuse() []Finding {
+	var out []Finding
+	f, err := os.OpenFile("/dev/fuse", os.O_RDWR, 0)
+	if err != nil {
+		out = append(out, Finding{
+			Severity: Error,
+			Check:    "fuse",
+			Message:  fmt.Sprintf("Cannot open /dev/fuse: %v.", err),
+			Advice:   "Load the fuse kernel module (\"modprobe fuse\"). In a container, pass /dev/fuse in.",
+		})
+	} else {
+		f.Close()
+	}
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		path, err := exec.LookPath(name)
+		if err != nil {
+			continue
+		}
+		v, err := exec.Command(path, "-V").Output()
+		if err != nil {
+			out = append(out, Finding{
+				Severity: Warning,
+				Check:    "fuse",
+				Message:  fmt.Sprintf("%s -V failed: %v.", path, err),
+				Advice:   "Reinstall fuse3.",
+			})
+			return out
+		}
+		// "fusermount3 version: 3.10.3"
+		out = append(out, Finding{Severity: Info, Check: "fuse",
+			Message: fmt.Sprintf("%s (%s).", strings.TrimSpace(string(v)), path)})
+		return out
+	}
+	out = append(out, Finding{
+		Severity: Error,
+		Check:    "fuse",
+		Message:  "Neither fusermount3 nor fusermount is in PATH.",
+		Advice:   "Install fuse3, gocryptfs needs fusermount to mount.",
+	})
+	return out
+}
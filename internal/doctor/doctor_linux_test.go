@@ -0,0 +1,108 @@
+package doctor
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSwaps(t *testing.T) {
+	in := "Filename\t\t\t\tType\t\tSize\t\tUsed\t\tPriority\n" +
+		"/dev/dm-1                               partition\t8388604\t\t0\t\t-2\n" +
+		"/var/my\\040swap                         file\t\t1048572\t\t0\t\t-3\n"
+	have := parseSwaps(strings.NewReader(in))
+	want := []swapEntry{{"/dev/dm-1", "partition"}, {"/var/my swap", "file"}}
+	if len(have) != len(want) {
+		t.Fatalf("have %v, want %v", have, want)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Errorf("entry %d: have %v, want %v", i, have[i], want[i])
+		}
+	}
+	// No swap: only the header
+	if have := parseSwaps(strings.NewReader("Filename\tType\tSize\tUsed\tPriority\n")); len(have) != 0 {
+		t.Errorf("have %v, want nothing", have)
+	}
+}
+
+// fakeSys creates a sysfs tree with the device mapper devices in "uuids"
+// (name -> dm/uuid) and "slaves" (name -> devices below it) and points
+// sysDir at it
+func fakeSys(t *testing.T, uuids map[string]string, slaves map[string][]string) {
+	dir := t.TempDir()
+	for name, uuid := range uuids {
+		d := filepath.Join(dir, "block", name)
+		if err := os.MkdirAll(filepath.Join(d, "dm"), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(d, "dm", "uuid"), []byte(uuid+"\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range slaves[name] {
+			if err := os.MkdirAll(filepath.Join(d, "slaves", s), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	old := sysDir
+	sysDir = dir
+	t.Cleanup(func() { sysDir = old })
+}
+
+func TestBlockDevEncrypted(t *testing.T) {
+	fakeSys(t, map[string]string{
+		// LUKS
+		"dm-0": "CRYPT-LUKS2-0123456789abcdef-luks",
+		// LVM on LUKS
+		"dm-1": "LVM-abc",
+		// LVM on a plain partition
+		"dm-2": "LVM-def",
+		// LVM on LUKS and a plain partition
+		"dm-3": "LVM-ghi",
+	}, map[string][]string{
+		"dm-1": {"dm-0"},
+		"dm-2": {"sda2"},
+		"dm-3": {"dm-0", "sdb1"},
+	})
+	cases := map[string]bool{
+		"dm-0":  true,
+		"dm-1":  true,
+		"dm-2":  false,
+		"dm-3":  false,
+		"dm-9":  false,
+		"zram0": true,
+		"sda2":  false,
+		"":      false,
+	}
+	for name, want := range cases {
+		if have := blockDevEncrypted(name); have != want {
+			t.Errorf("%q: have %v, want %v", name, have, want)
+		}
+	}
+}
+
+func TestHibernationEnabled(t *testing.T) {
+	cases := []struct {
+		state, disk string
+		want        bool
+	}{
+		{"freeze mem disk\n", "[platform] shutdown reboot suspend test_resume\n", true},
+		{"freeze mem disk\n", "[disabled]\n", false},
+		{"freeze mem\n", "[platform] shutdown\n", false},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		os.Mkdir(filepath.Join(dir, "power"), 0700)
+		os.WriteFile(filepath.Join(dir, "power", "state"), []byte(c.state), 0600)
+		os.WriteFile(filepath.Join(dir, "power", "disk"), []byte(c.disk), 0600)
+		old := sysDir
+		sysDir = dir
+		have := hibernationEnabled()
+		sysDir = old
+		if have != c.want {
+			t.Errorf("state=%q disk=%q: have %v, want %v", c.state, c.disk, have, c.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package doctor
+
+// The checks only know where Linux keeps this information
+
+func checkSwap() []Finding {
+	return nil
+}
+
+func checkCoreDumps() []Finding {
+	return nil
+}
+
+func checkFilesystem(cipherdir string) []Finding {
+	return nil
+}
+
+func checkFuse() []Finding {
+	return nil
+}
@@ -0,0 +1,44 @@
+package doctor
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/maclabel"
+)
+
+func TestSort(t *testing.T) {
+	f := []Finding{
+		{Severity: Info, Check: "a"},
+		{Severity: Error, Check: "b"},
+		{Severity: Warning, Check: "c"},
+		{Severity: Error, Check: "d"},
+	}
+	if w := Worst(f); w != Error {
+		t.Errorf("Worst: have %v", w)
+	}
+	Sort(f)
+	have := ""
+	for _, x := range f {
+		have += x.Check
+	}
+	if have != "bdca" {
+		t.Errorf("have order %q, want %q", have, "bdca")
+	}
+	if w := Worst(nil); w != Info {
+		t.Errorf("Worst(nil): have %v", w)
+	}
+}
+
+func TestCheckConfinement(t *testing.T) {
+	if f := checkConfinement(maclabel.Confinement{}); f != nil {
+		t.Errorf("no MAC: have %v", f)
+	}
+	f := checkConfinement(maclabel.Confinement{AppArmor: true, Context: "gocryptfs (enforce)"})
+	if len(f) != 1 || f[0].Advice != "" {
+		t.Errorf("confined: have %v", f)
+	}
+	f = checkConfinement(maclabel.Confinement{SELinux: "enforcing", Context: "unconfined_u:unconfined_r:unconfined_t:s0"})
+	if len(f) != 1 || f[0].Advice == "" {
+		t.Errorf("unconfined: have %v", f)
+	}
+}
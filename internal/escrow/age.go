@@ -0,0 +1,213 @@
+package escrow
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// This file implements the subset of the age format
+// (https://age-encryption.org/v1) that encrypting to a single X25519
+// recipient needs, so that "age -d" can decrypt the escrow blob.
+
+const (
+	// AgePublicKeyHRP is the bech32 human-readable part of age public keys
+	AgePublicKeyHRP = "age"
+	ageVersionLine  = "age-encryption.org/v1"
+	ageX25519Label  = "age-encryption.org/v1/X25519"
+	ageFileKeyLen   = 16
+	ageNonceLen     = 16
+	ageChunkSize    = 64 * 1024
+	ageArmorHeader  = "-----BEGIN AGE ENCRYPTED FILE-----"
+	ageArmorFooter  = "-----END AGE ENCRYPTED FILE-----"
+	ageArmorColumns = 64
+)
+
+var b64 = base64.RawStdEncoding
+
+// ageRecipient is an age X25519 public key, "age1..."
+type ageRecipient struct {
+	text      string
+	publicKey []byte
+}
+
+func parseAgeRecipient(s string) (*ageRecipient, error) {
+	hrp, data, err := bech32Decode(s)
+	if err != nil {
+		return nil, fmt.Errorf("age recipient %q: %v", s, err)
+	}
+	if hrp != AgePublicKeyHRP || len(data) != curve25519.PointSize {
+		return nil, fmt.Errorf("age recipient %q is not an X25519 public key", s)
+	}
+	return &ageRecipient{text: strings.ToLower(s), publicKey: data}, nil
+}
+
+// hkdf32 returns 32 bytes of HKDF-SHA256 output
+func hkdf32(secret []byte, salt []byte, info string) []byte {
+	out := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), out); err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// encrypt returns "plaintext" as an armored age file for the recipient
+func (r *ageRecipient) encrypt(plaintext []byte) (string, error) {
+	fileKey := cryptocore.RandBytes(ageFileKeyLen)
+	defer func() {
+		for i := range fileKey {
+			fileKey[i] = 0
+		}
+	}()
+	// X25519 recipient stanza
+	ephemeral := cryptocore.RandBytes(curve25519.ScalarSize)
+	share, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	shared, err := curve25519.X25519(ephemeral, r.publicKey)
+	if err != nil {
+		return "", err
+	}
+	salt := append(append([]byte{}, share...), r.publicKey...)
+	aead, err := chacha20poly1305.New(hkdf32(shared, salt, ageX25519Label))
+	if err != nil {
+		return "", err
+	}
+	body := aead.Seal(nil, make([]byte, chacha20poly1305.NonceSize), fileKey, nil)
+
+	var out bytes.Buffer
+	out.WriteString(ageVersionLine + "\n")
+	out.WriteString("-> X25519 " + b64.EncodeToString(share) + "\n")
+	// The body is shorter than a full 64-column line
+	out.WriteString(b64.EncodeToString(body) + "\n")
+	out.WriteString("---")
+	mac := hmac.New(sha256.New, hkdf32(fileKey, nil, "header"))
+	mac.Write(out.Bytes())
+	out.WriteString(" " + b64.EncodeToString(mac.Sum(nil)) + "\n")
+
+	// Payload: STREAM of 64 KiB chunks, the last one flagged
+	nonce := cryptocore.RandBytes(ageNonceLen)
+	out.Write(nonce)
+	aead, err = chacha20poly1305.New(hkdf32(fileKey, nonce, "payload"))
+	if err != nil {
+		return "", err
+	}
+	chunkNonce := make([]byte, chacha20poly1305.NonceSize)
+	for counter := uint64(0); ; counter++ {
+		n := len(plaintext)
+		if n > ageChunkSize {
+			n = ageChunkSize
+		}
+		last := n == len(plaintext)
+		binary.BigEndian.PutUint64(chunkNonce[3:11], counter)
+		if last {
+			chunkNonce[11] = 1
+		}
+		out.Write(aead.Seal(nil, chunkNonce, plaintext[:n], nil))
+		plaintext = plaintext[n:]
+		if last {
+			break
+		}
+	}
+	return ageArmor(out.Bytes()), nil
+}
+
+// ageArmor returns the ASCII armor of an age file
+func ageArmor(bin []byte) string {
+	enc := base64.StdEncoding.EncodeToString(bin)
+	var sb strings.Builder
+	sb.WriteString(ageArmorHeader + "\n")
+	for len(enc) > ageArmorColumns {
+		sb.WriteString(enc[:ageArmorColumns] + "\n")
+		enc = enc[ageArmorColumns:]
+	}
+	sb.WriteString(enc + "\n")
+	sb.WriteString(ageArmorFooter + "\n")
+	return sb.String()
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HRPExpand(hrp string) []byte {
+	out := make([]byte, 0, 2*len(hrp)+1)
+	for _, c := range []byte(hrp) {
+		out = append(out, c>>5)
+	}
+	out = append(out, 0)
+	for _, c := range []byte(hrp) {
+		out = append(out, c&31)
+	}
+	return out
+}
+
+// bech32Decode decodes a bech32 string (BIP 173) without the length limit,
+// like age does, and returns the human-readable part and the data as bytes
+func bech32Decode(s string) (hrp string, data []byte, err error) {
+	if strings.ToLower(s) != s && strings.ToUpper(s) != s {
+		return "", nil, fmt.Errorf("mixed case")
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, fmt.Errorf("invalid separator position")
+	}
+	hrp = s[:pos]
+	for _, c := range []byte(hrp) {
+		if c < 33 || c > 126 {
+			return "", nil, fmt.Errorf("invalid character in human-readable part")
+		}
+	}
+	var values []byte
+	for _, c := range []byte(s[pos+1:]) {
+		v := strings.IndexByte(bech32Charset, c)
+		if v < 0 {
+			return "", nil, fmt.Errorf("invalid character %q", c)
+		}
+		values = append(values, byte(v))
+	}
+	if bech32Polymod(append(bech32HRPExpand(hrp), values...)) != 1 {
+		return "", nil, fmt.Errorf("invalid checksum")
+	}
+	values = values[:len(values)-6]
+	// Convert from 5-bit to 8-bit groups
+	var acc, bits uint32
+	for _, v := range values {
+		acc = acc<<5 | uint32(v)
+		bits += 5
+		if bits >= 8 {
+			bits -= 8
+			data = append(data, byte(acc>>bits))
+		}
+	}
+	if bits >= 5 || acc&(1<<bits-1) != 0 {
+		return "", nil, fmt.Errorf("invalid padding")
+	}
+	return hrp, data, nil
+}
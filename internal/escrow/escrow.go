@@ -0,0 +1,63 @@
+// Package escrow encrypts copies of the master key to age and OpenPGP
+// public keys ("-init -key-escrow"), so that the master key can be
+// recovered with the matching private key alone.
+package escrow
+
+import (
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+)
+
+const (
+	// TypeAge is the configfile.KeyEscrow.Type of age recipients
+	TypeAge = "age"
+	// TypeOpenPGP is the configfile.KeyEscrow.Type of OpenPGP recipients
+	TypeOpenPGP = "openpgp"
+)
+
+// Recipient is an age public key or the OpenPGP public keys in a file
+type Recipient struct {
+	age *ageRecipient
+	pgp *pgpRecipient
+}
+
+// ParseRecipient parses an age public key ("age1...") or reads the OpenPGP
+// public keys from the file "s"
+func ParseRecipient(s string) (*Recipient, error) {
+	if strings.HasPrefix(strings.ToLower(s), AgePublicKeyHRP+"1") {
+		r, err := parseAgeRecipient(s)
+		if err != nil {
+			return nil, err
+		}
+		return &Recipient{age: r}, nil
+	}
+	r, err := parsePGPRecipient(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Recipient{pgp: r}, nil
+}
+
+// String returns the age public key or the OpenPGP fingerprints
+func (r *Recipient) String() string {
+	if r.age != nil {
+		return r.age.text
+	}
+	return r.pgp.String()
+}
+
+// Escrow encrypts "plaintext" to the recipient. Implements
+// configfile.EscrowRecipient.
+func (r *Recipient) Escrow(plaintext []byte) (configfile.KeyEscrow, error) {
+	e := configfile.KeyEscrow{Recipient: r.String()}
+	var err error
+	if r.age != nil {
+		e.Type = TypeAge
+		e.Blob, err = r.age.encrypt(plaintext)
+	} else {
+		e.Type = TypeOpenPGP
+		e.Blob, err = r.pgp.encrypt(plaintext)
+	}
+	return e, err
+}
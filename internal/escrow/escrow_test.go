@@ -0,0 +1,246 @@
+package escrow
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	//lint:ignore SA1019 See openpgp.go
+	"golang.org/x/crypto/openpgp"
+	//lint:ignore SA1019 See openpgp.go
+	"golang.org/x/crypto/openpgp/armor"
+	//lint:ignore SA1019 See openpgp.go
+	"golang.org/x/crypto/openpgp/packet"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// Valid strings from BIP 173
+func TestBech32Decode(t *testing.T) {
+	for _, s := range []string{
+		"A12UEL5L",
+		"a12uel5l",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	} {
+		if _, _, err := bech32Decode(s); err != nil {
+			t.Errorf("%q: %v", s, err)
+		}
+	}
+	for _, s := range []string{
+		"A12uEL5L",        // mixed case
+		"a12uel5m",        // checksum
+		"abcdef1qpzrz9x8", // checksum
+		"1pzry9x0s0muk",   // empty hrp
+		"a1b2c3d4e5f6",    // invalid character
+	} {
+		if _, _, err := bech32Decode(s); err == nil {
+			t.Errorf("%q was accepted", s)
+		}
+	}
+}
+
+// bech32Encode is the inverse of bech32Decode
+func bech32Encode(hrp string, data []byte) string {
+	var values []byte
+	var acc, bits uint32
+	for _, b := range data {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			values = append(values, byte(acc>>bits)&31)
+		}
+	}
+	if bits > 0 {
+		values = append(values, byte(acc<<(5-bits))&31)
+	}
+	polymod := bech32Polymod(append(append(bech32HRPExpand(hrp), values...), 0, 0, 0, 0, 0, 0)) ^ 1
+	for i := 0; i < 6; i++ {
+		values = append(values, byte(polymod>>(5*(5-i)))&31)
+	}
+	var sb strings.Builder
+	sb.WriteString(hrp + "1")
+	for _, v := range values {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
+
+// ageDecrypt decrypts an armored age file with an X25519 identity, following
+// the age specification independently of encrypt
+func ageDecrypt(t *testing.T, armored string, identity []byte) []byte {
+	lines := strings.Split(strings.TrimSpace(armored), "\n")
+	if lines[0] != ageArmorHeader || lines[len(lines)-1] != ageArmorFooter {
+		t.Fatalf("bad armor: %q", armored)
+	}
+	bin, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(bytes.NewReader(bin))
+	readLine := func() string {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSuffix(l, "\n")
+	}
+	var header strings.Builder
+	if l := readLine(); l != ageVersionLine {
+		t.Fatalf("version line %q", l)
+	}
+	header.WriteString(ageVersionLine + "\n")
+	stanza := readLine()
+	args := strings.Fields(stanza)
+	if len(args) != 3 || args[0] != "->" || args[1] != "X25519" {
+		t.Fatalf("stanza %q", stanza)
+	}
+	header.WriteString(stanza + "\n")
+	bodyLine := readLine()
+	header.WriteString(bodyLine + "\n")
+	macLine := readLine()
+	if !strings.HasPrefix(macLine, "--- ") {
+		t.Fatalf("mac line %q", macLine)
+	}
+	header.WriteString("---")
+
+	share, _ := b64.DecodeString(args[2])
+	body, _ := b64.DecodeString(bodyLine)
+	shared, err := curve25519.X25519(identity, share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := curve25519.X25519(identity, curve25519.Basepoint)
+	aead, _ := chacha20poly1305.New(hkdf32(shared, append(append([]byte{}, share...), pub...), ageX25519Label))
+	fileKey, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), body, nil)
+	if err != nil {
+		t.Fatalf("file key: %v", err)
+	}
+	mac := hmac.New(sha256.New, hkdf32(fileKey, nil, "header"))
+	mac.Write([]byte(header.String()))
+	want, _ := b64.DecodeString(strings.TrimPrefix(macLine, "--- "))
+	if !hmac.Equal(mac.Sum(nil), want) {
+		t.Fatal("header MAC mismatch")
+	}
+
+	payload, _ := io.ReadAll(r)
+	nonce, payload := payload[:ageNonceLen], payload[ageNonceLen:]
+	aead, _ = chacha20poly1305.New(hkdf32(fileKey, nonce, "payload"))
+	var out []byte
+	chunkNonce := make([]byte, chacha20poly1305.NonceSize)
+	for counter := byte(0); len(payload) > 0; counter++ {
+		n := len(payload)
+		if n > ageChunkSize+aead.Overhead() {
+			n = ageChunkSize + aead.Overhead()
+		}
+		chunkNonce[10] = counter
+		if n == len(payload) {
+			chunkNonce[11] = 1
+		}
+		p, err := aead.Open(nil, chunkNonce, payload[:n], nil)
+		if err != nil {
+			t.Fatalf("chunk %d: %v", counter, err)
+		}
+		out = append(out, p...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+func TestAge(t *testing.T) {
+	identity := cryptocore.RandBytes(curve25519.ScalarSize)
+	pub, _ := curve25519.X25519(identity, curve25519.Basepoint)
+	text := bech32Encode(AgePublicKeyHRP, pub)
+	r, err := ParseRecipient(strings.ToUpper(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.String() != text {
+		t.Errorf("String() = %q, want %q", r.String(), text)
+	}
+	for _, size := range []int{0, 65, ageChunkSize, ageChunkSize + 1} {
+		plaintext := bytes.Repeat([]byte{'k'}, size)
+		e, err := r.Escrow(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != TypeAge || e.Recipient != text {
+			t.Errorf("Type=%q Recipient=%q", e.Type, e.Recipient)
+		}
+		if have := ageDecrypt(t, e.Blob, identity); !bytes.Equal(have, plaintext) {
+			t.Errorf("size %d: content mismatch", size)
+		}
+	}
+	// The checksum protects against typos
+	typo := text[:10] + string(bech32Charset[(strings.IndexByte(bech32Charset, text[10])+1)%32]) + text[11:]
+	if _, err := ParseRecipient(typo); err == nil {
+		t.Error("typo was accepted")
+	}
+}
+
+func TestOpenPGP(t *testing.T) {
+	// Like keys made by gpg, the key needs hash preferences
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{DefaultHash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SerializePrivate signs the preferences, Serialize does not
+	var priv bytes.Buffer
+	if err = entity.SerializePrivate(&priv, nil); err != nil {
+		t.Fatal(err)
+	}
+	el, err := openpgp.ReadKeyRing(&priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entity = el[0]
+	var buf bytes.Buffer
+	w, _ := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err = entity.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	keyFile := filepath.Join(t.TempDir(), "key.asc")
+	if err = os.WriteFile(keyFile, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ParseRecipient(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("0123456789abcdef\n")
+	e, err := r.Escrow(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != TypeOpenPGP || e.Recipient != fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint) {
+		t.Errorf("Type=%q Recipient=%q", e.Type, e.Recipient)
+	}
+	block, err := armor.Decode(strings.NewReader(e.Blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := io.ReadAll(md.UnverifiedBody)
+	if err != nil || !bytes.Equal(have, plaintext) {
+		t.Fatalf("have %q, %v", have, err)
+	}
+	if _, err = ParseRecipient(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("missing key file was accepted")
+	}
+}
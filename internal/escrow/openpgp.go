@@ -0,0 +1,74 @@
+package escrow
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	//lint:ignore SA1019 Only used to encrypt to existing OpenPGP keys
+	"golang.org/x/crypto/openpgp"
+	//lint:ignore SA1019 See above
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+// pgpRecipient is the OpenPGP public key (or keys) in a key file
+type pgpRecipient struct {
+	entities openpgp.EntityList
+}
+
+// parsePGPRecipient reads the armored or binary OpenPGP public keys from
+// the file "path"
+func parsePGPRecipient(path string) (*pgpRecipient, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var el openpgp.EntityList
+	if bytes.Contains(buf, []byte("-----BEGIN PGP")) {
+		el, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(buf))
+	} else {
+		el, err = openpgp.ReadKeyRing(bytes.NewReader(buf))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(el) == 0 {
+		return nil, fmt.Errorf("%s: no OpenPGP public key found", path)
+	}
+	return &pgpRecipient{entities: el}, nil
+}
+
+// String returns the fingerprints of the keys
+func (r *pgpRecipient) String() string {
+	var fps []string
+	for _, e := range r.entities {
+		fps = append(fps, fmt.Sprintf("%X", e.PrimaryKey.Fingerprint))
+	}
+	return strings.Join(fps, ",")
+}
+
+// encrypt returns "plaintext" as an armored OpenPGP message for all keys
+// of the recipient
+func (r *pgpRecipient) encrypt(plaintext []byte) (string, error) {
+	var out bytes.Buffer
+	aw, err := armor.Encode(&out, "PGP MESSAGE", nil)
+	if err != nil {
+		return "", err
+	}
+	w, err := openpgp.Encrypt(aw, r.entities, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(plaintext); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	if err = aw.Close(); err != nil {
+		return "", err
+	}
+	out.WriteByte('\n')
+	return out.String(), nil
+}
@@ -72,6 +72,52 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// KeyHolder - the "-privsep" key-holder process could not be started
+	KeyHolder = 32
+	// Privileges - could not switch to the "-run-as" user
+	Privileges = 33
+	// WebDAV - the "-serve-webdav" server could not be started
+	WebDAV = 34
+	// NineP - the "-serve-9p" server could not be started
+	NineP = 35
+	// AccessPolicy - the "-access-policy" file could not be loaded
+	AccessPolicy = 36
+	// ConfTampered - the feature flags in the config file do not match
+	// their MAC
+	ConfTampered = 37
+	// Import - "-import" or "-export-fscrypt" could not open the source or
+	// target, or some files could not be copied
+	Import = 38
+	// NameTooLong - "-check-names" found names that cannot be stored
+	NameTooLong = 39
+	// MixedNormalization - "-check-normalization" found names that only
+	// differ in their Unicode normalization
+	MixedNormalization = 40
+	// Profiles - the PROFILES file of "-daemon" could not be loaded
+	Profiles = 41
+	// Archive - "-export", "-import archive" or "-verify-archive" failed,
+	// or the archive is damaged
+	Archive = 42
+	// TestVectors - "-selftest-vectors verify" found vectors that do not
+	// match this build, or could not read the file
+	TestVectors = 43
+	// Upstream - "-upstream-compat" was passed, but upstream gocryptfs
+	// cannot mount the filesystem, or the operation would change that
+	Upstream = 44
+	// Crash - a FUSE request handler has panicked. The filesystem has been
+	// unmounted, see the report in "-crash-dir".
+	Crash = 45
+	// Throttled - the unlock attempt was refused because of failed attempts
+	// before it, see "-throttle"
+	Throttled = 46
+	// KeyMismatch - the master key does not match the fingerprint in the
+	// config file or in CIPHERDIR
+	KeyMismatch = 47
+	// Doctor - "-doctor" found an error or a warning
+	Doctor = 48
+	// VerifyFailed - "-verify-on-mount" found damaged files or directories,
+	// or "-verify-checksums" found changes
+	VerifyFailed = 49
 )
 
 // Err wraps an error with an associated numeric exit code
@@ -88,6 +134,11 @@ func NewErr(msg string, code int) Err {
 	}
 }
 
+// Code returns the exit code
+func (e Err) Code() int {
+	return e.code
+}
+
 // Exit extracts the numeric exit code from "err" (if available) and exits the
 // application.
 func Exit(err error) {
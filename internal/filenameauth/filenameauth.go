@@ -6,6 +6,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
@@ -16,12 +17,30 @@ const (
 	FilenameAuthMACLen = 32 // SHA256 HMAC
 	// FilenameAuthSeparator is used to separate the encrypted name from the MAC
 	FilenameAuthSeparator = "."
+	// TagLen is the length of the truncated MAC that is embedded into the
+	// EME plaintext, see Tag().
+	TagLen = 16
 )
 
+// tagDomain separates embedded tags from the legacy MACs, which are computed
+// over base64 strings and can never contain a null byte.
+const tagDomain = "gocryptfs-filename-auth-v2\x00"
+
+// manifestDomain separates directory manifest MACs from the other MACs.
+const manifestDomain = "gocryptfs-dir-manifest-v1\x00"
+
+// dirIVDomain separates gocryptfs.diriv MACs from the other MACs.
+const dirIVDomain = "gocryptfs-diriv-auth-v1\x00"
+
 // FilenameAuth provides filename authentication functionality
 type FilenameAuth struct {
 	enabled bool
-	macKey  []byte
+	// embedded is set when the MAC is embedded into the encrypted name
+	// (Tag/VerifyTag) instead of being appended (AuthenticateFilename).
+	embedded bool
+	macKey   []byte
+	// macFunc, if set, is used instead of macKey. See NewWithMACFunc.
+	macFunc func(data []byte) []byte
 }
 
 // New creates a new FilenameAuth instance
@@ -38,11 +57,86 @@ func New(masterKey []byte, enabled bool) *FilenameAuth {
 	return fa
 }
 
+// NewEmbedded creates an enabled FilenameAuth instance whose MACs are
+// embedded into the encrypted name. This is the format used by filesystems
+// with the FilenameAuthEmbedded feature flag.
+func NewEmbedded(masterKey []byte) *FilenameAuth {
+	fa := New(masterKey, true)
+	fa.embedded = true
+	return fa
+}
+
+// NewWithMACFunc creates an enabled FilenameAuth instance that does not hold
+// the MAC key itself but calls macFunc to compute MACs. This is used by
+// "-privsep", where the key lives in the key-holder process.
+func NewWithMACFunc(macFunc func(data []byte) []byte, embedded bool) *FilenameAuth {
+	return &FilenameAuth{
+		enabled:  true,
+		embedded: embedded,
+		macFunc:  macFunc,
+	}
+}
+
 // IsEnabled returns whether filename authentication is enabled
 func (fa *FilenameAuth) IsEnabled() bool {
 	return fa.enabled
 }
 
+// IsEmbedded returns whether MACs are embedded into the encrypted name
+// instead of being appended to it.
+func (fa *FilenameAuth) IsEmbedded() bool {
+	return fa.enabled && fa.embedded
+}
+
+// Tag returns the truncated MAC over the directory IV and the plaintext
+// name. nametransform appends it to the name before EME encryption, so it
+// takes up no extra room in the ciphertext name beyond the EME blocks.
+//
+// Binding the directory IV means that an encrypted name cannot be moved to
+// another directory, like the EME tweak already guarantees for
+// unauthenticated names.
+func (fa *FilenameAuth) Tag(iv []byte, name []byte) []byte {
+	data := make([]byte, 0, len(tagDomain)+len(iv)+len(name))
+	data = append(data, tagDomain...)
+	data = append(data, iv...)
+	data = append(data, name...)
+	return fa.calculateMAC(data)[:TagLen]
+}
+
+// VerifyTag checks a tag returned by Tag in constant time.
+func (fa *FilenameAuth) VerifyTag(iv []byte, name []byte, tag []byte) error {
+	if !hmac.Equal(tag, fa.Tag(iv, name)) {
+		return fmt.Errorf("filename authentication failed: tag mismatch")
+	}
+	return nil
+}
+
+// ManifestMAC returns the MAC over the serialized directory manifest "body",
+// bound to the directory IV. See nametransform.Manifest.
+//
+// The body is hashed first so that the input has a fixed size no matter how
+// big the directory is, which keeps "-privsep" requests small.
+func (fa *FilenameAuth) ManifestMAC(iv []byte, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	data := make([]byte, 0, len(manifestDomain)+len(iv)+len(bodyHash))
+	data = append(data, manifestDomain...)
+	data = append(data, iv...)
+	data = append(data, bodyHash[:]...)
+	return fa.calculateMAC(data)
+}
+
+// DirIVMAC returns the MAC over a directory IV and its generation counter,
+// bound to "cName", the encrypted name of the directory in its parent. See
+// nametransform.VerifyDirIVAt.
+func (fa *FilenameAuth) DirIVMAC(cName string, iv []byte, gen uint64) []byte {
+	data := make([]byte, 0, len(dirIVDomain)+len(iv)+8+len(cName))
+	data = append(data, dirIVDomain...)
+	data = append(data, iv...)
+	data = binary.BigEndian.AppendUint64(data, gen)
+	data = append(data, cName...)
+	return fa.calculateMAC(data)
+}
+
 // AuthenticateFilename adds a MAC to an encrypted filename
 func (fa *FilenameAuth) AuthenticateFilename(encryptedName string) (string, error) {
 	if !fa.enabled {
@@ -93,6 +187,14 @@ func (fa *FilenameAuth) VerifyFilename(authenticatedName string) (string, error)
 
 // calculateMAC calculates HMAC-SHA256 of the given data
 func (fa *FilenameAuth) calculateMAC(data []byte) []byte {
+	if fa.macFunc != nil {
+		return fa.macFunc(data)
+	}
+	return fa.MAC(data)
+}
+
+// MAC calculates HMAC-SHA256 of the given data using the local MAC key.
+func (fa *FilenameAuth) MAC(data []byte) []byte {
 	h := hmac.New(sha256.New, fa.macKey)
 	h.Write(data)
 	return h.Sum(nil)
@@ -100,10 +202,7 @@ func (fa *FilenameAuth) calculateMAC(data []byte) []byte {
 
 // deriveFilenameMACKey derives a MAC key from the master key using HKDF
 func deriveFilenameMACKey(masterKey []byte) []byte {
-	// Use HKDF to derive a key specifically for filename authentication
-	// This ensures the MAC key is different from other derived keys
-	info := []byte("gocryptfs-filename-auth-v1")
-	return cryptocore.HKDFDerive(masterKey, info, FilenameAuthMACLen)
+	return cryptocore.DeriveKey(masterKey, cryptocore.KeyFilenameAuth)
 }
 
 // splitAuthenticatedName splits an authenticated filename into encrypted name and MAC
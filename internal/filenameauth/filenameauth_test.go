@@ -185,3 +185,33 @@ func BenchmarkFilenameAuthDisabled(b *testing.B) {
 		fa.VerifyFilename(authenticatedName)
 	}
 }
+
+func TestTag(t *testing.T) {
+	masterKey := make([]byte, 32)
+	fa := NewEmbedded(masterKey)
+	if !fa.IsEmbedded() {
+		t.Error("NewEmbedded should return an embedded instance")
+	}
+	if New(masterKey, true).IsEmbedded() {
+		t.Error("New should return a legacy instance")
+	}
+	iv := make([]byte, 16)
+	tag := fa.Tag(iv, []byte("foo"))
+	if len(tag) != TagLen {
+		t.Fatalf("wrong tag length %d", len(tag))
+	}
+	if err := fa.VerifyTag(iv, []byte("foo"), tag); err != nil {
+		t.Error(err)
+	}
+	if err := fa.VerifyTag(iv, []byte("bar"), tag); err == nil {
+		t.Error("tag of another name was accepted")
+	}
+	iv[0] = 1
+	if err := fa.VerifyTag(iv, []byte("foo"), tag); err == nil {
+		t.Error("tag with another IV was accepted")
+	}
+	// Tags must not collide with legacy MACs over the same bytes
+	if string(fa.MAC([]byte("foo"))[:TagLen]) == string(fa.Tag(nil, []byte("foo"))) {
+		t.Error("tag equals legacy MAC")
+	}
+}
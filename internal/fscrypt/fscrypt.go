@@ -0,0 +1,48 @@
+// Package fscrypt sets up directories that are encrypted by the kernel
+// ("fscrypt", the native encryption of ext4, f2fs and ubifs). Only v2
+// encryption policies with a raw 64-byte key are supported, like the
+// "fscryptctl" tool uses them. Keys that are wrapped by the protectors of
+// the "fscrypt" tool are not.
+package fscrypt
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// KeyLen is the length of an fscrypt master key
+const KeyLen = 64
+
+// ErrUnsupported is returned on platforms without fscrypt
+var ErrUnsupported = errors.New("fscrypt is only supported on Linux")
+
+// ErrNotEncrypted is returned by GetPolicy for directories without an
+// encryption policy
+var ErrNotEncrypted = errors.New("directory is not encrypted")
+
+// Identifier identifies a master key. The kernel derives it from the key.
+type Identifier [16]byte
+
+// String returns the hex encoding that "fscryptctl" uses
+func (id Identifier) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// ReadKeyFile reads a raw master key from "path". The file must contain
+// exactly KeyLen bytes, as created by
+// "head -c 64 /dev/urandom > KEYFILE".
+func ReadKeyFile(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeyLen {
+		for i := range key {
+			key[i] = 0
+		}
+		return nil, fmt.Errorf("%s: fscrypt key must be %d bytes, file has %d", path, KeyLen, len(key))
+	}
+	return key, nil
+}
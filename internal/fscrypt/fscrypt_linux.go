@@ -0,0 +1,88 @@
+package fscrypt
+
+import (
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// addKeyArg is struct fscrypt_add_key_arg followed by the raw key
+type addKeyArg struct {
+	unix.FscryptAddKeyArg
+	raw [KeyLen]byte
+}
+
+// ioctl opens "dir" and runs the ioctl "req" on it
+func ioctl(dir string, req uintptr, arg unsafe.Pointer) error {
+	fd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), req, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// AddKey adds "key" to the filesystem that contains "dir", which unlocks
+// all directories whose policy uses this key. Returns the key identifier.
+// Does not need root.
+func AddKey(dir string, key []byte) (id Identifier, err error) {
+	var arg addKeyArg
+	defer func() {
+		for i := range arg.raw {
+			arg.raw[i] = 0
+		}
+	}()
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	arg.Raw_size = uint32(copy(arg.raw[:], key))
+	if err = ioctl(dir, unix.FS_IOC_ADD_ENCRYPTION_KEY, unsafe.Pointer(&arg)); err != nil {
+		return id, err
+	}
+	copy(id[:], arg.Key_spec.U[:])
+	return id, nil
+}
+
+// RemoveKey removes our claim on the key "id" from the filesystem that
+// contains "dir". The directories that use it are locked once no other
+// user has added the key and no file is open.
+func RemoveKey(dir string, id Identifier) error {
+	var arg unix.FscryptRemoveKeyArg
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	copy(arg.Key_spec.U[:], id[:])
+	return ioctl(dir, unix.FS_IOC_REMOVE_ENCRYPTION_KEY, unsafe.Pointer(&arg))
+}
+
+// SetPolicy encrypts the empty directory "dir" and everything that is
+// created below it with the key "id", using AES-256-XTS for the contents
+// and AES-256-CTS for the names, like "fscryptctl set_policy" does.
+func SetPolicy(dir string, id Identifier) error {
+	p := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAGS_PAD_32,
+		Master_key_identifier:     id,
+	}
+	return ioctl(dir, unix.FS_IOC_SET_ENCRYPTION_POLICY, unsafe.Pointer(&p))
+}
+
+// GetPolicy returns the key identifier of the encryption policy of "dir".
+// Returns ErrNotEncrypted if "dir" has no policy.
+func GetPolicy(dir string) (id Identifier, err error) {
+	arg := unix.FscryptGetPolicyExArg{Size: uint64(unsafe.Sizeof(unix.FscryptPolicyV2{}))}
+	err = ioctl(dir, unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg))
+	if err == syscall.ENODATA {
+		return id, ErrNotEncrypted
+	} else if err != nil {
+		return id, err
+	}
+	p := (*unix.FscryptPolicyV2)(unsafe.Pointer(&arg.Policy))
+	if p.Version != unix.FSCRYPT_POLICY_V2 {
+		return id, syscall.EINVAL
+	}
+	return p.Master_key_identifier, nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package fscrypt
+
+// AddKey returns ErrUnsupported on non-Linux platforms.
+func AddKey(dir string, key []byte) (Identifier, error) {
+	return Identifier{}, ErrUnsupported
+}
+
+// RemoveKey returns ErrUnsupported on non-Linux platforms.
+func RemoveKey(dir string, id Identifier) error {
+	return ErrUnsupported
+}
+
+// SetPolicy returns ErrUnsupported on non-Linux platforms.
+func SetPolicy(dir string, id Identifier) error {
+	return ErrUnsupported
+}
+
+// GetPolicy returns ErrUnsupported on non-Linux platforms.
+func GetPolicy(dir string) (Identifier, error) {
+	return Identifier{}, ErrUnsupported
+}
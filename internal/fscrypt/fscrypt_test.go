@@ -0,0 +1,31 @@
+package fscrypt
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadKeyFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(fn, make([]byte, KeyLen-1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadKeyFile(fn); err == nil {
+		t.Error("short key accepted")
+	}
+	if err := os.WriteFile(fn, make([]byte, KeyLen), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := ReadKeyFile(fn); err != nil || len(key) != KeyLen {
+		t.Errorf("len=%d err=%v", len(key), err)
+	}
+}
+
+func TestGetPolicyNotEncrypted(t *testing.T) {
+	_, err := GetPolicy(t.TempDir())
+	t.Logf("GetPolicy: %v", err)
+	if err == nil {
+		t.Error("temporary directory should not be encrypted")
+	}
+}
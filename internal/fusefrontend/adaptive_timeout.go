@@ -0,0 +1,176 @@
+package fusefrontend
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// adaptiveHotWindow is how long a directory counts as hot after it changed.
+// The kernel gets zero timeouts for the entries of hot directories.
+const adaptiveHotWindow = time.Second
+
+// dirActivityMaxEntries is the number of tracked directories at which
+// dirActivity drops the directories that have been quiet for long.
+const dirActivityMaxEntries = 100000
+
+type dirActivityEntry struct {
+	// changed is the time of the last change of the directory
+	changed time.Time
+	// granted is true if the kernel got a nonzero timeout for an entry of
+	// the directory since the last change
+	granted bool
+}
+
+// dirActivity tracks when directories last changed, for "-adaptive-timeout".
+// The longer a directory has been quiet, the longer the kernel may cache its
+// entries and their attributes, up to "max".
+type dirActivity struct {
+	sync.Mutex
+	max time.Duration
+	// start is the time of the mount. Directories that we have not seen change
+	// count as changed at that time.
+	start time.Time
+	// dirs maps directory inode numbers to their activity
+	dirs map[uint64]*dirActivityEntry
+}
+
+func newDirActivity(max time.Duration) *dirActivity {
+	return &dirActivity{
+		max:   max,
+		start: time.Now(),
+		dirs:  make(map[uint64]*dirActivityEntry),
+	}
+}
+
+// timeout returns the cache timeout for the entries of directory "dirIno":
+// zero if it changed within adaptiveHotWindow, otherwise half the time it
+// has been quiet, but at most "max".
+func (a *dirActivity) timeout(dirIno uint64) time.Duration {
+	a.Lock()
+	defer a.Unlock()
+	e := a.dirs[dirIno]
+	changed := a.start
+	if e != nil {
+		changed = e.changed
+	}
+	quiet := time.Since(changed)
+	if quiet < adaptiveHotWindow {
+		return 0
+	}
+	t := quiet / 2
+	if t > a.max {
+		t = a.max
+	}
+	if e == nil {
+		a.prune()
+		e = &dirActivityEntry{changed: changed}
+		a.dirs[dirIno] = e
+	}
+	e.granted = true
+	return t
+}
+
+// changed marks directory "dirIno" as hot. Returns true if the kernel may
+// still hold entries of the directory with a nonzero timeout, which must
+// then be invalidated.
+func (a *dirActivity) changed(dirIno uint64) (granted bool) {
+	a.Lock()
+	defer a.Unlock()
+	e := a.dirs[dirIno]
+	if e == nil {
+		a.prune()
+		e = &dirActivityEntry{}
+		a.dirs[dirIno] = e
+	}
+	granted = e.granted
+	e.changed = time.Now()
+	e.granted = false
+	return granted
+}
+
+// prune drops the directories that would get "max" anyway when the map is
+// full. Directories with granted timeouts are kept so they are invalidated
+// on their next change. Must be called with the lock held.
+func (a *dirActivity) prune() {
+	if len(a.dirs) < dirActivityMaxEntries {
+		return
+	}
+	for ino, e := range a.dirs {
+		if !e.granted && time.Since(e.changed) >= 2*a.max {
+			delete(a.dirs, ino)
+		}
+	}
+}
+
+// parentIno returns the inode number of the directory containing "n", or of
+// "n" itself for the root directory.
+func (n *Node) parentIno() uint64 {
+	if _, p := n.Parent(); p != nil {
+		return p.StableAttr().Ino
+	}
+	return n.StableAttr().Ino
+}
+
+// attrTimeout returns the attribute timeout for "attr", an entry of
+// directory "dirIno". The attributes of a directory also change with its
+// entries.
+func (a *dirActivity) attrTimeout(dirIno uint64, attr *fuse.Attr) time.Duration {
+	t := a.timeout(dirIno)
+	if attr.IsDir() && attr.Ino != dirIno {
+		if t2 := a.timeout(attr.Ino); t2 < t {
+			t = t2
+		}
+	}
+	return t
+}
+
+// setEntryTimeout sets the entry and attribute timeouts of "out", which
+// describes an entry of directory "n", if there is a dirActivity.
+func (n *Node) setEntryTimeout(out *fuse.EntryOut) {
+	a := n.rootNode().dirActivity
+	if a == nil {
+		return
+	}
+	out.SetEntryTimeout(a.timeout(n.StableAttr().Ino))
+	out.SetAttrTimeout(a.attrTimeout(n.StableAttr().Ino, &out.Attr))
+}
+
+// setAttrTimeout sets the attribute timeout of "out", which describes "n",
+// if there is a dirActivity.
+func (n *Node) setAttrTimeout(out *fuse.AttrOut) {
+	a := n.rootNode().dirActivity
+	if a == nil {
+		return
+	}
+	out.SetTimeout(a.attrTimeout(n.parentIno(), &out.Attr))
+}
+
+// dirChanged must be called after "name" in directory "n" has been created,
+// deleted or renamed. If the kernel may still cache entries of "n", they
+// are invalidated.
+func (n *Node) dirChanged(name string) {
+	a := n.rootNode().dirActivity
+	if a == nil || !a.changed(n.StableAttr().Ino) {
+		return
+	}
+	// The kernel holds the directory lock while it waits for our reply, and
+	// the notifications need that lock as well.
+	go func() {
+		n.NotifyEntry(name)
+		n.NotifyContent(0, 0)
+	}()
+}
+
+// dirChangedPath is dirChanged for changes that did not come through FUSE.
+// "dir" is the plaintext path of the directory. Directories the kernel does
+// not know cannot have cached entries and are skipped.
+func (rn *RootNode) dirChangedPath(dir string, name string) {
+	if rn.dirActivity == nil {
+		return
+	}
+	if inode := rn.knownInode(dir); inode != nil {
+		toNode(inode.Operations()).dirChanged(name)
+	}
+}
@@ -0,0 +1,41 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDirActivity(t *testing.T) {
+	a := newDirActivity(time.Minute)
+	// Right after mount, everything is hot
+	if to := a.timeout(1); to != 0 {
+		t.Errorf("fresh mount: timeout %v", to)
+	}
+	a.start = a.start.Add(-time.Hour)
+	if to := a.timeout(1); to != time.Minute {
+		t.Errorf("quiet dir: want %v, got %v", time.Minute, to)
+	}
+	if !a.changed(1) {
+		t.Error("timeout was granted, but changed() returned false")
+	}
+	if to := a.timeout(1); to != 0 {
+		t.Errorf("hot dir: timeout %v", to)
+	}
+	if a.changed(1) {
+		t.Error("no timeout was granted, but changed() returned true")
+	}
+	// Quiet for 10s gives 5s
+	a.dirs[1].changed = time.Now().Add(-10 * time.Second)
+	if to := a.timeout(1); to < 4*time.Second || to > 6*time.Second {
+		t.Errorf("dir quiet for 10s: timeout %v", to)
+	}
+	// A directory's own attributes follow its entries
+	a.changed(2)
+	attr := fuse.Attr{Ino: 2, Mode: syscall.S_IFDIR}
+	if to := a.attrTimeout(1, &attr); to != 0 {
+		t.Errorf("hot subdir: attr timeout %v", to)
+	}
+}
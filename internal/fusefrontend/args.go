@@ -1,7 +1,12 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 )
 
 // Args is a container for arguments that are passed from main() to fusefrontend
@@ -51,4 +56,101 @@ type Args struct {
 	OneFileSystem bool
 	// DeterministicNames disables gocryptfs.diriv files
 	DeterministicNames bool
+	// DirManifest enables the gocryptfs.manifest directory manifests,
+	// see nametransform.Manifest
+	DirManifest bool
+	// XattrAuth binds encrypted xattr values to the file they belong to,
+	// see Node.xattrID
+	XattrAuth bool
+	// AuthTimes keeps an authenticated copy of the mtime of each regular
+	// file, see Node.recordTimes
+	AuthTimes bool
+	// LongSymlinks stores symlink targets that are longer than
+	// nametransform.SymlinkMax once encrypted in a separate file, see
+	// nametransform.WriteLongSymlink
+	LongSymlinks bool
+	// AuthLinks keeps an authenticated copy of the link count of each
+	// regular file, see Node.recordLinks. In reverse mode, it derives the
+	// IVs of hard-linked files from the inode, so that all links have the
+	// same ciphertext.
+	AuthLinks bool
+	// RestoreTimes sets the mtime back to the authenticated copy when it
+	// was changed behind our back, enabled via "-restore-times"
+	RestoreTimes bool
+	// EncryptACL stores ACLs and security.capability encrypted like other
+	// xattrs instead of passing them through, enabled via "-encrypt-acl"
+	EncryptACL bool
+	// XattrAllow and XattrDeny are the patterns of "-xattr-allow" and
+	// "-xattr-deny", see RootNode.xattrBlocked
+	XattrAllow []string
+	XattrDeny  []string
+	// ForbiddenNames are the glob patterns of "-forbid-name", see
+	// RootNode.checkForbiddenName
+	ForbiddenNames []string
+	// ReverseRW allows writes to the encrypted view in reverse mode, enabled
+	// via "-reverse-rw".
+	ReverseRW bool
+	// ChunkSize splits large files into chunks of about this many bytes
+	// in reverse mode, enabled via "-chunk-size". Zero means no chunking.
+	ChunkSize uint64
+	// Trash makes Unlink move files to the trash, where they are kept for
+	// this long, enabled via "-trash". Zero disables the trash.
+	Trash time.Duration
+	// Scrub makes a background scrubber check all of CIPHERDIR, with this
+	// much time between the passes, enabled via "-scrub". Zero disables
+	// the scrubber.
+	Scrub time.Duration
+	// ScrubBandwidth is how many bytes per second the scrubber reads at
+	// most, set via "-scrub-bw"
+	ScrubBandwidth int64
+	// AccessPolicy restricts access to plaintext subtrees by UID and GID,
+	// enabled via "-access-policy". Nil means no restrictions.
+	AccessPolicy *accesspolicy.Policy
+	// CaseInsensitive makes name lookups ignore case while preserving the
+	// case of new names, enabled via "-case-insensitive"
+	CaseInsensitive bool
+	// CaseFold additionally stores new names in lower case, enabled via
+	// "-case-fold". Implies CaseInsensitive.
+	CaseFold bool
+	// Normalization converts plaintext names to NFC or NFD before they are
+	// looked up or created, enabled via "-nfc" or "-nfd". Names stored in
+	// the other form are still found.
+	Normalization nametransform.Normalization
+	// StableInodes derives inode numbers from the file handles of the
+	// backing files, so they stay the same across mounts, enabled via
+	// "-stable-inodes"
+	StableInodes bool
+	// Supervise pauses the mount while CIPHERDIR is unavailable, like a
+	// network share that has gone away, and resumes when it is back,
+	// enabled via "-supervise"
+	Supervise bool
+	// OnCorruption is what to do after CorruptionLimit integrity failures:
+	// CorruptionContinue, CorruptionReadOnly or CorruptionUnmount. Set via
+	// "-on-corruption".
+	OnCorruption string
+	// CorruptionLimit is the number of integrity failures that triggers
+	// OnCorruption, set via "-corruption-limit"
+	CorruptionLimit int
+	// NameCacheSize is the number of decrypted directory entry names to
+	// cache, set via "-namecache-size". Zero disables the cache.
+	NameCacheSize int
+	// NegativeTimeout is how long Lookup remembers names that do not exist,
+	// set via "-negative-timeout". Zero disables the negative cache.
+	NegativeTimeout time.Duration
+	// AdaptiveTimeout is the longest attribute and entry timeout the kernel
+	// gets for quiet directories, set via "-adaptive-timeout". Zero means
+	// fixed timeouts.
+	AdaptiveTimeout time.Duration
+	// IOEngine is "uring" to read and write ciphertext through io_uring,
+	// set via "-io-engine". Anything else means pread/pwrite.
+	IOEngine string
+	// DirectIO is the "-direct-io" policy, see DirectIOAuto
+	DirectIO string
+	// Statfs is "raw" to report the free space of the backing filesystem
+	// as it is, see StatfsAdjusted
+	Statfs string
+	// OpWorkers maps operation classes like "read" or "fsync" to the
+	// number of workers that serve them, set via "-op-workers".
+	// Operation classes that are not in the map are not limited.
+	OpWorkers map[string]int
 }
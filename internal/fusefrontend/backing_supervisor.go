@@ -0,0 +1,158 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// probeTimeout is how long a probe may take before CIPHERDIR counts as
+// unavailable. A hard-mounted NFS share that has gone away blocks forever.
+const probeTimeout = 5 * time.Second
+
+// backingSupervisor implements "-supervise". It notices when CIPHERDIR
+// becomes unavailable, lets operations fail with EAGAIN meanwhile, and
+// resumes when CIPHERDIR is back.
+type backingSupervisor struct {
+	cipherdir string
+	// fingerprint identifies our CIPHERDIR, so we do not resume on the
+	// empty directory that is left when a removable drive is unmounted
+	fingerprint []byte
+	// interval is the time between probes while CIPHERDIR is unavailable
+	interval time.Duration
+	// onResume is called before operations resume
+	onResume func()
+	down     atomic.Bool
+	// mu protects "running"
+	mu sync.Mutex
+	// running is the probe in progress, nil if there is none. There is
+	// at most one, so a blocking backing filesystem does not pile up
+	// goroutines.
+	running *probe
+}
+
+// probe is a check of CIPHERDIR. "ok" is valid after "done" is closed.
+type probe struct {
+	done chan struct{}
+	ok   bool
+}
+
+func newBackingSupervisor(cipherdir string, onResume func()) (*backingSupervisor, error) {
+	fp, err := readFingerprint(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	return &backingSupervisor{
+		cipherdir:   cipherdir,
+		fingerprint: fp,
+		interval:    time.Second,
+		onResume:    onResume,
+	}, nil
+}
+
+// readFingerprint returns the contents of the "gocryptfs.diriv" file in
+// "cipherdir". With -plaintextnames there is none, and we use the inode
+// number of "cipherdir" and the type of the filesystem.
+func readFingerprint(cipherdir string) ([]byte, error) {
+	fp, err := os.ReadFile(filepath.Join(cipherdir, nametransform.DirIVFilename))
+	if err == nil || !os.IsNotExist(err) {
+		return fp, err
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(cipherdir, &st); err != nil {
+		return nil, err
+	}
+	var sfs syscall.Statfs_t
+	if err = syscall.Statfs(cipherdir, &sfs); err != nil {
+		return nil, err
+	}
+	fp = binary.LittleEndian.AppendUint64(nil, uint64(st.Ino))
+	return binary.LittleEndian.AppendUint64(fp, uint64(sfs.Type)), nil
+}
+
+// available probes CIPHERDIR and returns false if it is unavailable, or
+// if the probe takes longer than probeTimeout.
+func (s *backingSupervisor) available() bool {
+	s.mu.Lock()
+	p := s.running
+	if p == nil {
+		p = &probe{done: make(chan struct{})}
+		s.running = p
+		go func() {
+			fp, err := readFingerprint(s.cipherdir)
+			p.ok = err == nil && bytes.Equal(fp, s.fingerprint)
+			s.mu.Lock()
+			s.running = nil
+			s.mu.Unlock()
+			close(p.done)
+		}()
+	}
+	s.mu.Unlock()
+	select {
+	case <-p.done:
+		return p.ok
+	case <-time.After(probeTimeout):
+		return false
+	}
+}
+
+// paused returns EAGAIN while CIPHERDIR is unavailable
+func (s *backingSupervisor) paused() syscall.Errno {
+	if s.down.Load() {
+		return syscall.EAGAIN
+	}
+	return 0
+}
+
+// check looks at an error from the backing filesystem. If it may mean that
+// CIPHERDIR has gone away and a probe confirms it, the mount is paused
+// until CIPHERDIR is back, and EAGAIN is returned instead of "errno".
+func (s *backingSupervisor) check(errno syscall.Errno) syscall.Errno {
+	switch errno {
+	case syscall.ENOTCONN, syscall.EIO, syscall.ESTALE, syscall.ENODEV, syscall.ENXIO,
+		syscall.EHOSTDOWN, syscall.ETIMEDOUT, syscall.ENOENT:
+	default:
+		return errno
+	}
+	if s.down.Load() {
+		return syscall.EAGAIN
+	}
+	if s.available() {
+		return errno
+	}
+	if s.down.CompareAndSwap(false, true) {
+		tlog.Warn.Printf("CIPHERDIR %s is unavailable (%v). Operations fail with EAGAIN until it is back.",
+			s.cipherdir, errno)
+		go s.waitForResume()
+	}
+	return syscall.EAGAIN
+}
+
+// waitForResume probes CIPHERDIR until it is back and then resumes
+// operations
+func (s *backingSupervisor) waitForResume() {
+	for !s.available() {
+		time.Sleep(s.interval)
+	}
+	s.onResume()
+	s.down.Store(false)
+	tlog.Info.Printf("CIPHERDIR %s is back, resuming. Files that were open have to be reopened.", s.cipherdir)
+}
+
+// supervise replaces "*errno" by EAGAIN if it means that CIPHERDIR has
+// gone away. Used as "defer rn.supervise(&errno)" in the operations that
+// touch the backing files. These return ENOENT for every name that does
+// not exist, so only prepareAtSyscall treats ENOENT as suspicious.
+func (rn *RootNode) supervise(errno *syscall.Errno) {
+	if rn.supervisor != nil && *errno != 0 && *errno != syscall.ENOENT {
+		*errno = rn.supervisor.check(*errno)
+	}
+}
@@ -0,0 +1,99 @@
+package fusefrontend
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+func TestBackingSupervisor(t *testing.T) {
+	cipherdir := t.TempDir() + "/cipher"
+	if err := os.Mkdir(cipherdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(cipherdir, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resumed atomic.Bool
+	s, err := newBackingSupervisor(cipherdir, func() { resumed.Store(true) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.interval = 10 * time.Millisecond
+	// An error from a healthy CIPHERDIR is passed through
+	if errno := s.check(syscall.EIO); errno != syscall.EIO {
+		t.Errorf("healthy: have %v", errno)
+	}
+	// The drive is unmounted and leaves an empty directory behind
+	if err = os.Rename(cipherdir, cipherdir+".away"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(cipherdir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if errno := s.check(syscall.ENOENT); errno != syscall.EAGAIN {
+		t.Errorf("unavailable: have %v", errno)
+	}
+	if s.paused() != syscall.EAGAIN {
+		t.Error("operations are not paused")
+	}
+	// Other errors are not touched
+	if errno := s.check(syscall.EACCES); errno != syscall.EACCES {
+		t.Errorf("EACCES: have %v", errno)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if resumed.Load() {
+		t.Fatal("resumed on the wrong directory")
+	}
+	// The drive is back
+	os.Remove(cipherdir)
+	if err = os.Rename(cipherdir+".away", cipherdir); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; s.paused() != 0; i++ {
+		if i > 200 {
+			t.Fatal("timeout waiting for resume")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !resumed.Load() {
+		t.Error("onResume was not called")
+	}
+}
+
+// Without gocryptfs.diriv, an empty directory at the same path has a
+// different fingerprint
+func TestReadFingerprintPlaintextNames(t *testing.T) {
+	dir := t.TempDir() + "/plain"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fp1, err := readFingerprint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the old directory so its inode number is not reused
+	if err = os.Rename(dir, dir+".old"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fp2, err := readFingerprint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fp1) == string(fp2) {
+		t.Error("fingerprints are the same")
+	}
+}
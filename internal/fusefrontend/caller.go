@@ -0,0 +1,27 @@
+package fusefrontend
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// callerInternal describes requests that do not come from the kernel, but
+// from gocryptfs itself
+const callerInternal = "internal"
+
+// callerString describes the process that sent the FUSE request in "ctx"
+// for log messages, like "uid=1000 gid=1000 pid=4242", so that
+// administrators can see who triggered an integrity failure or was denied
+// access.
+func callerString(ctx context.Context) string {
+	if ctx == nil {
+		return callerInternal
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return callerInternal
+	}
+	return fmt.Sprintf("uid=%d gid=%d pid=%d", caller.Uid, caller.Gid, caller.Pid)
+}
@@ -0,0 +1,21 @@
+package fusefrontend
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestCallerString(t *testing.T) {
+	if s := callerString(context.Background()); s != callerInternal {
+		t.Errorf("no caller: have %q", s)
+	}
+	ctx := fuse.NewContext(context.Background(), &fuse.Caller{
+		Owner: fuse.Owner{Uid: 1000, Gid: 100},
+		Pid:   4242,
+	})
+	if s := callerString(ctx); s != "uid=1000 gid=100 pid=4242" {
+		t.Errorf("have %q", s)
+	}
+}
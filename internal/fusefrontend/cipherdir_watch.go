@@ -0,0 +1,121 @@
+package fusefrontend
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// watchOp is the kind of change "-watch-cipherdir" has seen in CIPHERDIR
+type watchOp int
+
+const (
+	// watchCreate: the entry has been created or renamed into the directory
+	watchCreate watchOp = iota
+	// watchDelete: the entry has been deleted or renamed out of the directory
+	watchDelete
+	// watchChange: the content or the attributes of the entry have changed
+	watchChange
+)
+
+// knownInode returns the inode of the plaintext path "plainPath", or nil if
+// the kernel has not looked it up. Inodes the kernel does not know cannot
+// be cached by it.
+func (rn *RootNode) knownInode(plainPath string) *fs.Inode {
+	inode := rn.EmbeddedInode()
+	for _, c := range strings.Split(plainPath, "/") {
+		if c == "" {
+			continue
+		}
+		if inode = inode.GetChild(c); inode == nil {
+			return nil
+		}
+	}
+	return inode
+}
+
+// cipherdirChanged invalidates what the kernel may cache about the entry
+// "cName" in directory "cDir" (relative to CIPHERDIR) after it has been
+// changed by another program. Deletions are sent with NotifyDelete, which
+// also generates IN_DELETE for inotify watchers on the mountpoint.
+//
+// Names that do not decrypt, like gocryptfs.diriv, or long names whose
+// ".name" file is already gone, only invalidate the directory listing.
+// Files that are open through the mount re-read their header, see
+// reloadOpenFile.
+func (rn *RootNode) cipherdirChanged(cDir string, cName string, op watchOp, isDir bool) {
+	if op == watchChange && !isDir {
+		rn.reloadOpenFile(path.Join(cDir, cName))
+	}
+	if isDir && op != watchChange {
+		// Cached directory fds may point to the old directory
+		rn.dirCache.Clear()
+	}
+	pDir, err := rn.DecryptPath(cDir)
+	if err != nil {
+		tlog.Debug.Printf("cipherdirChanged: cannot decrypt %q: %v", cDir, err)
+		return
+	}
+	dir := rn.knownInode(pDir)
+	if dir == nil {
+		return
+	}
+	dirNode := toNode(dir.Operations())
+	name := ""
+	if pPath, err := rn.DecryptPath(path.Join(cDir, cName)); err == nil {
+		name = path.Base(pPath)
+	}
+	tlog.Debug.Printf("cipherdirChanged: dir=%q name=%q op=%d", pDir, name, op)
+	if op == watchChange {
+		if name == "" {
+			return
+		}
+		if child := dir.GetChild(name); child != nil {
+			child.NotifyContent(0, 0)
+		}
+		return
+	}
+	if rn.dirActivity != nil {
+		rn.dirActivity.changed(dir.StableAttr().Ino)
+	}
+	if name != "" {
+		dirNode.forgetNegative(name)
+		if child := dir.GetChild(name); child != nil && op == watchDelete {
+			dir.NotifyDelete(name, child)
+		} else {
+			dir.NotifyEntry(name)
+		}
+	}
+	// Directory listing, mtime and link count
+	dir.NotifyContent(0, 0)
+}
+
+// reloadOpenFile makes the open file "cPath" (relative to CIPHERDIR) read
+// its header again after another program, like a sync client, has written
+// to it. The new content may have a new file ID, and the old ID would make
+// every block fail to decrypt. Taking the lock counts as a write, which
+// drops the tail blocks that the file handles cache.
+func (rn *RootNode) reloadOpenFile(cPath string) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(filepath.Join(rn.args.Cipherdir, cPath), &st); err != nil {
+		return
+	}
+	e := openfiletable.Lookup(inomap.QInoFromStat(&st))
+	if e == nil {
+		return
+	}
+	e.ContentLock.Lock()
+	e.ID = nil
+	e.Enc = nil
+	e.Recipe = nil
+	e.ContentLock.Unlock()
+	rn.cipherdirReloads.Inc()
+	tlog.Debug.Printf("reloadOpenFile: %q", cPath)
+}
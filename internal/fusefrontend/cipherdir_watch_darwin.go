@@ -0,0 +1,10 @@
+package fusefrontend
+
+import (
+	"syscall"
+)
+
+// WatchCipherdir is not implemented on Darwin, which has no inotify.
+func (rn *RootNode) WatchCipherdir() error {
+	return syscall.EOPNOTSUPP
+}
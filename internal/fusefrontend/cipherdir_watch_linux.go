@@ -0,0 +1,192 @@
+package fusefrontend
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// watchMask are the inotify events "-watch-cipherdir" listens for. Writes
+// are seen when the file is closed, which is what sync clients do.
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_CLOSE_WRITE | unix.IN_ATTRIB | unix.IN_ONLYDIR | unix.IN_DONT_FOLLOW
+
+// cipherdirWatcher watches all directories in CIPHERDIR with inotify and
+// calls "changed" for every entry that is created, deleted, renamed or
+// written to.
+type cipherdirWatcher struct {
+	root string
+	// fd is the inotify fd. "inotify" wraps it for reading through the
+	// netpoller, so its Fd method must not be called, which would make
+	// the fd blocking.
+	fd      int
+	inotify *os.File
+	// dirs maps watch descriptors to directory paths relative to "root"
+	dirs    map[int32]string
+	changed func(cDir string, cName string, op watchOp, isDir bool)
+}
+
+// WatchCipherdir starts watching CIPHERDIR for changes made by other
+// programs, see cipherdirChanged. Must be called after the FUSE server has
+// been created.
+func (rn *RootNode) WatchCipherdir() error {
+	w, err := newCipherdirWatcher(rn.args.Cipherdir, rn.cipherdirChanged)
+	if err != nil {
+		return err
+	}
+	go w.loop()
+	return nil
+}
+
+func newCipherdirWatcher(root string, changed func(cDir string, cName string, op watchOp, isDir bool)) (*cipherdirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &cipherdirWatcher{
+		root:    root,
+		fd:      fd,
+		inotify: os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int32]string),
+		changed: changed,
+	}
+	if err = w.addTree(""); err != nil {
+		w.inotify.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// addTree adds watches for directory "dir" (relative to the root) and all
+// directories below it. Running out of watches is logged, not returned.
+func (w *cipherdirWatcher) addTree(dir string) error {
+	err := filepath.WalkDir(filepath.Join(w.root, dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Deleted while we were walking
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(w.root, p)
+		if rel == "." {
+			rel = ""
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, p, watchMask)
+		if err == syscall.ENOSPC || (err != nil && rel == "") {
+			return err
+		} else if err != nil {
+			return nil
+		}
+		w.dirs[int32(wd)] = rel
+		return nil
+	})
+	if err == syscall.ENOSPC {
+		tlog.Warn.Printf("-watch-cipherdir: out of inotify watches, not all directories are watched. " +
+			"Raise fs.inotify.max_user_watches.")
+		return nil
+	}
+	return err
+}
+
+// removeTree forgets the watches of directory "dir" and the directories
+// below it, which have been moved out of CIPHERDIR.
+func (w *cipherdirWatcher) removeTree(dir string) {
+	for wd, p := range w.dirs {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// renameTree updates the paths of the watches below a directory that has
+// been renamed from "from" to "to".
+func (w *cipherdirWatcher) renameTree(from string, to string) {
+	for wd, p := range w.dirs {
+		if p == from {
+			w.dirs[wd] = to
+		} else if strings.HasPrefix(p, from+"/") {
+			w.dirs[wd] = to + p[len(from):]
+		}
+	}
+}
+
+// loop reads and dispatches events until the inotify fd is closed
+func (w *cipherdirWatcher) loop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				tlog.Warn.Printf("-watch-cipherdir: %v", err)
+			}
+			return
+		}
+		w.handle(buf[:n])
+	}
+}
+
+// handle dispatches the events in "buf", the result of one read from the
+// inotify fd. A directory rename comes as an IN_MOVED_FROM and IN_MOVED_TO
+// pair with the same cookie, which the kernel queues together.
+func (w *cipherdirWatcher) handle(buf []byte) {
+	// Directories moved away, by cookie
+	movedFrom := make(map[uint32]string)
+	for len(buf) >= unix.SizeofInotifyEvent {
+		ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		nameBytes := buf[unix.SizeofInotifyEvent : unix.SizeofInotifyEvent+int(ev.Len)]
+		buf = buf[unix.SizeofInotifyEvent+int(ev.Len):]
+		name := strings.TrimRight(string(nameBytes), "\x00")
+		if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+			tlog.Warn.Printf("-watch-cipherdir: inotify queue overflow, the kernel cache may be stale until it times out")
+			continue
+		}
+		dir, ok := w.dirs[ev.Wd]
+		if !ok {
+			continue
+		}
+		if ev.Mask&unix.IN_IGNORED != 0 {
+			delete(w.dirs, ev.Wd)
+			continue
+		}
+		if name == "" {
+			// Event on the watched directory itself. Its parent reports it.
+			continue
+		}
+		isDir := ev.Mask&unix.IN_ISDIR != 0
+		p := path.Join(dir, name)
+		switch {
+		case ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+			if isDir {
+				if from, ok := movedFrom[ev.Cookie]; ok && ev.Mask&unix.IN_MOVED_TO != 0 {
+					delete(movedFrom, ev.Cookie)
+					w.renameTree(from, p)
+				} else {
+					w.addTree(p)
+				}
+			}
+			w.changed(dir, name, watchCreate, isDir)
+		case ev.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+			if isDir && ev.Mask&unix.IN_MOVED_FROM != 0 {
+				movedFrom[ev.Cookie] = p
+			}
+			w.changed(dir, name, watchDelete, isDir)
+		default:
+			w.changed(dir, name, watchChange, isDir)
+		}
+	}
+	// Moved out of CIPHERDIR
+	for _, p := range movedFrom {
+		w.removeTree(p)
+	}
+}
@@ -0,0 +1,65 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type watchEvent struct {
+	dir, name string
+	op        watchOp
+	isDir     bool
+}
+
+func TestCipherdirWatcher(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "a"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan watchEvent, 100)
+	w, err := newCipherdirWatcher(root, func(cDir string, cName string, op watchOp, isDir bool) {
+		events <- watchEvent{cDir, cName, op, isDir}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.loop()
+	defer w.inotify.Close()
+	expect := func(want watchEvent) {
+		t.Helper()
+		select {
+		case have := <-events:
+			if have != want {
+				t.Errorf("have %+v, want %+v", have, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout waiting for %+v", want)
+		}
+	}
+	if err = os.WriteFile(filepath.Join(root, "a/f"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	expect(watchEvent{"a", "f", watchCreate, false})
+	expect(watchEvent{"a", "f", watchChange, false})
+	// New directories are watched as well
+	if err = os.Mkdir(filepath.Join(root, "a/b"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	expect(watchEvent{"a", "b", watchCreate, true})
+	if err = os.Mkdir(filepath.Join(root, "a/b/c"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	expect(watchEvent{"a/b", "c", watchCreate, true})
+	// After a rename, events carry the new path
+	if err = os.Rename(filepath.Join(root, "a"), filepath.Join(root, "z")); err != nil {
+		t.Fatal(err)
+	}
+	expect(watchEvent{"", "a", watchDelete, true})
+	expect(watchEvent{"", "z", watchCreate, true})
+	if err = os.Remove(filepath.Join(root, "z/b/c")); err != nil {
+		t.Fatal(err)
+	}
+	expect(watchEvent{"z/b", "c", watchDelete, true})
+}
@@ -0,0 +1,65 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// A sync client replaces the content of an open file in place. After
+// cipherdirChanged, the file handle must decrypt the new content, and an
+// append must not merge it with the stale tail block.
+func TestReloadOpenFile(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir})
+	open := func(name string) *File {
+		fd, err := syscall.Open(filepath.Join(dir, name), syscall.O_RDWR|syscall.O_CREAT, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, _, errno := NewFile(fd, name, rn)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		return f
+	}
+	a := open("a")
+	defer a.Release(context.Background())
+	if _, errno := a.Write(context.Background(), bytes.Repeat([]byte("a"), 5000), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	b := open("b")
+	want := bytes.Repeat([]byte("b"), 5000)
+	if _, errno := b.Write(context.Background(), want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	b.Release(context.Background())
+	// Replace the ciphertext of "a" by the one of "b", keeping the inode
+	ciphertext, err := os.ReadFile(filepath.Join(dir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(dir, "a"), ciphertext, 0600); err != nil {
+		t.Fatal(err)
+	}
+	rn.cipherdirChanged("", "a", watchChange, false)
+	if n := rn.cipherdirReloads.Value(); n != 1 {
+		t.Errorf("have %d reloads, want 1", n)
+	}
+	if _, errno := a.Write(context.Background(), []byte("tail"), 5000); errno != 0 {
+		t.Fatal(errno)
+	}
+	want = append(want, "tail"...)
+	a.fileTableEntry.ContentLock.RLock()
+	have, errno := a.doRead(context.Background(), nil, 0, 8192)
+	a.fileTableEntry.ContentLock.RUnlock()
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("content mismatch: have %q...", have[:10])
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -110,3 +113,43 @@ func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error)
 	}
 	return plainPath, nil
 }
+
+var _ ctlsocksrv.NameLimitsInterface = &RootNode{} // Verify that interface is implemented.
+
+// NameLimits implements ctlsocksrv.NameLimitsInterface
+func (rn *RootNode) NameLimits() (ctlsock.NameLimits, error) {
+	backingMax, err := syscallcompat.NameMax(rn.args.Cipherdir)
+	if err != nil {
+		return ctlsock.NameLimits{}, err
+	}
+	l := ctlsock.NameLimits{BackingMax: backingMax}
+	if rn.args.PlaintextNames {
+		l.Max, l.Direct = nametransform.PlainNameLimits(backingMax)
+	} else {
+		l.Max, l.Direct = rn.nameTransform.NameLimits(backingMax)
+	}
+	return l, nil
+}
+
+var _ ctlsocksrv.FeaturesInterface = &RootNode{} // Verify that interface is implemented.
+
+// CtlsockFeatures implements ctlsocksrv.FeaturesInterface
+func (rn *RootNode) CtlsockFeatures() (features []string) {
+	if rn.args.Trash != 0 {
+		features = append(features, ctlsock.FeatureTrash)
+	}
+	if rn.scrubber != nil {
+		features = append(features, ctlsock.FeatureScrub)
+	}
+	if rn.contentEnc.HeaderVersion() == contentenc.HeaderVersion3 {
+		features = append(features, ctlsock.FeatureShred)
+	}
+	return features
+}
+
+var _ ctlsocksrv.CryptoConfigInterface = &RootNode{} // Verify that interface is implemented.
+
+// ParallelCrypto implements ctlsocksrv.CryptoConfigInterface
+func (rn *RootNode) ParallelCrypto() *parallelcrypto.ParallelCrypto {
+	return rn.contentEnc.ParallelCrypto()
+}
@@ -12,6 +12,7 @@ import (
 	"math"
 	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
@@ -50,6 +51,20 @@ type File struct {
 	rootNode *RootNode
 	// If this open file is a directory, dirHandle will be set, otherwise it's nil.
 	dirHandle *DirHandle
+	// encCtx holds the encryption scratch buffers of doWrite. Only used
+	// with the exclusive ContentLock held. Created on the first write.
+	encCtx *contentenc.FileCtx
+	// timesDirty is set when the mtime has changed and has to be recorded
+	// by Node.Flush. Only used with AuthTimes.
+	timesDirty atomic.Bool
+	// tail caches the plaintext of the incomplete last block, see
+	// tailBlock. Only used with the exclusive ContentLock held.
+	tail *tailBlock
+	// direct is a second fd to the backing file, opened with O_DIRECT, see
+	// openDirect. nil if the file is read through the page cache.
+	direct *os.File
+	// directAlign is the alignment O_DIRECT reads on "direct" need
+	directAlign int64
 }
 
 // NewFile returns a new go-fuse File instance based on an already-open file
@@ -84,12 +99,21 @@ func (f *File) intFd() int {
 }
 
 // readFileID loads the file header from disk and extracts the file ID.
+// Also returns the ContentEnc of a per-file data key (nil if there is none),
+// which goes into fileTableEntry.Enc together with the ID.
 // Returns io.EOF if the file is empty.
-func (f *File) readFileID() ([]byte, error) {
+func (f *File) readFileID() ([]byte, *contentenc.ContentEnc, error) {
+	headerLen := f.rootNode.contentEnc.HeaderLen()
 	// We read +1 byte to determine if the file has actual content
 	// and not only the header. A header-only file will be considered empty.
 	// This makes File ID poisoning more difficult.
-	readLen := contentenc.HeaderLen + 1
+	readLen := headerLen + 1
+	if f.rootNode.args.XattrAuth || f.rootNode.args.DirManifest {
+		// Except with XattrAuth, where xattr values are bound to the file ID
+		// and it must not change (see Node.xattrID), and with DirManifest,
+		// where the manifest binds the file to its file ID.
+		readLen = headerLen
+	}
 	buf := make([]byte, readLen)
 	n, err := f.fd.ReadAt(buf, 0)
 	if err != nil {
@@ -98,38 +122,65 @@ func (f *File) readFileID() ([]byte, error) {
 				f.qIno.Ino, n, readLen)
 			f.rootNode.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
 		}
-		return nil, err
+		return nil, nil, err
 	}
-	buf = buf[:contentenc.HeaderLen]
-	h, err := contentenc.ParseHeader(buf)
+	buf = buf[:headerLen]
+	h, enc, err := f.rootNode.contentEnc.OpenHeader(buf)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return h.ID, nil
+	return h.ID, fileEnc(f.rootNode, enc), nil
 }
 
 // createHeader creates a new random header and writes it to disk.
-// Returns the new file ID.
+// Returns the new file ID and the ContentEnc of its data key, see
+// readFileID.
 // The caller must hold fileIDLock.Lock().
-func (f *File) createHeader() (fileID []byte, err error) {
-	h := contentenc.RandomHeader()
+func (f *File) createHeader() (fileID []byte, enc *contentenc.ContentEnc, err error) {
+	h, enc, err := f.rootNode.contentEnc.NewHeader()
+	if err != nil {
+		if !syscallcompat.IsENOSPC(err) {
+			tlog.Warn.Printf("ino%d: createHeader: key share: %v", f.qIno.Ino, err)
+		}
+		return nil, nil, err
+	}
 	buf := h.Pack()
 	// Prevent partially written (=corrupt) header by preallocating the space beforehand
 	if !f.rootNode.args.NoPrealloc && f.rootNode.quirks&syscallcompat.QuirkBrokenFalloc == 0 {
-		err = syscallcompat.EnospcPrealloc(f.intFd(), 0, contentenc.HeaderLen)
+		err = syscallcompat.EnospcPrealloc(f.intFd(), 0, int64(len(buf)))
 		if err != nil {
 			if !syscallcompat.IsENOSPC(err) {
 				tlog.Warn.Printf("ino%d: createHeader: prealloc failed: %s\n", f.qIno.Ino, err.Error())
 			}
-			return nil, err
+			return nil, nil, err
 		}
 	}
 	// Actually write header
 	_, err = f.fd.WriteAt(buf, 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return h.ID, err
+	return h.ID, fileEnc(f.rootNode, enc), err
+}
+
+// fileEnc returns nil if "enc" is the ContentEnc of the filesystem, so that
+// fileTableEntry.Enc is only set for files with their own data key
+func fileEnc(rn *RootNode, enc *contentenc.ContentEnc) *contentenc.ContentEnc {
+	if enc == rn.contentEnc {
+		return nil
+	}
+	return enc
+}
+
+// contentEnc returns the ContentEnc that encrypts the content of the file:
+// the one with the per-file data key of a version 3 header, or the one of
+// the filesystem. The caller must hold IDLock or ContentLock, after the ID
+// has been loaded.
+func (f *File) contentEnc() *contentenc.ContentEnc {
+	if e := f.fileTableEntry.Enc; e != nil {
+		return e
+	}
+	return f.rootNode.contentEnc
 }
 
 // doRead - read "length" plaintext bytes from plaintext offset "off" and append
@@ -141,7 +192,18 @@ func (f *File) createHeader() (fileID []byte, err error) {
 //
 // Called by Read() for normal reading,
 // by Write() and Truncate() via doWrite() for Read-Modify-Write.
-func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Errno) {
+func (f *File) doRead(ctx context.Context, dst []byte, off uint64, length uint64) ([]byte, syscall.Errno) {
+	if f.rootNode.dedup != nil {
+		f.fileTableEntry.IDLock.Lock()
+		r, errno := f.loadRecipe()
+		f.fileTableEntry.IDLock.Unlock()
+		if errno != 0 {
+			return nil, errno
+		}
+		if r != nil {
+			return f.dedupRead(dst, r, off, length)
+		}
+	}
 	// Get the file ID, either from the open file table, or from disk.
 	var fileID []byte
 	f.fileTableEntry.IDLock.Lock()
@@ -151,7 +213,8 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	} else {
 		// Not cached, we have to read it from disk.
 		var err error
-		fileID, err = f.readFileID()
+		var enc *contentenc.ContentEnc
+		fileID, enc, err = f.readFileID()
 		if err != nil {
 			f.fileTableEntry.IDLock.Unlock()
 			if err == io.EOF {
@@ -162,13 +225,15 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 			n, _ := f.fd.ReadAt(buf, 0)
 			buf = buf[:n]
 			hexdump := hex.EncodeToString(buf)
-			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
-				f.qIno.Ino, err, n, hexdump)
+			tlog.Warn.Printf("doRead %d: corrupt header: %v, caller %s\nFile hexdump (%d bytes): %s",
+				f.qIno.Ino, err, callerString(ctx), n, hexdump)
+			f.rootNode.reportIntegrityFailure(ctx, fmt.Sprint(f.qIno.Ino))
 			return nil, syscall.EIO
 		}
 		// Save into the file table
-		f.fileTableEntry.ID = fileID
+		f.fileTableEntry.ID, f.fileTableEntry.Enc = fileID, enc
 	}
+	ce := f.contentEnc()
 	f.fileTableEntry.IDLock.Unlock()
 	if fileID == nil {
 		log.Panicf("fileID=%v", fileID)
@@ -184,9 +249,17 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	tlog.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
 		off, length, alignedOffset, alignedLength, skip)
 
+	if f.rootNode.uring != nil && f.direct == nil {
+		plaintext, errno := f.readUring(ctx, ce, alignedOffset, alignedLength, blocks[0].BlockNo, fileID)
+		if errno != 0 {
+			return nil, errno
+		}
+		return cropPlaintext(dst, plaintext, skip, length), 0
+	}
+
 	ciphertext := f.rootNode.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
+	n, err := f.readCiphertext(ciphertext, int64(alignedOffset))
 	if err != nil && err != io.EOF {
 		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
 		return nil, fs.ToErrno(err)
@@ -203,15 +276,21 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
 	// Decrypt it
-	plaintext, err := f.rootNode.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	plaintext, err := ce.DecryptBlocks(ciphertext, firstBlockNo, fileID)
 	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
-		corruptBlockNo := firstBlockNo + f.rootNode.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
-		tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, corruptBlockNo, err)
+		tlog.Warn.Printf("doRead %d: corrupt %v, caller %s", f.qIno.Ino, err, callerString(ctx))
+		f.rootNode.reportIntegrityFailure(ctx, fmt.Sprint(f.qIno.Ino))
 		return nil, syscall.EIO
 	}
 
-	// Crop down to the relevant part
+	// Note: plaintext is not from the pool, so we don't put it back
+	return cropPlaintext(dst, plaintext, skip, length), 0
+}
+
+// cropPlaintext appends the part of "plaintext" that was requested by
+// doRead to "dst".
+func cropPlaintext(dst []byte, plaintext []byte, skip uint64, length uint64) []byte {
 	var out []byte
 	lenHave := len(plaintext)
 	lenWant := int(skip + length)
@@ -222,19 +301,29 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	}
 	// else: out stays empty, file was smaller than the requested offset
 
-	out = append(dst, out...)
-	// Note: plaintext is not from the pool, so we don't put it back
-
-	return out, 0
+	return append(dst, out...)
 }
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse.ReadResult, errno syscall.Errno) {
+	defer f.rootNode.supervise(&errno)
+	f.rootNode.foregroundOps.Inc()
 	if len(buf) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
 		return nil, syscall.EMSGSIZE
 	}
+	if len(buf) < largeReadSize {
+		return f.read(ctx, buf, off)
+	}
+	if errno2 := f.rootNode.runOp(ctx, "read", func() { resultData, errno = f.read(ctx, buf, off) }); errno2 != 0 {
+		return nil, errno2
+	}
+	return resultData, errno
+}
+
+// read implements Read, see there.
+func (f *File) read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -242,7 +331,7 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 	defer f.fileTableEntry.ContentLock.RUnlock()
 
 	tlog.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
-	out, errno := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+	out, errno := f.doRead(ctx, buf[:0], uint64(off), uint64(len(buf)))
 	if errno != 0 {
 		return nil, errno
 	}
@@ -259,7 +348,7 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 // and by Truncate() to rewrite the last file block.
 //
 // Empty writes do nothing and are allowed.
-func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
+func (f *File) doWrite(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
 	fileWasEmpty := false
 	// The caller has exclusively locked ContentLock, which blocks all other
 	// readers and writers. No need to take IDLock.
@@ -267,20 +356,21 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	// If the file ID is not cached, read it from disk
 	if f.fileTableEntry.ID == nil {
 		var err error
-		fileID, err := f.readFileID()
+		fileID, enc, err := f.readFileID()
 		// Write a new file header if the file is empty
 		if err == io.EOF {
-			fileID, err = f.createHeader()
+			fileID, enc, err = f.createHeader()
 			fileWasEmpty = true
 		} else if err != nil {
 			// Other errors mean readFileID() found a corrupt header
-			tlog.Warn.Printf("doWrite %d: corrupt header: %v", f.qIno.Ino, err)
+			tlog.Warn.Printf("doWrite %d: corrupt header: %v, caller %s", f.qIno.Ino, err, callerString(ctx))
+			f.rootNode.reportIntegrityFailure(ctx, fmt.Sprint(f.qIno.Ino))
 			return 0, syscall.EIO
 		}
 		if err != nil {
 			return 0, fs.ToErrno(err)
 		}
-		f.fileTableEntry.ID = fileID
+		f.fileTableEntry.ID, f.fileTableEntry.Enc = fileID, enc
 	}
 	// Handle payload data
 	dataBuf := bytes.NewBuffer(data)
@@ -290,11 +380,15 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		blockData := dataBuf.Next(int(b.Length))
 		// Incomplete block -> Read-Modify-Write
 		if b.IsPartial() {
-			// Read
-			oldData, errno := f.doRead(nil, b.BlockPlainOff(), f.rootNode.contentEnc.PlainBS())
-			if errno != 0 {
-				tlog.Warn.Printf("ino%d fh%d: RMW read failed: errno=%d", f.qIno.Ino, f.intFd(), errno)
-				return 0, errno
+			// Read, unless we have the block in the tail cache
+			oldData := f.getTail(b.BlockNo)
+			if oldData == nil {
+				var errno syscall.Errno
+				oldData, errno = f.doRead(ctx, nil, b.BlockPlainOff(), f.rootNode.contentEnc.PlainBS())
+				if errno != 0 {
+					tlog.Warn.Printf("ino%d fh%d: RMW read failed: errno=%d", f.qIno.Ino, f.intFd(), errno)
+					return 0, errno
+				}
 			}
 			// Modify
 			blockData = f.rootNode.contentEnc.MergeBlocks(oldData, blockData, int(b.Skip))
@@ -305,8 +399,7 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
 	}
-	// Encrypt all blocks
-	ciphertext := f.rootNode.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	ce := f.contentEnc()
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
 	var err error
@@ -315,15 +408,19 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 	if cOff > math.MaxInt64 {
 		return 0, syscall.EFBIG
 	}
+	cLen := 0
+	for _, b := range toEncrypt {
+		cLen += len(b) + int(ce.BlockOverhead())
+	}
 	if !f.rootNode.args.NoPrealloc && f.rootNode.quirks&syscallcompat.QuirkBrokenFalloc == 0 {
-		err = syscallcompat.EnospcPrealloc(f.intFd(), int64(cOff), int64(len(ciphertext)))
+		err = syscallcompat.EnospcPrealloc(f.intFd(), int64(cOff), int64(cLen))
 		if err != nil {
 			if !syscallcompat.IsENOSPC(err) {
 				tlog.Warn.Printf("ino%d fh%d: doWrite: prealloc failed: %v", f.qIno.Ino, f.intFd(), err)
 			}
 			if fileWasEmpty {
 				// Kill the file header again
-				f.fileTableEntry.ID = nil
+				f.fileTableEntry.ID, f.fileTableEntry.Enc = nil, nil
 				err2 := syscall.Ftruncate(f.intFd(), 0)
 				if err2 != nil {
 					tlog.Warn.Printf("ino%d fh%d: doWrite: rollback failed: %v", f.qIno.Ino, f.intFd(), err2)
@@ -332,18 +429,50 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 			return 0, fs.ToErrno(err)
 		}
 	}
-	// Write
-	_, err = f.fd.WriteAt(ciphertext, int64(cOff))
-	// Return memory to CReqPool
-	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	if f.encCtx == nil || f.encCtx.ContentEnc() != ce {
+		f.encCtx = ce.NewFileCtx()
+	}
+	if len(toEncrypt) > contentenc.EncryptAheadSegment {
+		// Large write: write out the first blocks while the next ones
+		// are being encrypted
+		err = f.encCtx.EncryptBlocksPipelined(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID, func(ciphertext []byte, o int) error {
+			return f.writeCiphertext(ciphertext, int64(cOff)+int64(o))
+		})
+	} else if f.rootNode.uring != nil {
+		// Encrypt all blocks
+		ciphertext := f.encCtx.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+		err = f.writeCiphertext(ciphertext, int64(cOff))
+		// Return memory to CReqPool
+		ce.CReqPool.Put(ciphertext)
+	} else {
+		// Encrypt all blocks and write them with pwritev, which saves
+		// copying them into one buffer
+		cBlocks := f.encCtx.EncryptBlocksVec(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+		err = syscallcompat.PwritevAll(f.intFd(), cBlocks, int64(cOff))
+		ce.PutBlocks(cBlocks)
+	}
 	if err != nil {
 		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
-			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
+			f.qIno.Ino, f.intFd(), cOff, cLen, err)
+		f.tail = nil
 		return 0, fs.ToErrno(err)
 	}
+	last := len(blocks) - 1
+	f.setTail(blocks[last].BlockNo, toEncrypt[last])
 	return uint32(len(data)), 0
 }
 
+// writeCiphertext writes "ciphertext" to the backing file at "off", through
+// the io_uring engine if it is enabled.
+func (f *File) writeCiphertext(ciphertext []byte, off int64) (err error) {
+	if f.rootNode.uring != nil {
+		_, err = f.rootNode.uring.WriteAt(f.intFd(), ciphertext, off)
+	} else {
+		_, err = f.fd.WriteAt(ciphertext, off)
+	}
+	return err
+}
+
 // isConsecutiveWrite returns true if the current write
 // directly (in time and space) follows the last write.
 // This is an optimisation for streaming writes on NFS where a
@@ -357,12 +486,17 @@ func (f *File) isConsecutiveWrite(off int64) bool {
 // Write - FUSE call
 //
 // If the write creates a hole, pads the file to the next block boundary.
-func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+func (f *File) Write(ctx context.Context, data []byte, off int64) (written uint32, errno syscall.Errno) {
+	defer f.rootNode.supervise(&errno)
+	f.rootNode.foregroundOps.Inc()
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
 		return 0, syscall.EMSGSIZE
 	}
+	if errno = f.rootNode.checkWritable(); errno != 0 {
+		return 0, errno
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -373,16 +507,19 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
 	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	if f.rootNode.args.AuthTimes {
+		f.timesDirty.Store(true)
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
 	if !f.isConsecutiveWrite(off) {
-		errno := f.writePadHole(off)
+		errno := f.writePadHole(ctx, off)
 		if errno != 0 {
 			return 0, errno
 		}
 	}
-	n, errno := f.doWrite(data, off)
+	n, errno := f.doWrite(ctx, data, off)
 	if errno == 0 {
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
@@ -398,6 +535,9 @@ func (f *File) Release(ctx context.Context) syscall.Errno {
 	}
 	f.released = true
 	openfiletable.Unregister(f.qIno)
+	if f.direct != nil {
+		f.direct.Close()
+	}
 	err := f.fd.Close()
 	f.fdLock.Unlock()
 	return fs.ToErrno(err)
@@ -417,6 +557,7 @@ func (f *File) Flush(ctx context.Context) syscall.Errno {
 // Unfortunately, as Node.Fsync is also defined and takes precedence,
 // File.Fsync is never called at the moment.
 func (f *File) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
+	defer f.rootNode.supervise(&errno)
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
@@ -434,10 +575,14 @@ func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	if err != nil {
 		return fs.ToErrno(err)
 	}
-	f.rootNode.inoMap.TranslateStat(&st)
+	f.rootNode.translateIno(f.intFd(), "", &st)
 	a.FromStat(&st)
 	if a.IsRegular() {
-		a.Size = f.rootNode.contentEnc.CipherSizeToPlainSize(a.Size)
+		if sz, ok := f.recipeSize(a.Size); ok {
+			a.Size = sz
+		} else {
+			a.Size = f.rootNode.contentEnc.CipherSizeToPlainSize(a.Size)
+		}
 	}
 	// TODO: Handle symlink size similar to node.translateSize()
 	if f.rootNode.args.ForceOwner != nil {
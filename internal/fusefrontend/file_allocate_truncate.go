@@ -5,12 +5,14 @@ package fusefrontend
 
 import (
 	"context"
+	"io"
 	"log"
 	"sync"
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -21,6 +23,10 @@ const FALLOC_DEFAULT = 0x00
 // FALLOC_FL_KEEP_SIZE allocates disk space while not modifying the file size
 const FALLOC_FL_KEEP_SIZE = 0x01
 
+// FALLOC_FL_ZERO_RANGE zeroes a range of the file and allocates disk space
+// for it
+const FALLOC_FL_ZERO_RANGE = 0x10
+
 // Only warn once
 var allocateWarnOnce sync.Once
 
@@ -36,15 +42,22 @@ var allocateWarnOnce sync.Once
 // This allows us to reuse the file grow mechanics from Truncate as they are
 // complicated and hard to get right.
 //
-// Other modes (hole punching, zeroing) are not supported.
+// mode=FALLOC_FL_ZERO_RANGE (with or without FALLOC_FL_KEEP_SIZE) zeroes
+// the existing data in the range between steps (1) and (2), see zeroRange.
+//
+// Other modes (hole punching, collapsing, inserting) are not supported.
 func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
-	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
+	zero := mode&FALLOC_FL_ZERO_RANGE != 0
+	if mode&^(FALLOC_FL_KEEP_SIZE|FALLOC_FL_ZERO_RANGE) != 0 {
 		f := func() {
-			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			tlog.Info.Printf("fallocate: only mode 0 (default), 1 (keep size) and 0x10 (zero range) are supported")
 		}
 		allocateWarnOnce.Do(f)
 		return syscall.EOPNOTSUPP
 	}
+	if errno := f.rootNode.checkWritable(); errno != 0 {
+		return errno
+	}
 
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
@@ -53,34 +66,37 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
-
-	blocks := f.rootNode.contentEnc.ExplodePlainRange(off, sz)
-	firstBlock := blocks[0]
-	lastBlock := blocks[len(blocks)-1]
+	if f.rootNode.args.AuthTimes {
+		f.timesDirty.Store(true)
+	}
+	// We need the old file size to know how much of the last block is
+	// going to be stored, and if we are growing the file at all.
+	oldPlainSz, err := f.statPlainSize()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
 
 	// Step (1): Allocate the space the user wants using FALLOC_FL_KEEP_SIZE.
 	// This will fill file holes and/or allocate additional space past the end of
 	// the file.
-	cipherOff := firstBlock.BlockCipherOff()
-	cipherSz := lastBlock.BlockCipherOff() - cipherOff +
-		f.rootNode.contentEnc.BlockOverhead() + lastBlock.Skip + lastBlock.Length
-	err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
+	cipherOff, cipherSz := f.allocateRange(off, sz, oldPlainSz)
+	err = syscallcompat.Fallocate(f.intFd(), FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
 	tlog.Debug.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
 		off, sz, mode, cipherOff, cipherSz)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
-	if mode == FALLOC_FL_KEEP_SIZE {
+	if zero {
+		if errno := f.zeroRange(ctx, off, sz, oldPlainSz); errno != 0 {
+			return errno
+		}
+	}
+	if mode&FALLOC_FL_KEEP_SIZE != 0 {
 		// The user did not want to change the apparent size. We are done.
 		return 0
 	}
 	// Step (2): Grow the apparent file size
-	// We need the old file size to determine if we are growing the file at all.
 	newPlainSz := off + sz
-	oldPlainSz, err := f.statPlainSize()
-	if err != nil {
-		return fs.ToErrno(err)
-	}
 	if newPlainSz <= oldPlainSz {
 		// The new size is smaller (or equal). Fallocate with mode = 0 never
 		// truncates a file, so we are done.
@@ -89,21 +105,135 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	// The file grows. The space has already been allocated in (1), so what is
 	// left to do is to pad the first and last block and call truncate.
 	// truncateGrowFile does just that.
-	return f.truncateGrowFile(oldPlainSz, newPlainSz)
+	return f.truncateGrowFile(ctx, oldPlainSz, newPlainSz)
+}
+
+// allocateRange returns the ciphertext range that backs the plaintext range
+// "off", "sz" of a file that is "plainSz" bytes long:
+//
+//   - If the range starts in the first block, the file header is included.
+//   - Blocks are included in full (data, nonce and tag), except for the last
+//     block of the file, which only takes as much space as it stores. The
+//     file ends at "plainSz" or at "off+sz", whichever is larger.
+func (f *File) allocateRange(off uint64, sz uint64, plainSz uint64) (cipherOff uint64, cipherSz uint64) {
+	ce := f.rootNode.contentEnc
+	end := off + sz
+	// Round up to the end of the last block...
+	if rem := end % ce.PlainBS(); rem != 0 {
+		end += ce.PlainBS() - rem
+	}
+	// ...unless the file ends in it
+	eof := plainSz
+	if off+sz > eof {
+		eof = off + sz
+	}
+	if end > eof {
+		end = eof
+	}
+	firstBlockNo := ce.PlainOffToBlockNo(off)
+	cipherOff = ce.BlockNoToCipherOff(firstBlockNo)
+	if firstBlockNo == 0 {
+		cipherOff = 0
+	}
+	return cipherOff, ce.PlainSizeToCipherSize(end) - cipherOff
+}
+
+// zeroRange zeroes the plaintext range "off", "sz" as far as it lies inside
+// the file, which is "plainSz" bytes long. Partial blocks are rewritten with
+// zeros. Full blocks are replaced by all-zero ciphertext, which reads back
+// as a block of zeros just like a file hole, but keeps the space allocated.
+func (f *File) zeroRange(ctx context.Context, off uint64, sz uint64, plainSz uint64) syscall.Errno {
+	if off >= plainSz {
+		return 0
+	}
+	if off+sz > plainSz {
+		sz = plainSz - off
+	}
+	// The blocks we write below update the tail cache again
+	f.tail = nil
+	ce := f.rootNode.contentEnc
+	blocks := ce.ExplodePlainRange(off, sz)
+	// Run of full blocks that have not been zeroed yet
+	var runStart, runLen uint64
+	flush := func() syscall.Errno {
+		if runLen == 0 {
+			return 0
+		}
+		errno := f.zeroCipherRange(ce.BlockNoToCipherOff(runStart), runLen*ce.CipherBS())
+		runLen = 0
+		return errno
+	}
+	for _, b := range blocks {
+		if !b.IsPartial() {
+			if runLen == 0 {
+				runStart = b.BlockNo
+			}
+			runLen++
+			continue
+		}
+		if errno := flush(); errno != 0 {
+			return errno
+		}
+		if _, errno := f.doWrite(ctx, make([]byte, b.Length), int64(b.BlockPlainOff()+b.Skip)); errno != 0 {
+			return errno
+		}
+	}
+	return flush()
+}
+
+// zeroCipherRange overwrites a ciphertext range with zeros, using
+// FALLOC_FL_ZERO_RANGE if the backing filesystem supports it.
+func (f *File) zeroCipherRange(cipherOff uint64, cipherSz uint64) syscall.Errno {
+	err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_ZERO_RANGE|FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
+	if err != syscall.EOPNOTSUPP && err != syscall.EINVAL {
+		return fs.ToErrno(err)
+	}
+	zeros := f.rootNode.contentEnc.CReqPool.Get()
+	defer f.rootNode.contentEnc.CReqPool.Put(zeros)
+	for i := range zeros {
+		zeros[i] = 0
+	}
+	for cipherSz > 0 {
+		n := uint64(len(zeros))
+		if n > cipherSz {
+			n = cipherSz
+		}
+		if err = f.writeCiphertext(zeros[:n], int64(cipherOff)); err != nil {
+			tlog.Warn.Printf("ino%d fh%d: zeroCipherRange: %v", f.qIno.Ino, f.intFd(), err)
+			return fs.ToErrno(err)
+		}
+		cipherOff += n
+		cipherSz -= n
+	}
+	return 0
 }
 
 // truncate - called from Setattr.
-func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
+func (f *File) truncate(ctx context.Context, newSize uint64) (errno syscall.Errno) {
 	var err error
+	// The blocks we write below update the tail cache again
+	f.tail = nil
 	// Common case first: Truncate to zero
 	if newSize == 0 {
-		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
+		var cSize int64
+		if f.rootNode.args.XattrAuth || f.rootNode.args.DirManifest {
+			// Keep the header, xattr values and the manifest entry are
+			// bound to the file ID
+			cSize = int64(f.rootNode.contentEnc.HeaderLen())
+			if _, _, err = f.readFileID(); err != nil {
+				// No (valid) header
+				cSize = 0
+			}
+		}
+		err = syscall.Ftruncate(int(f.fd.Fd()), cSize)
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
 			return fs.ToErrno(err)
 		}
-		// Truncate to zero kills the file header
-		f.fileTableEntry.ID = nil
+		if cSize == 0 {
+			// Truncate to zero kills the file header
+			f.fileTableEntry.ID, f.fileTableEntry.Enc = nil, nil
+		}
 		return 0
 	}
 	// We need the old file size to determine if we are growing or shrinking
@@ -123,7 +253,7 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 	}
 	// File grows
 	if newSize > oldSize {
-		return f.truncateGrowFile(oldSize, newSize)
+		return f.truncateGrowFile(ctx, oldSize, newSize)
 	}
 
 	// File shrinks
@@ -133,7 +263,7 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 	lastBlockLen := newSize - plainOff
 	var data []byte
 	if lastBlockLen > 0 {
-		data, errno = f.doRead(nil, plainOff, lastBlockLen)
+		data, errno = f.doRead(ctx, nil, plainOff, lastBlockLen)
 		if errno != 0 {
 			tlog.Warn.Printf("Truncate: shrink doRead returned error: %v", err)
 			return errno
@@ -147,7 +277,7 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 	}
 	// Append partial block
 	if lastBlockLen > 0 {
-		_, status := f.doWrite(data, int64(plainOff))
+		_, status := f.doWrite(ctx, data, int64(plainOff))
 		return status
 	}
 	return 0
@@ -168,7 +298,7 @@ func (f *File) statPlainSize() (uint64, error) {
 // truncateGrowFile extends a file using seeking or ftruncate performing RMW on
 // the first and last block as necessary. New blocks in the middle become
 // file holes unless they have been fallocate()'d beforehand.
-func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Errno {
+func (f *File) truncateGrowFile(ctx context.Context, oldPlainSz uint64, newPlainSz uint64) syscall.Errno {
 	if newPlainSz <= oldPlainSz {
 		log.Panicf("BUG: newSize=%d <= oldSize=%d", newPlainSz, oldPlainSz)
 	}
@@ -180,7 +310,7 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 		// Write a single zero to the last byte and let doWrite figure out the RMW.
 		if n1 == n2 {
 			buf := make([]byte, 1)
-			_, errno := f.doWrite(buf, int64(newEOFOffset))
+			_, errno := f.doWrite(ctx, buf, int64(newEOFOffset))
 			return errno
 		}
 	}
@@ -188,7 +318,7 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	//
 	// Make sure the old last block is padded to the block boundary. This call
 	// is a no-op if it is already block-aligned.
-	errno := f.zeroPad(oldPlainSz)
+	errno := f.zeroPad(ctx, oldPlainSz)
 	if errno != 0 {
 		return errno
 	}
@@ -197,11 +327,21 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	if newPlainSz%f.rootNode.contentEnc.PlainBS() == 0 {
 		// The file was empty, so it did not have a header. Create one.
 		if oldPlainSz == 0 {
-			id, err := f.createHeader()
+			var id []byte
+			var enc *contentenc.ContentEnc
+			err := io.EOF
+			if f.rootNode.args.XattrAuth || f.rootNode.args.DirManifest {
+				// With XattrAuth or DirManifest, it may have one that we
+				// have to keep.
+				id, enc, err = f.readFileID()
+			}
+			if err == io.EOF {
+				id, enc, err = f.createHeader()
+			}
 			if err != nil {
 				return fs.ToErrno(err)
 			}
-			f.fileTableEntry.ID = id
+			f.fileTableEntry.ID, f.fileTableEntry.Enc = id, enc
 		}
 		cSz := int64(f.rootNode.contentEnc.PlainSizeToCipherSize(newPlainSz))
 		err := syscall.Ftruncate(f.intFd(), cSz)
@@ -213,6 +353,6 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 	// The new size is NOT aligned, so we need to write a partial block.
 	// Write a single zero to the last byte and let doWrite figure it out.
 	buf := make([]byte, 1)
-	_, errno = f.doWrite(buf, int64(newEOFOffset))
+	_, errno = f.doWrite(ctx, buf, int64(newEOFOffset))
 	return errno
 }
@@ -0,0 +1,101 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+)
+
+func TestAllocateRange(t *testing.T) {
+	rn := newTestFS(Args{})
+	f := &File{rootNode: rn}
+	const h = contentenc.HeaderLen
+	testCases := []struct {
+		off, sz, plainSz uint64
+		cipherOff        uint64
+		cipherSz         uint64
+	}{
+		// Empty file: header, two full blocks and 10 bytes
+		{0, 8202, 0, 0, h + 2*4128 + 10 + 32},
+		// Inside a file hole: the whole block
+		{5000, 10, 9000, h + 4128, 4128},
+		// Last block of the file: only what it stores
+		{8200, 10, 9000, h + 2*4128, 9000 - 8192 + 32},
+		// Past the end of the file: the file grows to off+sz
+		{8200, 2000, 9000, h + 2*4128, 10200 - 8192 + 32},
+	}
+	for _, tc := range testCases {
+		cipherOff, cipherSz := f.allocateRange(tc.off, tc.sz, tc.plainSz)
+		if cipherOff != tc.cipherOff || cipherSz != tc.cipherSz {
+			t.Errorf("off=%d sz=%d plainSz=%d: have %d+%d, want %d+%d",
+				tc.off, tc.sz, tc.plainSz, cipherOff, cipherSz, tc.cipherOff, tc.cipherSz)
+		}
+	}
+}
+
+func TestAllocateZeroRange(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir})
+	fd, err := syscall.Open(filepath.Join(dir, "vm.img"), syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, "vm.img", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer f.Release(context.Background())
+	want := bytes.Repeat([]byte{0xff}, 5*4096+100)
+	if _, errno = f.Write(context.Background(), want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	check := func() {
+		t.Helper()
+		f.fileTableEntry.ContentLock.RLock()
+		have, errno := f.doRead(context.Background(), nil, 0, uint64(len(want))+4096)
+		f.fileTableEntry.ContentLock.RUnlock()
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("content mismatch: have %d bytes, want %d", len(have), len(want))
+		}
+	}
+	// From the middle of block 0 to the middle of block 4
+	errno = f.Allocate(context.Background(), 1000, 4*4096, FALLOC_FL_ZERO_RANGE|FALLOC_FL_KEEP_SIZE)
+	if errno == syscall.EOPNOTSUPP {
+		t.Skip("backing filesystem does not support fallocate")
+	} else if errno != 0 {
+		t.Fatal(errno)
+	}
+	copy(want[1000:], make([]byte, 4*4096))
+	check()
+	// Blocks 1 to 3 are all-zero ciphertext now
+	ciphertext, err := os.ReadFile(filepath.Join(dir, "vm.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce := rn.contentEnc
+	full := ciphertext[ce.BlockNoToCipherOff(1):ce.BlockNoToCipherOff(4)]
+	if !bytes.Equal(full, make([]byte, len(full))) {
+		t.Error("full blocks were not replaced by zeros")
+	}
+	// Across the end of the file, growing it
+	errno = f.Allocate(context.Background(), 5*4096, 3000, FALLOC_FL_ZERO_RANGE)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	copy(want[5*4096:], make([]byte, 100))
+	want = append(want, make([]byte, 3000-100)...)
+	check()
+	// Hole punching is not supported
+	const FALLOC_FL_PUNCH_HOLE = 0x02
+	if errno = f.Allocate(context.Background(), 0, 4096, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE); errno != syscall.EOPNOTSUPP {
+		t.Errorf("PUNCH_HOLE: have %v, want EOPNOTSUPP", errno)
+	}
+}
@@ -0,0 +1,148 @@
+package fusefrontend
+
+// Support for files whose content is stored in the dedup chunk store.
+// See package dedup for the on-disk format.
+//
+// Files are converted to recipes offline by "gocryptfs -dedup". While
+// mounted, recipes are read from the chunk store. Before a recipe can be
+// written to, it is converted back to a regular ciphertext file
+// ("materialized") when it is opened for writing.
+
+import (
+	"context"
+	"io"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// maxRecipeSize is a sanity limit for the size of recipe files. A recipe
+// has 36 bytes per chunk of about 80 KiB.
+const maxRecipeSize = 256 << 20
+
+// EnableDedup makes the filesystem read recipe files from the chunk store
+// "s" (feature flag Dedup).
+func (rn *RootNode) EnableDedup(s *dedup.Store) {
+	rn.dedup = s
+}
+
+// Dedup returns the chunk store passed to EnableDedup, or nil.
+func (rn *RootNode) Dedup() *dedup.Store {
+	return rn.dedup
+}
+
+// recipeSize returns the plaintext size of the recipe file open in "fd".
+func recipeSize(fd int) (uint64, bool) {
+	hdr := make([]byte, dedup.RecipeHeaderLen)
+	n, err := syscall.Pread(fd, hdr, 0)
+	if err != nil || n != len(hdr) {
+		return 0, false
+	}
+	return dedup.RecipeSize(hdr)
+}
+
+// recipeSizeAt is like recipeSize but opens "cName" in "dirfd".
+func recipeSizeAt(dirfd int, cName string) (uint64, bool) {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return 0, false
+	}
+	defer syscall.Close(fd)
+	return recipeSize(fd)
+}
+
+// loadRecipe returns the recipe of the file, or nil if it is a regular
+// ciphertext file. The recipe is cached in the open file table.
+// The caller must hold IDLock or an exclusive ContentLock.
+func (f *File) loadRecipe() (*dedup.Recipe, syscall.Errno) {
+	e := f.fileTableEntry
+	if e.Recipe != nil {
+		return e.Recipe, 0
+	}
+	if e.ID != nil {
+		return nil, 0
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(f.intFd(), &st); err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	if !dedup.IsRecipeSize(f.rootNode.contentEnc, uint64(st.Size)) {
+		return nil, 0
+	}
+	if st.Size > maxRecipeSize {
+		tlog.Warn.Printf("ino%d: recipe too big: %d bytes", f.qIno.Ino, st.Size)
+		return nil, syscall.EIO
+	}
+	buf := make([]byte, st.Size)
+	if _, err := f.fd.ReadAt(buf, 0); err != nil {
+		tlog.Warn.Printf("ino%d: reading recipe: %v", f.qIno.Ino, err)
+		return nil, fs.ToErrno(err)
+	}
+	r, err := f.rootNode.dedup.ParseRecipe(buf)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: %v", f.qIno.Ino, err)
+		return nil, syscall.EIO
+	}
+	e.Recipe = r
+	return r, 0
+}
+
+// dedupRead is doRead for recipe files.
+func (f *File) dedupRead(dst []byte, r *dedup.Recipe, off uint64, length uint64) ([]byte, syscall.Errno) {
+	start := len(dst)
+	dst = append(dst, make([]byte, length)...)
+	n, err := f.rootNode.dedup.ReadAt(r, dst[start:], int64(off))
+	if err != nil && err != io.EOF {
+		tlog.Warn.Printf("ino%d: dedupRead off=%d: %v", f.qIno.Ino, off, err)
+		return nil, syscall.EIO
+	}
+	return dst[:start+n], 0
+}
+
+// materialize converts a recipe file back into a regular ciphertext file,
+// so it can be written to. With "trunc", the file is truncated to zero
+// instead. Does nothing for regular files, except truncating them.
+//
+// A copy of the recipe is kept in the chunk store until the conversion is
+// complete, see dedup.Store.Materialize.
+func (f *File) materialize(ctx context.Context, trunc bool) syscall.Errno {
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	f.tail = nil
+	r, errno := f.loadRecipe()
+	if errno != 0 {
+		return errno
+	}
+	if r == nil {
+		if trunc {
+			return f.truncate(ctx, 0)
+		}
+		return 0
+	}
+	tlog.Debug.Printf("ino%d: materializing %d bytes, trunc=%v", f.qIno.Ino, r.Size, trunc)
+	if trunc {
+		// Keep the file ID, like truncate(0) with XattrAuth or DirManifest
+		r = dedup.NewRecipe(r.FileID)
+	}
+	if err := f.rootNode.dedup.Materialize(f.fd, r); err != nil {
+		tlog.Warn.Printf("ino%d: materialize failed, run \"gocryptfs -dedup\" to restore the file: %v",
+			f.qIno.Ino, err)
+		return fs.ToErrno(err)
+	}
+	f.fileTableEntry.Recipe = nil
+	f.fileTableEntry.ID = r.FileID
+	return 0
+}
+
+// recipeSize returns the plaintext size if "cipherSize" is the size of a
+// recipe file. The caller must hold fdLock.
+func (f *File) recipeSize(cipherSize uint64) (uint64, bool) {
+	if f.rootNode.dedup == nil || !dedup.IsRecipeSize(f.rootNode.contentEnc, cipherSize) {
+		return 0, false
+	}
+	return recipeSize(f.intFd())
+}
@@ -6,18 +6,30 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+	"golang.org/x/sys/unix"
 )
 
 func (n *Node) OpendirHandle(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.rootNode().supervise(&errno)
+	if errno = n.checkPolicy(ctx, "", accesspolicy.Read); errno != 0 {
+		return
+	}
 	var fd int = -1
 	var fdDup int = -1
 	var file *File
 	var dirIV []byte
 	var ds fs.DirStream
+	var st unix.Stat_t
 	rn := n.rootNode()
 
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
@@ -48,12 +60,24 @@ func (n *Node) OpendirHandle(ctx context.Context, flags uint32) (fh fs.FileHandl
 
 	if !rn.args.PlaintextNames {
 		// Read the DirIV from disk
-		dirIV, err = rn.nameTransform.ReadDirIVAt(fd)
+		dirIV, err = rn.nameTransform.VerifyDirIVAt(fd, cName)
 		if err != nil {
 			tlog.Warn.Printf("OpendirHandle: could not read %s: %v", nametransform.DirIVFilename, err)
 			errno = syscall.EIO
 			goto err_out
 		}
+		if rn.args.DirManifest {
+			errno = rn.verifyManifest(fd, dirIV, n.IsRoot())
+			if errno != 0 {
+				goto err_out
+			}
+		}
+		if rn.nameCache != nil {
+			if err = unix.Fstat(fd, &st); err != nil {
+				errno = fs.ToErrno(err)
+				goto err_out
+			}
+		}
 	}
 
 	file, _, errno = NewFile(fd, cName, rn)
@@ -65,6 +89,12 @@ func (n *Node) OpendirHandle(ctx context.Context, flags uint32) (fh fs.FileHandl
 		ds:        ds,
 		dirIV:     dirIV,
 		isRootDir: n.IsRoot(),
+		nameCacheKey: nametransform.NameCacheKey{
+			DirIV: string(dirIV),
+			Dev:   uint64(st.Dev),
+			Ino:   st.Ino,
+		},
+		mtime: st.Mtim,
 	}
 
 	return file, fuseFlags, errno
@@ -83,14 +113,32 @@ err_out:
 	return nil, 0, errno
 }
 
+const (
+	// readdirBatch is the number of entries Readdirent reads and decrypts
+	// at once
+	readdirBatch = 256
+	// readdirParallelMin is the batch size from which the names are
+	// decrypted in parallel
+	readdirParallelMin = 32
+)
+
 type DirHandle struct {
 	// Content of gocryptfs.diriv. nil if plaintextnames is used.
 	dirIV []byte
 
 	isRootDir bool
 
+	// nameCacheKey and mtime identify the directory in RootNode.nameCache
+	nameCacheKey nametransform.NameCacheKey
+	mtime        unix.Timespec
+
 	// fs.loopbackDirStream with a private dup of the file descriptor
 	ds fs.FileHandle
+
+	// pending holds the decrypted entries that Readdirent has not returned
+	// yet. pendingErrno is returned once they are used up.
+	pending      []fuse.DirEntry
+	pendingErrno syscall.Errno
 }
 
 var _ = (fs.FileReleasedirer)((*File)(nil))
@@ -105,73 +153,206 @@ func (f *File) Releasedir(ctx context.Context, flags uint32) {
 var _ = (fs.FileSeekdirer)((*File)(nil))
 
 func (f *File) Seekdir(ctx context.Context, off uint64) syscall.Errno {
+	f.dirHandle.pending = nil
+	f.dirHandle.pendingErrno = 0
 	return f.dirHandle.ds.(fs.FileSeekdirer).Seekdir(ctx, off)
 }
 
 var _ = (fs.FileFsyncdirer)((*File)(nil))
 
-func (f *File) Fsyncdir(ctx context.Context, flags uint32) syscall.Errno {
-	return f.dirHandle.ds.(fs.FileFsyncdirer).Fsyncdir(ctx, flags)
+func (f *File) Fsyncdir(ctx context.Context, flags uint32) (errno syscall.Errno) {
+	if errno2 := f.rootNode.runOp(ctx, "fsync", func() {
+		errno = f.dirHandle.ds.(fs.FileFsyncdirer).Fsyncdir(ctx, flags)
+	}); errno2 != 0 {
+		return errno2
+	}
+	return errno
 }
 
 var _ = (fs.FileReaddirenter)((*File)(nil))
 
+// Readdirent returns the next decrypted directory entry. The entries are
+// read and decrypted in batches of readdirBatch, see fillPending.
+//
 // This function is symlink-safe through use of openBackingDir() and
 // ReadDirIVAt().
 func (f *File) Readdirent(ctx context.Context) (entry *fuse.DirEntry, errno syscall.Errno) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
-	for {
-		entry, errno = f.dirHandle.ds.(fs.FileReaddirenter).Readdirent(ctx)
-		if errno != 0 || entry == nil {
-			return
+	dh := f.dirHandle
+	for len(dh.pending) == 0 {
+		if dh.pendingErrno != 0 {
+			errno = dh.pendingErrno
+			dh.pendingErrno = 0
+			return nil, errno
 		}
-
-		cName := entry.Name
-		if cName == "." || cName == ".." {
-			// We want these as-is
-			return
+		more, errno := f.fillPending(ctx)
+		if errno != 0 || !more {
+			return nil, errno
 		}
-		if f.dirHandle.isRootDir && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
-			continue
+	}
+	entry = &dh.pending[0]
+	dh.pending = dh.pending[1:]
+	return entry, 0
+}
+
+// fillPending reads up to readdirBatch entries from the backing directory,
+// decrypts their names, in parallel for large batches, and stores the result
+// in dirHandle.pending. Returns false at the end of the directory.
+func (f *File) fillPending(ctx context.Context) (more bool, errno syscall.Errno) {
+	dh := f.dirHandle
+	var batch []fuse.DirEntry
+	for len(batch) < readdirBatch {
+		entry, errno := dh.ds.(fs.FileReaddirenter).Readdirent(ctx)
+		if errno != 0 {
+			if len(batch) == 0 {
+				return false, errno
+			}
+			// Return the entries we have first
+			dh.pendingErrno = errno
+			break
 		}
-		if f.rootNode.args.PlaintextNames {
-			return
+		if entry == nil {
+			break
 		}
-		if !f.rootNode.args.DeterministicNames && cName == nametransform.DirIVFilename {
-			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
+		if f.hideDirent(entry.Name) {
 			continue
 		}
-		// Handle long file name
-		isLong := nametransform.LongNameNone
-		if f.rootNode.args.LongNames {
-			isLong = nametransform.NameType(cName)
+		batch = append(batch, *entry)
+	}
+	if len(batch) == 0 {
+		return false, 0
+	}
+	if f.rootNode.args.PlaintextNames {
+		dh.pending = batch
+		return true, 0
+	}
+	ok := make([]bool, len(batch))
+	decrypt := func(start, end int) {
+		for i := start; i < end; i++ {
+			ok[i] = f.decryptDirent(ctx, &batch[i])
 		}
-		if isLong == nametransform.LongNameContent {
-			cNameLong, err := nametransform.ReadLongNameAt(f.intFd(), cName)
-			if err != nil {
-				tlog.Warn.Printf("Readdirent: incomplete entry %q: Could not read .name: %v",
-					cName, err)
-				f.rootNode.reportMitigatedCorruption(cName)
-				continue
-			}
-			cName = cNameLong
-		} else if isLong == nametransform.LongNameFilename {
-			// ignore "gocryptfs.longname.*.name"
-			continue
+	}
+	if len(batch) >= readdirParallelMin {
+		f.rootNode.contentEnc.ParallelCrypto().ProcessBlocksParallel(len(batch), decrypt)
+	} else {
+		decrypt(0, len(batch))
+	}
+	dh.pending = batch[:0]
+	for i := range batch {
+		if ok[i] {
+			dh.pending = append(dh.pending, batch[i])
 		}
-		name, err := f.rootNode.nameTransform.DecryptName(cName, f.dirHandle.dirIV)
+	}
+	return true, 0
+}
+
+// hideDirent returns true for the names in the backing directory that are not
+// shown in the plaintext view.
+func (f *File) hideDirent(cName string) bool {
+	rn := f.rootNode
+	isRootDir := f.dirHandle.isRootDir
+	if isRootDir && cName == configfile.ConfDefaultName {
+		// silently ignore "gocryptfs.conf" in the top level dir
+		return true
+	}
+	if isRootDir && cName == dedup.DirName && rn.dedup != nil {
+		// silently ignore the chunk store in the top level dir
+		return true
+	}
+	if isRootDir && cName == snapshot.DirName {
+		// silently ignore the snapshots in the top level dir
+		return true
+	}
+	if isRootDir && cName == nametransform.TrashDirName {
+		// silently ignore the trash in the top level dir
+		return true
+	}
+	if isRootDir && cName == keystore.DirName && rn.contentEnc.HeaderVersion() == contentenc.HeaderVersion3 {
+		// silently ignore the key store in the top level dir
+		return true
+	}
+	if isRootDir && tuning.IsStateFile(cName) {
+		// silently ignore "gocryptfs.tuning" in the top level dir
+		return true
+	}
+	if isRootDir && configfile.IsBackupName(cName) {
+		// silently ignore the config file HMAC and backup copies in the
+		// top level dir
+		return true
+	}
+	if rn.args.PlaintextNames {
+		return false
+	}
+	if isRootDir && cName == nametransform.JournalDirName {
+		// silently ignore the long name journal in the top level dir
+		return true
+	}
+	if isRootDir && cName == nametransform.LongSymlinkDirName && rn.args.LongSymlinks {
+		// silently ignore the long symlink targets in the top level dir
+		return true
+	}
+	if !rn.args.DeterministicNames && cName == nametransform.DirIVFilename {
+		// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
+		return true
+	}
+	if cName == nametransform.DirIVNextFilename && rn.nameTransform.DirIVAuth() {
+		// silently ignore "gocryptfs.diriv.next" left by an interrupted rename
+		return true
+	}
+	if rn.args.DirManifest && nametransform.IsManifestName(cName) {
+		// silently ignore "gocryptfs.manifest" like "gocryptfs.diriv"
+		return true
+	}
+	if rn.args.LongNames && nametransform.NameType(cName) == nametransform.LongNameFilename {
+		// ignore "gocryptfs.longname.*.name"
+		return true
+	}
+	return false
+}
+
+// decryptDirent replaces the ciphertext name in "entry" with the plaintext
+// name. Returns false if the entry is corrupt and must be skipped.
+// Safe to call concurrently.
+func (f *File) decryptDirent(ctx context.Context, entry *fuse.DirEntry) bool {
+	rn := f.rootNode
+	cName := entry.Name
+	if cName == "." || cName == ".." {
+		// We want these as-is
+		return true
+	}
+	nameCache := rn.nameCache
+	if nameCache != nil {
+		if name, ok := nameCache.Get(f.dirHandle.nameCacheKey, f.dirHandle.mtime, cName); ok {
+			entry.Name = name
+			return true
+		}
+	}
+	// Handle long file name
+	if rn.args.LongNames && nametransform.IsLongContent(cName) {
+		cNameLong, err := nametransform.ReadLongNameAt(f.intFd(), cName)
 		if err != nil {
-			tlog.Warn.Printf("Readdirent: could not decrypt entry %q: %v",
+			tlog.Warn.Printf("Readdirent: incomplete entry %q: Could not read .name: %v",
 				cName, err)
-			f.rootNode.reportMitigatedCorruption(cName)
-			continue
+			rn.reportMitigatedCorruption(cName)
+			return false
 		}
-		// Override the ciphertext name with the plaintext name but reuse the rest
-		// of the structure
-		entry.Name = name
-		return
+		cName = cNameLong
+	}
+	name, err := rn.nameTransform.DecryptName(cName, f.dirHandle.dirIV)
+	if err != nil {
+		tlog.Warn.Printf("Readdirent: could not decrypt entry %q: %v, caller %s",
+			cName, err, callerString(ctx))
+		rn.reportMitigatedCorruption(cName)
+		rn.reportIntegrityFailure(ctx, cName)
+		return false
+	}
+	if nameCache != nil {
+		nameCache.Put(f.dirHandle.nameCacheKey, f.dirHandle.mtime, entry.Name, name)
 	}
+	// Override the ciphertext name with the plaintext name but reuse the rest
+	// of the structure
+	entry.Name = name
+	return true
 }
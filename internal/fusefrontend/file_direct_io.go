@@ -0,0 +1,107 @@
+package fusefrontend
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Policies for "-direct-io"
+const (
+	// DirectIOAuto bypasses the page cache for files opened with O_DIRECT
+	DirectIOAuto = "auto"
+	// DirectIOAlways bypasses the page cache for all files
+	DirectIOAlways = "always"
+	// DirectIONever reads the backing files through the page cache, even
+	// for O_DIRECT opens
+	DirectIONever = "never"
+)
+
+// directIO returns the FOPEN_* flags for a file opened with "flags", and
+// whether the backing file should be read with O_DIRECT.
+func (rn *RootNode) directIO(flags uint32) (fuseFlags uint32, backing bool) {
+	oDirect := syscallcompat.O_DIRECT != 0 && int(flags)&syscallcompat.O_DIRECT != 0
+	switch rn.args.DirectIO {
+	case DirectIOAlways:
+		return fuse.FOPEN_DIRECT_IO, oDirect
+	case DirectIONever:
+		return 0, false
+	}
+	if oDirect {
+		return fuse.FOPEN_DIRECT_IO, true
+	}
+	return 0, false
+}
+
+// openDirect opens a second, read-only fd to the backing file with
+// O_DIRECT, for reading with readCiphertext. The backing file is always
+// opened without O_DIRECT (see mangleOpenFlags) because writes have to
+// read-modify-write whole ciphertext blocks, which are not aligned. If the
+// backing filesystem does not support O_DIRECT (tmpfs, for example), reads
+// go through the page cache.
+func (f *File) openDirect(dirfd int, cName string) {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscallcompat.O_DIRECT|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Debug.Printf("openDirect %q: %v, reading through the page cache", cName, err)
+		return
+	}
+	f.direct = os.NewFile(uintptr(fd), cName)
+	f.directAlign = int64(syscallcompat.DirectIOAlign(fd))
+}
+
+// readCiphertext reads the backing file like f.fd.ReadAt. If the file has
+// been opened with O_DIRECT, the read is widened to the alignment the
+// backing filesystem needs and goes through an aligned buffer, as the
+// ciphertext blocks are not aligned even when the plaintext reads are.
+//
+// Writes through f.fd are seen, because the kernel writes the dirty page
+// cache back before an O_DIRECT read.
+func (f *File) readCiphertext(buf []byte, off int64) (int, error) {
+	if f.direct == nil {
+		return f.fd.ReadAt(buf, off)
+	}
+	a := f.directAlign
+	start := off - off%a
+	end := off + int64(len(buf))
+	if end%a != 0 {
+		end += a - end%a
+	}
+	tmp := alignedBuffer(int(end-start), int(a))
+	var n int
+	var err error
+	for {
+		n, err = syscall.Pread(int(f.direct.Fd()), tmp, start)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	have := n - int(off-start)
+	if have <= 0 {
+		return 0, io.EOF
+	}
+	copied := copy(buf, tmp[off-start:n])
+	if copied < len(buf) {
+		return copied, io.EOF
+	}
+	return copied, nil
+}
+
+// alignedBuffer returns a slice of length "n" whose address is a multiple
+// of "a"
+func alignedBuffer(n int, a int) []byte {
+	b := make([]byte, n+a)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % uintptr(a)); rem != 0 {
+		skip = a - rem
+	}
+	return b[skip : skip+n]
+}
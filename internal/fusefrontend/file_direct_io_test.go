@@ -0,0 +1,100 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+func TestDirectIOPolicy(t *testing.T) {
+	testCases := []struct {
+		policy    string
+		flags     uint32
+		fuseFlags uint32
+		backing   bool
+	}{
+		{DirectIOAuto, syscall.O_RDWR, 0, false},
+		{DirectIOAuto, syscall.O_RDWR | syscallcompat.O_DIRECT, fuse.FOPEN_DIRECT_IO, true},
+		{DirectIOAlways, syscall.O_RDWR, fuse.FOPEN_DIRECT_IO, false},
+		{DirectIOAlways, syscall.O_RDWR | syscallcompat.O_DIRECT, fuse.FOPEN_DIRECT_IO, true},
+		{DirectIONever, syscall.O_RDWR | syscallcompat.O_DIRECT, 0, false},
+	}
+	for _, tc := range testCases {
+		rn := &RootNode{args: Args{DirectIO: tc.policy}}
+		fuseFlags, backing := rn.directIO(tc.flags)
+		if fuseFlags != tc.fuseFlags || backing != tc.backing {
+			t.Errorf("%s, flags=%#x: have %#x %v, want %#x %v",
+				tc.policy, tc.flags, fuseFlags, backing, tc.fuseFlags, tc.backing)
+		}
+	}
+}
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, a := range []int{512, 4096} {
+		b := alignedBuffer(10000, a)
+		if len(b) != 10000 || uintptr(unsafe.Pointer(&b[0]))%uintptr(a) != 0 {
+			t.Errorf("a=%d: len=%d address=%p", a, len(b), &b[0])
+		}
+	}
+}
+
+// TestReadCiphertextDirect reads unaligned ciphertext ranges through an
+// O_DIRECT fd, right after writing them through the page cache.
+func TestReadCiphertextDirect(t *testing.T) {
+	if syscallcompat.O_DIRECT == 0 {
+		t.Skip("no O_DIRECT on this platform")
+	}
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir})
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, "db", syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, "db", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer f.Release(context.Background())
+	f.openDirect(dirfd, "db")
+	if f.direct == nil {
+		t.Skip("backing filesystem does not support O_DIRECT")
+	}
+	// 8 database pages of 4 KiB and a short tail
+	want := make([]byte, 8*4096+100)
+	for i := range want {
+		want[i] = byte(i * 7)
+	}
+	if _, errno = f.Write(context.Background(), want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+	for _, r := range [][2]uint64{{0, 4096}, {4096, 8192}, {512, 512}, {8 * 4096, 4096}, {1, uint64(len(want))}} {
+		have, errno := f.doRead(context.Background(), nil, r[0], r[1])
+		if errno != 0 {
+			t.Fatalf("off=%d len=%d: %v", r[0], r[1], errno)
+		}
+		end := r[0] + r[1]
+		if end > uint64(len(want)) {
+			end = uint64(len(want))
+		}
+		if !bytes.Equal(have, want[r[0]:end]) {
+			t.Errorf("off=%d len=%d: content mismatch", r[0], r[1])
+		}
+	}
+	// Past the end of the file
+	if have, errno := f.doRead(context.Background(), nil, 16*4096, 4096); errno != 0 || len(have) != 0 {
+		t.Errorf("read past EOF: %d bytes, %v", len(have), errno)
+	}
+}
@@ -14,7 +14,7 @@ import (
 
 // Will a write to plaintext offset "targetOff" create a file hole in the
 // ciphertext? If yes, zero-pad the last ciphertext block.
-func (f *File) writePadHole(targetOff int64) syscall.Errno {
+func (f *File) writePadHole(ctx context.Context, targetOff int64) syscall.Errno {
 	// Get the current file size.
 	fi, err := f.fd.Stat()
 	if err != nil {
@@ -35,7 +35,7 @@ func (f *File) writePadHole(targetOff int64) syscall.Errno {
 	// The write goes past the next block. nextBlock has
 	// to be zero-padded to the block boundary and (at least) nextBlock+1
 	// will contain a file hole in the ciphertext.
-	errno := f.zeroPad(plainSize)
+	errno := f.zeroPad(ctx, plainSize)
 	if errno != 0 {
 		return errno
 	}
@@ -44,7 +44,7 @@ func (f *File) writePadHole(targetOff int64) syscall.Errno {
 
 // Zero-pad the file of size plainSize to the next block boundary. This is a no-op
 // if the file is already block-aligned.
-func (f *File) zeroPad(plainSize uint64) syscall.Errno {
+func (f *File) zeroPad(ctx context.Context, plainSize uint64) syscall.Errno {
 	lastBlockLen := plainSize % f.rootNode.contentEnc.PlainBS()
 	if lastBlockLen == 0 {
 		// Already block-aligned
@@ -53,7 +53,7 @@ func (f *File) zeroPad(plainSize uint64) syscall.Errno {
 	missing := f.rootNode.contentEnc.PlainBS() - lastBlockLen
 	pad := make([]byte, missing)
 	tlog.Debug.Printf("zeroPad: Writing %d bytes\n", missing)
-	_, errno := f.doWrite(pad, int64(plainSize))
+	_, errno := f.doWrite(ctx, pad, int64(plainSize))
 	return errno
 }
 
@@ -88,6 +88,16 @@ func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, sy
 		return 0, fs.ToErrno(err)
 	}
 	fileSize := st.Size
+	if plainSize, ok := f.recipeSize(uint64(fileSize)); ok {
+		// Recipes have no holes
+		if off >= plainSize {
+			return MinusOne, syscall.ENXIO
+		}
+		if whence == SEEK_HOLE {
+			return plainSize, 0
+		}
+		return off, 0
+	}
 	// Better safe than sorry. The logic is only tested for 4k blocks.
 	if st.Blksize != 4096 {
 		tlog.Warn.Printf("unsupported block size of %d bytes, disabling SEEK_DATA & SEEK_HOLE", st.Blksize)
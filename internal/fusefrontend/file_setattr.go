@@ -76,7 +76,7 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 
 	// truncate(2)
 	if sz, ok := in.GetSize(); ok {
-		errno = syscall.Errno(f.truncate(sz))
+		errno = syscall.Errno(f.truncate(ctx, sz))
 		if errno != 0 {
 			return errno
 		}
@@ -0,0 +1,55 @@
+package fusefrontend
+
+// Tail block cache for small appends
+
+// tailBlock is the plaintext of the incomplete last block that this file
+// handle has written. Log-style appenders (journald, the SQLite WAL) write a
+// few bytes at a time, and without the cache, every write has to read and
+// decrypt the tail block again before it can merge the new bytes.
+//
+// The block still has to be encrypted on every write, as each version needs
+// a fresh nonce.
+type tailBlock struct {
+	blockNo uint64
+	data    []byte
+	// writes is the value of ContentLock.Writes() when "data" was stored
+	writes uint64
+}
+
+// getTail returns the cached plaintext of block "blockNo", or nil if there
+// is none or it may be stale. The caller must hold the exclusive
+// ContentLock.
+//
+// The cache is valid within the lock session that stored it, and in the
+// next one, if that is ours. Any other writer to the file, through another
+// handle, has taken the lock in between.
+func (f *File) getTail(blockNo uint64) []byte {
+	t := f.tail
+	if t == nil || t.blockNo != blockNo {
+		return nil
+	}
+	w := f.fileTableEntry.ContentLock.Writes()
+	if w != t.writes && w != t.writes+1 {
+		f.tail = nil
+		return nil
+	}
+	f.rootNode.tailCacheHits.Inc()
+	return t.data
+}
+
+// setTail stores a copy of "data", the new plaintext of block "blockNo", if
+// it is an incomplete block. Otherwise, the cache is dropped.
+func (f *File) setTail(blockNo uint64, data []byte) {
+	if f.rootNode.args.SharedStorage || len(data) >= int(f.rootNode.contentEnc.PlainBS()) {
+		f.tail = nil
+		return
+	}
+	t := f.tail
+	if t == nil {
+		t = &tailBlock{}
+	}
+	t.blockNo = blockNo
+	t.data = append(t.data[:0], data...)
+	t.writes = f.fileTableEntry.ContentLock.Writes()
+	f.tail = t
+}
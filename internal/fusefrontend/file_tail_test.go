@@ -0,0 +1,77 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTailCache(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir})
+	fd, err := syscall.Open(filepath.Join(dir, "log"), syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, "log", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer f.Release(context.Background())
+	// Append 100 bytes at a time across a block boundary
+	var want []byte
+	for i := 0; i < 50; i++ {
+		rec := bytes.Repeat([]byte{byte('a' + i%26)}, 100)
+		if _, errno = f.Write(context.Background(), rec, int64(len(want))); errno != 0 {
+			t.Fatal(errno)
+		}
+		want = append(want, rec...)
+	}
+	// Only the first write has to read the block. The write that crosses into
+	// the second block finds the first one in the cache, and the second one
+	// is new.
+	if h := rn.tailCacheHits.Value(); h != 49 {
+		t.Errorf("have %d cache hits, want 49", h)
+	}
+	check := func() {
+		t.Helper()
+		f.fileTableEntry.ContentLock.RLock()
+		have, errno := f.doRead(context.Background(), nil, 0, uint64(len(want))+100)
+		f.fileTableEntry.ContentLock.RUnlock()
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("content mismatch: have %d bytes, want %d", len(have), len(want))
+		}
+	}
+	check()
+	// A truncate through another handle must not leave us with a stale tail
+	fd2, err := syscall.Open(filepath.Join(dir, "log"), syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, _, errno := NewFile(fd2, "log", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f2.fileTableEntry.ContentLock.Lock()
+	errno = f2.truncate(context.Background(), 4200)
+	f2.fileTableEntry.ContentLock.Unlock()
+	f2.Release(context.Background())
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	want = want[:4200]
+	hits := rn.tailCacheHits.Value()
+	if _, errno = f.Write(context.Background(), []byte("xyz"), int64(len(want))); errno != 0 {
+		t.Fatal(errno)
+	}
+	want = append(want, "xyz"...)
+	if h := rn.tailCacheHits.Value(); h != hits {
+		t.Errorf("cache hit after a truncate through another handle")
+	}
+	check()
+}
@@ -0,0 +1,62 @@
+package fusefrontend
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/uring"
+)
+
+// uringRings is the number of io_uring instances for "-io-engine uring",
+// which is the number of reads and writes that run at the same time.
+const uringRings = 4
+
+// uringChunkBlocks is the number of blocks that readUring reads per io_uring
+// request. Each chunk is decrypted as soon as it arrives.
+const uringChunkBlocks = 8
+
+// newUringEngine sets up the io_uring engine with buffers large enough for
+// the largest ciphertext request.
+func newUringEngine(c *contentenc.ContentEnc) (*uring.Engine, error) {
+	bufSize := contentenc.MaxKernelWrite/c.PlainBS()*c.CipherBS() + c.CipherBS()
+	return uring.New(int(bufSize), uringRings)
+}
+
+// readUring reads "length" bytes of ciphertext at "off" through the io_uring
+// engine and decrypts them with "ce". The chunks that have arrived are decrypted while
+// the kernel is still reading the others.
+func (f *File) readUring(ctx context.Context, ce *contentenc.ContentEnc, off uint64, length uint64, firstBlockNo uint64, fileID []byte) ([]byte, syscall.Errno) {
+	cBS := int(ce.CipherBS())
+	pBS := int(ce.PlainBS())
+	plaintext := make([]byte, (int(length)+cBS-1)/cBS*pBS)
+	// Plaintext length and first decryption error, per chunk position
+	plainLen := make(map[int]int)
+	errs := make(map[int]error)
+	n, err := f.rootNode.uring.ReadChunks(f.intFd(), int64(off), int(length), uringChunkBlocks*cBS, func(pos int, data []byte) {
+		p, err := ce.DecryptBlocks(data, firstBlockNo+uint64(pos/cBS), fileID)
+		copy(plaintext[pos/cBS*pBS:], p)
+		plainLen[pos] = len(p)
+		if err != nil {
+			errs[pos] = err
+		}
+	})
+	if err != nil {
+		tlog.Warn.Printf("read: uring: %v", err)
+		return nil, fs.ToErrno(err)
+	}
+	end := 0
+	for pos := 0; pos < n; pos += uringChunkBlocks * cBS {
+		if err := errs[pos]; err != nil {
+			tlog.Warn.Printf("doRead %d: corrupt %v, caller %s", f.qIno.Ino, err, callerString(ctx))
+			f.rootNode.reportIntegrityFailure(ctx, fmt.Sprint(f.qIno.Ino))
+			return nil, syscall.EIO
+		}
+		end = pos/cBS*pBS + plainLen[pos]
+	}
+	return plaintext[:end], 0
+}
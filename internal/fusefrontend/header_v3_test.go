@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+)
+
+func TestHeaderV3ReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir})
+	if err := rn.contentEnc.UseHeaderV3(keystore.New(dir)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file")
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, "file", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	ctx := context.Background()
+	want := bytes.Repeat([]byte("x"), 5000)
+	if _, errno = f.Write(ctx, want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	f.Release(ctx)
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(buf)) != rn.contentEnc.PlainSizeToCipherSize(uint64(len(want))) {
+		t.Errorf("ciphertext has %d bytes", len(buf))
+	}
+	h, _, err := rn.contentEnc.OpenHeader(buf[:contentenc.HeaderLenV3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != contentenc.HeaderVersion3 || h.WrappedKey == nil {
+		t.Errorf("header %+v", h)
+	}
+	// Read back through a new file table entry, so that the data key is
+	// unwrapped from the header
+	fd, err = syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno = NewFile(fd, "file", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer f.Release(ctx)
+	have, errno := f.doRead(ctx, nil, 0, uint64(len(want)))
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("content mismatch: have %d bytes", len(have))
+	}
+}
@@ -0,0 +1,103 @@
+package fusefrontend
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Actions for "-on-corruption"
+const (
+	CorruptionContinue = "continue"
+	CorruptionReadOnly = "ro"
+	CorruptionUnmount  = "unmount"
+)
+
+// integrityGuard implements "-on-corruption". It counts integrity failures
+// (file content that fails GCM authentication, names that fail to decrypt)
+// and switches the mount to read-only once "limit" is reached.
+type integrityGuard struct {
+	action string
+	limit  int64
+	// failures is the number of integrity failures seen so far
+	failures atomic.Int64
+	readOnly atomic.Bool
+	// tripped is closed when the limit is reached
+	tripped  chan struct{}
+	tripOnce sync.Once
+}
+
+func newIntegrityGuard(action string, limit int) *integrityGuard {
+	if limit < 1 {
+		limit = 1
+	}
+	return &integrityGuard{
+		action:  action,
+		limit:   int64(limit),
+		tripped: make(chan struct{}),
+	}
+}
+
+// failure records an integrity failure on "item" (an inode number or a
+// ciphertext name) triggered by "caller", see callerString
+func (g *integrityGuard) failure(item string, caller string) {
+	n := g.failures.Add(1)
+	if n < g.limit || g.action == CorruptionContinue || g.action == "" {
+		return
+	}
+	g.tripOnce.Do(func() {
+		g.readOnly.Store(true)
+		// Logged at the Fatal level, which is LOG_CRIT in syslog, so it
+		// is not lost among the warnings about the single failures
+		tlog.Fatal.Printf("integrity: %d integrity failures, the last on %q by %s. CIPHERDIR may be tampered with or failing. action=%s, the mount is now read-only",
+			n, item, caller, g.action)
+		close(g.tripped)
+	})
+}
+
+// writable returns EROFS once the limit has been reached
+func (g *integrityGuard) writable() syscall.Errno {
+	if g.readOnly.Load() {
+		return syscall.EROFS
+	}
+	return 0
+}
+
+// reportIntegrityFailure is called for each GCM authentication failure and
+// each name that cannot be decrypted while serving the FUSE request in "ctx"
+func (rn *RootNode) reportIntegrityFailure(ctx context.Context, item string) {
+	if rn.integrity != nil {
+		rn.integrity.failure(item, callerString(ctx))
+	}
+}
+
+// checkWritable returns EROFS if "-on-corruption" has switched the mount to
+// read-only
+func (rn *RootNode) checkWritable() syscall.Errno {
+	if rn.integrity == nil {
+		return 0
+	}
+	return rn.integrity.writable()
+}
+
+// CorruptionLimitReached returns a channel that is closed when the
+// "-on-corruption" limit is reached. It is never closed with
+// "-on-corruption continue".
+func (rn *RootNode) CorruptionLimitReached() <-chan struct{} {
+	if rn.integrity == nil {
+		return nil
+	}
+	return rn.integrity.tripped
+}
+
+// registerStats registers the integrity failure statistics in "r"
+func (g *integrityGuard) registerStats(r *stats.Registry) {
+	r.Func("integrity_failures_total", stats.KindCounter, "File contents and names that failed authentication",
+		func() int64 { return g.failures.Load() })
+	r.Func("integrity_read_only", stats.KindGauge, "The mount has been switched to read-only by -on-corruption",
+		func() int64 { return stats.Bool(g.readOnly.Load()) })
+}
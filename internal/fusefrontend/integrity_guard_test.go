@@ -0,0 +1,47 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+)
+
+func TestIntegrityGuard(t *testing.T) {
+	rn := &RootNode{integrity: newIntegrityGuard(CorruptionReadOnly, 2)}
+	r := stats.New()
+	rn.RegisterStats(r)
+	rn.reportIntegrityFailure(context.Background(), "1")
+	if errno := rn.checkWritable(); errno != 0 {
+		t.Fatalf("read-only after one failure: %v", errno)
+	}
+	select {
+	case <-rn.CorruptionLimitReached():
+		t.Fatal("limit reached after one failure")
+	default:
+	}
+	rn.reportIntegrityFailure(context.Background(), "2")
+	rn.reportIntegrityFailure(context.Background(), "3")
+	if errno := rn.checkWritable(); errno != syscall.EROFS {
+		t.Errorf("have %v, want EROFS", errno)
+	}
+	select {
+	case <-rn.CorruptionLimitReached():
+	default:
+		t.Error("limit not reached")
+	}
+	if m := r.Map(); m["integrity_failures_total"] != 3 || m["integrity_read_only"] != 1 {
+		t.Errorf("wrong stats: %v", m)
+	}
+}
+
+func TestIntegrityGuardContinue(t *testing.T) {
+	rn := &RootNode{integrity: newIntegrityGuard(CorruptionContinue, 1)}
+	for i := 0; i < 10; i++ {
+		rn.reportIntegrityFailure(context.Background(), "x")
+	}
+	if errno := rn.checkWritable(); errno != 0 {
+		t.Errorf("have %v", errno)
+	}
+}
@@ -0,0 +1,89 @@
+package fusefrontend
+
+import (
+	"sync"
+	"time"
+)
+
+// negCacheMaxEntries is the number of entries at which negCache is emptied.
+const negCacheMaxEntries = 100000
+
+type negCacheKey struct {
+	// inode number of the parent directory
+	parentIno uint64
+	name      string
+}
+
+// negCache remembers names that Lookup did not find, for "-negative-timeout".
+// The kernel caches negative entries as well, but forgets them under memory
+// pressure and on its own invalidations. The entries are forgotten when a
+// name is created in the directory.
+type negCache struct {
+	sync.Mutex
+	ttl time.Duration
+	// entries maps names to the time they expire
+	entries map[negCacheKey]time.Time
+	// gen is incremented by every forget. A Lookup only stores its result
+	// if gen did not change while it was looking, see add.
+	gen uint64
+}
+
+func newNegCache(ttl time.Duration) *negCache {
+	return &negCache{
+		ttl:     ttl,
+		entries: make(map[negCacheKey]time.Time),
+	}
+}
+
+// has returns true if "name" in "parent" is known not to exist, and the
+// current generation, which must be passed to add.
+func (c *negCache) has(parent *Node, name string) (found bool, gen uint64) {
+	key := negCacheKey{parentIno: parent.StableAttr().Ino, name: name}
+	c.Lock()
+	defer c.Unlock()
+	expires, ok := c.entries[key]
+	if ok && time.Now().After(expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	return ok, c.gen
+}
+
+// add remembers that "name" in "parent" does not exist, unless a name has
+// been created since "gen" was returned by has.
+func (c *negCache) add(parent *Node, name string, gen uint64) {
+	c.Lock()
+	defer c.Unlock()
+	if c.gen != gen {
+		return
+	}
+	if len(c.entries) >= negCacheMaxEntries {
+		c.entries = make(map[negCacheKey]time.Time)
+	}
+	c.entries[negCacheKey{parentIno: parent.StableAttr().Ino, name: name}] = time.Now().Add(c.ttl)
+}
+
+// forget must be called after "name" has been created in "parent".
+func (c *negCache) forget(parent *Node, name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	delete(c.entries, negCacheKey{parentIno: parent.StableAttr().Ino, name: name})
+}
+
+// clear forgets all entries. Used when names are created outside of
+// the FUSE calls.
+func (c *negCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.gen++
+	c.entries = make(map[negCacheKey]time.Time)
+}
+
+// forgetNegative forgets the negative cache entry of "name" in "n", if
+// there is a negative cache.
+func (n *Node) forgetNegative(name string) {
+	if c := n.rootNode().negCache; c != nil {
+		c.forget(n, name)
+	}
+}
@@ -0,0 +1,37 @@
+package fusefrontend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNegCache(t *testing.T) {
+	c := newNegCache(time.Hour)
+	dir := &Node{}
+	found, gen := c.has(dir, "x")
+	if found {
+		t.Fatal("empty cache has x")
+	}
+	c.add(dir, "x", gen)
+	if found, _ = c.has(dir, "x"); !found {
+		t.Error("x was not added")
+	}
+	c.forget(dir, "x")
+	if found, _ = c.has(dir, "x"); found {
+		t.Error("x was not forgotten")
+	}
+	// A name created while Lookup was looking must not be added
+	_, gen = c.has(dir, "y")
+	c.forget(dir, "y")
+	c.add(dir, "y", gen)
+	if found, _ = c.has(dir, "y"); found {
+		t.Error("stale y was added")
+	}
+	// Entries expire
+	c.ttl = -time.Second
+	_, gen = c.has(dir, "z")
+	c.add(dir, "z", gen)
+	if found, _ = c.has(dir, "z"); found {
+		t.Error("z did not expire")
+	}
+}
@@ -2,6 +2,7 @@ package fusefrontend
 
 import (
 	"context"
+	"path"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -9,6 +10,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -22,6 +24,18 @@ type Node struct {
 
 // Lookup - FUSE call for discovering a file.
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch *fs.Inode, errno syscall.Errno) {
+	defer n.rootNode().supervise(&errno)
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Read); errno != 0 {
+		return
+	}
+	rn := n.rootNode()
+	var negGen uint64
+	if rn.negCache != nil {
+		var found bool
+		if found, negGen = rn.negCache.has(n, name); found {
+			return nil, syscall.ENOENT
+		}
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -31,19 +45,22 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 	// Get device number and inode number into `st`
 	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
+		if err == syscall.ENOENT && rn.negCache != nil {
+			rn.negCache.add(n, name, negGen)
+		}
 		return nil, fs.ToErrno(err)
 	}
 
 	// Create new inode and fill `out`
-	ch = n.newChild(ctx, st, out)
+	ch = n.newChild(ctx, dirfd, cName, st, out)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	n.translateSize(dirfd, cName, &out.Attr)
 
-	rn := n.rootNode()
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
+	n.setEntryTimeout(out)
 
 	if rn.args.SharedStorage {
 		// If we already have a child node that matches what we found on disk*
@@ -69,6 +86,7 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 //
 // GetAttr is symlink-safe through use of openBackingDir() and Fstatat().
 func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) (errno syscall.Errno) {
+	defer n.rootNode().supervise(&errno)
 	// If the kernel gives us a file handle, use it.
 	if f != nil {
 		if fga, ok := f.(fs.FileGetattrer); ok {
@@ -112,7 +130,7 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	}
 
 	// Fix inode number
-	rn.inoMap.TranslateStat(st)
+	rn.translateIno(dirfd, cName, st)
 	out.Attr.FromStat(st)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
@@ -122,10 +140,21 @@ out:
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
+	n.setAttrTimeout(out)
 	return 0
 }
 
 func (n *Node) Access(ctx context.Context, mode uint32) syscall.Errno {
+	want := accesspolicy.Read
+	if mode&unix.W_OK != 0 {
+		want = accesspolicy.Write
+		if mode&(unix.R_OK|unix.X_OK) != 0 {
+			want |= accesspolicy.Read
+		}
+	}
+	if errno := n.checkPolicy(ctx, "", want); errno != 0 {
+		return errno
+	}
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return errno
@@ -140,14 +169,41 @@ func (n *Node) Access(ctx context.Context, mode uint32) syscall.Errno {
 //
 // Symlink-safe through use of Unlinkat().
 func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.dirChanged(name)
+
+	manifestDone, errno := n.rootNode().manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return
+	}
+	defer journalDone()
+	rn := n.rootNode()
+	defer rn.linksBegin(ctx, dirfd, cName)()
 
-	// Delete content
-	err := syscallcompat.Unlinkat(dirfd, cName, 0)
+	// Delete content, or move it to the trash
+	var err error
+	if rn.args.Trash > 0 {
+		err = rn.trashUnlink(dirfd, cName, path.Join(n.Path(), name))
+		if err == syscall.EXDEV {
+			tlog.Warn.Printf("Unlink: %q is on a different filesystem than the trash, deleting it", cName)
+		}
+	}
+	if rn.args.Trash == 0 || err == syscall.EXDEV {
+		err = syscallcompat.Unlinkat(dirfd, cName, 0)
+	}
 	if err != nil {
 		return fs.ToErrno(err)
 	}
@@ -165,6 +221,9 @@ func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
 //
 // Symlink-safe through openBackingDir() + Readlinkat().
 func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
+	if errno = n.checkPolicy(ctx, "", accesspolicy.Read); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
@@ -176,6 +235,28 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 
 // Setattr - FUSE call. Called for chmod, truncate, utimens, ...
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	if errno = n.checkPolicy(ctx, "", accesspolicy.Write); errno != 0 {
+		return
+	}
+	// With AuthTimes, record the new mtime
+	_, mtimeSet := in.GetMTime()
+	_, sizeSet := in.GetSize()
+	if n.rootNode().args.AuthTimes && (mtimeSet || sizeSet) {
+		defer func() {
+			if errno == 0 {
+				n.recordTimes(ctx)
+			}
+		}()
+	}
+	// With -encrypt-acl, the backing filesystem cannot update the ACL on
+	// chmod for us
+	if mode, ok := in.GetMode(); ok && n.rootNode().args.EncryptACL {
+		defer func() {
+			if errno == 0 {
+				errno = n.chmodEncryptedACL(ctx, mode)
+			}
+		}()
+	}
 	// Use the fd if the kernel gave us one
 	if f != nil {
 		f2 := f.(*File)
@@ -246,7 +327,7 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		}
 		f2 := f.(*File)
 		defer f2.Release(ctx)
-		errno = syscall.Errno(f2.truncate(sz))
+		errno = syscall.Errno(f2.truncate(ctx, sz))
 		if errno != 0 {
 			return errno
 		}
@@ -260,13 +341,17 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 //
 // Symlink-safe because the path is ignored.
 func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	p := n.rootNode().args.Cipherdir
+	rn := n.rootNode()
+	p := rn.args.Cipherdir
 	var st syscall.Statfs_t
 	err := syscall.Statfs(p, &st)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
 	out.FromStatfsT(&st)
+	if rn.args.Statfs != StatfsRaw {
+		rn.adjustStatfs(out)
+	}
 	return 0
 }
 
@@ -274,17 +359,36 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 //
 // Symlink-safe through use of Mknodat().
 func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return
+	}
+	if errno = n.checkForbiddenName(ctx, name); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.forgetNegative(name)
+	defer n.dirChanged(name)
 
 	// Make sure context is nil if we don't want to preserve the owner
 	rn := n.rootNode()
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return
+	}
+	defer journalDone()
 
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
 	var err error
@@ -315,11 +419,14 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 		return
 	}
 
-	inode = n.newChild(ctx, st, out)
+	inode = n.newChild(ctx, dirfd, cName, st, out)
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
+	if rn.args.AuthTimes && mode&syscall.S_IFMT == syscall.S_IFREG {
+		toNode(inode.Operations()).recordTimes(ctx)
+	}
 
 	return inode, 0
 }
@@ -329,11 +436,23 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 //
 // Symlink-safe through use of Linkat().
 func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return
+	}
+	if errno = n.checkPolicyLink(ctx, toNode(target), name); errno != 0 {
+		return
+	}
+	if errno = n.checkForbiddenName(ctx, name); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.forgetNegative(name)
+	defer n.dirChanged(name)
 
 	n2 := toNode(target)
 	dirfd2, cName2, errno := n2.prepareAtSyscallMyself()
@@ -342,8 +461,19 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 	}
 	defer syscall.Close(dirfd2)
 
-	// Handle long file name (except in PlaintextNames mode)
 	rn := n.rootNode()
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return
+	}
+	defer journalDone()
+
+	// Handle long file name (except in PlaintextNames mode)
 	var err error
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
@@ -370,7 +500,10 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 		errno = fs.ToErrno(err)
 		return
 	}
-	inode = n.newChild(ctx, st, out)
+	if rn.args.AuthLinks {
+		n2.recordLinks(ctx)
+	}
+	inode = n.newChild(ctx, dirfd, cName, st, out)
 	n.translateSize(dirfd, cName, &out.Attr)
 	return inode, 0
 }
@@ -379,25 +512,47 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 //
 // Symlink-safe through use of Symlinkat.
 func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return
+	}
+	if errno = n.checkForbiddenName(ctx, name); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.forgetNegative(name)
+	defer n.dirChanged(name)
 
 	// Make sure context is nil if we don't want to preserve the owner
 	rn := n.rootNode()
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return
+	}
+	defer journalDone()
 
 	cTarget := target
+	var err error
 	if !rn.args.PlaintextNames {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
 		cTarget = rn.encryptSymlinkTarget(target)
+		if cTarget, err = rn.storeLongSymlink(name, target, cTarget); err != nil {
+			return nil, fs.ToErrno(err)
+		}
 	}
 	// Create ".name" file to store long file name (except in PlaintextNames mode)
-	var err error
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
 		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name)
@@ -425,7 +580,7 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 	// Report the plaintext size, not the encrypted blob size
 	st.Size = int64(len(target))
 
-	inode = n.newChild(ctx, st, out)
+	inode = n.newChild(ctx, dirfd, cName, st, out)
 	return inode, 0
 }
 
@@ -450,12 +605,32 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 	if errno = rejectRenameFlags(flags); errno != 0 {
 		return errno
 	}
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return
+	}
+	if errno = toNode(newParent).checkPolicy(ctx, newName, accesspolicy.Write); errno != 0 {
+		return
+	}
+	if errno = n.checkPolicyRename(ctx, name); errno != 0 {
+		return
+	}
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		// The destination moves as well
+		if errno = toNode(newParent).checkPolicyRename(ctx, newName); errno != 0 {
+			return
+		}
+	}
+	if errno = toNode(newParent).checkForbiddenName(ctx, newName); errno != 0 {
+		return
+	}
 
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.dirChanged(name)
 
 	n2 := toNode(newParent)
 	dirfd2, cName2, errno := n2.prepareAtSyscall(newName)
@@ -463,12 +638,49 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		return
 	}
 	defer syscall.Close(dirfd2)
+	defer n.rootNode().invalidateCaseIndex(dirfd2)
+	defer n2.forgetNegative(newName)
+	defer n2.dirChanged(newName)
 
 	// Easy case.
 	rn := n.rootNode()
 	if rn.args.PlaintextNames {
 		return fs.ToErrno(syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags)))
 	}
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return
+	}
+	defer journalDone()
+	manifestDone2, errno := rn.manifestBegin(dirfd2, cName2)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone2()
+	journalDone2, errno := n2.journalLongName(cName2)
+	if errno != 0 {
+		return
+	}
+	defer journalDone2()
+	// A file that is replaced loses a link
+	defer rn.linksBegin(ctx, dirfd2, cName2)()
+	dirIVDone, errno := rn.dirIVMove(dirfd, cName, cName2)
+	if errno != 0 {
+		return
+	}
+	dirIVDone2 := func(bool) {}
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		dirIVDone2, errno = rn.dirIVMove(dirfd2, cName2, cName)
+		if errno != 0 {
+			dirIVDone(false)
+			return
+		}
+	}
 	// Long destination file name: create .name file
 	nameFileAlreadyThere := false
 	var err error
@@ -480,6 +692,8 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		if err == syscall.EEXIST {
 			nameFileAlreadyThere = true
 		} else if err != nil {
+			dirIVDone(false)
+			dirIVDone2(false)
 			return fs.ToErrno(err)
 		}
 	}
@@ -497,6 +711,8 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 			err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
 		}
 	}
+	dirIVDone(err == nil)
+	dirIVDone2(err == nil)
 	if err != nil {
 		if nametransform.IsLongContent(cName2) && !nameFileAlreadyThere {
 			// Roll back .name creation unless the .name file was already there
@@ -515,10 +731,32 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 	return 0
 }
 
+// Flush - FUSE call. Called on each close(). With AuthTimes, records the
+// mtime of a file that has been written to.
+func (n *Node) Flush(ctx context.Context, f fs.FileHandle) syscall.Errno {
+	f2, ok := f.(*File)
+	if !ok {
+		return 0
+	}
+	errno := f2.Flush(ctx)
+	if errno == 0 && f2.timesDirty.Swap(false) {
+		n.recordTimes(ctx)
+	}
+	return errno
+}
+
 // Fsync: handles FUSE opcodes FSYNC & FDIRSYNC
 //
 // Note: f is always set to nil by go-fuse
-func (n *Node) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall.Errno {
+func (n *Node) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) (errno syscall.Errno) {
+	if errno2 := n.rootNode().runOp(ctx, "fsync", func() { errno = n.fsync() }); errno2 != 0 {
+		return errno2
+	}
+	return errno
+}
+
+// fsync implements Fsync, see there.
+func (n *Node) fsync() syscall.Errno {
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return errno
@@ -533,3 +771,37 @@ func (n *Node) Fsync(ctx context.Context, f fs.FileHandle, flags uint32) syscall
 
 	return fs.ToErrno(syscall.Fsync(fd))
 }
+
+// dirIVMove prepares renaming "cName" in "dirfd" to "cName2" if it is a
+// directory and gocryptfs.diriv files are authenticated, see
+// nametransform.PrepareDirIVMoveAt. The returned function must be called
+// once the rename is done, with "ok" set if it succeeded.
+func (rn *RootNode) dirIVMove(dirfd int, cName string, cName2 string) (done func(ok bool), errno syscall.Errno) {
+	noop := func(bool) {}
+	if !rn.nameTransform.DirIVAuth() {
+		return noop, 0
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+	if err == syscall.ENOTDIR || err == syscall.ENOENT {
+		// Not a directory, or nothing to move. Let Renameat handle it.
+		return noop, 0
+	} else if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	err = rn.nameTransform.PrepareDirIVMoveAt(fd, cName, cName2)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fs.ToErrno(err)
+	}
+	done = func(ok bool) {
+		if ok {
+			if err := rn.nameTransform.CommitDirIVMoveAt(fd); err != nil {
+				tlog.Warn.Printf("Rename: %q: could not update %s: %v", cName2, nametransform.DirIVFilename, err)
+			}
+		} else {
+			rn.nameTransform.AbortDirIVMoveAt(fd)
+		}
+		syscall.Close(fd)
+	}
+	return done, 0
+}
@@ -0,0 +1,150 @@
+package fusefrontend
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkPolicy returns EACCES if the "-access-policy" does not allow the
+// caller of the FUSE request in "ctx" to access "child" in directory "n"
+// with "want". If "child" is empty, "n" itself is checked.
+// Write access returns EROFS once "-on-corruption" has switched the mount to
+// read-only.
+//
+// Requests without a caller do not come from the kernel and are not checked.
+func (n *Node) checkPolicy(ctx context.Context, child string, want accesspolicy.Access) syscall.Errno {
+	if want&accesspolicy.Write != 0 {
+		if errno := n.rootNode().checkWritable(); errno != 0 {
+			return errno
+		}
+	}
+	policy, caller := n.policyCaller(ctx)
+	if policy == nil {
+		return 0
+	}
+	p := n.Path()
+	if child != "" {
+		p = path.Join(p, child)
+	}
+	groups := func() []uint32 {
+		return callerGroups(caller)
+	}
+	if !policy.Allowed(p, caller.Uid, groups, want) {
+		tlog.Info.Printf("access-policy: denied %s access to %q for %s", want, p, callerString(ctx))
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// policyCaller returns the "-access-policy" and the caller of the FUSE
+// request in "ctx". The policy is nil if there is none, or if the request
+// does not come from the kernel.
+func (n *Node) policyCaller(ctx context.Context) (*accesspolicy.Policy, *fuse.Caller) {
+	policy := n.rootNode().args.AccessPolicy
+	if policy == nil {
+		return nil, nil
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+	return policy, caller
+}
+
+// checkPolicyRename returns EACCES if a PATH of the "-access-policy" is at
+// or below "child" in directory "n". Renaming "child" would move the files
+// under that PATH away from its rules, like renaming "finance" when there
+// is a rule for "finance/salary".
+func (n *Node) checkPolicyRename(ctx context.Context, child string) syscall.Errno {
+	policy, _ := n.policyCaller(ctx)
+	if policy == nil {
+		return 0
+	}
+	p := path.Join(n.Path(), child)
+	if policy.HasRulesBelow(p) {
+		tlog.Info.Printf("access-policy: denied renaming %q, it contains a policy PATH, for %s", p, callerString(ctx))
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// checkPolicyLink returns EACCES if the "-access-policy" does not allow the
+// caller to create the hard link "child" in directory "n" to "target". The
+// caller needs write access to "target", and the link must be governed by
+// the same PATH as "target": otherwise, the link would give access to the
+// file under other rules.
+func (n *Node) checkPolicyLink(ctx context.Context, target *Node, child string) syscall.Errno {
+	if errno := target.checkPolicy(ctx, "", accesspolicy.Write); errno != 0 {
+		return errno
+	}
+	policy, _ := n.policyCaller(ctx)
+	if policy == nil {
+		return 0
+	}
+	src := target.Path()
+	dst := path.Join(n.Path(), child)
+	srcRule, srcOk := policy.Governing(src)
+	dstRule, dstOk := policy.Governing(dst)
+	if srcOk != dstOk || srcRule != dstRule {
+		tlog.Info.Printf("access-policy: denied linking %q to %q, they are governed by different PATHs, for %s",
+			src, dst, callerString(ctx))
+		return syscall.EACCES
+	}
+	return 0
+}
+
+// openFlagsAccess returns the access needed to open a file with "flags".
+func openFlagsAccess(flags uint32) accesspolicy.Access {
+	var want accesspolicy.Access
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		want = accesspolicy.Read
+	case syscall.O_WRONLY:
+		want = accesspolicy.Write
+	default:
+		want = accesspolicy.Read | accesspolicy.Write
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		want |= accesspolicy.Write
+	}
+	return want
+}
+
+// callerGroups returns the primary and the supplementary groups of "caller".
+// FUSE only passes the primary group, the supplementary groups are read from
+// /proc. If that fails (the process may have exited, or there is no /proc),
+// only the primary group is returned.
+func callerGroups(caller *fuse.Caller) []uint32 {
+	gids := []uint32{caller.Gid}
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", caller.Pid))
+	if err != nil {
+		return gids
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, g := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			gid, err := strconv.ParseUint(g, 10, 32)
+			if err == nil {
+				gids = append(gids, uint32(gid))
+			}
+		}
+		break
+	}
+	return gids
+}
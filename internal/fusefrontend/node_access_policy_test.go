@@ -0,0 +1,118 @@
+package fusefrontend
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// policyTestFS drives the node tree through the raw FUSE API, like the
+// kernel, so that requests carry a caller
+type policyTestFS struct {
+	t   *testing.T
+	raw fuse.RawFileSystem
+}
+
+func newPolicyTestFS(t *testing.T, policy string) *policyTestFS {
+	p, err := accesspolicy.Parse(strings.NewReader(policy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	n := nametransform.New(cCore.EMECipher, true, 0, true, nil, false, nil)
+	args := Args{Cipherdir: t.TempDir(), PlaintextNames: true, AccessPolicy: p}
+	return &policyTestFS{t: t, raw: fs.NewNodeFS(NewRootNode(args, cEnc, n), &fs.Options{})}
+}
+
+func header(nodeID uint64, uid uint32) fuse.InHeader {
+	return fuse.InHeader{NodeId: nodeID, Caller: fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: uid}}}
+}
+
+func (f *policyTestFS) mkdir(parent uint64, name string, uid uint32) uint64 {
+	var out fuse.EntryOut
+	in := fuse.MkdirIn{InHeader: header(parent, uid), Mode: 0700}
+	if st := f.raw.Mkdir(nil, &in, name, &out); !st.Ok() {
+		f.t.Fatalf("mkdir %q: %v", name, st)
+	}
+	return out.NodeId
+}
+
+func (f *policyTestFS) create(parent uint64, name string, uid uint32) uint64 {
+	var out fuse.CreateOut
+	in := fuse.CreateIn{InHeader: header(parent, uid), Flags: syscall.O_RDWR, Mode: 0600}
+	if st := f.raw.Create(nil, &in, name, &out); !st.Ok() {
+		f.t.Fatalf("create %q: %v", name, st)
+	}
+	f.raw.Release(nil, &fuse.ReleaseIn{InHeader: header(out.NodeId, uid), Fh: out.Fh})
+	return out.NodeId
+}
+
+func (f *policyTestFS) link(target uint64, parent uint64, name string, uid uint32) fuse.Status {
+	var out fuse.EntryOut
+	in := fuse.LinkIn{InHeader: header(parent, uid), Oldnodeid: target}
+	return f.raw.Link(nil, &in, name, &out)
+}
+
+func (f *policyTestFS) rename(parent uint64, name string, newParent uint64, newName string, uid uint32) fuse.Status {
+	in := fuse.RenameIn{InHeader: header(parent, uid), Newdir: newParent}
+	return f.raw.Rename(nil, &in, name, newName)
+}
+
+const policyTestRules = `
+/finance        rw   uid:1000
+/finance        r    uid:1001
+/finance/salary rw   uid:1000
+`
+
+// Renaming a directory above a policy PATH would take the files below it
+// away from their rules
+func TestAccessPolicyRenameAncestor(t *testing.T) {
+	f := newPolicyTestFS(t, policyTestRules)
+	root := uint64(fuse.FUSE_ROOT_ID)
+	finance := f.mkdir(root, "finance", 1000)
+	f.create(finance, "salary", 1000)
+	f.create(finance, "report", 1000)
+
+	if st := f.rename(root, "finance", root, "fin2", 1000); st != fuse.EACCES {
+		t.Errorf("renaming the parent of a PATH: have %v, want EACCES", st)
+	}
+	if st := f.rename(finance, "salary", finance, "salary2", 1000); st != fuse.EACCES {
+		t.Errorf("renaming a PATH: have %v, want EACCES", st)
+	}
+	if st := f.rename(finance, "report", finance, "report2", 1000); !st.Ok() {
+		t.Errorf("renaming below a PATH: %v", st)
+	}
+}
+
+// A hard link in an unrestricted directory would make a governed file
+// writable there
+func TestAccessPolicyLink(t *testing.T) {
+	f := newPolicyTestFS(t, policyTestRules)
+	root := uint64(fuse.FUSE_ROOT_ID)
+	finance := f.mkdir(root, "finance", 1000)
+	salary := f.create(finance, "salary", 1000)
+	report := f.create(finance, "report", 1000)
+
+	if st := f.link(report, root, "leak", 1001); st != fuse.EACCES {
+		t.Errorf("read-only user: have %v, want EACCES", st)
+	}
+	if st := f.link(report, root, "leak", 1000); st != fuse.EACCES {
+		t.Errorf("link out of the subtree: have %v, want EACCES", st)
+	}
+	if st := f.link(salary, finance, "salary2", 1000); st != fuse.EACCES {
+		t.Errorf("link to another PATH: have %v, want EACCES", st)
+	}
+	if st := f.link(report, finance, "report2", 1000); !st.Ok() {
+		t.Errorf("link within the subtree: %v", st)
+	}
+}
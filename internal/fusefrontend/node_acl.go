@@ -0,0 +1,214 @@
+package fusefrontend
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Names of the ACL xattrs
+const (
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+)
+
+// On-disk format of the ACL xattrs, see
+// linux/include/uapi/linux/posix_acl_xattr.h and posix_acl.h
+const (
+	aclXattrVersion = 2
+	aclHeaderLen    = 4
+	aclEntryLen     = 8
+
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+type aclEntry struct {
+	tag  uint16
+	perm uint16
+	id   uint32
+}
+
+// parseACL parses and validates an ACL xattr value.
+func parseACL(b []byte) ([]aclEntry, error) {
+	if len(b) < aclHeaderLen || (len(b)-aclHeaderLen)%aclEntryLen != 0 {
+		return nil, fmt.Errorf("invalid length %d", len(b))
+	}
+	if v := binary.LittleEndian.Uint32(b); v != aclXattrVersion {
+		return nil, fmt.Errorf("unsupported version %d", v)
+	}
+	var entries []aclEntry
+	count := map[uint16]int{}
+	for b = b[aclHeaderLen:]; len(b) > 0; b = b[aclEntryLen:] {
+		e := aclEntry{
+			tag:  binary.LittleEndian.Uint16(b),
+			perm: binary.LittleEndian.Uint16(b[2:]),
+			id:   binary.LittleEndian.Uint32(b[4:]),
+		}
+		switch e.tag {
+		case aclUserObj, aclUser, aclGroupObj, aclGroup, aclMask, aclOther:
+		default:
+			return nil, fmt.Errorf("unknown tag 0x%x", e.tag)
+		}
+		if e.perm > 7 {
+			return nil, fmt.Errorf("invalid permissions 0%o", e.perm)
+		}
+		count[e.tag]++
+		entries = append(entries, e)
+	}
+	for _, tag := range []uint16{aclUserObj, aclGroupObj, aclOther, aclMask} {
+		if count[tag] > 1 {
+			return nil, fmt.Errorf("duplicate tag 0x%x", tag)
+		}
+	}
+	if count[aclUserObj] != 1 || count[aclGroupObj] != 1 || count[aclOther] != 1 {
+		return nil, fmt.Errorf("missing base entry")
+	}
+	if count[aclUser]+count[aclGroup] > 0 && count[aclMask] == 0 {
+		return nil, fmt.Errorf("missing mask entry")
+	}
+	return entries, nil
+}
+
+// marshalACL is the inverse of parseACL.
+func marshalACL(entries []aclEntry) []byte {
+	b := make([]byte, aclHeaderLen, aclHeaderLen+len(entries)*aclEntryLen)
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for _, e := range entries {
+		b = binary.LittleEndian.AppendUint16(b, e.tag)
+		b = binary.LittleEndian.AppendUint16(b, e.perm)
+		b = binary.LittleEndian.AppendUint32(b, e.id)
+	}
+	return b
+}
+
+// aclMode returns the permission bits for an access ACL. The group bits come
+// from the mask entry if there is one. "equiv" is true if the ACL contains
+// nothing beyond the permission bits (like posix_acl_equiv_mode in the
+// kernel).
+func aclMode(entries []aclEntry) (mode uint32, equiv bool) {
+	var group, mask uint32
+	haveMask := false
+	for _, e := range entries {
+		switch e.tag {
+		case aclUserObj:
+			mode |= uint32(e.perm) << 6
+		case aclGroupObj:
+			group = uint32(e.perm)
+		case aclMask:
+			mask = uint32(e.perm)
+			haveMask = true
+		case aclOther:
+			mode |= uint32(e.perm)
+		}
+	}
+	if haveMask {
+		group = mask
+	}
+	return mode | group<<3, len(entries) == 3
+}
+
+// aclChmod applies the permission bits in "mode" to the ACL, like
+// posix_acl_chmod in the kernel does after chmod(2).
+func aclChmod(entries []aclEntry, mode uint32) {
+	haveMask := false
+	for _, e := range entries {
+		if e.tag == aclMask {
+			haveMask = true
+		}
+	}
+	for i := range entries {
+		e := &entries[i]
+		switch e.tag {
+		case aclUserObj:
+			e.perm = uint16(mode>>6) & 7
+		case aclGroupObj:
+			if !haveMask {
+				e.perm = uint16(mode>>3) & 7
+			}
+		case aclMask:
+			e.perm = uint16(mode>>3) & 7
+		case aclOther:
+			e.perm = uint16(mode) & 7
+		}
+	}
+}
+
+// setEncryptedAccessACL stores an access ACL when mounted with
+// "-encrypt-acl". Like a local filesystem would, we put the permission bits
+// into the file mode, so they are also enforced by the backing filesystem
+// and survive if the ACL is lost. An ACL that is fully represented by the
+// permission bits is not stored at all.
+func (n *Node) setEncryptedAccessACL(ctx context.Context, data []byte, flags uint32) syscall.Errno {
+	entries, err := parseACL(data)
+	if err != nil {
+		tlog.Warn.Printf("setEncryptedAccessACL: %v", err)
+		return syscall.EINVAL
+	}
+	mode, equiv := aclMode(entries)
+
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if uint32(st.Mode)&0777 != mode {
+		err = syscallcompat.FchmodatNofollow(dirfd, cName, uint32(st.Mode)&^(syscall.S_IFMT|0777)|mode)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	n.removePlaintextACL(aclAccess)
+	if equiv {
+		cAttr, err := n.rootNode().encryptXattrName(aclAccess)
+		if err != nil {
+			return syscall.EIO
+		}
+		if errno = n.removeXAttr(cAttr); errno == syscall.ENODATA {
+			errno = 0
+		}
+		return errno
+	}
+	return n.setEncryptedXattr(ctx, aclAccess, data, flags)
+}
+
+// chmodEncryptedACL updates a stored access ACL after chmod(2) when mounted
+// with "-encrypt-acl". The backing filesystem does this for plaintext ACLs.
+func (n *Node) chmodEncryptedACL(ctx context.Context, mode uint32) syscall.Errno {
+	data, errno := n.getEncryptedXattr(ctx, aclAccess)
+	if errno == syscall.ENODATA {
+		return 0
+	} else if errno != 0 {
+		return errno
+	}
+	entries, err := parseACL(data)
+	if err != nil {
+		tlog.Warn.Printf("chmodEncryptedACL: %v", err)
+		return syscall.EIO
+	}
+	aclChmod(entries, mode)
+	return n.setEncryptedXattr(ctx, aclAccess, marshalACL(entries), 0)
+}
+
+// removePlaintextACL removes a plaintext ACL that was set before we were
+// mounted with "-encrypt-acl". Returns true if there was one.
+func (n *Node) removePlaintextACL(attr string) bool {
+	return n.removeXAttr(attr) == 0
+}
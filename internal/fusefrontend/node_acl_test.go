@@ -0,0 +1,66 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseACL(t *testing.T) {
+	entries := []aclEntry{
+		{aclUserObj, 6, 0},
+		{aclUser, 4, 1000},
+		{aclGroupObj, 4, 0},
+		{aclMask, 5, 0},
+		{aclOther, 0, 0},
+	}
+	b := marshalACL(entries)
+	entries2, err := parseACL(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(entries, entries2) {
+		t.Errorf("round-trip failed: have %v, want %v", entries2, entries)
+	}
+	// Truncated input must not be accepted
+	for i := 0; i < len(b); i++ {
+		if _, err = parseACL(b[:i]); err == nil {
+			t.Errorf("truncated ACL (%d bytes) was accepted", i)
+		}
+	}
+	// Named entries need a mask
+	noMask := append([]aclEntry{}, entries[:3]...)
+	noMask = append(noMask, entries[4])
+	if _, err = parseACL(marshalACL(noMask)); err == nil {
+		t.Errorf("ACL without mask was accepted")
+	}
+	bad := append([]byte{}, b...)
+	bad[aclHeaderLen+2] = 8
+	if _, err = parseACL(bad); err == nil {
+		t.Errorf("invalid permissions were accepted")
+	}
+}
+
+func TestACLMode(t *testing.T) {
+	base := []aclEntry{{aclUserObj, 7, 0}, {aclGroupObj, 5, 0}, {aclOther, 1, 0}}
+	mode, equiv := aclMode(base)
+	if mode != 0751 || !equiv {
+		t.Errorf("have 0%o %v, want 0751 true", mode, equiv)
+	}
+	// The group bits come from the mask
+	named := []aclEntry{{aclUserObj, 7, 0}, {aclGroup, 7, 100}, {aclGroupObj, 5, 0}, {aclMask, 6, 0}, {aclOther, 1, 0}}
+	mode, equiv = aclMode(named)
+	if mode != 0761 || equiv {
+		t.Errorf("have 0%o %v, want 0761 false", mode, equiv)
+	}
+	// chmod changes the mask but leaves the group entry alone
+	aclChmod(named, 0640)
+	mode, _ = aclMode(named)
+	if mode != 0640 || named[2].perm != 5 || named[1].perm != 7 {
+		t.Errorf("aclChmod: have %v", named)
+	}
+	aclChmod(base, 0640)
+	if !bytes.Equal(marshalACL(base), marshalACL([]aclEntry{{aclUserObj, 6, 0}, {aclGroupObj, 4, 0}, {aclOther, 0, 0}})) {
+		t.Errorf("aclChmod without mask: have %v", base)
+	}
+}
@@ -24,6 +24,7 @@ var _ = (fs.NodeGetxattrer)((*Node)(nil))
 var _ = (fs.NodeSetxattrer)((*Node)(nil))
 var _ = (fs.NodeRemovexattrer)((*Node)(nil))
 var _ = (fs.NodeListxattrer)((*Node)(nil))
+var _ = (fs.NodeFlusher)((*Node)(nil))
 
 /* TODO
 var _ = (fs.NodeCopyFileRanger)((*Node)(nil))
@@ -0,0 +1,87 @@
+package fusefrontend
+
+import (
+	"errors"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// resolveCase implements "-case-insensitive", "-nfc" and "-nfd" for
+// prepareAtSyscall. "cName" is the ciphertext name of "child" in "dirfd". If
+// it does not exist, but a name that differs from "child" only in case or
+// normalization does, the (dirfd, cName) pair of that name is returned
+// instead. Otherwise, with "-case-fold", the pair of the lower-cased "child"
+// is returned, so that new names are created in lower case.
+//
+// Takes ownership of "dirfd".
+func (n *Node) resolveCase(dirfd int, cName string, child string) (int, string, syscall.Errno) {
+	rn := n.rootNode()
+	var st unix.Stat_t
+	if child == "" || syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW) != syscall.ENOENT {
+		return dirfd, cName, 0
+	}
+	actual, found, err := rn.caseIndex.Lookup(dirfd, child, rn.caseIndexDecrypter(dirfd))
+	if err != nil {
+		syscall.Close(dirfd)
+		return -1, "", fs.ToErrno(err)
+	}
+	if !found {
+		if !rn.args.CaseFold || nametransform.FoldCase(child) == child {
+			return dirfd, cName, 0
+		}
+		actual = nametransform.FoldCase(child)
+	}
+	syscall.Close(dirfd)
+	return n.prepareAtSyscallExact(actual)
+}
+
+// foldName returns the form of "name" that rn.caseIndex compares.
+func (rn *RootNode) foldName(name string) string {
+	name = rn.args.Normalization.Apply(name)
+	if rn.args.CaseInsensitive {
+		name = nametransform.FoldCase(name)
+	}
+	return name
+}
+
+// caseIndexDecrypter returns the function CaseIndex.Lookup uses to decrypt
+// the names in "dirfd".
+func (rn *RootNode) caseIndexDecrypter(dirfd int) func(cName string) (string, error) {
+	if rn.args.PlaintextNames {
+		return func(cName string) (string, error) {
+			return cName, nil
+		}
+	}
+	var iv []byte
+	return func(cName string) (string, error) {
+		if iv == nil {
+			var err error
+			if iv, err = rn.nameTransform.ReadDirIVAt(dirfd); err != nil {
+				return "", err
+			}
+		}
+		switch nametransform.NameType(cName) {
+		case nametransform.LongNameFilename:
+			return "", errors.New("long name file")
+		case nametransform.LongNameContent:
+			var err error
+			if cName, err = nametransform.ReadLongNameAt(dirfd, cName); err != nil {
+				return "", err
+			}
+		}
+		return rn.nameTransform.DecryptName(cName, iv)
+	}
+}
+
+// invalidateCaseIndex must be called after the names in "dirfd" have been
+// changed.
+func (rn *RootNode) invalidateCaseIndex(dirfd int) {
+	if rn.caseIndex != nil {
+		rn.caseIndex.Invalidate(dirfd)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
@@ -53,11 +54,19 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 	dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
 	if err == nil {
 		// Create gocryptfs.diriv
-		err = nametransform.WriteDirIVAt(dirfd2)
+		err = rn.nameTransform.CreateDirIVAt(dirfd2, cName)
+		if err == nil && rn.args.DirManifest {
+			// Create gocryptfs.manifest
+			err = rn.writeEmptyManifest(dirfd2)
+			if err != nil {
+				syscallcompat.Unlinkat(dirfd2, nametransform.DirIVFilename, 0)
+			}
+		}
 		syscall.Close(dirfd2)
 	}
 	if err != nil {
-		// Delete inconsistent directory (missing gocryptfs.diriv!)
+		// Delete inconsistent directory (missing gocryptfs.diriv or
+		// gocryptfs.manifest!)
 		err2 := syscallcompat.Unlinkat(dirfd, cName, unix.AT_REMOVEDIR)
 		if err2 != nil {
 			tlog.Warn.Printf("mkdirWithIv: rollback failed: %v", err2)
@@ -70,11 +79,20 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 //
 // Symlink-safe through use of Mkdirat().
 func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return nil, errno
+	}
+	if errno := n.checkForbiddenName(ctx, name); errno != 0 {
+		return nil, errno
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return nil, errno
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.forgetNegative(name)
+	defer n.dirChanged(name)
 
 	rn := n.rootNode()
 	var context *fuse.Context
@@ -82,6 +100,17 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		context = toFuseCtx(ctx)
 	}
 
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer journalDone()
+
 	var st syscall.Stat_t
 	if rn.args.PlaintextNames {
 		err := syscallcompat.MkdiratUser(dirfd, cName, mode, context)
@@ -96,7 +125,7 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 		st = syscallcompat.Unix2syscall(ust)
 
 		// Create child node & return
-		ch := n.newChild(ctx, &st, out)
+		ch := n.newChild(ctx, dirfd, cName, &st, out)
 		return ch, 0
 
 	}
@@ -154,7 +183,7 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 	}
 
 	// Create child node & return
-	ch := n.newChild(ctx, &st, out)
+	ch := n.newChild(ctx, dirfd, cName, &st, out)
 	return ch, 0
 }
 
@@ -162,17 +191,27 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 //
 // Symlink-safe through Unlinkat() + AT_REMOVEDIR.
 func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
+	if errno := n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return errno
+	}
 	rn := n.rootNode()
 	parentDirFd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return errno
 	}
 	defer syscall.Close(parentDirFd)
+	defer n.rootNode().invalidateCaseIndex(parentDirFd)
+	defer n.dirChanged(name)
 	if rn.args.PlaintextNames {
 		// Unlinkat with AT_REMOVEDIR is equivalent to Rmdir
 		err := unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 		return fs.ToErrno(err)
 	}
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return errno
+	}
+	defer journalDone()
 	if rn.args.DeterministicNames {
 		if err := unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR); err != nil {
 			return fs.ToErrno(err)
@@ -182,6 +221,11 @@ func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
 		}
 		return 0
 	}
+	manifestDone, errno := rn.manifestBegin(parentDirFd, cName)
+	if errno != 0 {
+		return errno
+	}
+	defer manifestDone()
 	// Unless we are running as root, we need read, write and execute permissions
 	// to handle gocryptfs.diriv.
 	permWorkaround := false
@@ -247,13 +291,33 @@ retry:
 		tlog.Warn.Printf("Rmdir: had to delete blocking file %q", dsStoreName)
 		goto retry
 	}
-	// If the directory is not empty besides gocryptfs.diriv, do not even
-	// attempt the dance around gocryptfs.diriv.
-	if len(children) > 1 {
+	// A gocryptfs.diriv.next file is left behind by a failed rename and can be
+	// deleted.
+	if rn.nameTransform.DirIVAuth() && len(children) <= 3 {
+		for _, c := range children {
+			if c.Name == nametransform.DirIVNextFilename {
+				tlog.Debug.Printf("Rmdir: deleting stale %s", c.Name)
+				err = unix.Unlinkat(dirfd, c.Name, 0)
+				if err != nil {
+					return fs.ToErrno(err)
+				}
+				goto retry
+			}
+		}
+	}
+	// If the directory is not empty besides gocryptfs.diriv (and
+	// gocryptfs.manifest), do not even attempt the dance around
+	// gocryptfs.diriv.
+	haveManifest := rn.args.DirManifest && len(children) == 2 &&
+		(children[0].Name == nametransform.ManifestFilename || children[1].Name == nametransform.ManifestFilename)
+	if len(children) > 1 && !haveManifest {
 		return fs.ToErrno(syscall.ENOTEMPTY)
 	}
-	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
-	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
+	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ",
+	// and "gocryptfs.manifest" as "gocryptfs.manifest.rmdir.XYZ"
+	rnd := cryptocore.RandUint64()
+	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, rnd)
+	tmpManifest := fmt.Sprintf("%s.rmdir.%d", nametransform.ManifestFilename, rnd)
 	tlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
 	// The directory is in an inconsistent state between rename and rmdir.
 	// Protect against concurrent readers.
@@ -266,6 +330,20 @@ retry:
 			nametransform.DirIVFilename, tmpName, err)
 		return fs.ToErrno(err)
 	}
+	if haveManifest {
+		err = syscallcompat.Renameat(dirfd, nametransform.ManifestFilename,
+			parentDirFd, tmpManifest)
+		if err != nil {
+			tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
+				nametransform.ManifestFilename, tmpManifest, err)
+			err2 := syscallcompat.Renameat(parentDirFd, tmpName,
+				dirfd, nametransform.DirIVFilename)
+			if err2 != nil {
+				tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
+			}
+			return fs.ToErrno(err)
+		}
+	}
 	// Actual Rmdir
 	err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 	if err != nil {
@@ -276,6 +354,13 @@ retry:
 		if err2 != nil {
 			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
 		}
+		if haveManifest {
+			err2 = syscallcompat.Renameat(parentDirFd, tmpManifest,
+				dirfd, nametransform.ManifestFilename)
+			if err2 != nil {
+				tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
+			}
+		}
 		return fs.ToErrno(err)
 	}
 	// Delete "gocryptfs.diriv.rmdir.XYZ"
@@ -283,6 +368,12 @@ retry:
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
 	}
+	if haveManifest {
+		err = syscallcompat.Unlinkat(parentDirFd, tmpManifest, 0)
+		if err != nil {
+			tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpManifest, err)
+		}
+	}
 	// Delete .name file
 	if nametransform.IsLongContent(cName) {
 		nametransform.DeleteLongNameAt(parentDirFd, cName)
@@ -292,6 +383,7 @@ retry:
 
 // Opendir is a FUSE call to check if the directory can be opened.
 func (n *Node) Opendir(ctx context.Context) (errno syscall.Errno) {
+	defer n.rootNode().supervise(&errno)
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
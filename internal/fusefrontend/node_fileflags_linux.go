@@ -0,0 +1,108 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+var _ = (fs.NodeIoctler)((*Node)(nil))
+
+// passthroughFlags are the file attribute flags (chattr +i, +a and +d) that
+// are forwarded to the ciphertext file. The others describe how the
+// backing filesystem stores the ciphertext, or do not make sense for it,
+// like compression of encrypted data, and are neither shown nor changed.
+const passthroughFlags = syscallcompat.FS_IMMUTABLE_FL | syscallcompat.FS_APPEND_FL | syscallcompat.FS_NODUMP_FL
+
+// Ioctl - FUSE call. The kernel implements FS_IOC_GETFLAGS and
+// FS_IOC_SETFLAGS (lsattr and chattr) through it, after checking that the
+// caller owns the file and, for the immutable and append-only flags, has
+// CAP_LINUX_IMMUTABLE. All other ioctls are rejected.
+//
+// The flags are set on the ciphertext file, so an immutable or append-only
+// file is protected by the backing filesystem. Fails with ENOTTY or
+// EOPNOTSUPP if the backing filesystem does not have these flags.
+func (n *Node) Ioctl(ctx context.Context, f fs.FileHandle, cmd uint32, arg uint64, input []byte, output []byte) (result int32, errno syscall.Errno) {
+	switch cmd {
+	case unix.FS_IOC_GETFLAGS:
+		if len(output) < 4 {
+			return 0, syscall.EINVAL
+		}
+		if errno = n.checkPolicy(ctx, "", accesspolicy.Read); errno != 0 {
+			return
+		}
+		var flags uint32
+		if flags, errno = n.getFlags(); errno != 0 {
+			return
+		}
+		*(*uint32)(unsafe.Pointer(&output[0])) = flags & passthroughFlags
+		return 0, 0
+	case unix.FS_IOC_SETFLAGS:
+		if len(input) < 4 {
+			return 0, syscall.EINVAL
+		}
+		if errno = n.checkPolicy(ctx, "", accesspolicy.Write); errno != 0 {
+			return
+		}
+		flags := *(*uint32)(unsafe.Pointer(&input[0]))
+		if flags&^passthroughFlags != 0 {
+			return 0, syscall.EOPNOTSUPP
+		}
+		return 0, n.setFlags(flags)
+	}
+	return 0, syscall.ENOTTY
+}
+
+// openFlags opens the ciphertext file or directory of "n" to get or set
+// its flags. Symlinks have no flags.
+func (n *Node) openFlags() (fd int, errno syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return -1, errno
+	}
+	defer syscall.Close(dirfd)
+
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ELOOP {
+		return -1, syscall.ENOTTY
+	}
+	return fd, fs.ToErrno(err)
+}
+
+// getFlags returns all flags of the ciphertext file
+func (n *Node) getFlags() (uint32, syscall.Errno) {
+	fd, errno := n.openFlags()
+	if errno != 0 {
+		return 0, errno
+	}
+	defer syscall.Close(fd)
+
+	flags, err := syscallcompat.GetFlags(fd)
+	return flags, fs.ToErrno(err)
+}
+
+// setFlags sets the passthroughFlags of the ciphertext file to "flags" and
+// keeps its other flags
+func (n *Node) setFlags(flags uint32) syscall.Errno {
+	fd, errno := n.openFlags()
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(fd)
+
+	old, err := syscallcompat.GetFlags(fd)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if old&passthroughFlags == flags {
+		return 0
+	}
+	return fs.ToErrno(syscallcompat.SetFlags(fd, old&^passthroughFlags|flags))
+}
@@ -0,0 +1,58 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+func TestIoctlFlags(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir})
+	ctx := context.Background()
+	get := func() uint32 {
+		out := make([]byte, 4)
+		if _, errno := rn.Ioctl(ctx, nil, unix.FS_IOC_GETFLAGS, 0, nil, out); errno != 0 {
+			if errno == syscall.ENOTTY || errno == syscall.EOPNOTSUPP {
+				t.Skipf("backing filesystem has no flags: %v", errno)
+			}
+			t.Fatal(errno)
+		}
+		return *(*uint32)(unsafe.Pointer(&out[0]))
+	}
+	set := func(flags uint32) syscall.Errno {
+		in := make([]byte, 4)
+		*(*uint32)(unsafe.Pointer(&in[0])) = flags
+		_, errno := rn.Ioctl(ctx, nil, unix.FS_IOC_SETFLAGS, 0, in, nil)
+		return errno
+	}
+	if flags := get(); flags&^passthroughFlags != 0 {
+		t.Errorf("flags %#x are not masked", flags)
+	}
+	// nodump does not need CAP_LINUX_IMMUTABLE
+	if errno := set(syscallcompat.FS_NODUMP_FL); errno != 0 {
+		if errno == syscall.EOPNOTSUPP {
+			t.Skip(errno)
+		}
+		t.Fatal(errno)
+	}
+	if flags := get(); flags != syscallcompat.FS_NODUMP_FL {
+		t.Errorf("have %#x", flags)
+	}
+	if errno := set(0); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Flags that describe the ciphertext storage are rejected. 0x4 is
+	// FS_COMPR_FL.
+	if errno := set(0x4); errno != syscall.EOPNOTSUPP {
+		t.Errorf("compression flag: have %v", errno)
+	}
+	if _, errno := rn.Ioctl(ctx, nil, unix.TIOCINQ, 0, nil, make([]byte, 4)); errno != syscall.ENOTTY {
+		t.Errorf("TIOCINQ: have %v", errno)
+	}
+}
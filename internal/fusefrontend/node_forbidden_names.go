@@ -0,0 +1,29 @@
+package fusefrontend
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkForbiddenName returns EPERM if "name", which the caller of the FUSE
+// request in "ctx" wants to create in directory "n", matches one of the
+// "-forbid-name" patterns. Like the names reserved by gocryptfs itself
+// (see isFiltered), the patterns are matched against the plaintext name,
+// in every directory.
+//
+// Only new names are refused. Existing entries with such a name can still be
+// accessed, renamed to another name and deleted.
+func (n *Node) checkForbiddenName(ctx context.Context, name string) syscall.Errno {
+	for _, pattern := range n.rootNode().args.ForbiddenNames {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			tlog.Info.Printf("forbid-name: refused to create %q (pattern %q) for %s",
+				path.Join(n.Path(), name), pattern, callerString(ctx))
+			return syscall.EPERM
+		}
+	}
+	return 0
+}
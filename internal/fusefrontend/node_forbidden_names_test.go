@@ -0,0 +1,42 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestForbiddenNames(t *testing.T) {
+	rn := newTestFS(Args{
+		Cipherdir:      t.TempDir(),
+		PlaintextNames: true,
+		ForbiddenNames: []string{".DS_Store", "[Tt]humbs.db", "._*"},
+	})
+	ctx := context.Background()
+	out := &fuse.EntryOut{}
+	for _, name := range []string{".DS_Store", "thumbs.db", "._foo"} {
+		if _, _, _, errno := rn.Create(ctx, name, syscall.O_RDWR, 0600, out); errno != syscall.EPERM {
+			t.Errorf("Create %q: have %v, want EPERM", name, errno)
+		}
+	}
+	if _, _, _, errno := rn.Create(ctx, "foo", syscall.O_RDWR, 0600, out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if errno := rn.Rename(ctx, "foo", rn, "Thumbs.db", 0); errno != syscall.EPERM {
+		t.Errorf("Rename: have %v, want EPERM", errno)
+	}
+	child, errno := rn.Mkdir(ctx, "dir", 0700, out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.AddChild("dir", child, false)
+	dir := toNode(child.Operations())
+	if _, errno := dir.Mkdir(ctx, ".DS_Store", 0700, out); errno != syscall.EPERM {
+		t.Errorf("Mkdir in subdirectory: have %v, want EPERM", errno)
+	}
+	if _, errno := dir.Symlink(ctx, "foo", "._bar", out); errno != syscall.EPERM {
+		t.Errorf("Symlink: have %v, want EPERM", errno)
+	}
+}
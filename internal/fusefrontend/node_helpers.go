@@ -8,6 +8,9 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -44,6 +47,13 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 	if rn.args.PlaintextNames {
 		return []byte(cTarget), 0
 	}
+	if rn.args.LongSymlinks && nametransform.IsLongSymlinkRef(cTarget) {
+		cTarget, err = nametransform.ReadLongSymlink(rn.args.Cipherdir, cTarget)
+		if err != nil {
+			tlog.Warn.Printf("Readlink %q: reading long target failed: %v", cName, err)
+			return nil, syscall.EIO
+		}
+	}
 	// Symlinks are encrypted like file contents (GCM) and base64-encoded
 	target, err := rn.decryptSymlinkTarget(cTarget)
 	if err != nil {
@@ -59,6 +69,12 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
 	if out.IsRegular() {
 		rn := n.rootNode()
+		if rn.dedup != nil && dedup.IsRecipeSize(rn.contentEnc, out.Size) {
+			if sz, ok := recipeSizeAt(dirfd, cName); ok {
+				out.Size = sz
+				return
+			}
+		}
 		out.Size = rn.contentEnc.CipherSizeToPlainSize(out.Size)
 	} else if out.IsSymlink() {
 		// read and decrypt target
@@ -72,18 +88,34 @@ func (n *Node) Path() string {
 	return n.Inode.Path(n.Root())
 }
 
+// translateIno replaces the inode number in "st", the stat of the backing
+// file "cName" in "dirfd", with the one the mount reports. If "cName" is
+// empty, "dirfd" is the backing file itself.
+func (rn *RootNode) translateIno(dirfd int, cName string, st *syscall.Stat_t) {
+	if !rn.args.StableInodes {
+		rn.inoMap.TranslateStat(st)
+		return
+	}
+	handle, err := syscallcompat.FileHandle(dirfd, cName)
+	if err != nil {
+		tlog.Warn.Printf("translateIno %q: %v, falling back to a spill inode number", cName, err)
+	}
+	st.Ino = rn.inoMap.TranslateHandle(handle, inomap.QInoFromStat(st))
+}
+
 // rootNode returns the Root Node of the filesystem.
 func (n *Node) rootNode() *RootNode {
 	return n.Root().Operations().(*RootNode)
 }
 
-// newChild attaches a new child inode to n.
+// newChild attaches a new child inode to n. "st" is the stat of the backing
+// file "cName" in "dirfd".
 // The passed-in `st` will be modified to get a unique inode number
 // (or, in `-sharedstorage` mode, the inode number will be set to zero).
-func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
+func (n *Node) newChild(ctx context.Context, dirfd int, cName string, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
 	rn := n.rootNode()
 	// Get stable inode number based on underlying (device,ino) pair
-	rn.inoMap.TranslateStat(st)
+	rn.translateIno(dirfd, cName, st)
 	out.Attr.FromStat(st)
 
 	var gen uint64 = 1
@@ -91,6 +123,11 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 		// Make each directory entry a unique node by using a unique generation
 		// value - see the comment at RootNode.gen for details.
 		gen = rn.gen.Add(1)
+	} else if rn.args.StableInodes {
+		// NFS file handles of FUSE mounts contain the node id and the
+		// generation. Node ids are handed out again after a remount, the
+		// inode number makes sure they do not match another file.
+		gen = st.Ino
 	}
 
 	// Create child node
@@ -0,0 +1,159 @@
+package fusefrontend
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// linksXattr is the backing xattr that holds the authenticated link count
+// with AuthLinks, like timesXattr. Files without it have a single link.
+const linksXattr = "user.gocryptfs.links"
+
+// linksRecordLen is the length of the plaintext linksXattr value
+const linksRecordLen = 4
+
+func encodeLinks(nlink uint64) []byte {
+	return binary.LittleEndian.AppendUint32(nil, uint32(nlink))
+}
+
+func decodeLinks(b []byte) (uint64, error) {
+	if len(b) != linksRecordLen {
+		return 0, fmt.Errorf("record has length %d, want %d", len(b), linksRecordLen)
+	}
+	return uint64(binary.LittleEndian.Uint32(b)), nil
+}
+
+// recordLinksFd stores the link count of the open backing file "fd" in
+// linksXattr, encrypted and bound to the file ID, so that every link of the
+// file carries it. Takes ownership of "fd". Empty files get a header if
+// "writable" is set, see Node.xattrID. The operation that changed the link
+// count has already succeeded, so errors are only logged.
+func (rn *RootNode) recordLinksFd(ctx context.Context, fd int, cName string, writable bool) {
+	f, st, errno := NewFile(fd, cName, rn)
+	if errno != 0 {
+		syscall.Close(fd)
+		tlog.Warn.Printf("recordLinks: %q: %v", cName, errno)
+		return
+	}
+	defer f.Release(ctx)
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	id, errno := f.xattrID(cName, true, writable)
+	if errno != 0 {
+		tlog.Warn.Printf("recordLinks: %q: %v", cName, errno)
+		return
+	}
+	cData := rn.encryptXattrValue(encodeLinks(uint64(st.Nlink)), rn.xattrAD(id, linksXattr))
+	if err := unix.Fsetxattr(fd, linksXattr, cData, 0); err != nil {
+		tlog.Warn.Printf("recordLinks: %q: could not store the link count: %v", cName, err)
+	}
+}
+
+// recordLinks stores the link count of the backing file, see recordLinksFd.
+// Called on the existing node after Link.
+func (n *Node) recordLinks(ctx context.Context) {
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(dirfd)
+	// We only need write access if we have to create the header
+	writable := true
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		writable = false
+		fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	}
+	if err != nil {
+		tlog.Warn.Printf("recordLinks: %q: %v", cName, err)
+		return
+	}
+	n.rootNode().recordLinksFd(ctx, fd, cName, writable)
+}
+
+// linksBegin is called before "cName" in "dirfd" is unlinked or replaced.
+// If it is a regular file with other links, these are not reachable by
+// name afterwards, so the file is kept open. The returned function must be
+// called when the operation is done and updates the link count if it has
+// changed. Moving a file to the trash does not change it.
+func (rn *RootNode) linksBegin(ctx context.Context, dirfd int, cName string) (done func()) {
+	done = func() {}
+	if !rn.args.AuthLinks {
+		return
+	}
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink < 2 {
+		return
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("linksBegin: %q: %v", cName, err)
+		return
+	}
+	return func() {
+		var st2 unix.Stat_t
+		if err := unix.Fstat(fd, &st2); err != nil || st2.Nlink == st.Nlink {
+			syscall.Close(fd)
+			return
+		}
+		rn.recordLinksFd(ctx, fd, cName, false)
+	}
+}
+
+// verifyLinks compares the link count of the backing file with the copy in
+// linksXattr. A copy that fails to decrypt is an integrity failure. A
+// different link count means that hard links were split into copies, or
+// that separate files were merged into one, behind our back. It is reported
+// as a mitigated corruption.
+func (n *Node) verifyLinks(ctx context.Context) {
+	rn := n.rootNode()
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	recorded := uint64(1)
+	cData, errno := n.getXAttr(linksXattr)
+	if errno == 0 {
+		id, errno := n.xattrID(ctx, false)
+		if errno != 0 {
+			return
+		}
+		data, err := rn.decryptXattrValue(cData, rn.xattrAD(id, linksXattr))
+		if err == nil {
+			recorded, err = decodeLinks(data)
+		}
+		if err != nil {
+			tlog.Warn.Printf("verifyLinks: %q: corrupt authenticated link count: %v. Was it copied from another file? caller %s",
+				cName, err, callerString(ctx))
+			rn.reportMitigatedCorruption(cName)
+			rn.reportIntegrityFailure(ctx, cName)
+			return
+		}
+	} else if errno != syscall.ENODATA {
+		tlog.Warn.Printf("verifyLinks: %q: %v", cName, errno)
+		return
+	}
+	if uint64(st.Nlink) == recorded {
+		return
+	}
+	tlog.Warn.Printf("verifyLinks: %q has %d links, the authenticated link count is %d. Were hard links split or merged behind our back?",
+		cName, st.Nlink, recorded)
+	rn.reportMitigatedCorruption(cName)
+}
@@ -0,0 +1,93 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+func TestEncodeLinks(t *testing.T) {
+	b := encodeLinks(3)
+	if len(b) != linksRecordLen {
+		t.Fatalf("wrong length %d", len(b))
+	}
+	have, err := decodeLinks(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != 3 {
+		t.Errorf("have %d, want 3", have)
+	}
+	if _, err = decodeLinks(b[1:]); err == nil {
+		t.Error("short record was accepted")
+	}
+}
+
+func TestAuthLinks(t *testing.T) {
+	rn := newTestFSDirIV(t, Args{XattrAuth: true, AuthLinks: true})
+	rn.MitigatedCorruptions = make(chan string, 10)
+	ctx := context.Background()
+	out := &fuse.EntryOut{}
+	inode, fh, _, errno := rn.Create(ctx, "a", syscall.O_RDWR, 0600, out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	fh.(*File).Release(ctx)
+	rn.AddChild("a", inode, false)
+	a := toNode(inode.Operations())
+	recorded := func() uint64 {
+		cData, errno := a.getXAttr(linksXattr)
+		if errno != 0 {
+			t.Fatalf("getXAttr: %v", errno)
+		}
+		id, errno := a.xattrID(ctx, false)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		data, err := rn.decryptXattrValue(cData, rn.xattrAD(id, linksXattr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		nlink, err := decodeLinks(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return nlink
+	}
+	if _, errno = rn.Link(ctx, a, "b", out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if _, errno = rn.Link(ctx, a, "c", out); errno != 0 {
+		t.Fatal(errno)
+	}
+	if have := recorded(); have != 3 {
+		t.Errorf("after Link: have %d, want 3", have)
+	}
+	if errno = rn.Unlink(ctx, "b"); errno != 0 {
+		t.Fatal(errno)
+	}
+	if have := recorded(); have != 2 {
+		t.Errorf("after Unlink: have %d, want 2", have)
+	}
+	a.verifyLinks(ctx)
+	if len(rn.MitigatedCorruptions) != 0 {
+		t.Fatalf("false positive: %q", <-rn.MitigatedCorruptions)
+	}
+	// Split the hard link behind our back
+	dirfd, cName, errno := rn.prepareAtSyscall("c")
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer syscall.Close(dirfd)
+	if err := syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+		t.Fatal(err)
+	}
+	a.verifyLinks(ctx)
+	if len(rn.MitigatedCorruptions) != 1 {
+		t.Error("split hard link was not detected")
+	}
+}
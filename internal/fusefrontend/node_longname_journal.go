@@ -0,0 +1,44 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// journalLongName records an operation on "cName" in directory "n" in the
+// long name journal if "cName" is a long name, see
+// nametransform.LongNameJournal. The returned function must be called
+// when the operation is done.
+func (n *Node) journalLongName(cName string) (done func(), errno syscall.Errno) {
+	rn := n.rootNode()
+	if rn.longNameJournal == nil || !nametransform.IsLongContent(cName) {
+		return func() {}, 0
+	}
+	cDir, err := rn.EncryptPath(n.Path())
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	done, err = rn.longNameJournal.Begin(cDir, cName)
+	if err != nil {
+		tlog.Warn.Printf("journalLongName: %v", err)
+		return nil, fs.ToErrno(err)
+	}
+	return done, 0
+}
+
+// ReplayLongNameJournal cleans up after operations on long names that were
+// interrupted by a crash. main.doMount() calls this before mounting.
+func (rn *RootNode) ReplayLongNameJournal() error {
+	if rn.longNameJournal == nil {
+		return nil
+	}
+	fixed, err := rn.longNameJournal.Replay()
+	if fixed > 0 {
+		tlog.Info.Printf("Cleaned up %d interrupted operations on long file names", fixed)
+	}
+	return err
+}
@@ -0,0 +1,207 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// manifestUpdate reads the manifest of the directory opened at "dirfd",
+// calls "fn" on it and writes it back.
+func (rn *RootNode) manifestUpdate(dirfd int, fn func(m *nametransform.Manifest)) error {
+	rn.manifestLock.Lock()
+	defer rn.manifestLock.Unlock()
+	iv, err := rn.nameTransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		return err
+	}
+	fa := rn.nameTransform.FilenameAuth()
+	m, err := nametransform.ReadManifestAt(dirfd, fa, iv)
+	if err != nil {
+		tlog.Warn.Printf("manifestUpdate: %v", err)
+		return syscall.EIO
+	}
+	fn(m)
+	return nametransform.WriteManifestAt(dirfd, fa, iv, m)
+}
+
+// manifestBegin marks "cName" in the directory opened at "dirfd" as pending
+// before an operation that may create or delete it.
+// The returned function must be called once the operation is done, no matter
+// if it succeeded. It records the actual state of "cName" in the manifest.
+//
+// Does nothing if DirManifest is not enabled.
+func (rn *RootNode) manifestBegin(dirfd int, cName string) (done func(), errno syscall.Errno) {
+	if !rn.args.DirManifest {
+		return func() {}, 0
+	}
+	err := rn.manifestUpdate(dirfd, func(m *nametransform.Manifest) {
+		m.Pending[cName]++
+	})
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	done = func() {
+		err := rn.manifestUpdate(dirfd, func(m *nametransform.Manifest) {
+			var st unix.Stat_t
+			err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+			if err == nil {
+				// This cast is needed on Darwin, where st.Mode is uint16.
+				m.Entries[cName] = uint32(st.Mode) & syscall.S_IFMT
+				delete(m.IDs, cName)
+				if m.Entries[cName] == syscall.S_IFREG {
+					id, err := rn.entryFileID(dirfd, cName)
+					if err != nil {
+						tlog.Warn.Printf("manifestBegin: file ID of %q: %v", cName, err)
+					} else if id != nil {
+						m.IDs[cName] = id
+					}
+				}
+			} else if err == syscall.ENOENT {
+				delete(m.Entries, cName)
+				delete(m.IDs, cName)
+			} else {
+				// Unknown state. Keep the entry pending.
+				tlog.Warn.Printf("manifestBegin: Fstatat %q: %v", cName, err)
+				return
+			}
+			m.Pending[cName]--
+			if m.Pending[cName] == 0 {
+				delete(m.Pending, cName)
+			}
+		})
+		if err != nil {
+			tlog.Warn.Printf("manifestBegin: could not update manifest for %q: %v", cName, err)
+		}
+	}
+	return done, 0
+}
+
+// writeEmptyManifest creates an empty manifest in the new directory opened
+// at "dirfd".
+func (rn *RootNode) writeEmptyManifest(dirfd int) error {
+	iv, err := rn.nameTransform.ReadDirIVAt(dirfd)
+	if err != nil {
+		return err
+	}
+	return nametransform.WriteManifestAt(dirfd, rn.nameTransform.FilenameAuth(), iv, nametransform.NewManifest())
+}
+
+// verifyManifest compares the content of the directory opened at "fd" with
+// its manifest. Returns EIO if they do not match.
+func (rn *RootNode) verifyManifest(fd int, iv []byte, isRoot bool) syscall.Errno {
+	// Operations in flight mark their entries as pending under this lock,
+	// so we see a consistent state.
+	rn.manifestLock.Lock()
+	defer rn.manifestLock.Unlock()
+	m, err := nametransform.ReadManifestAt(fd, rn.nameTransform.FilenameAuth(), iv)
+	if err != nil {
+		tlog.Warn.Printf("verifyManifest: could not read %s: %v", nametransform.ManifestFilename, err)
+		return syscall.EIO
+	}
+	// Getdents moves the file offset, so use a private fd
+	fd2, err := syscallcompat.Openat(fd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer syscall.Close(fd2)
+	entries, err := syscallcompat.Getdents(fd2)
+	if err != nil && err != io.EOF {
+		return fs.ToErrno(err)
+	}
+	have := make(map[string]uint32, len(entries))
+	for _, e := range entries {
+		if nametransform.ManifestIgnored(e.Name, isRoot) {
+			continue
+		}
+		have[e.Name] = e.Mode & syscall.S_IFMT
+	}
+	problems := m.Verify(have, func(cName string) ([]byte, bool) {
+		id, err := rn.entryFileID(fd, cName)
+		if err == syscall.EACCES {
+			// Like chmod 000 files. We cannot read them through the
+			// mount either, so there is nothing to protect.
+			return nil, false
+		} else if err != nil {
+			tlog.Warn.Printf("verifyManifest: file ID of %q: %v", cName, err)
+		}
+		return id, true
+	})
+	if len(problems) == 0 {
+		return 0
+	}
+	for _, p := range problems {
+		tlog.Warn.Printf("verifyManifest: %s", p)
+	}
+	return syscall.EIO
+}
+
+// initFileID writes the header of the new, empty file "f" in Create. The
+// manifest binds the file to its file ID, which must not change until the
+// file is deleted.
+func (f *File) initFileID() syscall.Errno {
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	if f.fileTableEntry.ID != nil {
+		return 0
+	}
+	id, enc, err := f.createHeader()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	f.fileTableEntry.ID, f.fileTableEntry.Enc = id, enc
+	return 0
+}
+
+// entryFileID returns the file ID of the regular file "cName" in the
+// directory opened at "dirfd", or nil if the file is empty. Recipe files
+// have the file ID of the file they replaced.
+//
+// Symlink-safe through use of Openat().
+func (rn *RootNode) entryFileID(dirfd int, cName string) ([]byte, error) {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	if rn.dedup != nil {
+		var st syscall.Stat_t
+		if err = syscall.Fstat(fd, &st); err != nil {
+			return nil, err
+		}
+		if dedup.IsRecipeSize(rn.contentEnc, uint64(st.Size)) && st.Size <= maxRecipeSize {
+			buf := make([]byte, st.Size)
+			if _, err = syscall.Pread(fd, buf, 0); err != nil {
+				return nil, err
+			}
+			r, err := rn.dedup.ParseRecipe(buf)
+			if err != nil {
+				return nil, err
+			}
+			return r.FileID, nil
+		}
+	}
+	buf := make([]byte, rn.contentEnc.HeaderLen())
+	n, err := syscall.Pread(fd, buf, 0)
+	if err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, nil
+	} else if n != len(buf) {
+		return nil, fmt.Errorf("short header (%d bytes)", n)
+	}
+	h, _, err := rn.contentEnc.OpenHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	return h.ID, nil
+}
@@ -0,0 +1,104 @@
+package fusefrontend
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// newManifestTestFS returns a filesystem with DirManifest, driven through
+// the raw FUSE API like newPolicyTestFS
+func newManifestTestFS(t *testing.T) (*policyTestFS, string) {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	fa := filenameauth.NewEmbedded(key)
+	n := nametransform.New(cCore.EMECipher, true, 0, true, nil, false, fa)
+	dir := t.TempDir()
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = n.CreateDirIVAt(dirfd, nametransform.RootDirCName); err != nil {
+		t.Fatal(err)
+	}
+	iv, err := n.ReadDirIVAt(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = nametransform.WriteManifestAt(dirfd, fa, iv, nametransform.NewManifest()); err != nil {
+		t.Fatal(err)
+	}
+	args := Args{Cipherdir: dir, DirManifest: true}
+	return &policyTestFS{t: t, raw: fs.NewNodeFS(NewRootNode(args, cEnc, n), &fs.Options{})}, dir
+}
+
+func (f *policyTestFS) opendir(nodeID uint64) fuse.Status {
+	var out fuse.OpenOut
+	st := f.raw.OpenDir(nil, &fuse.OpenIn{InHeader: header(nodeID, 0)}, &out)
+	if st.Ok() {
+		f.raw.ReleaseDir(&fuse.ReleaseIn{InHeader: header(nodeID, 0), Fh: out.Fh})
+	}
+	return st
+}
+
+// cipherFiles returns the ciphertext names of the files in "dir"
+func cipherFiles(t *testing.T, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		if !nametransform.ManifestIgnored(e.Name(), true) {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// Restoring an older copy of a file, here one from before it was deleted
+// and created again, must be caught like a restored directory entry
+func TestManifestOlderCopy(t *testing.T) {
+	f, dir := newManifestTestFS(t)
+	root := uint64(fuse.FUSE_ROOT_ID)
+	f.create(root, "file", 0)
+	names := cipherFiles(t, dir)
+	if len(names) != 1 {
+		t.Fatalf("have %v", names)
+	}
+	path := filepath.Join(dir, names[0])
+	old, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uint64(len(old)) != contentenc.HeaderLen {
+		t.Errorf("new file has %d bytes, want a header", len(old))
+	}
+	if st := f.opendir(root); !st.Ok() {
+		t.Fatalf("opendir: %v", st)
+	}
+	if st := f.raw.Unlink(nil, &fuse.InHeader{NodeId: root}, "file"); !st.Ok() {
+		t.Fatalf("unlink: %v", st)
+	}
+	f.create(root, "file", 0)
+	if st := f.opendir(root); !st.Ok() {
+		t.Fatalf("opendir after create: %v", st)
+	}
+	if err = os.WriteFile(path, old, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if st := f.opendir(root); st != fuse.EIO {
+		t.Errorf("older copy: have %v, want EIO", st)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -16,6 +17,10 @@ import (
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.rootNode().supervise(&errno)
+	if errno = n.checkPolicy(ctx, "", openFlagsAccess(flags)); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
@@ -24,11 +29,18 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 
 	rn := n.rootNode()
 	newFlags := rn.mangleOpenFlags(flags)
+	// Recipe files must not be truncated behind our back, see materialize()
+	writeAccess := newFlags&syscall.O_ACCMODE != syscall.O_RDONLY
+	trunc := newFlags&syscall.O_TRUNC != 0
+	if rn.dedup != nil && writeAccess {
+		newFlags &^= syscall.O_TRUNC
+	}
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	rn.openWriteOnlyLock.RLock()
 	defer rn.openWriteOnlyLock.RUnlock()
 
-	if rn.args.KernelCache {
+	fuseFlags, direct := rn.directIO(flags)
+	if rn.args.KernelCache && fuseFlags&fuse.FOPEN_DIRECT_IO == 0 {
 		fuseFlags = fuse.FOPEN_KEEP_CACHE
 	}
 
@@ -50,28 +62,76 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = fs.ToErrno(err)
 		return
 	}
-	fh, _, errno = NewFile(fd, cName, rn)
-	return fh, fuseFlags, errno
+	f, _, errno := NewFile(fd, cName, rn)
+	if errno != 0 {
+		return
+	}
+	if direct {
+		f.openDirect(dirfd, cName)
+	}
+	if rn.dedup != nil && writeAccess {
+		if errno = f.materialize(ctx, trunc); errno != 0 {
+			f.Release(ctx)
+			return nil, 0, errno
+		}
+	}
+	if rn.args.AuthTimes {
+		if trunc {
+			f.timesDirty.Store(true)
+		} else if !writeAccess && !f.fileTableEntry.Shared() {
+			// A writer may not have recorded the mtime yet
+			n.verifyTimes(ctx)
+		}
+	}
+	if rn.args.AuthLinks {
+		n.verifyLinks(ctx)
+	}
+	return f, fuseFlags, 0
 }
 
 // Create - FUSE call. Creates a new file.
 //
 // Symlink-safe through the use of Openat().
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.rootNode().supervise(&errno)
+	if errno = n.checkPolicy(ctx, name, accesspolicy.Write); errno != 0 {
+		return
+	}
+	if errno = n.checkForbiddenName(ctx, name); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
+	defer n.rootNode().invalidateCaseIndex(dirfd)
+	defer n.forgetNegative(name)
+	defer n.dirChanged(name)
 
 	var err error
 	fd := -1
 	// Make sure context is nil if we don't want to preserve the owner
 	rn := n.rootNode()
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return
+	}
+	defer manifestDone()
+	journalDone, errno := n.journalLongName(cName)
+	if errno != 0 {
+		return
+	}
+	defer journalDone()
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
 	newFlags := rn.mangleOpenFlags(flags)
+	if rn.args.DirManifest {
+		// We write the file header right away, even if the file is
+		// created read-only
+		newFlags = newFlags&^syscall.O_ACCMODE | syscall.O_RDWR
+	}
 	// Handle long file name
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
@@ -103,12 +163,25 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 	if errno != 0 {
 		return
 	}
+	if rn.args.DirManifest {
+		if errno = fh.(*File).initFileID(); errno != 0 {
+			fh.(*File).Release(ctx)
+			return nil, nil, 0, errno
+		}
+	}
+	fuseFlags, direct := rn.directIO(flags)
+	if direct {
+		fh.(*File).openDirect(dirfd, cName)
+	}
 
-	inode = n.newChild(ctx, st, out)
+	inode = n.newChild(ctx, dirfd, cName, st, out)
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
+	if rn.args.AuthTimes {
+		fh.(*File).timesDirty.Store(true)
+	}
 
 	return inode, fh, fuseFlags, errno
 }
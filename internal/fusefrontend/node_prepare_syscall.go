@@ -13,7 +13,20 @@ import (
 // prepareAtSyscall returns a (dirfd, cName) pair that can be used
 // with the "___at" family of system calls (openat, fstatat, unlinkat...) to
 // access the backing encrypted child file.
+// With -case-insensitive, "child" may differ in case from the actual name,
+// see resolveCase. With -nfc or -nfd, "child" is normalized first.
 func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno syscall.Errno) {
+	child = n.rootNode().args.Normalization.Apply(child)
+	dirfd, cName, errno = n.prepareAtSyscallExact(child)
+	if errno != 0 || n.rootNode().caseIndex == nil {
+		return
+	}
+	return n.resolveCase(dirfd, cName, child)
+}
+
+// prepareAtSyscallExact is like prepareAtSyscall but always uses "child"
+// as it is.
+func (n *Node) prepareAtSyscallExact(child string) (dirfd int, cName string, errno syscall.Errno) {
 	if child == "" {
 		tlog.Warn.Printf("BUG: prepareAtSyscall: child=%q, should have called prepareAtSyscallMyself", child)
 		return n.prepareAtSyscallMyself()
@@ -24,6 +37,13 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 	// All filesystem operations go through here, so this is a good place
 	// to reset the idle marker.
 	rn.IsIdle.Store(false)
+	rn.foregroundOps.Inc()
+
+	if rn.supervisor != nil {
+		if errno = rn.supervisor.paused(); errno != 0 {
+			return -1, "", errno
+		}
+	}
 
 	if n.IsRoot() && rn.isFiltered(child) {
 		return -1, "", syscall.EPERM
@@ -71,10 +91,16 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 	// Cache store
 	if !rn.args.PlaintextNames {
 		var err error
-		iv, err = rn.nameTransform.ReadDirIVAt(dirfd)
+		iv, err = rn.nameTransform.VerifyDirIVAt(dirfd, myCName)
 		if err != nil {
 			syscall.Close(dirfd)
-			return -1, "", fs.ToErrno(err)
+			errno = fs.ToErrno(err)
+			if n.IsRoot() && rn.supervisor != nil {
+				// The empty directory left behind by an unmounted drive
+				// has no gocryptfs.diriv
+				errno = rn.supervisor.check(errno)
+			}
+			return -1, "", errno
 		}
 	}
 	rn.dirCache.Store(n, dirfd, iv)
@@ -102,7 +128,11 @@ func (n *Node) prepareAtSyscallMyself() (dirfd int, cName string, errno syscall.
 		// Open cipherdir (following symlinks)
 		dirfd, err = syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		if err != nil {
-			return -1, "", fs.ToErrno(err)
+			errno = fs.ToErrno(err)
+			if rn.supervisor != nil {
+				errno = rn.supervisor.check(errno)
+			}
+			return -1, "", errno
 		}
 		return dirfd, ".", 0
 	}
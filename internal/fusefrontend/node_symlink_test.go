@@ -0,0 +1,87 @@
+package fusefrontend
+
+import (
+	"context"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// newTestFSDirIV is newTestFS with encrypted names
+func newTestFSDirIV(t *testing.T, args Args) *RootNode {
+	args.Cipherdir = t.TempDir()
+	dirfd, err := syscall.Open(args.Cipherdir, syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = nametransform.WriteDirIVAt(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestFS(args)
+}
+
+func TestSymlinkTooLong(t *testing.T) {
+	rn := newTestFSDirIV(t, Args{})
+	ctx := context.Background()
+	out := &fuse.EntryOut{}
+	max := rn.maxSymlinkTarget()
+	if max < 3000 || max > nametransform.SymlinkMax {
+		t.Fatalf("maxSymlinkTarget=%d", max)
+	}
+	if _, errno := rn.Symlink(ctx, strings.Repeat("x", max), "fits", out); errno != 0 {
+		t.Errorf("%d bytes: %v", max, errno)
+	}
+	if _, errno := rn.Symlink(ctx, strings.Repeat("x", max+1), "long", out); errno != syscall.ENAMETOOLONG {
+		t.Errorf("%d bytes: have %v, want ENAMETOOLONG", max+1, errno)
+	}
+}
+
+func TestLongSymlinks(t *testing.T) {
+	rn := newTestFSDirIV(t, Args{LongSymlinks: true})
+	ctx := context.Background()
+	out := &fuse.EntryOut{}
+	target := strings.Repeat("/long/path", 400)
+	inode, errno := rn.Symlink(ctx, target, "link", out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if out.Size != uint64(len(target)) {
+		t.Errorf("size: have %d, want %d", out.Size, len(target))
+	}
+	rn.AddChild("link", inode, false)
+	have, errno := toNode(inode.Operations()).Readlink(ctx)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	if string(have) != target {
+		t.Errorf("wrong target: %d bytes", len(have))
+	}
+	// The backing symlink refers to the stored target
+	dirfd, cName, errno := toNode(inode.Operations()).prepareAtSyscallMyself()
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer syscall.Close(dirfd)
+	ref, err := syscallcompat.Readlinkat(dirfd, cName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !nametransform.IsLongSymlinkRef(ref) {
+		t.Fatalf("backing target %q is not a reference", ref)
+	}
+	// A missing target file is an I/O error
+	if err = os.Remove(nametransform.LongSymlinkPath(rn.args.Cipherdir, ref)); err != nil {
+		t.Fatal(err)
+	}
+	if _, errno = toNode(inode.Operations()).Readlink(ctx); errno != syscall.EIO {
+		t.Errorf("missing target: have %v, want EIO", errno)
+	}
+}
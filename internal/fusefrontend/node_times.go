@@ -0,0 +1,134 @@
+package fusefrontend
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// timesXattr is the backing xattr that holds the authenticated mtime with
+// AuthTimes. It cannot clash with an encrypted xattr name, these are at
+// least 22 characters long after the prefix.
+const timesXattr = "user.gocryptfs.times"
+
+// timesRecordLen is the length of the plaintext timesXattr value: seconds
+// and nanoseconds of the mtime.
+const timesRecordLen = 12
+
+func encodeTimes(mtime unix.Timespec) []byte {
+	b := make([]byte, 0, timesRecordLen)
+	b = binary.LittleEndian.AppendUint64(b, uint64(mtime.Sec))
+	return binary.LittleEndian.AppendUint32(b, uint32(mtime.Nsec))
+}
+
+func decodeTimes(b []byte) (time.Time, error) {
+	if len(b) != timesRecordLen {
+		return time.Time{}, fmt.Errorf("record has length %d, want %d", len(b), timesRecordLen)
+	}
+	sec := int64(binary.LittleEndian.Uint64(b))
+	nsec := int64(binary.LittleEndian.Uint32(b[8:]))
+	return time.Unix(sec, nsec), nil
+}
+
+// recordTimes stores the mtime of the backing file in timesXattr, encrypted
+// and bound to the file ID (see Node.xattrID). Only regular files are
+// recorded. The operation that changed the mtime has already succeeded, so
+// errors are only logged.
+func (n *Node) recordTimes(ctx context.Context) {
+	rn := n.rootNode()
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		tlog.Warn.Printf("recordTimes: %q: %v", cName, err)
+		return
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	id, errno := n.xattrID(ctx, false)
+	if errno != 0 {
+		tlog.Warn.Printf("recordTimes: %q: %v", cName, errno)
+		return
+	}
+	cData := rn.encryptXattrValue(encodeTimes(st.Mtim), rn.xattrAD(id, timesXattr))
+	if errno = n.setXAttr(nil, timesXattr, cData, 0); errno != 0 {
+		tlog.Warn.Printf("recordTimes: %q: could not store the mtime: %v", cName, errno)
+	}
+}
+
+// verifyTimes compares the mtime of the backing file with the copy in
+// timesXattr. A copy that fails to decrypt is an integrity failure. A
+// different mtime means that the file was modified behind our back, or that
+// the mtime was lost, like when a backup was restored. With RestoreTimes it
+// is set back, otherwise it is reported as a mitigated corruption.
+func (n *Node) verifyTimes(ctx context.Context) {
+	rn := n.rootNode()
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	if err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	cData, errno := n.getXAttr(timesXattr)
+	if errno == syscall.ENODATA {
+		if rn.args.RestoreTimes {
+			tlog.Info.Printf("verifyTimes: %q: recording the missing mtime", cName)
+			n.recordTimes(ctx)
+			return
+		}
+		tlog.Warn.Printf("verifyTimes: %q has no authenticated mtime", cName)
+		rn.reportMitigatedCorruption(cName)
+		return
+	} else if errno != 0 {
+		tlog.Warn.Printf("verifyTimes: %q: %v", cName, errno)
+		return
+	}
+	id, errno := n.xattrID(ctx, false)
+	if errno != 0 {
+		return
+	}
+	data, err := rn.decryptXattrValue(cData, rn.xattrAD(id, timesXattr))
+	var recorded time.Time
+	if err == nil {
+		recorded, err = decodeTimes(data)
+	}
+	if err != nil {
+		tlog.Warn.Printf("verifyTimes: %q: corrupt authenticated mtime: %v. Was it copied from another file? caller %s",
+			cName, err, callerString(ctx))
+		rn.reportMitigatedCorruption(cName)
+		rn.reportIntegrityFailure(ctx, cName)
+		return
+	}
+	have := time.Unix(st.Mtim.Sec, st.Mtim.Nsec)
+	if have.Equal(recorded) {
+		return
+	}
+	if rn.args.RestoreTimes {
+		if err = syscallcompat.UtimesNanoAtNofollow(dirfd, cName, nil, &recorded); err != nil {
+			tlog.Warn.Printf("verifyTimes: %q: could not restore the mtime: %v", cName, err)
+			return
+		}
+		tlog.Info.Printf("verifyTimes: %q: restored mtime %v, was %v", cName, recorded, have)
+		return
+	}
+	tlog.Warn.Printf("verifyTimes: %q: mtime %v was changed behind our back, the authenticated mtime is %v",
+		cName, have, recorded)
+	rn.reportMitigatedCorruption(cName)
+}
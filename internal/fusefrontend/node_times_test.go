@@ -0,0 +1,26 @@
+package fusefrontend
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestEncodeTimes(t *testing.T) {
+	want := time.Date(2024, 2, 29, 12, 30, 0, 123456789, time.UTC)
+	b := encodeTimes(unix.NsecToTimespec(want.UnixNano()))
+	if len(b) != timesRecordLen {
+		t.Fatalf("wrong length %d", len(b))
+	}
+	have, err := decodeTimes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !have.Equal(want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if _, err = decodeTimes(b[1:]); err == nil {
+		t.Error("short record was accepted")
+	}
+}
@@ -4,11 +4,17 @@ package fusefrontend
 import (
 	"bytes"
 	"context"
+	"io"
 	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/accesspolicy"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -19,54 +25,73 @@ const minus1 = ^uint32(0)
 // encrypted original name.
 var xattrStorePrefix = "user.gocryptfs."
 
+// xattrNameMax is the maximum length of an xattr name on Linux
+// (XATTR_NAME_MAX). Encrypted names are longer than the plaintext names, so
+// names that are shorter than this can still be too long.
+const xattrNameMax = 255
+
+// xattrADDomain separates xattrAD hashes from other uses of SHA256.
+const xattrADDomain = "gocryptfs-xattr-ad-v1\x00"
+
+// xattrADLen is the length of the value returned by xattrAD. It must be
+// the length of a file ID, because contentenc checks that.
+const xattrADLen = 16
+
 // We get one read of this xattr for each write -
 // see https://github.com/rfjakob/gocryptfs/issues/515 for details.
 var xattrCapability = "security.capability"
 
 // isAcl returns true if the attribute name is for storing ACLs
-//
-// ACLs are passed through without encryption
 func isAcl(attr string) bool {
-	return attr == "system.posix_acl_access" || attr == "system.posix_acl_default"
+	return attr == aclAccess || attr == aclDefault
+}
+
+// passthroughXattr returns true if the attribute is stored without
+// encryption. This is the case for ACLs unless we are mounted with
+// "-encrypt-acl".
+func (rn *RootNode) passthroughXattr(attr string) bool {
+	return isAcl(attr) && !rn.args.EncryptACL
 }
 
 // GetXAttr - FUSE call. Reads the value of extended attribute "attr".
 //
 // This function is symlink-safe through Fgetxattr.
 func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	if errno := n.checkPolicy(ctx, "", accesspolicy.Read); errno != 0 {
+		return 0, errno
+	}
 	rn := n.rootNode()
+	if rn.xattrBlocked(attr) {
+		return 0, syscall.EOPNOTSUPP
+	}
 	// If we are not mounted with -suid, reading the capability xattr does not
 	// make a lot of sense, so reject the request and gain a massive speedup.
 	// See https://github.com/rfjakob/gocryptfs/issues/515 .
-	if !rn.args.Suid && attr == xattrCapability {
+	if !rn.args.Suid && !rn.args.EncryptACL && attr == xattrCapability {
 		// Returning EOPNOTSUPP is what we did till
 		// ca9e912a28b901387e1dbb85f6c531119f2d5ef2 "fusefrontend: drop xattr user namespace restriction"
 		// and it did not cause trouble. Seems cleaner than saying ENODATA.
 		return 0, syscall.EOPNOTSUPP
 	}
 	var data []byte
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
-		var errno syscall.Errno
+	var errno syscall.Errno
+	if rn.passthroughXattr(attr) {
 		data, errno = n.getXAttr(attr)
 		if errno != 0 {
 			return minus1, errno
 		}
 	} else {
-		// encrypted user xattr
-		cAttr, err := rn.encryptXattrName(attr)
-		if err != nil {
-			return minus1, syscall.EIO
+		data, errno = n.getEncryptedXattr(ctx, attr)
+		// ACLs that were set before -encrypt-acl was used are still stored
+		// in plaintext
+		if errno == syscall.ENODATA && isAcl(attr) {
+			data, errno = n.getXAttr(attr)
 		}
-		cData, errno := n.getXAttr(cAttr)
-		if errno != 0 {
+		if errno == syscall.EIO {
+			return minus1, errno
+		} else if errno != 0 {
 			return 0, errno
 		}
-		data, err = rn.decryptXattrValue(cData)
-		if err != nil {
-			tlog.Warn.Printf("GetXAttr: %v", err)
-			return minus1, syscall.EIO
-		}
 	}
 	// Caller passes size zero to find out how large their buffer should be
 	if len(dest) == 0 {
@@ -83,11 +108,16 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 //
 // This function is symlink-safe through Fsetxattr.
 func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	if errno := n.checkPolicy(ctx, "", accesspolicy.Write); errno != 0 {
+		return errno
+	}
 	rn := n.rootNode()
+	if rn.xattrBlocked(attr) {
+		return syscall.EOPNOTSUPP
+	}
 	flags = uint32(filterXattrSetFlags(int(flags)))
 
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	if rn.passthroughXattr(attr) {
 		// result of setting an acl depends on the user doing it
 		var context *fuse.Context
 		if rn.args.PreserveOwner {
@@ -95,12 +125,71 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 		}
 		return n.setXAttr(context, attr, data, flags)
 	}
+	if attr == aclAccess {
+		return n.setEncryptedAccessACL(ctx, data, flags)
+	}
+	errno := n.setEncryptedXattr(ctx, attr, data, flags)
+	if errno == 0 && isAcl(attr) {
+		n.removePlaintextACL(attr)
+	}
+	return errno
+}
 
+// getEncryptedXattr reads and decrypts the value of user xattr "attr".
+func (n *Node) getEncryptedXattr(ctx context.Context, attr string) ([]byte, syscall.Errno) {
+	rn := n.rootNode()
+	cAttr, err := rn.encryptXattrName(attr)
+	if err != nil {
+		return nil, syscall.EIO
+	}
+	if len(cAttr) > xattrNameMax {
+		// Cannot exist. The backing filesystem would fail with ERANGE,
+		// which getXAttr reports as EOVERFLOW.
+		return nil, syscall.ENODATA
+	}
+	cData, errno := n.getXAttr(cAttr)
+	if errno != 0 {
+		return nil, errno
+	}
+	var id []byte
+	if rn.args.XattrAuth {
+		id, errno = n.xattrID(ctx, false)
+		if errno != 0 {
+			return nil, errno
+		}
+	}
+	data, err := rn.decryptXattrValue(cData, rn.xattrAD(id, cAttr))
+	if err != nil {
+		if rn.args.XattrAuth {
+			tlog.Warn.Printf("GetXAttr: %q: %v. Was the value copied from another file?", cAttr, err)
+		} else {
+			tlog.Warn.Printf("GetXAttr: %v", err)
+		}
+		return nil, syscall.EIO
+	}
+	return data, 0
+}
+
+// setEncryptedXattr encrypts and stores the value of user xattr "attr".
+func (n *Node) setEncryptedXattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+	rn := n.rootNode()
 	cAttr, err := rn.encryptXattrName(attr)
 	if err != nil {
 		return syscall.EINVAL
 	}
-	cData := rn.encryptXattrValue(data)
+	if len(cAttr) > xattrNameMax {
+		// What setxattr(2) returns for names that are too long
+		return syscall.ERANGE
+	}
+	var id []byte
+	if rn.args.XattrAuth {
+		var errno syscall.Errno
+		id, errno = n.xattrID(ctx, true)
+		if errno != 0 {
+			return errno
+		}
+	}
+	cData := rn.encryptXattrValue(data, rn.xattrAD(id, cAttr))
 	return n.setXAttr(nil, cAttr, cData, flags)
 }
 
@@ -108,10 +197,15 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 //
 // This function is symlink-safe through Fremovexattr.
 func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+	if errno := n.checkPolicy(ctx, "", accesspolicy.Write); errno != 0 {
+		return errno
+	}
 	rn := n.rootNode()
+	if rn.xattrBlocked(attr) {
+		return syscall.EOPNOTSUPP
+	}
 
-	// ACLs are passed through without encryption
-	if isAcl(attr) {
+	if rn.passthroughXattr(attr) {
 		return n.removeXAttr(attr)
 	}
 
@@ -119,13 +213,33 @@ func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
 	if err != nil {
 		return syscall.EINVAL
 	}
-	return n.removeXAttr(cAttr)
+	if len(cAttr) > xattrNameMax {
+		return syscall.ENODATA
+	}
+	errno := n.removeXAttr(cAttr)
+	if isAcl(attr) && n.removePlaintextACL(attr) {
+		return 0
+	}
+	return errno
 }
 
 // ListXAttr - FUSE call. Lists extended attributes on the file at "relPath".
 //
 // This function is symlink-safe through Flistxattr.
 func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	if errno := n.checkPolicy(ctx, "", accesspolicy.Read); errno != 0 {
+		return 0, errno
+	}
+	var sz uint32
+	var errno syscall.Errno
+	if errno2 := n.rootNode().runOp(ctx, "listxattr", func() { sz, errno = n.listxattr(dest) }); errno2 != 0 {
+		return 0, errno2
+	}
+	return sz, errno
+}
+
+// listxattr implements Listxattr, see there.
+func (n *Node) listxattr(dest []byte) (uint32, syscall.Errno) {
 	cNames, errno := n.listXAttr()
 	if errno != 0 {
 		return 0, errno
@@ -133,12 +247,15 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 	rn := n.rootNode()
 	var buf bytes.Buffer
 	for _, curName := range cNames {
-		// ACLs are passed through without encryption
+		// ACLs are passed through without encryption. With -encrypt-acl,
+		// these are left over from before and still readable.
 		if isAcl(curName) {
-			buf.WriteString(curName + "\000")
+			if !rn.xattrBlocked(curName) {
+				buf.WriteString(curName + "\000")
+			}
 			continue
 		}
-		if !strings.HasPrefix(curName, xattrStorePrefix) {
+		if !strings.HasPrefix(curName, xattrStorePrefix) || curName == timesXattr {
 			continue
 		}
 		name, err := rn.decryptXattrName(curName)
@@ -148,11 +265,14 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			continue
 		}
 		// We *used to* encrypt ACLs, which caused a lot of problems.
-		if isAcl(name) {
+		if isAcl(name) && !rn.args.EncryptACL {
 			tlog.Warn.Printf("ListXAttr: ignoring deprecated encrypted ACL %q = %q", curName, name)
 			rn.reportMitigatedCorruption(curName)
 			continue
 		}
+		if rn.xattrBlocked(name) {
+			continue
+		}
 		buf.WriteString(name + "\000")
 	}
 	// Caller passes size zero to find out how large their buffer should be
@@ -164,3 +284,94 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 	}
 	return uint32(copy(dest, buf.Bytes())), 0
 }
+
+// xattrID returns the ID that the xattr values of this node are bound to
+// with XattrAuth: the file ID from the header for regular files, and the
+// directory IV for directories. Other file types get nil.
+//
+// Empty files have no header. If "create" is set, a header is written, which
+// is then kept even if the file is truncated to zero (see File.truncate).
+// Otherwise, nil is returned and the decryption of any value fails.
+func (n *Node) xattrID(ctx context.Context, create bool) (id []byte, errno syscall.Errno) {
+	rn := n.rootNode()
+	dirfd, cName, errno := n.prepareAtSyscallMyself()
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err := syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscallcompat.O_PATH, 0)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		defer syscall.Close(fd)
+		iv, err := rn.nameTransform.VerifyDirIVAt(fd, cName)
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		return iv, 0
+	case syscall.S_IFREG:
+		// We only need write access if we have to create the header
+		var fd int
+		writable := false
+		if create {
+			fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+			writable = err == nil
+		}
+		if !writable {
+			fd, err = syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		}
+		if err != nil {
+			return nil, fs.ToErrno(err)
+		}
+		f, _, errno := NewFile(fd, cName, rn)
+		if errno != 0 {
+			syscall.Close(fd)
+			return nil, errno
+		}
+		defer f.Release(ctx)
+		return f.xattrID(cName, create, writable)
+	}
+	return nil, 0
+}
+
+// xattrID is the part of Node.xattrID for regular files that works on the
+// open file "f". "writable" says if it was opened for writing.
+func (f *File) xattrID(cName string, create bool, writable bool) (id []byte, errno syscall.Errno) {
+	f.fileTableEntry.ContentLock.Lock()
+	defer f.fileTableEntry.ContentLock.Unlock()
+	if f.fileTableEntry.ID != nil {
+		return f.fileTableEntry.ID, 0
+	}
+	if f.rootNode.dedup != nil {
+		// Recipes keep the file ID of the file they replaced
+		r, errno := f.loadRecipe()
+		if errno != 0 {
+			return nil, errno
+		} else if r != nil {
+			return r.FileID, 0
+		}
+	}
+	id, enc, err := f.readFileID()
+	if err == io.EOF {
+		if !create {
+			return nil, 0
+		}
+		if !writable {
+			return nil, syscall.EACCES
+		}
+		id, enc, err = f.createHeader()
+	}
+	if err != nil {
+		tlog.Warn.Printf("xattrID: %q: %v", cName, err)
+		return nil, fs.ToErrno(err)
+	}
+	f.fileTableEntry.ID, f.fileTableEntry.Enc = id, enc
+	return id, 0
+}
@@ -0,0 +1,56 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParseXattrPatterns parses the comma-separated list of "-xattr-allow" and
+// "-xattr-deny". Each pattern is an xattr name like "security.selinux", or
+// a prefix followed by "*", like "user.*". A single "*" matches all names.
+func ParseXattrPatterns(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var patterns []string
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return nil, fmt.Errorf("invalid pattern %q", p)
+		}
+		if p != "*" && !strings.Contains(p, ".") {
+			return nil, fmt.Errorf("pattern %q has no namespace, like \"user.*\"", p)
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// xattrMatch returns true if the xattr name "attr" matches "pattern", see
+// ParseXattrPatterns
+func xattrMatch(pattern string, attr string) bool {
+	if prefix := strings.TrimSuffix(pattern, "*"); prefix != pattern {
+		return strings.HasPrefix(attr, prefix)
+	}
+	return attr == pattern
+}
+
+// xattrBlocked returns true if "-xattr-allow" and "-xattr-deny" block the
+// xattr "attr". Allowed names are never blocked. With only "-xattr-allow",
+// all other names are blocked.
+//
+// Blocked xattrs are hidden from Listxattr, and accessing them fails with
+// EOPNOTSUPP, like a namespace the filesystem does not support.
+func (rn *RootNode) xattrBlocked(attr string) bool {
+	for _, p := range rn.args.XattrAllow {
+		if xattrMatch(p, attr) {
+			return false
+		}
+	}
+	for _, p := range rn.args.XattrDeny {
+		if xattrMatch(p, attr) {
+			return true
+		}
+	}
+	return len(rn.args.XattrAllow) > 0 && len(rn.args.XattrDeny) == 0
+}
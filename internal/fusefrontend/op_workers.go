@@ -0,0 +1,33 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/workpool"
+)
+
+// largeReadSize is the size from which reads count as "read" operations for
+// "-op-workers". Smaller reads are cheap and are always served directly.
+const largeReadSize = 64 * 1024
+
+// newOpPools starts a worker pool for every operation class in "limits".
+func newOpPools(limits map[string]int) map[string]*workpool.Pool {
+	pools := make(map[string]*workpool.Pool)
+	for op, n := range limits {
+		tlog.Debug.Printf("newOpPools: %d workers for %q", n, op)
+		pools[op] = workpool.New(n)
+	}
+	return pools
+}
+
+// runOp runs "fn" on the worker pool of operation class "op", or directly if
+// "-op-workers" does not limit "op". Returns EINTR if the kernel interrupted
+// the request while it was waiting for a worker.
+func (rn *RootNode) runOp(ctx context.Context, op string, fn func()) syscall.Errno {
+	if err := rn.opPools[op].Do(ctx, fn); err != nil {
+		return syscall.EINTR
+	}
+	return 0
+}
@@ -1,6 +1,7 @@
 package fusefrontend
 
 import (
+	"crypto/sha256"
 	"os"
 	"strings"
 	"sync"
@@ -8,12 +9,21 @@ import (
 	"syscall"
 	"time"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+	"github.com/rfjakob/gocryptfs/v2/internal/uring"
+	"github.com/rfjakob/gocryptfs/v2/internal/workpool"
 )
 
 // RootNode is the root of the filesystem tree of Nodes.
@@ -25,6 +35,9 @@ type RootNode struct {
 	// Readers must RLock() it to prevent them from seeing intermediate
 	// states
 	dirIVLock sync.RWMutex
+	// manifestLock serializes all reads and writes of gocryptfs.manifest
+	// files, see node_manifest.go
+	manifestLock sync.Mutex
 	// Filename encryption helper
 	nameTransform *nametransform.NameTransform
 	// Content encryption helper
@@ -62,6 +75,45 @@ type RootNode struct {
 	quirks uint64
 	// rootIno is the inode number that we report for the root node on mount
 	rootIno uint64
+	// dedup is the chunk store, set by EnableDedup
+	dedup *dedup.Store
+	// longNameJournal makes operations on long names crash-safe. Nil with
+	// -plaintextnames or -longnames=false.
+	longNameJournal *nametransform.LongNameJournal
+	// caseIndex resolves names ignoring case and normalization. Nil unless
+	// -case-insensitive, -nfc or -nfd.
+	caseIndex *nametransform.CaseIndex
+	// nameCache caches decrypted directory entry names. Nil with
+	// -plaintextnames or -namecache-size=0.
+	nameCache *nametransform.NameCache
+	// negCache remembers names that do not exist. Nil unless
+	// -negative-timeout is set.
+	negCache *negCache
+	// dirActivity tracks directory changes to pick the kernel cache
+	// timeouts. Nil unless -adaptive-timeout is set.
+	dirActivity *dirActivity
+	// uring is the io_uring backing I/O engine. Nil unless
+	// "-io-engine uring" is set.
+	uring *uring.Engine
+	// opPools are the worker pools of the operation classes limited by
+	// "-op-workers". Operations without a pool run directly.
+	opPools map[string]*workpool.Pool
+	// supervisor pauses the mount while CIPHERDIR is unavailable. Nil
+	// unless "-supervise" is set.
+	supervisor *backingSupervisor
+	// integrity counts integrity failures and implements "-on-corruption"
+	integrity *integrityGuard
+	// tailCacheHits counts the partial-block writes that found the old
+	// block in the tail cache, see tailBlock
+	tailCacheHits stats.Counter
+	// cipherdirReloads counts the open files that "-watch-cipherdir" has
+	// seen changed in CIPHERDIR, see reloadOpenFile
+	cipherdirReloads stats.Counter
+	// foregroundOps counts the FUSE operations, so the scrubber can get
+	// out of the way
+	foregroundOps stats.Counter
+	// scrubber implements "-scrub". Nil if it is not enabled.
+	scrubber *scrubber
 }
 
 func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *RootNode {
@@ -90,9 +142,41 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTrans
 		inoMap:        inomap.New(rootDev),
 		dirCache:      dirCache{ivLen: ivLen},
 		quirks:        syscallcompat.DetectQuirks(args.Cipherdir),
+		integrity:     newIntegrityGuard(args.OnCorruption, args.CorruptionLimit),
+	}
+	if !args.PlaintextNames && args.LongNames {
+		rn.longNameJournal = nametransform.NewLongNameJournal(args.Cipherdir)
+	}
+	if !args.PlaintextNames && args.NameCacheSize > 0 {
+		rn.nameCache = nametransform.NewNameCache(args.NameCacheSize)
+	}
+	if args.NegativeTimeout > 0 {
+		rn.negCache = newNegCache(args.NegativeTimeout)
+	}
+	if args.AdaptiveTimeout > 0 {
+		rn.dirActivity = newDirActivity(args.AdaptiveTimeout)
+	}
+	if args.IOEngine == "uring" {
+		var err error
+		if rn.uring, err = newUringEngine(c); err != nil {
+			tlog.Warn.Printf("-io-engine uring: %v. Falling back to pread/pwrite.", err)
+		}
+	}
+	rn.opPools = newOpPools(args.OpWorkers)
+	if args.Supervise {
+		var err error
+		if rn.supervisor, err = newBackingSupervisor(args.Cipherdir, rn.dirCache.Clear); err != nil {
+			tlog.Warn.Printf("-supervise: %v. CIPHERDIR will not be supervised.", err)
+		}
+	}
+	if args.Scrub > 0 {
+		rn.scrubber = newScrubber(rn, args.Scrub, args.ScrubBandwidth)
+	}
+	if args.CaseInsensitive || args.CaseFold || args.Normalization != nametransform.NormalizeNone {
+		rn.caseIndex = nametransform.NewCaseIndex(rn.foldName)
 	}
 	if statErr == nil {
-		rn.inoMap.TranslateStat(&st)
+		rn.translateIno(unix.AT_FDCWD, args.Cipherdir+"/.", &st)
 		rn.rootIno = st.Ino
 	}
 	return rn
@@ -100,8 +184,14 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTrans
 
 // main.doMount() calls this after unmount
 func (rn *RootNode) AfterUnmount() {
+	rn.stopScrub()
 	// print stats before we exit
 	rn.dirCache.stats()
+	if rn.longNameJournal != nil {
+		if err := rn.longNameJournal.Close(); err != nil {
+			tlog.Warn.Printf("AfterUnmount: %v", err)
+		}
+	}
 }
 
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
@@ -119,6 +209,7 @@ func (rn *RootNode) mangleOpenFlags(flags uint32) (newFlags int) {
 	// crypto header, alignment will be off, even if userspace makes aligned
 	// accesses. Running xfstests generic/013 on ext4 used to trigger lots of
 	// EINVAL errors due to missing alignment. Just fall back to buffered IO.
+	// Reads may use a second fd with O_DIRECT, see File.openDirect.
 	newFlags = newFlags &^ syscallcompat.O_DIRECT
 	// Create and Open are two separate FUSE operations, so O_CREAT should not
 	// be part of the open flags.
@@ -158,6 +249,46 @@ func (rn *RootNode) isFiltered(child string) bool {
 			configfile.ConfDefaultName)
 		return true
 	}
+	// gocryptfs.dedup in the root directory is the chunk store
+	if child == dedup.DirName && rn.dedup != nil {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			dedup.DirName)
+		return true
+	}
+	// gocryptfs.snapshots in the root directory holds the snapshots
+	if child == snapshot.DirName {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			snapshot.DirName)
+		return true
+	}
+	// .gocryptfs.trash in the root directory holds the files deleted
+	// with -trash
+	if child == nametransform.TrashDirName {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			nametransform.TrashDirName)
+		return true
+	}
+	// gocryptfs.keys in the root directory holds the key shares of the
+	// files with version 3 headers
+	if child == keystore.DirName && rn.contentEnc.HeaderVersion() == contentenc.HeaderVersion3 {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			keystore.DirName)
+		return true
+	}
+	// gocryptfs.tuning in the root directory holds the learned tuning
+	// parameters
+	if tuning.IsStateFile(child) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			child)
+		return true
+	}
+	// gocryptfs.conf.hmac, gocryptfs.conf.bak and .gocryptfs-meta in the root
+	// directory hold the config file HMAC and backup copies
+	if configfile.IsBackupName(child) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
+			child)
+		return true
+	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
 	// are exclusive
 	return false
@@ -242,23 +373,65 @@ func (rn *RootNode) encryptSymlinkTarget(data string) (cData64 string) {
 	return cData64
 }
 
+// LongSymlinks returns true if symlink targets that are too long are stored
+// in separate files, see Args.LongSymlinks
+func (rn *RootNode) LongSymlinks() bool {
+	return rn.args.LongSymlinks
+}
+
+// storeLongSymlink checks that the encrypted target "cTarget" of the new
+// symlink "name" fits into a symlink, and returns it unchanged if it does.
+// If not, it is stored in a separate file with LongSymlinks, and the
+// reference to that file is returned, see nametransform.WriteLongSymlink.
+// Without LongSymlinks, fails with ENAMETOOLONG.
+func (rn *RootNode) storeLongSymlink(name string, target string, cTarget string) (string, error) {
+	if len(cTarget) <= nametransform.SymlinkMax {
+		return cTarget, nil
+	}
+	if !rn.args.LongSymlinks {
+		tlog.Warn.Printf("Symlink %q: the target has %d bytes, %d once encrypted, but a symlink holds at most %d. Targets up to %d bytes fit, or create the filesystem with -long-symlinks.",
+			name, len(target), len(cTarget), nametransform.SymlinkMax, rn.maxSymlinkTarget())
+		return "", syscall.ENAMETOOLONG
+	}
+	ref, err := nametransform.WriteLongSymlink(rn.args.Cipherdir, cTarget)
+	if err != nil {
+		tlog.Warn.Printf("Symlink %q: storing the long target failed: %v", name, err)
+		return "", err
+	}
+	return ref, nil
+}
+
+// maxSymlinkTarget returns the length of the longest symlink target that
+// still fits into a symlink once encrypted
+func (rn *RootNode) maxSymlinkTarget() int {
+	overhead := int(rn.contentEnc.BlockOverhead())
+	for n := nametransform.SymlinkMax*3/4 - overhead; n > 0; n-- {
+		if len(rn.nameTransform.B64EncodeToString(make([]byte, n+overhead))) <= nametransform.SymlinkMax {
+			return n
+		}
+	}
+	return 0
+}
+
 // encryptXattrValue encrypts the xattr value "data".
-// The data is encrypted like a file content block, but without binding it to
-// a file location (block number and file id are set to zero).
+// The data is encrypted like a file content block with block number zero.
+// Without XattrAuth, "xattrAD" is nil and the value is not bound to a file
+// location. With XattrAuth, it comes from xattrAD.
 // Special case: an empty value is encrypted to an empty value.
-func (rn *RootNode) encryptXattrValue(data []byte) (cData []byte) {
+func (rn *RootNode) encryptXattrValue(data []byte, xattrAD []byte) (cData []byte) {
 	if len(data) == 0 {
 		return []byte{}
 	}
-	return rn.contentEnc.EncryptBlock(data, 0, nil)
+	return rn.contentEnc.EncryptBlock(data, 0, xattrAD)
 }
 
-// decryptXattrValue decrypts the xattr value "cData".
-func (rn *RootNode) decryptXattrValue(cData []byte) (data []byte, err error) {
+// decryptXattrValue decrypts the xattr value "cData". "xattrAD" must be the
+// same that was passed to encryptXattrValue.
+func (rn *RootNode) decryptXattrValue(cData []byte, xattrAD []byte) (data []byte, err error) {
 	if len(cData) == 0 {
 		return []byte{}, nil
 	}
-	data, err1 := rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	data, err1 := rn.contentEnc.DecryptBlock([]byte(cData), 0, xattrAD)
 	if err1 == nil {
 		return data, nil
 	}
@@ -270,7 +443,32 @@ func (rn *RootNode) decryptXattrValue(cData []byte) (data []byte, err error) {
 		// Return the original decryption error: err1
 		return nil, err1
 	}
-	return rn.contentEnc.DecryptBlock([]byte(cData), 0, nil)
+	return rn.contentEnc.DecryptBlock([]byte(cData), 0, xattrAD)
+}
+
+// xattrAD derives the additional data for encryptXattrValue from the ID
+// returned by Node.xattrID and the encrypted attribute name "cAttr". Binding
+// the name as well means that values cannot be swapped between the
+// attributes of one file either.
+//
+// Returns nil if XattrAuth is disabled.
+func (rn *RootNode) xattrAD(id []byte, cAttr string) []byte {
+	if !rn.args.XattrAuth {
+		return nil
+	}
+	return XattrAD(id, cAttr)
+}
+
+// XattrAD returns the additional data that binds an xattr value to the ID
+// "id" and the encrypted attribute name "cAttr" on filesystems with the
+// XattrAuth feature flag.
+func XattrAD(id []byte, cAttr string) []byte {
+	h := sha256.New()
+	h.Write([]byte(xattrADDomain))
+	h.Write(id)
+	h.Write([]byte(cAttr))
+	// contentenc wants a value with the length of a file ID
+	return h.Sum(nil)[:xattrADLen]
 }
 
 // encryptXattrName transforms "user.foo" to "user.gocryptfs.a5sAd4XAa47f5as6dAf"
@@ -300,3 +498,15 @@ func (rn *RootNode) decryptXattrName(cAttr string) (attr string, err error) {
 func (rn *RootNode) RootIno() uint64 {
 	return rn.rootIno
 }
+
+// RegisterStats registers the statistics of the filesystem in "r"
+func (rn *RootNode) RegisterStats(r *stats.Registry) {
+	r.Counter("write_tail_cache_hits_total", "Partial-block writes that did not have to read the old block", &rn.tailCacheHits)
+	r.Counter("cipherdir_reloads_total", "Open files that were changed in CIPHERDIR by other programs", &rn.cipherdirReloads)
+	if rn.integrity != nil {
+		rn.integrity.registerStats(r)
+	}
+	if rn.scrubber != nil {
+		rn.scrubber.registerStats(r)
+	}
+}
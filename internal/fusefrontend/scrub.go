@@ -0,0 +1,401 @@
+package fusefrontend
+
+// Background scrubber ("-scrub"). Like a ZFS scrub, it slowly reads all of
+// CIPHERDIR while the filesystem is mounted and checks the authentication
+// tags of the file contents, the recipes and chunks of deduplicated files
+// and the gocryptfs.diriv files. This finds bit rot in files that are
+// rarely read while the backups still have good copies.
+//
+// The scrubber reads the backing files directly, not through FUSE, and
+// keeps out of the way of the user: it reads at most Args.ScrubBandwidth
+// bytes per second, and pauses while FUSE operations come in.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// scrubStartDelay is the time between the mount and the first pass
+	scrubStartDelay = time.Minute
+	// scrubQuiet is how long there must be no FUSE operations before a
+	// paused pass continues
+	scrubQuiet = time.Second
+	// scrubBatchBlocks is the number of blocks that are read at once
+	scrubBatchBlocks = 16
+	// scrubMaxFindings is the number of damaged files that ScrubStatus
+	// lists
+	scrubMaxFindings = 100
+)
+
+// errScrubStopped aborts a pass on unmount
+var errScrubStopped = errors.New("scrub stopped")
+
+// scrubber implements "-scrub"
+type scrubber struct {
+	rn *RootNode
+	// interval is the time between the end of a pass and the start of the
+	// next
+	interval time.Duration
+	// bandwidth is the read rate limit in bytes per second. 0 means no
+	// limit.
+	bandwidth int64
+	stop      chan struct{}
+	stopOnce  sync.Once
+	// quiet is how long a paused pass waits for the FUSE operations to
+	// stop. scrubQuiet, shorter in the tests.
+	quiet time.Duration
+	// lastOps is the value of RootNode.foregroundOps at the last check
+	lastOps int64
+	// t0 and read are the start of the current burst and the bytes read
+	// since, for the rate limit
+	t0   time.Time
+	read int64
+	// chunks are the dedup chunks that the current pass has checked
+	chunks map[dedup.ID]bool
+
+	// bytesTotal and damagedTotal are for stats.Default
+	bytesTotal   stats.Counter
+	damagedTotal stats.Counter
+
+	mu     sync.Mutex
+	status ctlsock.ScrubStatus
+}
+
+func newScrubber(rn *RootNode, interval time.Duration, bandwidth int64) *scrubber {
+	return &scrubber{
+		rn:        rn,
+		interval:  interval,
+		bandwidth: bandwidth,
+		stop:      make(chan struct{}),
+		quiet:     scrubQuiet,
+		status:    ctlsock.ScrubStatus{State: ctlsock.ScrubWaiting},
+	}
+}
+
+// ScrubLoop runs the scrubber passes, the first one scrubStartDelay after
+// the mount, and returns on unmount. Does nothing without "-scrub".
+func (rn *RootNode) ScrubLoop() {
+	s := rn.scrubber
+	if s == nil {
+		return
+	}
+	delay := scrubStartDelay
+	for s.sleep(delay) {
+		if s.pass() == errScrubStopped {
+			return
+		}
+		delay = s.interval
+	}
+}
+
+var _ ctlsocksrv.ScrubInterface = &RootNode{} // Verify that interface is implemented.
+
+// ScrubStatus implements ctlsocksrv.ScrubInterface
+func (rn *RootNode) ScrubStatus() (ctlsock.ScrubStatus, error) {
+	if rn.scrubber == nil {
+		return ctlsock.ScrubStatus{}, syscall.ENOTSUP
+	}
+	s := rn.scrubber
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	st.Findings = append([]ctlsock.ScrubFinding(nil), s.status.Findings...)
+	return st, nil
+}
+
+// stopScrub makes ScrubLoop return. The keys are wiped after the unmount,
+// and the scrubber would report every file as damaged.
+func (rn *RootNode) stopScrub() {
+	if s := rn.scrubber; s != nil {
+		s.stopOnce.Do(func() { close(s.stop) })
+	}
+}
+
+// sleep waits for "d". Returns false if the scrubber has been stopped.
+func (s *scrubber) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func (s *scrubber) setState(state string) {
+	s.mu.Lock()
+	s.status.State = state
+	s.mu.Unlock()
+}
+
+// pass checks all of CIPHERDIR once. Returns errScrubStopped if the
+// scrubber has been stopped meanwhile.
+func (s *scrubber) pass() error {
+	cipherdir := s.rn.args.Cipherdir
+	s.mu.Lock()
+	s.status = ctlsock.ScrubStatus{
+		State:    ctlsock.ScrubRunning,
+		Passes:   s.status.Passes,
+		Started:  time.Now().Unix(),
+		Finished: s.status.Finished,
+	}
+	s.mu.Unlock()
+	s.chunks = make(map[dedup.ID]bool)
+	s.lastOps = s.rn.foregroundOps.Value()
+	s.t0 = time.Now()
+	s.read = 0
+	tlog.Info.Printf("scrub: starting a pass over %s", cipherdir)
+	err := filepath.WalkDir(cipherdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			s.report(path, err)
+			return nil
+		}
+		if err := s.throttle(0); err != nil {
+			return err
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != cipherdir && filepath.Dir(path) == cipherdir && !nametransform.IsContentName(name) {
+				// Trash, chunk store, snapshots and the like. The chunks
+				// are checked through the recipes that use them.
+				return filepath.SkipDir
+			}
+			if err := s.dir(path); err != nil {
+				s.report(path, err)
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !nametransform.IsContentName(name) {
+			return nil
+		}
+		err = s.file(path)
+		if err == errScrubStopped {
+			return err
+		} else if err != nil {
+			s.report(path, err)
+		}
+		s.mu.Lock()
+		s.status.Files++
+		s.mu.Unlock()
+		return nil
+	})
+	s.chunks = nil
+	if err == errScrubStopped {
+		return err
+	}
+	s.mu.Lock()
+	s.status.State = ctlsock.ScrubWaiting
+	s.status.Passes++
+	s.status.Finished = time.Now().Unix()
+	st := s.status
+	s.mu.Unlock()
+	tlog.Info.Printf("scrub: pass finished, checked %d files (%d bytes), %d damaged",
+		st.Files, st.Bytes, st.Damaged)
+	return nil
+}
+
+// throttle is called before "n" bytes are read. It waits while there is
+// foreground activity, and as long as the rate limit asks for.
+func (s *scrubber) throttle(n int64) error {
+	for {
+		ops := s.rn.foregroundOps.Value()
+		if ops == s.lastOps {
+			break
+		}
+		s.lastOps = ops
+		s.setState(ctlsock.ScrubPaused)
+		if !s.sleep(s.quiet) {
+			return errScrubStopped
+		}
+		// Do not catch up on the time spent paused
+		s.t0 = time.Now()
+		s.read = 0
+	}
+	s.setState(ctlsock.ScrubRunning)
+	select {
+	case <-s.stop:
+		return errScrubStopped
+	default:
+	}
+	if n == 0 {
+		return nil
+	}
+	s.read += n
+	s.bytesTotal.Add(n)
+	s.mu.Lock()
+	s.status.Bytes += n
+	s.mu.Unlock()
+	if s.bandwidth <= 0 {
+		return nil
+	}
+	due := time.Duration(float64(s.read) / float64(s.bandwidth) * float64(time.Second))
+	if wait := due - time.Since(s.t0); wait > 0 && !s.sleep(wait) {
+		return errScrubStopped
+	}
+	return nil
+}
+
+// report logs the damaged file or directory "path" and adds it to the
+// findings
+func (s *scrubber) report(path string, err error) {
+	rel, _ := filepath.Rel(s.rn.args.Cipherdir, path)
+	f := ctlsock.ScrubFinding{CipherPath: rel, Error: err.Error(), Found: time.Now().Unix()}
+	if p, err := s.rn.DecryptPath(rel); err == nil {
+		f.Path = p
+	}
+	tlog.Warn.Printf("scrub: damaged: %q (plaintext %q): %v", rel, f.Path, err)
+	s.damagedTotal.Inc()
+	s.mu.Lock()
+	s.status.Damaged++
+	if len(s.status.Findings) < scrubMaxFindings {
+		s.status.Findings = append(s.status.Findings, f)
+	}
+	s.mu.Unlock()
+}
+
+// dir checks gocryptfs.diriv of the directory "path"
+func (s *scrubber) dir(path string) error {
+	if s.rn.args.PlaintextNames {
+		return nil
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	cName := nametransform.RootDirCName
+	if path != s.rn.args.Cipherdir {
+		cName = filepath.Base(path)
+	}
+	if _, err = s.rn.nameTransform.VerifyDirIVAt(fd, cName); err != nil {
+		return fmt.Errorf("%s: %v", nametransform.DirIVFilename, err)
+	}
+	return nil
+}
+
+// file checks all blocks of the file "path". Damage that was caused by a
+// write while we were reading is ignored.
+func (s *scrubber) file(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Deleted meanwhile
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	st1, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	err = s.fileContent(f, uint64(st1.Size()))
+	if err == nil || err == errScrubStopped {
+		return err
+	}
+	if st2, err2 := f.Stat(); err2 == nil && (st2.Size() != st1.Size() || !st2.ModTime().Equal(st1.ModTime())) {
+		tlog.Debug.Printf("scrub: %s changed while it was checked, skipping", path)
+		return nil
+	}
+	return err
+}
+
+// fileContent checks the content of "f", which is "size" bytes long
+func (s *scrubber) fileContent(f *os.File, size uint64) error {
+	cEnc := s.rn.contentEnc
+	if size == 0 {
+		return nil
+	}
+	if s.rn.dedup != nil && dedup.IsRecipeSize(cEnc, size) && size <= maxRecipeSize {
+		if _, ok := recipeSize(int(f.Fd())); ok {
+			return s.recipe(f, size)
+		}
+	}
+	headerLen := cEnc.HeaderLen()
+	if size < headerLen {
+		return fmt.Errorf("truncated header: %d bytes", size)
+	}
+	if err := s.throttle(int64(headerLen)); err != nil {
+		return err
+	}
+	buf := make([]byte, headerLen)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	h, cEnc, err := cEnc.OpenHeader(buf)
+	if err != nil {
+		return err
+	}
+	buf = make([]byte, scrubBatchBlocks*cEnc.CipherBS())
+	off := headerLen
+	for blockNo := uint64(0); off < size; blockNo += scrubBatchBlocks {
+		n, err := f.ReadAt(buf, int64(off))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			// Truncated meanwhile
+			return nil
+		}
+		if err := s.throttle(int64(n)); err != nil {
+			return err
+		}
+		plain, err := cEnc.DecryptBlocks(buf[:n], blockNo, h.ID)
+		cEnc.PReqPool.Put(plain)
+		if err != nil {
+			return err
+		}
+		off += uint64(n)
+	}
+	return nil
+}
+
+// recipe checks the recipe "f", which is "size" bytes long, and the chunks
+// it references that this pass has not checked yet
+func (s *scrubber) recipe(f *os.File, size uint64) error {
+	if err := s.throttle(int64(size)); err != nil {
+		return err
+	}
+	buf := make([]byte, size)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	r, err := s.rn.dedup.ParseRecipe(buf)
+	if err != nil {
+		return err
+	}
+	for _, ref := range r.Chunks {
+		if s.chunks[ref.ID] {
+			continue
+		}
+		if err := s.throttle(int64(ref.Len)); err != nil {
+			return err
+		}
+		if _, err := s.rn.dedup.Get(ref); err != nil {
+			return err
+		}
+		s.chunks[ref.ID] = true
+	}
+	return nil
+}
+
+func (s *scrubber) registerStats(r *stats.Registry) {
+	r.Counter("scrub_bytes_total", "Bytes that the background scrubber has checked", &s.bytesTotal)
+	r.Counter("scrub_damaged_total", "Damaged files and directories that the background scrubber has found", &s.damagedTotal)
+}
@@ -0,0 +1,105 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// writeTestFile creates the file "name" in the root directory of "rn" with
+// "size" bytes of content, through the FUSE code path
+func writeTestFile(t *testing.T, rn *RootNode, name string, size int) {
+	fd, err := syscall.Open(filepath.Join(rn.args.Cipherdir, name), syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, name, rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	defer f.Release(context.Background())
+	if _, errno = f.Write(context.Background(), bytes.Repeat([]byte("x"), size), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+}
+
+func TestScrubPass(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir, PlaintextNames: true, Scrub: time.Hour})
+	writeTestFile(t, rn, "small", 100)
+	writeTestFile(t, rn, "big", 100*contentenc.DefaultBS+10)
+	os.WriteFile(filepath.Join(dir, "empty"), nil, 0600)
+	s := rn.scrubber
+	if err := s.pass(); err != nil {
+		t.Fatal(err)
+	}
+	st, _ := rn.ScrubStatus()
+	if st.State != ctlsock.ScrubWaiting || st.Passes != 1 || st.Files != 3 || st.Damaged != 0 || st.Finished == 0 {
+		t.Fatalf("have %+v", st)
+	}
+
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	// Flip a bit in block 50, which a check of the first block misses
+	big := filepath.Join(dir, "big")
+	data, _ := os.ReadFile(big)
+	data[contentenc.HeaderLen+50*int(rn.contentEnc.CipherBS())+20] ^= 1
+	os.WriteFile(big, data, 0600)
+	if err := s.pass(); err != nil {
+		t.Fatal(err)
+	}
+	st, _ = rn.ScrubStatus()
+	if st.Passes != 2 || st.Damaged != 1 || len(st.Findings) != 1 || st.Findings[0].CipherPath != "big" {
+		t.Fatalf("have %+v", st)
+	}
+	if s.damagedTotal.Value() != 1 {
+		t.Errorf("damagedTotal=%d", s.damagedTotal.Value())
+	}
+}
+
+func TestScrubThrottle(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: t.TempDir(), Scrub: time.Hour, ScrubBandwidth: 1 << 20})
+	s := rn.scrubber
+	s.quiet = 10 * time.Millisecond
+	s.t0 = time.Now()
+	// 256 KiB at 1 MiB/s
+	t0 := time.Now()
+	if err := s.throttle(256 << 10); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d < 200*time.Millisecond {
+		t.Errorf("rate limit: returned after %v", d)
+	}
+	// Foreground activity makes the scrubber wait until it is quiet
+	rn.foregroundOps.Inc()
+	t0 = time.Now()
+	if err := s.throttle(0); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(t0); d < s.quiet {
+		t.Errorf("pause: returned after %v", d)
+	}
+	rn.stopScrub()
+	rn.stopScrub()
+	if err := s.throttle(0); err != errScrubStopped {
+		t.Errorf("have %v, want errScrubStopped", err)
+	}
+}
+
+func TestScrubDisabled(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: t.TempDir()})
+	if _, err := rn.ScrubStatus(); err != syscall.ENOTSUP {
+		t.Errorf("have %v, want ENOTSUP", err)
+	}
+	// Returns at once
+	rn.ScrubLoop()
+	rn.stopScrub()
+}
@@ -0,0 +1,140 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+var _ ctlsocksrv.ShredInterface = &RootNode{} // Verify that interface is implemented.
+
+// Shred implements ctlsocksrv.ShredInterface. It destroys the key share of
+// the file "plainPath" in the key store, overwrites the header with random
+// bytes and deletes the file, bypassing the trash. Copies of the file that
+// survive somewhere, even with the header, cannot be decrypted anymore, not
+// even with the master key.
+//
+// Needs version 3 headers (ENOTSUP otherwise). Fails with EBUSY if the
+// file is open, because the data key is still in memory, and with EMLINK
+// if it has more than one link. Only files opened through this RootNode
+// are seen, so other processes must not have CIPHERDIR mounted; "-shred"
+// makes sure of that with lockCipherdir.
+func (rn *RootNode) Shred(plainPath string) error {
+	if rn.contentEnc.HeaderVersion() != contentenc.HeaderVersion3 {
+		return syscall.ENOTSUP
+	}
+	parent, name := path.Split(plainPath)
+	parent = strings.TrimSuffix(parent, "/")
+	cParent, err := rn.EncryptPath(parent)
+	if err != nil {
+		return err
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.args.Cipherdir, cParent)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	cName := name
+	if !rn.args.PlaintextNames {
+		iv, err := rn.nameTransform.ReadDirIVAt(dirfd)
+		if err != nil {
+			return err
+		}
+		if cName, err = rn.nameTransform.EncryptAndHashName(name, iv); err != nil {
+			return err
+		}
+	}
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDWR|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ELOOP {
+		return syscall.EINVAL
+	} else if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return syscall.EINVAL
+	}
+	if st.Nlink > 1 {
+		return syscall.EMLINK
+	}
+	if openfiletable.Lookup(inomap.QInoFromStat(&st)) != nil {
+		return syscall.EBUSY
+	}
+	if err = rn.shredHeader(fd, st.Size, plainPath); err != nil {
+		return err
+	}
+
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return errno
+	}
+	defer manifestDone()
+	isLong := !rn.args.PlaintextNames && nametransform.IsLongContent(cName)
+	if isLong && rn.longNameJournal != nil {
+		journalDone, err := rn.longNameJournal.Begin(cParent, cName)
+		if err != nil {
+			return err
+		}
+		defer journalDone()
+	}
+	if err = syscallcompat.Unlinkat(dirfd, cName, 0); err != nil {
+		return err
+	}
+	if isLong {
+		if err = nametransform.DeleteLongNameAt(dirfd, cName); err != nil {
+			tlog.Warn.Printf("Shred: could not delete .name file: %v", err)
+		}
+	}
+	rn.invalidateCaseIndex(dirfd)
+	rn.dirChangedPath(parent, name)
+	tlog.Info.Printf("Shred: shredded %q", plainPath)
+	return nil
+}
+
+// shredHeader destroys the key share of the open backing file "fd" of size
+// "size" in the key store, overwrites its header with random bytes, and
+// waits until that is on disk. Empty files have no header and no content.
+func (rn *RootNode) shredHeader(fd int, size int64, plainPath string) error {
+	if size == 0 {
+		return nil
+	}
+	hLen := rn.contentEnc.HeaderLen()
+	buf := make([]byte, hLen)
+	if n, err := syscall.Pread(fd, buf, 0); err != nil {
+		return err
+	} else if uint64(n) != hLen {
+		return fmt.Errorf("%q: short header (%d bytes)", plainPath, n)
+	}
+	h, _, err := rn.contentEnc.OpenHeader(buf)
+	if err != nil {
+		return fmt.Errorf("%q: %v", plainPath, err)
+	}
+	if h.WrappedKey == nil {
+		// The content is encrypted with the content key, destroying the
+		// header would not make it unreadable
+		return fmt.Errorf("%q has no data key of its own", plainPath)
+	}
+	// Without the key share, the wrapped key in copies of the header is
+	// useless
+	if err = rn.contentEnc.DestroyKeyShare(h.ID); err != nil {
+		return fmt.Errorf("%q: key share: %v", plainPath, err)
+	}
+	if _, err = syscall.Pwrite(fd, cryptocore.RandBytes(int(hLen)), 0); err != nil {
+		return err
+	}
+	return syscall.Fsync(fd)
+}
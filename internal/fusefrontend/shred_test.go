@@ -0,0 +1,73 @@
+package fusefrontend
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+)
+
+func TestShred(t *testing.T) {
+	dir := t.TempDir()
+	rn := newTestFS(Args{Cipherdir: dir, PlaintextNames: true})
+	if err := rn.Shred("file"); err != syscall.ENOTSUP {
+		t.Errorf("without version 3 headers: have %v, want ENOTSUP", err)
+	}
+	if err := rn.contentEnc.UseHeaderV3(keystore.New(dir)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "file")
+	fd, err := syscall.Open(path, syscall.O_RDWR|syscall.O_CREAT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _, errno := NewFile(fd, "file", rn)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	ctx := context.Background()
+	if _, errno = f.Write(ctx, []byte("secret"), 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	if err = rn.Shred("file"); err != syscall.EBUSY {
+		t.Errorf("open file: have %v, want EBUSY", err)
+	}
+	f.Release(ctx)
+	// A backup of the ciphertext, header included
+	backupCopy, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The file itself, open before it is shredded
+	backup, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	if err = os.Link(path, path+".link"); err != nil {
+		t.Fatal(err)
+	}
+	if err = rn.Shred("file"); err != syscall.EMLINK {
+		t.Errorf("hard link: have %v, want EMLINK", err)
+	}
+	os.Remove(path + ".link")
+	if err = rn.Shred("file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("file was not deleted: %v", err)
+	}
+	hdr := make([]byte, rn.contentEnc.HeaderLen())
+	if _, err = backup.ReadAt(hdr, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = rn.contentEnc.OpenHeader(hdr); err == nil {
+		t.Error("the data key can still be unwrapped")
+	}
+	if _, _, err = rn.contentEnc.OpenHeader(backupCopy[:len(hdr)]); err == nil {
+		t.Error("the data key can still be unwrapped from the backup")
+	}
+}
@@ -0,0 +1,74 @@
+package fusefrontend
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// Values for "-statfs"
+const (
+	// StatfsAdjusted reports the space in plaintext bytes, see adjustStatfs
+	StatfsAdjusted = "adjusted"
+	// StatfsRaw reports the numbers of the backing filesystem
+	StatfsRaw = "raw"
+)
+
+// journalEntryMax is the largest LongNameJournal entry. It holds a path
+// relative to CIPHERDIR.
+const journalEntryMax = 4096
+
+// adjustStatfs converts "out", the statfs result of the backing
+// filesystem, into what can still be written through the mount:
+//
+//   - Block counts are scaled by PlainBS/CipherBS, the per-block overhead
+//     of nonce and tag. The 18-byte file header is ignored.
+//   - The space that we need for our own bookkeeping when a file is created
+//     or deleted is not counted as free: a LongNameJournal entry, and with
+//     "-trash", the ".path" file of a trashed file.
+//   - NameLen is the longest plaintext name, see NameLimits.
+//
+// Files in the trash are counted as used until they are purged. Free inodes
+// are reported as they are, although each directory and each hashed long
+// name needs a second one.
+func (rn *RootNode) adjustStatfs(out *fuse.StatfsOut) {
+	frsize := uint64(out.Frsize)
+	if frsize == 0 {
+		frsize = uint64(out.Bsize)
+	}
+	var reserve uint64
+	if rn.longNameJournal != nil {
+		reserve += journalEntryMax
+	}
+	if rn.args.Trash > 0 {
+		reserve += maxTrashPathFile
+	}
+	if frsize > 0 {
+		reserveBlocks := (reserve + frsize - 1) / frsize
+		out.Bfree = subSaturating(out.Bfree, reserveBlocks)
+		out.Bavail = subSaturating(out.Bavail, reserveBlocks)
+	}
+	plainBS := rn.contentEnc.PlainBS()
+	cipherBS := rn.contentEnc.CipherBS()
+	scale := func(b uint64) uint64 {
+		// b*plainBS/cipherBS without overflowing
+		return b/cipherBS*plainBS + b%cipherBS*plainBS/cipherBS
+	}
+	out.Blocks = scale(out.Blocks)
+	out.Bfree = scale(out.Bfree)
+	out.Bavail = scale(out.Bavail)
+	if rn.args.PlaintextNames {
+		max, _ := nametransform.PlainNameLimits(int(out.NameLen))
+		out.NameLen = uint32(max)
+	} else {
+		max, _ := rn.nameTransform.NameLimits(int(out.NameLen))
+		out.NameLen = uint32(max)
+	}
+}
+
+func subSaturating(a, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+	return a - b
+}
@@ -0,0 +1,41 @@
+package fusefrontend
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestAdjustStatfs(t *testing.T) {
+	rn := newTestFS(Args{})
+	raw := fuse.StatfsOut{Blocks: 1032000, Bfree: 516000, Bavail: 412800, Files: 100, Ffree: 50,
+		Bsize: 4096, Frsize: 4096, NameLen: 255}
+	out := raw
+	rn.adjustStatfs(&out)
+	// 4096 plaintext bytes take 4128 bytes in CIPHERDIR
+	if out.Blocks != 1024000 || out.Bfree != 512000 || out.Bavail != 409600 {
+		t.Errorf("wrong block counts: %+v", out)
+	}
+	if out.Files != raw.Files || out.Ffree != raw.Ffree {
+		t.Errorf("inode counts changed: %+v", out)
+	}
+	max, _ := rn.nameTransform.NameLimits(255)
+	if int(out.NameLen) != max {
+		t.Errorf("NameLen=%d, want %d", out.NameLen, max)
+	}
+	// The trash needs space for the ".path" file
+	rn.args.Trash = time.Hour
+	out = raw
+	rn.adjustStatfs(&out)
+	if out.Bavail >= 409600 {
+		t.Errorf("no space reserved for the trash: Bavail=%d", out.Bavail)
+	}
+	// Almost full
+	out = raw
+	out.Bfree, out.Bavail = 1, 1
+	rn.adjustStatfs(&out)
+	if out.Bfree != 0 || out.Bavail != 0 {
+		t.Errorf("have %d free blocks, want 0", out.Bavail)
+	}
+}
@@ -0,0 +1,294 @@
+package fusefrontend
+
+// Support for "-trash": Unlink moves files to CIPHERDIR/.gocryptfs.trash
+// instead of deleting them, where they are kept for Args.Trash.
+//
+// A file in the trash is stored under an ID of the form
+// "<unix time in ns>-<random hex>". Its original plaintext path is stored
+// encrypted, like a symlink target, in "<ID>.path". The file itself keeps
+// its header and file ID, so its content decrypts as before.
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+var _ ctlsocksrv.TrashInterface = &RootNode{} // Verify that interface is implemented.
+
+// maxTrashPathFile is the maximum size of a "<ID>.path" file. Plaintext
+// paths are at most 4096 bytes.
+const maxTrashPathFile = 8192
+
+// newTrashID returns a new ID for a file deleted at "t".
+func newTrashID(t time.Time) string {
+	return fmt.Sprintf("%d-%s", t.UnixNano(), hex.EncodeToString(cryptocore.RandBytes(8)))
+}
+
+// ParseTrashID returns the time of deletion encoded in "id", the name of a
+// file in the trash.
+func ParseTrashID(id string) (time.Time, bool) {
+	i := strings.IndexByte(id, '-')
+	if i < 0 {
+		return time.Time{}, false
+	}
+	ns, err := strconv.ParseInt(id[:i], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, ns), true
+}
+
+// openTrashDir opens the trash directory. With "create", it is created if
+// it does not exist yet.
+func (rn *RootNode) openTrashDir(create bool) (*os.File, error) {
+	rootfd, err := syscallcompat.OpenDirNofollow(rn.args.Cipherdir, "")
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(rootfd)
+	if create {
+		err = unix.Mkdirat(rootfd, nametransform.TrashDirName, 0700)
+		if err != nil && err != syscall.EEXIST {
+			return nil, err
+		}
+	}
+	fd, err := syscallcompat.Openat(rootfd, nametransform.TrashDirName,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), nametransform.TrashDirName), nil
+}
+
+// trashUnlink moves "cName" in "dirfd" to the trash. "plainPath" is the
+// plaintext path of the file, relative to the root.
+func (rn *RootNode) trashUnlink(dirfd int, cName string, plainPath string) error {
+	t, err := rn.openTrashDir(true)
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+	tfd := int(t.Fd())
+	id := newTrashID(time.Now())
+	pathFile := id + nametransform.TrashPathSuffix
+	fd, err := syscallcompat.Openat(tfd, pathFile, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = syscall.Write(fd, []byte(rn.encryptSymlinkTarget(plainPath)))
+	syscall.Close(fd)
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, cName, tfd, id)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(tfd, pathFile, 0)
+		return err
+	}
+	tlog.Debug.Printf("trashUnlink: %q -> %s", cName, id)
+	return nil
+}
+
+// readTrashPath returns the original plaintext path of trash entry "id".
+func (rn *RootNode) readTrashPath(tfd int, id string) (string, error) {
+	fd, err := syscallcompat.Openat(tfd, id+nametransform.TrashPathSuffix, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, maxTrashPathFile)
+	n, err := syscall.Read(fd, buf)
+	if err != nil {
+		return "", err
+	}
+	return rn.decryptSymlinkTarget(string(buf[:n]))
+}
+
+// TrashList implements ctlsocksrv.TrashInterface. It returns the files in
+// the trash, oldest first.
+func (rn *RootNode) TrashList() ([]ctlsock.TrashEntry, error) {
+	if rn.args.Trash == 0 {
+		return nil, syscall.ENOTSUP
+	}
+	t, err := rn.openTrashDir(false)
+	if err == syscall.ENOENT {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+	names, err := t.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var list []ctlsock.TrashEntry
+	for _, n := range names {
+		if !strings.HasSuffix(n, nametransform.TrashPathSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(n, nametransform.TrashPathSuffix)
+		deleted, ok := ParseTrashID(id)
+		if !ok {
+			continue
+		}
+		p, err := rn.readTrashPath(int(t.Fd()), id)
+		if err != nil {
+			tlog.Warn.Printf("TrashList: %s: %v", id, err)
+			rn.reportMitigatedCorruption(path.Join(nametransform.TrashDirName, n))
+			continue
+		}
+		list = append(list, ctlsock.TrashEntry{ID: id, Path: p, Deleted: deleted.Unix()})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list, nil
+}
+
+// TrashRestore implements ctlsocksrv.TrashInterface. It moves the trash entry
+// with ID "ref", or the most recently deleted file whose path was "ref", back
+// to its original path, and returns that path. Fails with EEXIST if the path
+// exists, and with ENOENT if its parent directory does not exist anymore.
+func (rn *RootNode) TrashRestore(ref string) (string, error) {
+	list, err := rn.TrashList()
+	if err != nil {
+		return "", err
+	}
+	var e *ctlsock.TrashEntry
+	for i := range list {
+		if list[i].ID == ref {
+			e = &list[i]
+			break
+		}
+	}
+	if e == nil {
+		for i := range list {
+			if list[i].Path == ref {
+				e = &list[i]
+			}
+		}
+	}
+	if e == nil {
+		return "", syscall.ENOENT
+	}
+	parent, name := path.Split(e.Path)
+	cParent, err := rn.EncryptPath(strings.TrimSuffix(parent, "/"))
+	if err != nil {
+		return "", err
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(rn.args.Cipherdir, cParent)
+	if err != nil {
+		return "", err
+	}
+	defer syscall.Close(dirfd)
+	cName := name
+	if !rn.args.PlaintextNames {
+		iv, err := rn.nameTransform.ReadDirIVAt(dirfd)
+		if err != nil {
+			return "", err
+		}
+		if cName, err = rn.nameTransform.EncryptAndHashName(name, iv); err != nil {
+			return "", err
+		}
+	}
+	manifestDone, errno := rn.manifestBegin(dirfd, cName)
+	if errno != 0 {
+		return "", errno
+	}
+	defer manifestDone()
+	isLong := !rn.args.PlaintextNames && nametransform.IsLongContent(cName)
+	if isLong && rn.longNameJournal != nil {
+		journalDone, err := rn.longNameJournal.Begin(cParent, cName)
+		if err != nil {
+			return "", err
+		}
+		defer journalDone()
+	}
+	if isLong {
+		if err = rn.nameTransform.WriteLongNameAt(dirfd, cName, name); err != nil {
+			return "", err
+		}
+	}
+	t, err := rn.openTrashDir(false)
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+	err = syscallcompat.Renameat2(int(t.Fd()), e.ID, dirfd, cName, syscallcompat.RENAME_NOREPLACE)
+	if err != nil {
+		if isLong {
+			nametransform.DeleteLongNameAt(dirfd, cName)
+		}
+		return "", err
+	}
+	syscallcompat.Unlinkat(int(t.Fd()), e.ID+nametransform.TrashPathSuffix, 0)
+	if rn.negCache != nil {
+		rn.negCache.clear()
+	}
+	rn.dirChangedPath(parent, name)
+	tlog.Info.Printf("TrashRestore: restored %q", e.Path)
+	return e.Path, nil
+}
+
+// PurgeTrashLoop deletes the files whose retention period is over from the
+// trash, at startup and then at least once per hour. Does not return.
+func (rn *RootNode) PurgeTrashLoop() {
+	interval := time.Hour
+	if rn.args.Trash < interval {
+		interval = rn.args.Trash
+	}
+	for {
+		rn.purgeTrash(time.Now())
+		time.Sleep(interval)
+	}
+}
+
+// purgeTrash deletes the files that were deleted more than Args.Trash
+// before "now" from the trash.
+func (rn *RootNode) purgeTrash(now time.Time) {
+	t, err := rn.openTrashDir(false)
+	if err == syscall.ENOENT {
+		return
+	} else if err != nil {
+		tlog.Warn.Printf("purgeTrash: %v", err)
+		return
+	}
+	defer t.Close()
+	names, err := t.Readdirnames(-1)
+	if err != nil {
+		tlog.Warn.Printf("purgeTrash: %v", err)
+		return
+	}
+	purged := 0
+	for _, n := range names {
+		deleted, ok := ParseTrashID(strings.TrimSuffix(n, nametransform.TrashPathSuffix))
+		if !ok || now.Sub(deleted) < rn.args.Trash {
+			continue
+		}
+		if err := syscallcompat.Unlinkat(int(t.Fd()), n, 0); err != nil {
+			tlog.Warn.Printf("purgeTrash: %s: %v", n, err)
+			continue
+		}
+		if !strings.HasSuffix(n, nametransform.TrashPathSuffix) {
+			purged++
+		}
+	}
+	if purged > 0 {
+		tlog.Debug.Printf("purgeTrash: purged %d files", purged)
+	}
+}
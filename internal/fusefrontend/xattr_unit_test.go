@@ -4,6 +4,10 @@ package fusefrontend
 // "xattr_integration_test.go" in the test/xattr package.
 
 import (
+	"bytes"
+	"context"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -19,7 +23,7 @@ func newTestFS(args Args) *RootNode {
 	key := make([]byte, cryptocore.KeyLen)
 	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
 	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
-	n := nametransform.New(cCore.EMECipher, true, 0, true, nil, false)
+	n := nametransform.New(cCore.EMECipher, true, 0, true, nil, false, nil)
 	rn := NewRootNode(args, cEnc, n)
 	oneSecond := time.Second
 	options := &fs.Options{
@@ -43,3 +47,76 @@ func TestEncryptDecryptXattrName(t *testing.T) {
 		t.Fatalf("Decrypt mismatch: %v != %v", attr1, attr2)
 	}
 }
+
+func TestParseXattrPatterns(t *testing.T) {
+	p, err := ParseXattrPatterns("user.*, security.selinux,*")
+	if err != nil || len(p) != 3 || p[1] != "security.selinux" {
+		t.Errorf("have %q %v", p, err)
+	}
+	for _, s := range []string{"user.*,", "us*er.x", "selinux"} {
+		if _, err := ParseXattrPatterns(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestXattrBlocked(t *testing.T) {
+	for _, tc := range []struct {
+		allow, deny []string
+		attr        string
+		blocked     bool
+	}{
+		{nil, nil, "user.foo", false},
+		{nil, []string{"user.*"}, "user.foo", true},
+		{nil, []string{"user.*"}, "security.selinux", false},
+		{[]string{"security.selinux"}, nil, "user.foo", true},
+		{[]string{"security.selinux"}, nil, "security.selinux", false},
+		{[]string{"user.keep"}, []string{"user.*"}, "user.keep", false},
+		{[]string{"user.keep"}, []string{"user.*"}, "user.foo", true},
+		{[]string{"user.keep"}, []string{"user.*"}, "trusted.foo", false},
+		{nil, []string{"*"}, "system.posix_acl_access", true},
+	} {
+		rn := &RootNode{args: Args{XattrAllow: tc.allow, XattrDeny: tc.deny}}
+		if b := rn.xattrBlocked(tc.attr); b != tc.blocked {
+			t.Errorf("allow=%q deny=%q %q: have %v", tc.allow, tc.deny, tc.attr, b)
+		}
+	}
+}
+
+func TestXattrFilterAndSize(t *testing.T) {
+	rn := newTestFS(Args{Cipherdir: t.TempDir(), XattrDeny: []string{"user.secret*"}})
+	ctx := context.Background()
+	if errno := rn.Setxattr(ctx, "user.foo", []byte("bar"), 0); errno != 0 {
+		if errno == syscall.EOPNOTSUPP {
+			t.Skip("backing filesystem has no user xattrs")
+		}
+		t.Fatal(errno)
+	}
+	if errno := rn.Setxattr(ctx, "user.secret", []byte("x"), 0); errno != syscall.EOPNOTSUPP {
+		t.Errorf("Setxattr blocked: have %v", errno)
+	}
+	if _, errno := rn.Getxattr(ctx, "user.secret", nil); errno != syscall.EOPNOTSUPP {
+		t.Errorf("Getxattr blocked: have %v", errno)
+	}
+	// Size queries report the plaintext size
+	if sz, errno := rn.Getxattr(ctx, "user.foo", nil); sz != 3 || errno != 0 {
+		t.Errorf("Getxattr size: have %d %v", sz, errno)
+	}
+	// Blocked names are not listed, and not counted in the size
+	rn.args.XattrDeny = []string{"user.foo"}
+	if sz, errno := rn.Listxattr(ctx, nil); sz != 0 || errno != 0 {
+		t.Errorf("Listxattr size: have %d %v", sz, errno)
+	}
+	rn.args.XattrDeny = nil
+	buf := make([]byte, 100)
+	sz, errno := rn.Listxattr(ctx, buf)
+	if errno != 0 || !bytes.Equal(buf[:sz], []byte("user.foo\000")) {
+		t.Errorf("Listxattr: have %q %v", buf[:sz], errno)
+	}
+	// A name whose encrypted form is too long for the backing filesystem
+	// does not exist
+	long := "user." + strings.Repeat("x", 200)
+	if _, errno := rn.Getxattr(ctx, long, nil); errno != syscall.ENODATA {
+		t.Errorf("Getxattr long name: have %v", errno)
+	}
+}
@@ -0,0 +1,202 @@
+package fusefrontend_reverse
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// With "-chunk-size", large files are split into chunks. Chunk 0 is the
+// ciphertext file itself, cut off at the end of the chunk, and chunk k >= 1
+// is presented as "CNAME.chunk.k". Concatenating all chunks gives the normal
+// ciphertext file, which is what "-join-chunks" does.
+//
+// Chunk boundaries are aligned to ciphertext blocks. As reverse mode
+// encrypts deterministically, changing a part of a plaintext file only
+// changes the chunks that contain it.
+const chunkSuffix = ".chunk."
+
+// chunkPayload returns the ciphertext length of a chunk, not counting the
+// file header that is in chunk 0.
+func (rn *RootNode) chunkPayload() uint64 {
+	cBS := rn.contentEnc.CipherBS()
+	c := rn.args.ChunkSize / cBS * cBS
+	if c == 0 {
+		c = cBS
+	}
+	return c
+}
+
+// chunkCount returns the number of chunks a file with ciphertext size
+// "cSize" is split into.
+func (rn *RootNode) chunkCount(cSize uint64) uint64 {
+	c := rn.chunkPayload()
+	if cSize <= contentenc.HeaderLen+c {
+		return 1
+	}
+	return (cSize - contentenc.HeaderLen + c - 1) / c
+}
+
+// chunkRange returns the range of ciphertext offsets [start, end) that chunk
+// "k" covers. The last chunk usually ends before "end".
+func (rn *RootNode) chunkRange(k uint64) (start uint64, end uint64) {
+	c := rn.chunkPayload()
+	if k > 0 {
+		start = contentenc.HeaderLen + k*c
+	}
+	return start, contentenc.HeaderLen + (k+1)*c
+}
+
+// chunkSize returns the size of chunk "k" of a file with ciphertext size
+// "cSize".
+func (rn *RootNode) chunkSize(cSize uint64, k uint64) uint64 {
+	start, end := rn.chunkRange(k)
+	if cSize < end {
+		end = cSize
+	}
+	if end < start {
+		return 0
+	}
+	return end - start
+}
+
+// ParseChunkName splits "CNAME.chunk.k" into "CNAME" and k. Only canonical
+// numbers >= 1 are accepted.
+func ParseChunkName(cName string) (base string, k uint64, ok bool) {
+	i := strings.LastIndex(cName, chunkSuffix)
+	if i <= 0 {
+		return "", 0, false
+	}
+	num := cName[i+len(chunkSuffix):]
+	if num == "" || num[0] == '0' {
+		return "", 0, false
+	}
+	k, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return cName[:i], k, true
+}
+
+// ChunkName is the inverse of ParseChunkName.
+func ChunkName(base string, k uint64) string {
+	return base + chunkSuffix + strconv.FormatUint(k, 10)
+}
+
+// chunkInoKey identifies a chunk for chunkIno.
+type chunkInoKey struct {
+	dev, ino, k uint64
+}
+
+// chunkIno returns the inode number for chunk "k" of the backing file "st".
+// The mapping is stable for the lifetime of the mount, so backup tools don't
+// see new files on each lookup.
+func (rn *RootNode) chunkIno(st *syscall.Stat_t, k uint64) uint64 {
+	key := chunkInoKey{uint64(st.Dev), uint64(st.Ino), k}
+	if v, found := rn.chunkInos.Load(key); found {
+		return v.(uint64)
+	}
+	v, _ := rn.chunkInos.LoadOrStore(key, rn.inoMap.NextSpillIno())
+	return v.(uint64)
+}
+
+// ChunkNode is chunk number "k" >= 1 of the file "base" in directory
+// "parent".
+type ChunkNode struct {
+	fs.Inode
+
+	parent *Node
+	base   string
+	k      uint64
+}
+
+var _ = (fs.NodeOpener)((*ChunkNode)(nil))
+var _ = (fs.NodeGetattrer)((*ChunkNode)(nil))
+
+// lookupChunk returns a new Inode for a "CNAME.chunk.k" file inside `n`.
+func (n *Node) lookupChunk(ctx context.Context, cName string, out *fuse.EntryOut) (ch *fs.Inode, errno syscall.Errno) {
+	base, k, _ := ParseChunkName(cName)
+	node := &ChunkNode{parent: n, base: base, k: k}
+	errno = node.getattr(&out.Attr)
+	if errno != 0 {
+		return nil, errno
+	}
+	rn := n.rootNode()
+	id := rn.uniqueStableAttr(syscall.S_IFREG, out.Attr.Ino)
+	return n.NewInode(ctx, node, id), 0
+}
+
+// getattr fills `a` with the attributes of the backing file, adjusted to
+// the chunk. Returns ENOENT if the file has no chunk number `k`.
+func (c *ChunkNode) getattr(a *fuse.Attr) syscall.Errno {
+	d, errno := c.parent.prepareAtSyscall(c.base)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	st, err := syscallcompat.Fstatat2(d.dirfd, d.pName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return syscall.ENOENT
+	}
+	rn := c.parent.rootNode()
+	cSize := rn.contentEnc.PlainSizeToCipherSize(uint64(st.Size))
+	if c.k >= rn.chunkCount(cSize) {
+		return syscall.ENOENT
+	}
+	ino := rn.chunkIno(st, c.k)
+	a.FromStat(st)
+	a.Ino = ino
+	a.Size = rn.chunkSize(cSize, c.k)
+	a.Blocks = (a.Size + 511) / 512
+	a.Nlink = 1
+	if rn.args.ForceOwner != nil {
+		a.Owner = *rn.args.ForceOwner
+	}
+	return 0
+}
+
+// Getattr - FUSE call
+func (c *ChunkNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	return c.getattr(&out.Attr)
+}
+
+// Open - FUSE call
+func (c *ChunkNode) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	d, errno := c.parent.prepareAtSyscall(c.base)
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(d.dirfd)
+	f, errno := c.parent.rootNode().newFile(d, flags)
+	if errno != 0 {
+		return
+	}
+	f.chunkStart, f.chunkEnd = c.parent.rootNode().chunkRange(c.k)
+	return f, 0, 0
+}
+
+// readdirChunks returns the "CNAME.chunk.k" entries for the plaintext file
+// "pName" in directory "fd".
+func (rn *RootNode) readdirChunks(fd int, pName string, cName string) (entries []fuse.DirEntry) {
+	st, err := syscallcompat.Fstatat2(fd, pName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return nil
+	}
+	n := rn.chunkCount(rn.contentEnc.PlainSizeToCipherSize(uint64(st.Size)))
+	for k := uint64(1); k < n; k++ {
+		entries = append(entries, fuse.DirEntry{Mode: syscall.S_IFREG, Name: ChunkName(cName, k)})
+	}
+	return entries
+}
@@ -0,0 +1,72 @@
+package fusefrontend_reverse
+
+import (
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+)
+
+func TestParseChunkName(t *testing.T) {
+	testCases := []struct {
+		in   string
+		base string
+		k    uint64
+		ok   bool
+	}{
+		{"abc.chunk.1", "abc", 1, true},
+		{"abc.chunk.12", "abc", 12, true},
+		{"gocryptfs.longname.xyz.chunk.3", "gocryptfs.longname.xyz", 3, true},
+		{"abc.chunk.0", "", 0, false},
+		{"abc.chunk.01", "", 0, false},
+		{"abc.chunk.", "", 0, false},
+		{"abc.chunk.1x", "", 0, false},
+		{".chunk.1", "", 0, false},
+		{"abc", "", 0, false},
+	}
+	for _, tc := range testCases {
+		base, k, ok := ParseChunkName(tc.in)
+		if base != tc.base || k != tc.k || ok != tc.ok {
+			t.Errorf("%q: have %q %d %v, want %q %d %v", tc.in, base, k, ok, tc.base, tc.k, tc.ok)
+		}
+		if ok && ChunkName(base, k) != tc.in {
+			t.Errorf("%q: ChunkName round-trip failed", tc.in)
+		}
+	}
+}
+
+func TestChunkRanges(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendAESSIV, contentenc.DefaultIVBits, true)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	cBS := cEnc.CipherBS()
+	// Not a multiple of the ciphertext block size, rounded down to 2 blocks
+	rn := &RootNode{
+		args:       fusefrontend.Args{ChunkSize: 2*cBS + 100},
+		contentEnc: cEnc,
+	}
+	if rn.chunkPayload() != 2*cBS {
+		t.Fatalf("chunkPayload: have %d, want %d", rn.chunkPayload(), 2*cBS)
+	}
+	for plainSize := uint64(0); plainSize < 10*contentenc.DefaultBS; plainSize += 1000 {
+		cSize := cEnc.PlainSizeToCipherSize(plainSize)
+		n := rn.chunkCount(cSize)
+		// The chunks must cover the file without gaps or overlap
+		var sum uint64
+		for k := uint64(0); k < n; k++ {
+			start, _ := rn.chunkRange(k)
+			if start != sum {
+				t.Errorf("size %d, chunk %d: starts at %d, want %d", cSize, k, start, sum)
+			}
+			size := rn.chunkSize(cSize, k)
+			if size == 0 && k > 0 {
+				t.Errorf("size %d, chunk %d: empty", cSize, k)
+			}
+			sum += size
+		}
+		if sum != cSize {
+			t.Errorf("size %d: chunks add up to %d", cSize, sum)
+		}
+	}
+}
@@ -6,11 +6,25 @@ import (
 
 	"golang.org/x/sys/unix"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
 )
 
-// Verify that the interface is implemented.
+// Verify that the interfaces are implemented.
 var _ ctlsocksrv.Interface = &RootNode{}
+var _ ctlsocksrv.CryptoConfigInterface = &RootNode{}
+var _ ctlsocksrv.FeaturesInterface = &RootNode{}
+
+// CtlsockFeatures implements ctlsocksrv.FeaturesInterface
+func (rn *RootNode) CtlsockFeatures() []string {
+	return []string{ctlsock.FeatureReverse}
+}
+
+// ParallelCrypto implements ctlsocksrv.CryptoConfigInterface
+func (rn *RootNode) ParallelCrypto() *parallelcrypto.ParallelCrypto {
+	return rn.contentEnc.ParallelCrypto()
+}
 
 // EncryptPath implements ctlsock.Backend.
 // This is used for the control socket and for the "-exclude" logic.
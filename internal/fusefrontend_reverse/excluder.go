@@ -1,25 +1,22 @@
 package fusefrontend_reverse
 
 import (
-	"log"
 	"os"
 	"strings"
 
-	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/gitignore"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
-
-	"github.com/sabhiram/go-gitignore"
 )
 
 // prepareExcluder creates an object to check if paths are excluded
 // based on the patterns specified in the command line.
-func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
-	patterns := getExclusionPatterns(args)
-	if len(patterns) == 0 {
-		log.Panic(patterns)
+func prepareExcluder(args fusefrontend.Args) (*gitignore.Matcher, error) {
+	patterns, err := getExclusionPatterns(args)
+	if err != nil {
+		return nil, err
 	}
-	return ignore.CompileIgnoreLines(patterns...)
+	return gitignore.Compile(patterns)
 }
 
 // getExclusionPatters prepares a list of patterns to be excluded.
@@ -27,7 +24,7 @@ func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
 // with a leading '/' to preserve backwards compatibility (before
 // wildcard matching was implemented, exclusions always were matched
 // against the full path).
-func getExclusionPatterns(args fusefrontend.Args) []string {
+func getExclusionPatterns(args fusefrontend.Args) ([]string, error) {
 	patterns := make([]string, len(args.Exclude)+len(args.ExcludeWildcard))
 	// add -exclude
 	for i, p := range args.Exclude {
@@ -39,12 +36,11 @@ func getExclusionPatterns(args fusefrontend.Args) []string {
 	for _, file := range args.ExcludeFrom {
 		lines, err := getLines(file)
 		if err != nil {
-			tlog.Fatal.Printf("Error reading exclusion patterns: %q", err)
-			os.Exit(exitcodes.ExcludeError)
+			return nil, err
 		}
 		patterns = append(patterns, lines...)
 	}
-	return patterns
+	return patterns, nil
 }
 
 // getLines reads a file and splits it into lines
@@ -55,3 +51,15 @@ func getLines(file string) ([]string, error) {
 	}
 	return strings.Split(string(buffer), "\n"), nil
 }
+
+// ReloadExcludes re-reads the "-exclude-from" files. On error, the old
+// patterns stay active.
+func (rn *RootNode) ReloadExcludes() error {
+	m, err := prepareExcluder(rn.args)
+	if err != nil {
+		return err
+	}
+	rn.excluder.Store(m)
+	tlog.Info.Printf("Reloaded exclusion patterns")
+	return nil
+}
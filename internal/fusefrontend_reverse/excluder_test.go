@@ -15,7 +15,10 @@ func TestShouldPrefixExcludeValuesWithSlash(t *testing.T) {
 
 	expected := []string{"/file1", "/dir1/file2.txt", "*~", "build/*.o"}
 
-	patterns := getExclusionPatterns(args)
+	patterns, err := getExclusionPatterns(args)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(patterns, expected) {
 		t.Errorf("expected %q, got %q", expected, patterns)
 	}
@@ -51,7 +54,10 @@ func TestShouldReadExcludePatternsFromFiles(t *testing.T) {
 	// It's ignored when the patterns are actually compiled
 	expected := []string{"cmdline1", "file1.1", "file1.2", "", "file2.1", "file2.2", ""}
 
-	patterns := getExclusionPatterns(args)
+	patterns, err := getExclusionPatterns(args)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !reflect.DeepEqual(patterns, expected) {
 		t.Errorf("expected %q, got %q", expected, patterns)
 	}
@@ -59,7 +65,41 @@ func TestShouldReadExcludePatternsFromFiles(t *testing.T) {
 
 func TestShouldReturnFalseIfThereAreNoExclusions(t *testing.T) {
 	var rfs RootNode
-	if rfs.isExcludedPlain("any/path") {
+	if rfs.isExcludedPlain("any/path", false) {
 		t.Error("Should not exclude any path if no exclusions were specified")
 	}
 }
+
+func TestReloadExcludes(t *testing.T) {
+	excludeFile := t.TempDir() + "/exclude"
+	if err := os.WriteFile(excludeFile, []byte("foo\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var rn RootNode
+	rn.args.ExcludeFrom = []string{excludeFile}
+	if err := rn.ReloadExcludes(); err != nil {
+		t.Fatal(err)
+	}
+	if !rn.isExcludedPlain("foo", false) || rn.isExcludedPlain("bar", false) {
+		t.Error("wrong initial state")
+	}
+	// Invalid patterns must not replace the old ones
+	if err := os.WriteFile(excludeFile, []byte("[bar\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.ReloadExcludes(); err == nil {
+		t.Error("invalid pattern was accepted")
+	}
+	if !rn.isExcludedPlain("foo", false) {
+		t.Error("old patterns were lost")
+	}
+	if err := os.WriteFile(excludeFile, []byte("bar/\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := rn.ReloadExcludes(); err != nil {
+		t.Fatal(err)
+	}
+	if rn.isExcludedPlain("foo", false) || rn.isExcludedPlain("bar", false) || !rn.isExcludedPlain("bar", true) {
+		t.Error("patterns were not reloaded")
+	}
+}
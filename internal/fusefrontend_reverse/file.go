@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"os"
+	"sync"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 type File struct {
@@ -21,12 +25,37 @@ type File struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// With -chunk-size, the file handle only covers the ciphertext range
+	// [chunkStart, chunkEnd). chunkEnd is zero when not chunking.
+	chunkStart uint64
+	chunkEnd   uint64
+	// Backing inode number, for log messages
+	ino uint64
+
+	// With -reverse-rw, writeMu serializes writes and protects the fields
+	// below. See file_write.go.
+	writeMu sync.Mutex
+	// writeHeader collects a file header that is being written
+	writeHeader *pendingBlock
+	// writeID is the file ID used to decrypt written blocks. This is the
+	// derived file ID until a new file header has been written.
+	writeID []byte
+	// pending holds incomplete ciphertext blocks by block number
+	pending map[uint64]*pendingBlock
 }
 
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fuse.ReadResult, errno syscall.Errno) {
 	length := uint64(len(buf))
-	off := uint64(ioff)
+	off := uint64(ioff) + f.chunkStart
+	if f.chunkEnd > 0 {
+		if off >= f.chunkEnd {
+			return nil, 0
+		}
+		if off+length > f.chunkEnd {
+			length = f.chunkEnd - off
+		}
+	}
 	out := bytes.NewBuffer(buf[:0])
 	var header []byte
 
@@ -34,7 +63,7 @@ func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fus
 	if off < contentenc.HeaderLen {
 		header = f.header.Pack()
 		// Truncate to requested part
-		end := int(off) + len(buf)
+		end := int(off + length)
 		if end > len(header) {
 			end = len(header)
 		}
@@ -66,16 +95,30 @@ func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fus
 
 // Release - FUSE call, close file
 func (f *File) Release(context.Context) syscall.Errno {
+	f.writeMu.Lock()
+	if len(f.pending) > 0 {
+		tlog.Warn.Printf("ino%d: Release: dropping %d incomplete blocks", f.ino, len(f.pending))
+	}
+	f.writeMu.Unlock()
 	return fs.ToErrno(f.fd.Close())
 }
 
 // Lseek - FUSE call.
 func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
-	plainOff := f.contentEnc.CipherSizeToPlainSize(off)
+	plainOff := f.contentEnc.CipherSizeToPlainSize(off + f.chunkStart)
 	newPlainOff, err := syscall.Seek(int(f.fd.Fd()), int64(plainOff), int(whence))
 	if err != nil {
 		return 0, fs.ToErrno(err)
 	}
 	newOff := f.contentEnc.PlainSizeToCipherSize(uint64(newPlainOff))
-	return newOff, 0
+	if f.chunkEnd > 0 && newOff >= f.chunkEnd {
+		if whence == unix.SEEK_DATA {
+			return 0, syscall.ENXIO
+		}
+		newOff = f.chunkEnd
+	}
+	if newOff < f.chunkStart {
+		newOff = f.chunkStart
+	}
+	return newOff - f.chunkStart, 0
 }
@@ -9,6 +9,11 @@ var _ = (fs.FileReader)((*File)(nil))
 var _ = (fs.FileReleaser)((*File)(nil))
 var _ = (fs.FileLseeker)((*File)(nil))
 
+// Only used with -reverse-rw, see file_write.go
+var _ = (fs.FileWriter)((*File)(nil))
+var _ = (fs.FileFsyncer)((*File)(nil))
+var _ = (fs.FileFlusher)((*File)(nil))
+
 /* Not needed
 var _ = (fs.FileGetattrer)((*File)(nil))
 var _ = (fs.FileGetlker)((*File)(nil))
@@ -16,10 +21,7 @@ var _ = (fs.FileSetlker)((*File)(nil))
 var _ = (fs.FileSetlkwer)((*File)(nil))
 */
 
-/* Will not implement these - reverse mode is read-only!
+/* Will not implement these, not even with -reverse-rw
 var _ = (fs.FileSetattrer)((*File)(nil))
-var _ = (fs.FileWriter)((*File)(nil))
-var _ = (fs.FileFsyncer)((*File)(nil))
-var _ = (fs.FileFlusher)((*File)(nil))
 var _ = (fs.FileAllocater)((*File)(nil))
 */
@@ -2,8 +2,10 @@ package fusefrontend_reverse
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"sync"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
@@ -12,6 +14,26 @@ import (
 
 var inodeTable sync.Map
 
+// hardlinkIVs derives the IVs of a file with more than one link from its
+// inode instead of its path, with AuthLinks. All links then have the same
+// ciphertext in every mount, and backups can store them as hard links again
+// instead of as copies. The inode number is encrypted like a file name
+// first, so that the IVs do not reveal it.
+func (rn *RootNode) hardlinkIVs(st *syscall.Stat_t) pathiv.FileIVs {
+	name := fmt.Sprintf("%d", st.Ino)
+	if uint64(st.Dev) != rn.rootDev {
+		name = fmt.Sprintf("%d.%d", st.Dev, st.Ino)
+	}
+	cName, err := rn.nameTransform.EncryptName(name, pathiv.Derive("", pathiv.PurposeDirIV))
+	if err != nil {
+		// Cannot happen, "name" is a valid file name
+		tlog.Warn.Printf("hardlinkIVs: ino%d: %v", st.Ino, err)
+	}
+	// The null byte cannot occur in paths, so this never matches the IVs
+	// of a path
+	return pathiv.DeriveFile("\000hardlink/" + cName)
+}
+
 // encryptBlocks - encrypt "plaintext" into a number of ciphertext blocks.
 // "plaintext" must already be block-aligned.
 func (rf *File) encryptBlocks(plaintext []byte, firstBlockNo uint64, fileID []byte, block0IV []byte) []byte {
@@ -0,0 +1,177 @@
+package fusefrontend_reverse
+
+import (
+	"context"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// With -reverse-rw, ciphertext written to the encrypted view is decrypted and
+// written to the plaintext file. A ciphertext block can only be decrypted as
+// a whole, so the written bytes are collected in pendingBlocks until the
+// block is complete. The last block of a file is usually shorter, it is
+// decrypted on Flush (close).
+
+// pendingBlock collects the bytes of a ciphertext block, or of the file
+// header, until all of it has been written.
+type pendingBlock struct {
+	buf     []byte
+	written []bool
+	// Number of distinct bytes written
+	n int
+}
+
+func newPendingBlock(size uint64) *pendingBlock {
+	return &pendingBlock{
+		buf:     make([]byte, size),
+		written: make([]bool, size),
+	}
+}
+
+// write copies "data" to offset "off" inside the block.
+func (p *pendingBlock) write(off uint64, data []byte) {
+	copy(p.buf[off:], data)
+	for i := off; i < off+uint64(len(data)); i++ {
+		if !p.written[i] {
+			p.written[i] = true
+			p.n++
+		}
+	}
+}
+
+// complete returns true if all bytes of the block have been written.
+func (p *pendingBlock) complete() bool {
+	return p.n == len(p.buf)
+}
+
+// prefix returns the written bytes if they are contiguous from the start of
+// the block, and nil otherwise.
+func (p *pendingBlock) prefix() []byte {
+	for i := 0; i < p.n; i++ {
+		if !p.written[i] {
+			return nil
+		}
+	}
+	return p.buf[:p.n]
+}
+
+// Write - FUSE call
+func (f *File) Write(ctx context.Context, data []byte, ioff int64) (uint32, syscall.Errno) {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if !f.writable() {
+		return 0, syscall.EBADF
+	}
+	written := uint32(len(data))
+	off := uint64(ioff)
+	// File header
+	if off < contentenc.HeaderLen {
+		n := uint64(len(data))
+		if n > contentenc.HeaderLen-off {
+			n = contentenc.HeaderLen - off
+		}
+		if f.writeHeader == nil {
+			f.writeHeader = newPendingBlock(contentenc.HeaderLen)
+		}
+		f.writeHeader.write(off, data[:n])
+		data = data[n:]
+		off += n
+		if f.writeHeader.complete() {
+			h, err := contentenc.ParseHeader(f.writeHeader.buf)
+			if err != nil {
+				tlog.Warn.Printf("ino%d: Write: %v", f.ino, err)
+				return 0, syscall.EINVAL
+			}
+			f.writeID = h.ID
+			f.writeHeader = nil
+		}
+	}
+	// Data blocks
+	cBS := f.contentEnc.CipherBS()
+	for len(data) > 0 {
+		blockNo := (off - contentenc.HeaderLen) / cBS
+		skip := (off - contentenc.HeaderLen) % cBS
+		n := uint64(len(data))
+		if n > cBS-skip {
+			n = cBS - skip
+		}
+		p := f.pending[blockNo]
+		if p == nil {
+			p = newPendingBlock(cBS)
+			f.pending[blockNo] = p
+		}
+		p.write(skip, data[:n])
+		data = data[n:]
+		off += n
+	}
+	// Blocks cannot be decrypted while a new header is being written
+	if f.writeHeader != nil {
+		return written, 0
+	}
+	for blockNo, p := range f.pending {
+		if !p.complete() {
+			continue
+		}
+		delete(f.pending, blockNo)
+		if errno := f.writeBlock(blockNo, p.buf); errno != 0 {
+			return 0, errno
+		}
+	}
+	return written, 0
+}
+
+// writeBlock decrypts ciphertext block number "blockNo" and writes it to
+// the plaintext file.
+func (f *File) writeBlock(blockNo uint64, cBlock []byte) syscall.Errno {
+	plain, err := f.contentEnc.DecryptBlock(cBlock, blockNo, f.writeID)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: block %d: written data does not decrypt: %v", f.ino, blockNo, err)
+		return syscall.EIO
+	}
+	_, err = f.fd.WriteAt(plain, int64(blockNo*f.contentEnc.PlainBS()))
+	return fs.ToErrno(err)
+}
+
+// Flush - FUSE call. Writes the short last block of the file.
+func (f *File) Flush(ctx context.Context) syscall.Errno {
+	f.writeMu.Lock()
+	defer f.writeMu.Unlock()
+
+	if len(f.pending) == 0 && f.writeHeader == nil {
+		return 0
+	}
+	var errno syscall.Errno
+	if f.writeHeader != nil {
+		tlog.Warn.Printf("ino%d: Flush: incomplete file header was written", f.ino)
+		errno = syscall.EIO
+	}
+	for blockNo, p := range f.pending {
+		delete(f.pending, blockNo)
+		b := p.prefix()
+		if b == nil || errno != 0 {
+			tlog.Warn.Printf("ino%d: Flush: block %d is incomplete, dropping it", f.ino, blockNo)
+			errno = syscall.EIO
+			continue
+		}
+		if e := f.writeBlock(blockNo, b); e != 0 {
+			errno = e
+		}
+	}
+	f.writeHeader = nil
+	return errno
+}
+
+// Fsync - FUSE call
+func (f *File) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return fs.ToErrno(syscall.Fsync(int(f.fd.Fd())))
+}
+
+// writable returns true if the File was opened for writing.
+func (f *File) writable() bool {
+	return f.pending != nil
+}
@@ -0,0 +1,32 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPendingBlock(t *testing.T) {
+	p := newPendingBlock(8)
+	p.write(4, []byte("efgh"))
+	if p.complete() || p.prefix() != nil {
+		t.Fatal("block with a gap at the start is neither complete nor a prefix")
+	}
+	p.write(0, []byte("abc"))
+	if have := p.prefix(); have != nil {
+		t.Fatalf("prefix: have %q, want nil", have)
+	}
+	// Overlapping writes are counted once
+	p.write(2, []byte("CD"))
+	if !p.complete() {
+		t.Fatalf("block should be complete, n=%d", p.n)
+	}
+	if !bytes.Equal(p.buf, []byte("abCDefgh")) {
+		t.Errorf("have %q", p.buf)
+	}
+	p = newPendingBlock(8)
+	p.write(0, []byte("ab"))
+	p.write(2, []byte("c"))
+	if have := p.prefix(); string(have) != "abc" {
+		t.Errorf("prefix: have %q, want %q", have, "abc")
+	}
+}
@@ -45,6 +45,9 @@ func (n *Node) Lookup(ctx context.Context, cName string, out *fuse.EntryOut) (ch
 	if t == typeName {
 		// gocryptfs.longname.*.name
 		return n.lookupLongnameName(ctx, cName, out)
+	} else if t == typeChunk {
+		// CNAME.chunk.N
+		return n.lookupChunk(ctx, cName, out)
 	} else if t == typeConfig {
 		// gocryptfs.conf
 		return n.lookupConf(ctx, out)
@@ -147,7 +150,37 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	}
 	defer syscall.Close(d.dirfd)
 
-	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	rn := n.rootNode()
+	f, errno := rn.newFile(d, flags)
+	if errno != 0 {
+		return
+	}
+	if flags&syscall.O_TRUNC != 0 && f.writable() {
+		if err := f.fd.Truncate(0); err != nil {
+			f.Release(ctx)
+			return nil, 0, fs.ToErrno(err)
+		}
+	}
+	if rn.args.ChunkSize > 0 {
+		// Chunk 0 is the file itself
+		f.chunkStart, f.chunkEnd = rn.chunkRange(0)
+	}
+	return f, 0, 0
+}
+
+// newFile opens the backing file described by `d` and returns a File that
+// encrypts it. `d.cPath` is used to derive the file ID and IVs. The file is
+// opened read-write if `flags` ask for it, which needs -reverse-rw.
+func (rn *RootNode) newFile(d *dirfdPlus, flags uint32) (f *File, errno syscall.Errno) {
+	newFlags := syscall.O_RDONLY
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		if !rn.args.ReverseRW {
+			return nil, syscall.EROFS
+		}
+		// Reads on an O_WRONLY file handle would fail, so ask for both
+		newFlags = syscall.O_RDWR
+	}
+	fd, err := syscallcompat.Openat(d.dirfd, d.pName, newFlags|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		errno = fs.ToErrno(err)
 		return
@@ -174,12 +207,13 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	// (even if Nlink has dropped to 1)
 	var derivedIVs pathiv.FileIVs
 	v, found := inodeTable.Load(st.Ino)
-	if found {
+	if rn.args.AuthLinks && st.Nlink > 1 {
+		derivedIVs = rn.hardlinkIVs(&st)
+	} else if found {
 		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
 		derivedIVs = v.(pathiv.FileIVs)
 	} else {
-		p := n.Path()
-		derivedIVs = pathiv.DeriveFile(p)
+		derivedIVs = pathiv.DeriveFile(d.cPath)
 		// Nlink > 1 means there is more than one path to this file.
 		// Store the derived values so we always return the same data,
 		// regardless of the path that is used to access the file.
@@ -198,11 +232,16 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		Version: contentenc.CurrentVersion,
 		ID:      derivedIVs.ID,
 	}
-	fh = &File{
+	f = &File{
 		fd:         os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)),
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
-		contentEnc: n.rootNode().contentEnc,
+		contentEnc: rn.contentEnc,
+		ino:        st.Ino,
+		writeID:    derivedIVs.ID,
+	}
+	if newFlags == syscall.O_RDWR {
+		f.pending = make(map[uint64]*pendingBlock)
 	}
 	return
 }
@@ -12,6 +12,15 @@ var _ = (fs.NodeReadlinker)((*Node)(nil))
 var _ = (fs.NodeOpener)((*Node)(nil))
 var _ = (fs.NodeStatfser)((*Node)(nil))
 
+// Only used with -reverse-rw, see node_write.go
+var _ = (fs.NodeCreater)((*Node)(nil))
+var _ = (fs.NodeMkdirer)((*Node)(nil))
+var _ = (fs.NodeRmdirer)((*Node)(nil))
+var _ = (fs.NodeUnlinker)((*Node)(nil))
+var _ = (fs.NodeSetattrer)((*Node)(nil))
+var _ = (fs.NodeSymlinker)((*Node)(nil))
+var _ = (fs.NodeRenamer)((*Node)(nil))
+
 /*
 TODO but low prio. reverse mode in gocryptfs v1 did not have xattr support
 either.
@@ -24,16 +33,9 @@ var _ = (fs.NodeListxattrer)((*Node)(nil))
 var _ = (fs.NodeOpendirer)((*Node)(nil))
 */
 
-/* Will not implement these - reverse mode is read-only!
+/* Will not implement these, not even with -reverse-rw
 var _ = (fs.NodeMknoder)((*Node)(nil))
-var _ = (fs.NodeCreater)((*Node)(nil))
-var _ = (fs.NodeMkdirer)((*Node)(nil))
-var _ = (fs.NodeRmdirer)((*Node)(nil))
-var _ = (fs.NodeUnlinker)((*Node)(nil))
-var _ = (fs.NodeSetattrer)((*Node)(nil))
 var _ = (fs.NodeLinker)((*Node)(nil))
-var _ = (fs.NodeSymlinker)((*Node)(nil))
-var _ = (fs.NodeRenamer)((*Node)(nil))
 var _ = (fs.NodeSetxattrer)((*Node)(nil))
 var _ = (fs.NodeRemovexattrer)((*Node)(nil))
 var _ = (fs.NodeCopyFileRanger)((*Node)(nil))
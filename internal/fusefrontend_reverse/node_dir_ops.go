@@ -81,6 +81,9 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 				}
 				virtualFiles = append(virtualFiles, dotNameFile)
 			}
+			if rn.args.ChunkSize > 0 && entries[i].Mode&syscall.S_IFMT == syscall.S_IFREG {
+				virtualFiles = append(virtualFiles, rn.readdirChunks(fd, entries[i].Name, cName)...)
+			}
 		}
 		entries[i].Name = cName
 	}
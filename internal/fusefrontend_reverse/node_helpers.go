@@ -31,6 +31,10 @@ func (n *Node) translateSize(dirfd int, cName string, pName string, out *fuse.At
 	if out.IsRegular() {
 		rn := n.rootNode()
 		out.Size = rn.contentEnc.PlainSizeToCipherSize(out.Size)
+		if rn.args.ChunkSize > 0 {
+			// The rest is in the chunk files
+			out.Size = rn.chunkSize(out.Size, 0)
+		}
 	} else if out.IsSymlink() {
 		cLink, _ := n.readlink(dirfd, cName, pName)
 		out.Size = uint64(len(cLink))
@@ -134,16 +138,16 @@ func (n *Node) lookupLongnameName(ctx context.Context, nameFile string, out *fus
 	if errno != 0 {
 		return
 	}
-	if rn.isExcludedPlain(filepath.Join(d.cPath, pName)) {
-		errno = syscall.EPERM
-		return
-	}
 	// Get attrs from parent file
 	st, err := syscallcompat.Fstatat2(fd, pName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
 		errno = fs.ToErrno(err)
 		return
 	}
+	if rn.isExcludedPlain(filepath.Join(d.pPath, pName), st.Mode&syscall.S_IFMT == syscall.S_IFDIR) {
+		errno = syscall.EPERM
+		return
+	}
 	var vf *VirtualMemNode
 	vf, errno = n.newVirtualMemNode([]byte(cFullname), st, inoTagNameFile)
 	if errno != 0 {
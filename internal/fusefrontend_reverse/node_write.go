@@ -0,0 +1,271 @@
+package fusefrontend_reverse
+
+import (
+	"context"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// The FUSE calls in this file are only reachable with -reverse-rw. Without
+// it, the kernel mounts the filesystem read-only and rejects writes before
+// they get to us.
+
+// prepareWrite is prepareAtSyscall for operations that modify `child`.
+// Virtual files cannot be modified, and long names cannot be created as
+// the plaintext name is only known from the ".name" file.
+func (n *Node) prepareWrite(child string, create bool) (d *dirfdPlus, errno syscall.Errno) {
+	rn := n.rootNode()
+	if !rn.args.ReverseRW {
+		return nil, syscall.EROFS
+	}
+	if rn.args.OneFileSystem && n.isOtherFilesystem {
+		return nil, syscall.EPERM
+	}
+	if n.lookupFileType(child) != typeReal {
+		return nil, syscall.EPERM
+	}
+	if create && !rn.args.PlaintextNames && nametransform.IsLongContent(child) {
+		return nil, syscall.EPERM
+	}
+	return n.prepareAtSyscall(child)
+}
+
+// callerCtx returns the caller for the *User syscalls if we should create
+// files as the accessing user, and nil otherwise.
+func (rn *RootNode) callerCtx(ctx context.Context) *fuse.Context {
+	if !rn.args.PreserveOwner {
+		return nil
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		return &fuse.Context{Caller: *caller}
+	}
+	return nil
+}
+
+// newChildAt returns a new Inode for the just-created entry `d` and fills
+// `out`.
+func (n *Node) newChildAt(ctx context.Context, d *dirfdPlus, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	st, err := syscallcompat.Fstatat2(d.dirfd, d.pName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	ch := n.newChild(ctx, st, out)
+	n.translateSize(d.dirfd, d.cName, d.pName, &out.Attr)
+	if rn := n.rootNode(); rn.args.ForceOwner != nil {
+		out.Owner = *rn.args.ForceOwner
+	}
+	return ch, 0
+}
+
+// Create - FUSE call. Creates a new file.
+func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	d, errno := n.prepareWrite(name, true)
+	if errno != 0 {
+		return
+	}
+	defer syscall.Close(d.dirfd)
+
+	rn := n.rootNode()
+	fd, err := syscallcompat.OpenatUser(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, mode, rn.callerCtx(ctx))
+	if err != nil {
+		return nil, nil, 0, fs.ToErrno(err)
+	}
+	syscall.Close(fd)
+	f, errno := rn.newFile(d, flags)
+	if errno != 0 {
+		return
+	}
+	inode, errno = n.newChildAt(ctx, d, out)
+	if errno != 0 {
+		f.Release(ctx)
+		return nil, nil, 0, errno
+	}
+	return inode, f, 0, 0
+}
+
+// Mkdir - FUSE call.
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	d, errno := n.prepareWrite(name, true)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(d.dirfd)
+
+	err := syscallcompat.MkdiratUser(d.dirfd, d.pName, mode, n.rootNode().callerCtx(ctx))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChildAt(ctx, d, out)
+}
+
+// Symlink - FUSE call. The link target is decrypted like in forward mode.
+func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	d, errno := n.prepareWrite(name, true)
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(d.dirfd)
+
+	rn := n.rootNode()
+	plainTarget := target
+	if !rn.args.PlaintextNames {
+		cBinTarget, err := rn.nameTransform.B64DecodeString(target)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+		plain, err := rn.contentEnc.DecryptBlock(cBinTarget, 0, nil)
+		if err != nil {
+			return nil, syscall.EINVAL
+		}
+		plainTarget = string(plain)
+	}
+	err := syscallcompat.SymlinkatUser(plainTarget, d.dirfd, d.pName, rn.callerCtx(ctx))
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	return n.newChildAt(ctx, d, out)
+}
+
+// Unlink - FUSE call. Unlinking a virtual gocryptfs.diriv or .name file
+// succeeds without doing anything, so "rm -r" works.
+func (n *Node) Unlink(ctx context.Context, name string) syscall.Errno {
+	if t := n.lookupFileType(name); t == typeDiriv || t == typeName {
+		return 0
+	}
+	d, errno := n.prepareWrite(name, false)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	return fs.ToErrno(unix.Unlinkat(d.dirfd, d.pName, 0))
+}
+
+// Rmdir - FUSE call.
+func (n *Node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	d, errno := n.prepareWrite(name, false)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	return fs.ToErrno(unix.Unlinkat(d.dirfd, d.pName, unix.AT_REMOVEDIR))
+}
+
+// Rename - FUSE call.
+func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	d, errno := n.prepareWrite(name, false)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+	n2 := toNode(newParent)
+	d2, errno := n2.prepareWrite(newName, true)
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d2.dirfd)
+
+	err := syscallcompat.Renameat2(d.dirfd, d.pName, d2.dirfd, d2.pName, uint(flags))
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	// The encrypted names below a directory depend on its path. Drop the
+	// cached children so they are looked up again under the new path.
+	if ch := n.GetChild(name); ch != nil && ch.IsDir() && !n.rootNode().args.DeterministicNames {
+		ch.RmAllChildren()
+	}
+	return 0
+}
+
+// Setattr - FUSE call. Called for chmod, truncate, utimens, ...
+func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	rn := n.rootNode()
+	if !rn.args.ReverseRW {
+		return syscall.EROFS
+	}
+	d, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(d.dirfd)
+
+	if mode, ok := in.GetMode(); ok {
+		if err := syscallcompat.FchmodatNofollow(d.dirfd, d.pName, mode); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	uid32, uOk := in.GetUID()
+	gid32, gOk := in.GetGID()
+	if uOk || gOk {
+		uid := -1
+		gid := -1
+		if uOk {
+			uid = int(uid32)
+		}
+		if gOk {
+			gid = int(gid32)
+		}
+		if err := syscallcompat.Fchownat(d.dirfd, d.pName, uid, gid, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap := &atime
+		mp := &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		if err := syscallcompat.UtimesNanoAtNofollow(d.dirfd, d.pName, ap, mp); err != nil {
+			return fs.ToErrno(err)
+		}
+	}
+	if sz, ok := in.GetSize(); ok {
+		if errno = n.truncate(ctx, d, f, sz); errno != 0 {
+			return errno
+		}
+	}
+	return n.Getattr(ctx, f, out)
+}
+
+// truncate sets the size of the plaintext file so that the ciphertext has
+// size `cSize`. Pending writes beyond the new end are dropped.
+func (n *Node) truncate(ctx context.Context, d *dirfdPlus, fh fs.FileHandle, cSize uint64) syscall.Errno {
+	rn := n.rootNode()
+	pSize := rn.contentEnc.CipherSizeToPlainSize(cSize)
+	if f, ok := fh.(*File); ok && f.writable() {
+		f.writeMu.Lock()
+		defer f.writeMu.Unlock()
+		for blockNo := range f.pending {
+			if blockNo*rn.contentEnc.PlainBS() >= pSize {
+				delete(f.pending, blockNo)
+			}
+		}
+		return fs.ToErrno(f.fd.Truncate(int64(pSize)))
+	}
+	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	defer syscall.Close(fd)
+	return fs.ToErrno(syscall.Ftruncate(fd, int64(pSize)))
+}
+
+// toNode casts a generic fs.InodeEmbedder into *Node. Also handles *RootNode
+// by returning rn.Node.
+func toNode(op fs.InodeEmbedder) *Node {
+	if r, ok := op.(*RootNode); ok {
+		return &r.Node
+	}
+	return op.(*Node)
+}
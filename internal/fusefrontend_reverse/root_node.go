@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 
@@ -16,12 +17,11 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/gitignore"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
-
-	ignore "github.com/sabhiram/go-gitignore"
 )
 
 // RootNode is the root directory in a `gocryptfs -reverse` mount
@@ -34,7 +34,8 @@ type RootNode struct {
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
 	// Tests whether a path is excluded (hidden) from the user. Used by -exclude.
-	excluder ignore.IgnoreParser
+	// Replaced by ReloadExcludes.
+	excluder atomic.Pointer[gitignore.Matcher]
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
@@ -53,6 +54,8 @@ type RootNode struct {
 	gen atomic.Uint64
 	// rootIno is the inode number that we report for the root node on mount
 	rootIno uint64
+	// chunkInos maps chunks to inode numbers for -chunk-size, see chunkIno
+	chunkInos sync.Map
 }
 
 // NewRootNode returns an encrypted FUSE overlay filesystem.
@@ -89,7 +92,12 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransf
 		rn.rootIno = st.Ino
 	}
 	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
-		rn.excluder = prepareExcluder(args)
+		m, err := prepareExcluder(args)
+		if err != nil {
+			tlog.Fatal.Printf("Error reading exclusion patterns: %v", err)
+			os.Exit(exitcodes.ExcludeError)
+		}
+		rn.excluder.Store(m)
 	}
 	return rn
 }
@@ -133,20 +141,33 @@ func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (p
 }
 
 // isExcludedPlain finds out if the plaintext path "pPath" is
-// excluded (used when -exclude is passed by the user).
-func (rn *RootNode) isExcludedPlain(pPath string) bool {
+// excluded (used when -exclude is passed by the user). "isDir" tells if
+// pPath is a directory.
+func (rn *RootNode) isExcludedPlain(pPath string, isDir bool) bool {
 	// root dir can't be excluded
 	if pPath == "" {
 		return false
 	}
-	return rn.excluder != nil && rn.excluder.MatchesPath(pPath)
+	m := rn.excluder.Load()
+	return m != nil && m.Match(pPath, isDir)
+}
+
+// isDirForExclude finds out if "name" in "dirfd" is a directory. We only
+// stat if there are directory-only exclusion patterns.
+func (rn *RootNode) isDirForExclude(dirfd int, name string) bool {
+	m := rn.excluder.Load()
+	if m == nil || !m.HasDirOnly() {
+		return false
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, name, unix.AT_SYMLINK_NOFOLLOW)
+	return err == nil && st.Mode&syscall.S_IFMT == syscall.S_IFDIR
 }
 
 // excludeDirEntries filters out directory entries that are "-exclude"d.
 // pDir is the relative plaintext path to the directory these entries are
 // from. The entries should be plaintext files.
 func (rn *RootNode) excludeDirEntries(d *dirfdPlus, entries []fuse.DirEntry) (filtered []fuse.DirEntry) {
-	if rn.excluder == nil {
+	if rn.excluder.Load() == nil {
 		return entries
 	}
 	filtered = make([]fuse.DirEntry, 0, len(entries))
@@ -154,7 +175,7 @@ func (rn *RootNode) excludeDirEntries(d *dirfdPlus, entries []fuse.DirEntry) (fi
 		// filepath.Join handles the case of pDir="" correctly:
 		// Join("", "foo") -> "foo". This does not: pDir + "/" + name"
 		p := filepath.Join(d.pPath, entry.Name)
-		if rn.isExcludedPlain(p) {
+		if rn.isExcludedPlain(p, entry.Mode&syscall.S_IFMT == syscall.S_IFDIR) {
 			// Skip file
 			continue
 		}
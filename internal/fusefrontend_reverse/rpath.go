@@ -109,15 +109,17 @@ func (rn *RootNode) openBackingDir(cPath string) (dirfd int, pPath string, err e
 	if err != nil {
 		return
 	}
-	if rn.isExcludedPlain(pPath) {
-		err = syscall.EPERM
-		return
-	}
 	// Open directory, safe against symlink races
 	pDir := filepath.Dir(pPath)
 	dirfd, err = syscallcompat.OpenDirNofollow(rn.args.Cipherdir, pDir)
 	if err != nil {
 		return
 	}
+	if rn.isExcludedPlain(pPath, rn.isDirForExclude(dirfd, filepath.Base(pPath))) {
+		syscall.Close(dirfd)
+		dirfd = -1
+		err = syscall.EPERM
+		return
+	}
 	return dirfd, pPath, nil
 }
@@ -35,6 +35,8 @@ const (
 	typeName
 	// The config file gocryptfs.conf
 	typeConfig
+	// A CNAME.chunk.N file created by -chunk-size
+	typeChunk
 )
 
 // lookupFileType returns the type of child file name
@@ -43,6 +45,14 @@ func (n *Node) lookupFileType(cName string) fileType {
 	rn := n.rootNode()
 	// In -plaintextname mode, neither diriv nor longname files exist.
 	if !rn.args.PlaintextNames {
+		// Is it a CNAME.chunk.N file? This must come before the longname
+		// check as the chunks of a long file name look like this:
+		// gocryptfs.longname.HASH.chunk.N
+		if rn.args.ChunkSize > 0 {
+			if _, _, ok := ParseChunkName(cName); ok {
+				return typeChunk
+			}
+		}
 		if !rn.args.DeterministicNames {
 			// Is it a gocryptfs.diriv file?
 			if cName == nametransform.DirIVFilename {
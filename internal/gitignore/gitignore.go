@@ -0,0 +1,221 @@
+// Package gitignore matches relative paths against patterns in
+// gitignore(5) syntax. It is used for the "-exclude-wildcard" and
+// "-exclude-from" options in reverse mode.
+package gitignore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type pattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Matcher is a compiled list of patterns. It is safe for concurrent use.
+type Matcher struct {
+	patterns []pattern
+	dirOnly  bool
+}
+
+// Compile parses gitignore lines. Blank lines and comments are skipped.
+func Compile(lines []string) (*Matcher, error) {
+	m := &Matcher{}
+	for i, line := range lines {
+		p, ok, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("pattern %d %q: %v", i+1, line, err)
+		}
+		if !ok {
+			continue
+		}
+		m.patterns = append(m.patterns, p)
+		m.dirOnly = m.dirOnly || p.dirOnly
+	}
+	return m, nil
+}
+
+// HasDirOnly returns true if there are patterns that only match directories,
+// meaning that the result of Match depends on the isDir argument.
+func (m *Matcher) HasDirOnly() bool {
+	return m.dirOnly
+}
+
+// Match returns true if the slash-separated relative path "p" is excluded.
+// "isDir" tells if "p" is a directory. The last matching pattern wins.
+//
+// A pattern that matches a directory also matches everything below it, so
+// "!/dir1" after "*" makes the contents of dir1 visible again.
+func (m *Matcher) Match(p string, isDir bool) bool {
+	for i := len(m.patterns) - 1; i >= 0; i-- {
+		pat := &m.patterns[i]
+		if pat.matches(p, isDir) {
+			return !pat.negate
+		}
+	}
+	return false
+}
+
+// matches checks "p" and its parent directories against the pattern.
+func (pat *pattern) matches(p string, isDir bool) bool {
+	if (isDir || !pat.dirOnly) && pat.re.MatchString(p) {
+		return true
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && pat.re.MatchString(p[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLine parses a single line. ok is false for blank lines and comments.
+func parseLine(line string) (p pattern, ok bool, err error) {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimTrailingSpaces(line)
+	if line == "" || line[0] == '#' {
+		return p, false, nil
+	}
+	if line[0] == '!' {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return p, false, fmt.Errorf("empty pattern")
+	}
+	// A slash at the beginning or in the middle anchors the pattern to the
+	// root directory
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	var re strings.Builder
+	re.WriteString("^")
+	if strings.HasPrefix(line, "**/") {
+		anchored = true
+	} else if !anchored {
+		re.WriteString("(?:.*/)?")
+	}
+	if err = globToRegexp(&re, line); err != nil {
+		return p, false, err
+	}
+	re.WriteString("$")
+	p.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return p, false, err
+	}
+	return p, true, nil
+}
+
+// trimTrailingSpaces removes trailing spaces that are not escaped with a
+// backslash.
+func trimTrailingSpaces(line string) string {
+	for strings.HasSuffix(line, " ") {
+		rest := line[:len(line)-1]
+		// Count backslashes in front of the space
+		n := 0
+		for n < len(rest) && rest[len(rest)-1-n] == '\\' {
+			n++
+		}
+		if n%2 == 1 {
+			break
+		}
+		line = rest
+	}
+	return line
+}
+
+// globToRegexp converts a glob with "**" support to a regular expression.
+// Wildcards never match a slash.
+func globToRegexp(re *strings.Builder, glob string) error {
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**") {
+				atStart := i == 0 || glob[i-1] == '/'
+				rest := glob[i+2:]
+				if atStart && rest == "" {
+					// "abc/**" matches everything inside
+					re.WriteString(".*")
+					i++
+					continue
+				}
+				if atStart && rest[0] == '/' {
+					// "**/" matches zero or more directories
+					re.WriteString("(?:.*/)?")
+					i += 2
+					continue
+				}
+			}
+			// Other consecutive asterisks are regular asterisks
+			for i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+			}
+			re.WriteString("[^/]*")
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			n, err := bracketToRegexp(re, glob[i:])
+			if err != nil {
+				return err
+			}
+			i += n - 1
+		case '\\':
+			if i+1 == len(glob) {
+				return fmt.Errorf("trailing backslash")
+			}
+			i++
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return nil
+}
+
+// bracketToRegexp converts the bracket expression at the start of "glob" and
+// returns its length.
+func bracketToRegexp(re *strings.Builder, glob string) (int, error) {
+	var class strings.Builder
+	i := 1
+	if i < len(glob) && (glob[i] == '!' || glob[i] == '^') {
+		// Negated classes must not match a slash either
+		class.WriteString("^/")
+		i++
+	}
+	// A "]" right at the start is a literal
+	start := i
+	for ; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == ']' && i > start:
+			re.WriteString("[" + class.String() + "]")
+			return i + 1, nil
+		case c == '[' && strings.HasPrefix(glob[i:], "[:"):
+			// Character classes like [:alpha:] are passed through
+			end := strings.Index(glob[i:], ":]")
+			if end < 0 {
+				return 0, fmt.Errorf("unterminated character class")
+			}
+			class.WriteString(glob[i : i+end+2])
+			i += end + 1
+		case c == '-' && i > start && i+1 < len(glob) && glob[i+1] != ']':
+			// Range
+			class.WriteByte('-')
+		case c == '-':
+			class.WriteString(`\-`)
+		case c == '\\' && i+1 < len(glob):
+			i++
+			class.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			class.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return 0, fmt.Errorf("unterminated bracket expression")
+}
@@ -0,0 +1,90 @@
+package gitignore
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	testCases := []struct {
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		// Unanchored patterns match at any level
+		{[]string{"foo"}, "foo", false, true},
+		{[]string{"foo"}, "a/b/foo", false, true},
+		{[]string{"foo"}, "foobar", false, false},
+		// Everything below a matching directory matches
+		{[]string{"foo"}, "foo/bar", false, true},
+		// A slash anchors the pattern
+		{[]string{"/foo"}, "a/foo", false, false},
+		{[]string{"a/foo"}, "a/foo", false, true},
+		{[]string{"a/foo"}, "x/a/foo", false, false},
+		// Wildcards do not match slashes
+		{[]string{"*.txt"}, "a/b.txt", false, true},
+		{[]string{"a/*.txt"}, "a/b/c.txt", false, false},
+		{[]string{"a?c"}, "abc", false, true},
+		{[]string{"a?c"}, "a/c", false, false},
+		// Directory-only patterns
+		{[]string{"foo/"}, "foo", false, false},
+		{[]string{"foo/"}, "foo", true, true},
+		{[]string{"foo/"}, "foo/bar", false, true},
+		// Double asterisks
+		{[]string{"**/foo"}, "a/b/foo", false, true},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"a/**"}, "a", true, false},
+		{[]string{"a/**"}, "a/x/y", false, true},
+		{[]string{"a**b"}, "axyb", false, true},
+		{[]string{"a**b"}, "ax/yb", false, false},
+		// Negation, the last match wins
+		{[]string{"*.txt", "!keep.txt"}, "keep.txt", false, false},
+		{[]string{"!keep.txt", "*.txt"}, "keep.txt", false, true},
+		{[]string{"*", "!/dir1"}, "dir1/file1", false, false},
+		{[]string{"*", "!/dir1"}, "dir2/file1", false, true},
+		// Comments, escapes and trailing spaces
+		{[]string{"#foo"}, "#foo", false, false},
+		{[]string{`\#foo`}, "#foo", false, true},
+		{[]string{`\!foo`}, "!foo", false, true},
+		{[]string{"foo  "}, "foo", false, true},
+		{[]string{`foo\ `}, "foo ", false, true},
+		{[]string{"foo\r"}, "foo", false, true},
+		// Bracket expressions
+		{[]string{"[abc].txt"}, "b.txt", false, true},
+		{[]string{"[!abc].txt"}, "b.txt", false, false},
+		{[]string{"[!abc].txt"}, "d.txt", false, true},
+		{[]string{"[a-c]"}, "b", false, true},
+		{[]string{"[]]"}, "]", false, true},
+		{[]string{"[[:digit:]]x"}, "1x", false, true},
+		{[]string{"a[!b]c"}, "a/c", false, false},
+		// Regexp metacharacters are literals
+		{[]string{"a.c"}, "abc", false, false},
+		{[]string{"a+(c)"}, "a+(c)", false, true},
+	}
+	for i, tc := range testCases {
+		m, err := Compile(tc.patterns)
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if have := m.Match(tc.path, tc.isDir); have != tc.want {
+			t.Errorf("case %d: %q, %q, isDir=%v: have %v, want %v", i, tc.patterns, tc.path, tc.isDir, have, tc.want)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, p := range []string{"[abc", `foo\`, "/", "!"} {
+		if _, err := Compile([]string{p}); err == nil {
+			t.Errorf("%q should be rejected", p)
+		}
+	}
+	m, err := Compile([]string{"", "# comment", "foo/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.HasDirOnly() {
+		t.Error("HasDirOnly should be true")
+	}
+}
@@ -12,9 +12,16 @@
 // If namespace ids are exhausted, or the original id is larger than 48 bits,
 // the whole (Dev, Tag, Ino) tuple gets mapped in the spill map, and the
 // spill bit is set to 1.
+//
+// The namespace ids depend on the order in which devices are seen, so inode
+// numbers of files outside of rootDev can change from mount to mount.
+// TranslateHandle instead derives the inode number from a file handle:
+//
+//	[spill bit = 0][63 bit hash of the file handle] = 64 bit stable inode number
 package inomap
 
 import (
+	"hash/fnv"
 	"log"
 	"math"
 	"sync"
@@ -46,6 +53,9 @@ type InoMap struct {
 	spillMap map[QIno]uint64
 	// spillNext is the next free inode number in the spill map
 	spillNext atomic.Uint64
+	// handles maps the inode numbers returned by TranslateHandle to
+	// their file handles, to detect hash collisions
+	handles map[uint64]string
 }
 
 // New returns a new InoMap.
@@ -129,3 +139,29 @@ func (m *InoMap) TranslateStat(st *syscall.Stat_t) {
 	in := QInoFromStat(st)
 	st.Ino = m.Translate(in)
 }
+
+// TranslateHandle maps the backing file with file handle "handle" (see
+// syscallcompat.FileHandle) to an inode number that is the same every time
+// the file is seen, also across mounts. "in" is the (device, tag, inode)
+// tuple of the file. If another file handle already has the same number,
+// or "handle" is empty, the file gets a spill inode number instead.
+func (m *InoMap) TranslateHandle(handle []byte, in QIno) (out uint64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if len(handle) == 0 {
+		return m.spill(in)
+	}
+	h := fnv.New64a()
+	h.Write(handle)
+	out = h.Sum64() &^ spillSpaceStart
+	if m.handles == nil {
+		m.handles = make(map[uint64]string)
+	}
+	if prev, found := m.handles[out]; found && prev != string(handle) {
+		tlog.Warn.Printf("InoMap: file handle hash collision on inode number %#x", out)
+		return m.spill(in)
+	}
+	m.handles[out] = string(handle)
+	return out
+}
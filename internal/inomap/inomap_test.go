@@ -166,3 +166,27 @@ func BenchmarkTranslateManyDevs(b *testing.B) {
 		m.Translate(q)
 	}
 }
+
+func TestTranslateHandle(t *testing.T) {
+	handle := []byte("fsid-and-handle")
+	q := QIno{Ino: 5}
+	out := New(0).TranslateHandle(handle, q)
+	if out&spillBit != 0 {
+		t.Errorf("spill bit set: %#x", out)
+	}
+	// The same handle must give the same number in another InoMap, as it
+	// would after a remount, no matter what the backing inode number is
+	m := New(0)
+	m.Translate(QIno{Ino: 1})
+	if out2 := m.TranslateHandle(handle, QIno{Ino: 6}); out2 != out {
+		t.Errorf("unstable mapping: %#x %#x", out2, out)
+	}
+	// A colliding handle gets a spill inode number
+	m.handles[out] = "other"
+	if out3 := m.TranslateHandle(handle, q); out3&spillBit == 0 {
+		t.Errorf("collision did not spill: %#x", out3)
+	}
+	if out4 := m.TranslateHandle(nil, q); out4&spillBit == 0 {
+		t.Errorf("empty handle did not spill: %#x", out4)
+	}
+}
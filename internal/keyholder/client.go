@@ -0,0 +1,329 @@
+package keyholder
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// ErrAuth is returned by Open when the key-holder reports an
+// authentication failure.
+var ErrAuth = errors.New("keyholder: message authentication failed")
+
+// Client is the FUSE server side of the connection to the key-holder.
+// It is safe for concurrent use. Requests are tagged with an id, so many of
+// them can be in flight at the same time.
+type Client struct {
+	conn io.ReadWriteCloser
+	// cmd is the key-holder process, nil in tests
+	cmd *exec.Cmd
+
+	writeLock sync.Mutex
+
+	pendingLock sync.Mutex
+	pending     map[uint64]chan *msg
+	nextID      uint64
+	// readErr is set when the connection breaks. No more requests are
+	// accepted afterwards.
+	readErr error
+
+	closeOnce sync.Once
+
+	// Reported by the key-holder in the reply to opInit
+	nonceSize int
+	overhead  int
+}
+
+// Params describes the ciphers the key-holder should set up.
+type Params struct {
+	AEADType cryptocore.AEADTypeEnum
+	IVBitLen int
+	UseHKDF  bool
+	// FilenameAuth enables filename MACs, see FilenameAuth()
+	FilenameAuth bool
+}
+
+// Start starts the key-holder process, hands "masterkey" to it and returns
+// a Client connected to it. "extraArgs" are appended to the command line of
+// the key-holder.
+// The caller should wipe "masterkey" afterwards.
+func Start(masterkey []byte, p Params, extraArgs []string) (*Client, error) {
+	ours, theirs, err := socketpair()
+	if err != nil {
+		return nil, err
+	}
+	defer theirs.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		ours.Close()
+		return nil, err
+	}
+	args := []string{"-keyholder"}
+	if tlog.Debug.Enabled {
+		args = append(args, "-d")
+	}
+	args = append(args, extraArgs...)
+	cmd := exec.Command(exe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Will be fd 3 in the child
+	cmd.ExtraFiles = []*os.File{theirs}
+	if err = cmd.Start(); err != nil {
+		ours.Close()
+		return nil, err
+	}
+	c := newClient(ours)
+	c.cmd = cmd
+	if err = c.init(masterkey, p); err != nil {
+		c.Close()
+		return nil, err
+	}
+	tlog.Debug.Printf("keyholder: started pid %d", cmd.Process.Pid)
+	return c, nil
+}
+
+// socketpair returns a connected pair of sockets. Both are set to
+// non-blocking mode so that they use the Go runtime poller, which lets
+// Close() interrupt a pending Read().
+func socketpair() (ours *os.File, theirs *os.File, err error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	syscall.CloseOnExec(fds[0])
+	for _, fd := range fds {
+		if err = syscall.SetNonblock(fd, true); err != nil {
+			syscall.Close(fds[0])
+			syscall.Close(fds[1])
+			return nil, nil, err
+		}
+	}
+	return os.NewFile(uintptr(fds[0]), "keyholder"), os.NewFile(uintptr(fds[1]), "keyholder"), nil
+}
+
+func newClient(conn io.ReadWriteCloser) *Client {
+	c := &Client{
+		conn:    conn,
+		pending: make(map[uint64]chan *msg),
+	}
+	go c.readLoop()
+	return c
+}
+
+// init sends the key to the key-holder and waits until it is ready.
+func (c *Client) init(masterkey []byte, p Params) error {
+	r, err := c.request(opInit,
+		masterkey,
+		[]byte(p.AEADType.String()),
+		binary.BigEndian.AppendUint32(nil, uint32(p.IVBitLen)),
+		[]byte{boolToByte(p.UseHKDF)},
+		[]byte{boolToByte(p.FilenameAuth)},
+	)
+	if err != nil {
+		return err
+	}
+	if r.code != statusOK || len(r.fields) != 2 || len(r.fields[0]) != 4 || len(r.fields[1]) != 4 {
+		return fmt.Errorf("keyholder: init failed with status %d", r.code)
+	}
+	c.nonceSize = int(binary.BigEndian.Uint32(r.fields[0]))
+	c.overhead = int(binary.BigEndian.Uint32(r.fields[1]))
+	return nil
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// readLoop dispatches replies to the goroutines waiting for them.
+func (c *Client) readLoop() {
+	for {
+		m, err := readMsg(c.conn)
+		if err != nil {
+			c.pendingLock.Lock()
+			c.readErr = err
+			for id, ch := range c.pending {
+				close(ch)
+				delete(c.pending, id)
+			}
+			c.pendingLock.Unlock()
+			return
+		}
+		c.pendingLock.Lock()
+		ch := c.pending[m.id]
+		delete(c.pending, m.id)
+		c.pendingLock.Unlock()
+		if ch == nil {
+			tlog.Warn.Printf("keyholder: reply with unknown id %d", m.id)
+			continue
+		}
+		ch <- m
+	}
+}
+
+// request sends a request and waits for the reply.
+func (c *Client) request(op uint8, fields ...[]byte) (*msg, error) {
+	ch := make(chan *msg, 1)
+	c.pendingLock.Lock()
+	if c.readErr != nil {
+		err := c.readErr
+		c.pendingLock.Unlock()
+		return nil, fmt.Errorf("keyholder: connection lost: %w", err)
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = ch
+	c.pendingLock.Unlock()
+
+	c.writeLock.Lock()
+	err := writeMsg(c.conn, &msg{id: id, code: op, fields: fields})
+	c.writeLock.Unlock()
+	if err != nil {
+		c.pendingLock.Lock()
+		delete(c.pending, id)
+		c.pendingLock.Unlock()
+		return nil, err
+	}
+	r, ok := <-ch
+	if !ok {
+		return nil, fmt.Errorf("keyholder: connection lost: %w", c.readErr)
+	}
+	if op != opInit && r.code == statusOK && len(r.fields) != 1 {
+		return nil, errBadMsg
+	}
+	return r, nil
+}
+
+// CryptoCore returns a CryptoCore whose ciphers forward all operations to
+// the key-holder.
+func (c *Client) CryptoCore(aeadType cryptocore.AEADTypeEnum) *cryptocore.CryptoCore {
+	aead := &aeadProxy{
+		c:         c,
+		nonceSize: c.nonceSize,
+		overhead:  c.overhead,
+	}
+	return cryptocore.NewWithCiphers(&emeProxy{c}, aead, aeadType)
+}
+
+// FilenameAuth returns a FilenameAuth whose MACs are computed by the
+// key-holder. Params.FilenameAuth must have been set. "embedded" selects the
+// name format, see filenameauth.NewEmbedded.
+func (c *Client) FilenameAuth(embedded bool) *filenameauth.FilenameAuth {
+	return filenameauth.NewWithMACFunc(func(data []byte) []byte {
+		r, err := c.request(opFilenameMAC, data)
+		if err != nil {
+			log.Panic(err)
+		}
+		if r.code != statusOK {
+			log.Panicf("keyholder: filename MAC failed with status %d", r.code)
+		}
+		return r.fields[0]
+	}, embedded)
+}
+
+// Close closes the connection, which makes the key-holder wipe the keys and
+// exit, and waits for the process to exit.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		if c.cmd != nil {
+			err := c.cmd.Wait()
+			if err != nil {
+				tlog.Warn.Printf("keyholder: %v", err)
+			}
+		}
+	})
+}
+
+// aeadProxy implements cipher.AEAD by forwarding Seal and Open to the
+// key-holder.
+type aeadProxy struct {
+	c         *Client
+	nonceSize int
+	overhead  int
+}
+
+var _ cipher.AEAD = &aeadProxy{}
+
+func (a *aeadProxy) NonceSize() int {
+	return a.nonceSize
+}
+
+func (a *aeadProxy) Overhead() int {
+	return a.overhead
+}
+
+// Seal panics if the key-holder cannot be reached, as we cannot return an
+// error.
+func (a *aeadProxy) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	r, err := a.c.request(opSeal, nonce, plaintext, additionalData)
+	if err != nil {
+		log.Panic(err)
+	}
+	if r.code != statusOK {
+		log.Panicf("keyholder: Seal failed with status %d", r.code)
+	}
+	return append(dst, r.fields[0]...)
+}
+
+func (a *aeadProxy) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	r, err := a.c.request(opOpen, nonce, ciphertext, additionalData)
+	if err != nil {
+		tlog.Warn.Printf("keyholder: Open: %v", err)
+		return nil, err
+	}
+	switch r.code {
+	case statusOK:
+		return append(dst, r.fields[0]...), nil
+	case statusAuthFailed:
+		return nil, ErrAuth
+	default:
+		return nil, fmt.Errorf("keyholder: Open failed with status %d", r.code)
+	}
+}
+
+// Wipe closes the connection to the key-holder. It is called by
+// CryptoCore.Wipe for the OpenSSL and AES-SIV backends.
+func (a *aeadProxy) Wipe() {
+	a.c.Close()
+}
+
+// emeProxy implements cryptocore.EME by forwarding to the key-holder.
+type emeProxy struct {
+	c *Client
+}
+
+// Encrypt panics on errors, just like eme.EMECipher.
+func (e *emeProxy) Encrypt(tweak []byte, inputData []byte) []byte {
+	return e.transform(opEMEEncrypt, tweak, inputData)
+}
+
+// Decrypt panics on errors, just like eme.EMECipher.
+func (e *emeProxy) Decrypt(tweak []byte, inputData []byte) []byte {
+	return e.transform(opEMEDecrypt, tweak, inputData)
+}
+
+func (e *emeProxy) transform(op uint8, tweak []byte, inputData []byte) []byte {
+	r, err := e.c.request(op, tweak, inputData)
+	if err != nil {
+		log.Panic(err)
+	}
+	if r.code != statusOK {
+		log.Panicf("keyholder: EME op %d failed with status %d", op, r.code)
+	}
+	return r.fields[0]
+}
@@ -0,0 +1,144 @@
+package keyholder
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+)
+
+// startInProcess runs Serve in a goroutine instead of a separate process.
+func startInProcess(t *testing.T, key []byte, aeadType cryptocore.AEADTypeEnum, IVBitLen int) (*Client, chan error) {
+	clientConn, serverConn, err := socketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(serverConn)
+		serverConn.Close()
+	}()
+	c := newClient(clientConn)
+	// Serve wipes the key, pass a copy
+	if err = c.init(append([]byte{}, key...), Params{aeadType, IVBitLen, true, true}); err != nil {
+		t.Fatal(err)
+	}
+	return c, done
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	for _, b := range []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendAESSIV} {
+		t.Run(b.String(), func(t *testing.T) {
+			local := cryptocore.New(append([]byte{}, key...), b, 128, true)
+			c, done := startInProcess(t, key, b, 128)
+			remote := c.CryptoCore(b)
+			if remote.IVLen != local.IVLen {
+				t.Fatalf("IVLen: want %d, have %d", local.IVLen, remote.IVLen)
+			}
+			if remote.AEADCipher.Overhead() != local.AEADCipher.Overhead() {
+				t.Errorf("Overhead mismatch")
+			}
+
+			nonce := remote.IVGenerator.Get()
+			plaintext := bytes.Repeat([]byte("x"), 4096)
+			ad := []byte("additional data")
+			prefix := []byte("prefix")
+			ciphertext := remote.AEADCipher.Seal(append([]byte{}, prefix...), nonce, plaintext, ad)
+			if !bytes.HasPrefix(ciphertext, prefix) {
+				t.Fatal("Seal did not append to dst")
+			}
+			ciphertext = ciphertext[len(prefix):]
+			p2, err := local.AEADCipher.Open(nil, nonce, ciphertext, ad)
+			if err != nil || !bytes.Equal(p2, plaintext) {
+				t.Fatalf("local Open of remote ciphertext failed: %v", err)
+			}
+			p3, err := remote.AEADCipher.Open(nil, nonce, ciphertext, ad)
+			if err != nil || !bytes.Equal(p3, plaintext) {
+				t.Fatalf("remote Open failed: %v", err)
+			}
+			ciphertext[0] ^= 1
+			_, err = remote.AEADCipher.Open(nil, nonce, ciphertext, ad)
+			if err != ErrAuth {
+				t.Errorf("tampered ciphertext: want ErrAuth, got %v", err)
+			}
+
+			tweak := make([]byte, 16)
+			name := bytes.Repeat([]byte("n"), 32)
+			encName := remote.EMECipher.Encrypt(tweak, name)
+			if !bytes.Equal(encName, local.EMECipher.Encrypt(tweak, name)) {
+				t.Error("EME Encrypt mismatch")
+			}
+			if !bytes.Equal(remote.EMECipher.Decrypt(tweak, encName), name) {
+				t.Error("EME Decrypt mismatch")
+			}
+
+			localFA := filenameauth.New(key, true)
+			remoteFA := c.FilenameAuth(false)
+			authName, err := remoteFA.AuthenticateFilename("encname")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = localFA.VerifyFilename(authName); err != nil {
+				t.Errorf("filename MAC mismatch: %v", err)
+			}
+			tag := c.FilenameAuth(true).Tag(tweak, name)
+			if err = filenameauth.NewEmbedded(key).VerifyTag(tweak, name, tag); err != nil {
+				t.Errorf("filename tag mismatch: %v", err)
+			}
+
+			remote.Wipe()
+			c.Close()
+			if err = <-done; err != nil {
+				t.Errorf("Serve returned %v", err)
+			}
+		})
+	}
+}
+
+// TestConcurrent checks that replies are delivered to the right caller when
+// many requests are in flight.
+func TestConcurrent(t *testing.T) {
+	key := cryptocore.RandBytes(cryptocore.KeyLen)
+	c, done := startInProcess(t, key, cryptocore.BackendGoGCM, 128)
+	remote := c.CryptoCore(cryptocore.BackendGoGCM)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				nonce := remote.IVGenerator.Get()
+				plaintext := bytes.Repeat([]byte{byte(i)}, 100+j)
+				ciphertext := remote.AEADCipher.Seal(nil, nonce, plaintext, nil)
+				p2, err := remote.AEADCipher.Open(nil, nonce, ciphertext, nil)
+				if err != nil || !bytes.Equal(p2, plaintext) {
+					t.Errorf("goroutine %d: round trip %d failed: %v", i, j, err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Serve returned %v", err)
+	}
+}
+
+// TestServerExit checks that requests fail instead of hanging when the
+// key-holder is gone.
+func TestServerExit(t *testing.T) {
+	clientConn, serverConn, err := socketpair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newClient(clientConn)
+	serverConn.Close()
+	err = c.init(make([]byte, cryptocore.KeyLen), Params{AEADType: cryptocore.BackendGoGCM, IVBitLen: 128})
+	if err == nil {
+		t.Fatal("init should have failed")
+	}
+}
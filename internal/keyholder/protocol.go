@@ -0,0 +1,119 @@
+// Package keyholder implements privilege separation ("-privsep"): the
+// encryption keys live in a small key-holder process that only performs
+// AEAD and EME operations. The FUSE server talks to it over a socketpair
+// and never has the keys mapped.
+package keyholder
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Request operations
+const (
+	opInit uint8 = iota + 1
+	opSeal
+	opOpen
+	opEMEEncrypt
+	opEMEDecrypt
+	opFilenameMAC
+)
+
+// Reply status codes
+const (
+	statusOK uint8 = iota
+	// statusAuthFailed means that AEAD Open failed
+	statusAuthFailed
+	// statusError means that the request was malformed
+	statusError
+)
+
+// maxMsgLen limits the size of a single message. The largest payloads are
+// encrypted xattr values (at most 64 kiB on Linux).
+const maxMsgLen = 256 * 1024
+
+// msgHeaderLen is the length of "id" plus "code"
+const msgHeaderLen = 8 + 1
+
+var (
+	errMsgTooLong = errors.New("keyholder: message too long")
+	errBadMsg     = errors.New("keyholder: malformed message")
+)
+
+// msg is a request or a reply. On the wire, it looks like this, all
+// integers big endian:
+//
+//	uint32 length of the rest of the message
+//	uint64 id
+//	uint8  code (op for requests, status for replies)
+//	for each field: uint32 length, data
+type msg struct {
+	// id is chosen by the client and copied into the reply
+	id     uint64
+	code   uint8
+	fields [][]byte
+}
+
+// writeMsg serializes "m" and writes it to "w" using a single Write call.
+// The caller must make sure that writes are not interleaved.
+func writeMsg(w io.Writer, m *msg) error {
+	n := msgHeaderLen
+	for _, f := range m.fields {
+		n += 4 + len(f)
+	}
+	if n > maxMsgLen {
+		return errMsgTooLong
+	}
+	buf := make([]byte, 4, 4+n)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	buf = binary.BigEndian.AppendUint64(buf, m.id)
+	buf = append(buf, m.code)
+	for _, f := range m.fields {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(f)))
+		buf = append(buf, f...)
+	}
+	_, err := w.Write(buf)
+	// The buffer may contain key material (opInit) or plaintext
+	for i := range buf {
+		buf[i] = 0
+	}
+	return err
+}
+
+// readMsg reads one message from "r".
+func readMsg(r io.Reader) (*msg, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n < msgHeaderLen || n > maxMsgLen {
+		return nil, errBadMsg
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	m := &msg{
+		id:   binary.BigEndian.Uint64(buf),
+		code: buf[8],
+	}
+	buf = buf[msgHeaderLen:]
+	for len(buf) > 0 {
+		if len(buf) < 4 {
+			return nil, errBadMsg
+		}
+		l := binary.BigEndian.Uint32(buf)
+		buf = buf[4:]
+		if uint32(len(buf)) < l {
+			return nil, errBadMsg
+		}
+		m.fields = append(m.fields, buf[:l:l])
+		buf = buf[l:]
+	}
+	return m, nil
+}
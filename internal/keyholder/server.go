@@ -0,0 +1,173 @@
+package keyholder
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// backends lists the AEAD backends the key-holder can be asked to use,
+// indexed by their String() value.
+var backends = map[string]cryptocore.AEADTypeEnum{}
+
+func init() {
+	for _, b := range []cryptocore.AEADTypeEnum{
+		cryptocore.BackendOpenSSL,
+		cryptocore.BackendGoGCM,
+		cryptocore.BackendOptimized,
+		cryptocore.BackendAESSIV,
+		cryptocore.BackendXChaCha20Poly1305,
+		cryptocore.BackendXChaCha20Poly1305OpenSSL,
+	} {
+		backends[b.String()] = b
+	}
+}
+
+type server struct {
+	cCore *cryptocore.CryptoCore
+	// fa is nil if filename authentication is disabled
+	fa   *filenameauth.FilenameAuth
+	conn io.ReadWriter
+	// writeLock serializes replies, which are sent from many goroutines
+	writeLock sync.Mutex
+}
+
+// Serve reads the init message from "conn", sets up the ciphers and then
+// answers requests until "conn" is closed by the other side.
+// The keys are wiped before Serve returns.
+func Serve(conn io.ReadWriter) error {
+	m, err := readMsg(conn)
+	if err != nil {
+		return fmt.Errorf("keyholder: reading init message: %w", err)
+	}
+	cCore, fa, err := initCiphers(m)
+	if err != nil {
+		return err
+	}
+	s := server{cCore: cCore, fa: fa, conn: conn}
+	aead := cCore.AEADCipher
+	s.reply(&msg{
+		id:   m.id,
+		code: statusOK,
+		fields: [][]byte{
+			binary.BigEndian.AppendUint32(nil, uint32(aead.NonceSize())),
+			binary.BigEndian.AppendUint32(nil, uint32(aead.Overhead())),
+		},
+	})
+	var wg sync.WaitGroup
+	for {
+		m, err = readMsg(conn)
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func(m *msg) {
+			s.handle(m)
+			wg.Done()
+		}(m)
+	}
+	wg.Wait()
+	cCore.Wipe()
+	if fa != nil {
+		fa.Wipe()
+	}
+	if err == io.EOF {
+		// Regular shutdown: the FUSE server closed its end
+		return nil
+	}
+	return fmt.Errorf("keyholder: %w", err)
+}
+
+// initCiphers parses the init message and wipes the key contained in it.
+func initCiphers(m *msg) (*cryptocore.CryptoCore, *filenameauth.FilenameAuth, error) {
+	if len(m.fields) > 0 {
+		defer func() {
+			key := m.fields[0]
+			for i := range key {
+				key[i] = 0
+			}
+		}()
+	}
+	f := m.fields
+	if m.code != opInit || len(f) != 5 || len(f[2]) != 4 || len(f[3]) != 1 || len(f[4]) != 1 {
+		return nil, nil, fmt.Errorf("keyholder: malformed init message")
+	}
+	key := f[0]
+	if len(key) != cryptocore.KeyLen {
+		return nil, nil, fmt.Errorf("keyholder: wrong key length %d", len(key))
+	}
+	aeadType, ok := backends[string(f[1])]
+	if !ok {
+		return nil, nil, fmt.Errorf("keyholder: unknown backend %q", f[1])
+	}
+	IVBitLen := int(binary.BigEndian.Uint32(f[2]))
+	useHKDF := f[3][0] != 0
+	var fa *filenameauth.FilenameAuth
+	if f[4][0] != 0 {
+		fa = filenameauth.New(key, true)
+	}
+	return cryptocore.New(key, aeadType, IVBitLen, useHKDF), fa, nil
+}
+
+func (s *server) reply(m *msg) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	err := writeMsg(s.conn, m)
+	if err != nil {
+		tlog.Warn.Printf("keyholder: sending reply: %v", err)
+	}
+}
+
+// handle performs the operation requested in "m" and sends the reply.
+func (s *server) handle(m *msg) {
+	r := &msg{id: m.id, code: statusError}
+	f := m.fields
+	aead := s.cCore.AEADCipher
+	switch m.code {
+	case opSeal:
+		if len(f) == 3 && len(f[0]) == aead.NonceSize() {
+			r.code = statusOK
+			r.fields = [][]byte{aead.Seal(nil, f[0], f[1], f[2])}
+		}
+	case opOpen:
+		if len(f) == 3 && len(f[0]) == aead.NonceSize() {
+			plaintext, err := aead.Open(nil, f[0], f[1], f[2])
+			if err != nil {
+				r.code = statusAuthFailed
+			} else {
+				r.code = statusOK
+				r.fields = [][]byte{plaintext}
+			}
+		}
+	case opEMEEncrypt, opEMEDecrypt:
+		if len(f) == 2 && validEMEInput(f[0], f[1]) {
+			r.code = statusOK
+			if m.code == opEMEEncrypt {
+				r.fields = [][]byte{s.cCore.EMECipher.Encrypt(f[0], f[1])}
+			} else {
+				r.fields = [][]byte{s.cCore.EMECipher.Decrypt(f[0], f[1])}
+			}
+		}
+	case opFilenameMAC:
+		if len(f) == 1 && s.fa != nil {
+			r.code = statusOK
+			r.fields = [][]byte{s.fa.MAC(f[0])}
+		}
+	}
+	if r.code == statusError {
+		tlog.Warn.Printf("keyholder: rejecting malformed request op=%d", m.code)
+	}
+	s.reply(r)
+}
+
+// validEMEInput checks the preconditions of eme.Transform, which panics
+// if they are not met.
+func validEMEInput(tweak []byte, data []byte) bool {
+	const emeMaxBlocks = 16 * 8
+	return len(tweak) == 16 && len(data) > 0 && len(data)%16 == 0 && len(data)/16 <= emeMaxBlocks
+}
@@ -0,0 +1,155 @@
+// Package keystore holds the key shares of the files with version 3
+// headers, outside of the files. The data key of such a file is the key
+// in its header combined with its share, so destroying the share makes the
+// content unrecoverable, also from copies of the file that have the header.
+// See contentenc.ContentEnc.UseHeaderV3.
+package keystore
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+const (
+	// DirName is the name of the key store directory in the CIPHERDIR.
+	DirName = "gocryptfs.keys"
+	// ShareLen is the length of a key share
+	ShareLen = cryptocore.KeyLen
+	// tmpSuffix is appended to the names of shares that are being written
+	tmpSuffix = ".tmp"
+)
+
+// Store is the key store of a CIPHERDIR. There is one file per share,
+// named after the file ID in hex.
+type Store struct {
+	dir string
+	// dirExists is set once the directory has been created
+	dirExists atomic.Bool
+}
+
+// New returns the key store of "cipherdir". The directory is created when
+// the first share is stored.
+func New(cipherdir string) *Store {
+	return &Store{dir: filepath.Join(cipherdir, DirName)}
+}
+
+// Dir returns the directory of the key store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// path returns the path of the share of "fileID"
+func (s *Store) path(fileID []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(fileID))
+}
+
+// Put stores "share" for the file ID "fileID". The share is on disk when
+// Put returns, so it is safe to write the header of the file afterwards.
+func (s *Store) Put(fileID []byte, share []byte) error {
+	if len(share) != ShareLen {
+		return fmt.Errorf("keystore: share has %d bytes, want %d", len(share), ShareLen)
+	}
+	if !s.dirExists.Load() {
+		if err := os.Mkdir(s.dir, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+		s.dirExists.Store(true)
+	}
+	p := s.path(fileID)
+	tmp := p + tmpSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(share)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// Get returns the share of "fileID".
+func (s *Store) Get(fileID []byte) ([]byte, error) {
+	share, err := os.ReadFile(s.path(fileID))
+	if err != nil {
+		return nil, fmt.Errorf("keystore: %v", err)
+	}
+	if len(share) != ShareLen {
+		return nil, fmt.Errorf("keystore: share of %x has %d bytes, want %d", fileID, len(share), ShareLen)
+	}
+	return share, nil
+}
+
+// Destroy overwrites the share of "fileID" with random bytes, waits until
+// that is on disk and deletes the share.
+func (s *Store) Destroy(fileID []byte) error {
+	p := s.path(fileID)
+	f, err := os.OpenFile(p, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if os.IsPermission(err) {
+		// Shares are read-only
+		if err = os.Chmod(p, 0600); err == nil {
+			f, err = os.OpenFile(p, os.O_WRONLY|syscall.O_NOFOLLOW, 0)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(cryptocore.RandBytes(ShareLen), 0)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(p); err != nil {
+		return err
+	}
+	return syncDir(s.dir)
+}
+
+// FileID returns the file ID that the entry "name" of the key store
+// directory holds the share of, or false for other names, like the
+// temporary files of an interrupted Put.
+func FileID(name string) ([]byte, bool) {
+	if strings.HasSuffix(name, tmpSuffix) {
+		return nil, false
+	}
+	id, err := hex.DecodeString(name)
+	if err != nil || len(id) == 0 {
+		return nil, false
+	}
+	return id, true
+}
+
+// syncDir fsyncs directory "dir".
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if err2 := d.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
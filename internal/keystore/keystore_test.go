@@ -0,0 +1,66 @@
+package keystore
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPutGetDestroy(t *testing.T) {
+	s := New(t.TempDir())
+	id := []byte{1, 2, 3, 4}
+	share := bytes.Repeat([]byte{7}, ShareLen)
+	if _, err := s.Get(id); err == nil {
+		t.Error("Get of a missing share succeeded")
+	}
+	if err := s.Put(id, share[:ShareLen-1]); err == nil {
+		t.Error("Put of a short share succeeded")
+	}
+	if err := s.Put(id, share); err != nil {
+		t.Fatal(err)
+	}
+	have, err := s.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, share) {
+		t.Errorf("have %x, want %x", have, share)
+	}
+	entries, err := os.ReadDir(s.Dir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "01020304" {
+		t.Errorf("key store has %v", entries)
+	}
+	if err = s.Destroy(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(s.Dir(), "01020304")); !os.IsNotExist(err) {
+		t.Errorf("share still exists: %v", err)
+	}
+	if err = s.Destroy(id); err == nil {
+		t.Error("Destroy of a missing share succeeded")
+	}
+}
+
+func TestFileID(t *testing.T) {
+	testCases := []struct {
+		name string
+		id   []byte
+		ok   bool
+	}{
+		{"01020304", []byte{1, 2, 3, 4}, true},
+		{"01020304.tmp", nil, false},
+		{"0102030", nil, false},
+		{"xx", nil, false},
+		{"", nil, false},
+	}
+	for _, tc := range testCases {
+		id, ok := FileID(tc.name)
+		if ok != tc.ok || !bytes.Equal(id, tc.id) {
+			t.Errorf("%q: have %x %v, want %x %v", tc.name, id, ok, tc.id, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// Package maclabel handles the labels of mandatory access control (MAC)
+// systems, SELinux and AppArmor, for running gocryptfs confined.
+//
+// SELinux and SMACK store the label of a file in a "security." xattr that
+// the policy of the host assigns. The labels are not portable: another
+// host may have a different policy, or none at all, and setting them
+// fails, even for a confined root. They are handled separately from the
+// xattrs that belong to the file.
+package maclabel
+
+import (
+	"strings"
+	"syscall"
+)
+
+// SELinuxXattr holds the SELinux label of a file
+const SELinuxXattr = "security.selinux"
+
+// smackPrefix starts the names of the SMACK label xattrs, like
+// "security.SMACK64" and "security.SMACK64EXEC"
+const smackPrefix = "security.SMACK64"
+
+// IsLabel returns true if the xattr "name" holds a MAC label
+func IsLabel(name string) bool {
+	return name == SELinuxXattr || strings.HasPrefix(name, smackPrefix)
+}
+
+// Ignorable returns true if setting the label xattr "name" failed with
+// "err" because the host cannot store it or does not allow it: the
+// filesystem has no labels (ENOTSUP), the label is not valid in the policy
+// of this host (EINVAL), or the policy forbids relabeling (EPERM, EACCES).
+// The file then keeps the label that the policy assigned when it was
+// created, like after restorecon(8).
+func Ignorable(name string, err error) bool {
+	if !IsLabel(name) {
+		return false
+	}
+	switch err {
+	case syscall.ENOTSUP, syscall.EINVAL, syscall.EPERM, syscall.EACCES:
+		return true
+	}
+	return false
+}
+
+// Confinement describes the MAC confinement of the running process
+type Confinement struct {
+	// SELinux is "enforcing", "permissive", or "" if SELinux is disabled
+	SELinux string
+	// AppArmor is true if AppArmor is enabled
+	AppArmor bool
+	// Context is the label of the process, like
+	// "system_u:system_r:gocryptfs_t:s0" or "gocryptfs (enforce)".
+	// "unconfined" (AppArmor) or a context with "unconfined_t" (SELinux)
+	// means that it is not confined.
+	Context string
+}
+
+// Confined returns true if the policy restricts the process
+func (c Confinement) Confined() bool {
+	switch {
+	case c.Context == "" || c.Context == "unconfined":
+		return false
+	case c.SELinux != "":
+		return !strings.Contains(c.Context, ":unconfined_t:") && !strings.Contains(c.Context, ":kernel_t:")
+	}
+	return c.AppArmor
+}
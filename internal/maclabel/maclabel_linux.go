@@ -0,0 +1,61 @@
+package maclabel
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// Where the kernel reports the MAC state. Tests point them at a fake tree.
+var (
+	selinuxEnforce  = "/sys/fs/selinux/enforce"
+	apparmorEnabled = "/sys/module/apparmor/parameters/enabled"
+	attrCurrent     = "/proc/self/attr/current"
+)
+
+// readTrimmed returns the contents of "path" without the trailing NUL and
+// line break that the kernel adds, or "" on errors
+func readTrimmed(path string) string {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimRight(string(b), "\x00\n")
+}
+
+// SELinuxEnabled returns true if SELinux is enabled, in enforcing or
+// permissive mode
+func SELinuxEnabled() bool {
+	_, err := os.Stat(selinuxEnforce)
+	return err == nil
+}
+
+// Current returns the MAC confinement of this process
+func Current() Confinement {
+	var c Confinement
+	switch readTrimmed(selinuxEnforce) {
+	case "1":
+		c.SELinux = "enforcing"
+	case "0":
+		c.SELinux = "permissive"
+	}
+	c.AppArmor = readTrimmed(apparmorEnabled) == "Y"
+	if c.SELinux != "" || c.AppArmor {
+		c.Context = readTrimmed(attrCurrent)
+	}
+	return c
+}
+
+// Get returns the SELinux label of "path". Returns "" without an error if
+// the file has no label, or the filesystem does not support labels.
+func Get(path string) (string, error) {
+	v, err := syscallcompat.Lgetxattr(path, SELinuxXattr)
+	if err == syscall.ENODATA || err == syscall.ENOTSUP {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(v), "\x00"), nil
+}
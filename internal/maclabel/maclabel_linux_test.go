@@ -0,0 +1,42 @@
+package maclabel
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCurrent(t *testing.T) {
+	dir := t.TempDir()
+	defer func(a, b, c string) {
+		selinuxEnforce, apparmorEnabled, attrCurrent = a, b, c
+	}(selinuxEnforce, apparmorEnabled, attrCurrent)
+	selinuxEnforce = filepath.Join(dir, "enforce")
+	apparmorEnabled = filepath.Join(dir, "enabled")
+	attrCurrent = filepath.Join(dir, "current")
+
+	if c := Current(); c != (Confinement{}) || SELinuxEnabled() {
+		t.Errorf("nothing enabled: have %+v", c)
+	}
+	os.WriteFile(apparmorEnabled, []byte("Y\n"), 0600)
+	os.WriteFile(attrCurrent, []byte("gocryptfs (enforce)\n"), 0600)
+	if c := Current(); !c.AppArmor || c.SELinux != "" || c.Context != "gocryptfs (enforce)" {
+		t.Errorf("AppArmor: have %+v", c)
+	}
+	os.Remove(apparmorEnabled)
+	os.WriteFile(selinuxEnforce, []byte("0"), 0600)
+	os.WriteFile(attrCurrent, []byte("system_u:system_r:gocryptfs_t:s0\x00"), 0600)
+	if c := Current(); c.SELinux != "permissive" || c.Context != "system_u:system_r:gocryptfs_t:s0" || !SELinuxEnabled() {
+		t.Errorf("SELinux: have %+v", c)
+	}
+}
+
+func TestGet(t *testing.T) {
+	// tmpfs and ext4 without SELinux have no label, which is not an error
+	if _, err := Get(t.TempDir()); err != nil {
+		t.Error(err)
+	}
+	if _, err := Get("/nonexistent"); err == nil {
+		t.Error("no error for a missing file")
+	}
+}
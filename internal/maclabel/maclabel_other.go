@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package maclabel
+
+// SELinux and AppArmor only exist on Linux
+
+// SELinuxEnabled returns false
+func SELinuxEnabled() bool {
+	return false
+}
+
+// Current returns an empty Confinement
+func Current() Confinement {
+	return Confinement{}
+}
+
+// Get returns ""
+func Get(path string) (string, error) {
+	return "", nil
+}
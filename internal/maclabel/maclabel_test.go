@@ -0,0 +1,42 @@
+package maclabel
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestIgnorable(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{SELinuxXattr, syscall.ENOTSUP, true},
+		{SELinuxXattr, syscall.EACCES, true},
+		{"security.SMACK64EXEC", syscall.EINVAL, true},
+		{SELinuxXattr, syscall.EIO, false},
+		{"user.foo", syscall.ENOTSUP, false},
+		{"security.capability", syscall.EPERM, false},
+	} {
+		if have := Ignorable(tc.name, tc.err); have != tc.want {
+			t.Errorf("%s %v: have %v", tc.name, tc.err, have)
+		}
+	}
+}
+
+func TestConfined(t *testing.T) {
+	for _, tc := range []struct {
+		c    Confinement
+		want bool
+	}{
+		{Confinement{}, false},
+		{Confinement{SELinux: "enforcing", Context: "unconfined_u:unconfined_r:unconfined_t:s0-s0:c0.c1023"}, false},
+		{Confinement{SELinux: "enforcing", Context: "system_u:system_r:gocryptfs_t:s0"}, true},
+		{Confinement{AppArmor: true, Context: "unconfined"}, false},
+		{Confinement{AppArmor: true, Context: "gocryptfs (enforce)"}, true},
+	} {
+		if have := tc.c.Confined(); have != tc.want {
+			t.Errorf("%+v: have %v", tc.c, have)
+		}
+	}
+}
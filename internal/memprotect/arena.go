@@ -0,0 +1,97 @@
+package memprotect
+
+import (
+	"sync/atomic"
+	"unsafe"
+)
+
+// Arena is a fixed set of equally-sized buffers in one memory mapping, for
+// buffer pools on high-throughput servers. If possible, the mapping is backed
+// by huge pages, which reduces TLB pressure, and locked into memory. The
+// buffers are outside of the Go heap, so the garbage collector never has to
+// scan or free them.
+type Arena struct {
+	mem      []byte
+	slotSize int
+	// free holds the buffers that are not in use
+	free chan []byte
+	// hugePages is true if the mapping is backed by explicit huge pages
+	hugePages bool
+	// locked is true if mlock on the mapping succeeded
+	locked bool
+	// misses counts the Get calls that found no free buffer
+	misses uint64
+}
+
+// ArenaStats is a snapshot of the state of an Arena.
+type ArenaStats struct {
+	// Slots is the total number of buffers
+	Slots int
+	// Free is the number of buffers that are not in use
+	Free int
+	// Misses is the number of Get calls that found no free buffer
+	Misses uint64
+	// HugePages is true if the arena is backed by explicit huge pages
+	HugePages bool
+	// Locked is true if the arena is locked into memory
+	Locked bool
+}
+
+// NewArena maps "slots" buffers of at least "slotSize" bytes each. Every
+// buffer starts at a page boundary.
+func NewArena(slotSize int, slots int) (*Arena, error) {
+	pageSize := PageSize()
+	slotSize = ((slotSize + pageSize - 1) / pageSize) * pageSize
+	mem, hugePages, err := mapArena(slotSize * slots)
+	if err != nil {
+		return nil, err
+	}
+	a := &Arena{
+		mem:       mem,
+		slotSize:  slotSize,
+		free:      make(chan []byte, slots),
+		hugePages: hugePages,
+		locked:    lockArena(mem),
+	}
+	for i := 0; i < slots; i++ {
+		a.free <- mem[i*slotSize : (i+1)*slotSize : (i+1)*slotSize]
+	}
+	return a, nil
+}
+
+// Get returns a free buffer of the slot size, or nil if all are in use.
+func (a *Arena) Get() []byte {
+	select {
+	case s := <-a.free:
+		return s
+	default:
+		atomic.AddUint64(&a.misses, 1)
+		return nil
+	}
+}
+
+// Owns returns true if "s" is a buffer returned by Get.
+func (a *Arena) Owns(s []byte) bool {
+	if cap(s) == 0 {
+		return false
+	}
+	p := uintptr(unsafe.Pointer(&s[:1][0]))
+	start := uintptr(unsafe.Pointer(&a.mem[0]))
+	return p >= start && p < start+uintptr(len(a.mem))
+}
+
+// Put returns buffer "s", which must have been returned by Get.
+func (a *Arena) Put(s []byte) {
+	a.free <- s[:a.slotSize]
+}
+
+// Stats returns a snapshot of the state of the arena.
+func (a *Arena) Stats() ArenaStats {
+	return ArenaStats{
+		Slots:     cap(a.free),
+		Free:      len(a.free),
+		Misses:    atomic.LoadUint64(&a.misses),
+		HugePages: a.hugePages,
+		Locked:    a.locked,
+	}
+}
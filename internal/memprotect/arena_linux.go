@@ -0,0 +1,46 @@
+package memprotect
+
+import (
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// hugePageSize is the size of the default huge pages on x86 and arm64
+const hugePageSize = 2 * 1024 * 1024
+
+// mapArena maps "size" bytes of anonymous memory, backed by explicit huge
+// pages if the system has free ones, and otherwise by normal pages with a
+// hint to use transparent huge pages. The memory is excluded from core
+// dumps, as the buffers hold plaintext.
+func mapArena(size int) (mem []byte, hugePages bool, err error) {
+	hugeSize := ((size + hugePageSize - 1) / hugePageSize) * hugePageSize
+	mem, err = unix.Mmap(-1, 0, hugeSize, unix.PROT_READ|unix.PROT_WRITE,
+		unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_HUGETLB)
+	if err == nil {
+		hugePages = true
+	} else {
+		tlog.Debug.Printf("mapArena: MAP_HUGETLB failed: %v", err)
+		mem, err = unix.Mmap(-1, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+		if err != nil {
+			return nil, false, err
+		}
+		if err2 := unix.Madvise(mem, unix.MADV_HUGEPAGE); err2 != nil {
+			tlog.Debug.Printf("mapArena: MADV_HUGEPAGE failed: %v", err2)
+		}
+	}
+	if err2 := unix.Madvise(mem, unix.MADV_DONTDUMP); err2 != nil {
+		tlog.Debug.Printf("mapArena: MADV_DONTDUMP failed: %v", err2)
+	}
+	return mem[:size], hugePages, nil
+}
+
+// lockArena locks "mem" into memory. Returns false if RLIMIT_MEMLOCK does
+// not allow it.
+func lockArena(mem []byte) bool {
+	if err := unix.Mlock(mem); err != nil {
+		tlog.Debug.Printf("lockArena: mlock failed: %v", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package memprotect
+
+import (
+	"errors"
+)
+
+// ErrArenaUnsupported is returned by NewArena on platforms other than Linux.
+var ErrArenaUnsupported = errors.New("buffer arena not supported")
+
+func mapArena(size int) (mem []byte, hugePages bool, err error) {
+	return nil, false, ErrArenaUnsupported
+}
+
+func lockArena(mem []byte) bool {
+	return false
+}
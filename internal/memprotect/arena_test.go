@@ -0,0 +1,34 @@
+package memprotect
+
+import (
+	"testing"
+)
+
+func TestArena(t *testing.T) {
+	a, err := NewArena(5000, 2)
+	if err != nil {
+		t.Skipf("arena not available: %v", err)
+	}
+	s1 := a.Get()
+	s2 := a.Get()
+	if len(s1) < 5000 || len(s1)%PageSize() != 0 {
+		t.Errorf("wrong slot length %d", len(s1))
+	}
+	// Slots must not overlap
+	s1[len(s1)-1] = 1
+	if s2[0] != 0 {
+		t.Error("slots overlap")
+	}
+	if a.Get() != nil {
+		t.Error("exhausted arena should return nil")
+	}
+	if !a.Owns(s1[100:]) || a.Owns(make([]byte, 10)) || a.Owns(nil) {
+		t.Error("Owns is wrong")
+	}
+	a.Put(s1[:0])
+	s := a.Stats()
+	if s.Slots != 2 || s.Free != 1 || s.Misses != 1 {
+		t.Errorf("wrong stats %+v", s)
+	}
+	t.Logf("stats: %+v", s)
+}
@@ -0,0 +1,182 @@
+package memprotect
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"log"
+	"runtime"
+	"sync"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// canaryLen is the length of the canary values placed directly before and
+// after the data in a GuardedBuffer.
+const canaryLen = 16
+
+// canary is the random per-process canary value. It is generated once at
+// startup so an attacker cannot predict it.
+var canary [canaryLen]byte
+
+func init() {
+	_, err := rand.Read(canary[:])
+	if err != nil {
+		log.Panicf("memprotect: could not generate canary: %v", err)
+	}
+}
+
+// ErrCanaryCorrupted is returned by GuardedBuffer.Check when one of the
+// canaries surrounding the data has been overwritten.
+var ErrCanaryCorrupted = errors.New("memprotect: guard canary corrupted")
+
+// GuardedBuffer holds sensitive data in a dedicated memory mapping that is
+// surrounded by PROT_NONE guard pages. Canary values directly before and
+// after the data are verified on Wipe.
+//
+// Memory layout (the data is right-aligned so that a linear overflow hits the
+// trailing canary and then the guard page):
+//
+//	[guard page][padding][canary][data][canary][guard page]
+type GuardedBuffer struct {
+	// mapping is the complete memory region including the guard pages
+	mapping []byte
+	// inner is the read-write part of the mapping between the guard pages
+	inner []byte
+	// data is the user-visible part of inner
+	data []byte
+	// offset of data inside inner
+	offset int
+	// mp is the MemoryProtection instance that locked inner
+	mp *MemoryProtection
+}
+
+// AllocateGuarded allocates a buffer of "size" bytes for key material.
+// The buffer is placed between two inaccessible guard pages and locked into
+// memory. Stray writes that overwrite the surrounding canaries are detected
+// on Wipe and turned into a panic, while accesses that reach the guard pages
+// (or any access after Wipe) crash the process immediately.
+//
+// On platforms without mmap support, the guard pages are omitted but the
+// canaries are still checked.
+func (mp *MemoryProtection) AllocateGuarded(size int) (*GuardedBuffer, error) {
+	if size <= 0 {
+		return nil, errors.New("memprotect: AllocateGuarded: size must be positive")
+	}
+	pageSize := PageSize()
+	innerLen := size + 2*canaryLen
+	// Round up to page boundary
+	innerLen = ((innerLen + pageSize - 1) / pageSize) * pageSize
+
+	mapping, inner, err := allocGuarded(innerLen)
+	if err != nil {
+		return nil, err
+	}
+	offset := innerLen - canaryLen - size
+	g := &GuardedBuffer{
+		mapping: mapping,
+		inner:   inner,
+		data:    inner[offset : offset+size : offset+size],
+		offset:  offset,
+	}
+	copy(inner[offset-canaryLen:offset], canary[:])
+	copy(inner[offset+size:], canary[:])
+	if mp.enabled {
+		mp.LockMemory(inner)
+		g.mp = mp
+	}
+	tlog.Debug.Printf("MemoryProtection: allocated guarded buffer of %d bytes at %p", size, &g.data[0])
+	return g, nil
+}
+
+// Bytes returns the data slice. The capacity of the slice is limited to its
+// length so that append() cannot silently write into the canary.
+// The slice must not be used after Wipe.
+func (g *GuardedBuffer) Bytes() []byte {
+	return g.data
+}
+
+// Check verifies the canaries surrounding the data.
+func (g *GuardedBuffer) Check() error {
+	if g.inner == nil {
+		return errors.New("memprotect: GuardedBuffer used after Wipe")
+	}
+	size := len(g.data)
+	if !bytes.Equal(g.inner[g.offset-canaryLen:g.offset], canary[:]) ||
+		!bytes.Equal(g.inner[g.offset+size:g.offset+size+canaryLen], canary[:]) {
+		return ErrCanaryCorrupted
+	}
+	return nil
+}
+
+// Wipe verifies the canaries, overwrites the buffer with zeros and releases
+// the memory. If a canary has been corrupted, Wipe panics: the key memory
+// has been written to by someone who should not have, and continuing would
+// mean operating on silently corrupted state.
+// Calling Wipe more than once is a no-op.
+func (g *GuardedBuffer) Wipe() {
+	if g.inner == nil {
+		return
+	}
+	err := g.Check()
+	for i := range g.inner {
+		g.inner[i] = 0
+	}
+	runtime.KeepAlive(g.inner)
+	if err != nil {
+		tlog.Fatal.Printf("MemoryProtection: %v at %p, aborting", err, &g.data[0])
+		log.Panic(err)
+	}
+	if g.mp != nil {
+		g.mp.UnlockMemory(g.inner)
+	}
+	if err := freeGuarded(g.mapping); err != nil {
+		tlog.Warn.Printf("MemoryProtection: freeing guarded buffer failed: %v", err)
+	}
+	g.mapping = nil
+	g.inner = nil
+	g.data = nil
+}
+
+// keyBuffers maps the data of the buffers returned by AllocateKey to their
+// GuardedBuffer, so WipeKey can find them again from the plain slice.
+var keyBuffers struct {
+	sync.Mutex
+	m map[*byte]*GuardedBuffer
+}
+
+// AllocateKey returns a buffer of "size" bytes for key material that is
+// allocated with AllocateGuarded, or ordinary memory if that fails. The
+// buffer must be released with WipeKey.
+func (mp *MemoryProtection) AllocateKey(size int) []byte {
+	g, err := mp.AllocateGuarded(size)
+	if err != nil {
+		tlog.Debug.Printf("MemoryProtection: AllocateKey: %v, using unguarded memory", err)
+		return make([]byte, size)
+	}
+	keyBuffers.Lock()
+	defer keyBuffers.Unlock()
+	if keyBuffers.m == nil {
+		keyBuffers.m = make(map[*byte]*GuardedBuffer)
+	}
+	keyBuffers.m[&g.data[0]] = g
+	return g.Bytes()
+}
+
+// WipeKey wipes "key". Buffers from AllocateKey are checked for corrupted
+// canaries and released (see GuardedBuffer.Wipe), others are overwritten
+// with SecureWipe.
+func (mp *MemoryProtection) WipeKey(key []byte) {
+	if len(key) == 0 {
+		return
+	}
+	keyBuffers.Lock()
+	g := keyBuffers.m[&key[0]]
+	delete(keyBuffers.m, &key[0])
+	keyBuffers.Unlock()
+	if g == nil {
+		mp.SecureWipe(key)
+		return
+	}
+	g.Wipe()
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package memprotect
+
+// allocGuarded falls back to a regular heap allocation on platforms where we
+// cannot create guard pages. The canaries are still checked on Wipe.
+func allocGuarded(innerLen int) (mapping []byte, inner []byte, err error) {
+	mapping = make([]byte, innerLen)
+	return mapping, mapping, nil
+}
+
+// freeGuarded is a no-op for heap allocations.
+func freeGuarded(mapping []byte) error {
+	return nil
+}
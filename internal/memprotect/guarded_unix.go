@@ -0,0 +1,31 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package memprotect
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// allocGuarded maps innerLen bytes of read-write memory between two PROT_NONE
+// guard pages. innerLen must be a multiple of the page size.
+func allocGuarded(innerLen int) (mapping []byte, inner []byte, err error) {
+	pageSize := PageSize()
+	mapping, err = unix.Mmap(-1, 0, innerLen+2*pageSize, unix.PROT_NONE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		return nil, nil, err
+	}
+	inner = mapping[pageSize : pageSize+innerLen]
+	err = unix.Mprotect(inner, unix.PROT_READ|unix.PROT_WRITE)
+	if err != nil {
+		unix.Munmap(mapping)
+		return nil, nil, err
+	}
+	return mapping, inner, nil
+}
+
+// freeGuarded unmaps a region returned by allocGuarded. Any later access
+// to it results in SIGSEGV.
+func freeGuarded(mapping []byte) error {
+	return unix.Munmap(mapping)
+}
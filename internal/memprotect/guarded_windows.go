@@ -0,0 +1,41 @@
+//go:build windows
+// +build windows
+
+package memprotect
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// allocGuarded allocates innerLen bytes of read-write memory between two
+// PAGE_NOACCESS guard pages using VirtualAlloc. innerLen must be a multiple
+// of the page size.
+func allocGuarded(innerLen int) (mapping []byte, inner []byte, err error) {
+	pageSize := PageSize()
+	total := innerLen + 2*pageSize
+	addr, err := windows.VirtualAlloc(0, uintptr(total), windows.MEM_RESERVE|windows.MEM_COMMIT, windows.PAGE_NOACCESS)
+	if err != nil {
+		return nil, nil, err
+	}
+	// VirtualAlloc memory is not managed by the Go runtime. Reinterpret the
+	// address instead of converting the uintptr, which vet cannot tell apart
+	// from a pointer that the GC may have moved.
+	p := *(*unsafe.Pointer)(unsafe.Pointer(&addr))
+	mapping = unsafe.Slice((*byte)(p), total)
+	inner = mapping[pageSize : pageSize+innerLen]
+	var oldProtect uint32
+	err = windows.VirtualProtect(uintptr(unsafe.Pointer(&inner[0])), uintptr(innerLen), windows.PAGE_READWRITE, &oldProtect)
+	if err != nil {
+		windows.VirtualFree(addr, 0, windows.MEM_RELEASE)
+		return nil, nil, err
+	}
+	return mapping, inner, nil
+}
+
+// freeGuarded releases a region returned by allocGuarded. Any later access
+// to it results in an access violation.
+func freeGuarded(mapping []byte) error {
+	return windows.VirtualFree(uintptr(unsafe.Pointer(&mapping[0])), 0, windows.MEM_RELEASE)
+}
@@ -8,6 +8,8 @@ import (
 	"syscall"
 	"unsafe"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -31,7 +33,7 @@ func (mp *MemoryProtection) LockMemory(data []byte) bool {
 	}
 
 	// Mark memory as MADV_DONTDUMP to exclude from core dumps
-	err = madvise(ptr, size, syscall.MADV_DONTDUMP)
+	err = madvise(ptr, size, unix.MADV_DONTDUMP)
 	if err != nil {
 		tlog.Debug.Printf("MemoryProtection: madvise MADV_DONTDUMP failed: %v", err)
 		// Don't fail completely, just log the warning
@@ -68,7 +70,7 @@ func (mp *MemoryProtection) LockMemoryPageAligned(data []byte) bool {
 	}
 
 	// Mark memory as MADV_DONTDUMP to exclude from core dumps
-	err = madvise(alignedPtr, alignedSize, syscall.MADV_DONTDUMP)
+	err = madvise(alignedPtr, alignedSize, unix.MADV_DONTDUMP)
 	if err != nil {
 		tlog.Debug.Printf("MemoryProtection: page-aligned madvise MADV_DONTDUMP failed: %v", err)
 		// Don't fail completely, just log the warning
@@ -113,3 +113,76 @@ func BenchmarkSecureWipe(b *testing.B) {
 		mp.SecureWipe(testData)
 	}
 }
+
+func TestAllocateGuarded(t *testing.T) {
+	mp := New()
+	g, err := mp.AllocateGuarded(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := g.Bytes()
+	if len(key) != 32 || cap(key) != 32 {
+		t.Fatalf("wrong len/cap: %d/%d", len(key), cap(key))
+	}
+	for i := range key {
+		key[i] = 0xaa
+	}
+	if err := g.Check(); err != nil {
+		t.Fatal(err)
+	}
+	g.Wipe()
+	if g.Bytes() != nil {
+		t.Error("Bytes() should return nil after Wipe")
+	}
+	// Second Wipe must be a no-op
+	g.Wipe()
+}
+
+func TestAllocateGuardedInvalidSize(t *testing.T) {
+	mp := New()
+	if _, err := mp.AllocateGuarded(0); err == nil {
+		t.Error("size 0 should be rejected")
+	}
+}
+
+func TestAllocateGuardedCanaryCorrupted(t *testing.T) {
+	mp := New()
+	g, err := mp.AllocateGuarded(32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Simulate an off-by-one overflow past the end of the key
+	g.inner[g.offset+len(g.data)] ^= 1
+	if err := g.Check(); err != ErrCanaryCorrupted {
+		t.Fatalf("want ErrCanaryCorrupted, got %v", err)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Wipe should panic on corrupted canary")
+		}
+	}()
+	g.Wipe()
+}
+
+func TestAllocateKey(t *testing.T) {
+	mp := New()
+	key := mp.AllocateKey(32)
+	if len(key) != 32 {
+		t.Fatalf("wrong len: %d", len(key))
+	}
+	keyBuffers.Lock()
+	g := keyBuffers.m[&key[0]]
+	keyBuffers.Unlock()
+	if g == nil {
+		t.Skip("AllocateKey fell back to unguarded memory")
+	}
+	mp.WipeKey(key)
+	if g.Bytes() != nil {
+		t.Error("WipeKey should release the guarded buffer")
+	}
+	keyBuffers.Lock()
+	defer keyBuffers.Unlock()
+	if _, ok := keyBuffers.m[&key[0]]; ok {
+		t.Error("WipeKey should remove the buffer from keyBuffers")
+	}
+}
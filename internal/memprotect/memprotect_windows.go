@@ -0,0 +1,150 @@
+//go:build windows
+// +build windows
+
+// Package memprotect provides memory protection utilities for Windows
+package memprotect
+
+import (
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// LockMemory locks a memory region into the working set using VirtualLock to
+// prevent it from being paged out to the pagefile.
+// Windows has no equivalent of MADV_DONTDUMP; crash dumps are controlled
+// system-wide via Windows Error Reporting.
+// Returns true if successful, false if not supported or failed.
+func (mp *MemoryProtection) LockMemory(data []byte) bool {
+	if !mp.enabled || len(data) == 0 {
+		return false
+	}
+
+	// Get the underlying memory address
+	ptr := unsafe.Pointer(&data[0])
+	size := uintptr(len(data))
+
+	// Lock the memory region to prevent paging
+	err := mlock(ptr, size)
+	if err != nil {
+		tlog.Debug.Printf("MemoryProtection: VirtualLock failed: %v", err)
+		// Don't fail completely, just log the warning
+	}
+
+	// Track locked pages for cleanup
+	mp.lockedPages = append(mp.lockedPages, ptr)
+
+	tlog.Debug.Printf("MemoryProtection: Locked %d bytes at %p", len(data), ptr)
+	return true
+}
+
+// LockMemoryPageAligned locks a page-aligned memory region
+// This is more efficient than LockMemory for arbitrary-sized regions
+func (mp *MemoryProtection) LockMemoryPageAligned(data []byte) bool {
+	if !mp.enabled || len(data) == 0 {
+		return false
+	}
+
+	// Get the underlying memory address
+	ptr := unsafe.Pointer(&data[0])
+	size := uintptr(len(data))
+
+	// Calculate page-aligned boundaries
+	pageSize := uintptr(PageSize())
+	alignedPtr := unsafe.Pointer(uintptr(ptr) &^ (pageSize - 1))
+	alignedSize := ((size + pageSize - 1) / pageSize) * pageSize
+
+	// Lock the page-aligned memory region
+	err := mlock(alignedPtr, alignedSize)
+	if err != nil {
+		tlog.Debug.Printf("MemoryProtection: page-aligned VirtualLock failed: %v", err)
+		return false
+	}
+
+	// Track locked pages for cleanup
+	mp.lockedPages = append(mp.lockedPages, alignedPtr)
+
+	tlog.Debug.Printf("MemoryProtection: Page-aligned locked %d bytes at %p (aligned to %p)", len(data), ptr, alignedPtr)
+	return true
+}
+
+// UnlockMemory unlocks a previously locked memory region
+func (mp *MemoryProtection) UnlockMemory(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	ptr := unsafe.Pointer(&data[0])
+	size := uintptr(len(data))
+
+	// Unlock the memory region
+	err := munlock(ptr, size)
+	if err != nil {
+		tlog.Debug.Printf("MemoryProtection: VirtualUnlock failed: %v", err)
+	}
+
+	// Remove from tracking
+	for i, p := range mp.lockedPages {
+		if p == ptr {
+			mp.lockedPages = append(mp.lockedPages[:i], mp.lockedPages[i+1:]...)
+			break
+		}
+	}
+
+	tlog.Debug.Printf("MemoryProtection: Unlocked %d bytes at %p", len(data), ptr)
+}
+
+// LockAllMemory is not supported on Windows, which has no mlockall()
+// equivalent. Sensitive buffers must be locked individually.
+func (mp *MemoryProtection) LockAllMemory() bool {
+	if !mp.enabled {
+		return false
+	}
+
+	tlog.Debug.Printf("MemoryProtection: LockAllMemory not supported on Windows")
+	return false
+}
+
+// UnlockAllMemory is a no-op on Windows, see LockAllMemory.
+func (mp *MemoryProtection) UnlockAllMemory() {
+	tlog.Debug.Printf("MemoryProtection: UnlockAllMemory not supported on Windows")
+}
+
+// SecureWipe zeroes memory and then unlocks it.
+// The memory is zeroed before VirtualUnlock so that the key material cannot
+// be paged out between the two calls.
+func (mp *MemoryProtection) SecureWipe(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	rtlSecureZeroMemory(data)
+	mp.UnlockMemory(data)
+}
+
+// Platform-specific system calls for Windows
+
+// rtlSecureZeroMemory has the same semantics as RtlSecureZeroMemory from
+// winnt.h. The original is a FORCEINLINE header function that is not exported
+// by any DLL, so we cannot call it through the syscall interface. The Go
+// compiler does not elide stores to memory that escapes, and KeepAlive keeps
+// the buffer reachable until the stores are done.
+func rtlSecureZeroMemory(data []byte) {
+	for i := range data {
+		data[i] = 0
+	}
+	runtime.KeepAlive(data)
+}
+
+// mlock locks a memory region into the working set using VirtualLock
+func mlock(ptr unsafe.Pointer, size uintptr) error {
+	return windows.VirtualLock(uintptr(ptr), size)
+}
+
+// munlock unlocks a memory region using VirtualUnlock
+func munlock(ptr unsafe.Pointer, size uintptr) error {
+	return windows.VirtualUnlock(uintptr(ptr), size)
+}
@@ -0,0 +1,124 @@
+package nametransform
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// caseIndexMaxDirs is the number of directories CaseIndex keeps indexes for.
+// When it is reached, all indexes are dropped.
+const caseIndexMaxDirs = 1024
+
+// FoldCase returns the form of "name" that case-insensitive lookups compare.
+func FoldCase(name string) string {
+	return strings.ToLower(name)
+}
+
+// CaseIndex supports case-insensitive lookups on top of encrypted names.
+// As the encrypted names of "Foo" and "foo" have nothing in common, finding
+// a name in any case means decrypting the whole directory. CaseIndex caches
+// the result per directory: a map from the folded plaintext names to the
+// plaintext names. The same works for names that only differ in their
+// Unicode normalization, it depends on the fold function.
+//
+// An index is keyed by the device and inode number of its directory and is
+// rebuilt when the mtime of the directory changes. Call Invalidate after
+// modifying a directory, as the mtime resolution may be too coarse to notice.
+type CaseIndex struct {
+	mu   sync.Mutex
+	fold func(string) string
+	dirs map[caseIndexKey]*caseIndexDir
+}
+
+type caseIndexKey struct {
+	dev uint64
+	ino uint64
+}
+
+type caseIndexDir struct {
+	mtime unix.Timespec
+	// names maps fold(plainName) to plainName
+	names map[string]string
+}
+
+// NewCaseIndex returns an empty CaseIndex that considers two names equal if
+// "fold" returns the same for both, like FoldCase.
+func NewCaseIndex(fold func(string) string) *CaseIndex {
+	return &CaseIndex{fold: fold, dirs: make(map[caseIndexKey]*caseIndexDir)}
+}
+
+// Lookup returns the plaintext name in directory "dirfd" that equals "name"
+// after folding. "decrypt" returns the plaintext name of an entry, or an
+// error for entries that should be skipped (like "gocryptfs.diriv").
+// If there are several matches, the first in directory order is returned.
+func (c *CaseIndex) Lookup(dirfd int, name string, decrypt func(cName string) (string, error)) (plainName string, found bool, err error) {
+	var st unix.Stat_t
+	if err = unix.Fstat(dirfd, &st); err != nil {
+		return "", false, err
+	}
+	key := caseIndexKey{dev: uint64(st.Dev), ino: st.Ino}
+	c.mu.Lock()
+	d := c.dirs[key]
+	c.mu.Unlock()
+	if d == nil || d.mtime != st.Mtim {
+		d, err = c.build(dirfd, decrypt)
+		if err != nil {
+			return "", false, err
+		}
+		d.mtime = st.Mtim
+		c.mu.Lock()
+		if len(c.dirs) >= caseIndexMaxDirs {
+			c.dirs = make(map[caseIndexKey]*caseIndexDir)
+		}
+		c.dirs[key] = d
+		c.mu.Unlock()
+	}
+	plainName, found = d.names[c.fold(name)]
+	return plainName, found, nil
+}
+
+// Invalidate drops the index of directory "dirfd".
+func (c *CaseIndex) Invalidate(dirfd int) {
+	var st unix.Stat_t
+	if err := unix.Fstat(dirfd, &st); err != nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.dirs, caseIndexKey{dev: uint64(st.Dev), ino: st.Ino})
+	c.mu.Unlock()
+}
+
+// build decrypts all names in directory "dirfd".
+func (c *CaseIndex) build(dirfd int, decrypt func(cName string) (string, error)) (*caseIndexDir, error) {
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), ".")
+	defer f.Close()
+	cNames, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	d := &caseIndexDir{names: make(map[string]string, len(cNames))}
+	for _, cName := range cNames {
+		plainName, err := decrypt(cName)
+		if err != nil {
+			continue
+		}
+		folded := c.fold(plainName)
+		if _, dup := d.names[folded]; dup {
+			tlog.Debug.Printf("CaseIndex: %q differs from another name only in case or normalization", plainName)
+			continue
+		}
+		d.names[folded] = plainName
+	}
+	return d, nil
+}
@@ -0,0 +1,78 @@
+package nametransform
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestCaseIndex(t *testing.T) {
+	dir := t.TempDir()
+	for _, n := range []string{"Foo", "bar.TXT", "skip"} {
+		if err := os.WriteFile(filepath.Join(dir, n), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	calls := 0
+	decrypt := func(cName string) (string, error) {
+		calls++
+		if cName == "skip" {
+			return "", errors.New("skipped")
+		}
+		return cName, nil
+	}
+
+	c := NewCaseIndex(FoldCase)
+	for _, tc := range []struct {
+		name, want string
+		found      bool
+	}{
+		{"foo", "Foo", true},
+		{"FOO", "Foo", true},
+		{"Bar.txt", "bar.TXT", true},
+		{"SKIP", "", false},
+		{"baz", "", false},
+	} {
+		have, found, err := c.Lookup(dirfd, tc.name, decrypt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != tc.want || found != tc.found {
+			t.Errorf("%q: want %q %v, have %q %v", tc.name, tc.want, tc.found, have, found)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("directory was decrypted more than once: %d calls", calls)
+	}
+
+	// Changes are seen after Invalidate, or when the mtime changes
+	if err = os.WriteFile(filepath.Join(dir, "BAZ"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.Invalidate(dirfd)
+	if have, _, _ := c.Lookup(dirfd, "baz", decrypt); have != "BAZ" {
+		t.Errorf("after Invalidate: have %q", have)
+	}
+	if err = os.Remove(filepath.Join(dir, "BAZ")); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err = os.Chtimes(dir, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if _, found, _ := c.Lookup(dirfd, "baz", decrypt); found {
+		t.Error("after mtime change: still found")
+	}
+	if FoldCase("ÄbC") != strings.ToLower("ÄBC") {
+		t.Error("FoldCase")
+	}
+}
@@ -18,6 +18,12 @@ const (
 	// DirIVFilename is the filename used to store directory IV.
 	// Exported because we have to ignore this name in directory listing.
 	DirIVFilename = "gocryptfs.diriv"
+	// TrashDirName is the directory in the CIPHERDIR root that holds the
+	// files deleted with "-trash". Ignored in directory listings.
+	TrashDirName = ".gocryptfs.trash"
+	// TrashPathSuffix is appended to the ID of a file in the trash for the
+	// file that stores its encrypted original path.
+	TrashPathSuffix = ".path"
 )
 
 // ReadDirIVAt reads "gocryptfs.diriv" from the directory that is opened as "dirfd".
@@ -35,6 +41,14 @@ func (n *NameTransform) ReadDirIVAt(dirfd int) (iv []byte, err error) {
 	}
 	fd := os.NewFile(uintptr(fdRaw), DirIVFilename)
 	defer fd.Close()
+	if n.dirIVAuth {
+		// Only parse the file. Use VerifyDirIVAt to also check the MAC.
+		d, err := fdReadAuthDirIV(fd)
+		if err != nil {
+			return nil, err
+		}
+		return d.iv, nil
+	}
 	return fdReadDirIV(fd)
 }
 
@@ -66,17 +80,23 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 // and also the automated tests.
 func WriteDirIVAt(dirfd int) error {
 	iv := cryptocore.RandBytes(DirIVLen)
+	return writeDirIVFileAt(dirfd, DirIVFilename, iv)
+}
+
+// writeDirIVFileAt creates the file "name" in the directory opened at "dirfd"
+// and writes "data" to it. On error we try to delete the incomplete file.
+func writeDirIVFileAt(dirfd int, name string, data []byte) error {
 	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "os.WriteFile", it causes trouble on NFS:
 	// https://github.com/rfjakob/gocryptfs/commit/7d38f80a78644c8ec4900cc990bfb894387112ed
-	fd, err := syscallcompat.Openat(dirfd, DirIVFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dirivPerms)
+	fd, err := syscallcompat.Openat(dirfd, name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dirivPerms)
 	if err != nil {
 		tlog.Warn.Printf("WriteDirIV: Openat: %v", err)
 		return err
 	}
 	// Wrap the fd in an os.File - we need the write retry logic.
-	f := os.NewFile(uintptr(fd), DirIVFilename)
-	_, err = f.Write(iv)
+	f := os.NewFile(uintptr(fd), name)
+	_, err = f.Write(data)
 	if err != nil {
 		f.Close()
 		// It is normal to get ENOSPC here
@@ -84,14 +104,14 @@ func WriteDirIVAt(dirfd int) error {
 			tlog.Warn.Printf("WriteDirIV: Write: %v", err)
 		}
 		// Delete incomplete gocryptfs.diriv file
-		syscallcompat.Unlinkat(dirfd, DirIVFilename, 0)
+		syscallcompat.Unlinkat(dirfd, name, 0)
 		return err
 	}
 	err = f.Close()
 	if err != nil {
 		tlog.Warn.Printf("WriteDirIV: Close: %v", err)
 		// Delete incomplete gocryptfs.diriv file
-		syscallcompat.Unlinkat(dirfd, DirIVFilename, 0)
+		syscallcompat.Unlinkat(dirfd, name, 0)
 		return err
 	}
 	return nil
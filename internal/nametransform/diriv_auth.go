@@ -0,0 +1,210 @@
+package nametransform
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// dirIVAuthLen is the size of an authenticated gocryptfs.diriv file:
+	// the IV, a 64-bit generation counter and the MAC.
+	dirIVAuthLen = DirIVLen + 8 + filenameauth.FilenameAuthMACLen
+	// DirIVNextFilename holds the new gocryptfs.diriv while a directory is
+	// renamed. See PrepareDirIVMoveAt.
+	DirIVNextFilename = DirIVFilename + ".next"
+	// RootDirCName is the name that the gocryptfs.diriv file in the root
+	// directory is bound to.
+	RootDirCName = "."
+)
+
+// authDirIV is the content of an authenticated gocryptfs.diriv file.
+type authDirIV struct {
+	iv []byte
+	// gen is incremented each time the file is rewritten, which happens
+	// when the directory is renamed.
+	gen uint64
+	mac []byte
+}
+
+// EnableDirIVAuth switches to authenticated gocryptfs.diriv files
+// (feature flag DirIVAuth). Requires filename authentication.
+//
+// An authenticated gocryptfs.diriv file is bound to the encrypted name of
+// its directory. As the encrypted name depends on the IV of the parent
+// directory, moving the file to another directory is detected by
+// VerifyDirIVAt. The generation counter detects a gocryptfs.diriv file that
+// has been rolled back to the state before a rename, as long as we have seen
+// the newer one during this mount.
+func (n *NameTransform) EnableDirIVAuth() {
+	if n.filenameAuth == nil {
+		panic("EnableDirIVAuth: filename authentication is not enabled")
+	}
+	n.dirIVAuth = true
+	n.dirIVGen = make(map[string]uint64)
+}
+
+// DirIVAuth returns true if EnableDirIVAuth has been called.
+func (n *NameTransform) DirIVAuth() bool {
+	return n.dirIVAuth
+}
+
+// fdReadAuthDirIV parses an authenticated gocryptfs.diriv file. It does not
+// check the MAC.
+func fdReadAuthDirIV(fd *os.File) (*authDirIV, error) {
+	// Make the buffer 1 byte bigger than necessary to detect oversized files
+	buf := make([]byte, dirIVAuthLen+1)
+	n, err := io.ReadFull(fd, buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("read failed: %v", err)
+	}
+	if n != dirIVAuthLen {
+		return nil, fmt.Errorf("wanted %d bytes, got %d", dirIVAuthLen, n)
+	}
+	d := &authDirIV{
+		iv:  buf[:DirIVLen],
+		gen: binary.BigEndian.Uint64(buf[DirIVLen:]),
+		mac: buf[DirIVLen+8 : dirIVAuthLen],
+	}
+	if bytes.Equal(d.iv, allZeroDirIV) {
+		return nil, fmt.Errorf("diriv is all-zero")
+	}
+	return d, nil
+}
+
+// readAuthDirIVAt opens the file "name" in the directory "dirfd" and parses
+// it using fdReadAuthDirIV.
+func readAuthDirIVAt(dirfd int, name string) (*authDirIV, error) {
+	fdRaw, err := syscallcompat.Openat(dirfd, name, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	fd := os.NewFile(uintptr(fdRaw), name)
+	defer fd.Close()
+	return fdReadAuthDirIV(fd)
+}
+
+// checkAuthDirIV verifies the MAC of "d" for a directory called "cName".
+func (n *NameTransform) checkAuthDirIV(d *authDirIV, cName string) bool {
+	return hmac.Equal(d.mac, n.filenameAuth.DirIVMAC(cName, d.iv, d.gen))
+}
+
+// writeAuthDirIVAt creates the file "name" in the directory opened at
+// "dirfd" that authenticates "iv" and "gen" for a directory called "cName".
+func (n *NameTransform) writeAuthDirIVAt(dirfd int, name string, cName string, iv []byte, gen uint64) error {
+	data := make([]byte, 0, dirIVAuthLen)
+	data = append(data, iv...)
+	data = binary.BigEndian.AppendUint64(data, gen)
+	data = append(data, n.filenameAuth.DirIVMAC(cName, iv, gen)...)
+	return writeDirIVFileAt(dirfd, name, data)
+}
+
+// CreateDirIVAt creates gocryptfs.diriv in the new directory opened at
+// "dirfd". "cName" is the encrypted name of the directory in its parent, or
+// RootDirCName for the root directory.
+//
+// Without EnableDirIVAuth, this is the same as WriteDirIVAt.
+func (n *NameTransform) CreateDirIVAt(dirfd int, cName string) error {
+	if !n.dirIVAuth {
+		return WriteDirIVAt(dirfd)
+	}
+	return n.writeAuthDirIVAt(dirfd, DirIVFilename, cName, cryptocore.RandBytes(DirIVLen), 0)
+}
+
+// VerifyDirIVAt reads gocryptfs.diriv from the directory opened at "dirfd"
+// like ReadDirIVAt. With EnableDirIVAuth, it also checks that the file
+// belongs to the directory "cName" and has not been rolled back, and returns
+// EIO otherwise.
+func (n *NameTransform) VerifyDirIVAt(dirfd int, cName string) (iv []byte, err error) {
+	if !n.dirIVAuth {
+		return n.ReadDirIVAt(dirfd)
+	}
+	d, err := n.verifyAuthDirIVAt(dirfd, cName)
+	if err != nil {
+		return nil, err
+	}
+	return d.iv, nil
+}
+
+func (n *NameTransform) verifyAuthDirIVAt(dirfd int, cName string) (*authDirIV, error) {
+	d, err := readAuthDirIVAt(dirfd, DirIVFilename)
+	if err != nil {
+		return nil, err
+	}
+	if !n.checkAuthDirIV(d, cName) {
+		// If we crashed during a rename, the new file is still in
+		// gocryptfs.diriv.next. Finish the job.
+		d2, err := readAuthDirIVAt(dirfd, DirIVNextFilename)
+		if err != nil || !bytes.Equal(d2.iv, d.iv) || !n.checkAuthDirIV(d2, cName) {
+			tlog.Warn.Printf("VerifyDirIVAt: %q: %s authentication failed", cName, DirIVFilename)
+			return nil, syscall.EIO
+		}
+		tlog.Info.Printf("VerifyDirIVAt: %q: completing interrupted rename", cName)
+		err = syscallcompat.Renameat(dirfd, DirIVNextFilename, dirfd, DirIVFilename)
+		// ENOENT means that somebody else was faster
+		if err != nil && err != syscall.ENOENT {
+			tlog.Warn.Printf("VerifyDirIVAt: %q: %v", cName, err)
+		}
+		d = d2
+	}
+	n.dirIVGenLock.Lock()
+	defer n.dirIVGenLock.Unlock()
+	key := string(d.iv)
+	if seen, ok := n.dirIVGen[key]; ok && d.gen < seen {
+		tlog.Warn.Printf("VerifyDirIVAt: %q: %s has been rolled back from generation %d to %d",
+			cName, DirIVFilename, seen, d.gen)
+		return nil, syscall.EIO
+	}
+	n.dirIVGen[key] = d.gen
+	return d, nil
+}
+
+// PrepareDirIVMoveAt must be called before the directory opened at "dirfd"
+// is renamed from "oldCName" to "newCName". It writes the gocryptfs.diriv
+// file for the new name to gocryptfs.diriv.next, where CommitDirIVMoveAt
+// picks it up after the rename. If the rename fails, call AbortDirIVMoveAt.
+//
+// Does nothing without EnableDirIVAuth.
+func (n *NameTransform) PrepareDirIVMoveAt(dirfd int, oldCName string, newCName string) error {
+	if !n.dirIVAuth {
+		return nil
+	}
+	d, err := n.verifyAuthDirIVAt(dirfd, oldCName)
+	if err != nil {
+		return err
+	}
+	// Remove leftovers from an earlier, failed, attempt
+	syscallcompat.Unlinkat(dirfd, DirIVNextFilename, 0)
+	return n.writeAuthDirIVAt(dirfd, DirIVNextFilename, newCName, d.iv, d.gen+1)
+}
+
+// CommitDirIVMoveAt replaces gocryptfs.diriv with gocryptfs.diriv.next after
+// the directory opened at "dirfd" has been renamed.
+func (n *NameTransform) CommitDirIVMoveAt(dirfd int) error {
+	if !n.dirIVAuth {
+		return nil
+	}
+	err := syscallcompat.Renameat(dirfd, DirIVNextFilename, dirfd, DirIVFilename)
+	if err == syscall.ENOENT {
+		// VerifyDirIVAt has already done it
+		return nil
+	}
+	return err
+}
+
+// AbortDirIVMoveAt deletes gocryptfs.diriv.next after a failed rename.
+func (n *NameTransform) AbortDirIVMoveAt(dirfd int) {
+	if !n.dirIVAuth {
+		return
+	}
+	syscallcompat.Unlinkat(dirfd, DirIVNextFilename, 0)
+}
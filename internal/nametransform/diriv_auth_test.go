@@ -0,0 +1,108 @@
+package nametransform
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+)
+
+func newDirIVAuthTestInstance(t *testing.T) (n *NameTransform, dirfd int, dir string) {
+	n = newFilenameAuthTestInstance(filenameauth.NewEmbedded(make([]byte, cryptocore.KeyLen)))
+	n.EnableDirIVAuth()
+	dir = t.TempDir()
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(dirfd) })
+	return n, dirfd, dir
+}
+
+// TestDirIVAuthBinding checks that an authenticated gocryptfs.diriv file is
+// only accepted for the directory it was created for.
+func TestDirIVAuthBinding(t *testing.T) {
+	n, dirfd, _ := newDirIVAuthTestInstance(t)
+	if err := n.CreateDirIVAt(dirfd, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	iv, err := n.VerifyDirIVAt(dirfd, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv2, err := n.ReadDirIVAt(dirfd)
+	if err != nil || !bytes.Equal(iv, iv2) {
+		t.Errorf("ReadDirIVAt returned %x, %v, want %x", iv2, err, iv)
+	}
+	if _, err = n.VerifyDirIVAt(dirfd, "bar"); err != syscall.EIO {
+		t.Errorf("want EIO for the wrong directory, have %v", err)
+	}
+}
+
+// TestDirIVAuthMove checks renaming including recovery from a crash between
+// the rename and CommitDirIVMoveAt, and that rolling back gocryptfs.diriv
+// afterwards is detected.
+func TestDirIVAuthMove(t *testing.T) {
+	n, dirfd, dir := newDirIVAuthTestInstance(t)
+	if err := n.CreateDirIVAt(dirfd, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.ReadFile(dir + "/" + DirIVFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.VerifyDirIVAt(dirfd, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.PrepareDirIVMoveAt(dirfd, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a crash before CommitDirIVMoveAt
+	if _, err = n.VerifyDirIVAt(dirfd, "bar"); err != nil {
+		t.Fatalf("interrupted rename was not completed: %v", err)
+	}
+	if _, err = os.Stat(dir + "/" + DirIVNextFilename); !os.IsNotExist(err) {
+		t.Errorf("%s should be gone, have %v", DirIVNextFilename, err)
+	}
+	if err = n.CommitDirIVMoveAt(dirfd); err != nil {
+		t.Errorf("CommitDirIVMoveAt after recovery: %v", err)
+	}
+	// Move it back and restore the old file, which is bound to "foo" as well
+	if err = n.PrepareDirIVMoveAt(dirfd, "bar", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err = n.CommitDirIVMoveAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.VerifyDirIVAt(dirfd, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(dir + "/" + DirIVFilename)
+	if err = os.WriteFile(dir+"/"+DirIVFilename, old, 0400); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = n.VerifyDirIVAt(dirfd, "foo"); err != syscall.EIO {
+		t.Errorf("want EIO for rolled back %s, have %v", DirIVFilename, err)
+	}
+}
+
+// TestDirIVAuthAbort checks that a failed rename leaves no trace.
+func TestDirIVAuthAbort(t *testing.T) {
+	n, dirfd, dir := newDirIVAuthTestInstance(t)
+	if err := n.CreateDirIVAt(dirfd, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.PrepareDirIVMoveAt(dirfd, "foo", "bar"); err != nil {
+		t.Fatal(err)
+	}
+	n.AbortDirIVMoveAt(dirfd)
+	if _, err := os.Stat(dir + "/" + DirIVNextFilename); !os.IsNotExist(err) {
+		t.Errorf("%s should be gone, have %v", DirIVNextFilename, err)
+	}
+	if _, err := n.VerifyDirIVAt(dirfd, "foo"); err != nil {
+		t.Error(err)
+	}
+}
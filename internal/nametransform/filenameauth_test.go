@@ -0,0 +1,102 @@
+package nametransform
+
+import (
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+)
+
+func newFilenameAuthTestInstance(fa *filenameauth.FilenameAuth) *NameTransform {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
+	return New(cCore.EMECipher, true, 0, true, nil, false, fa)
+}
+
+// TestEmbeddedAuth checks that embedded tags round-trip, are detected when
+// tampered with, and bind the name to the directory IV.
+func TestEmbeddedAuth(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	n := newFilenameAuthTestInstance(filenameauth.NewEmbedded(key))
+	iv := make([]byte, 16)
+	for _, name := range []string{"x", "hello.txt", strings.Repeat("y", NameMax)} {
+		cName, err := n.EncryptName(name, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(cName, ".") {
+			t.Errorf("embedded mode should not append a MAC: %q", cName)
+		}
+		plain, err := n.DecryptName(cName, iv)
+		if err != nil || plain != name {
+			t.Errorf("round-trip failed: have %q, %v", plain, err)
+		}
+		iv2 := make([]byte, 16)
+		iv2[0] = 1
+		if _, err = n.DecryptName(cName, iv2); err == nil {
+			t.Errorf("name was accepted in another directory")
+		}
+	}
+	// An unauthenticated name must be rejected
+	plainNT := newFilenameAuthTestInstance(nil)
+	cName, _ := plainNT.EncryptName("hello.txt", iv)
+	if _, err := n.DecryptName(cName, iv); err != syscall.EBADMSG {
+		t.Errorf("unauthenticated name: want EBADMSG, got %v", err)
+	}
+}
+
+// TestEmbeddedAuthLength checks that embedded tags make names shorter than
+// the legacy format, so that fewer names have to be hashed.
+func TestEmbeddedAuthLength(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	legacy := newFilenameAuthTestInstance(filenameauth.New(key, true))
+	embedded := newFilenameAuthTestInstance(filenameauth.NewEmbedded(key))
+	iv := make([]byte, 16)
+	for l := 1; l <= NameMax; l++ {
+		name := strings.Repeat("x", l)
+		l1, _ := legacy.EncryptName(name, iv)
+		l2, _ := embedded.EncryptName(name, iv)
+		if len(l2) >= len(l1) {
+			t.Errorf("l=%d: embedded=%d >= legacy=%d", l, len(l2), len(l1))
+		}
+	}
+}
+
+// TestReadLongNameAtLegacyAuth checks that the .name file of a 255-byte name
+// in the legacy format can be read back.
+func TestReadLongNameAtLegacyAuth(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	n := newFilenameAuthTestInstance(filenameauth.New(key, true))
+	dir := t.TempDir()
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	iv, err := n.ReadDirIVAt(dirfd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.Repeat("x", NameMax)
+	hashName, err := n.EncryptAndHashName(name, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = n.WriteLongNameAt(dirfd, hashName, name); err != nil {
+		t.Fatal(err)
+	}
+	cName, err := ReadLongNameAt(dirfd, hashName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := n.DecryptName(cName, iv)
+	if err != nil || plain != name {
+		t.Errorf("have %q, %v", plain, err)
+	}
+}
@@ -0,0 +1,36 @@
+package nametransform
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// FingerprintXattr is the xattr on the gocryptfs.diriv file in the
+// CIPHERDIR root that holds the fingerprint of the master key (see
+// configfile.KeyFingerprint). Like gocryptfs.diriv itself, it is not
+// visible in the plaintext view.
+const FingerprintXattr = "user.gocryptfs.fingerprint"
+
+// ReadRootFingerprint returns the master key fingerprint that is stored in
+// "cipherdir", or nil if there is none. There is none if the root directory
+// has no gocryptfs.diriv (-plaintextnames, -deterministic-names), if the
+// backing filesystem does not support xattrs, or if the filesystem was
+// created before fingerprints existed and has not been mounted read-write
+// since.
+func ReadRootFingerprint(cipherdir string) []byte {
+	fp, err := syscallcompat.Lgetxattr(filepath.Join(cipherdir, DirIVFilename), FingerprintXattr)
+	if err != nil || len(fp) == 0 {
+		return nil
+	}
+	return fp
+}
+
+// WriteRootFingerprint stores the master key fingerprint "fp" in
+// "cipherdir". Fails with ENOENT if the root directory has no
+// gocryptfs.diriv.
+func WriteRootFingerprint(cipherdir string, fp []byte) error {
+	return unix.Lsetxattr(filepath.Join(cipherdir, DirIVFilename), FingerprintXattr, fp, 0)
+}
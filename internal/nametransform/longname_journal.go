@@ -0,0 +1,166 @@
+package nametransform
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// JournalDirName is the directory in the CIPHERDIR root that holds the
+// intent records of LongNameJournal. Ignored in directory listings.
+const JournalDirName = "gocryptfs.journal"
+
+// LongNameJournal makes operations on long name pairs (the content file
+// "gocryptfs.longname.XYZ" and its "gocryptfs.longname.XYZ.name" file)
+// atomic across crashes.
+//
+// Operations on a pair are ordered so that a crash can only leave a ".name"
+// file without its content file behind, never the other way round: the
+// ".name" file is created before and deleted after the content file.
+// Before such an operation, Begin records the pair in a small file in
+// CIPHERDIR/gocryptfs.journal. Replay, run at mount time, deletes the
+// ".name" files of the recorded pairs whose content file does not exist.
+type LongNameJournal struct {
+	cipherdir string
+	// dirExists is set once the journal directory has been created
+	dirExists atomic.Bool
+}
+
+// NewLongNameJournal returns the journal for "cipherdir", which must be an
+// absolute path.
+func NewLongNameJournal(cipherdir string) *LongNameJournal {
+	return &LongNameJournal{cipherdir: cipherdir}
+}
+
+// Begin records an operation on the long name pair "cName" in the
+// directory "cDir" (relative to the CIPHERDIR). The record is on disk when
+// Begin returns. The returned function deletes the record and must be
+// called once the operation is done, whether it succeeded or not.
+func (j *LongNameJournal) Begin(cDir string, cName string) (done func(), err error) {
+	dir := filepath.Join(j.cipherdir, JournalDirName)
+	if !j.dirExists.Load() {
+		if err = os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		j.dirExists.Store(true)
+	}
+	entry := filepath.Join(dir, hex.EncodeToString(cryptocore.RandBytes(8)))
+	f, err := os.OpenFile(entry, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(filepath.Join(cDir, cName))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.Remove(entry)
+		return nil, err
+	}
+	return func() {
+		if err := os.Remove(entry); err != nil {
+			tlog.Warn.Printf("LongNameJournal: %v", err)
+		}
+	}, nil
+}
+
+// Replay completes the operations recorded by an earlier mount that did not
+// finish, and removes the journal directory. Must be called before the
+// filesystem is used. Returns the number of orphaned ".name" files that
+// have been deleted.
+func (j *LongNameJournal) Replay() (fixed int, err error) {
+	dir := filepath.Join(j.cipherdir, JournalDirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		entry := filepath.Join(dir, e.Name())
+		buf, err := os.ReadFile(entry)
+		if err != nil {
+			return fixed, err
+		}
+		ok, err := j.replayOne(string(buf))
+		if err != nil {
+			return fixed, err
+		}
+		if ok {
+			fixed++
+		}
+		if err = os.Remove(entry); err != nil {
+			return fixed, err
+		}
+	}
+	return fixed, j.Close()
+}
+
+// replayOne deletes the ".name" file of the pair "cPath" if its content file
+// does not exist.
+func (j *LongNameJournal) replayOne(cPath string) (fixed bool, err error) {
+	cDir, cName := filepath.Split(cPath)
+	if filepath.IsAbs(cPath) || strings.Contains(cPath, "..") || !IsLongContent(cName) {
+		tlog.Warn.Printf("LongNameJournal: ignoring invalid record %q", cPath)
+		return false, nil
+	}
+	dirfd, err := syscallcompat.OpenDirNofollow(j.cipherdir, strings.TrimSuffix(cDir, "/"))
+	if err == syscall.ENOENT || err == syscall.ENOTDIR {
+		// The directory has been deleted, together with the pair
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer syscall.Close(dirfd)
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != syscall.ENOENT {
+		// Content file exists (or we cannot tell), keep the .name file
+		return false, nil
+	}
+	err = syscallcompat.Unlinkat(dirfd, cName+LongNameSuffix, 0)
+	if err == syscall.ENOENT {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	tlog.Info.Printf("LongNameJournal: deleted orphaned %s%s", cPath, LongNameSuffix)
+	return true, nil
+}
+
+// Close removes the journal directory if it is empty, so that it only
+// exists while the filesystem is mounted or after a crash.
+func (j *LongNameJournal) Close() error {
+	err := syscall.Rmdir(filepath.Join(j.cipherdir, JournalDirName))
+	switch err {
+	case nil, syscall.ENOENT:
+		j.dirExists.Store(false)
+		return nil
+	case syscall.ENOTEMPTY, syscall.EEXIST:
+		return nil
+	}
+	return err
+}
+
+// syncDir fsyncs directory "dir".
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,47 @@
+package nametransform
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestLongNameJournalReplay simulates a crash in the middle of two long name
+// operations and checks that Replay only deletes the orphaned ".name" file.
+func TestLongNameJournalReplay(t *testing.T) {
+	cipherdir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(cipherdir, "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	orphan := "gocryptfs.longname.LkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU="
+	pair := "gocryptfs.longname.MkwUdALvV_ANnzQN6ZZMYnxxfARD3IeZWCKnxGJjYmU="
+	j := NewLongNameJournal(cipherdir)
+	for _, n := range []string{orphan, pair} {
+		if _, err := j.Begin("dir", n); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(cipherdir, "dir", n+LongNameSuffix), nil, 0400); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(cipherdir, "dir", pair), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fixed, err := NewLongNameJournal(cipherdir).Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fixed != 1 {
+		t.Errorf("want 1 fixed, have %d", fixed)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, "dir", orphan+LongNameSuffix)); !os.IsNotExist(err) {
+		t.Errorf("orphaned .name file was not deleted: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, "dir", pair+LongNameSuffix)); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(cipherdir, JournalDirName)); !os.IsNotExist(err) {
+		t.Errorf("journal directory was not removed: %v", err)
+	}
+}
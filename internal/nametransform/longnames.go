@@ -69,6 +69,19 @@ func IsLongContent(cName string) bool {
 	return NameType(cName) == LongNameContent
 }
 
+// IsContentName returns true if the file "cName" in CIPHERDIR holds file
+// content, as opposed to the files that gocryptfs keeps next to it, like
+// gocryptfs.diriv, gocryptfs.longname.*.name or gocryptfs.conf. Encrypted
+// names cannot contain a dot.
+//
+// This function does not do any I/O.
+func IsContentName(cName string) bool {
+	if NameType(cName) == LongNameContent {
+		return true
+	}
+	return !strings.HasPrefix(cName, "gocryptfs.") && !strings.HasPrefix(cName, ".gocryptfs")
+}
+
 // RemoveLongNameSuffix removes the ".name" suffix from cName, returning the corresponding
 // content file name.
 // No check is made if cName actually is a LongNameFilename.
@@ -91,8 +104,11 @@ func ReadLongNameAt(dirfd int, cName string) (string, error) {
 		// fd runs out of scope here
 	}
 	defer f.Close()
-	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA=="
-	lim := 344
+	// 256 (=255 padded to 16) bytes base64-encoded take 344 bytes: "AAAAAAA...AAA==".
+	// With embedded filename authentication, 272 (=255+16 padded to 16)
+	// bytes take 364 bytes. Legacy filename authentication appends "." and
+	// a 44-byte MAC to the 344 bytes.
+	lim := 344 + 1 + 44
 	// Allocate a bigger buffer so we see whether the file is too big
 	buf := make([]byte, lim+1)
 	n, err := f.ReadAt(buf, 0)
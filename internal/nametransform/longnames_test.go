@@ -36,7 +36,7 @@ func TestRemoveLongNameSuffix(t *testing.T) {
 func newLognamesTestInstance(longNameMax uint8) *NameTransform {
 	key := make([]byte, cryptocore.KeyLen)
 	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
-	return New(cCore.EMECipher, true, longNameMax, true, nil, false)
+	return New(cCore.EMECipher, true, longNameMax, true, nil, false, nil)
 }
 
 func TestLongNameMax(t *testing.T) {
@@ -69,3 +69,20 @@ func TestLongNameMax(t *testing.T) {
 		}
 	}
 }
+
+func TestIsContentName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"8E7dXTnEsKPTt4xmU5HsuQ":      true,
+		"gocryptfs.longname.abc":      true,
+		"gocryptfs.longname.abc.name": false,
+		DirIVFilename:                 false,
+		"gocryptfs.conf":              false,
+		".gocryptfs.reverse.conf":     false,
+		ManifestFilename:              false,
+		DirIVFilename + "x":           false,
+	} {
+		if have := IsContentName(name); have != want {
+			t.Errorf("%q: have %v, want %v", name, have, want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package nametransform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// SymlinkMax is the longest symlink target that Linux can store
+// (PATH_MAX - 1). Encrypted targets are about 4/3 of the plaintext target
+// plus 32 bytes, so plaintext targets above about 3000 bytes do not fit.
+const SymlinkMax = 4095
+
+// LongSymlinkDirName is the directory in the CIPHERDIR root that holds the
+// encrypted targets of symlinks that are longer than SymlinkMax, with the
+// LongSymlinks feature flag. Ignored in directory listings.
+const LongSymlinkDirName = "gocryptfs.longsymlinks"
+
+// LongSymlinkPrefix starts the backing target of a symlink whose encrypted
+// target is stored in LongSymlinkDirName. The rest is the hex SHA256 of the
+// encrypted target, which is also the name of the file it is stored in.
+// Encrypted targets are base64 and never contain a dot, so they cannot be
+// mistaken for such a reference.
+const LongSymlinkPrefix = "gocryptfs.longsymlink."
+
+// LongSymlinkRef returns the backing target that refers to the encrypted
+// target "cTarget"
+func LongSymlinkRef(cTarget string) string {
+	h := sha256.Sum256([]byte(cTarget))
+	return LongSymlinkPrefix + hex.EncodeToString(h[:])
+}
+
+// IsLongSymlinkRef returns true if the backing target "target" refers to a
+// file in LongSymlinkDirName
+func IsLongSymlinkRef(target string) bool {
+	h := strings.TrimPrefix(target, LongSymlinkPrefix)
+	if h == target || len(h) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(h)
+	return err == nil
+}
+
+// LongSymlinkPath returns the path of the file that the reference "ref"
+// refers to
+func LongSymlinkPath(cipherdir string, ref string) string {
+	return filepath.Join(cipherdir, LongSymlinkDirName, strings.TrimPrefix(ref, LongSymlinkPrefix))
+}
+
+// WriteLongSymlink stores the encrypted symlink target "cTarget" in
+// LongSymlinkDirName and returns the reference to use as the backing target.
+// Files are named after their content, so symlinks with the same target
+// share one file, and the file is on disk when WriteLongSymlink returns.
+func WriteLongSymlink(cipherdir string, cTarget string) (ref string, err error) {
+	ref = LongSymlinkRef(cTarget)
+	dir := filepath.Join(cipherdir, LongSymlinkDirName)
+	if err = os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	path := LongSymlinkPath(cipherdir, ref)
+	if have, err := ReadLongSymlink(cipherdir, ref); err == nil && have == cTarget {
+		return ref, nil
+	}
+	tmp := fmt.Sprintf("%s.%s.tmp", path, hex.EncodeToString(cryptocore.RandBytes(8)))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(cTarget)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return ref, nil
+}
+
+// ReadLongSymlink returns the encrypted symlink target that the reference
+// "ref" refers to. Fails if the file is missing, or if its content does not
+// match its name.
+func ReadLongSymlink(cipherdir string, ref string) (cTarget string, err error) {
+	buf, err := os.ReadFile(LongSymlinkPath(cipherdir, ref))
+	if err != nil {
+		return "", err
+	}
+	cTarget = string(buf)
+	if LongSymlinkRef(cTarget) != ref {
+		return "", fmt.Errorf("%s: content does not match the name", LongSymlinkPath(cipherdir, ref))
+	}
+	return cTarget, nil
+}
@@ -0,0 +1,40 @@
+package nametransform
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLongSymlink(t *testing.T) {
+	dir := t.TempDir()
+	cTarget := strings.Repeat("A", SymlinkMax+100)
+	ref, err := WriteLongSymlink(dir, cTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsLongSymlinkRef(ref) {
+		t.Errorf("%q is not recognized", ref)
+	}
+	// Writing the same target again reuses the file
+	if ref2, err := WriteLongSymlink(dir, cTarget); err != nil || ref2 != ref {
+		t.Errorf("have %q, %v", ref2, err)
+	}
+	if have, err := ReadLongSymlink(dir, ref); err != nil || have != cTarget {
+		t.Errorf("have %d bytes, %v", len(have), err)
+	}
+	// Changed content is detected
+	path := LongSymlinkPath(dir, ref)
+	os.Chmod(path, 0600)
+	if err = os.WriteFile(path, []byte(cTarget+"B"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadLongSymlink(dir, ref); err == nil {
+		t.Error("changed content was not detected")
+	}
+	for _, target := range []string{"", "gocryptfs.longsymlink.", "gocryptfs.longsymlink.xyz", ref[1:], "AAAA-_"} {
+		if IsLongSymlinkRef(target) {
+			t.Errorf("%q was recognized", target)
+		}
+	}
+}
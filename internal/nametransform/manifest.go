@@ -0,0 +1,310 @@
+package nametransform
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
+)
+
+const (
+	// ManifestFilename is the name of the directory manifest. See Manifest.
+	ManifestFilename = "gocryptfs.manifest"
+	// ManifestTmpName is where a new manifest is written before it is
+	// renamed over the old one.
+	ManifestTmpName = ManifestFilename + ".tmp"
+	// manifestMagic identifies the on-disk format version
+	manifestMagic = "GCMANIF2"
+	// manifestMagicV1 is the format without file IDs, which we still read
+	manifestMagicV1 = "GCMANIF1"
+	// manifestMaxSize limits how much we read from a manifest file
+	manifestMaxSize = 64 * 1024 * 1024
+	// Permissions for gocryptfs.manifest files. Like gocryptfs.diriv, and
+	// the file is never modified in place but replaced via rename.
+	manifestPerms = 0444
+)
+
+// ErrManifestAuth is returned by ReadManifestAt when the MAC does not match.
+var ErrManifestAuth = errors.New("manifest authentication failed")
+
+// Manifest lists the entries of a directory. It is stored in
+// "gocryptfs.manifest" together with a MAC over the content and the
+// directory IV. This allows to detect deleted entries and entries that
+// have been restored from an older copy of the directory, which the
+// per-name MACs cannot catch.
+//
+// Regular files are also bound to their file ID, so that a file that has
+// been replaced by an older copy of itself, or of another file, is caught
+// as well. The file ID is set when the file is created and stays the same
+// until it is deleted: with manifests, the file header is written right
+// away and kept on truncate.
+//
+// Only the ciphertext names of entries are listed, not gocryptfs.diriv,
+// gocryptfs.conf, the manifest itself, or the longname .name files, which
+// are covered by the MAC in the encrypted name they store.
+type Manifest struct {
+	// Entries maps ciphertext names to their file type (S_IFMT bits).
+	Entries map[string]uint32
+	// Pending counts operations that are in progress on an entry. It is
+	// incremented before the operation and decremented afterwards. The
+	// state of entries with a nonzero count is unknown: they may or may not
+	// exist, which is what allows a crash in the middle of an operation.
+	Pending map[string]uint32
+	// IDs maps the ciphertext names of regular files to their file IDs.
+	// Files without a header, like files created by mknod, have no entry.
+	IDs map[string][]byte
+}
+
+// NewManifest returns an empty Manifest.
+func NewManifest() *Manifest {
+	return &Manifest{
+		Entries: make(map[string]uint32),
+		Pending: make(map[string]uint32),
+		IDs:     make(map[string][]byte),
+	}
+}
+
+// IsManifestName returns true if cName is the manifest or a temporary file
+// used while writing or deleting it.
+func IsManifestName(cName string) bool {
+	return strings.HasPrefix(cName, ManifestFilename)
+}
+
+// marshal serializes the manifest with sorted keys, so that the output is
+// deterministic.
+func (m *Manifest) marshal() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(manifestMagic)
+	writeMap := func(mp map[string]uint32) {
+		keys := make([]string, 0, len(mp))
+		for k := range mp {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(keys))))
+		for _, k := range keys {
+			buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(k))))
+			buf.WriteString(k)
+			buf.Write(binary.BigEndian.AppendUint32(nil, mp[k]))
+		}
+	}
+	writeMap(m.Entries)
+	writeMap(m.Pending)
+	keys := make([]string, 0, len(m.IDs))
+	for k := range m.IDs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(keys))))
+	for _, k := range keys {
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(k))))
+		buf.WriteString(k)
+		buf.WriteByte(byte(len(m.IDs[k])))
+		buf.Write(m.IDs[k])
+	}
+	return buf.Bytes()
+}
+
+// unmarshalManifest parses the output of marshal. Manifests in the old
+// format have no file IDs.
+func unmarshalManifest(body []byte) (*Manifest, error) {
+	v1 := bytes.HasPrefix(body, []byte(manifestMagicV1))
+	if !v1 && !bytes.HasPrefix(body, []byte(manifestMagic)) {
+		return nil, fmt.Errorf("bad magic")
+	}
+	body = body[len(manifestMagic):]
+	readMap := func() (map[string]uint32, error) {
+		if len(body) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		count := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		mp := make(map[string]uint32)
+		for i := uint32(0); i < count; i++ {
+			if len(body) < 2 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			l := int(binary.BigEndian.Uint16(body))
+			body = body[2:]
+			if len(body) < l+4 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			mp[string(body[:l])] = binary.BigEndian.Uint32(body[l:])
+			body = body[l+4:]
+		}
+		return mp, nil
+	}
+	var m Manifest
+	var err error
+	if m.Entries, err = readMap(); err != nil {
+		return nil, err
+	}
+	if m.Pending, err = readMap(); err != nil {
+		return nil, err
+	}
+	m.IDs = make(map[string][]byte)
+	if !v1 {
+		if len(body) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		count := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		for i := uint32(0); i < count; i++ {
+			if len(body) < 2 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			l := int(binary.BigEndian.Uint16(body))
+			body = body[2:]
+			if len(body) < l+1 || len(body) < l+1+int(body[l]) {
+				return nil, io.ErrUnexpectedEOF
+			}
+			idLen := int(body[l])
+			m.IDs[string(body[:l])] = append([]byte{}, body[l+1:l+1+idLen]...)
+			body = body[l+1+idLen:]
+		}
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(body))
+	}
+	return &m, nil
+}
+
+// ReadManifestAt reads and authenticates "gocryptfs.manifest" in the
+// directory opened at "dirfd". "iv" is the directory IV.
+//
+// Symlink-safe through use of Openat().
+func ReadManifestAt(dirfd int, fa *filenameauth.FilenameAuth, iv []byte) (*Manifest, error) {
+	fd, err := syscallcompat.Openat(dirfd, ManifestFilename, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), ManifestFilename)
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, manifestMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > manifestMaxSize {
+		return nil, fmt.Errorf("ReadManifestAt: file too big")
+	}
+	if len(data) < filenameauth.FilenameAuthMACLen {
+		return nil, fmt.Errorf("ReadManifestAt: file too short")
+	}
+	body := data[:len(data)-filenameauth.FilenameAuthMACLen]
+	mac := data[len(body):]
+	if !hmac.Equal(mac, fa.ManifestMAC(iv, body)) {
+		return nil, ErrManifestAuth
+	}
+	m, err := unmarshalManifest(body)
+	if err != nil {
+		return nil, fmt.Errorf("ReadManifestAt: %v", err)
+	}
+	return m, nil
+}
+
+// WriteManifestAt writes "m" to "gocryptfs.manifest" in the directory
+// opened at "dirfd". The manifest is written to a temporary file first and
+// renamed over the old one, so readers always see a complete manifest.
+//
+// The caller must make sure that there is only one writer per directory.
+func WriteManifestAt(dirfd int, fa *filenameauth.FilenameAuth, iv []byte, m *Manifest) error {
+	body := m.marshal()
+	data := append(body, fa.ManifestMAC(iv, body)...)
+	// Remove leftovers from a crash
+	syscallcompat.Unlinkat(dirfd, ManifestTmpName, 0)
+	fd, err := syscallcompat.Openat(dirfd, ManifestTmpName,
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, manifestPerms)
+	if err != nil {
+		tlog.Warn.Printf("WriteManifestAt: Openat: %v", err)
+		return err
+	}
+	f := os.NewFile(uintptr(fd), ManifestTmpName)
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, ManifestTmpName, dirfd, ManifestFilename)
+	}
+	if err != nil {
+		if !syscallcompat.IsENOSPC(err) {
+			tlog.Warn.Printf("WriteManifestAt: %v", err)
+		}
+		syscallcompat.Unlinkat(dirfd, ManifestTmpName, 0)
+		return err
+	}
+	return nil
+}
+
+// ManifestIgnored returns true for directory entries that are not listed
+// in the manifest. "isRoot" is set for the top-level directory, which also
+// contains gocryptfs.conf and its backup copies, the dedup chunk store, the
+// snapshots, the trash, the key store and the tuning state.
+func ManifestIgnored(cName string, isRoot bool) bool {
+	switch {
+	case cName == "." || cName == "..":
+		return true
+	case cName == DirIVFilename || IsManifestName(cName):
+		return true
+	case strings.HasPrefix(cName, DirIVFilename+"."):
+		// gocryptfs.diriv.rmdir.XYZ left by Rmdir
+		return true
+	case NameType(cName) == LongNameFilename:
+		return true
+	case isRoot && (cName == configfile.ConfDefaultName || cName == dedup.DirName ||
+		cName == snapshot.DirName || cName == TrashDirName || cName == JournalDirName || cName == keystore.DirName ||
+		tuning.IsStateFile(cName) || configfile.IsBackupName(cName)):
+		return true
+	}
+	return false
+}
+
+// Verify compares the manifest to the actual directory content "have",
+// which maps ciphertext names to file types. Entries that ManifestIgnored
+// returns true for must not be included. "fileID" is called for the
+// regular files that have a file ID in the manifest and returns their
+// current file ID, or false if it cannot be read. Returns a description of
+// each mismatch.
+func (m *Manifest) Verify(have map[string]uint32, fileID func(cName string) ([]byte, bool)) (problems []string) {
+	for cName, typ := range m.Entries {
+		if m.Pending[cName] > 0 {
+			continue
+		}
+		haveTyp, ok := have[cName]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%q is missing", cName))
+		} else if haveTyp != typ {
+			problems = append(problems, fmt.Sprintf("%q has type %#o, want %#o", cName, haveTyp, typ))
+		} else if want := m.IDs[cName]; want != nil && typ == syscall.S_IFREG {
+			if id, ok := fileID(cName); ok && !bytes.Equal(id, want) {
+				problems = append(problems, fmt.Sprintf("%q has file ID %x, want %x", cName, id, want))
+			}
+		}
+	}
+	for cName := range have {
+		if _, ok := m.Entries[cName]; ok || m.Pending[cName] > 0 {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%q is not in the manifest", cName))
+	}
+	sort.Strings(problems)
+	return problems
+}
@@ -0,0 +1,165 @@
+package nametransform
+
+import (
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+)
+
+func TestManifestMarshal(t *testing.T) {
+	m := NewManifest()
+	m.Entries["foo"] = syscall.S_IFREG
+	m.Entries["bar"] = syscall.S_IFDIR
+	m.Pending["baz"] = 2
+	m.IDs["foo"] = []byte("0123456789abcdef")
+	m2, err := unmarshalManifest(m.marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("round-trip failed: have %v, want %v", m2, m)
+	}
+	// Truncated input must not panic
+	b := m.marshal()
+	for i := 0; i < len(b); i++ {
+		if _, err := unmarshalManifest(b[:i]); err == nil {
+			t.Errorf("truncated manifest (%d bytes) was accepted", i)
+		}
+	}
+	// Manifests in the old format have no file IDs
+	m.IDs = map[string][]byte{}
+	b = m.marshal()
+	b = append([]byte(manifestMagicV1), b[len(manifestMagic):len(b)-4]...)
+	if m2, err = unmarshalManifest(b); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("old format: have %v, want %v", m2, m)
+	}
+}
+
+func TestManifestReadWrite(t *testing.T) {
+	dir := t.TempDir()
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	fa := filenameauth.NewEmbedded(make([]byte, cryptocore.KeyLen))
+	iv := make([]byte, DirIVLen)
+	m := NewManifest()
+	m.Entries["foo"] = syscall.S_IFREG
+	// Write twice to check that the old manifest is replaced
+	for i := 0; i < 2; i++ {
+		if err = WriteManifestAt(dirfd, fa, iv, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m2, err := ReadManifestAt(dirfd, fa, iv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, m2) {
+		t.Errorf("have %v, want %v", m2, m)
+	}
+	// A manifest copied from another directory must be rejected
+	iv2 := make([]byte, DirIVLen)
+	iv2[0] = 1
+	if _, err = ReadManifestAt(dirfd, fa, iv2); err != ErrManifestAuth {
+		t.Errorf("wrong iv: want ErrManifestAuth, have %v", err)
+	}
+	// Tampered content must be rejected
+	path := dir + "/" + ManifestFilename
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(manifestMagic)+4+2] ^= 1
+	os.Chmod(path, 0600)
+	if err = os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadManifestAt(dirfd, fa, iv); err != ErrManifestAuth {
+		t.Errorf("tampered: want ErrManifestAuth, have %v", err)
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	m := NewManifest()
+	m.Entries["a"] = syscall.S_IFREG
+	m.Entries["b"] = syscall.S_IFDIR
+	m.Entries["c"] = syscall.S_IFREG
+	m.Pending["c"] = 1
+	m.Pending["d"] = 1
+	testCases := []struct {
+		have     map[string]uint32
+		problems int
+	}{
+		// Pending entries may or may not exist
+		{map[string]uint32{"a": syscall.S_IFREG, "b": syscall.S_IFDIR}, 0},
+		{map[string]uint32{"a": syscall.S_IFREG, "b": syscall.S_IFDIR, "c": syscall.S_IFREG, "d": syscall.S_IFLNK}, 0},
+		// Deleted entry
+		{map[string]uint32{"a": syscall.S_IFREG}, 1},
+		// Replaced by an entry of another type
+		{map[string]uint32{"a": syscall.S_IFLNK, "b": syscall.S_IFDIR}, 1},
+		// Restored entry
+		{map[string]uint32{"a": syscall.S_IFREG, "b": syscall.S_IFDIR, "e": syscall.S_IFREG}, 1},
+	}
+	for i, tc := range testCases {
+		problems := m.Verify(tc.have, func(string) ([]byte, bool) { return nil, false })
+		if len(problems) != tc.problems {
+			t.Errorf("case %d: want %d problems, have %v", i, tc.problems, problems)
+		}
+	}
+}
+
+// A file that has been replaced by an older copy has another file ID
+func TestManifestVerifyFileID(t *testing.T) {
+	m := NewManifest()
+	m.Entries["a"] = syscall.S_IFREG
+	m.Entries["b"] = syscall.S_IFREG
+	m.IDs["a"] = []byte("aaaaaaaaaaaaaaaa")
+	have := map[string]uint32{"a": syscall.S_IFREG, "b": syscall.S_IFREG}
+	ids := map[string][]byte{"a": []byte("aaaaaaaaaaaaaaaa"), "b": []byte("bbbbbbbbbbbbbbbb")}
+	fileID := func(cName string) ([]byte, bool) {
+		id, ok := ids[cName]
+		return id, ok
+	}
+	if problems := m.Verify(have, fileID); len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+	ids["a"] = []byte("0000000000000000")
+	if problems := m.Verify(have, fileID); len(problems) != 1 {
+		t.Errorf("older copy: want 1 problem, have %v", problems)
+	}
+	// Empty files have no file ID
+	ids["a"] = nil
+	if problems := m.Verify(have, fileID); len(problems) != 1 {
+		t.Errorf("empty file: want 1 problem, have %v", problems)
+	}
+	// The file ID cannot be read, there is nothing to compare
+	delete(ids, "a")
+	if problems := m.Verify(have, fileID); len(problems) != 0 {
+		t.Errorf("unreadable: unexpected problems: %v", problems)
+	}
+}
+
+func TestManifestIgnored(t *testing.T) {
+	ignored := []string{".", "..", DirIVFilename, ManifestFilename, ManifestTmpName,
+		DirIVFilename + ".rmdir.123", "gocryptfs.longname.abc.name"}
+	for _, n := range ignored {
+		if !ManifestIgnored(n, false) {
+			t.Errorf("%q should be ignored", n)
+		}
+	}
+	if ManifestIgnored("gocryptfs.conf", false) || !ManifestIgnored("gocryptfs.conf", true) {
+		t.Errorf("gocryptfs.conf should only be ignored in the root directory")
+	}
+	if ManifestIgnored("gocryptfs.longname.abc", false) {
+		t.Errorf("long name content files must be listed")
+	}
+}
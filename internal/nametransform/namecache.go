@@ -0,0 +1,112 @@
+package nametransform
+
+import (
+	"container/list"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultNameCacheSize is the default number of names NameCache holds.
+const DefaultNameCacheSize = 100000
+
+// NameCache caches decrypted directory entry names, so that listing a large
+// directory again does not decrypt every name (and read every
+// "gocryptfs.longname.*.name" file) again.
+//
+// The names of a directory are keyed by its DirIV and its device and inode
+// number, and are dropped when the mtime of the directory changes. The cache
+// holds at most maxEntries names. When it is full, the least recently used
+// directories are dropped.
+type NameCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	entries    int
+	dirs       map[NameCacheKey]*list.Element
+	// lru holds the *nameCacheDir values, most recently used first
+	lru *list.List
+}
+
+// NameCacheKey identifies a directory in the NameCache.
+type NameCacheKey struct {
+	DirIV string
+	Dev   uint64
+	Ino   uint64
+}
+
+type nameCacheDir struct {
+	key   NameCacheKey
+	mtime unix.Timespec
+	// names maps the names on disk to the plaintext names
+	names map[string]string
+}
+
+// NewNameCache returns a NameCache that holds at most "maxEntries" names.
+func NewNameCache(maxEntries int) *NameCache {
+	return &NameCache{
+		maxEntries: maxEntries,
+		dirs:       make(map[NameCacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// dir returns the cached directory "key" if its mtime is "mtime", and
+// removes it if not. Caller must hold c.mu.
+func (c *NameCache) dir(key NameCacheKey, mtime unix.Timespec) *nameCacheDir {
+	e := c.dirs[key]
+	if e == nil {
+		return nil
+	}
+	d := e.Value.(*nameCacheDir)
+	if d.mtime != mtime {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return d
+}
+
+// remove drops the cached directory "e". Caller must hold c.mu.
+func (c *NameCache) remove(e *list.Element) {
+	d := c.lru.Remove(e).(*nameCacheDir)
+	delete(c.dirs, d.key)
+	c.entries -= len(d.names)
+}
+
+// Get returns the plaintext name of "cName" in directory "key" with mtime
+// "mtime".
+func (c *NameCache) Get(key NameCacheKey, mtime unix.Timespec, cName string) (plainName string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.dir(key, mtime)
+	if d == nil {
+		return "", false
+	}
+	plainName, ok = d.names[cName]
+	return plainName, ok
+}
+
+// Put stores the plaintext name of "cName" in directory "key" with mtime
+// "mtime".
+func (c *NameCache) Put(key NameCacheKey, mtime unix.Timespec, cName string, plainName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.dir(key, mtime)
+	if d == nil {
+		d = &nameCacheDir{key: key, mtime: mtime, names: make(map[string]string)}
+		c.dirs[key] = c.lru.PushFront(d)
+	}
+	if _, ok := d.names[cName]; ok {
+		return
+	}
+	for c.entries >= c.maxEntries {
+		back := c.lru.Back()
+		if back.Value.(*nameCacheDir) == d {
+			// This directory alone fills the cache
+			return
+		}
+		c.remove(back)
+	}
+	d.names[cName] = plainName
+	c.entries++
+}
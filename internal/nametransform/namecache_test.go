@@ -0,0 +1,50 @@
+package nametransform
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestNameCache(t *testing.T) {
+	c := NewNameCache(3)
+	a := NameCacheKey{DirIV: "a", Ino: 1}
+	b := NameCacheKey{DirIV: "b", Ino: 2}
+	m1 := unix.Timespec{Sec: 1}
+	m2 := unix.Timespec{Sec: 2}
+
+	c.Put(a, m1, "x", "X")
+	c.Put(a, m1, "y", "Y")
+	if n, ok := c.Get(a, m1, "x"); !ok || n != "X" {
+		t.Errorf("Get: %q %v", n, ok)
+	}
+	if _, ok := c.Get(b, m1, "x"); ok {
+		t.Error("found name in wrong directory")
+	}
+	// Filling the cache drops the least recently used directory
+	c.Put(b, m1, "x", "BX")
+	c.Put(b, m1, "y", "BY")
+	if _, ok := c.Get(a, m1, "x"); ok {
+		t.Error("directory a was not dropped")
+	}
+	if n, _ := c.Get(b, m1, "y"); n != "BY" {
+		t.Errorf("directory b: %q", n)
+	}
+	if c.entries > 3 {
+		t.Errorf("too many entries: %d", c.entries)
+	}
+	// A new mtime drops the names
+	if _, ok := c.Get(b, m2, "x"); ok {
+		t.Error("found name after mtime change")
+	}
+	if c.entries != 0 || c.lru.Len() != 0 {
+		t.Errorf("entries=%d dirs=%d after mtime change", c.entries, c.lru.Len())
+	}
+	// A single directory cannot exceed the limit
+	for _, n := range []string{"1", "2", "3", "4"} {
+		c.Put(a, m1, n, n)
+	}
+	if c.entries != 3 {
+		t.Errorf("entries=%d", c.entries)
+	}
+}
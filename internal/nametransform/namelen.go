@@ -0,0 +1,57 @@
+package nametransform
+
+import (
+	"crypto/aes"
+	"encoding/base64"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+)
+
+// EncryptedNameLen returns the length of the encrypted name of a plaintext
+// name that is "plainLen" bytes long, before it is hashed. The length only
+// depends on the feature flags, so no key is needed.
+func (n *NameTransform) EncryptedNameLen(plainLen int) int {
+	l := plainLen
+	fa := n.filenameAuth
+	if fa != nil && fa.IsEmbedded() {
+		l += filenameauth.TagLen
+	}
+	// pad16 always adds at least one byte
+	l = (l/aes.BlockSize + 1) * aes.BlockSize
+	l = n.B64.EncodedLen(l)
+	if fa != nil && fa.IsEnabled() && !fa.IsEmbedded() {
+		l += len(filenameauth.FilenameAuthSeparator) +
+			base64.URLEncoding.EncodedLen(filenameauth.FilenameAuthMACLen)
+	}
+	return l
+}
+
+// NameLimits returns the longest plaintext name that can be stored when the
+// backing filesystem allows names of up to "backingMax" bytes ("max"), and
+// the longest plaintext name whose encrypted name is stored as-is
+// ("direct"). Names between the two are hashed to "gocryptfs.longname.*".
+func (n *NameTransform) NameLimits(backingMax int) (max int, direct int) {
+	limit := backingMax
+	if n.longNameMax < limit {
+		limit = n.longNameMax
+	}
+	for direct < NameMax && n.EncryptedNameLen(direct+1) <= limit {
+		direct++
+	}
+	// Hashing only helps if it happens before the backing filesystem
+	// rejects the name, and if "gocryptfs.longname.[sha256].name" fits
+	longNameFileLen := len(n.HashLongName("")) + len(LongNameSuffix)
+	if n.longNameMax <= backingMax && longNameFileLen <= backingMax {
+		return NameMax, direct
+	}
+	return direct, direct
+}
+
+// PlainNameLimits is NameLimits for filesystems with plaintext names
+func PlainNameLimits(backingMax int) (max int, direct int) {
+	max = NameMax
+	if backingMax < max {
+		max = backingMax
+	}
+	return max, max
+}
@@ -0,0 +1,65 @@
+package nametransform
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+)
+
+func newNameLenTestInstance(longNames bool, longNameMax uint8, raw64 bool, fa *filenameauth.FilenameAuth) *NameTransform {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
+	return New(cCore.EMECipher, longNames, longNameMax, raw64, nil, false, fa)
+}
+
+// EncryptedNameLen must match what EncryptName actually produces
+func TestEncryptedNameLen(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	iv := make([]byte, DirIVLen)
+	for _, fa := range []*filenameauth.FilenameAuth{nil, filenameauth.New(key, true), filenameauth.NewEmbedded(key)} {
+		for _, raw64 := range []bool{false, true} {
+			n := newNameLenTestInstance(true, 0, raw64, fa)
+			for l := 1; l <= NameMax; l++ {
+				cName, err := n.EncryptName(strings.Repeat("x", l), iv)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if have := n.EncryptedNameLen(l); have != len(cName) {
+					t.Fatalf("raw64=%v fa=%v l=%d: have %d, want %d", raw64, fa, l, have, len(cName))
+				}
+			}
+		}
+	}
+}
+
+func TestNameLimits(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	testCases := []struct {
+		desc       string
+		longNames  bool
+		fa         *filenameauth.FilenameAuth
+		backingMax int
+		max        int
+		direct     int
+	}{
+		{"default", true, nil, 255, 255, 175},
+		{"embedded auth", true, filenameauth.NewEmbedded(key), 255, 255, 159},
+		{"legacy auth", true, filenameauth.New(key, true), 255, 255, 143},
+		{"no long names", false, nil, 255, 175, 175},
+		// eCryptfs with encrypted names allows 143 bytes
+		{"short backing names", true, nil, 143, 95, 95},
+	}
+	for _, tc := range testCases {
+		n := newNameLenTestInstance(tc.longNames, 0, true, tc.fa)
+		max, direct := n.NameLimits(tc.backingMax)
+		if max != tc.max || direct != tc.direct {
+			t.Errorf("%s: have max=%d direct=%d, want max=%d direct=%d", tc.desc, max, direct, tc.max, tc.direct)
+		}
+	}
+	if max, direct := PlainNameLimits(143); max != 143 || direct != 143 {
+		t.Errorf("PlainNameLimits: max=%d direct=%d", max, direct)
+	}
+}
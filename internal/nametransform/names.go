@@ -8,10 +8,10 @@ import (
 	"math"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 
-	"github.com/rfjakob/eme"
-
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -23,7 +23,7 @@ const (
 
 // NameTransform is used to transform filenames.
 type NameTransform struct {
-	emeCipher *eme.EMECipher
+	emeCipher cryptocore.EME
 	// Names longer than `longNameMax` are hashed. Set to MaxInt when
 	// longnames are disabled.
 	longNameMax int
@@ -35,6 +35,12 @@ type NameTransform struct {
 	deterministicNames bool
 	// Optional filename authentication helper
 	filenameAuth *filenameauth.FilenameAuth
+	// dirIVAuth is set by EnableDirIVAuth
+	dirIVAuth bool
+	// dirIVGen maps directory IVs to the highest generation counter that
+	// VerifyDirIVAt has seen for them.
+	dirIVGen     map[string]uint64
+	dirIVGenLock sync.Mutex
 }
 
 // New returns a new NameTransform instance.
@@ -42,7 +48,7 @@ type NameTransform struct {
 // If `longNames` is set, names longer than `longNameMax` are hashed to
 // `gocryptfs.longname.[sha256]`.
 // Pass `longNameMax = 0` to use the default value (255).
-func New(e *eme.EMECipher, longNames bool, longNameMax uint8, raw64 bool, badname []string, deterministicNames bool, fa *filenameauth.FilenameAuth) *NameTransform {
+func New(e cryptocore.EME, longNames bool, longNameMax uint8, raw64 bool, badname []string, deterministicNames bool, fa *filenameauth.FilenameAuth) *NameTransform {
 	tlog.Debug.Printf("nametransform.New: longNameMax=%v, raw64=%v, badname=%q",
 		longNameMax, raw64, badname)
 	b64 := base64.URLEncoding
@@ -71,8 +77,8 @@ func New(e *eme.EMECipher, longNames bool, longNameMax uint8, raw64 bool, badnam
 // DecryptName calls decryptName to try and decrypt a base64-encoded encrypted
 // filename "cipherName", and failing that checks if it can be bypassed
 func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error) {
-	// If filename authentication is enabled, verify and strip MAC first
-	if n.filenameAuth != nil && n.filenameAuth.IsEnabled() {
+	// Legacy filename authentication: verify and strip the appended MAC first
+	if n.filenameAuth != nil && n.filenameAuth.IsEnabled() && !n.filenameAuth.IsEmbedded() {
 		var err error
 		cipherName, err = n.filenameAuth.VerifyFilename(cipherName)
 		if err != nil {
@@ -94,35 +100,58 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 }
 
 // decryptName decrypts a base64-encoded encrypted filename "cipherName" using the
-// initialization vector "iv".
+// initialization vector "iv", and verifies and strips the embedded
+// filename authentication tag, if enabled.
 func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error) {
+	bin, err := n.decryptNameEME(cipherName, iv)
+	if err != nil {
+		return "", err
+	}
+	if n.filenameAuth != nil && n.filenameAuth.IsEmbedded() {
+		// The shortest valid name is one byte
+		if len(bin) <= filenameauth.TagLen {
+			tlog.Warn.Printf("decryptName %q: too short for authentication tag", cipherName)
+			return "", syscall.EBADMSG
+		}
+		name := bin[:len(bin)-filenameauth.TagLen]
+		tag := bin[len(name):]
+		if err := n.filenameAuth.VerifyTag(iv, name, tag); err != nil {
+			tlog.Warn.Printf("decryptName %q: %v", cipherName, err)
+			return "", syscall.EBADMSG
+		}
+		bin = name
+	}
+	return string(bin), nil
+}
+
+// decryptNameEME base64-decodes, EME-decrypts and unpads "cipherName".
+func (n *NameTransform) decryptNameEME(cipherName string, iv []byte) ([]byte, error) {
 	// From https://pkg.go.dev/encoding/base64#Encoding.Strict :
 	// > Note that the input is still malleable, as new line characters
 	// > (CR and LF) are still ignored.
 	// Check for CR and LF ourselves.
 	if strings.ContainsAny(cipherName, "\r\n") {
-		return "", errors.New("characters CR or LF in base64")
+		return nil, errors.New("characters CR or LF in base64")
 	}
 	bin, err := n.B64.DecodeString(cipherName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	if len(bin) == 0 {
 		tlog.Warn.Printf("decryptName: empty input")
-		return "", syscall.EBADMSG
+		return nil, syscall.EBADMSG
 	}
 	if len(bin)%aes.BlockSize != 0 {
 		tlog.Debug.Printf("decryptName %q: decoded length %d is not a multiple of 16", cipherName, len(bin))
-		return "", syscall.EBADMSG
+		return nil, syscall.EBADMSG
 	}
 	bin = n.emeCipher.Decrypt(iv, bin)
 	bin, err = unPad16(bin)
 	if err != nil {
 		tlog.Warn.Printf("decryptName %q: unPad16 error: %v", cipherName, err)
-		return "", syscall.EBADMSG
+		return nil, syscall.EBADMSG
 	}
-	plain := string(bin)
-	return plain, err
+	return bin, nil
 }
 
 // EncryptName encrypts a file name "plainName" and returns a base64-encoded "cipherName64",
@@ -139,7 +168,7 @@ func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 s
 		return "", syscall.EBADMSG
 	}
 	enc := n.encryptName(plainName, iv)
-	if n.filenameAuth != nil && n.filenameAuth.IsEnabled() {
+	if n.filenameAuth != nil && n.filenameAuth.IsEnabled() && !n.filenameAuth.IsEmbedded() {
 		authName, err := n.filenameAuth.AuthenticateFilename(enc)
 		if err != nil {
 			return "", syscall.EBADMSG
@@ -151,10 +180,20 @@ func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 s
 
 // encryptName encrypts "plainName" and returns a base64-encoded "cipherName64",
 // encrypted using EME (https://github.com/rfjakob/eme).
+// With embedded filename authentication, the authentication tag is appended
+// to plainName before encryption.
 //
 // No checks for null bytes etc are performed against plainName.
 func (n *NameTransform) encryptName(plainName string, iv []byte) (cipherName64 string) {
 	bin := []byte(plainName)
+	if n.filenameAuth != nil && n.filenameAuth.IsEmbedded() {
+		bin = append(bin, n.filenameAuth.Tag(iv, bin)...)
+	}
+	return n.encryptNameEME(bin, iv)
+}
+
+// encryptNameEME pads, EME-encrypts and base64-encodes "bin".
+func (n *NameTransform) encryptNameEME(bin []byte, iv []byte) (cipherName64 string) {
 	bin = pad16(bin)
 	bin = n.emeCipher.Encrypt(iv, bin)
 	cipherName64 = n.B64.EncodeToString(bin)
@@ -198,6 +237,11 @@ func Dir(path string) string {
 	return d
 }
 
+// FilenameAuth returns the filename authentication helper, or nil.
+func (n *NameTransform) FilenameAuth() *filenameauth.FilenameAuth {
+	return n.filenameAuth
+}
+
 // GetLongNameMax will return curent `longNameMax`. File name longer than
 // this should be hashed.
 func (n *NameTransform) GetLongNameMax() int {
@@ -0,0 +1,78 @@
+package nametransform
+
+import (
+	"golang.org/x/text/unicode/norm"
+)
+
+// Normalization is the Unicode normalization form plaintext names are
+// converted to, set via "-nfc" or "-nfd". macOS creates names in NFD
+// (decomposed, "e" followed by a combining accent), Linux keeps them as
+// the application passes them, which is usually NFC (composed).
+type Normalization int
+
+const (
+	// NormalizeNone leaves names as they are
+	NormalizeNone Normalization = iota
+	// NormalizeNFC converts names to NFC
+	NormalizeNFC
+	// NormalizeNFD converts names to NFD
+	NormalizeNFD
+)
+
+// Apply returns "name" in normalization form f.
+func (f Normalization) Apply(name string) string {
+	switch f {
+	case NormalizeNFC:
+		return norm.NFC.String(name)
+	case NormalizeNFD:
+		return norm.NFD.String(name)
+	}
+	return name
+}
+
+// String returns the name of the form, like "NFC".
+func (f Normalization) String() string {
+	switch f {
+	case NormalizeNFC:
+		return "NFC"
+	case NormalizeNFD:
+		return "NFD"
+	}
+	return "none"
+}
+
+// NormalizationOf returns the form "name" is in. Names that are the same in
+// NFC and NFD, like all ASCII names, return NormalizeNone. So do names that
+// are in neither form, which happens when they mix both.
+func NormalizationOf(name string) Normalization {
+	nfc := norm.NFC.IsNormalString(name)
+	nfd := norm.NFD.IsNormalString(name)
+	switch {
+	case nfc && !nfd:
+		return NormalizeNFC
+	case nfd && !nfc:
+		return NormalizeNFD
+	}
+	return NormalizeNone
+}
+
+// NormalizationConflicts returns the groups of names in "names" that only
+// differ in their normalization. They look the same, but are different
+// directory entries, and only one of them can be reached with "-nfc" or
+// "-nfd".
+func NormalizationConflicts(names []string) [][]string {
+	groups := make(map[string][]string)
+	var order []string
+	for _, name := range names {
+		nfc := norm.NFC.String(name)
+		if len(groups[nfc]) == 1 {
+			order = append(order, nfc)
+		}
+		groups[nfc] = append(groups[nfc], name)
+	}
+	conflicts := make([][]string, 0, len(order))
+	for _, nfc := range order {
+		conflicts = append(conflicts, groups[nfc])
+	}
+	return conflicts
+}
@@ -0,0 +1,81 @@
+package nametransform
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+const (
+	// "é" as one code point (NFC) and as "e" + combining acute accent (NFD)
+	eNFC = "caf\u00e9"
+	eNFD = "cafe\u0301"
+)
+
+func TestNormalizationApply(t *testing.T) {
+	testCases := []struct {
+		f    Normalization
+		in   string
+		want string
+	}{
+		{NormalizeNone, eNFD, eNFD},
+		{NormalizeNFC, eNFD, eNFC},
+		{NormalizeNFC, eNFC, eNFC},
+		{NormalizeNFD, eNFC, eNFD},
+		{NormalizeNFD, "ascii", "ascii"},
+	}
+	for _, tc := range testCases {
+		if have := tc.f.Apply(tc.in); have != tc.want {
+			t.Errorf("%v.Apply(%q): have %q, want %q", tc.f, tc.in, have, tc.want)
+		}
+	}
+}
+
+func TestNormalizationOf(t *testing.T) {
+	testCases := map[string]Normalization{
+		eNFC:          NormalizeNFC,
+		eNFD:          NormalizeNFD,
+		"ascii":       NormalizeNone,
+		eNFC + eNFD:   NormalizeNone,
+		"\u00c5ngstr": NormalizeNFC,
+	}
+	for name, want := range testCases {
+		if have := NormalizationOf(name); have != want {
+			t.Errorf("%q: have %v, want %v", name, have, want)
+		}
+	}
+}
+
+func TestNormalizationConflicts(t *testing.T) {
+	have := NormalizationConflicts([]string{"a", eNFC, "b", eNFD, "c"})
+	want := [][]string{{eNFC, eNFD}}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have := NormalizationConflicts([]string{"a", eNFC}); len(have) != 0 {
+		t.Errorf("have %q, want no conflicts", have)
+	}
+}
+
+// A CaseIndex that folds to NFC finds names stored in NFD
+func TestCaseIndexNormalization(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, eNFD), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	c := NewCaseIndex(NormalizeNFC.Apply)
+	have, found, err := c.Lookup(dirfd, eNFC, func(cName string) (string, error) { return cName, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || have != eNFD {
+		t.Errorf("have %q %v, want %q", have, found, eNFD)
+	}
+}
@@ -8,7 +8,8 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
-// xattr names are encrypted like file names, but with a fixed IV.
+// xattr names are encrypted like file names, but with a fixed IV and without
+// filename authentication.
 // Padded with "_xx" for length 16.
 var xattrNameIV = []byte("xattr_name_iv_xx")
 
@@ -30,15 +31,17 @@ func (n *NameTransform) EncryptXattrName(plainName string) (cipherName64 string,
 		tlog.Warn.Printf("EncryptXattrName %q: invalid plainName: %v", plainName, err)
 		return "", syscall.EBADMSG
 	}
-	return n.encryptName(plainName, xattrNameIV), nil
+	return n.encryptNameEME([]byte(plainName), xattrNameIV), nil
 }
 
 // DecryptXattrName calls decryptName to try and decrypt a base64-encoded encrypted
 // filename "cipherName", and failing that checks if it can be bypassed
 func (n *NameTransform) DecryptXattrName(cipherName string) (plainName string, err error) {
-	if plainName, err = n.decryptName(cipherName, xattrNameIV); err != nil {
+	bin, err := n.decryptNameEME(cipherName, xattrNameIV)
+	if err != nil {
 		return "", err
 	}
+	plainName = string(bin)
 	if err := isValidXattrName(plainName); err != nil {
 		tlog.Warn.Printf("DecryptXattrName %q: invalid name after decryption: %v", cipherName, err)
 		return "", syscall.EBADMSG
@@ -8,6 +8,8 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
 	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 )
 
@@ -45,8 +47,15 @@ type Entry struct {
 	ContentLock countingMutex
 	// ID is the file ID in the file header.
 	ID []byte
-	// IDLock must be taken before reading or writing the ID field in this struct,
-	// unless you have an exclusive lock on ContentLock.
+	// Enc encrypts the content with the per-file data key of a version 3
+	// file header. nil if the file uses the key of the filesystem. Set and
+	// cleared together with ID.
+	Enc *contentenc.ContentEnc
+	// Recipe is set while the file content is stored in the dedup chunk
+	// store. ID is nil then.
+	Recipe *dedup.Recipe
+	// IDLock must be taken before reading or writing the ID or Recipe fields
+	// in this struct, unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
 }
 
@@ -65,6 +74,14 @@ func Register(qi inomap.QIno) *Entry {
 	return e
 }
 
+// Lookup returns the open file table entry for "qi", or nil if the file is
+// not open. Unlike Register, it does not take a reference.
+func Lookup(qi inomap.QIno) *Entry {
+	t.Lock()
+	defer t.Unlock()
+	return t.entries[qi]
+}
+
 // Unregister decrements the reference count for "qi" and deletes the entry from
 // the open file table if the reference count reaches 0.
 func Unregister(qi inomap.QIno) {
@@ -81,13 +98,23 @@ func Unregister(qi inomap.QIno) {
 // countingMutex incrementes t.writeLockCount on each Lock() call.
 type countingMutex struct {
 	sync.RWMutex
+	// writes counts the Lock() calls on this entry
+	writes uint64
 }
 
 func (c *countingMutex) Lock() {
 	c.RWMutex.Lock()
+	c.writes++
 	t.writeOpCount.Add(1)
 }
 
+// Writes returns the number of Lock() calls on this entry. Unlike
+// WriteOpCount, it is not affected by writes to other files. The caller must
+// hold the lock.
+func (c *countingMutex) Writes() uint64 {
+	return c.writes
+}
+
 // WriteOpCount returns the write lock counter value. This value is incremented
 // each time writeLock.Lock() on a file table entry is called.
 func WriteOpCount() uint64 {
@@ -101,3 +128,10 @@ func CountOpenFiles() int {
 	defer t.Unlock()
 	return len(t.entries)
 }
+
+// Shared returns true if the file is open more than once
+func (e *Entry) Shared() bool {
+	t.Lock()
+	defer t.Unlock()
+	return e.refCount > 1
+}
@@ -0,0 +1,764 @@
+package p9srv
+
+import (
+	"encoding/binary"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+)
+
+// 9P2000.L open flags. They are fixed by the protocol and differ from the
+// O_* constants on some architectures.
+const (
+	p9AccMode = 0x3
+	p9Trunc   = 0x200
+)
+
+// statfsMagic is the f_type reported by Rstatfs (V9FS_MAGIC)
+const statfsMagic = 0x01021997
+
+// qidOf returns the qid for a file with attributes "a".
+func qidOf(a *fuse.Attr) qid {
+	q := qid{typ: qtFile, path: a.Ino}
+	switch a.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		q.typ = qtDir
+	case syscall.S_IFLNK:
+		q.typ = qtSymlink
+	}
+	return q
+}
+
+// checkName rejects names that would leave the directory.
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return syscall.EINVAL
+	}
+	return nil
+}
+
+// toErr converts a fuse.Status to an error.
+func toErr(st fuse.Status) error {
+	if st == fuse.OK {
+		return nil
+	}
+	return syscall.Errno(st)
+}
+
+// Tversion: msize[4] version[s]
+func (c *conn) version(d *decoder, e *encoder) error {
+	msize := d.u32()
+	version := d.str()
+	if d.err != nil {
+		return nil
+	}
+	// Tversion aborts all outstanding I/O
+	c.clunkAll()
+	if msize > maxMsize {
+		msize = maxMsize
+	}
+	if msize < 4096 {
+		return syscall.EINVAL
+	}
+	c.msize = msize
+	if !strings.HasPrefix(version, "9P2000.L") {
+		version = "unknown"
+	} else {
+		version = "9P2000.L"
+	}
+	e.u32(msize)
+	e.str(version)
+	return nil
+}
+
+// Tattach: fid[4] afid[4] uname[s] aname[s] n_uname[4]
+func (c *conn) attach(d *decoder, e *encoder) error {
+	n := d.u32()
+	afid := d.u32()
+	d.str()
+	d.str()
+	d.u32()
+	if d.err != nil {
+		return nil
+	}
+	if afid != noFid {
+		return syscall.EOPNOTSUPP
+	}
+	if c.fids[n] != nil {
+		return syscall.EBADF
+	}
+	in := fuse.GetAttrIn{InHeader: c.header(fuse.FUSE_ROOT_ID)}
+	var out fuse.AttrOut
+	if st := c.s.raw.GetAttr(nil, &in, &out); !st.Ok() {
+		return toErr(st)
+	}
+	c.ref(fuse.FUSE_ROOT_ID)
+	c.fids[n] = &fid{nodeID: fuse.FUSE_ROOT_ID}
+	e.qid(qidOf(&out.Attr))
+	return nil
+}
+
+// Twalk: fid[4] newfid[4] nwname[2] nwname*(wname[s])
+func (c *conn) walk(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	newN := d.u32()
+	nwname := int(d.u16())
+	if err != nil || d.err != nil {
+		return err
+	}
+	if nwname > maxWalk {
+		return syscall.EINVAL
+	}
+	names := make([]string, nwname)
+	for i := range names {
+		names[i] = d.str()
+	}
+	if d.err != nil {
+		return nil
+	}
+	if f.open {
+		return syscall.EBADF
+	}
+	if old := c.fids[newN]; old != nil && old != f {
+		return syscall.EBADF
+	}
+	// Every node id in "ids" holds a fid reference
+	ids := []uint64{f.nodeID}
+	c.ref(f.nodeID)
+	release := func() {
+		for _, id := range ids {
+			c.unref(id)
+		}
+	}
+	var qids []qid
+	for _, name := range names {
+		err = checkName(name)
+		if err == nil {
+			hdr := c.header(ids[len(ids)-1])
+			var out fuse.EntryOut
+			if st := c.s.raw.Lookup(nil, &hdr, name, &out); st.Ok() {
+				c.gotLookup(out.NodeId)
+				ids = append(ids, out.NodeId)
+				qids = append(qids, qidOf(&out.Attr))
+				continue
+			} else {
+				err = toErr(st)
+			}
+		}
+		// If the first element fails, we return an error. Otherwise, we
+		// return the qids up to the failure and newfid is not created.
+		release()
+		if len(qids) == 0 {
+			return err
+		}
+		break
+	}
+	e.u16(uint16(len(qids)))
+	for _, q := range qids {
+		e.qid(q)
+	}
+	if len(qids) < nwname {
+		return nil
+	}
+	last := ids[len(ids)-1]
+	ids = ids[:len(ids)-1]
+	release()
+	if old := c.fids[newN]; old != nil {
+		c.unref(old.nodeID)
+	}
+	c.fids[newN] = &fid{nodeID: last}
+	return nil
+}
+
+// Tclunk: fid[4]
+func (c *conn) clunk(n uint32) error {
+	f, err := c.getFid(n)
+	if err != nil {
+		return err
+	}
+	delete(c.fids, n)
+	if f.open {
+		in := fuse.ReleaseIn{InHeader: c.header(f.nodeID), Fh: f.fh}
+		if f.isDir {
+			c.s.raw.ReleaseDir(&in)
+		} else {
+			flush := fuse.FlushIn{InHeader: c.header(f.nodeID), Fh: f.fh}
+			err = toErr(c.s.raw.Flush(nil, &flush))
+			c.s.raw.Release(nil, &in)
+		}
+	}
+	c.unref(f.nodeID)
+	return err
+}
+
+// Tremove: fid[4]
+//
+// 9P2000.L clients use Tunlinkat instead. We do not know the parent
+// directory of a fid, so this only clunks the fid.
+func (c *conn) remove(d *decoder) error {
+	if err := c.clunk(d.u32()); err != nil {
+		return err
+	}
+	return syscall.EOPNOTSUPP
+}
+
+// Tstatfs: fid[4]
+func (c *conn) statfs(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	if err != nil {
+		return err
+	}
+	hdr := c.header(f.nodeID)
+	var out fuse.StatfsOut
+	if st := c.s.raw.StatFs(nil, &hdr, &out); !st.Ok() {
+		return toErr(st)
+	}
+	e.u32(statfsMagic)
+	e.u32(out.Bsize)
+	e.u64(out.Blocks)
+	e.u64(out.Bfree)
+	e.u64(out.Bavail)
+	e.u64(out.Files)
+	e.u64(out.Ffree)
+	e.u64(0) // fsid
+	e.u32(out.NameLen)
+	return nil
+}
+
+// openFlags converts 9P2000.L open flags to the flags we pass to Open and
+// Create. O_TRUNC is handled by the caller.
+func (c *conn) openFlags(flags uint32) (uint32, error) {
+	acc := flags & p9AccMode
+	if c.s.readOnly && (acc != syscall.O_RDONLY || flags&p9Trunc != 0) {
+		return 0, syscall.EROFS
+	}
+	return acc, nil
+}
+
+// Tlopen: fid[4] flags[4]
+func (c *conn) lopen(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	flags := d.u32()
+	if err != nil || d.err != nil {
+		return err
+	}
+	if f.open {
+		return syscall.EBADF
+	}
+	getattr := fuse.GetAttrIn{InHeader: c.header(f.nodeID)}
+	var attr fuse.AttrOut
+	if st := c.s.raw.GetAttr(nil, &getattr, &attr); !st.Ok() {
+		return toErr(st)
+	}
+	in := fuse.OpenIn{InHeader: c.header(f.nodeID)}
+	var out fuse.OpenOut
+	if attr.IsDir() {
+		if st := c.s.raw.OpenDir(nil, &in, &out); !st.Ok() {
+			return toErr(st)
+		}
+		f.isDir = true
+	} else {
+		if in.Flags, err = c.openFlags(flags); err != nil {
+			return err
+		}
+		if st := c.s.raw.Open(nil, &in, &out); !st.Ok() {
+			return toErr(st)
+		}
+		// Like the kernel without FUSE_ATOMIC_O_TRUNC, we truncate using
+		// SetAttr instead of passing O_TRUNC on.
+		if flags&p9Trunc != 0 {
+			set := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+				InHeader: c.header(f.nodeID),
+				Valid:    fuse.FATTR_SIZE | fuse.FATTR_FH,
+				Fh:       out.Fh,
+			}}
+			if st := c.s.raw.SetAttr(nil, &set, &attr); !st.Ok() {
+				c.s.raw.Release(nil, &fuse.ReleaseIn{InHeader: c.header(f.nodeID), Fh: out.Fh})
+				return toErr(st)
+			}
+		}
+	}
+	f.open = true
+	f.fh = out.Fh
+	e.qid(qidOf(&attr.Attr))
+	e.u32(0) // iounit: use msize
+	return nil
+}
+
+// Tlcreate: fid[4] name[s] flags[4] mode[4] gid[4]
+func (c *conn) lcreate(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	name := d.str()
+	flags := d.u32()
+	mode := d.u32()
+	d.u32()
+	if err != nil || d.err != nil {
+		return err
+	}
+	if f.open {
+		return syscall.EBADF
+	}
+	if err = checkName(name); err != nil {
+		return err
+	}
+	if c.s.readOnly {
+		return syscall.EROFS
+	}
+	acc, _ := c.openFlags(flags)
+	in := fuse.CreateIn{
+		InHeader: c.header(f.nodeID),
+		Flags:    acc | syscall.O_CREAT | syscall.O_EXCL,
+		Mode:     mode & 07777,
+	}
+	var out fuse.CreateOut
+	if st := c.s.raw.Create(nil, &in, name, &out); !st.Ok() {
+		return toErr(st)
+	}
+	// The fid now refers to the new file
+	c.gotLookup(out.NodeId)
+	c.unref(f.nodeID)
+	*f = fid{nodeID: out.NodeId, open: true, fh: out.Fh}
+	e.qid(qidOf(&out.Attr))
+	e.u32(0)
+	return nil
+}
+
+// newEntry replies with the qid of a new directory entry and drops the
+// lookup reference we got for it.
+func (c *conn) newEntry(e *encoder, out *fuse.EntryOut) {
+	c.s.raw.Forget(out.NodeId, 1)
+	e.qid(qidOf(&out.Attr))
+}
+
+// dirFid returns fid "n", which must be a directory that is not open, and
+// checks that we can create "name" in it.
+func (c *conn) dirFid(n uint32, name string) (*fid, error) {
+	f, err := c.getFid(n)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkName(name); err != nil {
+		return nil, err
+	}
+	if c.s.readOnly {
+		return nil, syscall.EROFS
+	}
+	return f, nil
+}
+
+// Tsymlink: fid[4] name[s] symtgt[s] gid[4]
+func (c *conn) symlink(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	target := d.str()
+	d.u32()
+	if d.err != nil {
+		return nil
+	}
+	f, err := c.dirFid(n, name)
+	if err != nil {
+		return err
+	}
+	hdr := c.header(f.nodeID)
+	var out fuse.EntryOut
+	if st := c.s.raw.Symlink(nil, &hdr, target, name, &out); !st.Ok() {
+		return toErr(st)
+	}
+	c.newEntry(e, &out)
+	return nil
+}
+
+// Tmknod: dfid[4] name[s] mode[4] major[4] minor[4] gid[4]
+func (c *conn) mknod(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	major := d.u32()
+	minor := d.u32()
+	d.u32()
+	if d.err != nil {
+		return nil
+	}
+	f, err := c.dirFid(n, name)
+	if err != nil {
+		return err
+	}
+	in := fuse.MknodIn{
+		InHeader: c.header(f.nodeID),
+		Mode:     mode,
+		// Like new_encode_dev() in the kernel
+		Rdev: (minor & 0xff) | (major << 8) | ((minor &^ 0xff) << 12),
+	}
+	var out fuse.EntryOut
+	if st := c.s.raw.Mknod(nil, &in, name, &out); !st.Ok() {
+		return toErr(st)
+	}
+	c.newEntry(e, &out)
+	return nil
+}
+
+// Tmkdir: dfid[4] name[s] mode[4] gid[4]
+func (c *conn) mkdir(d *decoder, e *encoder) error {
+	n := d.u32()
+	name := d.str()
+	mode := d.u32()
+	d.u32()
+	if d.err != nil {
+		return nil
+	}
+	f, err := c.dirFid(n, name)
+	if err != nil {
+		return err
+	}
+	in := fuse.MkdirIn{InHeader: c.header(f.nodeID), Mode: mode & 07777}
+	var out fuse.EntryOut
+	if st := c.s.raw.Mkdir(nil, &in, name, &out); !st.Ok() {
+		return toErr(st)
+	}
+	c.newEntry(e, &out)
+	return nil
+}
+
+// Tlink: dfid[4] fid[4] name[s]
+func (c *conn) link(d *decoder) error {
+	dn := d.u32()
+	target, err := c.getFid(d.u32())
+	name := d.str()
+	if err != nil || d.err != nil {
+		return err
+	}
+	f, err := c.dirFid(dn, name)
+	if err != nil {
+		return err
+	}
+	in := fuse.LinkIn{InHeader: c.header(f.nodeID), Oldnodeid: target.nodeID}
+	var out fuse.EntryOut
+	if st := c.s.raw.Link(nil, &in, name, &out); !st.Ok() {
+		return toErr(st)
+	}
+	c.s.raw.Forget(out.NodeId, 1)
+	return nil
+}
+
+// Trenameat: olddirfid[4] oldname[s] newdirfid[4] newname[s]
+func (c *conn) renameat(d *decoder) error {
+	oldN := d.u32()
+	oldName := d.str()
+	newN := d.u32()
+	newName := d.str()
+	if d.err != nil {
+		return nil
+	}
+	oldDir, err := c.dirFid(oldN, oldName)
+	if err != nil {
+		return err
+	}
+	newDir, err := c.dirFid(newN, newName)
+	if err != nil {
+		return err
+	}
+	in := fuse.RenameIn{InHeader: c.header(oldDir.nodeID), Newdir: newDir.nodeID}
+	return toErr(c.s.raw.Rename(nil, &in, oldName, newName))
+}
+
+// Tunlinkat: dirfd[4] name[s] flags[4]
+func (c *conn) unlinkat(d *decoder) error {
+	n := d.u32()
+	name := d.str()
+	flags := d.u32()
+	if d.err != nil {
+		return nil
+	}
+	f, err := c.dirFid(n, name)
+	if err != nil {
+		return err
+	}
+	hdr := c.header(f.nodeID)
+	if flags&atRemoveDir != 0 {
+		return toErr(c.s.raw.Rmdir(nil, &hdr, name))
+	}
+	return toErr(c.s.raw.Unlink(nil, &hdr, name))
+}
+
+// Treadlink: fid[4]
+func (c *conn) readlink(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	if err != nil {
+		return err
+	}
+	hdr := c.header(f.nodeID)
+	target, st := c.s.raw.Readlink(nil, &hdr)
+	if !st.Ok() {
+		return toErr(st)
+	}
+	e.str(string(target))
+	return nil
+}
+
+// Tgetattr: fid[4] request_mask[8]
+func (c *conn) getattr(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	d.u64()
+	if err != nil || d.err != nil {
+		return err
+	}
+	in := fuse.GetAttrIn{InHeader: c.header(f.nodeID)}
+	if f.open && !f.isDir {
+		in.Flags_ = fuse.FUSE_GETATTR_FH
+		in.Fh_ = f.fh
+	}
+	var out fuse.AttrOut
+	if st := c.s.raw.GetAttr(nil, &in, &out); !st.Ok() {
+		return toErr(st)
+	}
+	a := &out.Attr
+	e.u64(getattrBasic)
+	e.qid(qidOf(a))
+	e.u32(a.Mode)
+	e.u32(a.Uid)
+	e.u32(a.Gid)
+	e.u64(uint64(a.Nlink))
+	e.u64(uint64(a.Rdev))
+	e.u64(a.Size)
+	e.u64(uint64(a.Blksize))
+	e.u64(a.Blocks)
+	e.u64(a.Atime)
+	e.u64(uint64(a.Atimensec))
+	e.u64(a.Mtime)
+	e.u64(uint64(a.Mtimensec))
+	e.u64(a.Ctime)
+	e.u64(uint64(a.Ctimensec))
+	// btime, gen, data_version
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	e.u64(0)
+	return nil
+}
+
+// Tsetattr: fid[4] valid[4] mode[4] uid[4] gid[4] size[8] atime_sec[8]
+// atime_nsec[8] mtime_sec[8] mtime_nsec[8]
+func (c *conn) setattr(d *decoder) error {
+	f, err := c.getFid(d.u32())
+	valid := d.u32()
+	mode := d.u32()
+	uid := d.u32()
+	gid := d.u32()
+	size := d.u64()
+	atime, atimensec := d.u64(), d.u64()
+	mtime, mtimensec := d.u64(), d.u64()
+	if err != nil || d.err != nil {
+		return err
+	}
+	if c.s.readOnly {
+		return syscall.EROFS
+	}
+	in := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader:  c.header(f.nodeID),
+		Mode:      mode,
+		Owner:     fuse.Owner{Uid: uid, Gid: gid},
+		Size:      size,
+		Atime:     atime,
+		Atimensec: uint32(atimensec),
+		Mtime:     mtime,
+		Mtimensec: uint32(mtimensec),
+	}}
+	if valid&setattrMode != 0 {
+		in.Valid |= fuse.FATTR_MODE
+	}
+	if valid&setattrUID != 0 {
+		in.Valid |= fuse.FATTR_UID
+	}
+	if valid&setattrGID != 0 {
+		in.Valid |= fuse.FATTR_GID
+	}
+	if valid&setattrSize != 0 {
+		in.Valid |= fuse.FATTR_SIZE
+	}
+	// Without the _SET bit, the time is set to the current time
+	if valid&setattrAtime != 0 {
+		in.Valid |= fuse.FATTR_ATIME
+		if valid&setattrAtimeSet == 0 {
+			in.Valid |= fuse.FATTR_ATIME_NOW
+		}
+	}
+	if valid&setattrMtime != 0 {
+		in.Valid |= fuse.FATTR_MTIME
+		if valid&setattrMtimeSet == 0 {
+			in.Valid |= fuse.FATTR_MTIME_NOW
+		}
+	}
+	if in.Valid == 0 {
+		// Only ctime, which is updated anyway
+		return nil
+	}
+	if f.open && !f.isDir {
+		in.Valid |= fuse.FATTR_FH
+		in.Fh = f.fh
+	}
+	var out fuse.AttrOut
+	return toErr(c.s.raw.SetAttr(nil, &in, &out))
+}
+
+// dirent is the serialized directory entry written by fuse.DirEntryList,
+// see struct fuse_dirent in the kernel.
+type dirent struct {
+	ino     uint64
+	off     uint64
+	nameLen uint32
+	typ     uint32
+}
+
+const direntSize = int(unsafe.Sizeof(dirent{}))
+
+// Treaddir: fid[4] offset[8] count[4]
+//
+// The reply contains count[4] and then entries of qid[13] offset[8] type[1]
+// name[s]. They are never larger than the FUSE dirents they are converted
+// from, so we ask for "count" bytes of FUSE dirents.
+func (c *conn) readdir(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	off := d.u64()
+	count := d.u32()
+	if err != nil || d.err != nil {
+		return err
+	}
+	if !f.open || !f.isDir {
+		return syscall.EBADF
+	}
+	if max := c.msize - headerSize - 4; count > max {
+		count = max
+	}
+	if max := uint32(len(c.data)); count > max {
+		count = max
+	}
+	buf := c.data[:count]
+	// The entries are not length-prefixed. Zero the buffer so we can tell
+	// where they end.
+	for i := range buf {
+		buf[i] = 0
+	}
+	in := fuse.ReadIn{
+		InHeader: c.header(f.nodeID),
+		Fh:       f.fh,
+		Offset:   off,
+		Size:     count,
+	}
+	if st := c.s.raw.ReadDir(nil, &in, fuse.NewDirEntryList(buf, off)); !st.Ok() {
+		return toErr(st)
+	}
+	start := len(e.buf)
+	e.u32(0)
+	for p := 0; p+direntSize <= len(buf); {
+		de := (*dirent)(unsafe.Pointer(&buf[p]))
+		if de.nameLen == 0 {
+			break
+		}
+		name := string(buf[p+direntSize : p+direntSize+int(de.nameLen)])
+		q := qid{typ: qtFile, path: de.ino}
+		switch de.typ {
+		case syscall.DT_DIR:
+			q.typ = qtDir
+		case syscall.DT_LNK:
+			q.typ = qtSymlink
+		}
+		e.qid(q)
+		e.u64(de.off)
+		e.u8(uint8(de.typ))
+		e.str(name)
+		// Entries are padded to 8 bytes
+		p += (direntSize + int(de.nameLen) + 7) &^ 7
+	}
+	n := len(e.buf) - start - 4
+	binary.LittleEndian.PutUint32(e.buf[start:], uint32(n))
+	return nil
+}
+
+// Tfsync: fid[4] datasync[4]
+func (c *conn) fsync(d *decoder) error {
+	f, err := c.getFid(d.u32())
+	datasync := d.u32()
+	if err != nil || d.err != nil {
+		return err
+	}
+	if !f.open {
+		return syscall.EBADF
+	}
+	in := fuse.FsyncIn{InHeader: c.header(f.nodeID), Fh: f.fh, FsyncFlags: datasync}
+	if f.isDir {
+		return toErr(c.s.raw.FsyncDir(nil, &in))
+	}
+	return toErr(c.s.raw.Fsync(nil, &in))
+}
+
+// Tread: fid[4] offset[8] count[4]
+func (c *conn) read(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	off := d.u64()
+	count := d.u32()
+	if err != nil || d.err != nil {
+		return err
+	}
+	if !f.open || f.isDir {
+		return syscall.EBADF
+	}
+	// count[4] follows the header
+	if max := c.msize - headerSize - 4; count > max {
+		count = max
+	}
+	if count > contentenc.MaxKernelWrite {
+		count = contentenc.MaxKernelWrite
+	}
+	in := fuse.ReadIn{
+		InHeader: c.header(f.nodeID),
+		Fh:       f.fh,
+		Offset:   off,
+		Size:     count,
+	}
+	buf := c.data[:count]
+	res, st := c.s.raw.Read(nil, &in, buf)
+	if !st.Ok() {
+		return toErr(st)
+	}
+	data, st := res.Bytes(buf)
+	res.Done()
+	if !st.Ok() {
+		return toErr(st)
+	}
+	e.u32(uint32(len(data)))
+	e.buf = append(e.buf, data...)
+	return nil
+}
+
+// Twrite: fid[4] offset[8] count[4] data[count]
+func (c *conn) write(d *decoder, e *encoder) error {
+	f, err := c.getFid(d.u32())
+	off := d.u64()
+	count := d.u32()
+	if count > c.msize {
+		return syscall.EINVAL
+	}
+	data := d.take(int(count))
+	if err != nil || d.err != nil {
+		return err
+	}
+	if !f.open || f.isDir {
+		return syscall.EBADF
+	}
+	in := fuse.WriteIn{
+		InHeader: c.header(f.nodeID),
+		Fh:       f.fh,
+		Offset:   off,
+		Size:     count,
+	}
+	written, st := c.s.raw.Write(nil, &in, data)
+	if !st.Ok() {
+		return toErr(st)
+	}
+	e.u32(written)
+	return nil
+}
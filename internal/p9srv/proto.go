@@ -0,0 +1,198 @@
+package p9srv
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+)
+
+// 9P2000.L message types, see
+// https://github.com/chaos/diod/blob/master/protocol.md
+const (
+	rlerror      = 7
+	tstatfs      = 8
+	tlopen       = 12
+	tlcreate     = 14
+	tsymlink     = 16
+	tmknod       = 18
+	treadlink    = 22
+	tgetattr     = 24
+	tsetattr     = 26
+	txattrwalk   = 30
+	txattrcreate = 32
+	treaddir     = 40
+	tfsync       = 50
+	tlink        = 70
+	tmkdir       = 72
+	trenameat    = 74
+	tunlinkat    = 76
+	tversion     = 100
+	tauth        = 102
+	tattach      = 104
+	tflush       = 108
+	twalk        = 110
+	tread        = 116
+	twrite       = 118
+	tclunk       = 120
+	tremove      = 122
+)
+
+const (
+	// noTag is the tag of Tversion
+	noTag = 0xFFFF
+	// noFid is the afid of Tattach without authentication
+	noFid = 0xFFFFFFFF
+	// maxWalk is the maximum number of names in a Twalk
+	maxWalk = 16
+	// headerSize is size[4] type[1] tag[2]
+	headerSize = 7
+)
+
+// Qid types
+const (
+	qtDir     = 0x80
+	qtSymlink = 0x02
+	qtFile    = 0x00
+)
+
+// Tgetattr request_mask and Rgetattr valid bits
+const (
+	getattrBasic = 0x000007ff
+)
+
+// Tsetattr valid bits
+const (
+	setattrMode     = 0x1
+	setattrUID      = 0x2
+	setattrGID      = 0x4
+	setattrSize     = 0x8
+	setattrAtime    = 0x10
+	setattrMtime    = 0x20
+	setattrAtimeSet = 0x80
+	setattrMtimeSet = 0x100
+)
+
+// atRemoveDir is the Tunlinkat flag for removing a directory
+const atRemoveDir = 0x200
+
+// errShort is returned when a message is shorter than its fields.
+var errShort = errors.New("message too short")
+
+// qid identifies a file on the server.
+type qid struct {
+	typ     uint8
+	version uint32
+	path    uint64
+}
+
+// decoder reads little-endian fields from a message. After the first
+// error, all reads return zero values and err is set.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+// take returns the next "n" bytes of the message, or nil if it is shorter.
+// Does not allocate, so a bogus length cannot make us allocate memory.
+func (d *decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) u8() uint8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) u16() uint16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint16(b)
+}
+
+func (d *decoder) u32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) u64() uint64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) str() string {
+	n := d.u16()
+	return string(d.take(int(n)))
+}
+
+// encoder builds a message. The size field is filled in by finish.
+type encoder struct {
+	buf []byte
+}
+
+// newEncoder starts a message of type "typ" with tag "tag".
+func newEncoder(buf []byte, typ uint8, tag uint16) *encoder {
+	e := &encoder{buf: buf[:0]}
+	e.u32(0)
+	e.u8(typ)
+	e.u16(tag)
+	return e
+}
+
+func (e *encoder) u8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) u16(v uint16) {
+	e.buf = binary.LittleEndian.AppendUint16(e.buf, v)
+}
+
+func (e *encoder) u32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) u64(v uint64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) str(s string) {
+	e.u16(uint16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) qid(q qid) {
+	e.u8(q.typ)
+	e.u32(q.version)
+	e.u64(q.path)
+}
+
+// finish fills in the size field and returns the message.
+func (e *encoder) finish() []byte {
+	binary.LittleEndian.PutUint32(e.buf, uint32(len(e.buf)))
+	return e.buf
+}
+
+// errnoOf converts "err" to the errno that is sent in Rlerror.
+func errnoOf(err error) uint32 {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return uint32(errno)
+	}
+	return uint32(syscall.EIO)
+}
@@ -0,0 +1,295 @@
+// Package p9srv exports a gocryptfs filesystem using the 9P2000.L protocol,
+// so that virtual machines and containers can mount it with the kernel's
+// 9p client instead of FUSE. Like package webdavsrv, it drives the go-fuse
+// node tree in-process through its fuse.RawFileSystem interface.
+package p9srv
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// maxMsize is the largest message size we negotiate. It allows reads and
+// writes of contentenc.MaxKernelWrite bytes, which is the most the FUSE
+// frontends can handle, plus the message headers.
+const maxMsize = contentenc.MaxKernelWrite + 4096
+
+// Server serves 9P2000.L on top of a fuse.RawFileSystem.
+type Server struct {
+	raw    fuse.RawFileSystem
+	caller fuse.Caller
+	// readOnly makes all modifications fail with EROFS. When mounted,
+	// the kernel does this for us.
+	readOnly bool
+
+	mu        sync.Mutex
+	closed    bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	wg        sync.WaitGroup
+}
+
+// New returns a Server for "raw", which must have been created by
+// fs.NewNodeFS. All operations are performed with our own uid and gid.
+func New(raw fuse.RawFileSystem, readOnly bool) *Server {
+	return &Server{
+		raw:      raw,
+		readOnly: readOnly,
+		caller: fuse.Caller{
+			Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+			Pid:   uint32(os.Getpid()),
+		},
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve accepts connections on "ln" until Close is called, and returns nil
+// then. Other errors from Accept are returned as-is.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.listeners[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			c.Close()
+			return nil
+		}
+		s.conns[c] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			newConn(s, c).serve()
+			s.mu.Lock()
+			delete(s.conns, c)
+			s.mu.Unlock()
+		}()
+	}
+}
+
+// Close closes all listeners and connections, and waits until the files
+// opened by the clients have been released.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// fid is a file on the server that the client refers to by number.
+type fid struct {
+	nodeID uint64
+	// open is set by Tlopen and Tlcreate. fh is only valid then.
+	open  bool
+	isDir bool
+	fh    uint64
+}
+
+// conn is a client connection. Requests are handled one at a time, in the
+// order they arrive.
+type conn struct {
+	s     *Server
+	c     net.Conn
+	msize uint32
+	fids  map[uint32]*fid
+	// refs counts the fids on each node id. We hold one lookup reference
+	// per node id, no matter how many fids point to it.
+	refs map[uint64]int
+	// in holds the request, out the reply, data the payload of Tread.
+	in, out, data []byte
+}
+
+func newConn(s *Server, c net.Conn) *conn {
+	return &conn{
+		s:     s,
+		c:     c,
+		msize: maxMsize,
+		fids:  make(map[uint32]*fid),
+		refs:  make(map[uint64]int),
+		in:    make([]byte, maxMsize),
+		out:   make([]byte, 0, maxMsize),
+		data:  make([]byte, contentenc.MaxKernelWrite),
+	}
+}
+
+// serve handles requests until the connection is closed, and then releases
+// all fids.
+func (c *conn) serve() {
+	defer c.c.Close()
+	defer c.clunkAll()
+	for {
+		if _, err := io.ReadFull(c.c, c.in[:4]); err != nil {
+			if err != io.EOF {
+				tlog.Debug.Printf("p9srv: %v", err)
+			}
+			return
+		}
+		size := binary.LittleEndian.Uint32(c.in)
+		if size < headerSize || size > c.msize {
+			tlog.Warn.Printf("p9srv: invalid message size %d", size)
+			return
+		}
+		if _, err := io.ReadFull(c.c, c.in[4:size]); err != nil {
+			tlog.Debug.Printf("p9srv: %v", err)
+			return
+		}
+		d := &decoder{buf: c.in[headerSize:size]}
+		typ := c.in[4]
+		tag := binary.LittleEndian.Uint16(c.in[5:])
+		reply := c.handle(typ, tag, d)
+		if _, err := c.c.Write(reply); err != nil {
+			tlog.Debug.Printf("p9srv: %v", err)
+			return
+		}
+	}
+}
+
+// handle dispatches one request and returns the reply.
+func (c *conn) handle(typ uint8, tag uint16, d *decoder) []byte {
+	e := newEncoder(c.out, typ+1, tag)
+	var err error
+	switch typ {
+	case tversion:
+		err = c.version(d, e)
+	case tattach:
+		err = c.attach(d, e)
+	case tflush:
+		// Requests are handled one at a time, so there is nothing to
+		// flush. The reply is empty.
+		d.u16()
+	case twalk:
+		err = c.walk(d, e)
+	case tclunk:
+		err = c.clunk(d.u32())
+	case tremove:
+		err = c.remove(d)
+	case tstatfs:
+		err = c.statfs(d, e)
+	case tlopen:
+		err = c.lopen(d, e)
+	case tlcreate:
+		err = c.lcreate(d, e)
+	case tsymlink:
+		err = c.symlink(d, e)
+	case tmknod:
+		err = c.mknod(d, e)
+	case treadlink:
+		err = c.readlink(d, e)
+	case tgetattr:
+		err = c.getattr(d, e)
+	case tsetattr:
+		err = c.setattr(d)
+	case treaddir:
+		err = c.readdir(d, e)
+	case tfsync:
+		err = c.fsync(d)
+	case tlink:
+		err = c.link(d)
+	case tmkdir:
+		err = c.mkdir(d, e)
+	case trenameat:
+		err = c.renameat(d)
+	case tunlinkat:
+		err = c.unlinkat(d)
+	case tread:
+		err = c.read(d, e)
+	case twrite:
+		err = c.write(d, e)
+	case tauth, txattrwalk, txattrcreate:
+		err = syscall.EOPNOTSUPP
+	default:
+		tlog.Debug.Printf("p9srv: unsupported message type %d", typ)
+		err = syscall.ENOSYS
+	}
+	if err == nil && d.err != nil {
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		e = newEncoder(c.out, rlerror, tag)
+		e.u32(errnoOf(err))
+	}
+	c.out = e.buf
+	return e.finish()
+}
+
+// ref adds a fid reference to "nodeID", which is already referenced.
+func (c *conn) ref(nodeID uint64) {
+	c.refs[nodeID]++
+}
+
+// gotLookup adds a fid reference to "nodeID", which has just been returned
+// by a successful Lookup, Create, Mkdir etc.
+func (c *conn) gotLookup(nodeID uint64) {
+	if c.refs[nodeID] > 0 {
+		// We already hold a lookup reference
+		c.s.raw.Forget(nodeID, 1)
+	}
+	c.refs[nodeID]++
+}
+
+// unref drops a fid reference to "nodeID".
+func (c *conn) unref(nodeID uint64) {
+	c.refs[nodeID]--
+	if c.refs[nodeID] > 0 {
+		return
+	}
+	delete(c.refs, nodeID)
+	// The root node is never forgotten
+	if nodeID != fuse.FUSE_ROOT_ID {
+		c.s.raw.Forget(nodeID, 1)
+	}
+}
+
+// header returns an InHeader for an operation on "nodeID".
+func (c *conn) header(nodeID uint64) fuse.InHeader {
+	return fuse.InHeader{NodeId: nodeID, Caller: c.s.caller}
+}
+
+// getFid returns the fid "n", or EBADF if it does not exist.
+func (c *conn) getFid(n uint32) (*fid, error) {
+	f := c.fids[n]
+	if f == nil {
+		return nil, syscall.EBADF
+	}
+	return f, nil
+}
+
+// clunkAll releases all fids.
+func (c *conn) clunkAll() {
+	for n := range c.fids {
+		c.clunk(n)
+	}
+}
@@ -0,0 +1,356 @@
+package p9srv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// client is a minimal 9P2000.L client.
+type client struct {
+	t *testing.T
+	c net.Conn
+}
+
+// newLoopbackServer serves a temporary directory through go-fuse's loopback
+// node tree and returns a connected client that has attached fid 0 to the
+// root directory.
+func newLoopbackServer(t *testing.T, readOnly bool) (*client, string) {
+	dir := t.TempDir()
+	root, err := fs.NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New(fs.NewNodeFS(root, &fs.Options{}), readOnly)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &client{t: t, c: conn}
+
+	e := c.msg(tversion)
+	e.u32(maxMsize * 2)
+	e.str("9P2000.L")
+	d := c.rpc(e)
+	if msize := d.u32(); msize != maxMsize {
+		t.Fatalf("msize %d", msize)
+	}
+	if v := d.str(); v != "9P2000.L" {
+		t.Fatalf("version %q", v)
+	}
+	e = c.msg(tattach)
+	e.u32(0)
+	e.u32(noFid)
+	e.str("")
+	e.str("")
+	e.u32(0)
+	c.rpc(e)
+	return c, dir
+}
+
+// msg starts a request of type "typ".
+func (c *client) msg(typ uint8) *encoder {
+	return newEncoder(nil, typ, 1)
+}
+
+// send sends the request and returns the reply type and body.
+func (c *client) send(e *encoder) (uint8, *decoder) {
+	if _, err := c.c.Write(e.finish()); err != nil {
+		c.t.Fatal(err)
+	}
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(c.c, hdr); err != nil {
+		c.t.Fatal(err)
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(hdr)-headerSize)
+	if _, err := io.ReadFull(c.c, body); err != nil {
+		c.t.Fatal(err)
+	}
+	return hdr[4], &decoder{buf: body}
+}
+
+// rpc is like send but fails the test on Rlerror.
+func (c *client) rpc(e *encoder) *decoder {
+	typ := e.buf[4]
+	rtyp, d := c.send(e)
+	if rtyp == rlerror {
+		c.t.Fatalf("request type %d: %v", typ, syscall.Errno(d.u32()))
+	}
+	if rtyp != typ+1 {
+		c.t.Fatalf("request type %d: reply type %d", typ, rtyp)
+	}
+	return d
+}
+
+// rpcErr sends the request and returns the Rlerror errno, or 0.
+func (c *client) rpcErr(e *encoder) syscall.Errno {
+	rtyp, d := c.send(e)
+	if rtyp == rlerror {
+		return syscall.Errno(d.u32())
+	}
+	return 0
+}
+
+// walk walks "names" from fid 0 to "newfid".
+func (c *client) walk(newfid uint32, names ...string) *encoder {
+	e := c.msg(twalk)
+	e.u32(0)
+	e.u32(newfid)
+	e.u16(uint16(len(names)))
+	for _, n := range names {
+		e.str(n)
+	}
+	return e
+}
+
+func (c *client) clunk(fid uint32) {
+	e := c.msg(tclunk)
+	e.u32(fid)
+	c.rpc(e)
+}
+
+func TestReadWrite(t *testing.T) {
+	c, dir := newLoopbackServer(t, false)
+	e := c.msg(tmkdir)
+	e.u32(0)
+	e.str("d")
+	e.u32(0700)
+	e.u32(0)
+	if q := c.rpc(e).u8(); q != qtDir {
+		t.Errorf("mkdir: qid type %#x", q)
+	}
+	c.rpc(c.walk(1, "d"))
+	e = c.msg(tlcreate)
+	e.u32(1)
+	e.str("f")
+	e.u32(syscall.O_RDWR)
+	e.u32(0600)
+	e.u32(0)
+	c.rpc(e)
+	// Larger than one request
+	content := bytes.Repeat([]byte("0123456789abcdef"), 100000)
+	for off := 0; off < len(content); {
+		chunk := content[off:]
+		if len(chunk) > 100000 {
+			chunk = chunk[:100000]
+		}
+		e = c.msg(twrite)
+		e.u32(1)
+		e.u64(uint64(off))
+		e.u32(uint32(len(chunk)))
+		e.buf = append(e.buf, chunk...)
+		off += int(c.rpc(e).u32())
+	}
+	c.clunk(1)
+	have, err := os.ReadFile(filepath.Join(dir, "d/f"))
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("backing file: err=%v len=%d, want len=%d", err, len(have), len(content))
+	}
+
+	c.rpc(c.walk(2, "d", "f"))
+	e = c.msg(tgetattr)
+	e.u32(2)
+	e.u64(getattrBasic)
+	d := c.rpc(e)
+	d.take(8 + 13 + 4 + 4 + 4 + 8 + 8)
+	if size := d.u64(); size != uint64(len(content)) {
+		t.Errorf("getattr: size %d", size)
+	}
+	e = c.msg(tlopen)
+	e.u32(2)
+	e.u32(syscall.O_RDONLY)
+	c.rpc(e)
+	have = nil
+	for {
+		e = c.msg(tread)
+		e.u32(2)
+		e.u64(uint64(len(have)))
+		e.u32(maxMsize)
+		d = c.rpc(e)
+		n := d.u32()
+		if n == 0 {
+			break
+		}
+		have = append(have, d.take(int(n))...)
+	}
+	if !bytes.Equal(have, content) {
+		t.Errorf("read back: len=%d", len(have))
+	}
+	c.clunk(2)
+
+	// Readdir
+	c.rpc(c.walk(3, "d"))
+	e = c.msg(tlopen)
+	e.u32(3)
+	e.u32(syscall.O_RDONLY)
+	c.rpc(e)
+	e = c.msg(treaddir)
+	e.u32(3)
+	e.u64(0)
+	e.u32(4096)
+	d = c.rpc(e)
+	d = &decoder{buf: d.take(int(d.u32()))}
+	var names []string
+	for len(d.buf) > 0 {
+		d.take(13 + 8 + 1)
+		names = append(names, d.str())
+	}
+	found := false
+	for _, n := range names {
+		found = found || n == "f"
+	}
+	if !found || d.err != nil {
+		t.Errorf("readdir: have %q, err=%v", names, d.err)
+	}
+	c.clunk(3)
+
+	// Walking to a missing file fails, and a partial walk does not
+	// create the new fid
+	if errno := c.rpcErr(c.walk(4, "missing")); errno != syscall.ENOENT {
+		t.Errorf("walk: have %v", errno)
+	}
+	if nwqid := c.rpc(c.walk(4, "d", "missing")).u16(); nwqid != 1 {
+		t.Errorf("partial walk: nwqid=%d", nwqid)
+	}
+	e = c.msg(tclunk)
+	e.u32(4)
+	if errno := c.rpcErr(e); errno != syscall.EBADF {
+		t.Errorf("clunk after partial walk: have %v", errno)
+	}
+	if errno := c.rpcErr(c.walk(4, "..")); errno != syscall.EINVAL {
+		t.Errorf("walk to ..: have %v", errno)
+	}
+
+	e = c.msg(trenameat)
+	e.u32(0)
+	e.str("d")
+	e.u32(0)
+	e.str("e")
+	c.rpc(e)
+	c.rpc(c.walk(5, "e"))
+	e = c.msg(tunlinkat)
+	e.u32(5)
+	e.str("f")
+	e.u32(0)
+	c.rpc(e)
+	e = c.msg(tunlinkat)
+	e.u32(0)
+	e.str("e")
+	e.u32(atRemoveDir)
+	c.rpc(e)
+	if _, err = os.Stat(filepath.Join(dir, "e")); !os.IsNotExist(err) {
+		t.Errorf("e still exists: %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	c, dir := newLoopbackServer(t, true)
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c.rpc(c.walk(1, "f"))
+	e := c.msg(tlopen)
+	e.u32(1)
+	e.u32(syscall.O_RDWR)
+	if errno := c.rpcErr(e); errno != syscall.EROFS {
+		t.Errorf("lopen: have %v", errno)
+	}
+	e = c.msg(tlopen)
+	e.u32(1)
+	e.u32(syscall.O_RDONLY)
+	c.rpc(e)
+	e = c.msg(tmkdir)
+	e.u32(0)
+	e.str("d")
+	e.u32(0700)
+	e.u32(0)
+	if errno := c.rpcErr(e); errno != syscall.EROFS {
+		t.Errorf("mkdir: have %v", errno)
+	}
+	e = c.msg(tunlinkat)
+	e.u32(0)
+	e.str("f")
+	e.u32(0)
+	if errno := c.rpcErr(e); errno != syscall.EROFS {
+		t.Errorf("unlinkat: have %v", errno)
+	}
+}
+
+// The largest count a client may ask for at the maximum msize must not
+// overrun the server's buffers
+func TestReaddirMaxCount(t *testing.T) {
+	c, dir := newLoopbackServer(t, false)
+	if err := os.WriteFile(filepath.Join(dir, "f"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	e := c.msg(tlopen)
+	e.u32(0)
+	e.u32(syscall.O_RDONLY)
+	c.rpc(e)
+	e = c.msg(treaddir)
+	e.u32(0)
+	e.u64(0)
+	e.u32(maxMsize - headerSize - 4)
+	d := c.rpc(e)
+	d = &decoder{buf: d.take(int(d.u32()))}
+	var names []string
+	for len(d.buf) > 0 {
+		d.take(13 + 8 + 1)
+		names = append(names, d.str())
+	}
+	found := false
+	for _, n := range names {
+		found = found || n == "f"
+	}
+	if !found || d.err != nil {
+		t.Errorf("readdir: have %q, err=%v", names, d.err)
+	}
+}
+
+// A Twrite whose count is larger than the message is rejected without
+// allocating "count" bytes
+func TestWriteShort(t *testing.T) {
+	c, _ := newLoopbackServer(t, false)
+	e := c.msg(tlcreate)
+	e.u32(0)
+	e.str("f")
+	e.u32(syscall.O_RDWR)
+	e.u32(0600)
+	e.u32(0)
+	c.rpc(e)
+	for _, count := range []uint32{0xFFFFFFFF, maxMsize, 1} {
+		e = c.msg(twrite)
+		e.u32(0)
+		e.u64(0)
+		e.u32(count)
+		if errno := c.rpcErr(e); errno != syscall.EINVAL {
+			t.Errorf("count %d: have %v, want EINVAL", count, errno)
+		}
+	}
+}
+
+func TestDecoderShort(t *testing.T) {
+	d := &decoder{buf: []byte{1, 2}}
+	if v := d.u32(); v != 0 || d.err != errShort {
+		t.Errorf("u32: have %d, err=%v", v, d.err)
+	}
+	if b := d.take(1 << 30); b != nil {
+		t.Errorf("take after error: have %d bytes", len(b))
+	}
+	if v := d.u8(); v != 0 {
+		t.Errorf("u8 after error: have %d", v)
+	}
+}
@@ -5,7 +5,9 @@ package parallelcrypto
 import (
 	"runtime"
 	"sync"
+	"sync/atomic"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -22,20 +24,30 @@ const (
 
 // ParallelCrypto provides enhanced parallel encryption/decryption capabilities
 type ParallelCrypto struct {
-	enabled bool
+	// enabled, workers and threshold can be changed at runtime through
+	// the ctlsock
+	enabled atomic.Bool
+	// workers is the maximum number of parallel workers, 0 means that it
+	// depends on the number of CPUs
+	workers atomic.Int32
+	// threshold is the minimum number of blocks for parallel processing
+	threshold atomic.Int32
 	// CPU-aware optimizations
 	cpuCount int
 	hasAVX   bool
 	hasAVX2  bool
 	hasAES   bool
+	// How often ProcessBlocksOptimized chose each processing method
+	parallelOps, batchOps, sequentialOps stats.Counter
 }
 
 // New creates a new ParallelCrypto instance
 func New() *ParallelCrypto {
 	pc := &ParallelCrypto{
-		enabled:  true,
 		cpuCount: runtime.NumCPU(),
 	}
+	pc.enabled.Store(true)
+	pc.threshold.Store(ParallelThreshold)
 
 	// Detect CPU features for optimization
 	pc.detectCPUFeatures()
@@ -54,25 +66,50 @@ func (pc *ParallelCrypto) detectCPUFeatures() {
 
 // IsEnabled returns whether parallel crypto is enabled
 func (pc *ParallelCrypto) IsEnabled() bool {
-	return pc.enabled
+	return pc.enabled.Load()
+}
+
+// SetWorkers sets the maximum number of parallel workers. 0 restores the
+// default, which depends on the number of CPUs (see GetOptimalWorkerCount).
+func (pc *ParallelCrypto) SetWorkers(n int) {
+	pc.workers.Store(int32(n))
+}
+
+// Workers returns the value set by SetWorkers
+func (pc *ParallelCrypto) Workers() int {
+	return int(pc.workers.Load())
+}
+
+// SetThreshold sets the minimum number of blocks for parallel processing.
+// 0 restores ParallelThreshold.
+func (pc *ParallelCrypto) SetThreshold(n int) {
+	if n <= 0 {
+		n = ParallelThreshold
+	}
+	pc.threshold.Store(int32(n))
+}
+
+// Threshold returns the minimum number of blocks for parallel processing
+func (pc *ParallelCrypto) Threshold() int {
+	return int(pc.threshold.Load())
 }
 
 // ShouldUseParallel determines if parallel processing should be used
 func (pc *ParallelCrypto) ShouldUseParallel(blockCount int) bool {
-	if !pc.enabled {
+	if !pc.enabled.Load() {
 		return false
 	}
 
-	if pc.cpuCount < MinParallelWorkers {
+	if w := pc.Workers(); w == 1 || (w == 0 && pc.cpuCount < MinParallelWorkers) {
 		return false
 	}
 
-	return blockCount >= ParallelThreshold
+	return blockCount >= pc.Threshold()
 }
 
 // ShouldUseBatch determines if batch processing should be used
 func (pc *ParallelCrypto) ShouldUseBatch(blockCount int) bool {
-	if !pc.enabled {
+	if !pc.enabled.Load() {
 		return false
 	}
 
@@ -81,17 +118,16 @@ func (pc *ParallelCrypto) ShouldUseBatch(blockCount int) bool {
 
 // GetOptimalWorkerCount returns the optimal number of workers for parallel processing
 func (pc *ParallelCrypto) GetOptimalWorkerCount(blockCount int) int {
-	if !pc.enabled {
-		return 1
-	}
-
-	// If below threshold, use sequential processing
-	if blockCount < ParallelThreshold {
+	if !pc.ShouldUseParallel(blockCount) {
 		return 1
 	}
 
-	if pc.cpuCount < MinParallelWorkers {
-		return 1
+	// Set by the user
+	if w := pc.Workers(); w > 0 {
+		if w > blockCount {
+			w = blockCount
+		}
+		return w
 	}
 
 	// CPU-aware worker count calculation
@@ -185,30 +221,39 @@ func (pc *ParallelCrypto) ProcessBlocksParallelWithResult(blockCount int, proces
 	return results
 }
 
-// GetPerformanceStats returns performance statistics for parallel processing
-func (pc *ParallelCrypto) GetPerformanceStats() map[string]interface{} {
-	stats := make(map[string]interface{})
-	stats["enabled"] = pc.enabled
-	stats["cpu_count"] = runtime.NumCPU()
-	stats["parallel_threshold"] = ParallelThreshold
-	stats["max_workers"] = MaxParallelWorkers
-	stats["min_workers"] = MinParallelWorkers
-
-	if pc.enabled {
-		stats["optimal_workers"] = pc.GetOptimalWorkerCount(100) // Example with 100 blocks
-	}
-
-	return stats
+// RegisterStats registers the configuration and the processing method
+// counters in "r".
+func (pc *ParallelCrypto) RegisterStats(r *stats.Registry) {
+	r.Func("parallelcrypto_enabled", stats.KindGauge, "Parallel processing is enabled",
+		func() int64 { return stats.Bool(pc.enabled.Load()) })
+	r.Func("parallelcrypto_cpu_count", stats.KindGauge, "Number of CPUs",
+		func() int64 { return int64(pc.cpuCount) })
+	r.Func("parallelcrypto_parallel_threshold", stats.KindGauge, "Minimum number of blocks for parallel processing",
+		func() int64 { return int64(pc.Threshold()) })
+	r.Func("parallelcrypto_max_workers", stats.KindGauge, "Maximum number of parallel workers",
+		func() int64 {
+			if w := pc.Workers(); w > 0 {
+				return int64(w)
+			}
+			return MaxParallelWorkers
+		})
+	r.Func("parallelcrypto_has_avx2", stats.KindGauge, "CPU supports AVX2",
+		func() int64 { return stats.Bool(pc.hasAVX2) })
+	r.Func("parallelcrypto_has_aes", stats.KindGauge, "CPU supports AES instructions",
+		func() int64 { return stats.Bool(pc.hasAES) })
+	r.Counter("parallelcrypto_parallel_ops_total", "Requests processed by parallel workers", &pc.parallelOps)
+	r.Counter("parallelcrypto_batch_ops_total", "Requests processed in batches", &pc.batchOps)
+	r.Counter("parallelcrypto_sequential_ops_total", "Requests processed sequentially", &pc.sequentialOps)
 }
 
 // Disable disables parallel processing (for testing or debugging)
 func (pc *ParallelCrypto) Disable() {
-	pc.enabled = false
+	pc.enabled.Store(false)
 }
 
 // Enable enables parallel processing
 func (pc *ParallelCrypto) Enable() {
-	pc.enabled = true
+	pc.enabled.Store(true)
 }
 
 // ProcessBlocksBatch processes blocks in batches for better cache locality
@@ -237,18 +282,20 @@ func (pc *ParallelCrypto) ProcessBlocksBatch(blockCount int, processFunc func(st
 // ProcessBlocksOptimized chooses the best processing method based on block count and CPU features
 func (pc *ParallelCrypto) ProcessBlocksOptimized(blockCount int, processFunc func(startIdx, endIdx int)) {
 	if pc.ShouldUseParallel(blockCount) {
+		pc.parallelOps.Inc()
 		pc.ProcessBlocksParallel(blockCount, processFunc)
 	} else if pc.ShouldUseBatch(blockCount) {
+		pc.batchOps.Inc()
 		pc.ProcessBlocksBatch(blockCount, processFunc)
 	} else {
 		// Sequential processing for very small operations
+		pc.sequentialOps.Inc()
 		processFunc(0, blockCount)
 	}
 }
 
 // LogPerformanceInfo logs performance information about parallel processing
 func (pc *ParallelCrypto) LogPerformanceInfo() {
-	stats := pc.GetPerformanceStats()
-	tlog.Debug.Printf("ParallelCrypto: enabled=%v, cpu_count=%v, threshold=%v, max_workers=%v, avx2=%v, aes=%v",
-		stats["enabled"], stats["cpu_count"], stats["parallel_threshold"], stats["max_workers"], pc.hasAVX2, pc.hasAES)
+	tlog.Debug.Printf("ParallelCrypto: enabled=%v, cpu_count=%v, threshold=%v, workers=%v, avx2=%v, aes=%v",
+		pc.IsEnabled(), pc.cpuCount, pc.Threshold(), pc.Workers(), pc.hasAVX2, pc.hasAES)
 }
@@ -4,6 +4,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 )
 
 func TestParallelCrypto(t *testing.T) {
@@ -33,9 +35,15 @@ func TestParallelCrypto(t *testing.T) {
 	}
 
 	// Test performance stats
-	stats := pc.GetPerformanceStats()
-	if stats["enabled"] != true {
-		t.Error("Stats should show enabled=true")
+	r := stats.New()
+	pc.RegisterStats(r)
+	pc.ProcessBlocksOptimized(1, func(int, int) {})
+	m := r.Map()
+	if m["parallelcrypto_enabled"] != 1 {
+		t.Error("Stats should show enabled=1")
+	}
+	if m["parallelcrypto_sequential_ops_total"] != 1 {
+		t.Errorf("Stats should count one sequential op: %v", m)
 	}
 }
 
@@ -163,3 +171,32 @@ func TestWorkerCountOptimization(t *testing.T) {
 		}
 	}
 }
+
+func TestSetWorkersThreshold(t *testing.T) {
+	pc := New()
+	pc.SetWorkers(3)
+	pc.SetThreshold(10)
+	if pc.ShouldUseParallel(9) {
+		t.Error("Should not use parallel below the configured threshold")
+	}
+	// Explicit workers do not depend on the number of CPUs
+	if w := pc.GetOptimalWorkerCount(100); w != 3 {
+		t.Errorf("Expected 3 workers, got %d", w)
+	}
+	if w := pc.GetOptimalWorkerCount(10); w != 3 {
+		t.Errorf("Expected 3 workers at the threshold, got %d", w)
+	}
+	pc.SetWorkers(1)
+	if pc.ShouldUseParallel(100) {
+		t.Error("Should not use parallel with one worker")
+	}
+	pc.SetThreshold(0)
+	if pc.Threshold() != ParallelThreshold {
+		t.Errorf("SetThreshold(0) should restore the default, got %d", pc.Threshold())
+	}
+	r := stats.New()
+	pc.RegisterStats(r)
+	if m := r.Map(); m["parallelcrypto_max_workers"] != 1 || m["parallelcrypto_parallel_threshold"] != ParallelThreshold {
+		t.Errorf("Stats do not show the configuration: %v", m)
+	}
+}
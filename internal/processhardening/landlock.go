@@ -0,0 +1,16 @@
+package processhardening
+
+// LandlockRules lists the paths the process keeps access to once the
+// Landlock sandbox is active. Everything else on the filesystem becomes
+// inaccessible.
+type LandlockRules struct {
+	// ReadWrite are directories that allow full access beneath them,
+	// like CIPHERDIR.
+	ReadWrite []string
+	// ReadOnly are files or directories that can only be read, like the
+	// config file.
+	ReadOnly []string
+	// RemoveFile are directories where files may be deleted. The control
+	// socket is unlinked from its parent directory on exit.
+	RemoveFile []string
+}
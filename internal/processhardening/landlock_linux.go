@@ -0,0 +1,153 @@
+//go:build linux
+// +build linux
+
+package processhardening
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// ErrLandlockUnsupported is returned by InstallLandlock when the running
+// kernel or the build cannot provide a Landlock sandbox.
+var ErrLandlockUnsupported = errors.New("landlock not supported")
+
+// Access rights that only make sense on regular files. The kernel rejects
+// rules for files that contain directory rights.
+const landlockFileAccess = unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+	unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE | unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+
+// landlockABI returns the Landlock ABI version supported by the kernel, or 0
+// if Landlock is not available.
+func landlockABI() int {
+	v, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
+
+// landlockHandledAccess returns all filesystem access rights known to
+// Landlock ABI "abi".
+func landlockHandledAccess(abi int) uint64 {
+	// ABI 1 (Linux 5.13)
+	access := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		// Linux 5.19
+		access |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		// Linux 6.2
+		access |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	if abi >= 5 {
+		// Linux 6.10
+		access |= unix.LANDLOCK_ACCESS_FS_IOCTL_DEV
+	}
+	return access
+}
+
+// landlockAddRule allows "access" beneath "path" in the ruleset "rulesetFd".
+func landlockAddRule(rulesetFd int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	var st unix.Stat_t
+	if err = unix.Fstat(fd, &st); err != nil {
+		return err
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		access &= landlockFileAccess
+	}
+	attr := unix.LandlockPathBeneathAttr{
+		Allowed_access: access,
+		Parent_fd:      int32(fd),
+	}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(rulesetFd),
+		unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&attr)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// InstallLandlock restricts filesystem access of the whole process to the
+// paths in "rules" using Landlock (Linux 5.13+).
+//
+// Landlock ABI 1 does not allow renaming or linking files across directories
+// inside the sandbox (the kernel returns EXDEV), which would break rename(2)
+// on the mounted filesystem. We therefore require ABI 2 (Linux 5.19).
+//
+// Note that a sandboxed process can no longer unmount filesystems.
+//
+// Returns ErrLandlockUnsupported if the kernel is too old or if the binary
+// has been built with cgo, where we cannot apply the restriction to all
+// threads.
+func (ph *ProcessHardening) InstallLandlock(rules LandlockRules) error {
+	if !ph.enabled {
+		return nil
+	}
+	abi := landlockABI()
+	if abi < 2 {
+		return fmt.Errorf("%w: kernel Landlock ABI %d, need 2", ErrLandlockUnsupported, abi)
+	}
+	handled := landlockHandledAccess(abi)
+	rulesetAttr := unix.LandlockRulesetAttr{Access_fs: handled}
+	// Size of the ABI 1 struct that only contains Access_fs. We do not
+	// restrict network access or scopes.
+	const rulesetAttrSize = 8
+	r, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET,
+		uintptr(unsafe.Pointer(&rulesetAttr)), rulesetAttrSize, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %v", errno)
+	}
+	rulesetFd := int(r)
+	defer unix.Close(rulesetFd)
+
+	readOnly := uint64(unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR)
+	for _, p := range rules.ReadWrite {
+		if err := landlockAddRule(rulesetFd, p, handled); err != nil {
+			return fmt.Errorf("landlock rule for %q: %v", p, err)
+		}
+	}
+	for _, p := range rules.ReadOnly {
+		if err := landlockAddRule(rulesetFd, p, readOnly); err != nil {
+			return fmt.Errorf("landlock rule for %q: %v", p, err)
+		}
+	}
+	for _, p := range rules.RemoveFile {
+		if err := landlockAddRule(rulesetFd, p, unix.LANDLOCK_ACCESS_FS_REMOVE_FILE); err != nil {
+			return fmt.Errorf("landlock rule for %q: %v", p, err)
+		}
+	}
+	// landlock_restrict_self() only applies to the calling thread. The Go
+	// runtime runs goroutines on many threads, so both calls have to be made
+	// on all of them. AllThreadsSyscall returns ENOTSUP in cgo builds.
+	_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("%w: binary built with cgo", ErrLandlockUnsupported)
+	}
+	if errno != 0 {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %v", errno)
+	}
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, uintptr(rulesetFd), 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %v", errno)
+	}
+	tlog.Debug.Printf("ProcessHardening: Landlock ABI %d sandbox active, rules: %+v", abi, rules)
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package processhardening
+
+import (
+	"errors"
+)
+
+// ErrLandlockUnsupported is returned by InstallLandlock on platforms without
+// Landlock.
+var ErrLandlockUnsupported = errors.New("landlock not supported")
+
+// InstallLandlock is not available on non-Linux platforms.
+func (ph *ProcessHardening) InstallLandlock(rules LandlockRules) error {
+	if !ph.enabled {
+		return nil
+	}
+	return ErrLandlockUnsupported
+}
@@ -0,0 +1,74 @@
+//go:build openbsd
+// +build openbsd
+
+package processhardening
+
+import (
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// pledgePromises are the promises needed to serve FUSE requests and the
+// control socket once the filesystem is mounted.
+//
+//	stdio                  basic I/O, including reading and writing /dev/fuse
+//	rpath wpath cpath      file operations in CIPHERDIR
+//	dpath                  mknod and mkfifo
+//	fattr chown            chmod, utimes, chown
+//	flock                  file locking
+//	unix                   accepting connections on the control socket
+const pledgePromises = "stdio rpath wpath cpath dpath fattr chown flock unix"
+
+// InstallUnveil restricts filesystem access to the paths in rules using
+// unveil(2). Once this returns successfully, no further paths can be
+// unveiled.
+func (ph *ProcessHardening) InstallUnveil(rules LandlockRules) error {
+	if !ph.enabled {
+		return nil
+	}
+	removeDirs := map[string]bool{}
+	for _, p := range rules.RemoveFile {
+		removeDirs[p] = true
+		if err := unix.Unveil(p, "c"); err != nil {
+			return err
+		}
+	}
+	for _, p := range rules.ReadWrite {
+		if err := unix.Unveil(p, "rwc"); err != nil {
+			return err
+		}
+	}
+	for _, p := range rules.ReadOnly {
+		// The most specific unveil wins. A file that sits in a RemoveFile
+		// directory, like the control socket, must keep "c" so we can
+		// delete it on exit.
+		flags := "r"
+		if removeDirs[filepath.Dir(p)] {
+			flags = "rc"
+		}
+		if err := unix.Unveil(p, flags); err != nil {
+			return err
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		return err
+	}
+	tlog.Debug.Printf("ProcessHardening: unveil active, rules: %+v", rules)
+	return nil
+}
+
+// InstallPledge drops all pledge(2) promises except those in pledgePromises.
+// Exec is not permitted afterwards.
+func (ph *ProcessHardening) InstallPledge() error {
+	if !ph.enabled {
+		return nil
+	}
+	if err := unix.Pledge(pledgePromises, ""); err != nil {
+		return err
+	}
+	tlog.Debug.Printf("ProcessHardening: pledge(%q) active", pledgePromises)
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !openbsd
+// +build !openbsd
+
+package processhardening
+
+// InstallUnveil is a no-op on platforms other than OpenBSD.
+func (ph *ProcessHardening) InstallUnveil(rules LandlockRules) error {
+	return nil
+}
+
+// InstallPledge is a no-op on platforms other than OpenBSD.
+func (ph *ProcessHardening) InstallPledge() error {
+	return nil
+}
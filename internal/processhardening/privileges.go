@@ -0,0 +1,23 @@
+package processhardening
+
+import (
+	"errors"
+)
+
+// Linux capability numbers, see capabilities(7). They are defined here
+// instead of using golang.org/x/sys/unix so that callers compile on all
+// platforms.
+const (
+	CapChown         = 0
+	CapDACOverride   = 1
+	CapDACReadSearch = 2
+	CapFowner        = 3
+	CapFsetid        = 4
+	CapSetgid        = 6
+	CapSetuid        = 7
+	CapMknod         = 27
+)
+
+// ErrCapabilitiesUnsupported is returned by DropCapabilities when the
+// capabilities cannot be changed for all threads.
+var ErrCapabilitiesUnsupported = errors.New("dropping capabilities not supported")
@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package processhardening
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// DropCapabilities drops all capabilities except those listed in "keep"
+// (Cap* constants) from the permitted, effective, inheritable, ambient and
+// bounding sets.
+// Capabilities in "keep" that we do not have are silently ignored.
+func (ph *ProcessHardening) DropCapabilities(keep []int) error {
+	if !ph.enabled {
+		return nil
+	}
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var have [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &have[0]); err != nil {
+		return fmt.Errorf("capget: %v", err)
+	}
+	var want [2]unix.CapUserData
+	keepSet := map[int]bool{}
+	for _, c := range keep {
+		keepSet[c] = true
+		i, bit := c/32, uint32(1)<<(c%32)
+		if have[i].Permitted&bit != 0 {
+			want[i].Permitted |= bit
+			want[i].Effective |= bit
+		}
+	}
+	// Like landlock_restrict_self(), these calls only affect the calling
+	// thread, so they are made on all threads. AllThreadsSyscall returns
+	// ENOTSUP in cgo builds.
+	_, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_CLEAR_ALL, 0)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("%w: binary built with cgo", ErrCapabilitiesUnsupported)
+	}
+	if errno != 0 && errno != syscall.EINVAL {
+		// EINVAL: kernel older than 4.3 without ambient capabilities
+		return fmt.Errorf("PR_CAP_AMBIENT_CLEAR_ALL: %v", errno)
+	}
+	// Dropping from the bounding set needs CAP_SETPCAP, so do it before
+	// capset(). Stop at the first capability the kernel does not know.
+	if have[0].Effective&(1<<unix.CAP_SETPCAP) != 0 {
+		for c := 0; c < 64; c++ {
+			if keepSet[c] {
+				continue
+			}
+			_, _, errno = syscall.AllThreadsSyscall(syscall.SYS_PRCTL, unix.PR_CAPBSET_DROP, uintptr(c), 0)
+			if errno == syscall.EINVAL {
+				break
+			}
+			if errno != 0 {
+				return fmt.Errorf("PR_CAPBSET_DROP %d: %v", c, errno)
+			}
+		}
+	}
+	_, _, errno = syscall.AllThreadsSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&want[0])), 0)
+	if errno != 0 {
+		return fmt.Errorf("capset: %v", errno)
+	}
+	tlog.Debug.Printf("ProcessHardening: dropped capabilities, permitted now %#x", uint64(want[1].Permitted)<<32|uint64(want[0].Permitted))
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package processhardening
+
+// DropCapabilities is a no-op on non-Linux platforms, which have no
+// capabilities.
+func (ph *ProcessHardening) DropCapabilities(keep []int) error {
+	return nil
+}
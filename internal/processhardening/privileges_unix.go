@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package processhardening
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// SwitchUser permanently switches the real, effective and saved user and
+// group ids of all threads to uid and gid, and the supplementary groups to
+// "groups". When switching away from root, the kernel clears all
+// capabilities.
+//
+// Go's syscall.Setuid & friends apply to all threads since Go 1.16, also
+// in cgo builds.
+func (ph *ProcessHardening) SwitchUser(uid int, gid int, groups []int) error {
+	if !ph.enabled {
+		return nil
+	}
+	// Order matters: once we have given up root, we cannot change groups
+	// anymore.
+	if err := syscall.Setgroups(groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return err
+	}
+	tlog.Debug.Printf("ProcessHardening: switched to uid=%d gid=%d groups=%v", uid, gid, groups)
+	return nil
+}
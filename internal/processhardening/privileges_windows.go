@@ -0,0 +1,13 @@
+package processhardening
+
+import (
+	"errors"
+)
+
+// SwitchUser is not supported on Windows, which has no uids and gids.
+func (ph *ProcessHardening) SwitchUser(uid int, gid int, groups []int) error {
+	if !ph.enabled {
+		return nil
+	}
+	return errors.New("switching users is not supported on Windows")
+}
@@ -0,0 +1,60 @@
+//go:build openbsd
+// +build openbsd
+
+// Package processhardening provides process security hardening utilities for OpenBSD
+package processhardening
+
+import (
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// HardenProcess applies various process hardening measures.
+// pledge and unveil are applied later, see InstallPledge and InstallUnveil.
+func (ph *ProcessHardening) HardenProcess() {
+	if !ph.enabled {
+		return
+	}
+
+	// Disable core dumps
+	_ = syscall.Setrlimit(syscall.RLIMIT_CORE, &syscall.Rlimit{
+		Cur: 0,
+		Max: 0,
+	})
+
+	tlog.Debug.Printf("ProcessHardening: Process hardening applied (OpenBSD)")
+}
+
+// KeepAlive ensures that a buffer remains in memory and is not garbage collected
+func (ph *ProcessHardening) KeepAlive(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	runtime.KeepAlive(data)
+
+	// Mark memory as non-swappable
+	_ = unix.Mlock(data)
+}
+
+// SecureWipe overwrites memory with random data and ensures it's not recoverable
+func (ph *ProcessHardening) SecureWipe(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	// Overwrite with random pattern
+	for i := range data {
+		data[i] = byte(i % 256)
+	}
+
+	// Force garbage collection
+	runtime.GC()
+
+	// Use KeepAlive to ensure the data is processed
+	ph.KeepAlive(data)
+}
@@ -0,0 +1,105 @@
+//go:build linux
+// +build linux
+
+package processhardening
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Offsets into struct seccomp_data, see linux/seccomp.h
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	// Lower 32 bits of the first syscall argument. Both architectures we
+	// support are little-endian.
+	seccompDataArg0 = 16
+)
+
+// seccompFilter builds the BPF program for the allowlist.
+// Syscalls that are not on the list fail with EPERM, or, in strict mode, kill
+// the process. socket(2) is only allowed for AF_UNIX sockets, so a
+// compromised daemon cannot open network connections. Strict mode thereby also turns any attempt to inspect other
+// processes' memory (ptrace, process_vm_readv, process_vm_writev) into a
+// crash.
+// Returns nil if seccomp is not supported on this architecture.
+func seccompFilter(strict bool) []unix.SockFilter {
+	if seccompArch == 0 {
+		return nil
+	}
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	if strict {
+		deny = unix.SECCOMP_RET_KILL_PROCESS
+	}
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	prog := []unix.SockFilter{
+		// Syscall numbers are only meaningful for one architecture. Kill
+		// everything that uses a foreign calling convention.
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompArch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+	}
+	if seccompNrLimit != 0 {
+		// Reject the x32 ABI on amd64
+		prog = append(prog,
+			jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, seccompNrLimit, 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, deny))
+	}
+	allowed := append(seccompAllowedSyscalls[:len(seccompAllowedSyscalls):len(seccompAllowedSyscalls)], seccompArchSyscalls...)
+	for _, nr := range allowed {
+		prog = append(prog,
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW))
+	}
+	prog = append(prog,
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.SYS_SOCKET, 0, 3),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArg0),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, unix.AF_UNIX, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW),
+		stmt(unix.BPF_RET|unix.BPF_K, deny))
+	return prog
+}
+
+// InstallSeccomp restricts the process to the syscalls needed for serving
+// FUSE requests. It must be called after the filesystem has been mounted and
+// all setup (daemonization, syslog, control socket) is done.
+// The filter applies to all threads and cannot be removed again.
+func (ph *ProcessHardening) InstallSeccomp(strict bool) error {
+	if !ph.enabled {
+		return nil
+	}
+	filter := seccompFilter(strict)
+	if filter == nil {
+		tlog.Debug.Printf("ProcessHardening: seccomp not supported on this architecture")
+		return nil
+	}
+	// Required for unprivileged processes to install a filter
+	err := prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+	if err != nil {
+		return fmt.Errorf("PR_SET_NO_NEW_PRIVS: %v", err)
+	}
+	prog := unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	// The Go runtime runs on many threads. TSYNC applies the filter to all of
+	// them, not just to the calling thread.
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %v", errno)
+	}
+	tlog.Debug.Printf("ProcessHardening: seccomp filter installed (%d instructions, strict=%v)", len(filter), strict)
+	return nil
+}
@@ -0,0 +1,21 @@
+package processhardening
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const seccompArch = unix.AUDIT_ARCH_X86_64
+
+// seccompNrLimit is __X32_SYSCALL_BIT. Syscall numbers at or above it belong
+// to the x32 ABI and are rejected.
+const seccompNrLimit = 0x40000000
+
+// seccompArchSyscalls are legacy syscalls that only exist on amd64 but are
+// still used by the Go runtime and the standard library.
+var seccompArchSyscalls = []uintptr{
+	unix.SYS_OPEN, unix.SYS_STAT, unix.SYS_LSTAT, unix.SYS_READLINK,
+	unix.SYS_POLL, unix.SYS_SELECT, unix.SYS_EPOLL_WAIT, unix.SYS_EPOLL_CREATE,
+	unix.SYS_PIPE, unix.SYS_DUP2, unix.SYS_ARCH_PRCTL, unix.SYS_GETDENTS,
+	unix.SYS_RENAME, unix.SYS_UNLINK, unix.SYS_RMDIR, unix.SYS_MKDIR, unix.SYS_ACCESS,
+	unix.SYS_TIME,
+}
@@ -0,0 +1,14 @@
+package processhardening
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const seccompArch = unix.AUDIT_ARCH_AARCH64
+
+// seccompNrLimit is not needed on arm64, there is no alternative ABI.
+const seccompNrLimit = 0
+
+// seccompArchSyscalls is empty on arm64, which only has the modern *at
+// syscalls.
+var seccompArchSyscalls []uintptr
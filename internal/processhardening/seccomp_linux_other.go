@@ -0,0 +1,14 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package processhardening
+
+// seccompArch is zero on architectures we have no syscall allowlist for.
+// InstallSeccomp is a no-op there.
+const seccompArch = 0
+
+const seccompNrLimit = 0
+
+var seccompArchSyscalls []uintptr
+
+var seccompAllowedSyscalls []uintptr
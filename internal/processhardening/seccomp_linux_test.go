@@ -0,0 +1,99 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package processhardening
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFilter is a minimal BPF interpreter for the instructions used by
+// seccompFilter.
+func runFilter(t *testing.T, prog []unix.SockFilter, arch uint32, nr uint32, arg0 uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			switch ins.K {
+			case seccompDataNr:
+				acc = nr
+			case seccompDataArch:
+				acc = arch
+			case seccompDataArg0:
+				acc = arg0
+			default:
+				t.Fatalf("pc=%d: unexpected load offset %d", pc, ins.K)
+			}
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			if acc >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("pc=%d: unexpected opcode %#x", pc, ins.Code)
+		}
+	}
+	t.Fatal("program fell off the end")
+	return 0
+}
+
+func TestSeccompFilter(t *testing.T) {
+	eperm := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	testCases := []struct {
+		strict bool
+		arch   uint32
+		nr     uintptr
+		arg0   uint32
+		want   uint32
+	}{
+		{false, seccompArch, unix.SYS_READ, 0, unix.SECCOMP_RET_ALLOW},
+		{false, seccompArch, unix.SYS_UMOUNT2, 0, unix.SECCOMP_RET_ALLOW},
+		{true, seccompArch, unix.SYS_NAME_TO_HANDLE_AT, 0, unix.SECCOMP_RET_ALLOW},
+		{false, seccompArch, unix.SYS_PTRACE, 0, eperm},
+		{false, seccompArch, unix.SYS_PROCESS_VM_READV, 0, eperm},
+		{true, seccompArch, unix.SYS_FUTEX, 0, unix.SECCOMP_RET_ALLOW},
+		{true, seccompArch, unix.SYS_PTRACE, 0, unix.SECCOMP_RET_KILL_PROCESS},
+		{true, seccompArch, unix.SYS_PROCESS_VM_READV, 0, unix.SECCOMP_RET_KILL_PROCESS},
+		{true, seccompArch, unix.SYS_PROCESS_VM_WRITEV, 0, unix.SECCOMP_RET_KILL_PROCESS},
+		// Only AF_UNIX sockets
+		{false, seccompArch, unix.SYS_SOCKET, unix.AF_UNIX, unix.SECCOMP_RET_ALLOW},
+		{false, seccompArch, unix.SYS_SOCKET, unix.AF_INET, eperm},
+		{true, seccompArch, unix.SYS_SOCKET, unix.AF_INET6, unix.SECCOMP_RET_KILL_PROCESS},
+		{true, seccompArch, unix.SYS_SOCKET, unix.AF_NETLINK, unix.SECCOMP_RET_KILL_PROCESS},
+		// No exec
+		{false, seccompArch, unix.SYS_EXECVE, 0, eperm},
+		{true, seccompArch, unix.SYS_EXECVEAT, 0, unix.SECCOMP_RET_KILL_PROCESS},
+		// Foreign architecture is always killed
+		{false, 0x12345678, unix.SYS_READ, 0, unix.SECCOMP_RET_KILL_PROCESS},
+	}
+	for _, tc := range testCases {
+		have := runFilter(t, seccompFilter(tc.strict), tc.arch, uint32(tc.nr), tc.arg0)
+		if have != tc.want {
+			t.Errorf("strict=%v arch=%#x nr=%d: want %#x, have %#x", tc.strict, tc.arch, tc.nr, tc.want, have)
+		}
+	}
+}
+
+func TestSeccompFilterX32(t *testing.T) {
+	if seccompNrLimit == 0 {
+		t.Skip("no alternative ABI on this architecture")
+	}
+	// x32 variant of read()
+	have := runFilter(t, seccompFilter(true), seccompArch, seccompNrLimit|unix.SYS_READ, 0)
+	if have != unix.SECCOMP_RET_KILL_PROCESS {
+		t.Errorf("x32 syscall was not rejected: %#x", have)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package processhardening
+
+// InstallSeccomp is a no-op on non-Linux platforms.
+func (ph *ProcessHardening) InstallSeccomp(strict bool) error {
+	return nil
+}
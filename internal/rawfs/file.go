@@ -0,0 +1,297 @@
+package rawfs
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+)
+
+// File is an open file or directory. It holds a lookup reference on
+// nodeID (unless it is the root directory) that is dropped by Close. The
+// method set matches webdav.File. File is not safe for concurrent use.
+type File struct {
+	fs     *FS
+	name   string
+	nodeID uint64
+	fh     uint64
+	isDir  bool
+	// Current offset for Read, Write and Seek
+	off int64
+	// Directory entries that have not been returned by Readdir yet.
+	// nil until the first Readdir call.
+	entries []os.FileInfo
+}
+
+// Close implements io.Closer.
+func (f *File) Close() error {
+	in := fuse.ReleaseIn{InHeader: f.fs.header(f.nodeID), Fh: f.fh}
+	var err error
+	if f.isDir {
+		f.fs.raw.ReleaseDir(&in)
+	} else {
+		flush := fuse.FlushIn{InHeader: f.fs.header(f.nodeID), Fh: f.fh}
+		err = toErr(f.fs.raw.Flush(nil, &flush))
+		f.fs.raw.Release(nil, &in)
+	}
+	f.fs.forget([]uint64{f.nodeID})
+	return err
+}
+
+// Read implements io.Reader.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt. It does not change the offset used by
+// Read and Write.
+func (f *File) ReadAt(p []byte, off int64) (n int, err error) {
+	if f.isDir {
+		return 0, syscall.EISDIR
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	for len(p) > 0 {
+		// The FUSE frontends cannot handle larger requests
+		chunk := p
+		if len(chunk) > contentenc.MaxKernelWrite {
+			chunk = chunk[:contentenc.MaxKernelWrite]
+		}
+		in := fuse.ReadIn{
+			InHeader: f.fs.header(f.nodeID),
+			Fh:       f.fh,
+			Offset:   uint64(off),
+			Size:     uint32(len(chunk)),
+		}
+		res, st := f.fs.raw.Read(nil, &in, chunk)
+		if !st.Ok() {
+			return n, toErr(st)
+		}
+		data, st := res.Bytes(chunk)
+		res.Done()
+		if !st.Ok() {
+			return n, toErr(st)
+		}
+		if len(data) == 0 {
+			return n, io.EOF
+		}
+		copy(chunk, data)
+		n += len(data)
+		off += int64(len(data))
+		p = p[len(data):]
+	}
+	return n, nil
+}
+
+// Write implements io.Writer.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.WriteAt(p, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// WriteAt implements io.WriterAt. It does not change the offset used by
+// Read and Write.
+func (f *File) WriteAt(p []byte, off int64) (n int, err error) {
+	if f.isDir {
+		return 0, syscall.EISDIR
+	}
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > contentenc.MaxKernelWrite {
+			chunk = chunk[:contentenc.MaxKernelWrite]
+		}
+		in := fuse.WriteIn{
+			InHeader: f.fs.header(f.nodeID),
+			Fh:       f.fh,
+			Offset:   uint64(off),
+			Size:     uint32(len(chunk)),
+		}
+		written, st := f.fs.raw.Write(nil, &in, chunk)
+		if !st.Ok() {
+			return n, toErr(st)
+		}
+		if written == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += int(written)
+		off += int64(written)
+		p = p[written:]
+	}
+	return n, nil
+}
+
+// Seek implements io.Seeker.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += fi.Size()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.off = offset
+	return offset, nil
+}
+
+// Stat returns information about the open file.
+func (f *File) Stat() (os.FileInfo, error) {
+	in := fuse.GetAttrIn{InHeader: f.fs.header(f.nodeID)}
+	if !f.isDir {
+		in.Flags_ = fuse.FUSE_GETATTR_FH
+		in.Fh_ = f.fh
+	}
+	var out fuse.AttrOut
+	if st := f.fs.raw.GetAttr(nil, &in, &out); !st.Ok() {
+		return nil, toErr(st)
+	}
+	return &fileInfo{name: f.name, attr: out.Attr}, nil
+}
+
+// Truncate changes the size of the file.
+func (f *File) Truncate(size int64) error {
+	if f.isDir {
+		return syscall.EISDIR
+	}
+	if size < 0 {
+		return os.ErrInvalid
+	}
+	in := fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		InHeader: f.fs.header(f.nodeID),
+		Valid:    fuse.FATTR_SIZE | fuse.FATTR_FH,
+		Fh:       f.fh,
+		Size:     uint64(size),
+	}}
+	var out fuse.AttrOut
+	return toErr(f.fs.raw.SetAttr(nil, &in, &out))
+}
+
+// Sync writes the file contents to stable storage.
+func (f *File) Sync() error {
+	in := fuse.FsyncIn{InHeader: f.fs.header(f.nodeID), Fh: f.fh}
+	if f.isDir {
+		return toErr(f.fs.raw.FsyncDir(nil, &in))
+	}
+	return toErr(f.fs.raw.Fsync(nil, &in))
+}
+
+// Readdir reads the directory. Like os.File.Readdir, it returns at most
+// "count" entries if count > 0, and io.EOF at the end of the directory.
+func (f *File) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.isDir {
+		return nil, syscall.ENOTDIR
+	}
+	if f.entries == nil {
+		names, err := f.fs.readDirNamesFh(nil, f.nodeID, f.fh)
+		if err != nil {
+			return nil, err
+		}
+		f.entries = []os.FileInfo{}
+		for _, name := range names {
+			hdr := f.fs.header(f.nodeID)
+			var out fuse.EntryOut
+			if st := f.fs.raw.Lookup(nil, &hdr, name, &out); !st.Ok() {
+				// Deleted in the meantime
+				continue
+			}
+			f.fs.raw.Forget(out.NodeId, 1)
+			f.entries = append(f.entries, &fileInfo{name: name, attr: out.Attr})
+		}
+	}
+	if count <= 0 {
+		ret := f.entries
+		f.entries = f.entries[len(f.entries):]
+		return ret, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+	ret := f.entries[:count]
+	f.entries = f.entries[count:]
+	return ret, nil
+}
+
+// readDirNames returns the names in directory "nodeID", without "." and "..".
+func (f *FS) readDirNames(cancel <-chan struct{}, nodeID uint64) ([]string, error) {
+	in := fuse.OpenIn{InHeader: f.header(nodeID)}
+	var out fuse.OpenOut
+	if st := f.raw.OpenDir(cancel, &in, &out); !st.Ok() {
+		return nil, toErr(st)
+	}
+	defer f.raw.ReleaseDir(&fuse.ReleaseIn{InHeader: f.header(nodeID), Fh: out.Fh})
+	return f.readDirNamesFh(cancel, nodeID, out.Fh)
+}
+
+// dirent is the serialized directory entry written by fuse.DirEntryList,
+// see struct fuse_dirent in the kernel.
+type dirent struct {
+	ino     uint64
+	off     uint64
+	nameLen uint32
+	typ     uint32
+}
+
+const direntSize = int(unsafe.Sizeof(dirent{}))
+
+// readDirNamesFh is like readDirNames for an already-open directory.
+func (f *FS) readDirNamesFh(cancel <-chan struct{}, nodeID uint64, fh uint64) ([]string, error) {
+	var names []string
+	buf := make([]byte, 64*1024)
+	var off uint64
+	for {
+		// The entries are not length-prefixed. Zero the buffer so we can
+		// tell where they end.
+		for i := range buf {
+			buf[i] = 0
+		}
+		in := fuse.ReadIn{
+			InHeader: f.header(nodeID),
+			Fh:       fh,
+			Offset:   off,
+			Size:     uint32(len(buf)),
+		}
+		if st := f.raw.ReadDir(cancel, &in, fuse.NewDirEntryList(buf, off)); !st.Ok() {
+			return nil, toErr(st)
+		}
+		n := 0
+		for p := 0; p+direntSize <= len(buf); {
+			d := (*dirent)(unsafe.Pointer(&buf[p]))
+			if d.nameLen == 0 {
+				break
+			}
+			name := string(buf[p+direntSize : p+direntSize+int(d.nameLen)])
+			if name != "." && name != ".." {
+				names = append(names, name)
+			}
+			off = d.off
+			n++
+			// Entries are padded to 8 bytes
+			p += (direntSize + int(d.nameLen) + 7) &^ 7
+		}
+		if n == 0 {
+			return names, nil
+		}
+	}
+}
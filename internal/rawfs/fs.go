@@ -0,0 +1,474 @@
+// Package rawfs accesses a gocryptfs filesystem without mounting it
+// through the kernel. The go-fuse node tree is driven in-process through
+// its fuse.RawFileSystem interface, so all the encryption logic of the FUSE
+// frontends is reused unchanged. It is used by the WebDAV server and by
+// pkg/vault.
+package rawfs
+
+import (
+	"context"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// xattrBufSize is the buffer size for Listxattr and Getxattr. Linux limits
+// both the list and a single value to 64 KiB.
+const xattrBufSize = 64 * 1024
+
+// FS provides operations like in package os on top of a
+// fuse.RawFileSystem. The method signatures match webdav.FileSystem. FS is
+// safe for concurrent use.
+type FS struct {
+	raw    fuse.RawFileSystem
+	caller fuse.Caller
+	// readOnly makes all modifications fail with EROFS. When mounted,
+	// the kernel does this for us.
+	readOnly bool
+}
+
+// New returns an FS for "raw", which must have been created by
+// fs.NewNodeFS. All operations are performed with our own uid and gid.
+func New(raw fuse.RawFileSystem, readOnly bool) *FS {
+	return &FS{
+		raw:      raw,
+		readOnly: readOnly,
+		caller: fuse.Caller{
+			Owner: fuse.Owner{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())},
+			Pid:   uint32(os.Getpid()),
+		},
+	}
+}
+
+// header returns an InHeader for an operation on "nodeID".
+func (f *FS) header(nodeID uint64) fuse.InHeader {
+	return fuse.InHeader{NodeId: nodeID, Caller: f.caller}
+}
+
+// toErr converts a fuse.Status to an error that works with os.IsNotExist
+// and friends.
+func toErr(st fuse.Status) error {
+	if st == fuse.OK {
+		return nil
+	}
+	return syscall.Errno(st)
+}
+
+// splitPath cleans the slash-separated "name" and returns its components.
+// The root directory has no components.
+func splitPath(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// lookup resolves "name" component by component. Every node id in the
+// returned slice (except the root) holds a lookup reference that must be
+// dropped using forget. The last id is "name" itself.
+func (f *FS) lookup(cancel <-chan struct{}, name string) (ids []uint64, attr fuse.Attr, err error) {
+	ids = []uint64{fuse.FUSE_ROOT_ID}
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		var out fuse.AttrOut
+		in := fuse.GetAttrIn{InHeader: f.header(fuse.FUSE_ROOT_ID)}
+		if st := f.raw.GetAttr(cancel, &in, &out); !st.Ok() {
+			return nil, attr, toErr(st)
+		}
+		return ids, out.Attr, nil
+	}
+	for _, part := range parts {
+		if attr.Ino != 0 && !attr.IsDir() {
+			f.forget(ids)
+			return nil, attr, syscall.ENOTDIR
+		}
+		var out fuse.EntryOut
+		hdr := f.header(ids[len(ids)-1])
+		if st := f.raw.Lookup(cancel, &hdr, part, &out); !st.Ok() {
+			f.forget(ids)
+			return nil, attr, toErr(st)
+		}
+		ids = append(ids, out.NodeId)
+		attr = out.Attr
+	}
+	return ids, attr, nil
+}
+
+// lookupParent resolves the parent directory of "name" and returns the
+// last path component.
+func (f *FS) lookupParent(cancel <-chan struct{}, name string) (ids []uint64, base string, err error) {
+	parts := splitPath(name)
+	if len(parts) == 0 {
+		// The root directory has no parent
+		return nil, "", os.ErrInvalid
+	}
+	ids, attr, err := f.lookup(cancel, strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !attr.IsDir() && len(ids) > 1 {
+		f.forget(ids)
+		return nil, "", syscall.ENOTDIR
+	}
+	return ids, parts[len(parts)-1], nil
+}
+
+// forget drops the lookup references returned by lookup.
+func (f *FS) forget(ids []uint64) {
+	for i := len(ids) - 1; i >= 0; i-- {
+		if ids[i] != fuse.FUSE_ROOT_ID {
+			f.raw.Forget(ids[i], 1)
+		}
+	}
+}
+
+// Mkdir creates a directory.
+func (f *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	ids, base, err := f.lookupParent(ctx.Done(), name)
+	if err != nil {
+		return err
+	}
+	defer f.forget(ids)
+	in := fuse.MkdirIn{InHeader: f.header(ids[len(ids)-1]), Mode: uint32(perm.Perm())}
+	var out fuse.EntryOut
+	if st := f.raw.Mkdir(ctx.Done(), &in, base, &out); !st.Ok() {
+		return toErr(st)
+	}
+	f.raw.Forget(out.NodeId, 1)
+	return nil
+}
+
+// OpenFile opens a file or directory like os.OpenFile.
+func (f *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (*File, error) {
+	if f.readOnly && flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, syscall.EROFS
+	}
+	cancel := ctx.Done()
+	ids, attr, err := f.lookup(cancel, name)
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		return f.create(cancel, name, flag, perm)
+	} else if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		f.forget(ids)
+		return nil, os.ErrExist
+	}
+	// Only the last node id stays referenced while the file is open
+	nodeID := ids[len(ids)-1]
+	f.forget(ids[:len(ids)-1])
+	file := &File{fs: f, name: path.Base("/" + name), nodeID: nodeID}
+	var out fuse.OpenOut
+	if attr.IsDir() {
+		in := fuse.OpenIn{InHeader: f.header(nodeID)}
+		if st := f.raw.OpenDir(cancel, &in, &out); !st.Ok() {
+			f.forget([]uint64{nodeID})
+			return nil, toErr(st)
+		}
+		file.isDir = true
+		file.fh = out.Fh
+		return file, nil
+	}
+	// Like the kernel without FUSE_ATOMIC_O_TRUNC, we truncate using
+	// SetAttr instead of passing O_TRUNC on.
+	in := fuse.OpenIn{InHeader: f.header(nodeID), Flags: uint32(flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC))}
+	if st := f.raw.Open(cancel, &in, &out); !st.Ok() {
+		f.forget([]uint64{nodeID})
+		return nil, toErr(st)
+	}
+	file.fh = out.Fh
+	if flag&os.O_TRUNC != 0 {
+		if err := file.Truncate(0); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+// create creates and opens a new regular file.
+func (f *FS) create(cancel <-chan struct{}, name string, flag int, perm os.FileMode) (*File, error) {
+	ids, base, err := f.lookupParent(cancel, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.forget(ids)
+	in := fuse.CreateIn{
+		InHeader: f.header(ids[len(ids)-1]),
+		Flags:    uint32(flag &^ os.O_TRUNC),
+		Mode:     uint32(perm.Perm()),
+	}
+	var out fuse.CreateOut
+	if st := f.raw.Create(cancel, &in, base, &out); !st.Ok() {
+		return nil, toErr(st)
+	}
+	return &File{fs: f, name: base, nodeID: out.NodeId, fh: out.Fh}, nil
+}
+
+// Remove removes a file or an empty directory.
+func (f *FS) Remove(ctx context.Context, name string) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	cancel := ctx.Done()
+	ids, base, err := f.lookupParent(cancel, name)
+	if err != nil {
+		return err
+	}
+	defer f.forget(ids)
+	hdr := f.header(ids[len(ids)-1])
+	var out fuse.EntryOut
+	if st := f.raw.Lookup(cancel, &hdr, base, &out); !st.Ok() {
+		return toErr(st)
+	}
+	f.raw.Forget(out.NodeId, 1)
+	if out.Attr.IsDir() {
+		return toErr(f.raw.Rmdir(cancel, &hdr, base))
+	}
+	return toErr(f.raw.Unlink(cancel, &hdr, base))
+}
+
+// RemoveAll removes "name" and everything it contains. Like
+// os.RemoveAll, it is not an error if "name" does not exist.
+func (f *FS) RemoveAll(ctx context.Context, name string) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	ids, base, err := f.lookupParent(ctx.Done(), name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.forget(ids)
+	return f.removeAll(ctx.Done(), ids[len(ids)-1], base)
+}
+
+// removeAll removes "name" in directory "parent" recursively.
+func (f *FS) removeAll(cancel <-chan struct{}, parent uint64, name string) error {
+	hdr := f.header(parent)
+	var out fuse.EntryOut
+	if st := f.raw.Lookup(cancel, &hdr, name, &out); !st.Ok() {
+		if st == fuse.ENOENT {
+			return nil
+		}
+		return toErr(st)
+	}
+	defer f.raw.Forget(out.NodeId, 1)
+	if !out.Attr.IsDir() {
+		return toErr(f.raw.Unlink(cancel, &hdr, name))
+	}
+	names, err := f.readDirNames(cancel, out.NodeId)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err := f.removeAll(cancel, out.NodeId, n); err != nil {
+			return err
+		}
+	}
+	return toErr(f.raw.Rmdir(cancel, &hdr, name))
+}
+
+// Rename renames (moves) a file or directory.
+func (f *FS) Rename(ctx context.Context, oldName, newName string) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	cancel := ctx.Done()
+	oldIDs, oldBase, err := f.lookupParent(cancel, oldName)
+	if err != nil {
+		return err
+	}
+	defer f.forget(oldIDs)
+	newIDs, newBase, err := f.lookupParent(cancel, newName)
+	if err != nil {
+		return err
+	}
+	defer f.forget(newIDs)
+	in := fuse.RenameIn{
+		InHeader: f.header(oldIDs[len(oldIDs)-1]),
+		Newdir:   newIDs[len(newIDs)-1],
+	}
+	return toErr(f.raw.Rename(cancel, &in, oldBase, newBase))
+}
+
+// Symlink creates the symbolic link "name" pointing to "target".
+func (f *FS) Symlink(ctx context.Context, target, name string) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	ids, base, err := f.lookupParent(ctx.Done(), name)
+	if err != nil {
+		return err
+	}
+	defer f.forget(ids)
+	hdr := f.header(ids[len(ids)-1])
+	var out fuse.EntryOut
+	if st := f.raw.Symlink(ctx.Done(), &hdr, target, base, &out); !st.Ok() {
+		return toErr(st)
+	}
+	f.raw.Forget(out.NodeId, 1)
+	return nil
+}
+
+// Readlink returns the target of the symbolic link "name".
+func (f *FS) Readlink(ctx context.Context, name string) (string, error) {
+	ids, _, err := f.lookup(ctx.Done(), name)
+	if err != nil {
+		return "", err
+	}
+	defer f.forget(ids)
+	hdr := f.header(ids[len(ids)-1])
+	target, st := f.raw.Readlink(ctx.Done(), &hdr)
+	return string(target), toErr(st)
+}
+
+// Chmod changes the permission bits of "name". Like os.Lchmod, symbolic
+// links are not followed.
+func (f *FS) Chmod(ctx context.Context, name string, mode os.FileMode) error {
+	return f.setAttr(ctx, name, fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: uint32(mode.Perm())})
+}
+
+// Chtimes changes the access and modification times of "name". Symbolic
+// links are not followed.
+func (f *FS) Chtimes(ctx context.Context, name string, atime time.Time, mtime time.Time) error {
+	return f.setAttr(ctx, name, fuse.SetAttrInCommon{
+		Valid:     fuse.FATTR_ATIME | fuse.FATTR_MTIME,
+		Atime:     uint64(atime.Unix()),
+		Atimensec: uint32(atime.Nanosecond()),
+		Mtime:     uint64(mtime.Unix()),
+		Mtimensec: uint32(mtime.Nanosecond()),
+	})
+}
+
+// setAttr applies "in" to "name". The InHeader is filled in.
+func (f *FS) setAttr(ctx context.Context, name string, in fuse.SetAttrInCommon) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	ids, _, err := f.lookup(ctx.Done(), name)
+	if err != nil {
+		return err
+	}
+	defer f.forget(ids)
+	in.InHeader = f.header(ids[len(ids)-1])
+	var out fuse.AttrOut
+	return toErr(f.raw.SetAttr(ctx.Done(), &fuse.SetAttrIn{SetAttrInCommon: in}, &out))
+}
+
+// Setxattr sets the extended attribute "attr" of "name" to "data".
+func (f *FS) Setxattr(ctx context.Context, name string, attr string, data []byte) error {
+	if f.readOnly {
+		return syscall.EROFS
+	}
+	ids, _, err := f.lookup(ctx.Done(), name)
+	if err != nil {
+		return err
+	}
+	defer f.forget(ids)
+	in := fuse.SetXAttrIn{InHeader: f.header(ids[len(ids)-1]), Size: uint32(len(data))}
+	return toErr(f.raw.SetXAttr(ctx.Done(), &in, attr, data))
+}
+
+// Listxattr returns the names of the extended attributes of "name".
+func (f *FS) Listxattr(ctx context.Context, name string) ([]string, error) {
+	ids, _, err := f.lookup(ctx.Done(), name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.forget(ids)
+	hdr := f.header(ids[len(ids)-1])
+	buf := make([]byte, xattrBufSize)
+	sz, st := f.raw.ListXAttr(ctx.Done(), &hdr, buf)
+	if !st.Ok() {
+		return nil, toErr(st)
+	}
+	var attrs []string
+	for _, a := range strings.Split(string(buf[:sz]), "\x00") {
+		if a != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	return attrs, nil
+}
+
+// Getxattr returns the value of the extended attribute "attr" of "name".
+func (f *FS) Getxattr(ctx context.Context, name string, attr string) ([]byte, error) {
+	ids, _, err := f.lookup(ctx.Done(), name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.forget(ids)
+	hdr := f.header(ids[len(ids)-1])
+	buf := make([]byte, xattrBufSize)
+	sz, st := f.raw.GetXAttr(ctx.Done(), &hdr, attr, buf)
+	if !st.Ok() {
+		return nil, toErr(st)
+	}
+	return buf[:sz], nil
+}
+
+// Stat returns information about a file or directory.
+func (f *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	ids, attr, err := f.lookup(ctx.Done(), name)
+	if err != nil {
+		return nil, err
+	}
+	f.forget(ids)
+	return &fileInfo{name: path.Base("/" + name), attr: attr}, nil
+}
+
+// fileInfo implements os.FileInfo for a fuse.Attr.
+type fileInfo struct {
+	name string
+	attr fuse.Attr
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return int64(fi.attr.Size)
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	m := os.FileMode(fi.attr.Mode & 0777)
+	switch fi.attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		m |= os.ModeDir
+	case syscall.S_IFLNK:
+		m |= os.ModeSymlink
+	case syscall.S_IFIFO:
+		m |= os.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		m |= os.ModeSocket
+	case syscall.S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	case syscall.S_IFBLK:
+		m |= os.ModeDevice
+	}
+	return m
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(int64(fi.attr.Mtime), int64(fi.attr.Mtimensec))
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.attr.IsDir()
+}
+
+// Sys returns the fuse.Attr.
+func (fi *fileInfo) Sys() interface{} {
+	return &fi.attr
+}
@@ -0,0 +1,219 @@
+package rawfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// newLoopbackFS serves a temporary directory through go-fuse's loopback
+// node tree.
+func newLoopbackFS(t *testing.T, readOnly bool) (*FS, string) {
+	dir := t.TempDir()
+	root, err := fs.NewLoopbackRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(fs.NewNodeFS(root, &fs.Options{}), readOnly), dir
+}
+
+func TestReadWrite(t *testing.T) {
+	f, dir := newLoopbackFS(t, false)
+	ctx := context.Background()
+	if err := f.Mkdir(ctx, "/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Larger than one request
+	content := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	w, err := f.OpenFile(ctx, "/d/f", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	have, err := os.ReadFile(filepath.Join(dir, "d/f"))
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("backing file: err=%v len=%d, want len=%d", err, len(have), len(content))
+	}
+	r, err := f.OpenFile(ctx, "/d/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Seek(16, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	have, err = io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(have, content[16:]) {
+		t.Fatalf("read back: err=%v len=%d", err, len(have))
+	}
+	// O_TRUNC
+	w, err = f.OpenFile(ctx, "/d/f", os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	fi, err := f.Stat(ctx, "/d/f")
+	if err != nil || fi.Size() != 0 || fi.Name() != "f" {
+		t.Fatalf("after O_TRUNC: err=%v fi=%v", err, fi)
+	}
+	if _, err = f.OpenFile(ctx, "/d/f", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600); !os.IsExist(err) {
+		t.Errorf("O_EXCL: have %v", err)
+	}
+	if _, err = f.Stat(ctx, "/d/missing"); !os.IsNotExist(err) {
+		t.Errorf("missing file: have %v", err)
+	}
+	if _, err = f.Stat(ctx, "/d/f/x"); err == nil {
+		t.Errorf("lookup below a file should fail")
+	}
+}
+
+func TestReaddirRenameRemove(t *testing.T) {
+	f, dir := newLoopbackFS(t, false)
+	ctx := context.Background()
+	var want []string
+	for i := 0; i < 300; i++ {
+		// Long names so the entries need several ReadDir calls
+		name := string(bytes.Repeat([]byte{'a' + byte(i%26)}, 200)) + string(rune('A'+i/26))
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, "sub")
+	sort.Strings(want)
+
+	d, err := f.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for {
+		fis, err := d.Readdir(7)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		for _, fi := range fis {
+			have = append(have, fi.Name())
+			if fi.IsDir() != (fi.Name() == "sub") {
+				t.Errorf("%q: wrong IsDir", fi.Name())
+			}
+		}
+	}
+	d.Close()
+	sort.Strings(have)
+	if len(have) != len(want) {
+		t.Fatalf("have %d entries, want %d", len(have), len(want))
+	}
+	for i := range have {
+		if have[i] != want[i] {
+			t.Fatalf("entry %d: have %q, want %q", i, have[i], want[i])
+		}
+	}
+
+	if err = f.Rename(ctx, "/"+want[0], "/sub/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sub/x")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.RemoveAll(ctx, "/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "sub")); !os.IsNotExist(err) {
+		t.Errorf("sub still exists: %v", err)
+	}
+	if err = f.RemoveAll(ctx, "/"); err != os.ErrInvalid {
+		t.Errorf("removing the root: have %v", err)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	f, dir := newLoopbackFS(t, true)
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r, err := f.OpenFile(ctx, "/f", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err = f.OpenFile(ctx, "/f", os.O_RDWR, 0); err != syscall.EROFS {
+		t.Errorf("OpenFile: have %v", err)
+	}
+	if err = f.Mkdir(ctx, "/d", 0700); err != syscall.EROFS {
+		t.Errorf("Mkdir: have %v", err)
+	}
+	if err = f.Rename(ctx, "/f", "/g"); err != syscall.EROFS {
+		t.Errorf("Rename: have %v", err)
+	}
+	if err = f.RemoveAll(ctx, "/f"); err != syscall.EROFS {
+		t.Errorf("RemoveAll: have %v", err)
+	}
+	if err = f.Chmod(ctx, "/f", 0644); err != syscall.EROFS {
+		t.Errorf("Chmod: have %v", err)
+	}
+}
+
+func TestSymlinkAttrs(t *testing.T) {
+	f, dir := newLoopbackFS(t, false)
+	ctx := context.Background()
+	if err := os.WriteFile(filepath.Join(dir, "f"), []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Symlink(ctx, "f", "/l"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := f.Readlink(ctx, "/l"); err != nil || target != "f" {
+		t.Errorf("Readlink: target=%q err=%v", target, err)
+	}
+	if err := f.Chmod(ctx, "/f", 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	if err := f.Chtimes(ctx, "/f", time.Now(), mtime); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("mode=%v mtime=%v", fi.Mode(), fi.ModTime())
+	}
+	err = f.Setxattr(ctx, "/f", "user.foo", []byte("bar"))
+	if err == syscall.ENOTSUP {
+		t.Skip("xattrs are not supported")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	if val, err := syscallcompat.Lgetxattr(filepath.Join(dir, "f"), "user.foo"); err != nil || string(val) != "bar" {
+		t.Errorf("xattr: val=%q err=%v", val, err)
+	}
+	if val, err := f.Getxattr(ctx, "/f", "user.foo"); err != nil || string(val) != "bar" {
+		t.Errorf("Getxattr: val=%q err=%v", val, err)
+	}
+	if attrs, err := f.Listxattr(ctx, "/f"); err != nil || len(attrs) != 1 || attrs[0] != "user.foo" {
+		t.Errorf("Listxattr: attrs=%q err=%v", attrs, err)
+	}
+}
@@ -67,6 +67,21 @@ func Twice(extpass []string, passfile []string) ([]byte, error) {
 	return p1, nil
 }
 
+// Confirm asks a yes/no question on the terminal. Returns false if the user
+// does not answer "y" or "yes", or if stdin is not a terminal.
+func Confirm(prompt string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+	fmt.Fprint(os.Stderr, prompt+" [y/N] ")
+	l, err := readLineUnbuffered(os.Stdin)
+	if err != nil {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(string(l)))
+	return answer == "y" || answer == "yes"
+}
+
 // readPasswordTerminal reads a line from the terminal.
 // Exits on read error or empty result.
 func readPasswordTerminal(prompt string) ([]byte, error) {
@@ -0,0 +1,296 @@
+// Package share implements "gocryptfs -share": a single file is exported,
+// encrypted with a random key of its own, together with a token that holds
+// that key wrapped for one recipient. The recipient opens it with
+// gocryptfs-share and needs neither the master key nor the password of the
+// filesystem.
+package share
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+const (
+	// TokenVersion is the version of the Token format
+	TokenVersion = 1
+	// TokenSuffix is appended to the name of the exported file to get the
+	// name of its token
+	TokenSuffix = ".token"
+	// RecipientPassword means that the key is wrapped under a password
+	RecipientPassword = "password"
+	// RecipientX25519 means that the key is wrapped for an X25519 public
+	// key
+	RecipientX25519 = "x25519"
+	// PublicKeyPrefix starts the text form of an X25519 public key
+	PublicKeyPrefix = "gocryptfs-share-pub:"
+	// PrivateKeyPrefix starts the text form of an X25519 private key
+	PrivateKeyPrefix = "gocryptfs-share-priv:"
+)
+
+// backend encrypts exported files. It does not depend on the filesystem,
+// so that gocryptfs-share only has to know this one.
+var backend = cryptocore.BackendGoGCM
+
+// Token is the share token, stored as JSON next to the exported file
+type Token struct {
+	// Version is TokenVersion
+	Version int
+	// Cipher is the content encryption of the exported file
+	Cipher string
+	// Recipient is RecipientPassword or RecipientX25519
+	Recipient string
+	// ScryptObject derives the key that wraps the file key from the
+	// password, for RecipientPassword
+	ScryptObject *configfile.ScryptKDF `json:",omitempty"`
+	// EphemeralKey is the X25519 public key of the sender, for
+	// RecipientX25519
+	EphemeralKey []byte `json:",omitempty"`
+	// EncryptedKey is the wrapped file key
+	EncryptedKey []byte
+}
+
+// NewKey returns a new random file key
+func NewKey() []byte {
+	return cryptocore.RandBytes(cryptocore.KeyLen)
+}
+
+// contentEnc returns the ContentEnc that encrypts an exported file with
+// "key", or wraps a key with the key-encryption key "key"
+func contentEnc(key []byte) *contentenc.ContentEnc {
+	cc := cryptocore.New(key, backend, contentenc.DefaultIVBits, true)
+	return contentenc.New(cc, contentenc.DefaultBS)
+}
+
+// Encrypt reads the plaintext from "r" and writes it to "w", encrypted with
+// "key" in the gocryptfs file format. Empty files stay empty.
+func Encrypt(w io.Writer, r io.Reader, key []byte) error {
+	ce := contentEnc(key)
+	defer ce.Wipe()
+	var id []byte
+	buf := make([]byte, ce.PlainBS())
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if id == nil {
+				h := contentenc.RandomHeader()
+				id = h.ID
+				if _, err := w.Write(h.Pack()); err != nil {
+					return err
+				}
+			}
+			if _, err := w.Write(ce.EncryptBlock(buf[:n], blockNo, id)); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Decrypt reads a file written by Encrypt from "r" and writes the plaintext
+// to "w". Fails on the first block that does not decrypt.
+func Decrypt(w io.Writer, r io.Reader, key []byte) error {
+	ce := contentEnc(key)
+	defer ce.Wipe()
+	hdr := make([]byte, contentenc.HeaderLen)
+	if n, err := io.ReadFull(r, hdr); err == io.EOF {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("header: %d bytes: %v", n, err)
+	}
+	h, err := contentenc.ParseHeader(hdr)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, ce.CipherBS())
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			plaintext, err := ce.DecryptBlock(buf[:n], blockNo, h.ID)
+			if err != nil {
+				return fmt.Errorf("block %d: %v", blockNo, err)
+			}
+			if _, err := w.Write(plaintext); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// ad binds the wrapped key to the fields of the token. It is passed in
+// place of the 16-byte file ID, like the AD of the master key in the config
+// file.
+func (t *Token) ad() []byte {
+	h := sha256.Sum256([]byte(fmt.Sprintf("gocryptfs share v%d %s %s", t.Version, t.Cipher, t.Recipient)))
+	return h[:16]
+}
+
+func newToken(recipient string) *Token {
+	return &Token{
+		Version:   TokenVersion,
+		Cipher:    backend.Algo,
+		Recipient: recipient,
+	}
+}
+
+// WrapPassword returns a token that gives the holder of "password" access
+// to "key". "logN" is the scrypt cost, see configfile.NewScryptKDF.
+func WrapPassword(key []byte, password []byte, logN int) *Token {
+	t := newToken(RecipientPassword)
+	kdf := configfile.NewScryptKDF(logN)
+	t.ScryptObject = &kdf
+	kek := kdf.DeriveKey(password)
+	t.EncryptedKey = wrap(kek, key, t.ad())
+	return t
+}
+
+// WrapX25519 returns a token that gives the holder of the private key of
+// "publicKey" access to "key"
+func WrapX25519(key []byte, publicKey []byte) (*Token, error) {
+	t := newToken(RecipientX25519)
+	ephemeral := cryptocore.RandBytes(curve25519.ScalarSize)
+	var err error
+	t.EphemeralKey, err = curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(ephemeral, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	t.EncryptedKey = wrap(x25519KEK(shared, t.EphemeralKey, publicKey), key, t.ad())
+	return t, nil
+}
+
+// x25519KEK derives the key-encryption key from the X25519 shared secret
+// and the two public keys
+func x25519KEK(shared []byte, ephemeral []byte, recipient []byte) []byte {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	return cryptocore.DeriveKeySalt(shared, salt, cryptocore.KeyShareX25519)
+}
+
+func wrap(kek []byte, key []byte, ad []byte) []byte {
+	ce := contentEnc(kek)
+	defer ce.Wipe()
+	return ce.EncryptBlock(key, 0, ad)
+}
+
+func unwrap(kek []byte, encryptedKey []byte, ad []byte) ([]byte, error) {
+	ce := contentEnc(kek)
+	defer ce.Wipe()
+	key, err := ce.DecryptBlock(encryptedKey, 0, ad)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != cryptocore.KeyLen {
+		return nil, fmt.Errorf("file key has length %d", len(key))
+	}
+	return append([]byte{}, key...), nil
+}
+
+// UnwrapPassword returns the file key of a RecipientPassword token
+func (t *Token) UnwrapPassword(password []byte) ([]byte, error) {
+	if t.Recipient != RecipientPassword || t.ScryptObject == nil {
+		return nil, fmt.Errorf("the token is for recipient %q, not a password", t.Recipient)
+	}
+	key, err := unwrap(t.ScryptObject.DeriveKey(password), t.EncryptedKey, t.ad())
+	if err != nil {
+		return nil, errors.New("wrong password")
+	}
+	return key, nil
+}
+
+// UnwrapX25519 returns the file key of a RecipientX25519 token
+func (t *Token) UnwrapX25519(privateKey []byte) ([]byte, error) {
+	if t.Recipient != RecipientX25519 {
+		return nil, fmt.Errorf("the token is for recipient %q, not a key", t.Recipient)
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(privateKey, t.EphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := unwrap(x25519KEK(shared, t.EphemeralKey, publicKey), t.EncryptedKey, t.ad())
+	if err != nil {
+		return nil, errors.New("the token is for another key")
+	}
+	return key, nil
+}
+
+// Marshal returns the JSON form of the token
+func (t *Token) Marshal() []byte {
+	js, err := json.MarshalIndent(t, "", "\t")
+	if err != nil {
+		panic(err)
+	}
+	return append(js, '\n')
+}
+
+// ParseToken parses the JSON form of a token
+func ParseToken(js []byte) (*Token, error) {
+	var t Token
+	if err := json.Unmarshal(js, &t); err != nil {
+		return nil, err
+	}
+	if t.Version != TokenVersion {
+		return nil, fmt.Errorf("token version %d is not supported", t.Version)
+	}
+	if t.Cipher != backend.Algo {
+		return nil, fmt.Errorf("cipher %q is not supported", t.Cipher)
+	}
+	return &t, nil
+}
+
+// NewKeyPair returns a new X25519 key pair for RecipientX25519
+func NewKeyPair() (privateKey []byte, publicKey []byte) {
+	privateKey = cryptocore.RandBytes(curve25519.ScalarSize)
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		panic(err)
+	}
+	return privateKey, publicKey
+}
+
+// FormatKey returns the text form of a key with prefix PublicKeyPrefix or
+// PrivateKeyPrefix
+func FormatKey(prefix string, key []byte) string {
+	return prefix + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// ParseKey parses the text form of a key that starts with "prefix"
+func ParseKey(prefix string, s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("key does not start with %q", prefix)
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, prefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != curve25519.PointSize {
+		return nil, fmt.Errorf("key has length %d, want %d", len(key), curve25519.PointSize)
+	}
+	return key, nil
+}
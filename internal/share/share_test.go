@@ -0,0 +1,84 @@
+package share
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	key := NewKey()
+	for _, size := range []int{0, 1, 4096, 4097, 10000} {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+		var c bytes.Buffer
+		if err := Encrypt(&c, bytes.NewReader(plaintext), key); err != nil {
+			t.Fatal(err)
+		}
+		if size == 0 && c.Len() != 0 {
+			t.Errorf("empty file has %d bytes", c.Len())
+		}
+		var p bytes.Buffer
+		if err := Decrypt(&p, bytes.NewReader(c.Bytes()), key); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(p.Bytes(), plaintext) {
+			t.Errorf("size %d: content mismatch", size)
+		}
+		if size > 0 {
+			if err := Decrypt(&p, bytes.NewReader(c.Bytes()), NewKey()); err == nil {
+				t.Errorf("size %d: wrong key was accepted", size)
+			}
+		}
+	}
+}
+
+func TestTokenPassword(t *testing.T) {
+	key := NewKey()
+	tok := WrapPassword(key, []byte("test"), 10)
+	tok, err := ParseToken(tok.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := tok.UnwrapPassword([]byte("test"))
+	if err != nil || !bytes.Equal(have, key) {
+		t.Fatalf("have %x, %v", have, err)
+	}
+	if _, err = tok.UnwrapPassword([]byte("wrong")); err == nil {
+		t.Error("wrong password was accepted")
+	}
+	priv, _ := NewKeyPair()
+	if _, err = tok.UnwrapX25519(priv); err == nil {
+		t.Error("key was accepted for a password token")
+	}
+}
+
+func TestTokenX25519(t *testing.T) {
+	key := NewKey()
+	priv, pub := NewKeyPair()
+	pub2, err := ParseKey(PublicKeyPrefix, FormatKey(PublicKeyPrefix, pub))
+	if err != nil || !bytes.Equal(pub2, pub) {
+		t.Fatalf("ParseKey: %v", err)
+	}
+	if _, err = ParseKey(PrivateKeyPrefix, FormatKey(PublicKeyPrefix, pub)); err == nil {
+		t.Error("public key was accepted as private key")
+	}
+	tok, err := WrapX25519(key, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err = ParseToken(tok.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := tok.UnwrapX25519(priv)
+	if err != nil || !bytes.Equal(have, key) {
+		t.Fatalf("have %x, %v", have, err)
+	}
+	other, _ := NewKeyPair()
+	if _, err = tok.UnwrapX25519(other); err == nil {
+		t.Error("other private key was accepted")
+	}
+	tok.Version = 2
+	if _, err = ParseToken(tok.Marshal()); err == nil {
+		t.Error("unknown token version was accepted")
+	}
+}
@@ -0,0 +1,400 @@
+// Package snapshot implements "gocryptfs -snapshot": read-only copies of
+// the CIPHERDIR that are stored in CIPHERDIR/gocryptfs.snapshots/NAME.
+//
+// A snapshot is a complete CIPHERDIR, including the config file, so it can
+// be mounted like any other CIPHERDIR. File contents are copied with
+// reflinks (FICLONE) where the backing filesystem supports it, which makes
+// snapshots cheap in time and space. Otherwise, the data is copied.
+//
+// Snapshots are built in a temporary directory that is renamed to its final
+// name once everything has been synced to disk. After a crash, a snapshot
+// either exists completely or not at all.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// DirName is the name of the directory in the CIPHERDIR that holds the
+// snapshots.
+const DirName = configfile.SnapshotDirName
+
+// tmpSuffix marks snapshots that are being created or deleted. Their names
+// also start with a dot so they can never clash with a snapshot name.
+const tmpSuffix = ".tmp"
+
+var (
+	// ErrInvalidName is returned for snapshot names that cannot be used
+	// as a directory name.
+	ErrInvalidName = errors.New("invalid snapshot name")
+	// ErrExists is returned by Create if the snapshot already exists.
+	ErrExists = errors.New("snapshot already exists")
+)
+
+// Info describes a snapshot.
+type Info struct {
+	Name string
+	// Created is the time when the snapshot was completed.
+	Created time.Time
+}
+
+// Stats is returned by Create.
+type Stats struct {
+	// Files is the number of regular files in the snapshot.
+	Files int
+	// Reflinked is the number of files whose data was shared using a
+	// reflink instead of being copied.
+	Reflinked int
+	// Copied is the number of bytes that had to be copied.
+	Copied int64
+}
+
+// CheckName returns ErrInvalidName if "name" cannot be used as a snapshot
+// name.
+func CheckName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsRune(name, '/') ||
+		len(name) > 255-len(tmpSuffix)-1 {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// Path returns the directory of snapshot "name" of "cipherdir".
+func Path(cipherdir string, name string) string {
+	return filepath.Join(cipherdir, DirName, name)
+}
+
+// tmpPath returns the temporary name of snapshot "name".
+func tmpPath(cipherdir string, name string) string {
+	return filepath.Join(cipherdir, DirName, "."+name+tmpSuffix)
+}
+
+// Create creates snapshot "name" of "cipherdir". Existing snapshots are not
+// part of the new snapshot.
+//
+// The snapshot is only consistent if "cipherdir" does not change while it
+// is taken, so it should not be mounted.
+func Create(cipherdir string, name string) (stats Stats, err error) {
+	if err = CheckName(name); err != nil {
+		return stats, err
+	}
+	if _, err = os.Lstat(Path(cipherdir, name)); err == nil {
+		return stats, fmt.Errorf("%w: %q", ErrExists, name)
+	}
+	if err = os.Mkdir(filepath.Join(cipherdir, DirName), 0700); err != nil && !os.IsExist(err) {
+		return stats, err
+	}
+	if err = removeLeftovers(cipherdir); err != nil {
+		return stats, err
+	}
+	tmp := tmpPath(cipherdir, name)
+	c := copier{
+		src:   cipherdir,
+		dst:   tmp,
+		links: make(map[[2]uint64]string),
+	}
+	if err = filepath.Walk(cipherdir, c.walkFn); err == nil {
+		err = c.finishDirs()
+	}
+	if err != nil {
+		if err2 := removeAll(tmp); err2 != nil {
+			tlog.Warn.Printf("snapshot: cleaning up %q: %v", tmp, err2)
+		}
+		return c.stats, err
+	}
+	if err = os.Rename(tmp, Path(cipherdir, name)); err != nil {
+		return c.stats, err
+	}
+	return c.stats, syncDir(filepath.Join(cipherdir, DirName))
+}
+
+// List returns the snapshots of "cipherdir", oldest first.
+func List(cipherdir string) ([]Info, error) {
+	entries, err := os.ReadDir(filepath.Join(cipherdir, DirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []Info
+	for _, e := range entries {
+		if !e.IsDir() || CheckName(e.Name()) != nil {
+			continue
+		}
+		var st unix.Stat_t
+		if err := unix.Lstat(Path(cipherdir, e.Name()), &st); err != nil {
+			return nil, err
+		}
+		// The snapshot directory is renamed into place when it is
+		// complete, which sets its ctime. Mounting it read-only does
+		// not change it.
+		list = append(list, Info{
+			Name:    e.Name(),
+			Created: time.Unix(st.Ctim.Unix()),
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// Delete deletes snapshot "name" of "cipherdir". The snapshot is renamed
+// away first, so an interrupted Delete does not leave a partial snapshot.
+func Delete(cipherdir string, name string) error {
+	if err := CheckName(name); err != nil {
+		return err
+	}
+	tmp := tmpPath(cipherdir, name)
+	if err := os.Rename(Path(cipherdir, name), tmp); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Join(cipherdir, DirName)); err != nil {
+		return err
+	}
+	return removeAll(tmp)
+}
+
+// Prune deletes all but the "keep" newest snapshots of "cipherdir" and
+// returns the names of the deleted snapshots.
+func Prune(cipherdir string, keep int) (deleted []string, err error) {
+	if err = removeLeftovers(cipherdir); err != nil {
+		return nil, err
+	}
+	list, err := List(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(list)-keep; i++ {
+		if err = Delete(cipherdir, list[i].Name); err != nil {
+			return deleted, err
+		}
+		deleted = append(deleted, list[i].Name)
+	}
+	return deleted, nil
+}
+
+// Leftovers returns the paths of the temporary directories left behind by
+// an interrupted Create or Delete.
+func Leftovers(cipherdir string) ([]string, error) {
+	dir := filepath.Join(cipherdir, DirName)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		n := e.Name()
+		if strings.HasPrefix(n, ".") && strings.HasSuffix(n, tmpSuffix) {
+			paths = append(paths, filepath.Join(dir, n))
+		}
+	}
+	return paths, nil
+}
+
+// RemoveLeftover removes "path", which has been returned by Leftovers.
+func RemoveLeftover(path string) error {
+	return removeAll(path)
+}
+
+// removeLeftovers removes temporary directories left behind by an
+// interrupted Create or Delete.
+func removeLeftovers(cipherdir string) error {
+	paths, err := Leftovers(cipherdir)
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		tlog.Info.Printf("snapshot: removing leftover %q", filepath.Base(p))
+		if err := removeAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll is like os.RemoveAll, but also removes directories that are
+// not writable, which are common in snapshots.
+func removeAll(path string) error {
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && info.Mode().Perm()&0700 != 0700 {
+			os.Chmod(p, info.Mode().Perm()|0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// syncDir fsyncs directory "dir".
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// dirAttrs is a directory whose attributes are set after its contents have
+// been copied.
+type dirAttrs struct {
+	src string
+	dst string
+	st  unix.Stat_t
+}
+
+// copier copies a CIPHERDIR into a new snapshot.
+type copier struct {
+	src string
+	dst string
+	// links maps the device and inode number of files with more than one
+	// hard link to the first copy.
+	links map[[2]uint64]string
+	// dirs in the order they have been created.
+	dirs  []dirAttrs
+	stats Stats
+}
+
+func (c *copier) walkFn(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(c.src, path)
+	if err != nil {
+		return err
+	}
+	if rel == DirName {
+		// Do not snapshot the snapshots
+		return filepath.SkipDir
+	}
+	dst := filepath.Join(c.dst, rel)
+	var st unix.Stat_t
+	if err = unix.Lstat(path, &st); err != nil {
+		return err
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		// Writable until finishDirs() sets the real mode
+		if err = os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+		c.dirs = append(c.dirs, dirAttrs{src: path, dst: dst, st: st})
+		return nil
+	case syscall.S_IFREG:
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := c.links[key]; ok {
+			return os.Link(first, dst)
+		}
+		if st.Nlink > 1 {
+			c.links[key] = dst
+		}
+		if err = c.copyFile(path, dst); err != nil {
+			return err
+		}
+	case syscall.S_IFLNK:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		if err = os.Symlink(target, dst); err != nil {
+			return err
+		}
+	default:
+		if err = syscall.Mknod(dst, uint32(st.Mode), int(st.Rdev)); err != nil {
+			return err
+		}
+	}
+	return copyAttrs(path, dst, &st)
+}
+
+// copyFile copies the regular file "src" to "dst", using a reflink if
+// possible.
+func (c *copier) copyFile(src string, dst string) error {
+	in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	c.stats.Files++
+	if err = syscallcompat.Reflink(int(out.Fd()), int(in.Fd())); err == nil {
+		c.stats.Reflinked++
+	} else {
+		if c.stats.Files-c.stats.Reflinked == 1 {
+			tlog.Debug.Printf("snapshot: reflink failed, copying data: %v", err)
+		}
+		n, err := io.Copy(out, in)
+		c.stats.Copied += n
+		if err != nil {
+			return err
+		}
+	}
+	return out.Sync()
+}
+
+// finishDirs sets the attributes of the copied directories and syncs them.
+// Runs deepest first, as a parent may be made read-only.
+func (c *copier) finishDirs() error {
+	for i := len(c.dirs) - 1; i >= 0; i-- {
+		d := c.dirs[i]
+		if err := syncDir(d.dst); err != nil {
+			return err
+		}
+		if err := copyAttrs(d.src, d.dst, &d.st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyAttrs copies the extended attributes, owner, mode and timestamps
+// described by "st" from "src" to "dst". The owner is only copied when
+// running as root.
+func copyAttrs(src string, dst string, st *unix.Stat_t) error {
+	attrs, err := syscallcompat.Llistxattr(src)
+	if err != nil && err != syscall.EOPNOTSUPP {
+		return err
+	}
+	for _, a := range attrs {
+		val, err := syscallcompat.Lgetxattr(src, a)
+		if err != nil {
+			return err
+		}
+		if err = unix.Lsetxattr(dst, a, val, 0); err != nil {
+			return fmt.Errorf("xattr %q: %w", a, err)
+		}
+	}
+	if os.Getuid() == 0 {
+		if err = os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			return err
+		}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+		if err = syscall.Chmod(dst, uint32(st.Mode)&07777); err != nil {
+			return err
+		}
+	}
+	atime := time.Unix(st.Atim.Unix())
+	mtime := time.Unix(st.Mtim.Unix())
+	return syscallcompat.UtimesNanoAtNofollow(unix.AT_FDCWD, dst, &atime, &mtime)
+}
@@ -0,0 +1,100 @@
+package snapshot
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	for _, n := range []string{"", ".", "..", ".hidden", "a/b"} {
+		if err := CheckName(n); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: have %v", n, err)
+		}
+	}
+	if err := CheckName("2026-10-15"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/file", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(dir+"/file", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", dir+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir+"/ro", 0500); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(dir, "one"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(dir, "one"); !errors.Is(err, ErrExists) {
+		t.Errorf("second Create: have %v", err)
+	}
+	snap := Path(dir, "one")
+	content, err := os.ReadFile(snap + "/file")
+	if err != nil || string(content) != "content" {
+		t.Errorf("file: %q %v", content, err)
+	}
+	var st1, st2 syscall.Stat_t
+	syscall.Stat(snap+"/file", &st1)
+	syscall.Stat(snap+"/link", &st2)
+	if st1.Ino != st2.Ino {
+		t.Error("hard link was not preserved")
+	}
+	if target, _ := os.Readlink(snap + "/symlink"); target != "file" {
+		t.Errorf("symlink: %q", target)
+	}
+	if fi, err := os.Stat(snap + "/ro"); err != nil || fi.Mode().Perm() != 0500 {
+		t.Errorf("ro: %v %v", fi, err)
+	}
+	// The snapshot is independent of the original
+	if err = os.WriteFile(dir+"/file", []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ = os.ReadFile(snap + "/file"); string(content) != "content" {
+		t.Errorf("snapshot changed: %q", content)
+	}
+	// Snapshots do not contain older snapshots
+	if _, err = Create(dir, "two"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(Path(dir, "two"), DirName)); !os.IsNotExist(err) {
+		t.Errorf("nested snapshot dir: %v", err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	for _, n := range []string{"a", "b", "c"} {
+		if _, err := Create(dir, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Leftover of an interrupted Create
+	if err := os.Mkdir(tmpPath(dir, "d"), 0500); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := Prune(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("deleted %v", deleted)
+	}
+	list, err := List(dir)
+	if err != nil || len(list) != 1 || list[0].Name != "c" {
+		t.Fatalf("List: %v %v", list, err)
+	}
+	if _, err = os.Stat(tmpPath(dir, "d")); !os.IsNotExist(err) {
+		t.Errorf("leftover was not removed: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package speed
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/uring"
+)
+
+// ioFileSize is the size of the temporary file read by the I/O engine test
+const ioFileSize = 16 * 1024 * 1024
+
+// ioReqSize is the size of one read request, like the largest FUSE read
+// request plus gocryptfs block overhead
+const ioReqSize = 132 * 1024
+
+// ioEngineGroup compares the "-io-engine" options by reading a temporary
+// file. The file is usually in the page cache, so this measures the overhead
+// of the engines, not the speed of the disk.
+func ioEngineGroup() group {
+	var f *os.File
+	setup := func() (func(), error) {
+		var err error
+		f, err = os.CreateTemp("", "gocryptfs-speed-")
+		if err != nil {
+			return nil, err
+		}
+		cleanup := func() {
+			f.Close()
+			os.Remove(f.Name())
+		}
+		if _, err = f.Write(make([]byte, ioFileSize)); err != nil {
+			cleanup()
+			return nil, err
+		}
+		return cleanup, nil
+	}
+	return group{
+		id:        "io-engine",
+		nameWidth: 26,
+		setup:     setup,
+		benchmarks: []benchmark{
+			{name: "io-engine pread", f: func(b *testing.B) { bPread(b, f) }},
+			{name: "io-engine uring", f: func(b *testing.B) { bUring(b, int(f.Fd())) }},
+		},
+	}
+}
+
+// bPread benchmarks reading "f" with pread(2)
+func bPread(b *testing.B, f *os.File) {
+	buf := make([]byte, ioReqSize)
+	b.SetBytes(ioReqSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(i*ioReqSize) % (ioFileSize - ioReqSize)
+		if _, err := f.ReadAt(buf, off); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// bUring benchmarks reading "fd" through the io_uring engine, in chunks like
+// fusefrontend does
+func bUring(b *testing.B, fd int) {
+	e, err := uring.New(ioReqSize, 1)
+	if err != nil {
+		b.Skip(err)
+	}
+	defer e.Close()
+	b.SetBytes(ioReqSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		off := int64(i*ioReqSize) % (ioFileSize - ioReqSize)
+		if _, err := e.ReadChunks(fd, off, ioReqSize, ioReqSize/4, func(int, []byte) {}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package speed
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+)
+
+// kdfPassword is the password the KDF benchmarks derive a key from
+var kdfPassword = []byte("gocryptfs speed test")
+
+// kdfScryptLogN are the scrypt logN values that kdfGroup measures. logN=19
+// already needs 512 MiB of memory.
+var kdfScryptLogN = []int{16, 17, 18, 19}
+
+// kdfArgon2id are the Argon2id settings that kdfGroup measures
+var kdfArgon2id = []struct {
+	memoryMiB  uint32
+	iterations uint32
+}{
+	{64, 3},
+	{128, 3},
+	{256, 3},
+	{64, 6},
+}
+
+// kdfGroup measures how long unlocking a filesystem takes with different
+// key derivation settings. Each setting runs once, like an unlock does.
+func kdfGroup() group {
+	g := group{
+		id:            "kdf",
+		title:         "Key Derivation (estimated unlock time):\n=======================================",
+		nameWidth:     35,
+		preferredNote: "(default)",
+	}
+	for _, logN := range kdfScryptLogN {
+		logN := logN
+		g.benchmarks = append(g.benchmarks, benchmark{
+			// scrypt needs 128 * r * N bytes with r=8
+			name: fmt.Sprintf("scrypt logN=%d (%d MiB)", logN, (1<<logN)/1024),
+			once: func() time.Duration {
+				return ScryptUnlockTime(logN)
+			},
+			preferred: logN == configfile.ScryptDefaultLogN,
+		})
+	}
+	for _, s := range kdfArgon2id {
+		s := s
+		g.benchmarks = append(g.benchmarks, benchmark{
+			name: fmt.Sprintf("Argon2id m=%dMiB t=%d p=%d", s.memoryMiB, s.iterations,
+				configfile.Argon2idDefaultParallelism),
+			once: func() time.Duration {
+				kdf := configfile.NewArgon2idKDFWithParams(s.memoryMiB*1024, s.iterations,
+					configfile.Argon2idDefaultParallelism)
+				return timeDeriveKey(kdf.DeriveKey)
+			},
+			preferred: s.memoryMiB*1024 == configfile.Argon2idDefaultMemory &&
+				s.iterations == configfile.Argon2idDefaultIterations,
+		})
+	}
+	return g
+}
+
+// ScryptUnlockTime returns how long deriving the key with scrypt takes
+// at cost parameter "logN".
+func ScryptUnlockTime(logN int) time.Duration {
+	kdf := configfile.NewScryptKDF(logN)
+	return timeDeriveKey(kdf.DeriveKey)
+}
+
+// Argon2idUnlockTime returns how long deriving the key with the default
+// Argon2id parameters takes.
+func Argon2idUnlockTime() time.Duration {
+	kdf := configfile.NewArgon2idKDF()
+	return timeDeriveKey(kdf.DeriveKey)
+}
+
+// timeDeriveKey runs "deriveKey" once and returns how long it took
+func timeDeriveKey(deriveKey func([]byte) []byte) time.Duration {
+	t0 := time.Now()
+	deriveKey(kdfPassword)
+	return time.Since(t0)
+}
@@ -2,12 +2,14 @@
 package speed
 
 import (
+	"crypto/cipher"
 	"crypto/rand"
 	"fmt"
 	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/parallelcrypto"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 )
 
 // RunOptimizedSpeedTests runs comprehensive speed tests including optimized backends
@@ -46,14 +48,13 @@ func runOptimizedBackendTests() {
 	// Test different backend types
 	backends := []struct {
 		name    string
-		backend func([]byte) (interface{}, error)
+		backend func([]byte) cipher.AEAD
 	}{
-		{"Standard GCM", func(k []byte) (interface{}, error) {
-			cc := cryptocore.New(k, cryptocore.BackendGoGCM, 128, true)
-			return cc, nil
+		{"Standard GCM", func(k []byte) cipher.AEAD {
+			return cryptocore.New(k, cryptocore.BackendGoGCM, 128, true).AEADCipher
 		}},
-		{"Optimized Backend", func(k []byte) (interface{}, error) {
-			return cryptocore.NewOptimizedBackend(k)
+		{"Optimized Backend", func(k []byte) cipher.AEAD {
+			return cryptocore.New(k, cryptocore.BackendOptimized, 128, true).AEADCipher
 		}},
 	}
 
@@ -64,11 +65,7 @@ func runOptimizedBackendTests() {
 		fmt.Printf("%-20s: ", backend.name)
 
 		// Create backend instance
-		instance, err := backend.backend(key)
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			continue
-		}
+		instance := backend.backend(key)
 
 		// Run benchmarks for different sizes
 		totalMBps := 0.0
@@ -92,13 +89,12 @@ func runOptimizedBackendTests() {
 }
 
 // benchmarkBackend benchmarks a specific backend with given data size
-func benchmarkBackend(backend interface{}, size int) float64 {
+func benchmarkBackend(backend cipher.AEAD, size int) float64 {
 	// Generate test data
 	plaintext := make([]byte, size)
 	rand.Read(plaintext)
 
-	// Use correct nonce size for CryptoCore (16 bytes for 128-bit IV)
-	nonce := make([]byte, 16)
+	nonce := make([]byte, backend.NonceSize())
 	rand.Read(nonce)
 
 	additionalData := make([]byte, 24)
@@ -109,22 +105,9 @@ func benchmarkBackend(backend interface{}, size int) float64 {
 	iterations := 1000
 
 	for i := 0; i < iterations; i++ {
-		switch b := backend.(type) {
-		case *cryptocore.CryptoCore:
-			// Test with CryptoCore
-			ciphertext := b.AEADCipher.Seal(nil, nonce, plaintext, additionalData)
-			_, err := b.AEADCipher.Open(nil, nonce, ciphertext, additionalData)
-			if err != nil {
-				return 0
-			}
-		case *cryptocore.OptimizedBackend:
-			// Test with OptimizedBackend
-			ciphertext := b.Seal(nil, nonce, plaintext, additionalData)
-			_, err := b.Open(nil, nonce, ciphertext, additionalData)
-			if err != nil {
-				return 0
-			}
-		default:
+		ciphertext := backend.Seal(nil, nonce, plaintext, additionalData)
+		_, err := backend.Open(nil, nonce, ciphertext, additionalData)
+		if err != nil {
 			return 0
 		}
 	}
@@ -316,13 +299,15 @@ func runCPUAwareTests() {
 	fmt.Println("--- CPU-Aware Optimization Performance ---")
 
 	pc := parallelcrypto.New()
-	stats := pc.GetPerformanceStats()
-
-	fmt.Printf("CPU Count: %v\n", stats["cpu_count"])
-	fmt.Printf("Parallel Threshold: %v\n", stats["parallel_threshold"])
-	fmt.Printf("Max Workers: %v\n", stats["max_workers"])
-	fmt.Printf("AVX2 Support: %v\n", stats["avx2"])
-	fmt.Printf("AES Support: %v\n", stats["aes"])
+	r := stats.New()
+	pc.RegisterStats(r)
+	m := r.Map()
+
+	fmt.Printf("CPU Count: %v\n", m["parallelcrypto_cpu_count"])
+	fmt.Printf("Parallel Threshold: %v\n", m["parallelcrypto_parallel_threshold"])
+	fmt.Printf("Max Workers: %v\n", m["parallelcrypto_max_workers"])
+	fmt.Printf("AVX2 Support: %v\n", m["parallelcrypto_has_avx2"] == 1)
+	fmt.Printf("AES Support: %v\n", m["parallelcrypto_has_aes"] == 1)
 
 	// Test optimal worker count calculation
 	fmt.Println("\nOptimal Worker Counts:")
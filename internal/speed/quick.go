@@ -0,0 +1,63 @@
+package speed
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/siv_aead"
+	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
+)
+
+// QuickResult is the encryption speed of the content ciphers in MB/s, as
+// measured by Quick.
+type QuickResult struct {
+	AESGCM            float64
+	AESSIV            float64
+	XChaCha20Poly1305 float64
+}
+
+// Quick measures the encryption speed of the content ciphers for about "d"
+// each. It uses the implementation that "-openssl=auto" would pick. The
+// numbers are less precise than the "-speed" ones, but good enough to
+// compare the ciphers against each other while the user waits.
+func Quick(d time.Duration) QuickResult {
+	var gcm, xchacha cipher.AEAD
+	if stupidgcm.PreferOpenSSLAES256GCM() {
+		gcm = stupidgcm.NewAES256GCM(randBytes(32))
+	} else {
+		gAES, _ := aes.NewCipher(randBytes(32))
+		gcm, _ = cipher.NewGCMWithNonceSize(gAES, 16)
+	}
+	if stupidgcm.PreferOpenSSLXchacha20poly1305() {
+		xchacha = stupidgcm.NewXchacha20poly1305(randBytes(32))
+	} else {
+		xchacha, _ = chacha20poly1305.NewX(randBytes(32))
+	}
+	return QuickResult{
+		AESGCM:            quickEncrypt(gcm, d),
+		AESSIV:            quickEncrypt(siv_aead.New(randBytes(64)), d),
+		XChaCha20Poly1305: quickEncrypt(xchacha, d),
+	}
+}
+
+// quickEncrypt encrypts gocryptfs-sized blocks with "c" for about "d" and
+// returns the throughput in MB/s
+func quickEncrypt(c cipher.AEAD, d time.Duration) float64 {
+	authData := randBytes(adLen)
+	iv := randBytes(c.NonceSize())
+	in := make([]byte, gocryptfsBlockSize)
+	dst := make([]byte, 0, len(in)+c.Overhead())
+	n := 0
+	t0 := time.Now()
+	for time.Since(t0) < d {
+		// Check the time only every 100 blocks, it is not free either
+		for i := 0; i < 100; i++ {
+			c.Seal(dst, iv, in, authData)
+		}
+		n += 100
+	}
+	return float64(n*len(in)) / 1e6 / time.Since(t0).Seconds()
+}
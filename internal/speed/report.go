@@ -0,0 +1,236 @@
+package speed
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Output formats for Options.Format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Options select the benchmarks that Run and RunEnhanced run, and how the
+// results are printed.
+type Options struct {
+	// Format is FormatText, FormatJSON or FormatCSV
+	Format string
+	// Run selects the benchmarks whose name matches. nil runs all of them.
+	Run *regexp.Regexp
+	// Version is the gocryptfs version string. It is part of the json and
+	// csv output, so results from different releases can be told apart.
+	Version string
+}
+
+// Result is the outcome of one benchmark
+type Result struct {
+	// Group is the table the benchmark belongs to, like "cipher"
+	Group string `json:"group"`
+	Name  string `json:"name"`
+	// MBPerSec is the throughput in MB/s, 0 if the benchmark was skipped
+	MBPerSec float64 `json:"mb_per_s"`
+	// Skipped is set if the benchmark is not available on this system
+	Skipped bool `json:"skipped,omitempty"`
+	// UnlockMs is the time one key derivation takes in milliseconds. Only
+	// set for the KDF benchmarks, which report no MBPerSec.
+	UnlockMs float64 `json:"unlock_ms,omitempty"`
+	// Selected is set for the implementation that "auto" mode picks, or
+	// the default KDF parameters
+	Selected bool `json:"selected,omitempty"`
+}
+
+// report is the json output
+type report struct {
+	Version string `json:"version,omitempty"`
+	CPU     string `json:"cpu"`
+	// AESGCMAcceleration is set if the CPU has AES-GCM instructions
+	AESGCMAcceleration bool     `json:"aes_gcm_acceleration"`
+	Results            []Result `json:"results"`
+}
+
+// benchmark is one line in a table
+type benchmark struct {
+	name string
+	f    func(*testing.B)
+	// once, if not nil, is run a single time instead of benchmarking "f".
+	// It returns how long the operation took.
+	once      func() time.Duration
+	preferred bool
+}
+
+// group is a table of benchmarks
+type group struct {
+	// id is Result.Group
+	id string
+	// title is printed above the table in text format
+	title string
+	// nameWidth is the width of the name column in text format
+	nameWidth int
+	// preferredNote is printed after preferred benchmarks in text format.
+	// Default: "(selected in auto mode)".
+	preferredNote string
+	// setup, if not nil, is called before the first benchmark of the
+	// group runs. The returned function is called when the group is done.
+	setup      func() (cleanup func(), err error)
+	benchmarks []benchmark
+}
+
+// reporter runs benchmark groups and prints the results
+type reporter struct {
+	opts   Options
+	out    io.Writer
+	report report
+	csv    *csv.Writer
+	// groups is the number of groups printed so far
+	groups int
+}
+
+// newReporter returns a reporter that prints to "out"
+func newReporter(opts Options, out io.Writer) *reporter {
+	if opts.Format == "" {
+		opts.Format = FormatText
+	}
+	r := &reporter{
+		opts: opts,
+		out:  out,
+		report: report{
+			Version:            opts.Version,
+			CPU:                cpuModelName(),
+			AESGCMAcceleration: stupidgcm.HasAESGCMHardwareSupport(),
+			Results:            []Result{},
+		},
+	}
+	if r.report.CPU == "" {
+		r.report.CPU = "unknown"
+	}
+	switch opts.Format {
+	case FormatText:
+		aes := "; no AES-GCM acceleration"
+		if r.report.AESGCMAcceleration {
+			aes = "; with AES-GCM acceleration"
+		}
+		fmt.Fprintf(r.out, "cpu: %s%s\n", r.report.CPU, aes)
+	case FormatCSV:
+		r.csv = csv.NewWriter(r.out)
+		r.csv.Write([]string{"version", "cpu", "group", "name", "mb_per_s", "selected", "unlock_ms"})
+	}
+	return r
+}
+
+// selected returns the benchmarks of "g" that match opts.Run
+func (r *reporter) selected(g group) (out []benchmark) {
+	for _, b := range g.benchmarks {
+		if r.opts.Run == nil || r.opts.Run.MatchString(b.name) {
+			out = append(out, b)
+		}
+	}
+	return out
+}
+
+// runGroup runs the selected benchmarks of "g". In text format, each result
+// is printed as soon as it is available.
+func (r *reporter) runGroup(g group) {
+	benchmarks := r.selected(g)
+	if len(benchmarks) == 0 {
+		return
+	}
+	text := r.opts.Format == FormatText
+	if text {
+		// The cpu line belongs to the first table
+		if r.groups > 0 {
+			fmt.Fprintln(r.out)
+		}
+		if g.title != "" {
+			fmt.Fprintln(r.out, g.title)
+		}
+	}
+	r.groups++
+	if g.setup != nil {
+		cleanup, err := g.setup()
+		if err != nil {
+			if text {
+				fmt.Fprintf(r.out, "%s: %v\n", g.id, err)
+			} else {
+				tlog.Warn.Printf("%s: %v", g.id, err)
+			}
+			return
+		}
+		defer cleanup()
+	}
+	testing.Init()
+	for _, b := range benchmarks {
+		if text {
+			fmt.Fprintf(r.out, "%-*s\t", g.nameWidth, b.name)
+		}
+		res := Result{
+			Group:    g.id,
+			Name:     b.name,
+			Selected: b.preferred,
+		}
+		if b.once != nil {
+			res.UnlockMs = float64(b.once()) / float64(time.Millisecond)
+		} else {
+			res.MBPerSec = mbPerSec(testing.Benchmark(b.f))
+			res.Skipped = res.MBPerSec <= 0
+		}
+		r.add(res, g.preferredNote)
+	}
+}
+
+// add records "res" and prints it unless the format is json
+func (r *reporter) add(res Result, preferredNote string) {
+	r.report.Results = append(r.report.Results, res)
+	switch r.opts.Format {
+	case FormatText:
+		switch {
+		case res.UnlockMs > 0:
+			fmt.Fprintf(r.out, "%7.0f ms", res.UnlockMs)
+		case res.Skipped:
+			fmt.Fprintf(r.out, "    N/A")
+		default:
+			fmt.Fprintf(r.out, "%7.2f MB/s", res.MBPerSec)
+		}
+		if res.Selected {
+			if preferredNote == "" {
+				preferredNote = "(selected in auto mode)"
+			}
+			fmt.Fprintf(r.out, "\t%s", preferredNote)
+		}
+		fmt.Fprintln(r.out)
+	case FormatCSV:
+		mbs, ms := "", ""
+		if res.MBPerSec > 0 {
+			mbs = strconv.FormatFloat(res.MBPerSec, 'f', 2, 64)
+		}
+		if res.UnlockMs > 0 {
+			ms = strconv.FormatFloat(res.UnlockMs, 'f', 0, 64)
+		}
+		r.csv.Write([]string{r.report.Version, r.report.CPU, res.Group, res.Name,
+			mbs, strconv.FormatBool(res.Selected), ms})
+		r.csv.Flush()
+	}
+}
+
+// finish prints the json output
+func (r *reporter) finish() {
+	switch r.opts.Format {
+	case FormatJSON:
+		enc := json.NewEncoder(r.out)
+		enc.SetIndent("", "\t")
+		enc.Encode(r.report)
+	case FormatCSV:
+		// Flush the header if no benchmark was selected
+		r.csv.Flush()
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"log"
+	"os"
 	"testing"
 
 	"golang.org/x/crypto/chacha20poly1305"
@@ -26,67 +27,53 @@ const adLen = 24
 const gocryptfsBlockSize = 4096
 
 // Run - run the speed the test and print the results.
-func Run() {
-	runBasicSpeedTest()
+func Run(opts Options) {
+	r := newReporter(opts, os.Stdout)
+	r.runGroup(cipherGroup())
+	r.runGroup(ioEngineGroup())
+	r.finish()
 }
 
-// RunEnhanced - run enhanced speed tests including decryption and block size scaling
-func RunEnhanced() {
-	runBasicSpeedTest()
-	fmt.Println()
-	runDecryptionSpeedTest()
-	fmt.Println()
-	runBlockSizeSpeedTest()
-	fmt.Println()
-	RunOptimizedSpeedTests()
+// RunEnhanced - run enhanced speed tests including decryption, block size scaling
+// and key derivation.
+// The tests of RunOptimizedSpeedTests only run in text format and when
+// all benchmarks are selected.
+func RunEnhanced(opts Options) {
+	r := newReporter(opts, os.Stdout)
+	r.runGroup(cipherGroup())
+	r.runGroup(ioEngineGroup())
+	r.runGroup(decryptGroup())
+	r.runGroup(blockSizeGroup())
+	r.runGroup(kdfGroup())
+	r.finish()
+	if r.opts.Format == FormatText && r.opts.Run == nil {
+		fmt.Println()
+		RunOptimizedSpeedTests()
+	}
 }
 
-// runBasicSpeedTest - run the basic encryption speed test
-func runBasicSpeedTest() {
-	cpu := cpuModelName()
-	if cpu == "" {
-		cpu = "unknown"
-	}
-	aes := "; no AES-GCM acceleration"
-	if stupidgcm.HasAESGCMHardwareSupport() {
-		aes = "; with AES-GCM acceleration"
-	}
-	fmt.Printf("cpu: %s%s\n", cpu, aes)
-
-	bTable := []struct {
-		name      string
-		f         func(*testing.B)
-		preferred bool
-	}{
-		// AES-GCM variants
-		{name: cryptocore.BackendOpenSSL.String(), f: bStupidGCM, preferred: stupidgcm.PreferOpenSSLAES256GCM()},
-		{name: cryptocore.BackendGoGCM.String(), f: bGoGCM, preferred: !stupidgcm.PreferOpenSSLAES256GCM()},
-
-		// AES-SIV
-		{name: cryptocore.BackendAESSIV.String(), f: bAESSIV, preferred: false},
-
-		// XChaCha20-Poly1305 variants
-		{name: cryptocore.BackendXChaCha20Poly1305OpenSSL.String(), f: bStupidXchacha, preferred: stupidgcm.PreferOpenSSLXchacha20poly1305()},
-		{name: cryptocore.BackendXChaCha20Poly1305.String(), f: bXchacha20poly1305, preferred: !stupidgcm.PreferOpenSSLXchacha20poly1305()},
-
-		// ChaCha20-Poly1305 variants (additional methods not in main backends)
-		{name: "ChaCha20-Poly1305-OpenSSL", f: bStupidChacha, preferred: false},
-		{name: "ChaCha20-Poly1305-Go", f: bChacha20poly1305, preferred: false},
-	}
-	testing.Init()
-	for _, b := range bTable {
-		fmt.Printf("%-26s\t", b.name)
-		mbs := mbPerSec(testing.Benchmark(b.f))
-		if mbs > 0 {
-			fmt.Printf("%7.2f MB/s", mbs)
-		} else {
-			fmt.Printf("    N/A")
-		}
-		if b.preferred {
-			fmt.Printf("\t(selected in auto mode)\n")
-		} else {
-			fmt.Printf("\n")
-		}
+// cipherGroup benchmarks the encryption speed of the content ciphers
+func cipherGroup() group {
+	return group{
+		id:        "cipher",
+		nameWidth: 26,
+		benchmarks: []benchmark{
+			// AES-GCM variants
+			{name: cryptocore.BackendOpenSSL.String(), f: bStupidGCM, preferred: stupidgcm.PreferOpenSSLAES256GCM()},
+			{name: cryptocore.BackendGoGCM.String(), f: bGoGCM, preferred: !stupidgcm.PreferOpenSSLAES256GCM()},
+			{name: cryptocore.BackendOptimized.String(), f: bOptimized, preferred: false},
+
+			// AES-SIV
+			{name: cryptocore.BackendAESSIV.String(), f: bAESSIV, preferred: false},
+
+			// XChaCha20-Poly1305 variants
+			{name: cryptocore.BackendXChaCha20Poly1305OpenSSL.String(), f: bStupidXchacha, preferred: stupidgcm.PreferOpenSSLXchacha20poly1305()},
+			{name: cryptocore.BackendXChaCha20Poly1305.String(), f: bXchacha20poly1305, preferred: !stupidgcm.PreferOpenSSLXchacha20poly1305()},
+
+			// ChaCha20-Poly1305 variants (additional methods not in main backends)
+			{name: "ChaCha20-Poly1305-OpenSSL", f: bStupidChacha, preferred: false},
+			{name: "ChaCha20-Poly1305-Go", f: bChacha20poly1305, preferred: false},
+		},
 	}
 }
 
@@ -174,6 +161,15 @@ func bGoGCMBlockSize(b *testing.B, blockSize int) {
 	bEncryptBlockSize(b, gGCM, blockSize)
 }
 
+// bOptimized benchmarks cryptocore.OptimizedBackend ("-cipher optimized")
+func bOptimized(b *testing.B) {
+	c, err := cryptocore.NewOptimizedBackend(randBytes(32), 16)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bEncrypt(b, c)
+}
+
 // bAESSIV benchmarks AES-SIV from github.com/aperturerobotics/jacobsa-crypto/siv
 func bAESSIV(b *testing.B) {
 	c := siv_aead.New(randBytes(64))
@@ -208,66 +204,46 @@ func bChacha20poly1305(b *testing.B) {
 	bEncrypt(b, c)
 }
 
-// runDecryptionSpeedTest - run decryption speed tests
-func runDecryptionSpeedTest() {
-	fmt.Println("Decryption Performance:")
-	fmt.Println("======================")
-
-	dTable := []struct {
-		name      string
-		f         func(*testing.B)
-		preferred bool
-	}{
-		// AES-GCM variants
-		{name: cryptocore.BackendOpenSSL.String() + " (decrypt)", f: bStupidGCMDecrypt, preferred: stupidgcm.PreferOpenSSLAES256GCM()},
-		{name: cryptocore.BackendGoGCM.String() + " (decrypt)", f: bGoGCMDecrypt, preferred: !stupidgcm.PreferOpenSSLAES256GCM()},
-
-		// AES-SIV
-		{name: cryptocore.BackendAESSIV.String() + " (decrypt)", f: bAESSIVDecrypt, preferred: false},
-
-		// XChaCha20-Poly1305 variants
-		{name: cryptocore.BackendXChaCha20Poly1305OpenSSL.String() + " (decrypt)", f: bStupidXchachaDecrypt, preferred: stupidgcm.PreferOpenSSLXchacha20poly1305()},
-		{name: cryptocore.BackendXChaCha20Poly1305.String() + " (decrypt)", f: bXchacha20poly1305Decrypt, preferred: !stupidgcm.PreferOpenSSLXchacha20poly1305()},
-
-		// ChaCha20-Poly1305 variants
-		{name: "ChaCha20-Poly1305-OpenSSL (decrypt)", f: bStupidChachaDecrypt, preferred: false},
-		{name: "ChaCha20-Poly1305-Go (decrypt)", f: bChacha20poly1305Decrypt, preferred: false},
-	}
-
-	testing.Init()
-	for _, b := range dTable {
-		fmt.Printf("%-35s\t", b.name)
-		mbs := mbPerSec(testing.Benchmark(b.f))
-		if mbs > 0 {
-			fmt.Printf("%7.2f MB/s", mbs)
-		} else {
-			fmt.Printf("    N/A")
-		}
-		if b.preferred {
-			fmt.Printf("\t(selected in auto mode)\n")
-		} else {
-			fmt.Printf("\n")
-		}
+// decryptGroup benchmarks the decryption speed of the content ciphers
+func decryptGroup() group {
+	return group{
+		id:        "decrypt",
+		title:     "Decryption Performance:\n======================",
+		nameWidth: 35,
+		benchmarks: []benchmark{
+			// AES-GCM variants
+			{name: cryptocore.BackendOpenSSL.String() + " (decrypt)", f: bStupidGCMDecrypt, preferred: stupidgcm.PreferOpenSSLAES256GCM()},
+			{name: cryptocore.BackendGoGCM.String() + " (decrypt)", f: bGoGCMDecrypt, preferred: !stupidgcm.PreferOpenSSLAES256GCM()},
+
+			// AES-SIV
+			{name: cryptocore.BackendAESSIV.String() + " (decrypt)", f: bAESSIVDecrypt, preferred: false},
+
+			// XChaCha20-Poly1305 variants
+			{name: cryptocore.BackendXChaCha20Poly1305OpenSSL.String() + " (decrypt)", f: bStupidXchachaDecrypt, preferred: stupidgcm.PreferOpenSSLXchacha20poly1305()},
+			{name: cryptocore.BackendXChaCha20Poly1305.String() + " (decrypt)", f: bXchacha20poly1305Decrypt, preferred: !stupidgcm.PreferOpenSSLXchacha20poly1305()},
+
+			// ChaCha20-Poly1305 variants
+			{name: "ChaCha20-Poly1305-OpenSSL (decrypt)", f: bStupidChachaDecrypt, preferred: false},
+			{name: "ChaCha20-Poly1305-Go (decrypt)", f: bChacha20poly1305Decrypt, preferred: false},
+		},
 	}
 }
 
-// runBlockSizeSpeedTest - run block size scaling tests
-func runBlockSizeSpeedTest() {
-	fmt.Println("Block Size Scaling (AES-GCM-256-Go):")
-	fmt.Println("=====================================")
-
-	blockSizes := []int{1024, 4096, 16384, 65536, 262144, 1048576}
-
-	testing.Init()
-	for _, size := range blockSizes {
-		fmt.Printf("%-8d bytes\t", size)
-		mbs := mbPerSec(testing.Benchmark(func(b *testing.B) { bGoGCMBlockSize(b, size) }))
-		if mbs > 0 {
-			fmt.Printf("%7.2f MB/s\n", mbs)
-		} else {
-			fmt.Printf("    N/A\n")
-		}
+// blockSizeGroup benchmarks AES-GCM-256-Go at different block sizes
+func blockSizeGroup() group {
+	g := group{
+		id:        "block-size",
+		title:     "Block Size Scaling (AES-GCM-256-Go):\n=====================================",
+		nameWidth: 13,
+	}
+	for _, size := range []int{1024, 4096, 16384, 65536, 262144, 1048576} {
+		size := size
+		g.benchmarks = append(g.benchmarks, benchmark{
+			name: fmt.Sprintf("%d bytes", size),
+			f:    func(b *testing.B) { bGoGCMBlockSize(b, size) },
+		})
 	}
+	return g
 }
 
 // Decryption benchmark functions
@@ -1,10 +1,16 @@
 package speed
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
 
@@ -90,3 +96,100 @@ func BenchmarkStupidChacha(b *testing.B) {
 func BenchmarkStupidChachaDecrypt(b *testing.B) {
 	bDecrypt(b, stupidgcm.NewChacha20poly1305(randBytes(32)))
 }
+
+// fakeGroup returns a group with a benchmark that always runs and one that
+// is always skipped
+func fakeGroup() group {
+	return group{
+		id:        "fake",
+		nameWidth: 10,
+		benchmarks: []benchmark{
+			{name: "fast", f: func(b *testing.B) {
+				b.SetBytes(1000)
+				for i := 0; i < b.N; i++ {
+					time.Sleep(time.Microsecond)
+				}
+			}, preferred: true},
+			{name: "missing", f: func(b *testing.B) { b.Skip("not available") }},
+		},
+	}
+}
+
+func TestReportJSON(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(Options{Format: FormatJSON, Version: "v0.0.0"}, &buf)
+	r.runGroup(fakeGroup())
+	r.finish()
+	var rep report
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if rep.Version != "v0.0.0" || len(rep.Results) != 2 {
+		t.Fatalf("wrong report: %+v", rep)
+	}
+	fast, missing := rep.Results[0], rep.Results[1]
+	if fast.Name != "fast" || fast.Group != "fake" || fast.MBPerSec <= 0 || fast.Skipped || !fast.Selected {
+		t.Errorf("wrong result: %+v", fast)
+	}
+	if !missing.Skipped || missing.MBPerSec != 0 {
+		t.Errorf("wrong result: %+v", missing)
+	}
+}
+
+func TestReportCSVRun(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(Options{Format: FormatCSV, Run: regexp.MustCompile("(?i)MISS")}, &buf)
+	r.runGroup(fakeGroup())
+	r.finish()
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("want header and one row, got %q", rows)
+	}
+	if row := rows[1]; row[2] != "fake" || row[3] != "missing" || row[4] != "" || row[5] != "false" {
+		t.Errorf("wrong row: %q", row)
+	}
+}
+
+func TestReportOnce(t *testing.T) {
+	var buf bytes.Buffer
+	r := newReporter(Options{Format: FormatText}, &buf)
+	r.runGroup(group{
+		id:            "kdf",
+		nameWidth:     10,
+		preferredNote: "(default)",
+		benchmarks: []benchmark{{
+			name:      "slow",
+			once:      func() time.Duration { return 1500 * time.Millisecond },
+			preferred: true,
+		}},
+	})
+	if !bytes.Contains(buf.Bytes(), []byte("slow      \t   1500 ms\t(default)\n")) {
+		t.Errorf("wrong output: %q", buf.String())
+	}
+	if res := r.report.Results[0]; res.UnlockMs != 1500 || res.MBPerSec != 0 || res.Skipped {
+		t.Errorf("wrong result: %+v", res)
+	}
+}
+
+// Every KDF has exactly one default setting
+func TestKDFGroupDefaults(t *testing.T) {
+	defaults := map[string]int{}
+	for _, b := range kdfGroup().benchmarks {
+		if b.preferred {
+			defaults[b.name[:strings.IndexByte(b.name, ' ')]]++
+		}
+	}
+	if defaults["scrypt"] != 1 || defaults["Argon2id"] != 1 {
+		t.Errorf("wrong defaults: %v", defaults)
+	}
+}
+
+func TestQuick(t *testing.T) {
+	r := Quick(10 * time.Millisecond)
+	if r.AESGCM <= 0 || r.AESSIV <= 0 || r.XChaCha20Poly1305 <= 0 {
+		t.Errorf("wrong result: %+v", r)
+	}
+}
@@ -0,0 +1,152 @@
+// Package stats is a registry of runtime counters and gauges. Subsystems
+// register their values, and the control socket ("Metrics" request), the
+// Prometheus exporter ("-metrics-addr") and "-debug" read them.
+package stats
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Kind tells counters, which only go up, from gauges.
+type Kind int
+
+const (
+	// KindCounter is a value that only increases, like a number of requests
+	KindCounter = Kind(iota)
+	// KindGauge is a value that can go up and down, like a buffer size
+	KindGauge
+)
+
+// String returns the Prometheus name of the kind
+func (k Kind) String() string {
+	if k == KindCounter {
+		return "counter"
+	}
+	return "gauge"
+}
+
+// Sample is the value of a registered variable at the time of Snapshot.
+type Sample struct {
+	Name  string
+	Kind  Kind
+	Help  string
+	Value int64
+}
+
+type entry struct {
+	kind Kind
+	help string
+	read func() int64
+}
+
+// Registry holds named variables. Names are lower case with underscores,
+// prefixed by the subsystem, like "parallelcrypto_parallel_ops_total".
+type Registry struct {
+	mu      sync.RWMutex
+	entries map[string]entry
+}
+
+// Default is the registry of the running mount
+var Default = New()
+
+// New returns an empty registry.
+func New() *Registry {
+	return &Registry{entries: make(map[string]entry)}
+}
+
+// Func registers a variable whose value is returned by "read". "read" is
+// called on every Snapshot and must be safe for concurrent use. Registering
+// a name again replaces the earlier variable.
+func (r *Registry) Func(name string, kind Kind, help string, read func() int64) {
+	r.mu.Lock()
+	r.entries[name] = entry{kind: kind, help: help, read: read}
+	r.mu.Unlock()
+}
+
+// Counter is a counter variable that the owner increments.
+type Counter struct {
+	v int64
+}
+
+// Add adds "n" to the counter.
+func (c *Counter) Add(n int64) {
+	atomic.AddInt64(&c.v, n)
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Value returns the current count.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+// Counter registers "c" under "name".
+func (r *Registry) Counter(name string, help string, c *Counter) {
+	r.Func(name, KindCounter, help, c.Value)
+}
+
+// Bool converts a flag to a gauge value.
+func Bool(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// Snapshot returns the current values of all variables, sorted by name.
+func (r *Registry) Snapshot() []Sample {
+	r.mu.RLock()
+	out := make([]Sample, 0, len(r.entries))
+	for name, e := range r.entries {
+		out = append(out, Sample{Name: name, Kind: e.kind, Help: e.help, Value: e.read()})
+	}
+	r.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// Map returns the current values of all variables keyed by name.
+func (r *Registry) Map() map[string]int64 {
+	m := make(map[string]int64)
+	for _, s := range r.Snapshot() {
+		m[s.Name] = s.Value
+	}
+	return m
+}
+
+// String returns one "name=value" line per variable, for debug dumps.
+func (r *Registry) String() string {
+	var b strings.Builder
+	for _, s := range r.Snapshot() {
+		fmt.Fprintf(&b, "%s=%d\n", s.Name, s.Value)
+	}
+	return b.String()
+}
+
+// WritePrometheus writes all variables in the Prometheus text format, with
+// the names prefixed by "gocryptfs_".
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	for _, s := range r.Snapshot() {
+		name := "gocryptfs_" + s.Name
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, s.Help, name, s.Kind, name, s.Value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP implements http.Handler by serving WritePrometheus.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.WritePrometheus(w)
+}
@@ -0,0 +1,34 @@
+package stats
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := New()
+	var c Counter
+	r.Counter("test_ops_total", "Operations", &c)
+	c.Add(2)
+	c.Inc()
+	size := int64(7)
+	r.Func("test_size", KindGauge, "Size", func() int64 { return size })
+	m := r.Map()
+	if m["test_ops_total"] != 3 || m["test_size"] != 7 {
+		t.Errorf("wrong values: %v", m)
+	}
+	// Gauges are read on every snapshot
+	size = 8
+	if r.Map()["test_size"] != 8 {
+		t.Error("gauge not updated")
+	}
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "# HELP gocryptfs_test_ops_total Operations\n# TYPE gocryptfs_test_ops_total counter\ngocryptfs_test_ops_total 3\n" +
+		"# HELP gocryptfs_test_size Size\n# TYPE gocryptfs_test_size gauge\ngocryptfs_test_size 8\n"
+	if buf.String() != want {
+		t.Errorf("wrong Prometheus output:\n%s", buf.String())
+	}
+}
@@ -8,11 +8,18 @@ import (
 )
 
 /*
+#include <openssl/crypto.h>
 #include "openssl_aead.h"
 #cgo pkg-config: libcrypto
 */
 import "C"
 
+// OpenSSLVersion returns the version of the OpenSSL library that gocryptfs
+// is running with, like "OpenSSL 3.0.2 15 Mar 2022"
+func OpenSSLVersion() string {
+	return C.GoString(C.OpenSSL_version(C.OPENSSL_VERSION))
+}
+
 func openSSLSeal(a *stupidAEADCommon, dst, iv, in, authData []byte) []byte {
 	if a.Wiped() {
 		log.Panic("BUG: tried to use wiped key")
@@ -16,6 +16,11 @@ const (
 	BuiltWithoutOpenssl = true
 )
 
+// OpenSSLVersion returns "" because OpenSSL is not used
+func OpenSSLVersion() string {
+	return ""
+}
+
 func errExit() {
 	fmt.Fprintln(os.Stderr, "I have been compiled without openssl support but you are still trying to use openssl")
 	os.Exit(exitcodes.OpenSSL)
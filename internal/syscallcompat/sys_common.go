@@ -2,6 +2,7 @@ package syscallcompat
 
 import (
 	"bytes"
+	"io"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -231,3 +232,30 @@ func parseListxattrBlob(buf []byte) (attrs []string) {
 	}
 	return attrs
 }
+
+// PwritevAll writes the buffers in "iovs" back-to-back at offset "off" of
+// "fd", without concatenating them first. Retries on short writes and EINTR.
+func PwritevAll(fd int, iovs [][]byte, off int64) error {
+	for len(iovs) > 0 {
+		n, err := pwritev(fd, iovs, off)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		off += int64(n)
+		// Skip what has been written
+		for len(iovs) > 0 && n >= len(iovs[0]) {
+			n -= len(iovs[0])
+			iovs = iovs[1:]
+		}
+		if n > 0 {
+			iovs = append([][]byte{iovs[0][n:]}, iovs[1:]...)
+		}
+	}
+	return nil
+}
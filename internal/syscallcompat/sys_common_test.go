@@ -325,3 +325,20 @@ func BenchmarkLgetxattr(b *testing.B) {
 		Lgetxattr("/", "user.this.attr.does.not.exist")
 	}
 }
+
+func TestPwritevAll(t *testing.T) {
+	f, err := os.Create(tmpDir + "/TestPwritevAll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	iovs := [][]byte{[]byte("foo"), []byte("ba"), []byte("r")}
+	if err = PwritevAll(int(f.Fd()), iovs, 2); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 10)
+	n, _ := f.ReadAt(buf, 0)
+	if string(buf[:n]) != "\x00\x00foobar" {
+		t.Errorf("wrong content %q", buf[:n])
+	}
+}
@@ -59,6 +59,18 @@ func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// Reflink is not implemented on Darwin. clonefile(2) works on paths, not on
+// file descriptors.
+func Reflink(dst int, src int) error {
+	return syscall.EOPNOTSUPP
+}
+
+// pwritev is not wrapped by x/sys/unix on Darwin, so we write the first
+// buffer only. PwritevAll loops over the rest.
+func pwritev(fd int, iovs [][]byte, off int64) (int, error) {
+	return unix.Pwrite(fd, iovs[0], off)
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
@@ -163,3 +175,24 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 	// Let RenameatxNp handle everything else
 	return unix.RenameatxNp(olddirfd, oldpath, newdirfd, newpath, uint32(flags))
 }
+
+// NameMax returns the maximum length of a file name, in bytes, on the
+// filesystem that contains "path". Statfs does not report it on MacOS, but
+// APFS and HFS+ both allow 255 bytes.
+func NameMax(path string) (int, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return 255, nil
+}
+
+// FileHandle is not implemented on MacOS, which has no name_to_handle_at.
+func FileHandle(dirfd int, name string) ([]byte, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// DirectIOAlign returns 4096. MacOS has no O_DIRECT, see O_DIRECT.
+func DirectIOAlign(fd int) int {
+	return 4096
+}
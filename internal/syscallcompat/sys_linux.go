@@ -2,6 +2,7 @@
 package syscallcompat
 
 import (
+	"encoding/binary"
 	"fmt"
 	"sync"
 	"syscall"
@@ -58,11 +59,40 @@ func EnospcPrealloc(fd int, off int64, len int64) (err error) {
 	}
 }
 
+// pwritev wraps the pwritev syscall.
+func pwritev(fd int, iovs [][]byte, off int64) (int, error) {
+	return unix.Pwritev(fd, iovs, off)
+}
+
 // Fallocate wraps the Fallocate syscall.
 func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return syscall.Fallocate(fd, mode, off, len)
 }
 
+// Reflink makes "dst" share the data of "src" using the FICLONE ioctl.
+// Fails with EOPNOTSUPP, EXDEV or EINVAL if the filesystem cannot do it.
+func Reflink(dst int, src int) (err error) {
+	return unix.IoctlFileClone(dst, src)
+}
+
+// File attribute flags from linux/fs.h, as shown by lsattr(1)
+const (
+	FS_APPEND_FL    = 0x00000020
+	FS_IMMUTABLE_FL = 0x00000010
+	FS_NODUMP_FL    = 0x00000040
+)
+
+// GetFlags returns the file attribute flags of "fd" (FS_IOC_GETFLAGS).
+// The kernel reads and writes an int, not the long in the ioctl number.
+func GetFlags(fd int) (uint32, error) {
+	return unix.IoctlGetUint32(fd, unix.FS_IOC_GETFLAGS)
+}
+
+// SetFlags sets the file attribute flags of "fd" (FS_IOC_SETFLAGS).
+func SetFlags(fd int, flags uint32) error {
+	return unix.IoctlSetPointerInt(fd, unix.FS_IOC_SETFLAGS, int(int32(flags)))
+}
+
 // Mknodat wraps the Mknodat syscall.
 func Mknodat(dirfd int, path string, mode uint32, dev int) (err error) {
 	return syscall.Mknodat(dirfd, path, mode, dev)
@@ -176,3 +206,59 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 	})
 	return err
 }
+
+// NameMax returns the maximum length of a file name, in bytes, on the
+// filesystem that contains "path".
+func NameMax(path string) (int, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int(st.Namelen), nil
+}
+
+// FileHandle returns bytes that identify the file "name" in "dirfd" across
+// mounts and reboots: the f_fsid of its filesystem, followed by the type
+// and the contents of its name_to_handle_at(2) file handle. Symlinks are
+// not followed. An empty "name" refers to "dirfd" itself, which may be any
+// file.
+func FileHandle(dirfd int, name string) ([]byte, error) {
+	fd := dirfd
+	if name != "" {
+		var err error
+		fd, err = Openat(dirfd, name, O_PATH|unix.O_NOFOLLOW, 0)
+		if err != nil {
+			return nil, err
+		}
+		defer syscall.Close(fd)
+	}
+	var st unix.Statfs_t
+	if err := unix.Fstatfs(fd, &st); err != nil {
+		return nil, err
+	}
+	h, _, err := unix.NameToHandleAt(fd, "", unix.AT_EMPTY_PATH)
+	if err != nil {
+		return nil, err
+	}
+	b := h.Bytes()
+	out := make([]byte, 12, 12+len(b))
+	binary.LittleEndian.PutUint32(out[0:], uint32(st.Fsid.Val[0]))
+	binary.LittleEndian.PutUint32(out[4:], uint32(st.Fsid.Val[1]))
+	binary.LittleEndian.PutUint32(out[8:], uint32(h.Type()))
+	return append(out, b...), nil
+}
+
+// DirectIOAlign returns the alignment that O_DIRECT reads on "fd" need, in
+// bytes, for both the file offset and the buffer address. Kernels before
+// 6.1 do not report it, then we assume 4096, which is enough everywhere.
+func DirectIOAlign(fd int) int {
+	var stx unix.Statx_t
+	err := unix.Statx(fd, "", unix.AT_EMPTY_PATH, unix.STATX_DIOALIGN, &stx)
+	if err != nil || stx.Mask&unix.STATX_DIOALIGN == 0 || stx.Dio_offset_align == 0 {
+		return 4096
+	}
+	if stx.Dio_mem_align > stx.Dio_offset_align {
+		return int(stx.Dio_mem_align)
+	}
+	return int(stx.Dio_offset_align)
+}
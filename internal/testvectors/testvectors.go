@@ -0,0 +1,435 @@
+// Package testvectors generates and checks known-answer test vectors for the
+// on-disk format: file headers, content blocks, file names, long names and
+// extended attributes, for each supported combination of content cipher and
+// feature flags.
+//
+// The vectors are generated with a fixed master key and fixed nonces and
+// written to a JSON file. Verify checks a build against such a file, so a
+// change that silently alters the format is noticed before it is released.
+package testvectors
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
+)
+
+// FormatVersion is the version of the JSON file. Verify rejects other
+// versions.
+const FormatVersion = 1
+
+// Vector kinds
+const (
+	// KindHeader is a file header. Plain is the file ID.
+	KindHeader = "header"
+	// KindBlock is a content block.
+	KindBlock = "block"
+	// KindName is a file name that is short enough to be stored directly.
+	KindName = "name"
+	// KindLongName is a file name that is stored in a
+	// "gocryptfs.longname.*.name" file. Cipher is the content of that file.
+	KindLongName = "longname"
+	// KindXattrName is the name of an extended attribute.
+	KindXattrName = "xattr_name"
+	// KindXattrValue is the value of an extended attribute.
+	KindXattrValue = "xattr_value"
+)
+
+// File is the content of a test vector file
+type File struct {
+	FormatVersion int `json:"format_version"`
+	// Creator is the program and version that generated the file
+	Creator string `json:"creator"`
+	// MasterKey is the hex-encoded master key of all suites
+	MasterKey string  `json:"master_key"`
+	Suites    []Suite `json:"suites"`
+}
+
+// Suite holds the vectors of one combination of feature flags
+type Suite struct {
+	FeatureFlags []string `json:"feature_flags"`
+	Vectors      []Vector `json:"vectors"`
+}
+
+// Vector is one known answer. Binary values are hex-encoded, names are
+// stored as they are.
+type Vector struct {
+	Kind  string `json:"kind"`
+	Plain string `json:"plain"`
+	// FileID is the file ID of blocks, and the ID returned by
+	// Node.xattrID for xattr values.
+	FileID  string `json:"file_id,omitempty"`
+	BlockNo uint64 `json:"block_no,omitempty"`
+	Nonce   string `json:"nonce,omitempty"`
+	// DirIV is the directory IV of names and long names
+	DirIV string `json:"dir_iv,omitempty"`
+	// Attr is the stored, encrypted attribute name of xattr values
+	Attr   string `json:"attr,omitempty"`
+	Cipher string `json:"cipher"`
+	// Hashed is the "gocryptfs.longname.*" name of long names
+	Hashed string `json:"hashed,omitempty"`
+}
+
+// Result is the outcome of Verify
+type Result struct {
+	// Checked is the number of vectors checked, counted once per backend
+	Checked int
+	// Backends lists the backends that have been checked
+	Backends []string
+	// Skipped lists the backends that are not available in this build
+	Skipped []string
+	// Failures describes the vectors that did not match
+	Failures []string
+}
+
+// baseFlags are set in every suite. "LongNames" is in there because the
+// long name vectors need it.
+var baseFlags = []string{"GCMIV128", "EMENames", "LongNames", "DirIV"}
+
+// flagSets returns the feature flag combinations that Generate creates
+// suites for. Filesystems without HKDF were created by gocryptfs v1.2 and
+// older, which had none of the later name and xattr flags.
+func flagSets() (sets [][]string) {
+	add := func(extra ...string) {
+		flags := append([]string{}, baseFlags...)
+		for _, f := range extra {
+			if f == "XChaCha20Poly1305" {
+				flags = flags[1:] // conflicts with GCMIV128
+			}
+			if f != "" {
+				flags = append(flags, f)
+			}
+		}
+		sets = append(sets, flags)
+	}
+	add()
+	add("AESSIV")
+	for _, cipher := range []string{"", "AESSIV", "XChaCha20Poly1305"} {
+		for _, raw64 := range []string{"", "Raw64"} {
+			for _, auth := range [][]string{nil, {"FilenameAuth"}, {"FilenameAuth", "FilenameAuthEmbedded"}} {
+				for _, xattrAuth := range []string{"", "XattrAuth"} {
+					extra := append([]string{"HKDF", cipher, raw64, xattrAuth}, auth...)
+					add(extra...)
+				}
+			}
+		}
+	}
+	return sets
+}
+
+// backends returns the content encryption backends for the feature flags
+// "cf". They all produce the same ciphertext, the first one is used to
+// generate vectors.
+func backends(cf *configfile.ConfFile) []cryptocore.AEADTypeEnum {
+	switch {
+	case cf.IsFeatureFlagSet(configfile.FlagXChaCha20Poly1305):
+		return []cryptocore.AEADTypeEnum{cryptocore.BackendXChaCha20Poly1305, cryptocore.BackendXChaCha20Poly1305OpenSSL}
+	case cf.IsFeatureFlagSet(configfile.FlagAESSIV):
+		return []cryptocore.AEADTypeEnum{cryptocore.BackendAESSIV}
+	}
+	return []cryptocore.AEADTypeEnum{cryptocore.BackendGoGCM, cryptocore.BackendOpenSSL, cryptocore.BackendOptimized}
+}
+
+// available tells if the backend "b" is part of this build
+func available(b cryptocore.AEADTypeEnum) bool {
+	return b.Lib != "OpenSSL" || !stupidgcm.BuiltWithoutOpenssl
+}
+
+// suiteCrypto holds the objects that a suite is checked with
+type suiteCrypto struct {
+	cc        *cryptocore.CryptoCore
+	ce        *contentenc.ContentEnc
+	nt        *nametransform.NameTransform
+	xattrAuth bool
+}
+
+// newSuiteCrypto sets up the objects for the feature flags "flags", like
+// mounting a filesystem with these flags would, using "backend" for content
+// encryption.
+func newSuiteCrypto(flags []string, masterkey []byte, backend cryptocore.AEADTypeEnum) *suiteCrypto {
+	cf := &configfile.ConfFile{FeatureFlags: flags}
+	s := suiteCrypto{
+		cc:        cryptocore.New(masterkey, backend, backend.NonceSize*8, cf.IsFeatureFlagSet(configfile.FlagHKDF)),
+		xattrAuth: cf.IsFeatureFlagSet(configfile.FlagXattrAuth),
+	}
+	var fa *filenameauth.FilenameAuth
+	if cf.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded) {
+		fa = filenameauth.NewEmbedded(masterkey)
+	} else if cf.IsFeatureFlagSet(configfile.FlagFilenameAuth) {
+		fa = filenameauth.New(masterkey, true)
+	}
+	s.ce = contentenc.New(s.cc, contentenc.DefaultBS)
+	s.nt = nametransform.New(s.cc.EMECipher, true, 0, cf.IsFeatureFlagSet(configfile.FlagRaw64), nil, false, fa)
+	return &s
+}
+
+// seal encrypts a block with the nonce chosen by the caller. ContentEnc
+// only allows this in SIV mode, so the block is put together here, in the
+// format that ContentEnc.DecryptBlock reads.
+func (s *suiteCrypto) seal(plain []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+	aData := make([]byte, 8, 8+len(fileID))
+	binary.BigEndian.PutUint64(aData, blockNo)
+	aData = append(aData, fileID...)
+	return s.cc.AEADCipher.Seal(append([]byte{}, nonce...), nonce, plain, aData)
+}
+
+// xattrAD returns the additional data of an xattr value, like
+// RootNode.xattrAD does
+func (s *suiteCrypto) xattrAD(fileID []byte, attr string) []byte {
+	if !s.xattrAuth {
+		return nil
+	}
+	return fusefrontend.XattrAD(fileID, attr)
+}
+
+// stream returns "n" deterministic pseudo-random bytes for "label"
+func stream(label string, n int) []byte {
+	var out []byte
+	for i := uint32(0); len(out) < n; i++ {
+		h := sha256.New()
+		h.Write([]byte(label))
+		binary.Write(h, binary.BigEndian, i)
+		out = h.Sum(out)
+	}
+	return out[:n]
+}
+
+// Generate returns the vectors for all feature flag combinations. The
+// output only depends on "creator" and the code, it is the same on every
+// run.
+func Generate(creator string) *File {
+	masterkey := stream("masterkey", cryptocore.KeyLen)
+	f := &File{
+		FormatVersion: FormatVersion,
+		Creator:       creator,
+		MasterKey:     hex.EncodeToString(masterkey),
+	}
+	for _, flags := range flagSets() {
+		s := newSuiteCrypto(flags, masterkey, backends(&configfile.ConfFile{FeatureFlags: flags})[0])
+		f.Suites = append(f.Suites, Suite{FeatureFlags: flags, Vectors: s.generate()})
+		s.cc.Wipe()
+	}
+	return f
+}
+
+// generate creates the vectors of one suite
+func (s *suiteCrypto) generate() (vv []Vector) {
+	nonceLen := s.cc.IVLen
+	fileID := stream("file id", 16)
+	vv = append(vv, Vector{
+		Kind:   KindHeader,
+		Plain:  hex.EncodeToString(fileID),
+		Cipher: hex.EncodeToString((&contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: fileID}).Pack()),
+	})
+	for i, b := range []struct {
+		blockNo uint64
+		size    int
+	}{{0, 1}, {1, 100}, {7, contentenc.DefaultBS}} {
+		plain := stream(fmt.Sprintf("block %d", i), b.size)
+		nonce := stream(fmt.Sprintf("nonce %d", i), nonceLen)
+		vv = append(vv, Vector{
+			Kind:    KindBlock,
+			Plain:   hex.EncodeToString(plain),
+			FileID:  hex.EncodeToString(fileID),
+			BlockNo: b.blockNo,
+			Nonce:   hex.EncodeToString(nonce),
+			Cipher:  hex.EncodeToString(s.seal(plain, b.blockNo, fileID, nonce)),
+		})
+	}
+	dirIV := stream("dir iv", nametransform.DirIVLen)
+	names := []string{"a", "file.txt", "exactly 16 bytes", "Grüße, 世界 🙂",
+		string(bytes.Repeat([]byte("x"), 150)), string(bytes.Repeat([]byte("y"), nametransform.NameMax))}
+	for _, name := range names {
+		cName, err := s.nt.EncryptName(name, dirIV)
+		if err != nil {
+			panic(err)
+		}
+		v := Vector{Kind: KindName, Plain: name, DirIV: hex.EncodeToString(dirIV), Cipher: cName}
+		if hashed, _ := s.nt.EncryptAndHashName(name, dirIV); hashed != cName {
+			v.Kind = KindLongName
+			v.Hashed = hashed
+		}
+		vv = append(vv, v)
+	}
+	for i, x := range []struct{ name, value string }{{"user.a", "1"}, {"user.mime_type", "text/plain; charset=utf-8"}} {
+		cAttr, _ := s.nt.EncryptXattrName(x.name)
+		vv = append(vv, Vector{Kind: KindXattrName, Plain: x.name, Cipher: cAttr})
+		attr := "user.gocryptfs." + cAttr
+		nonce := stream(fmt.Sprintf("xattr nonce %d", i), nonceLen)
+		vv = append(vv, Vector{
+			Kind:   KindXattrValue,
+			Plain:  hex.EncodeToString([]byte(x.value)),
+			FileID: hex.EncodeToString(fileID),
+			Nonce:  hex.EncodeToString(nonce),
+			Attr:   attr,
+			Cipher: hex.EncodeToString(s.seal([]byte(x.value), 0, s.xattrAD(fileID, attr), nonce)),
+		})
+	}
+	return vv
+}
+
+// Verify checks this build against the vectors in "f". Every suite is
+// checked with each backend that implements its cipher and is available.
+// Encryption must give exactly the stored ciphertext, and decryption, done
+// like the filesystem does it, must give back the plaintext.
+func Verify(f *File) (*Result, error) {
+	if f.FormatVersion != FormatVersion {
+		return nil, fmt.Errorf("unsupported format version %d, want %d", f.FormatVersion, FormatVersion)
+	}
+	masterkey, err := hex.DecodeString(f.MasterKey)
+	if err != nil || len(masterkey) != cryptocore.KeyLen {
+		return nil, fmt.Errorf("invalid master key")
+	}
+	if len(f.Suites) == 0 {
+		return nil, fmt.Errorf("no suites")
+	}
+	r := &Result{}
+	seen := make(map[string]bool)
+	for _, suite := range f.Suites {
+		for _, flag := range suite.FeatureFlags {
+			if !configfile.IsFeatureFlagKnown(flag) {
+				return nil, fmt.Errorf("unknown feature flag %q", flag)
+			}
+		}
+		for _, b := range backends(&configfile.ConfFile{FeatureFlags: suite.FeatureFlags}) {
+			name := b.String()
+			if !available(b) {
+				if !seen[name] {
+					r.Skipped = append(r.Skipped, name)
+				}
+				seen[name] = true
+				continue
+			}
+			if !seen[name] {
+				r.Backends = append(r.Backends, name)
+			}
+			seen[name] = true
+			s := newSuiteCrypto(suite.FeatureFlags, masterkey, b)
+			for i, v := range suite.Vectors {
+				if err := s.check(v); err != nil {
+					r.Failures = append(r.Failures, fmt.Sprintf("%v with %s: vector %d (%s): %v",
+						suite.FeatureFlags, name, i, v.Kind, err))
+				}
+				r.Checked++
+			}
+			s.cc.Wipe()
+		}
+	}
+	return r, nil
+}
+
+// check verifies one vector
+func (s *suiteCrypto) check(v Vector) error {
+	switch v.Kind {
+	case KindHeader:
+		id, err := hex.DecodeString(v.Plain)
+		if err != nil {
+			return err
+		}
+		h, err := hex.DecodeString(v.Cipher)
+		if err != nil {
+			return err
+		}
+		if len(id) != 16 {
+			return fmt.Errorf("invalid file ID length %d", len(id))
+		}
+		if have := (&contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: id}).Pack(); !bytes.Equal(have, h) {
+			return fmt.Errorf("header is %x, want %x", have, h)
+		}
+		parsed, err := contentenc.ParseHeader(h)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(parsed.ID, id) {
+			return fmt.Errorf("parsed file ID is %x, want %x", parsed.ID, id)
+		}
+	case KindBlock, KindXattrValue:
+		var in [4][]byte
+		for i, x := range []string{v.Plain, v.FileID, v.Nonce, v.Cipher} {
+			var err error
+			if in[i], err = hex.DecodeString(x); err != nil {
+				return err
+			}
+		}
+		plain, fileID, nonce, cipher := in[0], in[1], in[2], in[3]
+		if len(nonce) != s.cc.IVLen || len(fileID) != 16 {
+			return fmt.Errorf("invalid nonce or file ID length")
+		}
+		blockNo := v.BlockNo
+		if v.Kind == KindXattrValue {
+			fileID = s.xattrAD(fileID, v.Attr)
+			blockNo = 0
+		}
+		if have := s.seal(plain, blockNo, fileID, nonce); !bytes.Equal(have, cipher) {
+			return fmt.Errorf("encryption gives a different ciphertext")
+		}
+		have, err := s.ce.DecryptBlock(cipher, blockNo, fileID)
+		if err != nil {
+			return fmt.Errorf("decryption failed: %v", err)
+		}
+		if !bytes.Equal(have, plain) {
+			return fmt.Errorf("decryption gives a different plaintext")
+		}
+	case KindName, KindLongName:
+		dirIV, err := hex.DecodeString(v.DirIV)
+		if err != nil {
+			return err
+		}
+		if len(dirIV) != nametransform.DirIVLen {
+			return fmt.Errorf("invalid directory IV length %d", len(dirIV))
+		}
+		cName, err := s.nt.EncryptName(v.Plain, dirIV)
+		if err != nil {
+			return err
+		}
+		if cName != v.Cipher {
+			return fmt.Errorf("name encrypts to %q, want %q", cName, v.Cipher)
+		}
+		hashed, err := s.nt.EncryptAndHashName(v.Plain, dirIV)
+		if err != nil {
+			return err
+		}
+		want := v.Cipher
+		if v.Kind == KindLongName {
+			want = v.Hashed
+		}
+		if hashed != want {
+			return fmt.Errorf("stored name is %q, want %q", hashed, want)
+		}
+		plain, err := s.nt.DecryptName(v.Cipher, dirIV)
+		if err != nil {
+			return fmt.Errorf("decryption failed: %v", err)
+		}
+		if plain != v.Plain {
+			return fmt.Errorf("name decrypts to %q, want %q", plain, v.Plain)
+		}
+	case KindXattrName:
+		cAttr, err := s.nt.EncryptXattrName(v.Plain)
+		if err != nil {
+			return err
+		}
+		if cAttr != v.Cipher {
+			return fmt.Errorf("name encrypts to %q, want %q", cAttr, v.Cipher)
+		}
+		plain, err := s.nt.DecryptXattrName(v.Cipher)
+		if err != nil {
+			return fmt.Errorf("decryption failed: %v", err)
+		}
+		if plain != v.Plain {
+			return fmt.Errorf("name decrypts to %q, want %q", plain, v.Plain)
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", v.Kind)
+	}
+	return nil
+}
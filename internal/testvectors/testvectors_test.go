@@ -0,0 +1,111 @@
+package testvectors
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGenerateVerify(t *testing.T) {
+	f := Generate("test")
+	if !reflect.DeepEqual(f, Generate("test")) {
+		t.Fatal("Generate is not deterministic")
+	}
+	// Check the JSON roundtrip as well
+	j, err := json.Marshal(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var f2 File
+	if err = json.Unmarshal(j, &f2); err != nil {
+		t.Fatal(err)
+	}
+	r, err := Verify(&f2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Failures) > 0 {
+		t.Fatalf("%d failures, first one: %s", len(r.Failures), r.Failures[0])
+	}
+	if r.Checked == 0 || len(r.Backends) == 0 {
+		t.Errorf("nothing checked: %+v", r)
+	}
+	kinds := make(map[string]bool)
+	for _, v := range f.Suites[0].Vectors {
+		kinds[v.Kind] = true
+	}
+	for _, k := range []string{KindHeader, KindBlock, KindName, KindLongName, KindXattrName, KindXattrValue} {
+		if !kinds[k] {
+			t.Errorf("no %s vector", k)
+		}
+	}
+}
+
+// TestKnownAnswers pins a few vectors, so that Generate and Verify cannot
+// change together without being noticed.
+func TestKnownAnswers(t *testing.T) {
+	f := Generate("test")
+	want := []struct {
+		suite  int
+		plain  string
+		cipher string
+	}{
+		// v1.2 and older: no HKDF
+		{0, "446bc5ed7394dfa1a19439607fdd489d", "0002446bc5ed7394dfa1a19439607fdd489d"},
+		{0, "51", "aac641af7d9863710407ac15d300892ae3e5b249013508b2b3f399b4585c5a92cd"},
+		{0, "file.txt", "l290PaIbvioR3XM6iT-rQQ=="},
+		{0, "user.a", "xVNrrsLqZSHIwXKZt1mRfA=="},
+		// AES-GCM with HKDF
+		{2, "51", "aac641af7d9863710407ac15d300892afaaa4d7b1c06ad1e7491e84a43f8bffd11"},
+		{2, "file.txt", "9LuLvOjMcY46ZImlByWkNA=="},
+		{2, "31", "0b9d19773bdb14522b2f67f33fc90fb8b2cd8445f5f42e477da5901d832698f5ea"},
+	}
+	if f.MasterKey != "8a0321969d0872ea92e96fae9f4c225d1007e260ac5f992657d12c8fd4986156" {
+		t.Errorf("MasterKey=%s", f.MasterKey)
+	}
+	for _, w := range want {
+		found := false
+		for _, v := range f.Suites[w.suite].Vectors {
+			if v.Plain == w.plain {
+				found = true
+				if v.Cipher != w.cipher {
+					t.Errorf("suite %d, %q: have %s, want %s", w.suite, w.plain, v.Cipher, w.cipher)
+				}
+			}
+		}
+		if !found {
+			t.Errorf("suite %d: no vector for %q", w.suite, w.plain)
+		}
+	}
+}
+
+func TestVerifyMismatch(t *testing.T) {
+	f := Generate("test")
+	v := &f.Suites[len(f.Suites)-1].Vectors[1]
+	// Flip a nibble of the ciphertext
+	c := []byte(v.Cipher)
+	c[len(c)-1] ^= 1
+	v.Cipher = string(c)
+	f.Suites[3].Vectors[4].Cipher = "x" + f.Suites[3].Vectors[4].Cipher[1:]
+	r, err := Verify(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Failures) < 2 {
+		t.Fatalf("have failures %v", r.Failures)
+	}
+	if !strings.Contains(r.Failures[0], "(name)") || !strings.Contains(r.Failures[len(r.Failures)-1], "(block)") {
+		t.Errorf("have failures %v", r.Failures)
+	}
+
+	f.FormatVersion++
+	if _, err := Verify(f); err == nil {
+		t.Error("unsupported format version accepted")
+	}
+	f = Generate("test")
+	f.Suites[0].FeatureFlags = append(f.Suites[0].FeatureFlags, "Unknown")
+	if _, err := Verify(f); err == nil {
+		t.Error("unknown feature flag accepted")
+	}
+}
@@ -0,0 +1,193 @@
+package tlog
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Level is the severity of a message
+type Level int
+
+const (
+	// LevelDebug is the level of the Debug logger
+	LevelDebug Level = iota
+	// LevelInfo is the level of the Info logger
+	LevelInfo
+	// LevelWarn is the level of the Warn logger
+	LevelWarn
+	// LevelFatal is the level of the Fatal logger
+	LevelFatal
+)
+
+var levelNames = []string{"debug", "info", "warn", "fatal"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("level%d", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts "debug", "info", "warn" or "fatal" to a Level
+func ParseLevel(s string) (Level, error) {
+	for i, n := range levelNames {
+		if s == n {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, valid levels: %s", s, strings.Join(levelNames, ", "))
+}
+
+// DefaultSubsystem is the key for the level of all subsystems that have no
+// level of their own in SetLevels and Levels
+const DefaultSubsystem = "default"
+
+// config is the logging configuration that is shared by all loggers. It is
+// replaced as a whole, so the loggers can read it without locking.
+type config struct {
+	// format is the output format
+	format Format
+	// plain is set when the output is not the console: color escape
+	// sequences are removed and the text format gets timestamps
+	plain bool
+	// levels is the minimum level per subsystem
+	levels map[string]Level
+	// journal is set when logging to journald
+	journal *journalWriter
+}
+
+// structured returns true if the messages carry the subsystem
+func (c *config) structured() bool {
+	return c.format == FormatJSON || c.journal != nil
+}
+
+var (
+	conf atomic.Pointer[config]
+	// confMu serializes the updates of "conf"
+	confMu sync.Mutex
+)
+
+// updateConfig applies "f" to a copy of the configuration and stores it
+func updateConfig(f func(c *config)) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	c := *conf.Load()
+	f(&c)
+	conf.Store(&c)
+}
+
+// callerSubsystem returns the name of the Go package of the function "skip"
+// frames up the stack, like "fusefrontend" or "main"
+func callerSubsystem(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	f := runtime.FuncForPC(pc)
+	if f == nil {
+		return "unknown"
+	}
+	// "github.com/rfjakob/gocryptfs/v2/internal/fusefrontend.(*Node).Open"
+	name := f.Name()
+	if i := strings.LastIndexByte(name, '/'); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// SetLevels sets the minimum level of the messages that are logged, per
+// subsystem. The subsystem is the Go package that logs the message, like
+// "fusefrontend", "ctlsocksrv" or "main". DefaultSubsystem sets the level of
+// all other subsystems, like "-d" and "-q" do. An empty level removes the
+// level of a subsystem. Fatal messages cannot be disabled by
+// DefaultSubsystem. Nothing is changed if a level is invalid.
+func SetLevels(levels map[string]string) error {
+	parsed := make(map[string]Level)
+	for sub, s := range levels {
+		if sub == "" || strings.ContainsAny(sub, "=, ") {
+			return fmt.Errorf("invalid subsystem name %q", sub)
+		}
+		if s == "" {
+			if sub == DefaultSubsystem {
+				return fmt.Errorf("%s needs a level", DefaultSubsystem)
+			}
+			continue
+		}
+		l, err := ParseLevel(s)
+		if err != nil {
+			return err
+		}
+		parsed[sub] = l
+	}
+	if l, ok := parsed[DefaultSubsystem]; ok {
+		Debug.Enabled = l <= LevelDebug
+		Info.Enabled = l <= LevelInfo
+		Warn.Enabled = l <= LevelWarn
+		delete(parsed, DefaultSubsystem)
+	}
+	updateConfig(func(c *config) {
+		m := make(map[string]Level)
+		for sub, l := range c.levels {
+			m[sub] = l
+		}
+		for sub, s := range levels {
+			if s == "" {
+				delete(m, sub)
+			}
+		}
+		for sub, l := range parsed {
+			m[sub] = l
+		}
+		c.levels = m
+	})
+	return nil
+}
+
+// Levels returns the level of each subsystem that has one, and the
+// DefaultSubsystem level
+func Levels() map[string]string {
+	m := map[string]string{DefaultSubsystem: LevelFatal.String()}
+	for _, l := range []*toggledLogger{Warn, Info, Debug} {
+		if l.Enabled {
+			m[DefaultSubsystem] = l.level.String()
+		}
+	}
+	for sub, l := range conf.Load().levels {
+		m[sub] = l.String()
+	}
+	return m
+}
+
+// ParseLevels parses a "-log-level" value like "fusefrontend=debug,default=warn"
+// for SetLevels
+func ParseLevels(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		sub, l, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok || sub == "" {
+			return nil, fmt.Errorf("invalid subsystem level %q, want SUBSYSTEM=LEVEL", kv)
+		}
+		if _, err := ParseLevel(l); err != nil {
+			return nil, err
+		}
+		m[sub] = l
+	}
+	return m, nil
+}
+
+// FormatLevels is the inverse of ParseLevels, with the subsystems sorted
+func FormatLevels(m map[string]string) string {
+	var kv []string
+	for sub, l := range m {
+		kv = append(kv, sub+"="+l)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
@@ -1,5 +1,6 @@
 // Package tlog is a "toggled logger" that can be enabled and disabled and
-// provides coloring.
+// provides coloring. Messages can also be written as JSON, to journald or
+// to a log file, and the level can be set per subsystem (see SetLevels).
 package tlog
 
 import (
@@ -7,7 +8,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"log/syslog"
 	"os"
 
 	"golang.org/x/term"
@@ -46,10 +46,13 @@ func JSONDump(obj interface{}) string {
 
 // toggledLogger - a Logger than can be enabled and disabled
 type toggledLogger struct {
-	// Enable or disable output
+	// Enable or disable output. A level set with SetLevels for the
+	// subsystem that logs takes precedence.
 	Enabled bool
 	// Panic after logging a message, useful in regression tests
 	Wpanic bool
+	// level is the severity of the messages
+	level Level
 	// Private prefix and postfix are used for coloring
 	prefix  string
 	postfix string
@@ -69,26 +72,43 @@ func trimNewline(msg string) string {
 }
 
 func (l *toggledLogger) Printf(format string, v ...interface{}) {
-	if !l.Enabled {
+	subsystem, ok := l.check()
+	if !ok {
 		return
 	}
 	msg := trimNewline(fmt.Sprintf(format, v...))
-	l.Logger.Printf(l.prefix + msg + l.postfix)
+	l.output(subsystem, msg)
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + msg)
 	}
 }
 func (l *toggledLogger) Println(v ...interface{}) {
-	if !l.Enabled {
+	subsystem, ok := l.check()
+	if !ok {
 		return
 	}
 	msg := trimNewline(fmt.Sprint(v...))
-	l.Logger.Println(l.prefix + msg + l.postfix)
+	l.output(subsystem, msg)
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + msg)
 	}
 }
 
+// check returns the subsystem of the caller of Printf or Println, and if
+// the message should be logged. The subsystem is only looked up if it is
+// needed.
+func (l *toggledLogger) check() (string, bool) {
+	c := conf.Load()
+	if len(c.levels) == 0 && !c.structured() {
+		return "", l.Enabled
+	}
+	subsystem := callerSubsystem(3)
+	if min, ok := c.levels[subsystem]; ok {
+		return subsystem, l.level >= min
+	}
+	return subsystem, l.Enabled
+}
+
 // Debug logs debug messages
 // Can be enabled by passing "-d"
 var Debug *toggledLogger
@@ -119,53 +139,34 @@ func init() {
 	}
 
 	Debug = &toggledLogger{
+		level:  LevelDebug,
 		Logger: log.New(os.Stdout, "", 0),
 	}
 	Info = &toggledLogger{
 		Enabled: true,
+		level:   LevelInfo,
 		Logger:  log.New(os.Stdout, "", 0),
 	}
 	Warn = &toggledLogger{
 		Enabled: true,
+		level:   LevelWarn,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorYellow,
 		postfix: ColorReset,
 	}
 	Fatal = &toggledLogger{
 		Enabled: true,
+		level:   LevelFatal,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorRed,
 		postfix: ColorReset,
 	}
+	conf.Store(&config{})
 }
 
-// SwitchToSyslog redirects the output of this logger to syslog.
-// p = facility | severity
-func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
-	if err != nil {
-		Warn.Printf("SwitchToSyslog: %v", err)
-	} else {
-		l.Logger.SetOutput(w)
-		// Disable colors
-		l.prefix = ""
-		l.postfix = ""
-	}
-}
-
-// SwitchLoggerToSyslog redirects the default log.Logger that the go-fuse lib uses
-// to syslog.
-func SwitchLoggerToSyslog() {
-	p := syslog.LOG_USER | syslog.LOG_WARNING
-	w, err := syslog.New(p, ProgramName)
-	if err != nil {
-		Warn.Printf("SwitchLoggerToSyslog: %v", err)
-	} else {
-		log.SetPrefix("go-fuse: ")
-		// Disable printing the timestamp, syslog already provides that
-		log.SetFlags(0)
-		log.SetOutput(w)
-	}
+// loggers returns Debug, Info, Warn and Fatal
+func loggers() []*toggledLogger {
+	return []*toggledLogger{Debug, Info, Warn, Fatal}
 }
 
 // PrintMasterkeyReminder reminds the user that he should store the master key in
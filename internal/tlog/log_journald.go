@@ -0,0 +1,64 @@
+package tlog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// journalSocket is where journald receives messages in its native protocol
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalWriter sends messages to journald, with the level as PRIORITY and
+// the subsystem in the GOCRYPTFS_SUBSYSTEM field
+type journalWriter struct {
+	conn *net.UnixConn
+}
+
+// journalPriority maps a Level to a syslog priority
+var journalPriority = map[Level]string{
+	LevelDebug: "7",
+	LevelInfo:  "6",
+	LevelWarn:  "4",
+	LevelFatal: "2",
+}
+
+// SwitchToJournald sends the messages of all loggers to journald.
+func SwitchToJournald() error {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	updateConfig(func(c *config) {
+		c.journal = &journalWriter{conn: conn}
+	})
+	return nil
+}
+
+func (j *journalWriter) send(level Level, subsystem string, msg string) error {
+	var b bytes.Buffer
+	journalField(&b, "MESSAGE", msg)
+	journalField(&b, "PRIORITY", journalPriority[level])
+	journalField(&b, "SYSLOG_IDENTIFIER", ProgramName)
+	journalField(&b, "GOCRYPTFS_SUBSYSTEM", subsystem)
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
+
+// journalField appends a field in the journald native protocol. Values with
+// a newline are sent in the binary form: the name, a newline, the length as
+// a little-endian uint64, and the value.
+func journalField(b *bytes.Buffer, name string, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
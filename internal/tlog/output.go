@@ -0,0 +1,112 @@
+package tlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"time"
+)
+
+// Format is the output format of the loggers
+type Format int
+
+const (
+	// FormatText is one line of text per message, colored on a terminal
+	FormatText Format = iota
+	// FormatJSON is one JSON object per line, with the fields "time",
+	// "level", "subsystem" and "msg"
+	FormatJSON
+)
+
+// ParseFormat converts "text" or "json" to a Format
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return 0, fmt.Errorf("unknown log format %q, valid formats: text, json", s)
+}
+
+// SetFormat sets the output format of all loggers
+func SetFormat(f Format) {
+	updateConfig(func(c *config) {
+		c.format = f
+		setFlags(c)
+	})
+}
+
+// SetOutput redirects all loggers, and the default log.Logger that the
+// go-fuse lib uses, to "w", like a RotatingFile. Colors are disabled and
+// the text format gets timestamps.
+func SetOutput(w io.Writer) {
+	for _, l := range loggers() {
+		l.Logger.SetOutput(w)
+		l.prefix = ""
+		l.postfix = ""
+	}
+	log.SetPrefix("go-fuse: ")
+	log.SetOutput(w)
+	updateConfig(func(c *config) {
+		c.plain = true
+		setFlags(c)
+	})
+}
+
+// setFlags sets the timestamp flags of the loggers for the configuration
+// "c". JSON has its own timestamp field.
+func setFlags(c *config) {
+	flags := 0
+	if c.plain && c.format == FormatText {
+		flags = log.LstdFlags
+	}
+	for _, l := range loggers() {
+		l.Logger.SetFlags(flags)
+	}
+}
+
+// colorRegexp matches the terminal escape sequences of the Color* variables
+var colorRegexp = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// stripColors removes terminal escape sequences from "msg"
+func stripColors(msg string) string {
+	return colorRegexp.ReplaceAllString(msg, "")
+}
+
+// jsonMessage is a message in FormatJSON
+type jsonMessage struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Subsystem string `json:"subsystem"`
+	Msg       string `json:"msg"`
+}
+
+// output writes "msg" of "subsystem" in the configured format
+func (l *toggledLogger) output(subsystem string, msg string) {
+	c := conf.Load()
+	if c.journal != nil {
+		err := c.journal.send(l.level, subsystem, stripColors(msg))
+		if err == nil {
+			return
+		}
+		// Fall back to the logger, so the message is not lost
+		msg = fmt.Sprintf("%s (journald: %v)", msg, err)
+	}
+	if c.format == FormatJSON {
+		j, _ := json.Marshal(jsonMessage{
+			Time:      time.Now().Format(time.RFC3339Nano),
+			Level:     l.level.String(),
+			Subsystem: subsystem,
+			Msg:       stripColors(msg),
+		})
+		l.Logger.Print(string(j))
+		return
+	}
+	if c.plain {
+		msg = stripColors(msg)
+	}
+	l.Logger.Print(l.prefix + msg + l.postfix)
+}
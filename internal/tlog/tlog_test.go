@@ -1,6 +1,11 @@
 package tlog
 
 import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -24,3 +29,109 @@ func TestTrimNewline(t *testing.T) {
 		}
 	}
 }
+
+// captureLogs sends the output of all loggers to a buffer and restores the
+// configuration when the test is done
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	c := conf.Load()
+	enabled := map[*toggledLogger]bool{}
+	for _, l := range loggers() {
+		enabled[l] = l.Enabled
+		w := l.Logger.Writer()
+		l.Logger.SetOutput(&buf)
+		defer func(l *toggledLogger) {
+			t.Cleanup(func() { l.Logger.SetOutput(w) })
+		}(l)
+	}
+	t.Cleanup(func() {
+		conf.Store(c)
+		for l, e := range enabled {
+			l.Enabled = e
+		}
+	})
+	return &buf
+}
+
+func TestSubsystemLevels(t *testing.T) {
+	buf := captureLogs(t)
+	Debug.Printf("hidden")
+	if err := SetLevels(map[string]string{"tlog": "debug"}); err != nil {
+		t.Fatal(err)
+	}
+	Debug.Printf("shown")
+	if err := SetLevels(map[string]string{"tlog": "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	Info.Printf("hidden")
+	Warn.Printf("warning")
+	if buf.String() != "shown\n"+ColorYellow+"warning"+ColorReset+"\n" {
+		t.Errorf("have %q", buf.String())
+	}
+	want := map[string]string{"tlog": "warn", DefaultSubsystem: "info"}
+	if have := Levels(); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	// Invalid levels do not change anything
+	if err := SetLevels(map[string]string{"tlog": "", "x": "loud"}); err == nil {
+		t.Error("invalid level should fail")
+	}
+	if err := SetLevels(map[string]string{"tlog": "", DefaultSubsystem: "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]string{DefaultSubsystem: "warn"}
+	if have := Levels(); !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	buf := captureLogs(t)
+	SetFormat(FormatJSON)
+	Warn.Printf("%s", ColorGreen+"hello\nworld"+ColorReset)
+	var m jsonMessage
+	if err := json.Unmarshal(buf.Bytes(), &m); err != nil {
+		t.Fatalf("%v: %q", err, buf.String())
+	}
+	if m.Level != "warn" || m.Subsystem != "tlog" || m.Msg != "hello\nworld" || m.Time == "" {
+		t.Errorf("have %+v", m)
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	m, err := ParseLevels("fusefrontend=debug, default=warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if FormatLevels(m) != "default=warn,fusefrontend=debug" {
+		t.Errorf("have %v", m)
+	}
+	for _, in := range []string{"", "fusefrontend", "=debug", "x=loud"} {
+		if _, err := ParseLevels(in); err == nil {
+			t.Errorf("%q should fail", in)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	r, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"aaaaaaa\n", "bbbbbbb\n", "ccccccc\n", "ddddddd\n"} {
+		if _, err = r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{"log": "ddddddd\n", "log.1": "ccccccc\n", "log.2": "bbbbbbb\n"} {
+		have, err := os.ReadFile(filepath.Join(filepath.Dir(path), name))
+		if err != nil || string(have) != want {
+			t.Errorf("%s: have %q, %v", name, have, err)
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("only 2 old files should be kept: %v", err)
+	}
+}
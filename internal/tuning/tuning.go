@@ -0,0 +1,100 @@
+// Package tuning stores performance parameters that gocryptfs learns while a
+// filesystem is mounted, so the next mount can start with them instead of
+// re-learning them from the defaults. It also records the result of the last
+// "-fsck" run for "-info".
+//
+// The parameters are kept in CIPHERDIR/gocryptfs.tuning. The file holds no
+// secrets and losing it is harmless: a missing, unreadable or invalid file
+// just means that the defaults are used.
+package tuning
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/writecoalescing"
+)
+
+// FileName is the name of the state file in the CIPHERDIR root. Ignored in
+// directory listings.
+const FileName = "gocryptfs.tuning"
+
+// tmpSuffix is appended to FileName while the file is being written.
+const tmpSuffix = ".tmp"
+
+// IsStateFile returns true if "name" is the state file or its temporary
+// version.
+func IsStateFile(name string) bool {
+	return name == FileName || name == FileName+tmpSuffix
+}
+
+// State is the content of the state file. Zero values mean "not learned
+// yet".
+type State struct {
+	// PrefetchSize is the last buffer size of the adaptive nonce prefetcher
+	// in bytes.
+	PrefetchSize int `json:",omitempty"`
+	// WriteCoalescing are the last write coalescer thresholds.
+	WriteCoalescing *writecoalescing.CoalesceConfig `json:",omitempty"`
+	// LastFsck is the result of the last complete "-fsck" run.
+	LastFsck *FsckResult `json:",omitempty"`
+}
+
+// FsckResult is the result of a "-fsck" run.
+type FsckResult struct {
+	// Time is when the check finished
+	Time time.Time
+	// Corrupt is the number of corrupt files found
+	Corrupt int
+	// Skipped is the number of files that could not be checked
+	Skipped int
+}
+
+// Load reads the state of "cipherdir". A missing file is not an error and
+// returns an empty State.
+func Load(cipherdir string) (*State, error) {
+	s := &State{}
+	js, err := os.ReadFile(filepath.Join(cipherdir, FileName))
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(js, s); err != nil {
+		return &State{}, err
+	}
+	return s, nil
+}
+
+// CoalesceConfig returns the saved write coalescer thresholds, or the
+// defaults if none were saved or they are invalid.
+func (s *State) CoalesceConfig() *writecoalescing.CoalesceConfig {
+	c := s.WriteCoalescing
+	if c == nil || c.Threshold <= 0 || c.MaxSize < c.Threshold || c.Timeout < 0 {
+		return writecoalescing.DefaultConfig()
+	}
+	cc := *c
+	return &cc
+}
+
+// Save writes "s" to the state file of "cipherdir". The file is replaced
+// atomically so a crash leaves either the old or the new state behind.
+func (s *State) Save(cipherdir string) error {
+	js, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	js = append(js, '\n')
+	path := filepath.Join(cipherdir, FileName)
+	tmp := path + tmpSuffix
+	if err := os.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package tuning
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/writecoalescing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	dir := t.TempDir()
+	// Missing file -> empty state
+	s, err := Load(dir)
+	if err != nil || s.PrefetchSize != 0 || s.WriteCoalescing != nil {
+		t.Fatalf("Load of missing file: %v %+v", err, s)
+	}
+	if *s.CoalesceConfig() != *writecoalescing.DefaultConfig() {
+		t.Error("empty state should return the default coalescer config")
+	}
+
+	s.PrefetchSize = 2048
+	s.WriteCoalescing = &writecoalescing.CoalesceConfig{
+		Threshold: 4096, Timeout: 5 * time.Millisecond, MaxSize: 128 * 1024, Enabled: true,
+	}
+	if err := s.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, FileName+tmpSuffix)); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	s2, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.PrefetchSize != 2048 || *s2.CoalesceConfig() != *s.WriteCoalescing {
+		t.Errorf("got %+v %+v", s2, s2.WriteCoalescing)
+	}
+}
+
+func TestLastFsck(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now().Truncate(time.Second)
+	s := &State{LastFsck: &FsckResult{Time: now, Corrupt: 2, Skipped: 1}}
+	if err := s.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+	s2, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.LastFsck == nil || !s2.LastFsck.Time.Equal(now) || s2.LastFsck.Corrupt != 2 || s2.LastFsck.Skipped != 1 {
+		t.Errorf("got %+v", s2.LastFsck)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, FileName), []byte("{garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Load(dir)
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if s == nil || s.PrefetchSize != 0 {
+		t.Errorf("should return an empty state, got %+v", s)
+	}
+	// Nonsensical thresholds fall back to the defaults
+	s.WriteCoalescing = &writecoalescing.CoalesceConfig{Threshold: 1000, MaxSize: 10}
+	if *s.CoalesceConfig() != *writecoalescing.DefaultConfig() {
+		t.Error("invalid config was not replaced by the defaults")
+	}
+}
@@ -0,0 +1,17 @@
+// Package uring implements the experimental "-io-engine uring" backing I/O
+// engine. It reads and writes ciphertext through io_uring, using buffers that
+// are registered with the kernel once at startup so the kernel does not have
+// to map them for every request.
+package uring
+
+import (
+	"errors"
+)
+
+// ErrUnsupported is returned by New on platforms without io_uring.
+var ErrUnsupported = errors.New("io_uring not supported")
+
+// ChunkFunc is called by Engine.ReadChunks for every chunk that has been
+// read. "pos" is the offset of "data" relative to the start of the read.
+// "data" is only valid until ChunkFunc returns.
+type ChunkFunc func(pos int, data []byte)
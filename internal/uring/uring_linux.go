@@ -0,0 +1,351 @@
+package uring
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Constants from include/uapi/linux/io_uring.h
+const (
+	opReadFixed  = 4
+	opWriteFixed = 5
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	enterGetEvents = 1
+
+	registerBuffers = 0
+)
+
+// ringEntries is the number of submission queue entries of each ring, and
+// the maximum number of requests in flight per ring.
+const ringEntries = 32
+
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+// params is struct io_uring_params
+type params struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFd uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  sqringOffsets
+	cqOff                                                                  cqringOffsets
+}
+
+// sqe is struct io_uring_sqe
+type sqe struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	rwFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+// cqe is struct io_uring_cqe
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// ring is one io_uring instance with one registered buffer. A ring is only
+// used by one goroutine at a time, so all completions it sees belong to the
+// current request.
+type ring struct {
+	fd                   int
+	sqMem, cqMem, sqeMem []byte
+	sqHead, sqTail       *uint32
+	sqMask               uint32
+	sqArray              []uint32
+	sqes                 []sqe
+	cqHead, cqTail       *uint32
+	cqMask               uint32
+	cqes                 []cqe
+	// buf is registered as fixed buffer 0
+	buf []byte
+}
+
+func newRing(bufSize int) (r *ring, err error) {
+	var p params
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, ringEntries, uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, fmt.Errorf("io_uring_setup: %w", errno)
+	}
+	r = &ring{fd: int(fd)}
+	defer func() {
+		if err != nil {
+			r.close()
+		}
+	}()
+	prot := unix.PROT_READ | unix.PROT_WRITE
+	flags := unix.MAP_SHARED | unix.MAP_POPULATE
+	r.sqMem, err = unix.Mmap(r.fd, offSQRing, int(p.sqOff.array+p.sqEntries*4), prot, flags)
+	if err != nil {
+		return nil, fmt.Errorf("mmap sq ring: %w", err)
+	}
+	r.cqMem, err = unix.Mmap(r.fd, offCQRing, int(p.cqOff.cqes)+int(p.cqEntries)*int(unsafe.Sizeof(cqe{})), prot, flags)
+	if err != nil {
+		return nil, fmt.Errorf("mmap cq ring: %w", err)
+	}
+	r.sqeMem, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries)*int(unsafe.Sizeof(sqe{})), prot, flags)
+	if err != nil {
+		return nil, fmt.Errorf("mmap sqes: %w", err)
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqMem[p.sqOff.array])), p.sqEntries)
+	r.sqes = unsafe.Slice((*sqe)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqMem[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*cqe)(unsafe.Pointer(&r.cqMem[p.cqOff.cqes])), p.cqEntries)
+
+	// Anonymous memory, so the buffer never moves
+	r.buf, err = unix.Mmap(-1, 0, bufSize, prot, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, fmt.Errorf("mmap buffer: %w", err)
+	}
+	iov := unix.Iovec{Base: &r.buf[0]}
+	iov.SetLen(bufSize)
+	_, _, errno = unix.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), registerBuffers,
+		uintptr(unsafe.Pointer(&iov)), 1, 0, 0)
+	if errno != 0 {
+		// ENOMEM usually means that RLIMIT_MEMLOCK is too low
+		return nil, fmt.Errorf("registering buffer: %w", errno)
+	}
+	return r, nil
+}
+
+func (r *ring) close() {
+	for _, m := range [][]byte{r.buf, r.sqeMem, r.cqMem, r.sqMem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	syscall.Close(r.fd)
+}
+
+// queue adds a fixed-buffer read or write of buf[bufOff:bufOff+length] at
+// file offset "off" to the submission queue.
+func (r *ring) queue(op uint8, fd int, off int64, bufOff int, length int, userData uint64) {
+	tail := *r.sqTail
+	idx := tail & r.sqMask
+	r.sqes[idx] = sqe{
+		opcode:   op,
+		fd:       int32(fd),
+		off:      uint64(off),
+		addr:     uint64(uintptr(unsafe.Pointer(&r.buf[bufOff]))),
+		len:      uint32(length),
+		userData: userData,
+	}
+	r.sqArray[idx] = idx
+	atomic.StoreUint32(r.sqTail, tail+1)
+}
+
+// enter submits the queued requests and waits until at least one
+// completion is available.
+func (r *ring) enter() error {
+	for {
+		toSubmit := *r.sqTail - atomic.LoadUint32(r.sqHead)
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), 1, enterGetEvents, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	}
+}
+
+// reap calls fn for every available completion.
+func (r *ring) reap(fn func(userData uint64, res int32)) {
+	head := *r.cqHead
+	tail := atomic.LoadUint32(r.cqTail)
+	for ; head != tail; head++ {
+		c := r.cqes[head&r.cqMask]
+		fn(c.userData, c.res)
+	}
+	atomic.StoreUint32(r.cqHead, head)
+}
+
+// Engine reads and writes files through a set of io_uring instances.
+type Engine struct {
+	bufSize int
+	rings   chan *ring
+}
+
+// New sets up "rings" io_uring instances, each with a registered buffer of
+// "bufSize" bytes. This is the maximum length of a ReadChunks or WriteAt
+// call. At most "rings" calls run concurrently, others wait.
+func New(bufSize int, rings int) (*Engine, error) {
+	e := &Engine{
+		bufSize: bufSize,
+		rings:   make(chan *ring, rings),
+	}
+	for i := 0; i < rings; i++ {
+		r, err := newRing(bufSize)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.rings <- r
+	}
+	return e, nil
+}
+
+// Close releases the rings. The Engine must not be used afterwards.
+func (e *Engine) Close() {
+	for {
+		select {
+		case r := <-e.rings:
+			r.close()
+		default:
+			return
+		}
+	}
+}
+
+// chunk is the state of one chunk of a ReadChunks call
+type chunk struct {
+	pos, want, done int
+}
+
+// ReadChunks reads "length" bytes at "off" from "fd", split into chunks of
+// "chunkSize" bytes that the kernel reads in parallel. "fn" is called for
+// each complete chunk as soon as it has been read, while the others are still
+// in flight, and for the last, partial chunk at the end. Returns the number of
+// contiguous bytes read like pread(2); that is less than "length" at the end
+// of the file. If the file grows at the same time, "fn" may also be called for
+// chunks beyond that, which the caller must ignore.
+func (e *Engine) ReadChunks(fd int, off int64, length int, chunkSize int, fn ChunkFunc) (n int, err error) {
+	if length > e.bufSize {
+		return 0, unix.EINVAL
+	}
+	r := <-e.rings
+	defer func() { e.rings <- r }()
+
+	var chunks []chunk
+	for pos := 0; pos < length; pos += chunkSize {
+		want := chunkSize
+		if pos+want > length {
+			want = length - pos
+		}
+		chunks = append(chunks, chunk{pos: pos, want: want})
+	}
+	next := 0
+	pending := 0
+	for next < len(chunks) || pending > 0 {
+		for next < len(chunks) && pending < ringEntries {
+			c := &chunks[next]
+			r.queue(opReadFixed, fd, off+int64(c.pos), c.pos, c.want, uint64(next))
+			next++
+			pending++
+		}
+		if err = r.enter(); err != nil {
+			// Requests still in flight would write into the buffer of the
+			// next user of the ring
+			e.drain(r, pending)
+			return 0, err
+		}
+		r.reap(func(i uint64, res int32) {
+			pending--
+			if err != nil {
+				return
+			}
+			c := &chunks[i]
+			if res < 0 {
+				err = syscall.Errno(-res)
+				return
+			}
+			c.done += int(res)
+			// res == 0 means end of file
+			if res > 0 && c.done < c.want {
+				// Short read, get the rest
+				r.queue(opReadFixed, fd, off+int64(c.pos+c.done), c.pos+c.done, c.want-c.done, i)
+				pending++
+				return
+			}
+			if c.done == c.want {
+				fn(c.pos, r.buf[c.pos:c.pos+c.done])
+			}
+		})
+		if err != nil {
+			e.drain(r, pending)
+			return 0, err
+		}
+	}
+	for _, c := range chunks {
+		n += c.done
+		if c.done < c.want {
+			if c.done > 0 {
+				fn(c.pos, r.buf[c.pos:c.pos+c.done])
+			}
+			break
+		}
+	}
+	return n, nil
+}
+
+// drain waits for "pending" requests to complete.
+func (e *Engine) drain(r *ring, pending int) {
+	for pending > 0 {
+		if r.enter() != nil {
+			return
+		}
+		r.reap(func(uint64, int32) { pending-- })
+	}
+}
+
+// WriteAt writes "data" at "off" to "fd" like pwrite(2). "data" is copied
+// into a registered buffer first.
+func (e *Engine) WriteAt(fd int, data []byte, off int64) (n int, err error) {
+	if len(data) > e.bufSize {
+		return 0, unix.EINVAL
+	}
+	r := <-e.rings
+	defer func() { e.rings <- r }()
+
+	copy(r.buf, data)
+	for n < len(data) {
+		r.queue(opWriteFixed, fd, off+int64(n), n, len(data)-n, 0)
+		if err = r.enter(); err != nil {
+			e.drain(r, 1)
+			return n, err
+		}
+		var res int32
+		r.reap(func(_ uint64, res2 int32) { res = res2 })
+		if res < 0 {
+			return n, syscall.Errno(-res)
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += int(res)
+	}
+	return n, nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package uring
+
+// Engine is not available on non-Linux platforms.
+type Engine struct{}
+
+// New returns ErrUnsupported on non-Linux platforms.
+func New(bufSize int, rings int) (*Engine, error) {
+	return nil, ErrUnsupported
+}
+
+// Close is a no-op on non-Linux platforms.
+func (e *Engine) Close() {}
+
+// ReadChunks is not available on non-Linux platforms.
+func (e *Engine) ReadChunks(fd int, off int64, length int, chunkSize int, fn ChunkFunc) (int, error) {
+	return 0, ErrUnsupported
+}
+
+// WriteAt is not available on non-Linux platforms.
+func (e *Engine) WriteAt(fd int, data []byte, off int64) (int, error) {
+	return 0, ErrUnsupported
+}
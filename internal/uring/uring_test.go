@@ -0,0 +1,43 @@
+package uring
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+)
+
+func TestReadWrite(t *testing.T) {
+	e, err := New(1000, 2)
+	if err != nil {
+		t.Skipf("io_uring not available: %v", err)
+	}
+	defer e.Close()
+	f, err := os.CreateTemp(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data := make([]byte, 1000)
+	rand.Read(data)
+	if n, err := e.WriteAt(int(f.Fd()), data, 0); n != len(data) || err != nil {
+		t.Fatalf("WriteAt: n=%d err=%v", n, err)
+	}
+	// Short file: the last chunk is partial, and there is nothing beyond
+	got := make([]byte, 1000)
+	n, err := e.ReadChunks(int(f.Fd()), 100, 1000, 64, func(pos int, d []byte) {
+		copy(got[pos:], d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 900 {
+		t.Errorf("want n=900, got %d", n)
+	}
+	if !bytes.Equal(got[:n], data[100:]) {
+		t.Error("content mismatch")
+	}
+	if _, err = e.ReadChunks(int(f.Fd()), 0, 1001, 64, func(int, []byte) {}); err == nil {
+		t.Error("oversized read should fail")
+	}
+}
@@ -0,0 +1,597 @@
+// Package vaultarchive implements "gocryptfs -export" and
+// "-import archive": a CIPHERDIR packed into a single file that can be
+// streamed, backed up or sent by email.
+//
+// The archive is a tar stream. Only ciphertext is stored, names stay
+// encrypted, and no key is needed to create, verify or unpack it. The
+// first entry, "GFSA", identifies the format. The CIPHERDIR follows below
+// "cipherdir/", with modes, timestamps, extended attributes and hard
+// links. The last entry, "MANIFEST", lists every entry with the SHA-256
+// of its content. A damaged or truncated archive is detected without the
+// password. The manifest does not protect against deliberate changes, as
+// anyone can compute it; gocryptfs detects those when the files are read.
+package vaultarchive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/maclabel"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// Extension is the file name extension of archives
+	Extension = ".gfsa"
+	// Version is the format version written to the "GFSA" entry
+	Version = 1
+
+	headerName   = "GFSA"
+	manifestName = "MANIFEST"
+	// dataPrefix is the directory in the archive that holds the CIPHERDIR
+	dataPrefix = "cipherdir/"
+	// xattrPrefix marks extended attributes in the PAX records
+	xattrPrefix = "SCHILY.xattr."
+	// tmpDirName is where Extract unpacks the archive before it moves the
+	// contents into place
+	tmpDirName = ".gfsa-import.tmp"
+	// maxMetaSize limits how much of the "GFSA" and "MANIFEST" entries is
+	// read
+	maxMetaSize = 1 << 30
+)
+
+// ErrDamaged is returned when the archive does not match its manifest, or
+// is not an archive at all.
+var ErrDamaged = errors.New("archive is damaged")
+
+// Entry types in the manifest
+const (
+	TypeDir     = "dir"
+	TypeFile    = "file"
+	TypeSymlink = "symlink"
+	// TypeLink is a hard link to an earlier file
+	TypeLink = "link"
+)
+
+// header is the content of the "GFSA" entry
+type header struct {
+	Version int
+	Creator string
+	Created time.Time
+}
+
+// Entry describes a file in the manifest.
+type Entry struct {
+	// Path relative to the CIPHERDIR
+	Path string
+	Type string
+	Mode uint32
+	Size int64 `json:",omitempty"`
+	// SHA256 is the hex hash of the content of files
+	SHA256 string `json:",omitempty"`
+	// XattrSHA256 is the hex hash of the extended attributes, see
+	// hashXattrs
+	XattrSHA256 string `json:",omitempty"`
+	// Target of symlinks and hard links
+	Target string `json:",omitempty"`
+}
+
+// Stats is returned by Write, Verify and Extract.
+type Stats struct {
+	Files, Dirs, Symlinks int
+	// Bytes is the size of the file contents
+	Bytes int64
+	// Skipped are special files, like sockets, that cannot be archived
+	Skipped int
+	// Creator of the archive, as read from the "GFSA" entry
+	Creator string
+}
+
+func (s *Stats) add(e *Entry) {
+	switch e.Type {
+	case TypeDir:
+		s.Dirs++
+	case TypeFile:
+		s.Files++
+		s.Bytes += e.Size
+	case TypeSymlink:
+		s.Symlinks++
+	}
+}
+
+// excluded returns true for the entries in the CIPHERDIR root that are not
+// archived: the snapshots, which are complete copies, and the long name
+// journal, which only has content while mounted.
+func excluded(rel string) bool {
+	return rel == snapshot.DirName || rel == nametransform.JournalDirName
+}
+
+// Write writes an archive of "cipherdir" to "w". "creator" is stored in
+// the archive header. "cipherdir" should not be mounted.
+func Write(w io.Writer, cipherdir string, creator string) (Stats, error) {
+	a := archiver{
+		tw:    tar.NewWriter(w),
+		root:  cipherdir,
+		links: make(map[[2]uint64]string),
+	}
+	h, _ := json.Marshal(header{Version: Version, Creator: creator, Created: time.Now().UTC()})
+	if err := a.writeMeta(headerName, h); err != nil {
+		return a.stats, err
+	}
+	if err := filepath.Walk(cipherdir, a.walkFn); err != nil {
+		return a.stats, err
+	}
+	m, err := json.MarshalIndent(a.manifest, "", "\t")
+	if err != nil {
+		return a.stats, err
+	}
+	if err = a.writeMeta(manifestName, m); err != nil {
+		return a.stats, err
+	}
+	return a.stats, a.tw.Close()
+}
+
+// archiver holds the state of Write.
+type archiver struct {
+	tw   *tar.Writer
+	root string
+	// links maps the device and inode number of files with more than one
+	// hard link to the path of the first one
+	links    map[[2]uint64]string
+	manifest []Entry
+	stats    Stats
+}
+
+func (a *archiver) writeMeta(name string, content []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0400,
+		Size:     int64(len(content)),
+		ModTime:  time.Now(),
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(content)
+	return err
+}
+
+func (a *archiver) walkFn(p string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(a.root, p)
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	rel = filepath.ToSlash(rel)
+	if info.IsDir() && excluded(rel) {
+		return filepath.SkipDir
+	}
+	var st unix.Stat_t
+	if err = unix.Lstat(p, &st); err != nil {
+		return err
+	}
+	e := Entry{Path: rel, Mode: uint32(st.Mode) & 07777}
+	hdr := &tar.Header{
+		Name:    dataPrefix + rel,
+		Mode:    int64(e.Mode),
+		Uid:     int(st.Uid),
+		Gid:     int(st.Gid),
+		ModTime: time.Unix(st.Mtim.Unix()),
+		Format:  tar.FormatPAX,
+	}
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rel, err)
+	}
+	if len(xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string)
+		for k, v := range xattrs {
+			hdr.PAXRecords[xattrPrefix+k] = v
+		}
+		e.XattrSHA256 = hashXattrs(xattrs)
+	}
+	var content *os.File
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		e.Type = TypeDir
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case syscall.S_IFLNK:
+		e.Type = TypeSymlink
+		if e.Target, err = os.Readlink(p); err != nil {
+			return err
+		}
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Target
+	case syscall.S_IFREG:
+		key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+		if first, ok := a.links[key]; ok {
+			e.Type = TypeLink
+			e.Target = first
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = dataPrefix + first
+			break
+		}
+		if st.Nlink > 1 {
+			a.links[key] = rel
+		}
+		if content, err = os.OpenFile(p, os.O_RDONLY|syscall.O_NOFOLLOW, 0); err != nil {
+			return err
+		}
+		defer content.Close()
+		e.Type = TypeFile
+		e.Size = st.Size
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = st.Size
+	default:
+		tlog.Warn.Printf("vaultarchive: skipping special file %q", rel)
+		a.stats.Skipped++
+		return nil
+	}
+	if err = a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if content != nil {
+		h := sha256.New()
+		// Fails if the file has changed size while we copy it
+		if _, err = io.CopyN(io.MultiWriter(a.tw, h), content, e.Size); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+		e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	a.manifest = append(a.manifest, e)
+	a.stats.add(&e)
+	return nil
+}
+
+// readXattrs returns the extended attributes of "p". MAC labels are left
+// out, the policy of the host that unpacks the archive assigns them.
+func readXattrs(p string) (map[string]string, error) {
+	names, err := syscallcompat.Llistxattr(p)
+	if err == syscall.EOPNOTSUPP {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(names))
+	for _, n := range names {
+		if maclabel.IsLabel(n) {
+			continue
+		}
+		v, err := syscallcompat.Lgetxattr(p, n)
+		if err != nil {
+			return nil, err
+		}
+		m[n] = string(v)
+	}
+	return m, nil
+}
+
+// hashXattrs returns the hex SHA-256 of the extended attributes "m",
+// sorted by name, each as "name\0value\0".
+func hashXattrs(m map[string]string) string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	h := sha256.New()
+	for _, n := range names {
+		h.Write([]byte(n + "\x00" + m[n] + "\x00"))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Verify reads the archive from "r" and checks it against its manifest.
+// Nothing is written to disk.
+func Verify(r io.Reader) (Stats, error) {
+	return read(r, nil)
+}
+
+// Extract unpacks the archive from "r" into "dst", which must be an empty
+// directory. The archive is unpacked into a temporary directory in "dst"
+// and only moved into place once it has been verified against its
+// manifest. If the archive does not verify, "dst" is left empty.
+func Extract(r io.Reader, dst string) (Stats, error) {
+	names, err := readDirNames(dst)
+	if err != nil {
+		return Stats{}, err
+	}
+	if len(names) > 0 {
+		return Stats{}, fmt.Errorf("%s is not empty", dst)
+	}
+	tmp := filepath.Join(dst, tmpDirName)
+	if err = os.Mkdir(tmp, 0700); err != nil {
+		return Stats{}, err
+	}
+	x := &extractor{root: tmp, dirs: map[string]bool{".": true}}
+	stats, err := read(r, x)
+	if err == nil {
+		err = x.finish(dst)
+	}
+	if err != nil {
+		if err2 := snapshot.RemoveLeftover(tmp); err2 != nil {
+			tlog.Warn.Printf("vaultarchive: cleaning up %q: %v", tmp, err2)
+		}
+		return stats, err
+	}
+	return stats, os.Remove(tmp)
+}
+
+// read reads and verifies the archive. If "x" is not nil, the entries are
+// also unpacked.
+func read(r io.Reader, x *extractor) (stats Stats, err error) {
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != headerName {
+		return stats, fmt.Errorf("%w: not a gocryptfs archive", ErrDamaged)
+	}
+	var h header
+	if err = readJSON(tr, &h); err != nil {
+		return stats, err
+	}
+	if h.Version != Version {
+		return stats, fmt.Errorf("unsupported archive version %d", h.Version)
+	}
+	stats.Creator = h.Creator
+	var have []Entry
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			return stats, fmt.Errorf("%w: the manifest is missing, the archive may be truncated", ErrDamaged)
+		} else if err != nil {
+			return stats, fmt.Errorf("%w: %v", ErrDamaged, err)
+		}
+		if hdr.Name == manifestName {
+			break
+		}
+		e, err := readEntry(tr, hdr, x)
+		if err != nil {
+			return stats, err
+		}
+		have = append(have, e)
+		stats.add(&e)
+	}
+	var want []Entry
+	if err = readJSON(tr, &want); err != nil {
+		return stats, err
+	}
+	if _, err = tr.Next(); err != io.EOF {
+		return stats, fmt.Errorf("%w: unexpected data after the manifest", ErrDamaged)
+	}
+	if len(have) != len(want) {
+		return stats, fmt.Errorf("%w: have %d entries, the manifest lists %d", ErrDamaged, len(have), len(want))
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			return stats, fmt.Errorf("%w: %q does not match the manifest", ErrDamaged, want[i].Path)
+		}
+	}
+	return stats, nil
+}
+
+// readJSON decodes the current entry of "tr" into "v".
+func readJSON(tr *tar.Reader, v interface{}) error {
+	buf, err := io.ReadAll(io.LimitReader(tr, maxMetaSize))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDamaged, err)
+	}
+	if err = json.Unmarshal(buf, v); err != nil {
+		return fmt.Errorf("%w: %v", ErrDamaged, err)
+	}
+	return nil
+}
+
+// readEntry returns the manifest entry for the data entry "hdr", and
+// unpacks it if "x" is not nil.
+func readEntry(tr *tar.Reader, hdr *tar.Header, x *extractor) (Entry, error) {
+	rel := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, dataPrefix), "/")
+	if !strings.HasPrefix(hdr.Name, dataPrefix) || !validPath(rel) {
+		return Entry{}, fmt.Errorf("%w: invalid entry %q", ErrDamaged, hdr.Name)
+	}
+	e := Entry{Path: rel, Mode: uint32(hdr.Mode) & 07777}
+	xattrs := make(map[string]string)
+	for k, v := range hdr.PAXRecords {
+		if strings.HasPrefix(k, xattrPrefix) {
+			xattrs[strings.TrimPrefix(k, xattrPrefix)] = v
+		}
+	}
+	if len(xattrs) > 0 {
+		e.XattrSHA256 = hashXattrs(xattrs)
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		e.Type = TypeDir
+	case tar.TypeSymlink:
+		e.Type = TypeSymlink
+		e.Target = hdr.Linkname
+	case tar.TypeLink:
+		e.Type = TypeLink
+		e.Target = strings.TrimPrefix(hdr.Linkname, dataPrefix)
+		if !strings.HasPrefix(hdr.Linkname, dataPrefix) || !validPath(e.Target) {
+			return e, fmt.Errorf("%w: invalid link target %q", ErrDamaged, hdr.Linkname)
+		}
+	case tar.TypeReg:
+		e.Type = TypeFile
+		e.Size = hdr.Size
+	default:
+		return e, fmt.Errorf("%w: %q has unsupported type %q", ErrDamaged, rel, hdr.Typeflag)
+	}
+	var f *os.File
+	if x != nil {
+		var err error
+		if f, err = x.create(&e, hdr); err != nil {
+			return e, fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+	if e.Type == TypeFile {
+		h := sha256.New()
+		w := io.Writer(h)
+		if f != nil {
+			w = io.MultiWriter(f, h)
+		}
+		n, err := io.Copy(w, tr)
+		if err == nil && n != e.Size {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil && f != nil {
+			err = f.Sync()
+		}
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			return e, fmt.Errorf("%w: %s: %v", ErrDamaged, rel, err)
+		}
+		e.SHA256 = hex.EncodeToString(h.Sum(nil))
+	}
+	if x != nil {
+		if err := x.setAttrs(&e, hdr, xattrs); err != nil {
+			return e, fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+	return e, nil
+}
+
+// validPath returns true for relative paths that stay below the root
+func validPath(rel string) bool {
+	return rel != "" && rel != "." && !path.IsAbs(rel) && path.Clean(rel) == rel &&
+		rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// extractor holds the state of Extract.
+type extractor struct {
+	root string
+	// dirs are the directories that have been unpacked, relative to root,
+	// and "." for the root itself. Entries are only created in these,
+	// never below a symlink.
+	dirs map[string]bool
+	// dirEntries in the order they have been created, for finish
+	dirEntries []dirEntry
+}
+
+// dirEntry is a directory whose mode and mtime are set by finish, after
+// its contents have been unpacked.
+type dirEntry struct {
+	path  string
+	mode  uint32
+	mtime time.Time
+}
+
+// create creates the file system object for "e". For files, it returns
+// the opened file, which the caller must close.
+func (x *extractor) create(e *Entry, hdr *tar.Header) (*os.File, error) {
+	if !x.dirs[path.Dir(e.Path)] {
+		return nil, fmt.Errorf("%w: parent directory is missing", ErrDamaged)
+	}
+	p := filepath.Join(x.root, e.Path)
+	switch e.Type {
+	case TypeDir:
+		// Writable until finish() sets the real mode
+		if err := os.Mkdir(p, 0700); err != nil {
+			return nil, err
+		}
+		x.dirs[e.Path] = true
+		x.dirEntries = append(x.dirEntries, dirEntry{path: p, mode: e.Mode, mtime: hdr.ModTime})
+	case TypeSymlink:
+		return nil, os.Symlink(e.Target, p)
+	case TypeLink:
+		if x.dirs[e.Target] {
+			return nil, fmt.Errorf("%w: hard link to a directory", ErrDamaged)
+		}
+		return nil, os.Link(filepath.Join(x.root, e.Target), p)
+	case TypeFile:
+		return os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	}
+	return nil, nil
+}
+
+// setAttrs sets the extended attributes, owner, mode and mtime of "e".
+// The owner is only set when running as root. Directories get their mode
+// and mtime in finish().
+func (x *extractor) setAttrs(e *Entry, hdr *tar.Header, xattrs map[string]string) error {
+	if e.Type == TypeLink {
+		return nil
+	}
+	p := filepath.Join(x.root, e.Path)
+	for k, v := range xattrs {
+		// Older archives have the labels of the host they were created on
+		if err := unix.Lsetxattr(p, k, []byte(v), 0); err != nil && !maclabel.Ignorable(k, err) {
+			return fmt.Errorf("xattr %q: %w", k, err)
+		}
+	}
+	if os.Getuid() == 0 {
+		if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if e.Type == TypeDir {
+		return nil
+	}
+	if e.Type == TypeFile {
+		if err := syscall.Chmod(p, e.Mode); err != nil {
+			return err
+		}
+	}
+	mtime := hdr.ModTime
+	return syscallcompat.UtimesNanoAtNofollow(unix.AT_FDCWD, p, &mtime, &mtime)
+}
+
+// finish sets the mode and mtime of the directories, deepest first, as a
+// parent may be made read-only, and moves the contents of the temporary
+// directory into "dst".
+func (x *extractor) finish(dst string) error {
+	for i := len(x.dirEntries) - 1; i >= 0; i-- {
+		d := x.dirEntries[i]
+		if err := syscall.Chmod(d.path, d.mode); err != nil {
+			return err
+		}
+		if err := syscallcompat.UtimesNanoAtNofollow(unix.AT_FDCWD, d.path, &d.mtime, &d.mtime); err != nil {
+			return err
+		}
+	}
+	names, err := readDirNames(x.root)
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if err = os.Rename(filepath.Join(x.root, n), filepath.Join(dst, n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the names in directory "dir".
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
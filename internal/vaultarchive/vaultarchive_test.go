@@ -0,0 +1,128 @@
+package vaultarchive
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+)
+
+// testDir creates a CIPHERDIR-like tree with a hard link, a symlink and a
+// read-only directory.
+func testDir(t *testing.T) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/file", []byte("content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(dir+"/file", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", dir+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir+"/ro/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dir+"/ro/sub/f", []byte("f"), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir+"/ro", 0500); err != nil {
+		t.Fatal(err)
+	}
+	// Snapshots are not archived
+	if err := os.MkdirAll(filepath.Join(dir, snapshot.DirName, "s"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir+"/ro", 0700) })
+	return dir
+}
+
+func TestRoundtrip(t *testing.T) {
+	src := testDir(t)
+	var buf bytes.Buffer
+	stats, err := Write(&buf, src, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 2 || stats.Dirs != 2 || stats.Symlinks != 1 {
+		t.Errorf("Write: %+v", stats)
+	}
+	if stats, err = Verify(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Creator != "test" {
+		t.Errorf("Creator=%q", stats.Creator)
+	}
+	dst := t.TempDir()
+	if _, err = Extract(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dst+"/ro", 0700)
+	content, err := os.ReadFile(dst + "/file")
+	if err != nil || string(content) != "content" {
+		t.Errorf("file: %q %v", content, err)
+	}
+	var st1, st2 syscall.Stat_t
+	syscall.Stat(dst+"/file", &st1)
+	syscall.Stat(dst+"/link", &st2)
+	if st1.Ino != st2.Ino {
+		t.Error("hard link was not preserved")
+	}
+	if target, _ := os.Readlink(dst + "/symlink"); target != "file" {
+		t.Errorf("symlink: %q", target)
+	}
+	if fi, err := os.Stat(dst + "/ro"); err != nil || fi.Mode().Perm() != 0500 {
+		t.Errorf("ro: %v %v", fi, err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, snapshot.DirName)); !os.IsNotExist(err) {
+		t.Errorf("snapshots have been archived: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dst, tmpDirName)); !os.IsNotExist(err) {
+		t.Errorf("temporary directory is left: %v", err)
+	}
+	// The target must be empty
+	if _, err = Extract(bytes.NewReader(buf.Bytes()), dst); err == nil {
+		t.Error("Extract into a non-empty directory succeeded")
+	}
+}
+
+func TestDamaged(t *testing.T) {
+	src := testDir(t)
+	var buf bytes.Buffer
+	if _, err := Write(&buf, src, "test"); err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+	// Flip a byte of the file content, which is stored in one piece
+	corrupt := bytes.Replace(archive, []byte("content"), []byte("cOntent"), 1)
+	truncated := archive[:len(archive)/2]
+	for name, a := range map[string][]byte{"corrupt": corrupt, "truncated": truncated, "empty": nil} {
+		if _, err := Verify(bytes.NewReader(a)); !errors.Is(err, ErrDamaged) {
+			t.Errorf("%s: Verify returned %v", name, err)
+		}
+		dst := t.TempDir()
+		if _, err := Extract(bytes.NewReader(a), dst); !errors.Is(err, ErrDamaged) {
+			t.Errorf("%s: Extract returned %v", name, err)
+		}
+		if names, _ := readDirNames(dst); len(names) != 0 {
+			t.Errorf("%s: Extract left %v", name, names)
+		}
+	}
+}
+
+func TestValidPath(t *testing.T) {
+	for _, p := range []string{"", ".", "..", "../x", "/etc", "a/../../b", "a//b"} {
+		if validPath(p) {
+			t.Errorf("%q is valid", p)
+		}
+	}
+	for _, p := range []string{"a", "a/b", "..a"} {
+		if !validPath(p) {
+			t.Errorf("%q is invalid", p)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+// Package webdavsrv serves a gocryptfs filesystem over WebDAV instead of
+// mounting it through the kernel. The file system operations are provided
+// by package rawfs.
+package webdavsrv
+
+import (
+	"context"
+	"os"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+)
+
+// FS implements webdav.FileSystem.
+type FS struct {
+	*rawfs.FS
+}
+
+var _ webdav.FileSystem = &FS{} // Verify that interface is implemented.
+
+// New returns an FS for "raw", which must have been created by
+// fs.NewNodeFS. All operations are performed with our own uid and gid.
+func New(raw fuse.RawFileSystem, readOnly bool) *FS {
+	return &FS{rawfs.New(raw, readOnly)}
+}
+
+// OpenFile implements webdav.FileSystem.
+func (f *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	file, err := f.FS.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		// Don't return a typed nil
+		return nil, err
+	}
+	return file, nil
+}
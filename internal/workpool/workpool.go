@@ -0,0 +1,86 @@
+// Package workpool runs expensive operations on a bounded number of worker
+// goroutines, so that they do not all hit the backing storage at once. This
+// avoids thundering herds of reads and fsyncs on spinning disks.
+package workpool
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Ops are the operation classes that can be limited with "-op-workers".
+var Ops = []string{"read", "fsync", "listxattr"}
+
+// Pool runs functions on a fixed number of worker goroutines.
+// A nil *Pool runs them directly in the caller's goroutine.
+type Pool struct {
+	jobs chan func()
+}
+
+// New starts a Pool with "workers" goroutines.
+func New(workers int) *Pool {
+	p := &Pool{
+		jobs: make(chan func()),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *Pool) worker() {
+	for fn := range p.jobs {
+		fn()
+	}
+}
+
+// Do runs "fn" on a worker and waits for it to finish. If "ctx" is canceled
+// while all workers are busy, Do returns ctx.Err() without running "fn".
+func (p *Pool) Do(ctx context.Context, fn func()) error {
+	if p == nil {
+		fn()
+		return nil
+	}
+	done := make(chan struct{})
+	job := func() {
+		fn()
+		close(done)
+	}
+	select {
+	case p.jobs <- job:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	<-done
+	return nil
+}
+
+// ParseLimits parses the "-op-workers" value, like "read=4,fsync=1", into
+// a map from operation class to the number of workers.
+func ParseLimits(s string) (map[string]int, error) {
+	limits := make(map[string]int)
+	if s == "" {
+		return limits, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		op, val, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want OP=N", kv)
+		}
+		known := false
+		for _, o := range Ops {
+			known = known || o == op
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown operation %q, must be one of %s", op, strings.Join(Ops, ", "))
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q: N must be a positive number", kv)
+		}
+		limits[op] = n
+	}
+	return limits, nil
+}
@@ -0,0 +1,71 @@
+package workpool
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPoolLimit(t *testing.T) {
+	p := New(2)
+	var running, max int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.Do(context.Background(), func() {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					m := atomic.LoadInt32(&max)
+					if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+						break
+					}
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+			})
+		}()
+	}
+	wg.Wait()
+	if max != 2 {
+		t.Errorf("want 2 concurrent jobs, got %d", max)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	p := New(1)
+	block := make(chan struct{})
+	go p.Do(context.Background(), func() { <-block })
+	defer close(block)
+	time.Sleep(10 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	if err := p.Do(ctx, func() { ran = true }); err == nil || ran {
+		t.Errorf("err=%v ran=%v", err, ran)
+	}
+}
+
+func TestNilPool(t *testing.T) {
+	var p *Pool
+	ran := false
+	p.Do(context.Background(), func() { ran = true })
+	if !ran {
+		t.Error("nil pool did not run fn")
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	l, err := ParseLimits("read=4,fsync=1")
+	if err != nil || l["read"] != 4 || l["fsync"] != 1 || len(l) != 2 {
+		t.Errorf("l=%v err=%v", l, err)
+	}
+	for _, s := range []string{"read", "read=0", "write=1", "read=x"} {
+		if _, err := ParseLimits(s); err == nil {
+			t.Errorf("%q should fail", s)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -276,27 +277,32 @@ func (wbm *WriteBufferManager) Close() error {
 	return lastErr
 }
 
-// GetStats returns statistics about the write buffer manager
-func (wbm *WriteBufferManager) GetStats() map[string]interface{} {
+// RegisterStats registers the statistics of the write buffer manager in "r".
+func (wbm *WriteBufferManager) RegisterStats(r *stats.Registry) {
+	r.Func("writecoalescing_buffers", stats.KindGauge, "Number of write buffers",
+		func() int64 {
+			count, _ := wbm.bufferUsage()
+			return int64(count)
+		})
+	r.Func("writecoalescing_buffered_bytes", stats.KindGauge, "Bytes waiting in write buffers",
+		func() int64 {
+			_, size := wbm.bufferUsage()
+			return int64(size)
+		})
+}
+
+// bufferUsage returns the number of buffers and the bytes in them
+func (wbm *WriteBufferManager) bufferUsage() (count int, size int) {
 	wbm.Mutex.RLock()
 	defer wbm.Mutex.RUnlock()
-
-	stats := make(map[string]interface{})
-	stats["buffer_count"] = len(wbm.Buffers)
-	stats["config"] = wbm.Config
-
-	totalBufferSize := 0
 	for _, buffer := range wbm.Buffers {
-		totalBufferSize += buffer.GetBufferSize()
+		size += buffer.GetBufferSize()
 	}
-	stats["total_buffer_size"] = totalBufferSize
-
-	return stats
+	return len(wbm.Buffers), size
 }
 
 // LogStats logs statistics about the write buffer manager
 func (wbm *WriteBufferManager) LogStats() {
-	stats := wbm.GetStats()
-	tlog.Debug.Printf("WriteBufferManager: buffer_count=%v, total_buffer_size=%v",
-		stats["buffer_count"], stats["total_buffer_size"])
+	count, size := wbm.bufferUsage()
+	tlog.Debug.Printf("WriteBufferManager: buffer_count=%v, total_buffer_size=%v", count, size)
 }
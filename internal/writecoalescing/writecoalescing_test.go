@@ -4,6 +4,8 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
 )
 
 func TestWriteBuffer(t *testing.T) {
@@ -219,9 +221,10 @@ func TestWriteBufferManager(t *testing.T) {
 	mu.Unlock()
 
 	// Test stats
-	stats := wbm.GetStats()
-	if stats["buffer_count"].(int) != 2 {
-		t.Errorf("Expected 2 buffers, got %d", stats["buffer_count"])
+	r := stats.New()
+	wbm.RegisterStats(r)
+	if n := r.Map()["writecoalescing_buffers"]; n != 2 {
+		t.Errorf("Expected 2 buffers, got %d", n)
 	}
 
 	// Close manager
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// joinChunks implements "-join-chunks". It restores a copy of a
+// "-reverse -chunk-size" view to a regular CIPHERDIR by appending the
+// "CNAME.chunk.N" files to CNAME. No password is needed as everything stays
+// encrypted.
+// Does not return (calls os.Exit both on success and on error).
+func joinChunks(args *argContainer) {
+	nErrors := 0
+	joined := 0
+	err := filepath.Walk(args.cipherdir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// A chunk that we have joined and deleted already
+			return nil
+		} else if err != nil {
+			tlog.Warn.Printf("%s: %v", path, err)
+			nErrors++
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		base, k, ok := fusefrontend_reverse.ParseChunkName(info.Name())
+		if !ok || k != 1 {
+			return nil
+		}
+		n, err := joinFileChunks(filepath.Join(filepath.Dir(path), base))
+		if err != nil {
+			tlog.Warn.Printf("%s: %v", path, err)
+			nErrors++
+			return nil
+		}
+		joined++
+		tlog.Debug.Printf("%s: joined %d chunks", base, n)
+		return nil
+	})
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Other)
+	}
+	// Chunks whose predecessors are missing have not been touched
+	err = filepath.Walk(args.cipherdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, _, ok := fusefrontend_reverse.ParseChunkName(info.Name()); ok {
+			tlog.Warn.Printf("%s: left over, was not joined", path)
+			nErrors++
+		}
+		return nil
+	})
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf("joined %d files, %d errors", joined, nErrors)
+	if nErrors > 0 {
+		os.Exit(exitcodes.Other)
+	}
+	os.Exit(0)
+}
+
+// joinFileChunks appends "base.chunk.1", "base.chunk.2", ... to "base" until
+// a chunk is missing, and deletes the chunks once "base" has been synced.
+// Returns the number of chunks joined. On error, "base" is truncated back to
+// its original size so the operation can be retried.
+func joinFileChunks(base string) (n int, err error) {
+	f, err := os.OpenFile(base, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Truncate(st.Size())
+		}
+	}()
+	var chunks []string
+	for k := uint64(1); ; k++ {
+		p := fusefrontend_reverse.ChunkName(base, k)
+		var c *os.File
+		c, err = os.Open(p)
+		if os.IsNotExist(err) {
+			err = nil
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		_, err = io.Copy(f, c)
+		c.Close()
+		if err != nil {
+			return 0, err
+		}
+		chunks = append(chunks, p)
+	}
+	// Make sure the data is on disk before we delete the chunks
+	if err = f.Sync(); err != nil {
+		return 0, err
+	}
+	// From here on, the chunks are in "base" and must not be appended again
+	for _, p := range chunks {
+		if err2 := syscall.Unlink(p); err2 != nil {
+			tlog.Warn.Printf("%s: %v", p, err2)
+		}
+	}
+	return len(chunks), nil
+}
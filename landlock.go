@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/processhardening"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// unmountHelperScript is run by /bin/sh before the Landlock sandbox or the
+// seccomp filter is installed. A sandboxed process cannot unmount
+// filesystems or run fusermount, so we ask this unsandboxed helper to do it
+// for us. "$1" is the mountpoint.
+// The helper exits when our end of the pipe is closed.
+const unmountHelperScript = `
+while read cmd; do
+	case "$cmd" in
+		u) fusermount -u "$1" 2>/dev/null || umount "$1" ;;
+		z) fusermount -u -z "$1" 2>/dev/null || umount -l "$1" ;;
+	esac
+	echo $?
+done
+`
+
+// unmountHelper talks to the helper process started by startUnmountHelper.
+type unmountHelper struct {
+	sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+// mountHelper is non-nil when the Landlock sandbox or the seccomp filter is
+// active, or we have dropped root privileges
+var mountHelper *unmountHelper
+
+func startUnmountHelper(mountpoint string) (*unmountHelper, error) {
+	cmd := exec.Command("/bin/sh", "-c", unmountHelperScript, "sh", mountpoint)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &unmountHelper{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: bufio.NewReader(stdout),
+	}, nil
+}
+
+// Unmount asks the helper to unmount the filesystem. If lazy is set, a
+// lazy unmount ("umount -l") is performed.
+func (h *unmountHelper) Unmount(lazy bool) error {
+	h.Lock()
+	defer h.Unlock()
+	cmd := "u\n"
+	if lazy {
+		cmd = "z\n"
+	}
+	if _, err := io.WriteString(h.stdin, cmd); err != nil {
+		return err
+	}
+	line, err := h.stdout.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if status := strings.TrimSpace(line); status != "0" {
+		return fmt.Errorf("unmount helper: exit status %s", status)
+	}
+	return nil
+}
+
+// Close terminates the helper.
+func (h *unmountHelper) Close() {
+	h.stdin.Close()
+	h.cmd.Wait()
+}
+
+// srvUnmount calls srv.Unmount(). If that fails and the unmount helper is
+// running, the helper is asked to unmount instead.
+func srvUnmount(srv *fuse.Server, lazy bool) error {
+	err := srv.Unmount()
+	if err == nil || mountHelper == nil {
+		return err
+	}
+	tlog.Debug.Printf("srvUnmount: srv.Unmount returned %v, trying unmount helper", err)
+	return mountHelper.Unmount(lazy)
+}
+
+// installSeccomp installs the seccomp filter. The filter does not allow
+// execve(2), so the unmount helper is started first if Landlock or
+// dropPrivileges have not done so already: "fusermount -u" runs there.
+func installSeccomp(args *argContainer) error {
+	if runtime.GOOS != "linux" {
+		return nil
+	}
+	if mountHelper == nil {
+		helper, err := startUnmountHelper(args.mountpoint)
+		if err != nil {
+			return fmt.Errorf("could not start unmount helper: %v", err)
+		}
+		mountHelper = helper
+	}
+	return processhardening.New().InstallSeccomp(args.seccomp_strict)
+}
+
+// setupLandlock confines the process to CIPHERDIR, the mountpoint, the
+// control socket and the config file. On OpenBSD, unveil(2) is used.
+// Errors are not fatal, we continue without the sandbox.
+func setupLandlock(args *argContainer) {
+	rules := processhardening.LandlockRules{}
+	if args.reverse {
+		// Reverse mode only writes to the plaintext directory with -reverse-rw
+		if args.reverse_rw {
+			rules.ReadWrite = append(rules.ReadWrite, args.cipherdir)
+		} else {
+			rules.ReadOnly = append(rules.ReadOnly, args.cipherdir)
+		}
+		// The -exclude-from files are re-read on SIGHUP. Editors often
+		// replace the file, so allow the directory it is in.
+		for _, f := range args.excludeFrom {
+			rules.ReadOnly = append(rules.ReadOnly, filepath.Dir(f))
+		}
+	} else {
+		rules.ReadWrite = append(rules.ReadWrite, args.cipherdir)
+	}
+	if !strings.HasPrefix(args.mountpoint, "/dev/fd/") {
+		rules.ReadOnly = append(rules.ReadOnly, args.mountpoint)
+	}
+	// The config file does not exist with -zerokey and -masterkey
+	if _, err := os.Stat(args.config); err == nil {
+		rules.ReadOnly = append(rules.ReadOnly, args.config)
+	}
+	// Abstract and systemd sockets have no socket file that we delete
+	if args.ctlsock != "" && !ctlsocksrv.IsAbstract(args.ctlsock) && !ctlsocksrv.IsSystemd(args.ctlsock) {
+		rules.ReadOnly = append(rules.ReadOnly, args.ctlsock)
+		rules.RemoveFile = append(rules.RemoveFile, filepath.Dir(args.ctlsock))
+	}
+	// -logfile is rotated by renaming it and creating a new one
+	if args.logfile != "" {
+		rules.ReadWrite = append(rules.ReadWrite, filepath.Dir(args.logfile))
+	}
+	// Crash reports are new files in -crash-dir
+	rules.ReadWrite = append(rules.ReadWrite, args.crash_dir)
+	helper, err := startUnmountHelper(args.mountpoint)
+	if err != nil {
+		tlog.Warn.Printf("Landlock: could not start unmount helper, not enabling sandbox: %v", err)
+		return
+	}
+	ph := processhardening.New()
+	if runtime.GOOS == "openbsd" {
+		// OpenBSD has unveil(2) instead of Landlock
+		err = ph.InstallUnveil(rules)
+	} else {
+		err = ph.InstallLandlock(rules)
+	}
+	if errors.Is(err, processhardening.ErrLandlockUnsupported) {
+		tlog.Debug.Printf("Landlock: %v", err)
+		helper.Close()
+		return
+	} else if err != nil {
+		tlog.Warn.Printf("Could not enable Landlock sandbox: %v", err)
+		helper.Close()
+		return
+	}
+	mountHelper = helper
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// "-log-target" values
+const (
+	// logTargetAuto logs to the console, and to syslog after forking into
+	// the background (unless "-nosyslog")
+	logTargetAuto     = "auto"
+	logTargetConsole  = "console"
+	logTargetSyslog   = "syslog"
+	logTargetJournald = "journald"
+)
+
+// checkLogArgs validates the logging options
+func checkLogArgs(args *argContainer) error {
+	if _, err := tlog.ParseFormat(args.log_format); err != nil {
+		return fmt.Errorf("-log-format: %v", err)
+	}
+	switch args.log_target {
+	case logTargetAuto, logTargetConsole, logTargetSyslog, logTargetJournald:
+	default:
+		return fmt.Errorf("-log-target: unknown target %q, must be \"auto\", \"console\", \"syslog\" or \"journald\"", args.log_target)
+	}
+	if args.logfile != "" && args.log_target != logTargetAuto {
+		return fmt.Errorf("-logfile cannot be combined with -log-target")
+	}
+	if args.logfile_max_size < 0 {
+		return fmt.Errorf("-logfile-max-size cannot be negative")
+	}
+	if args.log_level != "" {
+		if _, err := tlog.ParseLevels(args.log_level); err != nil {
+			return fmt.Errorf("-log-level: %v", err)
+		}
+	}
+	return nil
+}
+
+// logfileKeep is the number of rotated -logfile files that are kept
+const logfileKeep = 3
+
+// setupLogging applies "-log-format", "-log-level", "-logfile" and
+// "-log-target". The checks have been done by checkLogArgs.
+// Calls os.Exit if the log file or journald cannot be opened.
+func setupLogging(args *argContainer) {
+	f, _ := tlog.ParseFormat(args.log_format)
+	tlog.SetFormat(f)
+	if args.log_level != "" {
+		levels, _ := tlog.ParseLevels(args.log_level)
+		tlog.SetLevels(levels)
+	}
+	if args.logfile != "" {
+		// Rotation renames the file, and we cd to / when daemonizing
+		args.logfile, _ = filepath.Abs(args.logfile)
+		w, err := tlog.OpenRotatingFile(args.logfile, int64(args.logfile_max_size)<<20, logfileKeep)
+		if err != nil {
+			tlog.Fatal.Printf("-logfile: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		tlog.SetOutput(w)
+	}
+	switch args.log_target {
+	case logTargetSyslog:
+		switchToSyslog()
+	case logTargetJournald:
+		if err := tlog.SwitchToJournald(); err != nil {
+			tlog.Fatal.Printf("-log-target journald: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+	}
+}
+
+// logsToConsole returns true if the log messages go to stdout and stderr,
+// so they have to go to syslog after forking into the background
+func logsToConsole(args *argContainer) bool {
+	return args.logfile == "" && (args.log_target == logTargetAuto || args.log_target == logTargetConsole)
+}
+
+// switchToSyslog switches all of our logs and the generic logger to syslog
+func switchToSyslog() {
+	tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
+	tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
+	tlog.Warn.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+	tlog.Fatal.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_CRIT)
+	tlog.SwitchLoggerToSyslog()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/maclabel"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// contextMountpoint is the "-context" value that labels the mount like the
+// mountpoint
+const contextMountpoint = "mountpoint"
+
+// mountContext returns the value of the "context" mount option, or "" for
+// none. "-context mountpoint" uses the SELinux label of the mountpoint, so
+// that the files in the mount are labeled like the directory they cover,
+// for example user_home_t in a home directory. Without SELinux, the kernel
+// would reject the mount, so "-context" is dropped with a warning.
+func mountContext(args *argContainer) string {
+	if args.context == "" {
+		return ""
+	}
+	if !maclabel.SELinuxEnabled() {
+		tlog.Warn.Printf("-context: SELinux is not enabled, mounting without a context")
+		return ""
+	}
+	ctx := args.context
+	if ctx == contextMountpoint {
+		var err error
+		ctx, err = maclabel.Get(args.mountpoint)
+		if err != nil {
+			tlog.Warn.Printf("-context: cannot read the label of %q: %v. Mounting without a context.", args.mountpoint, err)
+			return ""
+		} else if ctx == "" {
+			tlog.Warn.Printf("-context: %q has no label, mounting without a context", args.mountpoint)
+			return ""
+		}
+		tlog.Debug.Printf("-context: using the label %q of the mountpoint", ctx)
+	}
+	// MCS category ranges like "s0:c0,c1023" contain a comma, which would
+	// end the mount option
+	if strings.Contains(ctx, ",") && !strings.HasPrefix(ctx, `"`) {
+		ctx = `"` + ctx + `"`
+	}
+	return ctx
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
 	"github.com/rfjakob/gocryptfs/v2/internal/processhardening"
 	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
 	"github.com/rfjakob/gocryptfs/v2/internal/speed"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -32,25 +33,32 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Printf("Cannot open config file: %v", err)
 		return nil, nil, err
 	}
+	if args.upstream_compat {
+		if err = cf.UpstreamCompatible(); err != nil {
+			return nil, nil, fatalErr(exitcodes.Upstream, "-upstream-compat: %v", err)
+		}
+	}
 	// The user may have passed the master key on the command line (probably because
 	// he forgot the password).
 	masterkey = handleArgsMasterkey(args)
 	if masterkey != nil {
-		return masterkey, cf, nil
-	}
-	var pw []byte
-	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
-		if args.fido2 == "" {
-			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
-			return nil, nil, exitcodes.NewErr("", exitcodes.Usage)
+		if err = cf.VerifyFeatureFlags(masterkey); err != nil {
+			tlog.Fatal.Println(err)
+			return nil, nil, err
 		}
-		pw = fido2.Secret(args.fido2, cf.FIDO2.AssertOptions, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
-	} else {
-		pw, err = readpassword.Once([]string(args.extpass), []string(args.passfile), "")
-		if err != nil {
+		if err = cf.VerifyKeyFingerprint(masterkey); err != nil {
 			tlog.Fatal.Println(err)
-			return nil, nil, exitcodes.NewErr("", exitcodes.ReadPassword)
+			return nil, nil, err
 		}
+		return masterkey, cf, nil
+	}
+	if err = cf.ThrottleCheck(); err != nil {
+		tlog.Fatal.Println(err)
+		return nil, nil, err
+	}
+	pw, err := readConfigPassword(args, cf)
+	if err != nil {
+		return nil, nil, err
 	}
 	tlog.Info.Println("Decrypting master key")
 	masterkey, err = cf.DecryptMasterKey(pw)
@@ -62,9 +70,49 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Println(err)
 		return nil, nil, err
 	}
+	if cf.NeedsRepair() {
+		repairConfig(args.config, cf)
+	}
 	return masterkey, cf, nil
 }
 
+// readConfigPassword gets the password that unlocks "cf" from the FIDO2
+// token, or via readpassword.Once.
+func readConfigPassword(args *argContainer, cf *configfile.ConfFile) ([]byte, error) {
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		if args.fido2 == "" {
+			return nil, fatalErr(exitcodes.Usage, "Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
+		}
+		return fido2.Secret(args.fido2, cf.FIDO2.AssertOptions, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt), nil
+	}
+	if args._password != nil {
+		// Sent by a "-daemon" client. loadConfig wipes it.
+		return args._password, nil
+	}
+	pw, err := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	if err != nil {
+		tlog.Fatal.Println(err)
+		return nil, exitcodes.NewErr(err.Error(), exitcodes.ReadPassword)
+	}
+	return pw, nil
+}
+
+// repairConfig offers to overwrite the damaged config file "filename" with
+// the backup copy that has been used instead.
+func repairConfig(filename string, cf *configfile.ConfFile) {
+	tlog.Warn.Printf("The config file %s is missing, damaged or has been modified. The backup copy %s has been used instead.",
+		filename, cf.LoadedFrom())
+	if !readpassword.Confirm("Restore the config file from the backup copy?") {
+		tlog.Warn.Printf("Not restoring. Unlock the filesystem from a terminal to be asked again.")
+		return
+	}
+	if err := cf.WriteFile(); err != nil {
+		tlog.Warn.Printf("Restoring the config file failed: %v", err)
+		return
+	}
+	tlog.Info.Printf(tlog.ColorGreen + "Config file restored." + tlog.ColorReset)
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer) {
@@ -105,9 +153,11 @@ func changePassword(args *argContainer) {
 	// Are we resetting the password without knowing the old one using
 	// "-masterkey"?
 	if args.masterkey != "" {
-		bak := args.config + ".bak"
-		err := os.Link(args.config, bak)
-		if err != nil {
+		bak := args.config + configfile.BackupSuffix
+		if confFile.IsFeatureFlagSet(configfile.FlagConfigHMAC) {
+			// WriteFile updates the backup copies, except for this one
+			confFile.KeepBackup()
+		} else if err := os.Link(args.config, bak); err != nil {
 			tlog.Fatal.Printf("Could not create backup file: %v", err)
 			os.Exit(exitcodes.Init)
 		}
@@ -124,6 +174,59 @@ func changePassword(args *argContainer) {
 	tlog.Info.Printf(tlog.ColorGreen + "Password changed." + tlog.ColorReset)
 }
 
+// completeArgs fills in the settings that depend on other options and on
+// args.cipherdir: "-reverse" implies "-aessiv", the default "-config" path
+// and the parsed "-force_owner".
+func completeArgs(args *argContainer) error {
+	var err error
+	// "-reverse" implies "-aessiv"
+	if args.reverse {
+		args.aessiv = true
+		// The files are re-read on SIGHUP, when we may have changed our
+		// working directory
+		for i, f := range args.excludeFrom {
+			args.excludeFrom[i], _ = filepath.Abs(f)
+		}
+	} else {
+		if args.exclude != nil {
+			return fatalErr(exitcodes.ExcludeError, "-exclude only works in reverse mode")
+		}
+	}
+	// "-crash-dir" is used after we have changed our working directory
+	args.crash_dir, _ = filepath.Abs(args.crash_dir)
+	// "-config"
+	if args.config != "" {
+		args.config, err = filepath.Abs(args.config)
+		if err != nil {
+			return fatalErr(exitcodes.Init, "Invalid \"-config\" setting: %v", err)
+		}
+		tlog.Info.Printf("Using config file at custom location %s", args.config)
+		args._configCustom = true
+	} else if args.reverse {
+		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
+	} else {
+		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+	}
+	// "-force_owner"
+	if args.force_owner != "" {
+		var uidNum, gidNum int64
+		ownerPieces := strings.SplitN(args.force_owner, ":", 2)
+		if len(ownerPieces) != 2 {
+			return fatalErr(exitcodes.Usage, "force_owner must be in form UID:GID")
+		}
+		uidNum, err = strconv.ParseInt(ownerPieces[0], 0, 32)
+		if err != nil || uidNum < 0 {
+			return fatalErr(exitcodes.Usage, "force_owner: Unable to parse UID %v as positive integer", ownerPieces[0])
+		}
+		gidNum, err = strconv.ParseInt(ownerPieces[1], 0, 32)
+		if err != nil || gidNum < 0 {
+			return fatalErr(exitcodes.Usage, "force_owner: Unable to parse GID %v as positive integer", ownerPieces[1])
+		}
+		args._forceOwner = &fuse.Owner{Uid: uint32(uidNum), Gid: uint32(gidNum)}
+	}
+	return nil
+}
+
 func main() {
 	// Clean up memory protection on exit
 	defer configfile.CleanupMemoryProtection()
@@ -151,14 +254,19 @@ func main() {
 	args := parseCliOpts(os.Args)
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	if !args.fg && flagSet.NArg() == 2 && args.import_type == "" && !args.check_names {
 		ret := forkChild()
 		os.Exit(ret)
 	}
 	if args.debug {
 		tlog.Debug.Enabled = true
 	}
+	setupLogging(&args)
 	tlog.Debug.Printf("cli args: %q", os.Args)
+	// "-keyholder" (internal, started by "-privsep")
+	if args.keyholder {
+		runKeyholder(&args)
+	}
 	// "-v"
 	if args.version {
 		tlog.Debug.Printf("openssl=%v\n", args.openssl)
@@ -172,21 +280,39 @@ func main() {
 		os.Exit(0)
 	}
 	// "-speed"
-	if args.speed {
-		printVersion()
-		speed.Run()
-		os.Exit(0)
-	}
-	// "-speed-enhanced"
-	if args.speed_enhanced {
-		printVersion()
-		speed.RunEnhanced()
+	if args.speed || args.speed_enhanced {
+		opts := speed.Options{
+			Format:  args.format,
+			Run:     args._run,
+			Version: versionString(),
+		}
+		if opts.Format == speed.FormatText {
+			printVersion()
+		}
+		if args.speed_enhanced {
+			// "-speed-enhanced"
+			speed.RunEnhanced(opts)
+		} else {
+			speed.Run(opts)
+		}
 		os.Exit(0)
 	}
 	if args.wpanic {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
 	}
+	// "-daemon" takes the PROFILES file instead of CIPHERDIR
+	if args.daemon {
+		runDaemon(&args)
+	}
+	// "-verify-archive" takes the archive instead of CIPHERDIR
+	if args.verify_archive {
+		verifyArchive(&args)
+	}
+	// "-selftest-vectors" takes the vector file instead of CIPHERDIR
+	if args.selftest_vectors != "" {
+		selftestVectors(&args)
+	}
 	// Every operation below requires CIPHERDIR. Exit if we don't have it.
 	if flagSet.NArg() == 0 {
 		if flagSet.NFlag() == 0 {
@@ -199,59 +325,55 @@ func main() {
 		}
 		os.Exit(exitcodes.Usage)
 	}
+	// "-import TYPE SRC CIPHERDIR" has the source volume in front
+	cipherdirArg := flagSet.Arg(0)
+	if args.import_type != "" && flagSet.NArg() == 2 {
+		args._importSrc, _ = filepath.Abs(flagSet.Arg(0))
+		cipherdirArg = flagSet.Arg(1)
+	}
 	// Check that CIPHERDIR exists
-	args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
+	args.cipherdir, _ = filepath.Abs(cipherdirArg)
 	err = isDir(args.cipherdir)
 	if err != nil {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
 		os.Exit(exitcodes.CipherDir)
 	}
+	// "-from-snapshot"
+	if args.from_snapshot != "" {
+		if err = snapshot.CheckName(args.from_snapshot); err != nil {
+			tlog.Fatal.Printf("-from-snapshot: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		args.cipherdir = snapshot.Path(args.cipherdir, args.from_snapshot)
+		if err = isDir(args.cipherdir); err != nil {
+			tlog.Fatal.Printf("-from-snapshot: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		args.ro = true
+	}
 	// "-q"
 	if args.quiet {
 		tlog.Info.Enabled = false
 	}
-	// "-reverse" implies "-aessiv"
-	if args.reverse {
-		args.aessiv = true
-	} else {
-		if args.exclude != nil {
-			tlog.Fatal.Printf("-exclude only works in reverse mode")
-			os.Exit(exitcodes.ExcludeError)
-		}
+	// "-wizard" may switch on "-reverse", so it has to run before the
+	// "-reverse" and "-config" handling
+	if args.wizard {
+		initWizard(&args)
 	}
-	// "-config"
-	if args.config != "" {
-		args.config, err = filepath.Abs(args.config)
-		if err != nil {
-			tlog.Fatal.Printf("Invalid \"-config\" setting: %v", err)
-			os.Exit(exitcodes.Init)
-		}
-		tlog.Info.Printf("Using config file at custom location %s", args.config)
-		args._configCustom = true
-	} else if args.reverse {
-		args.config = filepath.Join(args.cipherdir, configfile.ConfReverseName)
-	} else {
-		args.config = filepath.Join(args.cipherdir, configfile.ConfDefaultName)
+	if err = completeArgs(&args); err != nil {
+		exitcodes.Exit(err)
 	}
-	// "-force_owner"
-	if args.force_owner != "" {
-		var uidNum, gidNum int64
-		ownerPieces := strings.SplitN(args.force_owner, ":", 2)
-		if len(ownerPieces) != 2 {
-			tlog.Fatal.Printf("force_owner must be in form UID:GID")
+	// "-run-as"
+	if args.run_as != "" {
+		if os.Getuid() != 0 {
+			tlog.Fatal.Printf("-run-as only works when gocryptfs is started as root")
 			os.Exit(exitcodes.Usage)
 		}
-		uidNum, err = strconv.ParseInt(ownerPieces[0], 0, 32)
-		if err != nil || uidNum < 0 {
-			tlog.Fatal.Printf("force_owner: Unable to parse UID %v as positive integer", ownerPieces[0])
-			os.Exit(exitcodes.Usage)
-		}
-		gidNum, err = strconv.ParseInt(ownerPieces[1], 0, 32)
-		if err != nil || gidNum < 0 {
-			tlog.Fatal.Printf("force_owner: Unable to parse GID %v as positive integer", ownerPieces[1])
+		args._runAs, err = lookupRunAs(args.run_as)
+		if err != nil {
+			tlog.Fatal.Printf("-run-as: %v", err)
 			os.Exit(exitcodes.Usage)
 		}
-		args._forceOwner = &fuse.Owner{Uid: uint32(uidNum), Gid: uint32(gidNum)}
 	}
 	// "-cpuprofile"
 	if args.cpuprofile != "" {
@@ -287,17 +409,36 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -migrate-filenameauth, -upgrade-config, -check-names, -check-normalization, -doctor, -import, -export-fscrypt, -join-chunks, -dedup, -gc, -export, -export-checksums, -verify-checksums, -snapshot, -prune-snapshots, -shred, -share, -serve-webdav, -serve-9p is allowed")
 		os.Exit(exitcodes.Usage)
 	}
+	// "-import" takes two arguments
+	if args.import_type != "" {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -import encfs|cryfs|fscrypt|archive [OPTIONS] SRC CIPHERDIR", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.import_type == importArchive {
+			importVaultArchive(&args)
+		}
+		importFS(&args)
+	}
+	// "-check-names" takes an optional second argument
+	if args.check_names {
+		if flagSet.NArg() > 2 {
+			tlog.Fatal.Printf("Usage: %s -check-names [OPTIONS] CIPHERDIR [TREE]", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		checkNames(&args, flagSet.Arg(1))
+	}
 	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -duress-passwd, -duress-remove, -throttle, -fsck, -migrate-filenameauth, -upgrade-config, -check-normalization, -doctor, -export-fscrypt, -join-chunks, -dedup, -gc, -export, -export-checksums, -verify-checksums, -snapshot, -prune-snapshots, -shred, -share, -serve-webdav, -serve-9p take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
 	if args.info {
-		info(args.config)
+		info(&args)
 		os.Exit(0)
 	}
 	// "-init"
@@ -310,9 +451,87 @@ func main() {
 		changePassword(&args)
 		os.Exit(0)
 	}
+	// "-duress-passwd" and "-duress-remove"
+	if args.duress_passwd || args.duress_remove {
+		changeDuress(&args)
+		os.Exit(0)
+	}
+	// "-throttle"
+	if args.throttle != "" {
+		changeThrottle(&args)
+		os.Exit(0)
+	}
 	// "-fsck"
 	if args.fsck {
 		code := fsck(&args)
 		os.Exit(code)
 	}
+	// "-migrate-filenameauth"
+	if args.migrate_filenameauth {
+		migrateFilenameAuth(&args)
+	}
+	// "-upgrade-config"
+	if args.upgrade_config {
+		upgradeConfig(&args)
+	}
+	// "-check-normalization"
+	if args.check_normalization {
+		checkNormalization(&args)
+	}
+	// "-doctor"
+	if args.doctor {
+		runDoctor(&args)
+	}
+	// "-export-fscrypt"
+	if args.export_fscrypt != "" {
+		exportFscrypt(&args)
+	}
+	// "-join-chunks"
+	if args.join_chunks {
+		joinChunks(&args)
+	}
+	// "-dedup"
+	if args.dedup {
+		runDedup(&args)
+	}
+	// "-gc"
+	if args.gc {
+		runGC(&args)
+	}
+	// "-export"
+	if args.export != "" {
+		exportArchive(&args)
+	}
+	// "-export-checksums"
+	if args.export_checksums != "" {
+		exportChecksums(&args)
+	}
+	// "-verify-checksums"
+	if args.verify_checksums != "" {
+		verifyChecksums(&args)
+	}
+	// "-snapshot"
+	if args.snapshot != "" {
+		createSnapshot(&args)
+	}
+	// "-prune-snapshots"
+	if args.prune_snapshots >= 0 {
+		pruneSnapshots(&args)
+	}
+	// "-shred"
+	if args.shred != "" {
+		shredFile(&args)
+	}
+	// "-share"
+	if args.share != "" {
+		shareFile(&args)
+	}
+	// "-serve-webdav"
+	if args.serve_webdav != "" {
+		serveWebdav(&args)
+	}
+	// "-serve-9p"
+	if args.serve_9p != "" {
+		serve9P(&args)
+	}
 }
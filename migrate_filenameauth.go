@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// migrateJournalName is the journal file in CIPHERDIR that lists the
+// directories that have been migrated completely. The name starts with
+// "gocryptfs." so it is skipped by the migration itself.
+const migrateJournalName = "gocryptfs.migrate-filenameauth.journal"
+
+// filenameAuthMigration renames all entries of a CIPHERDIR from the legacy
+// filename authentication format (MAC appended to the encrypted name), or
+// from unauthenticated names, to the embedded format (MAC inside the EME
+// plaintext).
+type filenameAuthMigration struct {
+	// oldNT and newNT decrypt and encrypt names in the old and in the
+	// embedded format, respectively
+	oldNT, newNT *nametransform.NameTransform
+	// Number of entries that could not be migrated
+	errors int
+	// Number of entries that were renamed
+	renamed int
+	// root is CIPHERDIR. Paths in the journal are relative to it.
+	root string
+	// journal is appended to when a directory is complete
+	journal *os.File
+	// done contains the directories listed in the journal
+	done map[string]bool
+}
+
+// migrateFilenameAuth implements "-migrate-filenameauth".
+// Does not return (calls os.Exit both on success and on error).
+//
+// The migration is safe to run again after an interruption: directories
+// listed in the journal, and entries that already are in the new format,
+// are skipped. The feature flags are only switched once all entries have
+// been migrated.
+func migrateFilenameAuth(args *argContainer) {
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	journalPath := filepath.Join(args.cipherdir, migrateJournalName)
+	if cf.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded) {
+		// We may have been interrupted after writing the config file
+		os.Remove(journalPath)
+		tlog.Info.Printf("This filesystem already uses the new filename authentication format")
+		os.Exit(0)
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		tlog.Fatal.Printf("This filesystem uses plaintext names, which cannot be authenticated")
+		os.Exit(exitcodes.Usage)
+	}
+	leaveUpstream(args, cf, "-migrate-filenameauth")
+	// "legacy" filesystems have appended MACs, all others have none
+	legacy := cf.IsFeatureFlagSet(configfile.FlagFilenameAuth)
+	from := "none"
+	var oldFA *filenameauth.FilenameAuth
+	if legacy {
+		from = "legacy"
+		oldFA = filenameauth.New(masterkey, true)
+	}
+	cryptoBackend, err := cf.ContentEncryption()
+	if err != nil {
+		tlog.Fatal.Printf("%v", err)
+		os.Exit(exitcodes.DeprecatedFS)
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, cryptoBackend.NonceSize*8,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF))
+	longNames := cf.IsFeatureFlagSet(configfile.FlagLongNames)
+	raw64 := cf.IsFeatureFlagSet(configfile.FlagRaw64)
+	deterministicNames := !cf.IsFeatureFlagSet(configfile.FlagDirIV)
+	m := filenameAuthMigration{
+		oldNT: nametransform.New(cCore.EMECipher, longNames, cf.LongNameMax, raw64, nil,
+			deterministicNames, oldFA),
+		newNT: nametransform.New(cCore.EMECipher, longNames, cf.LongNameMax, raw64, nil,
+			deterministicNames, filenameauth.NewEmbedded(masterkey)),
+		root: args.cipherdir,
+	}
+	if legacy {
+		tlog.Info.Printf("Migrating %q to the new filename authentication format. "+
+			"The filesystem must not be mounted while this runs.", args.cipherdir)
+	} else {
+		tlog.Info.Printf("Enabling filename authentication on %q. "+
+			"The filesystem must not be mounted while this runs.", args.cipherdir)
+	}
+	err = m.openJournal(journalPath, from)
+	if err != nil {
+		tlog.Fatal.Printf("migrate-filenameauth: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	m.dir(args.cipherdir)
+	m.journal.Close()
+	cCore.Wipe()
+	if m.errors > 0 {
+		tlog.Fatal.Printf("migrate-filenameauth: %d entries could not be migrated, "+
+			"the config file was not changed. Fix the errors and run again.", m.errors)
+		os.Exit(exitcodes.FsckErrors)
+	}
+	cf.SetFeatureFlag(configfile.FlagFilenameAuth)
+	cf.SetFeatureFlag(configfile.FlagFilenameAuthEmbedded)
+	cf.UpdateFeatureFlagsMAC(masterkey)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	err = cf.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	os.Remove(journalPath)
+	tlog.Info.Printf(tlog.ColorGreen+"Migration complete, %d entries renamed."+tlog.ColorReset, m.renamed)
+	os.Exit(0)
+}
+
+// openJournal reads the journal at "path", if it exists, and opens it for
+// appending. The first line records the format we are migrating "from". A
+// journal from another kind of migration is discarded.
+func (m *filenameAuthMigration) openJournal(path string, from string) error {
+	header := "gocryptfs -migrate-filenameauth journal v1 from=" + from
+	m.done = make(map[string]bool)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() && scanner.Text() != header {
+		tlog.Warn.Printf("migrate-filenameauth: discarding journal from another migration: %q", scanner.Text())
+	} else {
+		for scanner.Scan() {
+			m.done[scanner.Text()] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		f.Close()
+		return err
+	}
+	if len(m.done) > 0 {
+		tlog.Info.Printf("Resuming, %d directories are already done", len(m.done))
+	} else {
+		// New or discarded journal: start over
+		if err = f.Truncate(0); err == nil {
+			_, err = fmt.Fprintln(f, header)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	m.journal = f
+	return nil
+}
+
+// journalDone records that the directory "path" and everything below it has
+// been migrated.
+func (m *filenameAuthMigration) journalDone(path string) {
+	rel, err := filepath.Rel(m.root, path)
+	if err == nil {
+		_, err = fmt.Fprintln(m.journal, rel)
+	}
+	if err == nil {
+		err = m.journal.Sync()
+	}
+	if err != nil {
+		// Not fatal, we will just redo the directory next time
+		tlog.Warn.Printf("migrate-filenameauth: writing journal: %v", err)
+	}
+}
+
+// dir migrates all entries in the directory "path" and recurses into
+// subdirectories.
+func (m *filenameAuthMigration) dir(path string) {
+	if rel, _ := filepath.Rel(m.root, path); m.done[rel] {
+		tlog.Debug.Printf("migrate-filenameauth: dir %q: done according to journal", path)
+		return
+	}
+	tlog.Debug.Printf("migrate-filenameauth: dir %q", path)
+	errorsBefore := m.errors
+	dirfd, err := syscallcompat.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		tlog.Warn.Printf("migrate-filenameauth: %q: %v", path, err)
+		m.errors++
+		return
+	}
+	defer syscall.Close(dirfd)
+	iv, err := m.newNT.ReadDirIVAt(dirfd)
+	if err != nil {
+		tlog.Warn.Printf("migrate-filenameauth: %q: could not read diriv: %v", path, err)
+		m.errors++
+		return
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		tlog.Warn.Printf("migrate-filenameauth: %q: %v", path, err)
+		m.errors++
+		return
+	}
+	for _, e := range entries {
+		cName := e.Name()
+		// Skip gocryptfs.diriv, gocryptfs.conf and its backups, the journal,
+		// and the .name files, which are handled together with their content
+		// file.
+		// Encrypted names never start with "gocryptfs.".
+		if nametransform.NameType(cName) != nametransform.LongNameContent &&
+			strings.HasPrefix(cName, "gocryptfs.") {
+			continue
+		}
+		// The backup copies of the config file in the root
+		if path == m.root && configfile.IsBackupName(cName) {
+			continue
+		}
+		newName, ok := m.entry(dirfd, path, cName, iv)
+		if ok && e.IsDir() {
+			m.dir(filepath.Join(path, newName))
+		}
+	}
+	if m.errors == errorsBefore {
+		m.journalDone(path)
+	}
+}
+
+// entry renames the single entry "cName" in "dirfd" to the new format and
+// returns the new name.
+func (m *filenameAuthMigration) entry(dirfd int, path string, cName string, iv []byte) (newName string, ok bool) {
+	fullName := cName
+	if nametransform.IsLongContent(cName) {
+		var err error
+		fullName, err = nametransform.ReadLongNameAt(dirfd, cName)
+		if err != nil {
+			tlog.Warn.Printf("migrate-filenameauth: %q: %v", filepath.Join(path, cName), err)
+			m.errors++
+			return "", false
+		}
+	}
+	// Already migrated by an earlier, interrupted run? This fails for all
+	// entries that still need work, so silence the warnings.
+	warnEnabled := tlog.Warn.Enabled
+	tlog.Warn.Enabled = false
+	_, err := m.newNT.DecryptName(fullName, iv)
+	tlog.Warn.Enabled = warnEnabled
+	if err == nil {
+		return cName, true
+	}
+	plainName, err := m.oldNT.DecryptName(fullName, iv)
+	if err != nil {
+		tlog.Warn.Printf("migrate-filenameauth: %q: could not decrypt name: %v", filepath.Join(path, cName), err)
+		m.errors++
+		return "", false
+	}
+	newName, err = m.newNT.EncryptAndHashName(plainName, iv)
+	if err != nil {
+		tlog.Warn.Printf("migrate-filenameauth: %q: could not encrypt name: %v", filepath.Join(path, cName), err)
+		m.errors++
+		return "", false
+	}
+	if nametransform.IsLongContent(newName) {
+		// EEXIST means that an earlier run was interrupted after writing the
+		// .name file. Its content is the same as what we would write.
+		err = m.newNT.WriteLongNameAt(dirfd, newName, plainName)
+		if err != nil && err != syscall.EEXIST {
+			tlog.Warn.Printf("migrate-filenameauth: %q: %v", filepath.Join(path, cName), err)
+			m.errors++
+			return "", false
+		}
+	}
+	err = unix.Renameat(dirfd, cName, dirfd, newName)
+	if err != nil {
+		tlog.Warn.Printf("migrate-filenameauth: %q: rename failed: %v", filepath.Join(path, cName), err)
+		m.errors++
+		return "", false
+	}
+	if nametransform.IsLongContent(cName) {
+		nametransform.DeleteLongNameAt(dirfd, cName)
+	}
+	m.renamed++
+	return newName, true
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"log"
-	"log/syslog"
 	"math"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -17,6 +19,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -25,13 +28,21 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/keyholder"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+	"github.com/rfjakob/gocryptfs/v2/internal/memprotect"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/processhardening"
+	"github.com/rfjakob/gocryptfs/v2/internal/stats"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/tuning"
 )
 
 // AfterUnmount is called after the filesystem has been unmounted.
@@ -40,6 +51,11 @@ type AfterUnmounter interface {
 	AfterUnmount()
 }
 
+// ExcludeReloader is implemented by the reverse mode root node
+type ExcludeReloader interface {
+	ReloadExcludes() error
+}
+
 // doMount mounts an encrypted directory.
 // Called from main.
 func doMount(args *argContainer) {
@@ -50,60 +66,43 @@ func doMount(args *argContainer) {
 		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
-	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
-	// will hide ".cipher" also for us.
-	if args.cipherdir == args.mountpoint || strings.HasPrefix(args.cipherdir, args.mountpoint+"/") {
-		tlog.Fatal.Printf("Mountpoint %q would shadow cipherdir %q, this is not supported",
-			args.mountpoint, args.cipherdir)
-		os.Exit(exitcodes.MountPoint)
-	}
-	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
-	// encrypting ourselves.
-	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
-		tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
-			args.mountpoint, args.cipherdir)
-		os.Exit(exitcodes.MountPoint)
-	}
-	if args.nonempty {
-		err = isDir(args.mountpoint)
-	} else if strings.HasPrefix(args.mountpoint, "/dev/fd/") {
-		// Magic fuse fd syntax, do nothing and let go-fuse figure it out.
-		//
-		// See https://github.com/libfuse/libfuse/commit/64e11073b9347fcf9c6d1eea143763ba9e946f70
-		// and `drop_privileges` in `man mount.fuse3` for background.
-	} else {
-		err = isEmptyDir(args.mountpoint)
-		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
-		if runtime.GOOS == "darwin" && os.IsNotExist(err) {
-			tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
-				args.mountpoint)
-			err = nil
-		}
-	}
-	if err != nil {
-		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
+	if err = checkMountpoint(args); err != nil {
+		tlog.Fatal.Printf("%v", err)
 		os.Exit(exitcodes.MountPoint)
 	}
 	// Open control socket early so we can error out before asking the user
 	// for the password
 	if args.ctlsock != "" {
-		// We must use an absolute path because we cd to / when daemonizing.
-		// This messes up the delete-on-close logic in the unix socket object.
-		args.ctlsock, _ = filepath.Abs(args.ctlsock)
-
-		args._ctlsockFd, err = ctlsocksrv.Listen(args.ctlsock)
+		args._ctlsockFd, err = listenCtlsock(args)
 		if err != nil {
 			tlog.Fatal.Printf("ctlsock: %v", err)
 			os.Exit(exitcodes.CtlSock)
 		}
 		// Close also deletes the socket file
 		defer func() {
-			err = args._ctlsockFd.Close()
+			if args._ctlsockSrv != nil {
+				err = args._ctlsockSrv.Shutdown(ctlsockDrainTimeout)
+			} else {
+				err = args._ctlsockFd.Close()
+			}
 			if err != nil {
 				tlog.Warn.Printf("ctlsock close: %v", err)
 			}
 		}()
 	}
+	// Listen before Landlock and seccomp are set up
+	if args.metrics_addr != "" {
+		ln, err := net.Listen("tcp", args.metrics_addr)
+		if err != nil {
+			tlog.Fatal.Printf("-metrics-addr: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		defer ln.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", stats.Default)
+		go http.Serve(ln, mux)
+	}
+	doctorWarn(args)
 	// Initialize gocryptfs (read config file, ask for password, ...)
 	fs, wipeKeys := initFuseFrontend(args)
 	// Try to wipe secret keys from memory after unmount
@@ -113,6 +112,14 @@ func doMount(args *argContainer) {
 	if x, ok := fs.(AfterUnmounter); ok {
 		defer x.AfterUnmount()
 	}
+	// The watcher sends notifications to the kernel, so it needs the FUSE
+	// server. It is set up before seccomp is installed.
+	if args.watch_cipherdir {
+		fwdFs := fs.(*fusefrontend.RootNode)
+		if err := fwdFs.WatchCipherdir(); err != nil {
+			tlog.Warn.Printf("-watch-cipherdir: %v. Changes to CIPHERDIR will not be seen until the kernel cache times out.", err)
+		}
+	}
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
 	// We have been forked into the background, as evidenced by the set
@@ -129,14 +136,11 @@ func doMount(args *argContainer) {
 		if err != nil {
 			tlog.Warn.Printf("Setsid: %v", err)
 		}
-		// Switch to syslog
-		if !args.nosyslog {
-			// Switch all of our logs and the generic logger to syslog
-			tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
-			tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
-			tlog.Warn.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
-			tlog.Fatal.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_CRIT)
-			tlog.SwitchLoggerToSyslog()
+		// Switch to syslog, unless the messages already go somewhere else
+		if !logsToConsole(args) {
+			redirectStdFds()
+		} else if !args.nosyslog && args.log_target == logTargetAuto {
+			switchToSyslog()
 			// Daemons should redirect stdin, stdout and stderr
 			redirectStdFds()
 		}
@@ -150,17 +154,90 @@ func doMount(args *argContainer) {
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
 	handleSigint(srv, args.mountpoint)
+	// Re-read the -exclude-from files on SIGHUP
+	if x, ok := fs.(ExcludeReloader); ok && len(args.excludeFrom) > 0 {
+		handleSighup(x)
+	}
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
+	// Confine ourselves to the paths we need, so a compromised daemon
+	// cannot touch the rest of the filesystem.
+	if !args.no_landlock {
+		setupLandlock(args)
+	}
+	// Give up root privileges we no longer need
+	dropPrivileges(args, srv)
+	// Setup is done. From here on we only serve FUSE requests, so restrict
+	// ourselves to the syscalls needed for that.
+	if !args.no_seccomp {
+		if runtime.GOOS == "openbsd" {
+			err = processhardening.New().InstallPledge()
+		} else {
+			err = installSeccomp(args)
+		}
+		if err != nil {
+			tlog.Warn.Printf("Could not restrict syscalls: %v", err)
+		}
+	}
 	// Set up autounmount, if requested.
 	if args.idle > 0 && !args.reverse {
 		// Not being in reverse mode means we always have a forward file system.
 		fwdFs := fs.(*fusefrontend.RootNode)
 		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
 	}
+	if args.on_corruption == fusefrontend.CorruptionUnmount {
+		fwdFs := fs.(*fusefrontend.RootNode)
+		go func() {
+			<-fwdFs.CorruptionLimitReached()
+			tlog.Info.Printf("-on-corruption: unmounting %s", args.mountpoint)
+			unmount(srv, args.mountpoint)
+		}()
+	}
 	// Wait for unmount.
 	srv.Wait()
+	tlog.Debug.Printf("Runtime statistics:\n%s", stats.Default)
+	if args._crash.Crashed() {
+		os.Exit(exitcodes.Crash)
+	}
+}
+
+// checkMountpoint checks that the absolute path args.mountpoint can be
+// used to mount args.cipherdir
+func checkMountpoint(args *argContainer) error {
+	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
+	// will hide ".cipher" also for us.
+	if args.cipherdir == args.mountpoint || strings.HasPrefix(args.cipherdir, args.mountpoint+"/") {
+		return fmt.Errorf("Mountpoint %q would shadow cipherdir %q, this is not supported",
+			args.mountpoint, args.cipherdir)
+	}
+	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
+	// encrypting ourselves.
+	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
+		return fmt.Errorf("Mountpoint %q is contained in cipherdir %q, this is not supported",
+			args.mountpoint, args.cipherdir)
+	}
+	var err error
+	if args.nonempty {
+		err = isDir(args.mountpoint)
+	} else if strings.HasPrefix(args.mountpoint, "/dev/fd/") {
+		// Magic fuse fd syntax, do nothing and let go-fuse figure it out.
+		//
+		// See https://github.com/libfuse/libfuse/commit/64e11073b9347fcf9c6d1eea143763ba9e946f70
+		// and `drop_privileges` in `man mount.fuse3` for background.
+	} else {
+		err = isEmptyDir(args.mountpoint)
+		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
+		if runtime.GOOS == "darwin" && os.IsNotExist(err) {
+			tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
+				args.mountpoint)
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Invalid mountpoint: %v", err)
+	}
+	return nil
 }
 
 // Based on the EncFS idle monitor:
@@ -194,7 +271,7 @@ func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse
 			idleTime(), idleCount, isIdle, openFileCount)
 		if idleCount > 0 && idleCount%timeoutCycles == 0 {
 			tlog.Info.Printf("idleMonitor: filesystem idle; unmounting: %s", mountpoint)
-			err := srv.Unmount()
+			err := srvUnmount(srv, false)
 			if err != nil {
 				// We get "Device or resource busy" when a process has its
 				// working directory on the mount. Log the event at Info level
@@ -228,11 +305,85 @@ func setOpenFileLimit() {
 	}
 }
 
+// ctlsockDrainTimeout is how long requests on the control socket can take
+// to finish when gocryptfs exits
+const ctlsockDrainTimeout = 5 * time.Second
+
+// ctlsockOptions returns the control socket limits from the command line
+func ctlsockOptions(args *argContainer) ctlsocksrv.Options {
+	o := ctlsocksrv.Options{
+		MaxConns:       args.ctlsock_max_conns,
+		RequestTimeout: args.ctlsock_timeout,
+	}
+	// With "-fg", the parent is the program that mounted us, like a GUI.
+	// Otherwise it is the gocryptfs process that has forked us and exits.
+	if args.notifypid == 0 {
+		o.OwnerPID = os.Getppid()
+	}
+	return o
+}
+
+// listenCtlsock opens the "-ctlsock" socket: a socket file, an abstract
+// socket, or a socket passed by systemd
+func listenCtlsock(args *argContainer) (net.Listener, error) {
+	if ctlsocksrv.IsSystemd(args.ctlsock) {
+		// The parent has passed the systemd sockets on to us when forking
+		return ctlsocksrv.ListenSystemd(args.ctlsock, args.notifypid)
+	}
+	if !ctlsocksrv.IsAbstract(args.ctlsock) {
+		// We must use an absolute path because we cd to / when daemonizing.
+		// This messes up the delete-on-close logic in the unix socket object.
+		args.ctlsock, _ = filepath.Abs(args.ctlsock)
+	}
+	return ctlsocksrv.Listen(args.ctlsock)
+}
+
+// fatalErr logs the message like "tlog.Fatal.Printf" and returns it as an
+// exitcodes.Err with exit code "code"
+func fatalErr(code int, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	tlog.Fatal.Println(msg)
+	return exitcodes.NewErr(msg, code)
+}
+
 // initFuseFrontend - initialize gocryptfs/internal/fusefrontend
 // Calls os.Exit on errors
 func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func()) {
-	var err error
+	rootNode, wipeKeys, err := newFuseFrontend(args)
+	if err != nil {
+		if args._ctlsockFd != nil {
+			// Close the socket file (which also deletes it)
+			args._ctlsockFd.Close()
+		}
+		exitcodes.Exit(err)
+	}
+	return rootNode, wipeKeys
+}
+
+// newFuseFrontend is initFuseFrontend for callers that must not exit, like
+// "-daemon". The error has the exit code as an exitcodes.Err.
+func newFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func(), err error) {
 	var confFile *configfile.ConfFile
+	// Lock CIPHERDIR before asking for the password. "-shred" must be alone,
+	// as it cannot see the files that other processes have open.
+	unlockCipherdir := func() {}
+	if !args.reverse {
+		unlockCipherdir, err = lockCipherdir(args.cipherdir, args.shred != "")
+		if err == errCipherdirInUse && args.shred != "" {
+			return nil, nil, fatalErr(exitcodes.CipherDir,
+				"-shred: %s is mounted or in use. Use the Shred request of -ctlsock on the mount instead.", args.cipherdir)
+		} else if err == errCipherdirInUse {
+			return nil, nil, fatalErr(exitcodes.CipherDir,
+				"%s: %v, wait until -shred or -gc has finished", args.cipherdir, err)
+		} else if err != nil {
+			return nil, nil, fatalErr(exitcodes.CipherDir, "Cannot lock %s: %v", args.cipherdir, err)
+		}
+		defer func() {
+			if err != nil {
+				unlockCipherdir()
+			}
+		}()
+	}
 	// Get the masterkey from the command line if it was specified
 	masterkey := handleArgsMasterkey(args)
 	// Otherwise, load masterkey from config file (normal operation).
@@ -240,11 +391,7 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	if masterkey == nil {
 		masterkey, confFile, err = loadConfig(args)
 		if err != nil {
-			if args._ctlsockFd != nil {
-				// Close the socket file (which also deletes it)
-				args._ctlsockFd.Close()
-			}
-			exitcodes.Exit(err)
+			return nil, nil, err
 		}
 	}
 	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
@@ -285,12 +432,54 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		SharedStorage:      args.sharedstorage,
 		OneFileSystem:      args.one_file_system,
 		DeterministicNames: args.deterministic_names,
+		EncryptACL:         args.encrypt_acl,
+		XattrAllow:         args._xattrAllow,
+		XattrDeny:          args._xattrDeny,
+		ForbiddenNames:     args.forbid_name,
+		ChunkSize:          uint64(args.chunk_size) << 20,
+		ReverseRW:          args.reverse_rw,
+		Trash:              args._trash,
+		Scrub:              args._scrub,
+		ScrubBandwidth:     int64(args.scrub_bw) << 20,
+		AccessPolicy:       args._accessPolicy,
+		CaseInsensitive:    args.case_insensitive || args.case_fold,
+		CaseFold:           args.case_fold,
+		Normalization:      args._normalization,
+		StableInodes:       args.stable_inodes,
+		Supervise:          args.supervise,
+		RestoreTimes:       args.restore_times,
+		OnCorruption:       args.on_corruption,
+		CorruptionLimit:    args.corruption_limit,
+		NameCacheSize:      args.namecache_size,
+		NegativeTimeout:    args.negative_timeout,
+		AdaptiveTimeout:    args.adaptive_timeout,
+		IOEngine:           args.io_engine,
+		DirectIO:           args.direct_io,
+		Statfs:             args.statfs,
+		AuthLinks:          args.reverse && args.auth_links,
+		OpWorkers:          args._opWorkers,
+	}
+	if args.stable_inodes {
+		// Fail early instead of warning on every file
+		if _, err := syscallcompat.FileHandle(unix.AT_FDCWD, args.cipherdir+"/."); err != nil {
+			return nil, nil, fatalErr(exitcodes.CipherDir, "-stable-inodes: cannot get file handles in %s: %v", args.cipherdir, err)
+		}
+	}
+	if args._accessPolicy != nil && !args.allow_other {
+		tlog.Info.Printf("-access-policy without -allow_other only restricts your own user")
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		frontendArgs.DeterministicNames = !confFile.IsFeatureFlagSet(configfile.FlagDirIV)
+		frontendArgs.DirManifest = confFile.IsFeatureFlagSet(configfile.FlagDirManifest)
+		frontendArgs.XattrAuth = confFile.IsFeatureFlagSet(configfile.FlagXattrAuth)
+		frontendArgs.AuthTimes = confFile.IsFeatureFlagSet(configfile.FlagAuthTimes)
+		frontendArgs.LongSymlinks = confFile.IsFeatureFlagSet(configfile.FlagLongSymlinks)
+		if !args.reverse {
+			frontendArgs.AuthLinks = confFile.IsFeatureFlagSet(configfile.FlagAuthLinks)
+		}
 		// Things that don't have to be in frontendArgs are only in args
 		args.longnamemax = confFile.LongNameMax
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
@@ -298,13 +487,14 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		// Note: this will always return the non-openssl variant
 		cryptoBackend, err = confFile.ContentEncryption()
 		if err != nil {
-			tlog.Fatal.Printf("%v", err)
-			os.Exit(exitcodes.DeprecatedFS)
+			return nil, nil, fatalErr(exitcodes.DeprecatedFS, "%v", err)
 		}
 		IVBits = cryptoBackend.NonceSize * 8
+		if frontendArgs.PlaintextNames && frontendArgs.ChunkSize > 0 {
+			return nil, nil, fatalErr(exitcodes.Usage, "-chunk-size cannot be used with a plaintextnames filesystem")
+		}
 		if cryptoBackend != cryptocore.BackendAESSIV && args.reverse {
-			tlog.Fatal.Printf("AES-SIV is required by reverse mode, but not enabled in the config file")
-			os.Exit(exitcodes.Usage)
+			return nil, nil, fatalErr(exitcodes.Usage, "AES-SIV is required by reverse mode, but not enabled in the config file")
 		}
 		// Upgrade to OpenSSL variant if requested
 		if args.openssl {
@@ -316,32 +506,123 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			}
 		}
 	}
+	if args.cipher == "optimized" {
+		switch cryptoBackend {
+		case cryptocore.BackendGoGCM, cryptocore.BackendOpenSSL:
+			cryptoBackend = cryptocore.BackendOptimized
+		default:
+			return nil, nil, fatalErr(exitcodes.Usage, "-cipher optimized only works with AES-GCM, but this filesystem uses %s", cryptoBackend.Algo)
+		}
+	}
 	// If allow_other is set and we run as root, create files as the accessing
 	// user.
-	// Except when -force_owner is set, because in this case the user may
-	// not have write permissions. And the point of -force_owner is to map uids,
-	// so we want the files on the backing dir to get the uid the gocryptfs process
-	// is running as.
-	if args.allow_other && os.Getuid() == 0 && args._forceOwner == nil {
-		frontendArgs.PreserveOwner = true
-	}
+	frontendArgs.PreserveOwner = preserveOwner(args)
 
+	filenameAuth := confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagFilenameAuth)
+	filenameAuthEmbedded := filenameAuth && confFile.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded)
+	if filenameAuth && !filenameAuthEmbedded {
+		tlog.Info.Printf("This filesystem uses the old filename authentication format. " +
+			"Run \"gocryptfs -migrate-filenameauth\" to convert it.")
+	}
+	if confFile != nil && len(confFile.PendingMigrations()) > 0 && !args.upstream_compat {
+		hint := ""
+		if confFile.UpstreamCompatible() == nil {
+			hint = " Afterwards, upstream gocryptfs v2.x can no longer mount it."
+		}
+		tlog.Info.Printf("This filesystem uses config file version %d. "+
+			"Run \"gocryptfs -upgrade-config\" to upgrade it to version %d.%s",
+			confFile.SchemaVersion(), configfile.ConfigVersionCurrent, hint)
+	}
+	if err = checkCipherdirFingerprint(args, masterkey); err != nil {
+		return nil, nil, err
+	}
 	// Init crypto backend
-	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	var cCore *cryptocore.CryptoCore
 	// Initialize optional filename authentication helper
 	var fa *filenameauth.FilenameAuth
-	if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagFilenameAuth) {
-		// Use the master key before it gets wiped
-		fa = filenameauth.New(masterkey, true)
+	var kh *keyholder.Client
+	if args.privsep {
+		kh = startKeyholder(args, masterkey, keyholder.Params{
+			AEADType:     cryptoBackend,
+			IVBitLen:     IVBits,
+			UseHKDF:      args.hkdf,
+			FilenameAuth: filenameAuth,
+		})
+		cCore = kh.CryptoCore(cryptoBackend)
+		if filenameAuth {
+			fa = kh.FilenameAuth(filenameAuthEmbedded)
+		}
+	} else {
+		cCore = cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf)
+		if filenameAuth {
+			// Use the master key before it gets wiped
+			if filenameAuthEmbedded {
+				fa = filenameauth.NewEmbedded(masterkey)
+			} else {
+				fa = filenameauth.New(masterkey, true)
+			}
+		}
+	}
+	var prefetcher *cryptocore.AdaptivePrefetcher
+	switch {
+	case args.nonce_prefetch == "adaptive":
+		// Start with the size learned during the last mount
+		size := cryptocore.GetOptimalPrefetchSize()
+		if st := loadTuningState(args); st.PrefetchSize > 0 {
+			size = st.PrefetchSize
+		}
+		prefetcher = cCore.UseAdaptivePrefetcher(size, true)
+	case args._noncePrefetchSize > 0:
+		cCore.UseAdaptivePrefetcher(args._noncePrefetchSize, false)
 	}
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagHeaderV3) {
+		if args.privsep {
+			return nil, nil, fatalErr(exitcodes.Usage, "The HeaderV3 feature flag is not supported with -privsep")
+		}
+		if err := cEnc.UseHeaderV3(keystore.New(args.cipherdir)); err != nil {
+			return nil, nil, fatalErr(exitcodes.DeprecatedFS, "%v", err)
+		}
+	}
+	if args.buffer_arena > 0 {
+		if err := cEnc.UseArena(args.buffer_arena); err != nil {
+			tlog.Warn.Printf("-buffer-arena: %v, using the Go heap", err)
+		}
+	}
+	pc := cEnc.ParallelCrypto()
+	pc.SetWorkers(args.crypto_workers)
+	pc.SetThreshold(args.crypto_parallel_threshold)
+	if args.no_parallel_crypto {
+		pc.Disable()
+	}
+	cEnc.RegisterStats(stats.Default)
 	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.longnamemax,
 		args.raw64, []string(args.badname), frontendArgs.DeterministicNames, fa)
+	if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagDirIVAuth) {
+		if args.reverse {
+			return nil, nil, fatalErr(exitcodes.Usage, "The DirIVAuth feature flag is not supported in reverse mode")
+		}
+		nameTransform.EnableDirIVAuth()
+	}
+	var dedupStore *dedup.Store
+	if confFile != nil && confFile.IsFeatureFlagSet(configfile.FlagDedup) {
+		if args.reverse {
+			return nil, nil, fatalErr(exitcodes.Usage, "The Dedup feature flag is not supported in reverse mode")
+		}
+		if args.privsep {
+			return nil, nil, fatalErr(exitcodes.Usage, "The Dedup feature flag is not supported with -privsep")
+		}
+		dedupStore = dedup.New(masterkey, args.cipherdir, cEnc)
+	}
+	// "-verify-on-mount"
+	if args.verify_on_mount != "" {
+		if err := verifyOnMount(args, cEnc, nameTransform, !frontendArgs.PlaintextNames, dedupStore); err != nil {
+			return nil, nil, err
+		}
+	}
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
-	for i := range masterkey {
-		masterkey[i] = 0
-	}
+	memprotect.New().WipeKey(masterkey)
 	masterkey = nil
 	// Spawn fusefrontend
 	tlog.Debug.Printf("frontendArgs: %s", tlog.JSONDump(frontendArgs))
@@ -351,14 +632,75 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		}
 		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
 	} else {
-		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		rn.RegisterStats(stats.Default)
+		if dedupStore != nil {
+			rn.EnableDedup(dedupStore)
+		}
+		if !args.ro {
+			if err := rn.ReplayLongNameJournal(); err != nil {
+				tlog.Warn.Printf("Could not replay the long name journal: %v", err)
+			}
+		}
+		if frontendArgs.Trash > 0 {
+			go rn.PurgeTrashLoop()
+		}
+		if frontendArgs.Scrub > 0 {
+			go rn.ScrubLoop()
+		}
+		rootNode = rn
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
 	if args._ctlsockFd != nil {
-		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface))
+		args._ctlsockSrv = ctlsocksrv.NewServer(args._ctlsockFd, rootNode.(ctlsocksrv.Interface), ctlsockOptions(args))
+		go args._ctlsockSrv.Serve()
+	}
+	wipeKeys = func() {
+		cCore.Wipe()
+		if prefetcher != nil {
+			saveTuningState(args, func(st *tuning.State) {
+				st.PrefetchSize = prefetcher.GetPrefetchSize()
+			})
+		}
+		if dedupStore != nil {
+			dedupStore.Wipe()
+		}
+		if kh != nil {
+			// Makes the key-holder wipe its keys and exit
+			kh.Close()
+		}
+		unlockCipherdir()
+	}
+	return rootNode, wipeKeys, nil
+}
+
+// loadTuningState returns the tuning parameters learned during earlier
+// mounts of args.cipherdir, or an empty state in reverse mode or on error.
+func loadTuningState(args *argContainer) *tuning.State {
+	if args.reverse {
+		// CIPHERDIR is the user's plaintext, we don't put files there
+		return &tuning.State{}
+	}
+	st, err := tuning.Load(args.cipherdir)
+	if err != nil {
+		tlog.Warn.Printf("Ignoring %s: %v", tuning.FileName, err)
+	}
+	return st
+}
+
+// saveTuningState applies "update" to the saved tuning parameters of
+// args.cipherdir and writes them back. Does nothing in reverse mode and
+// with -ro.
+func saveTuningState(args *argContainer, update func(*tuning.State)) {
+	if args.reverse || args.ro {
+		return
+	}
+	st := loadTuningState(args)
+	update(st)
+	if err := st.Save(args.cipherdir); err != nil {
+		tlog.Warn.Printf("Could not save %s: %v", tuning.FileName, err)
 	}
-	return rootNode, func() { cCore.Wipe() }
 }
 
 type RootInoer interface {
@@ -369,6 +711,15 @@ type RootInoer interface {
 // The mountpoint is ready to use when the functions returns.
 // On error, it calls os.Exit and does not return.
 func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
+	srv, err := newGoFuse(rootNode, args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	return srv
+}
+
+// newGoFuse is initGoFuse for callers that must not exit
+func newGoFuse(rootNode fs.InodeEmbedder, args *argContainer) (*fuse.Server, error) {
 	var fuseOpts *fs.Options
 	sec := time.Second
 	if args.sharedstorage {
@@ -388,6 +739,18 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 			EntryTimeout:    &sec,
 		}
 	}
+	if args.case_insensitive || args.case_fold || args._normalization != nametransform.NormalizeNone {
+		// A negative entry for "foo" would hide a "Foo" created later
+		fuseOpts.NegativeTimeout = nil
+	} else if args._negativeTimeoutSet {
+		fuseOpts.NegativeTimeout = &args.negative_timeout
+	}
+	if args.adaptive_timeout > 0 && !args.reverse {
+		// fusefrontend sets the timeouts itself. go-fuse would replace
+		// the zero timeouts of hot directories by the defaults.
+		fuseOpts.AttrTimeout = nil
+		fuseOpts.EntryTimeout = nil
+	}
 	fuseOpts.NullPermissions = true
 	// The inode number for the root node must be manually set on mount
 	// https://github.com/hanwen/go-fuse/issues/399
@@ -431,8 +794,10 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	}
 	// Add FUSE optimization options
 	if args.writeback_cache {
-		opts["writeback_cache"] = ""
-		tlog.Info.Printf("FUSE writeback cache enabled for better write performance")
+		// The writeback cache is negotiated in FUSE_INIT, which go-fuse
+		// does not offer, and the kernel rejects "writeback_cache" as a
+		// mount option. Writable shared mmap does not need it.
+		tlog.Warn.Printf("-writeback-cache: not supported by the FUSE library, ignoring it")
 	}
 	if args.async_read {
 		opts["async_read"] = ""
@@ -464,10 +829,14 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	// something like "osxfuse Volume 0 (gocryptfs)".
 	if runtime.GOOS == "darwin" {
 		opts["volname"] = strings.Replace(path.Base(args.mountpoint), ",", "_", -1)
+		// macFUSE 5 and later can use FSKit instead of the kernel extension
+		if args.macos_backend == "fskit" {
+			opts["backend"] = "fskit"
+		}
 	}
 	// The kernel enforces read-only operation, we just have to pass "ro".
-	// Reverse mounts are always read-only.
-	if args.ro || args.reverse {
+	// Reverse mounts are read-only unless "-reverse-rw" is passed.
+	if args.ro || (args.reverse && !args.reverse_rw) {
 		opts["ro"] = ""
 	} else if args.rw {
 		opts["rw"] = ""
@@ -489,8 +858,8 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	} else if args.exec {
 		opts["exec"] = ""
 	}
-	if args.context != "" {
-		opts["context"] = args.context
+	if ctx := mountContext(args); ctx != "" {
+		opts["context"] = ctx
 	}
 	// Add additional mount options (if any) after the stock ones, so the user has
 	// a chance to override them.
@@ -514,13 +883,26 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		}
 	}
 
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
+	// Like fs.Mount, but with the crash handler in front of the node tree
+	args._crash = newCrashHandler(args)
+	rawFS := args._crash.Wrap(fs.NewNodeFS(rootNode, fuseOpts))
+	srv, err := fuse.NewServer(rawFS, args.mountpoint, &fuseOpts.MountOptions)
+	if err == nil {
+		args._crash.OnCrash = func(report string) {
+			unmount(srv, args.mountpoint)
+		}
+		go srv.Serve()
+		// If the mount fails, the serve loop exits by itself
+		err = srv.WaitMount()
+	}
 	if err != nil {
-		tlog.Fatal.Printf("fs.Mount failed: %s", strings.TrimSpace(err.Error()))
-		if runtime.GOOS == "darwin" {
+		err = fatalErr(exitcodes.FuseNewServer, "fs.Mount failed: %s", strings.TrimSpace(err.Error()))
+		if runtime.GOOS == "darwin" && args.macos_backend == "fskit" {
+			tlog.Info.Printf("-macos-backend fskit needs macFUSE 5 and macOS 15.4 or later")
+		} else if runtime.GOOS == "darwin" {
 			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
 		}
-		os.Exit(exitcodes.FuseNewServer)
+		return nil, err
 	}
 
 	// All FUSE file and directory create calls carry explicit permission
@@ -528,7 +910,7 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	// directories with the requested permissions.
 	syscall.Umask(0000)
 
-	return srv
+	return srv, nil
 }
 
 // haveFusermount2 finds out if the "fusermount" binary is from libfuse 2.x.
@@ -562,15 +944,33 @@ func handleSigint(srv *fuse.Server, mountpoint string) {
 	}()
 }
 
+// handleSighup reloads the exclusion patterns when we get SIGHUP.
+func handleSighup(x ExcludeReloader) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := x.ReloadExcludes(); err != nil {
+				tlog.Warn.Printf("Could not reload exclusion patterns, keeping the old ones: %v", err)
+			}
+		}
+	}()
+}
+
 // unmount() calls srv.Unmount(), and if that fails, calls "fusermount -u -z"
 // (lazy unmount).
 func unmount(srv *fuse.Server, mountpoint string) {
-	err := srv.Unmount()
+	err := srvUnmount(srv, false)
 	if err != nil {
 		tlog.Warn.Printf("unmount: srv.Unmount returned %v", err)
 		if runtime.GOOS == "linux" {
 			// MacOSX does not support lazy unmount
 			tlog.Info.Printf("Trying lazy unmount")
+			if mountHelper != nil {
+				// We are sandboxed and cannot run fusermount ourselves
+				mountHelper.Unmount(true)
+				return
+			}
 			cmd := exec.Command("fusermount", "-u", "-z", mountpoint)
 			cmd.Stdout = os.Stdout
 			cmd.Stderr = os.Stderr
@@ -0,0 +1,100 @@
+package vault
+
+import (
+	"io"
+	"io/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+)
+
+// File is an open file or directory in a Vault. Offsets and sizes refer
+// to the plaintext. A File is not safe for concurrent use, but different
+// Files can be used concurrently, even if they refer to the same file.
+type File struct {
+	f    *rawfs.File
+	name string
+}
+
+// Verify that the interfaces are implemented.
+var (
+	_ io.ReadWriteSeeker = &File{}
+	_ io.ReaderAt        = &File{}
+	_ io.WriterAt        = &File{}
+	_ io.Closer          = &File{}
+)
+
+func (f *File) wrap(op string, err error) error {
+	if err == nil || err == io.EOF || err == io.ErrShortWrite {
+		return err
+	}
+	return pathErr(op, f.name, err)
+}
+
+// Name returns the name that was passed to Open.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Read reads up to len(p) bytes at the current offset. It returns io.EOF
+// at the end of the file.
+func (f *File) Read(p []byte) (int, error) {
+	n, err := f.f.Read(p)
+	return n, f.wrap("read", err)
+}
+
+// ReadAt reads len(p) bytes at offset "off". It returns io.EOF if the
+// file ends before. The current offset is not changed.
+func (f *File) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(p, off)
+	return n, f.wrap("read", err)
+}
+
+// Write writes "p" at the current offset.
+func (f *File) Write(p []byte) (int, error) {
+	n, err := f.f.Write(p)
+	return n, f.wrap("write", err)
+}
+
+// WriteAt writes "p" at offset "off". The current offset is not changed.
+func (f *File) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.f.WriteAt(p, off)
+	return n, f.wrap("write", err)
+}
+
+// Seek sets the offset for the next Read or Write, like os.File.Seek.
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	off, err := f.f.Seek(offset, whence)
+	return off, f.wrap("seek", err)
+}
+
+// Truncate changes the size of the file. The current offset is not
+// changed.
+func (f *File) Truncate(size int64) error {
+	return f.wrap("truncate", f.f.Truncate(size))
+}
+
+// Sync writes the file contents to stable storage.
+func (f *File) Sync() error {
+	return f.wrap("sync", f.f.Sync())
+}
+
+// Stat returns information about the file.
+func (f *File) Stat() (fs.FileInfo, error) {
+	fi, err := f.f.Stat()
+	return fi, f.wrap("stat", err)
+}
+
+// Readdir reads the directory like os.File.Readdir: if count > 0, it
+// returns at most "count" entries, and io.EOF at the end of the
+// directory. If count <= 0, it returns all remaining entries. The entries
+// are not sorted.
+func (f *File) Readdir(count int) ([]fs.FileInfo, error) {
+	fis, err := f.f.Readdir(count)
+	return fis, f.wrap("readdirent", err)
+}
+
+// Close closes the file. It returns errors from writing back data that
+// Write could not report.
+func (f *File) Close() error {
+	return f.wrap("close", f.f.Close())
+}
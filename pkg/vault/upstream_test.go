@@ -0,0 +1,157 @@
+package vault
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// upstreamExamples were created by upstream gocryptfs, with password "test"
+var upstreamExamples = []string{
+	"v1.1-aessiv",
+	"v1.3",
+	"v2.2-deterministic-names",
+	"v2.2-xchacha",
+	"v2.2-xchacha-deterministic-names",
+}
+
+// listCipherdir returns the names of all files in "dir", relative to it
+func listCipherdir(t *testing.T, dir string) (names []string) {
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// TestUpstreamReadWrite checks that filesystems created by upstream gocryptfs
+// can be used read-write, and that upstream can still mount them afterwards:
+// the config file is not touched and no files appear that upstream does not
+// know.
+func TestUpstreamReadWrite(t *testing.T) {
+	for _, name := range upstreamExamples {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), name)
+			// Keep symlinks, the example filesystems contain some
+			out, err := exec.Command("cp", "-a", "../../tests/example_filesystems/"+name, dir).CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v: %s", err, out)
+			}
+			conf := filepath.Join(dir, configfile.ConfDefaultName)
+			confBefore, err := os.ReadFile(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := listCipherdir(t, dir)
+
+			v, err := Open(dir, testPw, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, err := v.ReadFile("status.txt"); err != nil || string(have) != "It works!\n" {
+				t.Errorf("status.txt: %q, %v", have, err)
+			}
+			longname := "longname_255_" + strings.Repeat("x", 255-len("longname_255_"))
+			if _, err = v.Stat(longname); err != nil {
+				t.Error(err)
+			}
+			content := bytes.Repeat([]byte("interop "), 1000)
+			if err = v.Mkdir("newdir", 0700); err != nil {
+				t.Fatal(err)
+			}
+			if err = v.WriteFile("newdir/f", content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if err = v.Rename("newdir/f", "newdir/"+longname); err != nil {
+				t.Fatal(err)
+			}
+			v.Close()
+
+			v, err = Open(dir, testPw, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, err := v.ReadFile("newdir/" + longname); err != nil || !bytes.Equal(have, content) {
+				t.Errorf("ReadFile after reopen: len=%d, %v", len(have), err)
+			}
+			if err = v.RemoveAll("newdir"); err != nil {
+				t.Fatal(err)
+			}
+			v.Close()
+
+			confAfter, err := os.ReadFile(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(confBefore, confAfter) {
+				t.Error("gocryptfs.conf has been modified")
+			}
+			cf, err := configfile.Load(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = cf.UpstreamCompatible(); err != nil {
+				t.Error(err)
+			}
+			if after := listCipherdir(t, dir); strings.Join(before, "\n") != strings.Join(after, "\n") {
+				t.Errorf("files in CIPHERDIR changed:\nbefore: %v\nafter:  %v", before, after)
+			}
+		})
+	}
+}
+
+// TestUpstreamCreated checks that a filesystem created with
+// "CreateArgs.Upstream" works and stays upstream-compatible.
+func TestUpstreamCreated(t *testing.T) {
+	dir := t.TempDir()
+	err := configfile.Create(&configfile.CreateArgs{
+		Filename:  filepath.Join(dir, configfile.ConfDefaultName),
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "vault_test",
+		BlockSize: 4096,
+		Upstream:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	v, err := Open(dir, testPw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.WriteFile("f", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+	cf, err := configfile.Load(filepath.Join(dir, configfile.ConfDefaultName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cf.UpstreamCompatible(); err != nil {
+		t.Error(err)
+	}
+}
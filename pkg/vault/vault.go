@@ -0,0 +1,275 @@
+// Package vault reads and writes a gocryptfs filesystem without mounting
+// it. It is meant for programs like backup tools and servers that want to
+// link gocryptfs directly instead of going through FUSE.
+//
+// A Vault is opened with the password of the filesystem, like a mount:
+//
+//	v, err := vault.Open("/path/to/cipherdir", password, nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer v.Close()
+//	data, err := v.ReadFile("dir/file.txt")
+//
+// Names are slash-separated paths relative to the root of the plaintext
+// view. Leading slashes, "." and ".." elements are cleaned like by
+// path.Clean, so a name can never point outside of the filesystem.
+// Errors are *fs.PathError (or *os.LinkError for Rename) wrapping a
+// syscall.Errno, so os.IsNotExist and errors.Is work as usual.
+//
+// The semantics are those of a gocryptfs mount: the encryption, file
+// name handling and integrity checks are done by the same code. Files are
+// accessed with the uid and gid of the calling process. Like a mount
+// without "-sharedstorage", a Vault assumes that nobody else modifies
+// the cipherdir while it is open.
+//
+// Reverse mode and filesystems whose master key is protected by a FIDO2
+// token are not supported.
+package vault
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	gofs "github.com/hanwen/go-fuse/v2/fs"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/filenameauth"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/keystore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+)
+
+// Options are optional settings for Open. The zero value gives the
+// defaults.
+type Options struct {
+	// ConfigFile is the path of the config file. Default:
+	// "gocryptfs.conf" in the cipherdir.
+	ConfigFile string
+	// ReadOnly makes all modifications fail with syscall.EROFS.
+	ReadOnly bool
+}
+
+// ErrFIDO2 is returned by Open for filesystems that need a FIDO2 token.
+var ErrFIDO2 = errors.New("vault: filesystems protected by a FIDO2 token are not supported")
+
+// Vault is an open gocryptfs filesystem. It is safe for concurrent use.
+type Vault struct {
+	fs    *rawfs.FS
+	root  *fusefrontend.RootNode
+	cCore *cryptocore.CryptoCore
+	// dedup is nil unless the Dedup feature flag is set
+	dedup *dedup.Store
+}
+
+// Open decrypts the master key of the filesystem in "cipherdir" using
+// "password". "opts" may be nil. The returned Vault must be closed with
+// Close, which also wipes the keys from memory.
+func Open(cipherdir string, password []byte, opts *Options) (*Vault, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	cipherdir, err := filepath.Abs(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	configFile := opts.ConfigFile
+	if configFile == "" {
+		configFile = filepath.Join(cipherdir, configfile.ConfDefaultName)
+	}
+	cf, err := configfile.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		return nil, ErrFIDO2
+	}
+	masterkey, err := cf.DecryptMasterKey(password)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for i := range masterkey {
+			masterkey[i] = 0
+		}
+	}()
+	// Like initFuseFrontend in the gocryptfs main package, with all
+	// settings taken from the config file.
+	cryptoBackend, err := cf.ContentEncryption()
+	if err != nil {
+		return nil, err
+	}
+	frontendArgs := fusefrontend.Args{
+		Cipherdir:          cipherdir,
+		PlaintextNames:     cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		LongNames:          cf.IsFeatureFlagSet(configfile.FlagLongNames),
+		DeterministicNames: !cf.IsFeatureFlagSet(configfile.FlagDirIV),
+		DirManifest:        cf.IsFeatureFlagSet(configfile.FlagDirManifest),
+		XattrAuth:          cf.IsFeatureFlagSet(configfile.FlagXattrAuth),
+		AuthTimes:          cf.IsFeatureFlagSet(configfile.FlagAuthTimes),
+		LongSymlinks:       cf.IsFeatureFlagSet(configfile.FlagLongSymlinks),
+		AuthLinks:          cf.IsFeatureFlagSet(configfile.FlagAuthLinks),
+	}
+	if opts.ConfigFile != "" {
+		frontendArgs.ConfigCustom = true
+	}
+	var fa *filenameauth.FilenameAuth
+	if cf.IsFeatureFlagSet(configfile.FlagFilenameAuth) {
+		if cf.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded) {
+			fa = filenameauth.NewEmbedded(masterkey)
+		} else {
+			fa = filenameauth.New(masterkey, true)
+		}
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, cryptoBackend.NonceSize*8,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF))
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	if cf.IsFeatureFlagSet(configfile.FlagHeaderV3) {
+		if err := cEnc.UseHeaderV3(keystore.New(cipherdir)); err != nil {
+			cCore.Wipe()
+			return nil, err
+		}
+	}
+	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, cf.LongNameMax,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64), nil, frontendArgs.DeterministicNames, fa)
+	if cf.IsFeatureFlagSet(configfile.FlagDirIVAuth) {
+		nameTransform.EnableDirIVAuth()
+	}
+	root := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+	var dedupStore *dedup.Store
+	if cf.IsFeatureFlagSet(configfile.FlagDedup) {
+		dedupStore = dedup.New(masterkey, cipherdir, cEnc)
+		root.EnableDedup(dedupStore)
+	}
+	gofsOpts := &gofs.Options{
+		NullPermissions: true,
+		RootStableAttr:  &gofs.StableAttr{Ino: root.RootIno()},
+		Logger:          log.New(os.Stderr, "go-fuse: ", log.Lmicroseconds),
+	}
+	return &Vault{
+		fs:    rawfs.New(gofs.NewNodeFS(root, gofsOpts), opts.ReadOnly),
+		root:  root,
+		cCore: cCore,
+		dedup: dedupStore,
+	}, nil
+}
+
+// Close wipes the keys from memory. All files must have been closed
+// before. The Vault cannot be used afterwards.
+func (v *Vault) Close() error {
+	v.root.AfterUnmount()
+	v.cCore.Wipe()
+	if v.dedup != nil {
+		v.dedup.Wipe()
+	}
+	return nil
+}
+
+// pathErr wraps a non-nil "err" into a *fs.PathError.
+func pathErr(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// OpenFile opens the named file like os.OpenFile. Directories can be
+// opened read-only to list them with File.Readdir.
+func (v *Vault) OpenFile(name string, flag int, perm fs.FileMode) (*File, error) {
+	f, err := v.fs.OpenFile(context.Background(), name, flag, perm)
+	if err != nil {
+		return nil, pathErr("open", name, err)
+	}
+	return &File{f: f, name: name}, nil
+}
+
+// Open opens the named file or directory for reading.
+func (v *Vault) Open(name string) (*File, error) {
+	return v.OpenFile(name, os.O_RDONLY, 0)
+}
+
+// Create creates or truncates the named file, like os.Create.
+func (v *Vault) Create(name string) (*File, error) {
+	return v.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+// ReadFile returns the contents of the named file.
+func (v *Vault) ReadFile(name string) ([]byte, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile writes "data" to the named file, creating it with permissions
+// "perm" if necessary, like os.WriteFile.
+func (v *Vault) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := v.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// ReadDir returns the entries of the named directory, sorted by name.
+func (v *Vault) ReadDir(name string) ([]fs.FileInfo, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fis, err := f.Readdir(-1)
+	sort.Slice(fis, func(i, j int) bool { return fis[i].Name() < fis[j].Name() })
+	return fis, err
+}
+
+// Mkdir creates a directory.
+func (v *Vault) Mkdir(name string, perm fs.FileMode) error {
+	return pathErr("mkdir", name, v.fs.Mkdir(context.Background(), name, perm))
+}
+
+// Remove removes a file or an empty directory.
+func (v *Vault) Remove(name string) error {
+	return pathErr("remove", name, v.fs.Remove(context.Background(), name))
+}
+
+// RemoveAll removes "name" and everything it contains. It is not an error
+// if "name" does not exist.
+func (v *Vault) RemoveAll(name string) error {
+	return pathErr("removeall", name, v.fs.RemoveAll(context.Background(), name))
+}
+
+// Rename renames (moves) a file or directory. An existing file at
+// "newName" is replaced.
+func (v *Vault) Rename(oldName, newName string) error {
+	if err := v.fs.Rename(context.Background(), oldName, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	return nil
+}
+
+// Stat returns information about the named file. The returned
+// fs.FileInfo reports the plaintext size.
+func (v *Vault) Stat(name string) (fs.FileInfo, error) {
+	fi, err := v.fs.Stat(context.Background(), name)
+	if err != nil {
+		return nil, pathErr("stat", name, err)
+	}
+	return fi, nil
+}
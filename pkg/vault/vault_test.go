@@ -0,0 +1,133 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+var testPw = []byte("test")
+
+// initFS creates a new gocryptfs filesystem like "gocryptfs -init".
+func initFS(t *testing.T) string {
+	dir := t.TempDir()
+	err := configfile.Create(&configfile.CreateArgs{
+		Filename:     filepath.Join(dir, configfile.ConfDefaultName),
+		Password:     testPw,
+		LogN:         10,
+		Creator:      "vault_test",
+		FilenameAuth: true,
+		BlockSize:    4096,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestVault(t *testing.T) {
+	dir := initFS(t)
+	v, err := Open(dir, testPw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Mkdir("d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("vault "), 100000)
+	if err = v.WriteFile("d/f", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite in the middle and grow the file
+	f, err := v.OpenFile("/d/f", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("XYZ"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	copy(content[5000:], "XYZ")
+	if err = f.Truncate(int64(len(content) + 10)); err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, make([]byte, 10)...)
+	buf := make([]byte, 3)
+	if _, err = f.ReadAt(buf, 5000); err != nil || string(buf) != "XYZ" {
+		t.Errorf("ReadAt: %q, %v", buf, err)
+	}
+	if _, err = f.ReadAt(buf, int64(len(content))-1); err != io.EOF {
+		t.Errorf("ReadAt at the end: have %v", err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	v.Close()
+
+	// Reopen and check that everything is there. The names in the
+	// cipherdir are encrypted.
+	v, err = Open(dir, testPw, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	have, err := v.ReadFile("d/f")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Fatalf("ReadFile: err=%v len=%d, want len=%d", err, len(have), len(content))
+	}
+	if _, err = os.Stat(filepath.Join(dir, "d")); !os.IsNotExist(err) {
+		t.Errorf("plaintext name in cipherdir: %v", err)
+	}
+	fis, err := v.ReadDir("d")
+	if err != nil || len(fis) != 1 || fis[0].Name() != "f" || fis[0].Size() != int64(len(content)) {
+		t.Errorf("ReadDir: err=%v fis=%v", err, fis)
+	}
+	if err = v.Rename("d/f", "g"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.Stat("d/f"); !os.IsNotExist(err) {
+		t.Errorf("Stat after rename: have %v", err)
+	}
+	if err = v.Remove("d"); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.RemoveAll("missing"); err != nil {
+		t.Errorf("RemoveAll: %v", err)
+	}
+	if _, err = v.Open("../../etc/passwd"); !os.IsNotExist(err) {
+		t.Errorf("names must not leave the filesystem: have %v", err)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	dir := initFS(t)
+	if _, err := Open(dir, []byte("wrong"), nil); err == nil {
+		t.Fatal("Open with the wrong password should fail")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := initFS(t)
+	v, err := Open(dir, testPw, &Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if err = v.WriteFile("f", nil, 0600); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("WriteFile: have %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/processhardening"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// runAsUser is the parsed and looked-up version of "-run-as"
+type runAsUser struct {
+	uid, gid int
+	groups   []int
+}
+
+// lookupRunAs resolves a user name or numeric uid to uid, primary gid and
+// supplementary groups. This must happen before the Landlock sandbox is
+// active, as it reads /etc/passwd and /etc/group.
+func lookupRunAs(name string) (*runAsUser, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if _, numErr := strconv.Atoi(name); numErr != nil {
+			return nil, err
+		}
+		u, err = user.LookupId(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	r := &runAsUser{}
+	if r.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, err
+	}
+	if r.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		// Not fatal, we just won't have supplementary groups
+		tlog.Warn.Printf("-run-as: could not get groups of %q: %v", name, err)
+	}
+	for _, g := range gids {
+		gid, err := strconv.Atoi(g)
+		if err != nil {
+			return nil, err
+		}
+		r.groups = append(r.groups, gid)
+	}
+	if r.uid == 0 {
+		return nil, fmt.Errorf("refusing to run as uid 0")
+	}
+	return r, nil
+}
+
+// preserveOwner returns true when we create files as the accessing user.
+// This is the case if allow_other is set and we run as root,
+// except when -force_owner is set, because in this case the user may
+// not have write permissions. And the point of -force_owner is to map uids,
+// so we want the files on the backing dir to get the uid the gocryptfs process
+// is running as.
+// With -run-as, the files get the uid of the -run-as user.
+func preserveOwner(args *argContainer) bool {
+	return args.allow_other && os.Getuid() == 0 && args._forceOwner == nil && args._runAs == nil
+}
+
+// keepCapabilities returns the capabilities a root daemon needs to serve
+// the filesystem.
+func keepCapabilities(args *argContainer) (keep []int) {
+	// Access and manage the files in CIPHERDIR, which may belong to other
+	// users.
+	keep = []int{
+		processhardening.CapChown,
+		processhardening.CapDACOverride,
+		processhardening.CapDACReadSearch,
+		processhardening.CapFowner,
+		processhardening.CapFsetid,
+	}
+	if preserveOwner(args) {
+		// Switch to the accessing user when creating files
+		keep = append(keep, processhardening.CapSetuid, processhardening.CapSetgid)
+	}
+	if args.dev {
+		keep = append(keep, processhardening.CapMknod)
+	}
+	return keep
+}
+
+// dropPrivileges switches to the "-run-as" user, or, if we run as root,
+// drops all capabilities the daemon does not need.
+// Unmounting needs root, so an unmount helper is started beforehand if
+// Landlock has not done so already.
+// Errors are not fatal, except when -run-as was requested. In this case, we
+// unmount and exit.
+func dropPrivileges(args *argContainer, srv *fuse.Server) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	if mountHelper == nil {
+		helper, err := startUnmountHelper(args.mountpoint)
+		if err != nil {
+			if args._runAs != nil {
+				tlog.Fatal.Printf("-run-as: could not start unmount helper: %v", err)
+				unmount(srv, args.mountpoint)
+				os.Exit(exitcodes.Privileges)
+			}
+			tlog.Warn.Printf("Could not start unmount helper, keeping privileges: %v", err)
+			return
+		}
+		mountHelper = helper
+	}
+	ph := processhardening.New()
+	if args._runAs != nil {
+		r := args._runAs
+		err := ph.SwitchUser(r.uid, r.gid, r.groups)
+		if err != nil {
+			tlog.Fatal.Printf("-run-as: %v", err)
+			unmount(srv, args.mountpoint)
+			os.Exit(exitcodes.Privileges)
+		}
+		return
+	}
+	err := ph.DropCapabilities(keepCapabilities(args))
+	if errors.Is(err, processhardening.ErrCapabilitiesUnsupported) {
+		tlog.Debug.Printf("%v", err)
+	} else if err != nil {
+		tlog.Warn.Printf("Could not drop capabilities: %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/keyholder"
+	"github.com/rfjakob/gocryptfs/v2/internal/processhardening"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// startKeyholder starts the "-privsep" key-holder process and hands the
+// master key to it.
+// Calls os.Exit on errors.
+func startKeyholder(args *argContainer, masterkey []byte, p keyholder.Params) *keyholder.Client {
+	// The key-holder applies the same sandboxing options as we do
+	var extraArgs []string
+	if args.no_seccomp {
+		extraArgs = append(extraArgs, "-no-seccomp")
+	}
+	if args.seccomp_strict {
+		extraArgs = append(extraArgs, "-seccomp-strict")
+	}
+	if args.no_landlock {
+		extraArgs = append(extraArgs, "-no-landlock")
+	}
+	if args.run_as != "" {
+		extraArgs = append(extraArgs, "-run-as", args.run_as)
+	}
+	kh, err := keyholder.Start(masterkey, p, extraArgs)
+	if err != nil {
+		tlog.Fatal.Printf("privsep: could not start key-holder: %v", err)
+		os.Exit(exitcodes.KeyHolder)
+	}
+	return kh
+}
+
+// runKeyholder is the main function of the key-holder process. It receives
+// the master key on fd 3 and answers crypto requests until the FUSE server
+// closes the connection.
+// Does not return.
+func runKeyholder(args *argContainer) {
+	// CTRL-C is delivered to the whole process group. We must stay alive
+	// until the FUSE server has unmounted and closes the connection.
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+	ph := processhardening.New()
+	// Like the FUSE server, give up root. The key-holder needs no
+	// capabilities at all.
+	if args.run_as != "" {
+		r, err := lookupRunAs(args.run_as)
+		if err == nil {
+			err = ph.SwitchUser(r.uid, r.gid, r.groups)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("keyholder: -run-as: %v", err)
+			os.Exit(exitcodes.Privileges)
+		}
+	} else if os.Geteuid() == 0 {
+		err := ph.DropCapabilities(nil)
+		if err != nil && !errors.Is(err, processhardening.ErrCapabilitiesUnsupported) {
+			tlog.Warn.Printf("keyholder: could not drop capabilities: %v", err)
+		}
+	}
+	// The key-holder needs no filesystem access at all
+	if !args.no_landlock {
+		err := ph.InstallLandlock(processhardening.LandlockRules{})
+		if errors.Is(err, processhardening.ErrLandlockUnsupported) {
+			tlog.Debug.Printf("keyholder: Landlock: %v", err)
+		} else if err != nil {
+			tlog.Warn.Printf("keyholder: could not enable Landlock sandbox: %v", err)
+		}
+	}
+	if !args.no_seccomp {
+		err := ph.InstallSeccomp(args.seccomp_strict)
+		if err != nil {
+			tlog.Warn.Printf("keyholder: could not install seccomp filter: %v", err)
+		}
+	}
+	err := keyholder.Serve(os.NewFile(3, "keyholder"))
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.KeyHolder)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/testvectors"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// "-selftest-vectors" actions
+const (
+	vectorsGenerate = "generate"
+	vectorsVerify   = "verify"
+)
+
+// selftestVectors implements "-selftest-vectors generate|verify FILE".
+// "generate" writes the known-answer test vectors of this build to FILE,
+// "verify" checks this build against the vectors in FILE. FILE can be "-"
+// for stdout or stdin.
+// Does not return (calls os.Exit both on success and on error).
+func selftestVectors(args *argContainer) {
+	if flagSet.NArg() != 1 {
+		tlog.Fatal.Printf("Usage: %s -selftest-vectors generate|verify FILE", tlog.ProgramName)
+		os.Exit(exitcodes.Usage)
+	}
+	path := flagSet.Arg(0)
+	if args.selftest_vectors == vectorsGenerate {
+		writeVectors(path)
+	}
+	var f testvectors.File
+	in := os.Stdin
+	if path != "-" {
+		var err error
+		in, err = os.Open(path)
+		if err != nil {
+			tlog.Fatal.Printf("-selftest-vectors: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+		defer in.Close()
+	}
+	if err := json.NewDecoder(in).Decode(&f); err != nil {
+		tlog.Fatal.Printf("-selftest-vectors: cannot parse %s: %v", path, err)
+		os.Exit(exitcodes.TestVectors)
+	}
+	r, err := testvectors.Verify(&f)
+	if err != nil {
+		tlog.Fatal.Printf("-selftest-vectors: %s: %v", path, err)
+		os.Exit(exitcodes.TestVectors)
+	}
+	for _, failure := range r.Failures {
+		tlog.Warn.Printf("%s", failure)
+	}
+	if len(r.Skipped) > 0 {
+		tlog.Info.Printf("Not available in this build, skipped: %s", strings.Join(r.Skipped, ", "))
+	}
+	if len(r.Failures) > 0 {
+		tlog.Fatal.Printf("-selftest-vectors: %d of %d vectors do not match, the on-disk format of this build differs from %s",
+			len(r.Failures), r.Checked, f.Creator)
+		os.Exit(exitcodes.TestVectors)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"All %d vectors of %d suites, created by %s, match. Checked backends: %s"+tlog.ColorReset,
+		r.Checked, len(f.Suites), f.Creator, strings.Join(r.Backends, ", "))
+	os.Exit(0)
+}
+
+// writeVectors writes the vectors of this build to "path", or to stdout if
+// it is "-".
+// Does not return (calls os.Exit both on success and on error).
+func writeVectors(path string) {
+	f := testvectors.Generate(tlog.ProgramName + " " + GitVersion)
+	j, err := json.MarshalIndent(f, "", "\t")
+	if err != nil {
+		tlog.Fatal.Printf("-selftest-vectors: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	j = append(j, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(j)
+	} else {
+		err = os.WriteFile(path, j, 0644)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-selftest-vectors: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if path != "-" {
+		tlog.Info.Printf("Wrote %d suites to %s", len(f.Suites), path)
+	}
+	os.Exit(0)
+}
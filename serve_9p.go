@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/p9srv"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// serve9P implements "gocryptfs -serve-9p ADDR CIPHERDIR". Instead of
+// mounting, the plaintext view is served over 9P2000.L. ADDR is a TCP
+// address, or the path of a unix socket if it contains a slash.
+// Does not return.
+func serve9P(args *argContainer) {
+	// Open the socket before asking for the password, so we can error out
+	// early.
+	var ln net.Listener
+	var err error
+	if strings.Contains(args.serve_9p, "/") {
+		// Only we may connect to the socket. 9P has no authentication.
+		oldMask := syscall.Umask(0077)
+		ln, err = net.Listen("unix", args.serve_9p)
+		syscall.Umask(oldMask)
+	} else {
+		ln, err = net.Listen("tcp", args.serve_9p)
+		if host, _, _ := net.SplitHostPort(args.serve_9p); err == nil && !isLoopback(host) {
+			tlog.Warn.Printf("Warning: serving 9P on %q without authentication or encryption. Anyone on the network can access the plaintext.",
+				args.serve_9p)
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-serve-9p: %v", err)
+		os.Exit(exitcodes.NineP)
+	}
+	doctorWarn(args)
+	raw, rootNode, wipeKeys := initRawFS(args)
+	srv := p9srv.New(raw, serveReadOnly(args))
+	// Shut down gracefully on SIGINT and SIGTERM so open files are closed
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		srv.Close()
+	}()
+	tlog.Info.Println(tlog.ColorGreen + "Serving 9P2000.L on " + ln.Addr().Network() + ":" + ln.Addr().String() + tlog.ColorReset)
+	err = srv.Serve(ln)
+	// Serve returns as soon as the listener is closed. Wait until all
+	// files have been released.
+	srv.Close()
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		x.AfterUnmount()
+	}
+	wipeKeys()
+	if err != nil {
+		tlog.Fatal.Printf("-serve-9p: %v", err)
+		os.Exit(exitcodes.NineP)
+	}
+	os.Exit(0)
+}
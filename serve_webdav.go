@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/webdavsrv"
+)
+
+// serveWebdav implements "gocryptfs -serve-webdav ADDR CIPHERDIR". Instead
+// of mounting, the plaintext view is served over WebDAV. Does not return.
+func serveWebdav(args *argContainer) {
+	// Read the credentials and open the socket before asking for the
+	// password, so we can error out early.
+	var authPw []byte
+	if args.webdav_user != "" {
+		var err error
+		authPw, err = readpassword.Once(nil, []string{args.webdav_passfile}, "")
+		if err != nil {
+			tlog.Fatal.Printf("-webdav-passfile: %v", err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+	}
+	ln, err := net.Listen("tcp", args.serve_webdav)
+	if err != nil {
+		tlog.Fatal.Printf("-serve-webdav: %v", err)
+		os.Exit(exitcodes.WebDAV)
+	}
+	if host, _, _ := net.SplitHostPort(args.serve_webdav); args.webdav_tls_cert == "" && !isLoopback(host) {
+		tlog.Warn.Printf("Warning: serving unencrypted WebDAV on %q. Anyone on the network can read the plaintext.",
+			args.serve_webdav)
+	}
+	doctorWarn(args)
+	raw, rootNode, wipeKeys := initRawFS(args)
+	var handler http.Handler = &webdav.Handler{
+		FileSystem: webdavsrv.New(raw, serveReadOnly(args)),
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				tlog.Debug.Printf("webdav: %s %q: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	if args.webdav_user != "" {
+		handler = basicAuth(handler, args.webdav_user, authPw)
+	}
+	srv := &http.Server{Handler: handler}
+	// Shut down gracefully on SIGINT and SIGTERM so open files are closed
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		srv.Shutdown(context.Background())
+	}()
+	scheme := "http"
+	if args.webdav_tls_cert != "" {
+		scheme = "https"
+	}
+	tlog.Info.Println(tlog.ColorGreen + "Serving WebDAV on " + scheme + "://" + ln.Addr().String() + "/" + tlog.ColorReset)
+	if args.webdav_tls_cert != "" {
+		err = srv.ServeTLS(ln, args.webdav_tls_cert, args.webdav_tls_key)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		x.AfterUnmount()
+	}
+	wipeKeys()
+	if err != http.ErrServerClosed {
+		tlog.Fatal.Printf("-serve-webdav: %v", err)
+		os.Exit(exitcodes.WebDAV)
+	}
+	os.Exit(0)
+}
+
+// initRawFS sets up the FUSE frontend like for mounting, and returns the
+// go-fuse node tree without a kernel mount. The caller must call
+// AfterUnmount (if implemented) and wipeKeys when done.
+func initRawFS(args *argContainer) (raw fuse.RawFileSystem, rootNode fs.InodeEmbedder, wipeKeys func()) {
+	rootNode, wipeKeys = initFuseFrontend(args)
+	opts := &fs.Options{
+		NullPermissions: true,
+		RootStableAttr:  &fs.StableAttr{Ino: rootNode.(RootInoer).RootIno()},
+		Logger:          log.New(os.Stderr, "go-fuse: ", log.Lmicroseconds),
+	}
+	return fs.NewNodeFS(rootNode, opts), rootNode, wipeKeys
+}
+
+// serveReadOnly returns true if the served view must be read-only. When
+// mounting, the kernel enforces this through the "ro" mount option.
+func serveReadOnly(args *argContainer) bool {
+	return args.ro || (args.reverse && !args.reverse_rw)
+}
+
+// isLoopback returns true if "host" is "localhost" or a loopback address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// basicAuth wraps "h" so that it requires HTTP basic authentication.
+func basicAuth(h http.Handler, user string, pw []byte) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		// Compare both so the timing does not tell which one was wrong
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		pwOk := subtle.ConstantTimeCompare([]byte(p), pw) == 1
+		if !ok || !userOk || !pwOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gocryptfs"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/rawfs"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/share"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// shareFile implements "-share PATH": it writes the file PATH, relative to
+// the root of the plaintext view, to "-share-out FILE", encrypted with a
+// new random key, and that key to FILE.token, wrapped for the recipient.
+// The recipient is the public key "-share-to", or a password that is asked
+// for (or read from "-share-passfile"). gocryptfs-share decrypts it.
+// Does not return (calls os.Exit both on success and on error).
+func shareFile(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-share cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	plainPath := ctlsocksrv.SanitizePath(args.share)
+	if plainPath == "" || args.share_out == "" {
+		tlog.Fatal.Printf("Usage: %s -share PATH -share-out FILE [-share-to KEY] CIPHERDIR", tlog.ProgramName)
+		os.Exit(exitcodes.Usage)
+	}
+	var publicKey []byte
+	if args.share_to != "" {
+		var err error
+		if publicKey, err = share.ParseKey(share.PublicKeyPrefix, args.share_to); err != nil {
+			tlog.Fatal.Printf("-share-to: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	tokenPath := args.share_out + share.TokenSuffix
+	for _, p := range []string{args.share_out, tokenPath} {
+		if _, err := os.Lstat(p); err == nil {
+			tlog.Fatal.Printf("-share-out: %s already exists", p)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	key := share.NewKey()
+	err := shareExport(args, plainPath, key)
+	if err != nil {
+		tlog.Fatal.Printf("-share: %s: %v", plainPath, err)
+		os.Exit(exitcodes.Other)
+	}
+	var token *share.Token
+	if publicKey != nil {
+		token, err = share.WrapX25519(key, publicKey)
+	} else {
+		tlog.Info.Printf("Choose a password for the recipient of %s.", plainPath)
+		var pw []byte
+		var passfile []string
+		if args.share_passfile != "" {
+			passfile = []string{args.share_passfile}
+		}
+		pw, err = readpassword.Twice(nil, passfile)
+		if err == nil && len(pw) == 0 {
+			tlog.Fatal.Printf("The password cannot be empty")
+			os.Remove(args.share_out)
+			os.Exit(exitcodes.ReadPassword)
+		}
+		if err == nil {
+			token = share.WrapPassword(key, pw, args.scryptn)
+		}
+		for i := range pw {
+			pw[i] = 0
+		}
+	}
+	for i := range key {
+		key[i] = 0
+	}
+	if err == nil {
+		err = os.WriteFile(tokenPath, token.Marshal(), 0600)
+	}
+	if err != nil {
+		os.Remove(args.share_out)
+		tlog.Fatal.Printf("-share: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	tlog.Info.Printf("Exported %s to %s, the token is %s. Open it with gocryptfs-share.",
+		plainPath, args.share_out, tokenPath)
+	os.Exit(0)
+}
+
+// shareExport encrypts the plaintext of "plainPath" with "key" into
+// "-share-out". Nothing is left behind on error.
+func shareExport(args *argContainer, plainPath string, key []byte) error {
+	raw, rootNode, wipeKeys := initRawFS(args)
+	defer wipeKeys()
+	if x, ok := rootNode.(AfterUnmounter); ok {
+		defer x.AfterUnmount()
+	}
+	ctx := context.Background()
+	src := rawfs.New(raw, true)
+	in, err := src.OpenFile(ctx, plainPath, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file but %s", fi.Mode().Type())
+	}
+	out, err := os.OpenFile(args.share_out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = share.Encrypt(out, in, key)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		os.Remove(args.share_out)
+	}
+	return err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// shredFile implements "-shred PATH": it destroys the data key of the file
+// PATH, relative to the root of the plaintext view, and deletes the file.
+// Refuses to run while CIPHERDIR is mounted, as the open files of the mount
+// cannot be seen from here; the "Shred" ctlsock request does the same
+// through the mount.
+// Does not return (calls os.Exit both on success and on error).
+func shredFile(args *argContainer) {
+	if args.reverse || args.ro {
+		tlog.Fatal.Printf("-shred cannot be used with -reverse or -ro")
+		os.Exit(exitcodes.Usage)
+	}
+	plainPath := ctlsocksrv.SanitizePath(args.shred)
+	if plainPath == "" {
+		tlog.Fatal.Printf("-shred: empty path")
+		os.Exit(exitcodes.Usage)
+	}
+	_, rootNode, wipeKeys := initRawFS(args)
+	err := rootNode.(*fusefrontend.RootNode).Shred(plainPath)
+	wipeKeys()
+	if err == syscall.ENOTSUP {
+		tlog.Fatal.Printf("-shred: files on this filesystem have no data keys of their own, see -header-v3")
+		os.Exit(exitcodes.Usage)
+	} else if err != nil {
+		tlog.Fatal.Printf("-shred: %s: %v", plainPath, err)
+		os.Exit(exitcodes.Other)
+	}
+	os.Exit(0)
+}
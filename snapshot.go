@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/snapshot"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// createSnapshot implements "-snapshot NAME". No password is needed as
+// everything stays encrypted.
+// Does not return (calls os.Exit both on success and on error).
+func createSnapshot(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-snapshot cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	stats, err := snapshot.Create(args.cipherdir, args.snapshot)
+	if errors.Is(err, snapshot.ErrInvalidName) || errors.Is(err, snapshot.ErrExists) {
+		tlog.Fatal.Printf("-snapshot: %v", err)
+		os.Exit(exitcodes.Usage)
+	} else if err != nil {
+		tlog.Fatal.Printf("-snapshot: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	if stats.Reflinked < stats.Files {
+		tlog.Info.Printf("The filesystem does not support reflinks, %d bytes were copied", stats.Copied)
+	}
+	tlog.Info.Printf("Created snapshot %q of %d files", args.snapshot, stats.Files)
+	os.Exit(0)
+}
+
+// pruneSnapshots implements "-prune-snapshots KEEP".
+// Does not return (calls os.Exit both on success and on error).
+func pruneSnapshots(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-prune-snapshots cannot be used with -reverse")
+		os.Exit(exitcodes.Usage)
+	}
+	deleted, err := snapshot.Prune(args.cipherdir, args.prune_snapshots)
+	for _, n := range deleted {
+		tlog.Info.Printf("Deleted snapshot %q", n)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-prune-snapshots: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	os.Exit(0)
+}
@@ -3,11 +3,16 @@ package cli
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -15,6 +20,9 @@ import (
 	"testing"
 	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
@@ -48,6 +56,39 @@ func TestInit(t *testing.T) {
 	}
 }
 
+// Test -info -json
+func TestInfoJSON(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-argon2id")
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-info", "-json", dir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		ConfigVersion int    `json:"config_version"`
+		BlockSize     int    `json:"block_size"`
+		FilenameAuth  string `json:"filename_auth"`
+		Keyslots      []struct {
+			Type     string
+			KDF      string
+			Argon2id *struct {
+				MemoryKiB uint32 `json:"memory_kib"`
+			}
+		}
+		LastFsck *struct{} `json:"last_fsck"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if info.ConfigVersion != configfile.ConfigVersionCurrent || info.BlockSize != 4096 ||
+		info.FilenameAuth != "embedded" || info.LastFsck != nil {
+		t.Errorf("wrong output: %s", out)
+	}
+	if len(info.Keyslots) != 1 || info.Keyslots[0].Type != "password" || info.Keyslots[0].KDF != "argon2id" ||
+		info.Keyslots[0].Argon2id == nil || info.Keyslots[0].Argon2id.MemoryKiB == 0 {
+		t.Errorf("wrong keyslots: %s", out)
+	}
+}
+
 // Test that gocryptfs.conf and gocryptfs.diriv are there with the expected
 // permissions after -init
 func TestInitFilePerms(t *testing.T) {
@@ -211,12 +252,30 @@ func cp(t *testing.T, src string, dst string) {
 	}
 }
 
+// removeConfigCopies deletes the signed backup copies of gocryptfs.conf and
+// the master key fingerprint in CIPHERDIR "dir", like on a filesystem
+// created by an older version. Used after overwriting gocryptfs.conf with cp.
+func removeConfigCopies(t *testing.T, dir string) {
+	conf := dir + "/" + configfile.ConfDefaultName
+	for _, f := range []string{conf + configfile.HMACSuffix, conf + configfile.BackupSuffix,
+		conf + configfile.BackupSuffix + configfile.HMACSuffix} {
+		if err := os.Remove(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.RemoveAll(dir + "/" + configfile.MetaDirName); err != nil {
+		t.Fatal(err)
+	}
+	unix.Lremovexattr(dir+"/"+nametransform.DirIVFilename, nametransform.FingerprintXattr)
+}
+
 // Test -passwd with -masterkey
 func TestPasswdMasterkey(t *testing.T) {
 	// Create FS
 	dir := test_helpers.InitFS(t)
 	// Overwrite with config with known master key
 	cp(t, "gocryptfs.conf.b9e5ba23", dir+"/gocryptfs.conf")
+	removeConfigCopies(t, dir)
 	// Add content
 	mnt := dir + ".mnt"
 	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
@@ -265,6 +324,7 @@ func TestPasswdMasterkeyStdin(t *testing.T) {
 	dir := test_helpers.InitFS(t)
 	// Overwrite with config with known master key
 	cp(t, "gocryptfs.conf.b9e5ba23", dir+"/gocryptfs.conf")
+	removeConfigCopies(t, dir)
 	// Add content
 	mnt := dir + ".mnt"
 	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
@@ -608,6 +668,293 @@ func TestMissingOArg(t *testing.T) {
 	}
 }
 
+// Unknown or unsupported "-macos-backend" values must be rejected
+func TestMacosBackendInvalid(t *testing.T) {
+	for _, b := range []string{"nfs", "foo"} {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-macos-backend", b, "foo", "bar")
+		err := cmd.Run()
+		exitCode := test_helpers.ExtractCmdExitCode(err)
+		if exitCode != exitcodes.Usage {
+			t.Errorf("%q: this should have failed with code %d, but returned %d",
+				b, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+// Wrong "-import" invocations must be rejected before asking for passwords
+func TestImportInvalid(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	for _, args := range [][]string{
+		{"-import", "zfs", dir, dir},
+		{"-import", "encfs", dir},
+		{"-import", "encfs", "-reverse", dir, dir},
+		{"-import-passfile", "/dev/null", dir},
+		{"-import", "fscrypt", dir, dir},
+	} {
+		err := exec.Command(test_helpers.GocryptfsBinary, args...).Run()
+		exitCode := test_helpers.ExtractCmdExitCode(err)
+		if exitCode != exitcodes.Usage {
+			t.Errorf("%q: this should have failed with code %d, but returned %d",
+				args, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+func TestExportFscryptInvalid(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	for _, args := range [][]string{
+		{"-export-fscrypt", dir, dir},
+		{"-fscrypt-key", "/dev/null", dir},
+		{"-export-fscrypt", dir, "-fscrypt-key", "/dev/null", "-reverse", dir},
+		{"-export-fscrypt", dir, "-fscrypt-key", "/dev/null", "-fsck", dir},
+	} {
+		err := exec.Command(test_helpers.GocryptfsBinary, args...).Run()
+		exitCode := test_helpers.ExtractCmdExitCode(err)
+		if exitCode != exitcodes.Usage {
+			t.Errorf("%q: this should have failed with code %d, but returned %d",
+				args, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+func TestCheckNames(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-check-names", dir, dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "Longest plaintext name:  255 bytes") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	err = exec.Command(test_helpers.GocryptfsBinary, "-check-names", "-reverse", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("-reverse: this should have failed with code %d, but returned %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// -stable-inodes cannot be used with -reverse or -sharedstorage
+func TestStableInodesInvalid(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	for _, opt := range []string{"-reverse", "-sharedstorage"} {
+		err := exec.Command(test_helpers.GocryptfsBinary, "-stable-inodes", opt, "-extpass", "echo test", dir, dir+".mnt").Run()
+		if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+			t.Errorf("%s: this should have failed with code %d, but returned %d", opt, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+func TestSuperviseReverse(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	err := exec.Command(test_helpers.GocryptfsBinary, "-supervise", "-reverse", "-extpass", "echo test", dir, dir+".mnt").Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("this should have failed with code %d, but returned %d", exitcodes.Usage, exitCode)
+	}
+}
+
+func TestOnCorruptionInvalid(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	for _, opts := range [][]string{{"-on-corruption", "panic"}, {"-corruption-limit", "0"}} {
+		args := append(opts, "-extpass", "echo test", dir, dir+".mnt")
+		err := exec.Command(test_helpers.GocryptfsBinary, args...).Run()
+		if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+			t.Errorf("%v: this should have failed with code %d, but returned %d", opts, exitcodes.Usage, exitCode)
+		}
+	}
+}
+
+func TestCheckNormalization(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-check-normalization", "-extpass", "echo test", dir).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "0 names are in NFC") {
+		t.Errorf("unexpected output: %s", out)
+	}
+	err = exec.Command(test_helpers.GocryptfsBinary, "-nfc", "-nfd", "-check-normalization", "-extpass", "echo test", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("-nfc -nfd: this should have failed with code %d, but returned %d", exitcodes.Usage, exitCode)
+	}
+}
+
+func TestDaemonInvalid(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	// -ctlsock is missing
+	err := exec.Command(test_helpers.GocryptfsBinary, "-daemon", dir+"/gocryptfs.conf").Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("want exit code %d, have %d", exitcodes.Usage, exitCode)
+	}
+	// The config file is not a PROFILES file
+	err = exec.Command(test_helpers.GocryptfsBinary, "-daemon", "-ctlsock", dir+".sock", dir+"/gocryptfs.conf").Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Profiles {
+		t.Errorf("want exit code %d, have %d", exitcodes.Profiles, exitCode)
+	}
+}
+
+// Test the vault requests of "-daemon" that work without mounting
+func TestDaemon(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	profiles := dir + ".json"
+	profile := fmt.Sprintf(`{"Vaults": [{"Name": "a", "Cipherdir": %q, "Mountpoint": %q}]}`, dir, mnt)
+	if err := os.WriteFile(profiles, []byte(profile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sock := dir + ".sock"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-daemon", "-ctlsock", sock, profiles)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+	for i := 0; ; i++ {
+		if _, err := os.Stat(sock); err == nil {
+			break
+		}
+		if i > 100 {
+			t.Fatal("timeout waiting for the control socket")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Handshake: true})
+	if resp.Handshake == nil || !resp.Handshake.HasFeature(ctlsock.FeatureDaemon) || !resp.Handshake.Supports("VaultMount") {
+		t.Errorf("Handshake: %+v", resp)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{VaultList: true})
+	if len(resp.Vaults) != 1 || resp.Vaults[0].Name != "a" || resp.Vaults[0].State != "unmounted" || resp.Vaults[0].Mountpoint != mnt {
+		t.Errorf("VaultList: %+v", resp)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{VaultMount: "a", Password: "wrong"})
+	if resp.ErrText != "Password incorrect." {
+		t.Errorf("mount with wrong password: %+v", resp)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{VaultStatus: "a"})
+	if len(resp.Vaults) != 1 || resp.Vaults[0].LastError != "Password incorrect." {
+		t.Errorf("VaultStatus: %+v", resp)
+	}
+	// Requests for a filesystem need a mounted vault
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Vault: "a", EncryptPath: "foo"})
+	if resp.ErrNo == 0 {
+		t.Errorf("EncryptPath on an unmounted vault: %+v", resp)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{VaultMount: "nonexistent"})
+	if resp.ErrNo == 0 {
+		t.Errorf("mounting a nonexistent vault: %+v", resp)
+	}
+	// Change the password with the typed client
+	c, err := ctlsock.Connect(context.Background(), sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.ChangePassword(context.Background(), "a", []byte("wrong"), []byte("new")); err == nil {
+		t.Error("ChangePassword with the wrong password should fail")
+	}
+	if err := c.ChangePassword(context.Background(), "a", testPw, []byte("new")); err != nil {
+		t.Error(err)
+	}
+	if _, _, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, []byte("new")); err != nil {
+		t.Errorf("new password does not work: %v", err)
+	}
+	if st, err := c.Stat(context.Background(), "a"); err != nil || st.State != "unmounted" {
+		t.Errorf("Stat: %+v, %v", st, err)
+	}
+	cmd.Process.Signal(syscall.SIGTERM)
+	err = cmd.Wait()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.SigInt {
+		t.Errorf("want exit code %d, have %d", exitcodes.SigInt, exitCode)
+	}
+	if _, err := os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("control socket has not been deleted: %v", err)
+	}
+}
+
+// startDaemon starts "gocryptfs -daemon" through "bash -c", with the extra
+// file "extra" as fd 3, and waits until the control socket at "sock" answers
+func startDaemon(t *testing.T, sock string, ctlsockArg string, extra *os.File) *exec.Cmd {
+	dir := test_helpers.InitFS(t)
+	profiles := dir + ".json"
+	profile := fmt.Sprintf(`{"Vaults": [{"Name": "a", "Cipherdir": %q, "Mountpoint": %q}]}`, dir, dir+".mnt")
+	if err := os.WriteFile(profiles, []byte(profile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// LISTEN_PID must be the pid of gocryptfs, which is known only in the
+	// shell that exec's it
+	bashLine := fmt.Sprintf("LISTEN_PID=$$ exec %s -daemon -ctlsock %s %s", test_helpers.GocryptfsBinary, ctlsockArg, profiles)
+	cmd := exec.Command("bash", "-c", bashLine)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if extra != nil {
+		cmd.ExtraFiles = []*os.File{extra}
+		cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "LISTEN_FDNAMES=ctl")
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		c, err := ctlsock.Connect(ctx, sock)
+		if err == nil {
+			_, err = c.Do(ctx, &ctlsock.RequestStruct{VaultList: true})
+			c.Close()
+		}
+		cancel()
+		if err == nil {
+			break
+		}
+		if i > 100 {
+			cmd.Process.Kill()
+			t.Fatalf("timeout waiting for the control socket: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return cmd
+}
+
+// stopDaemon sends SIGTERM and checks the exit code
+func stopDaemon(t *testing.T, cmd *exec.Cmd) {
+	cmd.Process.Signal(syscall.SIGTERM)
+	err := cmd.Wait()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.SigInt {
+		t.Errorf("want exit code %d, have %d", exitcodes.SigInt, exitCode)
+	}
+}
+
+// -ctlsock @NAME uses an abstract socket, without a socket file
+func TestDaemonAbstractSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract sockets are Linux-only")
+	}
+	sock := fmt.Sprintf("@gocryptfs-test-%d", os.Getpid())
+	cmd := startDaemon(t, sock, sock, nil)
+	stopDaemon(t, cmd)
+}
+
+// -ctlsock systemd:NAME uses the socket passed by systemd socket activation
+func TestDaemonSystemdSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.UnixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cmd := startDaemon(t, sock, "systemd:ctl", f)
+	stopDaemon(t, cmd)
+	// The socket belongs to systemd, gocryptfs must not delete it
+	if _, err := os.Stat(sock); err != nil {
+		t.Error(err)
+	}
+}
+
 // -exclude must return an error in forward mode
 func TestExcludeForward(t *testing.T) {
 	dir := test_helpers.InitFS(t)
@@ -800,7 +1147,7 @@ func TestBadname(t *testing.T) {
 		t.Fatal(err)
 	}
 	for _, ciphername := range ciphernames {
-		if ciphername != "gocryptfs.conf" && ciphername != "gocryptfs.diriv" {
+		if !strings.HasPrefix(ciphername, "gocryptfs.") && ciphername != configfile.MetaDirName {
 			encryptedfilename = ciphername
 			// found cipher name of "file"
 			break
@@ -1093,3 +1440,222 @@ func TestOrphanedSocket(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, mnt, "-extpass", "echo test", "-wpanic=false", "-ctlsock", ctlSock)
 	test_helpers.UnmountPanic(mnt)
 }
+
+// Test that "-migrate-filenameauth" enables filename authentication on a
+// filesystem that was created without it
+func TestMigrateFilenameAuth(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-no-filename-auth")
+	mnt := dir + ".mnt"
+	long := strings.Repeat("x", 200)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.MkdirAll(mnt+"/dir1/"+long, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(mnt+"/dir1/"+long+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-migrate-filenameauth", "-extpass=echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagFilenameAuth) || !c.IsFeatureFlagSet(configfile.FlagFilenameAuthEmbedded) {
+		t.Errorf("feature flags not set: %v", c.FeatureFlags)
+	}
+	if _, err = os.Stat(dir + "/gocryptfs.migrate-filenameauth.journal"); !os.IsNotExist(err) {
+		t.Errorf("journal should have been deleted: %v", err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if _, err = os.Stat(mnt + "/dir1/" + long + "/file"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestXattrAuth checks that with -xattr-auth, an encrypted xattr value that
+// is copied to another file in the ciphertext directory is rejected.
+func TestXattrAuth(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-xattr-auth")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-wpanic=false")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, n := range []string{"a", "b"} {
+		if err := os.WriteFile(mnt+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := unix.Setxattr(mnt+"/"+n, "user.foo", []byte("value of "+n), 0); err != nil {
+			if err == syscall.EOPNOTSUPP {
+				t.Skip("xattrs not supported on the backing filesystem")
+			}
+			t.Fatal(err)
+		}
+	}
+	// Find the two ciphertext files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFiles []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), "gocryptfs.") {
+			cFiles = append(cFiles, dir+"/"+e.Name())
+		}
+	}
+	if len(cFiles) != 2 {
+		t.Fatalf("want 2 ciphertext files, have %v", cFiles)
+	}
+	buf := make([]byte, 1000)
+	sz, err := unix.Listxattr(cFiles[0], buf)
+	if err != nil || sz == 0 {
+		t.Fatalf("Listxattr: %d, %v", sz, err)
+	}
+	cAttr := strings.TrimRight(string(buf[:sz]), "\000")
+	sz, err = unix.Getxattr(cFiles[0], cAttr, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = unix.Setxattr(cFiles[1], cAttr, buf[:sz], 0); err != nil {
+		t.Fatal(err)
+	}
+	// One of the two plaintext files now carries the value of the other
+	for _, n := range []string{"a", "b"} {
+		_, err = unix.Getxattr(mnt+"/"+n, "user.foo", buf)
+		if err == syscall.EIO {
+			return
+		}
+	}
+	t.Errorf("copied xattr value was accepted")
+}
+
+// TestAuthTimes checks that with -auth-times, an mtime that is changed in
+// the ciphertext directory is reported by -fsck and restored with
+// -restore-times.
+func TestAuthTimes(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-auth-times")
+	cf, err := configfile.Load(dir + "/gocryptfs.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cf.IsFeatureFlagSet(configfile.FlagAuthTimes) || !cf.IsFeatureFlagSet(configfile.FlagXattrAuth) {
+		t.Fatalf("wrong feature flags: %v", cf.FeatureFlags)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-wpanic=false")
+	err = os.WriteFile(mnt+"/a", []byte("hello"), 0600)
+	test_helpers.UnmountPanic(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if e.Type().IsRegular() && !strings.HasPrefix(e.Name(), "gocryptfs.") {
+			cFile = dir + "/" + e.Name()
+		}
+	}
+	if _, err = unix.Getxattr(cFile, "user.gocryptfs.times", nil); err == syscall.EOPNOTSUPP {
+		t.Skip("xattrs not supported on the backing filesystem")
+	} else if err != nil {
+		t.Fatalf("mtime was not recorded: %v", err)
+	}
+	old := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err = os.Chtimes(cFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	err = exec.Command(test_helpers.GocryptfsBinary, "-q", "-fsck", "-extpass", "echo test", dir).Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.FsckErrors {
+		t.Errorf("-fsck: want exit code %d, have %d", exitcodes.FsckErrors, exitCode)
+	}
+	runGocryptfs(t, "-fsck", "-restore-times", "-extpass", "echo test", dir)
+	runGocryptfs(t, "-fsck", "-extpass", "echo test", dir)
+	fi, err := os.Stat(cFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.ModTime().Equal(old) {
+		t.Error("mtime was not restored")
+	}
+}
+
+// A file created and deleted through a second mount of the same CIPHERDIR
+// must show up in a mount with -watch-cipherdir, although failed lookups
+// are cached for an hour there
+func TestWatchCipherdir(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt1 := dir + ".mnt1"
+	mnt2 := dir + ".mnt2"
+	test_helpers.MountOrFatal(t, dir, mnt1, "-extpass=echo test", "-watch-cipherdir", "-negative-timeout=1h")
+	defer test_helpers.UnmountPanic(mnt1)
+	test_helpers.MountOrFatal(t, dir, mnt2, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt2)
+	waitFor := func(name string, exists bool) {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat(mnt1 + "/" + name); (err == nil) == exists {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("%s: exists should be %v", name, exists)
+	}
+	waitFor("foo", false)
+	if err := os.WriteFile(mnt2+"/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("foo", true)
+	if err := os.Remove(mnt2 + "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("foo", false)
+	// New directories are watched as well
+	waitFor("dir/foo", false)
+	if err := os.Mkdir(mnt2+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("dir/foo", false)
+	if err := os.WriteFile(mnt2+"/dir/foo", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("dir/foo", true)
+	// A file that is open in mnt1 and rewritten through mnt2, which gives it
+	// a new file ID
+	f, err := os.Open(mnt1 + "/dir/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	buf := make([]byte, 100)
+	if n, _ := f.ReadAt(buf, 0); string(buf[:n]) != "bar" {
+		t.Fatalf("open file: have %q", buf[:n])
+	}
+	if err = os.WriteFile(mnt2+"/dir/foo", []byte("new content"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		var n int
+		n, _ = f.ReadAt(buf, 0)
+		if string(buf[:n]) == "new content" {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("open file: have %q", buf)
+}
+
+func TestWatchCipherdirReverse(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse")
+	err := exec.Command(test_helpers.GocryptfsBinary, "-watch-cipherdir", "-reverse", "-extpass", "echo test", dir, dir+".mnt").Run()
+	if exitCode := test_helpers.ExtractCmdExitCode(err); exitCode != exitcodes.Usage {
+		t.Errorf("this should have failed with code %d, but returned %d", exitcodes.Usage, exitCode)
+	}
+}
@@ -0,0 +1,134 @@
+package cli
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+func runDedup(t *testing.T, dir string) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-dedup", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("-dedup: %v", err)
+	}
+}
+
+// ciphertextSizes returns the sizes of the regular files in the root of
+// CIPHERDIR, without gocryptfs.conf, its backup copies and gocryptfs.diriv.
+func ciphertextSizes(t *testing.T, dir string) (sizes []int64) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), "gocryptfs.") {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, fi.Size())
+	}
+	return sizes
+}
+
+// TestDedup converts two files with the same content with "-dedup", checks
+// that they are readable, and that writing converts a file back.
+func TestDedup(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	content := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(content)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	for _, n := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(mnt, n), content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	runDedup(t, dir)
+	if _, err := os.Stat(filepath.Join(dir, "gocryptfs.dedup")); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range ciphertextSizes(t, dir) {
+		if s > 65536 {
+			t.Errorf("file was not converted: %d bytes", s)
+		}
+	}
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	for _, n := range []string{"a", "b"} {
+		have, err := os.ReadFile(filepath.Join(mnt, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, content) {
+			t.Errorf("%s: content differs", n)
+		}
+		fi, err := os.Stat(filepath.Join(mnt, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(content)) {
+			t.Errorf("%s: wrong size %d", n, fi.Size())
+		}
+	}
+	entries, err := os.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("chunk store is visible: %d entries", len(entries))
+	}
+	// Writing converts "a" back to a regular file
+	f, err := os.OpenFile(filepath.Join(mnt, "a"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("xyz"), 1000); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	copy(content[1000:], "xyz")
+	have, err := os.ReadFile(filepath.Join(mnt, "a"))
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("content differs after write: %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	var big int
+	for _, s := range ciphertextSizes(t, dir) {
+		if s > 65536 {
+			big++
+		}
+	}
+	if big != 1 {
+		t.Errorf("want one regular file, have %d", big)
+	}
+
+	// Run again and check the result
+	runDedup(t, dir)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fsck", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Errorf("-fsck: %v", err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	have, err = os.ReadFile(filepath.Join(mnt, "a"))
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("content differs after second -dedup: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package cli
+
+import (
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestDirectIO writes and reads 4 KiB pages with O_DIRECT, like a database,
+// with all -direct-io policies
+func TestDirectIO(t *testing.T) {
+	for _, policy := range []string{"auto", "always", "never"} {
+		dir := test_helpers.InitFS(t)
+		mnt := dir + ".mnt"
+		test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-direct-io="+policy)
+		fd, err := syscall.Open(mnt+"/db", syscall.O_RDWR|syscall.O_CREAT|syscall.O_DIRECT, 0600)
+		if err != nil {
+			test_helpers.UnmountPanic(mnt)
+			t.Fatalf("%s: %v", policy, err)
+		}
+		// Page-aligned buffer
+		mem := make([]byte, 3*4096)
+		page := mem[4096-int(uintptr(unsafe.Pointer(&mem[0]))%4096):][:4096]
+		for i := 0; i < 8; i++ {
+			for j := range page {
+				page[j] = byte(i + j)
+			}
+			if _, err = syscall.Pwrite(fd, page, int64(i)*4096); err != nil {
+				t.Errorf("%s: write page %d: %v", policy, i, err)
+			}
+		}
+		for i := 7; i >= 0; i-- {
+			if _, err = syscall.Pread(fd, page, int64(i)*4096); err != nil {
+				t.Errorf("%s: read page %d: %v", policy, i, err)
+			}
+			for j := range page {
+				if page[j] != byte(i+j) {
+					t.Errorf("%s: page %d: content mismatch at byte %d", policy, i, j)
+					break
+				}
+			}
+		}
+		syscall.Close(fd)
+		test_helpers.UnmountPanic(mnt)
+	}
+}
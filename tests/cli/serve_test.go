@@ -0,0 +1,158 @@
+package cli
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test "-serve-webdav": write through WebDAV and read back through a
+// regular mount.
+func TestServeWebdav(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	pwfile := dir + ".webdav-pw"
+	if err := os.WriteFile(pwfile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass=echo test",
+		"-serve-webdav=127.0.0.1:0", "-webdav-user=u", "-webdav-passfile="+pwfile, dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Find out which port we got
+	var url string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if i := strings.Index(scanner.Text(), "http://"); i >= 0 {
+			url = strings.Fields(scanner.Text()[i:])[0]
+			break
+		}
+	}
+	go io.Copy(io.Discard, stdout)
+	if url == "" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatal("did not find the WebDAV URL in the output")
+	}
+	do := func(method string, path string, body []byte, auth bool) (int, []byte) {
+		req, err := http.NewRequest(method, url+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if auth {
+			req.SetBasicAuth("u", "secret")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, data
+	}
+	content := bytes.Repeat([]byte("hello webdav "), 1000)
+	if status, _ := do("GET", "", nil, false); status != http.StatusUnauthorized {
+		t.Errorf("no auth: status %d", status)
+	}
+	if status, _ := do("MKCOL", "dir", nil, true); status != http.StatusCreated {
+		t.Errorf("MKCOL: status %d", status)
+	}
+	if status, _ := do("PUT", "dir/file", content, true); status != http.StatusCreated {
+		t.Errorf("PUT: status %d", status)
+	}
+	_, have := do("GET", "dir/file", nil, true)
+	if !bytes.Equal(have, content) {
+		t.Errorf("GET: have %d bytes, want %d", len(have), len(content))
+	}
+	http.DefaultClient.CloseIdleConnections()
+	// Shuts down cleanly on SIGINT
+	cmd.Process.Signal(syscall.SIGINT)
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("exit: %v", err)
+	}
+
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	have, err = os.ReadFile(mnt + "/dir/file")
+	if err != nil || !bytes.Equal(have, content) {
+		t.Errorf("mounted: err=%v, have %d bytes, want %d", err, len(have), len(content))
+	}
+}
+
+// Test "-serve-9p" on a unix socket: only we can connect, the server speaks
+// 9P2000.L, and it exits cleanly on SIGINT.
+func TestServe9P(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	sock := dir + ".9p"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass=echo test",
+		"-serve-9p="+sock, dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// Wait until the server is ready
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "Serving 9P2000.L") {
+			break
+		}
+	}
+	go io.Copy(io.Discard, stdout)
+	defer cmd.Wait()
+	defer cmd.Process.Signal(syscall.SIGINT)
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm()&077 != 0 {
+		t.Errorf("socket mode %v", fi.Mode())
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tversion: size[4] type[1]=100 tag[2]=0xffff msize[4] version[s]
+	req := []byte{0, 0, 0, 0, 100, 0xff, 0xff, 0, 0x20, 0, 0, 8, 0}
+	req = append(req, "9P2000.L"...)
+	binary.LittleEndian.PutUint32(req, uint32(len(req)))
+	if _, err = conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, len(req))
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	// Rversion has the same layout
+	req[4] = 101
+	if !bytes.Equal(reply, req) {
+		t.Errorf("Rversion: have %x, want %x", reply, req)
+	}
+	conn.Close()
+	cmd.Process.Signal(syscall.SIGINT)
+	if err = cmd.Wait(); err != nil {
+		t.Errorf("exit: %v", err)
+	}
+	if _, err = os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket was not removed: %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+func runGocryptfs(t *testing.T, args ...string) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+}
+
+// TestSnapshot creates a snapshot, changes the filesystem, and checks that
+// the snapshot still shows the old state and is read-only.
+func TestSnapshot(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := os.WriteFile(mnt+"/file", []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	runGocryptfs(t, "-snapshot", "one", dir)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	if err := os.WriteFile(mnt+"/file", []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("snapshot dir is visible: %d entries", len(entries))
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-from-snapshot", "one")
+	content, err := os.ReadFile(mnt + "/file")
+	if err != nil || string(content) != "old" {
+		t.Errorf("snapshot content: %q %v", content, err)
+	}
+	if err = os.WriteFile(mnt+"/file2", nil, 0600); err == nil {
+		t.Error("snapshot is writeable")
+	}
+	test_helpers.UnmountPanic(mnt)
+	runGocryptfs(t, "-fsck", "-extpass", "echo test", "-from-snapshot", "one", dir)
+
+	runGocryptfs(t, "-snapshot", "two", dir)
+	runGocryptfs(t, "-prune-snapshots", "1", dir)
+	snapdir := filepath.Join(dir, "gocryptfs.snapshots")
+	if _, err = os.Stat(snapdir + "/one"); !os.IsNotExist(err) {
+		t.Errorf("snapshot one was not pruned: %v", err)
+	}
+	if _, err = os.Stat(snapdir + "/two"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,73 @@
+package cli
+
+import (
+	"encoding/json"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// Test -init -upstream-compat
+func TestInitUpstreamCompat(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-upstream-compat")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UpstreamCompatible(); err != nil {
+		t.Error(err)
+	}
+	if c.IsFeatureFlagSet(configfile.FlagArgon2id) || c.IsFeatureFlagSet(configfile.FlagFilenameAuth) {
+		t.Errorf("FeatureFlags=%v", c.FeatureFlags)
+	}
+
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-info", "-json", dir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		UpstreamCompatible bool     `json:"upstream_compatible"`
+		ForkFeatureFlags   []string `json:"fork_feature_flags"`
+	}
+	if err = json.Unmarshal(out, &info); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !info.UpstreamCompatible || info.ForkFeatureFlags == nil || len(info.ForkFeatureFlags) != 0 {
+		t.Errorf("wrong output: %s", out)
+	}
+
+	// Upgrading the config file would lock out upstream
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-upgrade-config", "-upstream-compat",
+		"-extpass", "echo test", dir)
+	err = cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Upstream {
+		t.Errorf("-upgrade-config: want exit code %d, have %d", exitcodes.Upstream, code)
+	}
+}
+
+// Fork-only options cannot be combined with -upstream-compat
+func TestInitUpstreamCompatConflicts(t *testing.T) {
+	for _, opt := range []string{"-dir-manifest", "-xattr-auth", "-blocksize=16384", "-argon2id"} {
+		dir := t.TempDir()
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-init", "-extpass", "echo test",
+			"-scryptn=10", "-upstream-compat", opt, dir)
+		err := cmd.Run()
+		if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+			t.Errorf("%s: want exit code %d, have %d", opt, exitcodes.Usage, code)
+		}
+	}
+}
+
+// Filesystems created without -upstream-compat are refused with it
+func TestUpstreamCompatRefused(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-upstream-compat", "-passwd",
+		"-extpass", "echo test", dir)
+	err := cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Upstream {
+		t.Errorf("want exit code %d, have %d", exitcodes.Upstream, code)
+	}
+}
@@ -0,0 +1,60 @@
+package defaults
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestAccessPolicy mounts with "-access-policy" and checks that it is
+// enforced for our own user.
+func TestAccessPolicy(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	for _, d := range []string{"secret", "readonly", "readonly/rw"} {
+		if err := os.Mkdir(pDir+"/"+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(pDir+"/"+d+"/file", []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	policy := cDir + ".policy"
+	uid := strconv.Itoa(os.Getuid())
+	err := os.WriteFile(policy, []byte("/secret none *\n/readonly r *\n/readonly/rw rw uid:"+uid+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-access-policy", policy)
+	defer test_helpers.UnmountPanic(pDir)
+
+	if _, err = os.ReadFile(pDir + "/secret/file"); !os.IsPermission(err) {
+		t.Errorf("reading secret: %v", err)
+	}
+	if _, err = os.ReadDir(pDir + "/secret"); !os.IsPermission(err) {
+		t.Errorf("listing secret: %v", err)
+	}
+	if _, err = os.ReadFile(pDir + "/readonly/file"); err != nil {
+		t.Error(err)
+	}
+	if err = os.WriteFile(pDir+"/readonly/file", nil, 0600); !os.IsPermission(err) {
+		t.Errorf("writing readonly: %v", err)
+	}
+	if err = os.WriteFile(pDir+"/readonly/new", nil, 0600); !os.IsPermission(err) {
+		t.Errorf("creating in readonly: %v", err)
+	}
+	if err = os.Rename(pDir+"/readonly/file", pDir+"/moved"); !os.IsPermission(err) {
+		t.Errorf("renaming out of readonly: %v", err)
+	}
+	if err = os.WriteFile(pDir+"/readonly/rw/file", []byte("y"), 0600); err != nil {
+		t.Error(err)
+	}
+	if err = os.WriteFile(pDir+"/unrestricted", nil, 0600); err != nil {
+		t.Error(err)
+	}
+}
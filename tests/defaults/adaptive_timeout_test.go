@@ -0,0 +1,54 @@
+package defaults
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestAdaptiveTimeout checks that with "-adaptive-timeout", changes through
+// the mount show up right away in directories that were quiet before.
+func TestAdaptiveTimeout(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-adaptive-timeout", "1h")
+	defer test_helpers.UnmountPanic(pDir)
+
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pDir+"/dir/a", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Let the directory become quiet so the kernel gets long timeouts
+	time.Sleep(2 * time.Second)
+	st1, err := os.Stat(pDir + "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(pDir + "/dir/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(pDir+"/dir/a", pDir+"/dir/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(pDir + "/dir/a"); !os.IsNotExist(err) {
+		t.Errorf("a: %v", err)
+	}
+	if _, err = os.Stat(pDir + "/dir/b"); err != nil {
+		t.Error(err)
+	}
+	if err = os.Mkdir(pDir+"/dir/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	st2, err := os.Stat(pDir + "/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st2.Sys().(*syscall.Stat_t).Nlink == st1.Sys().(*syscall.Stat_t).Nlink {
+		t.Errorf("stale link count %d", st2.Sys().(*syscall.Stat_t).Nlink)
+	}
+}
@@ -0,0 +1,44 @@
+package defaults
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestBufferArena checks that large reads and writes work with
+// "-buffer-arena", and that the arena statistics show up on the control
+// socket.
+func TestBufferArena(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test", "-buffer-arena", "2")
+	defer test_helpers.UnmountPanic(pDir)
+
+	data := make([]byte, 3*1024*1024+1234)
+	rand.Read(data)
+	fn := pDir + "/file"
+	if err := os.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Metrics: true})
+	if resp.ErrNo != 0 {
+		t.Fatal(resp.ErrText)
+	}
+	if resp.Metrics["bpool_creq_arena_slots"] != 2 {
+		t.Errorf("wrong metrics: %v", resp.Metrics)
+	}
+}
@@ -0,0 +1,90 @@
+package defaults
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestCaseInsensitive checks that names are found in any case with
+// "-case-insensitive", including long names, and that the case is preserved.
+func TestCaseInsensitive(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-case-insensitive")
+	defer test_helpers.UnmountPanic(pDir)
+
+	long := "Long" + strings.Repeat("x", 200)
+	for _, n := range []string{"File.TXT", long} {
+		if err := os.WriteFile(pDir+"/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(pDir+"/Dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(pDir + "/file.txt")
+	if err != nil || string(content) != "File.TXT" {
+		t.Errorf("file.txt: %q %v", content, err)
+	}
+	content, err = os.ReadFile(pDir + "/" + strings.ToUpper(long))
+	if err != nil || string(content) != long {
+		t.Errorf("long name: %v", err)
+	}
+	// Writing through another case must not create a second file
+	if err = os.WriteFile(pDir+"/DIR/a", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(pDir+"/FILE.txt", []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(pDir+"/dir", 0700); !os.IsExist(err) {
+		t.Errorf("mkdir dir: %v", err)
+	}
+	if _, err = os.Stat(pDir + "/dir/A"); err != nil {
+		t.Error(err)
+	}
+	entries, err := os.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if strings.Join(names, "/") != "Dir/File.TXT/"+long {
+		t.Errorf("wrong names: %v", names)
+	}
+	if err = os.Remove(pDir + "/file.TXT"); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(pDir + "/File.TXT"); !os.IsNotExist(err) {
+		t.Errorf("File.TXT still exists: %v", err)
+	}
+}
+
+// TestCaseFold checks that "-case-fold" creates new names in lower case.
+func TestCaseFold(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-case-fold")
+	defer test_helpers.UnmountPanic(pDir)
+
+	if err := os.WriteFile(pDir+"/MixedCase", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "mixedcase" {
+		t.Errorf("wrong entries: %v", entries)
+	}
+	if _, err = os.Stat(pDir + "/MIXEDCASE"); err != nil {
+		t.Error(err)
+	}
+}
@@ -2,6 +2,7 @@ package defaults
 
 import (
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -15,10 +16,15 @@ func TestCtlSock(t *testing.T) {
 	sock := cDir + ".sock"
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Handshake: true})
+	if h := response.Handshake; h == nil || h.ProtocolVersion != ctlsock.ProtocolVersion ||
+		!h.Supports("NameLimits") || h.Supports("TrashList") {
+		t.Errorf("Handshake: %+v", response)
+	}
 	req := ctlsock.RequestStruct{
 		EncryptPath: "foobar",
 	}
-	response := test_helpers.QueryCtlSock(t, sock, req)
+	response = test_helpers.QueryCtlSock(t, sock, req)
 	if response.Result == "" || response.ErrNo != 0 {
 		t.Errorf("got an error reply: %+v", response)
 	}
@@ -96,3 +102,71 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// TestCtlSockNameLimits checks that the NameLimits request reports limits
+// that actually work
+func TestCtlSockNameLimits(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{NameLimits: true})
+	l := resp.NameLimits
+	if resp.ErrNo != 0 || l == nil {
+		t.Fatalf("got an error reply: %+v", resp)
+	}
+	if l.Max != 255 || l.Direct <= 0 || l.Direct >= l.Max || l.BackingMax < l.Direct {
+		t.Errorf("implausible limits: %+v", *l)
+	}
+	for _, n := range []int{l.Direct, l.Max} {
+		if err := os.WriteFile(pDir+"/"+strings.Repeat("x", n), nil, 0600); err != nil {
+			t.Errorf("name of length %d: %v", n, err)
+		}
+	}
+}
+
+// TestCtlSockCryptoConfig changes the parallel crypto configuration at
+// runtime
+func TestCtlSockCryptoConfig(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test", "-crypto-workers=2")
+	defer test_helpers.UnmountPanic(pDir)
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{CryptoConfig: &ctlsock.CryptoConfig{}})
+	c := resp.CryptoConfig
+	if resp.ErrNo != 0 || c == nil {
+		t.Fatalf("got an error reply: %+v", resp)
+	}
+	if *c.Workers != 2 || !*c.Parallel {
+		t.Errorf("wrong configuration: workers=%d parallel=%v", *c.Workers, *c.Parallel)
+	}
+	off := false
+	threshold := 64
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{CryptoConfig: &ctlsock.CryptoConfig{
+		Parallel:          &off,
+		ParallelThreshold: &threshold,
+	}})
+	c = resp.CryptoConfig
+	if resp.ErrNo != 0 || c == nil {
+		t.Fatalf("got an error reply: %+v", resp)
+	}
+	if *c.Workers != 2 || *c.Parallel || *c.ParallelThreshold != 64 {
+		t.Errorf("configuration was not changed: workers=%d parallel=%v threshold=%d",
+			*c.Workers, *c.Parallel, *c.ParallelThreshold)
+	}
+	// The filesystem still works
+	data := make([]byte, 1024*1024)
+	if err := os.WriteFile(pDir+"/big", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := os.ReadFile(pDir + "/big"); err != nil || len(have) != len(data) {
+		t.Errorf("read back %d bytes: %v", len(have), err)
+	}
+	invalid := -1
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{CryptoConfig: &ctlsock.CryptoConfig{Workers: &invalid}})
+	if resp.ErrNo != int32(syscall.EINVAL) {
+		t.Errorf("negative worker count: want EINVAL, have %+v", resp)
+	}
+}
@@ -0,0 +1,34 @@
+package defaults
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestIOEngineUring checks that files written and read with
+// "-io-engine uring" keep their content, including a partial last block.
+func TestIOEngineUring(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-io-engine", "uring")
+	defer test_helpers.UnmountPanic(pDir)
+
+	data := make([]byte, 1024*1024+1234)
+	rand.Read(data)
+	fn := pDir + "/file"
+	if err := os.WriteFile(fn, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("content mismatch")
+	}
+	test_helpers.VerifySize(t, fn, len(data))
+}
@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -554,3 +555,75 @@ func TestSeekDir(t *testing.T) {
 		t.Error("Seek did not have any effect")
 	}
 }
+
+// TestNameCacheChanges lists a directory, changes it, and checks that the
+// next listing is not served from stale cached names.
+func TestNameCacheChanges(t *testing.T) {
+	wd := test_helpers.DefaultPlainDir + "/" + t.Name()
+	if err := os.Mkdir(wd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("l", 200)
+	for _, n := range []string{"a", long} {
+		if err := os.WriteFile(wd+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func() string {
+		entries, err := os.ReadDir(wd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		sort.Strings(names)
+		return strings.Join(names, ",")
+	}
+	if have := list(); have != "a,"+long {
+		t.Errorf("1st listing: %q", have)
+	}
+	if err := os.Rename(wd+"/a", wd+"/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(wd+"/"+long, wd+"/"+long+"2"); err != nil {
+		t.Fatal(err)
+	}
+	if have := list(); have != "b,"+long+"2" {
+		t.Errorf("2nd listing: %q", have)
+	}
+}
+
+// TestReaddirLarge lists a directory that spans several readdir batches and
+// contains both short and long names.
+func TestReaddirLarge(t *testing.T) {
+	wd := test_helpers.DefaultPlainDir + "/" + t.Name()
+	if err := os.Mkdir(wd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		n := fmt.Sprintf("%04d", i)
+		if i%3 == 0 {
+			n += strings.Repeat("x", 200)
+		}
+		if err := os.WriteFile(wd+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		want[n] = true
+	}
+	entries, err := os.ReadDir(wd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Errorf("want %d entries, have %d", len(want), len(entries))
+	}
+	for _, e := range entries {
+		if !want[e.Name()] {
+			t.Errorf("unexpected entry %q", e.Name())
+		}
+		delete(want, e.Name())
+	}
+}
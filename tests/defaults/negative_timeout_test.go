@@ -0,0 +1,36 @@
+package defaults
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestNegativeTimeout checks that with "-negative-timeout", failed lookups
+// are cached, but names created through the mount are visible right away.
+func TestNegativeTimeout(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-plaintextnames")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-negative-timeout", "1h")
+	defer test_helpers.UnmountPanic(pDir)
+
+	for _, n := range []string{"created", "backing"} {
+		if _, err := os.Stat(pDir + "/" + n); !os.IsNotExist(err) {
+			t.Fatalf("%s: %v", n, err)
+		}
+	}
+	if err := os.WriteFile(pDir+"/created", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pDir + "/created"); err != nil {
+		t.Error(err)
+	}
+	// Created behind our back: stays invisible
+	if err := os.WriteFile(cDir+"/backing", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pDir + "/backing"); !os.IsNotExist(err) {
+		t.Errorf("backing: %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+package defaults
+
+import (
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// "é" composed (NFC) and decomposed (NFD)
+const (
+	cafeNFC = "caf\u00e9"
+	cafeNFD = "cafe\u0301"
+)
+
+// TestNormalization checks that "-nfc" stores new names in NFC and finds
+// them in either form, also names stored in NFD by an earlier mount.
+func TestNormalization(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.WriteFile(pDir+"/old"+cafeNFD, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-nfc")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := os.WriteFile(pDir+"/"+cafeNFD, []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]bool)
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	if len(names) != 2 || !names[cafeNFC] || !names["old"+cafeNFD] {
+		t.Errorf("wrong names: %v", names)
+	}
+	content, err := os.ReadFile(pDir + "/" + cafeNFC)
+	if err != nil || string(content) != "new" {
+		t.Errorf("%q: %q %v", cafeNFC, content, err)
+	}
+	content, err = os.ReadFile(pDir + "/old" + cafeNFC)
+	if err != nil || string(content) != "old" {
+		t.Errorf("old name in NFC: %q %v", content, err)
+	}
+	if err = os.Remove(pDir + "/old" + cafeNFC); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(pDir + "/old" + cafeNFD); !os.IsNotExist(err) {
+		t.Errorf("old name still exists: %v", err)
+	}
+}
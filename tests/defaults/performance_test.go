@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
@@ -128,3 +129,28 @@ func BenchmarkCreate4kB(t *testing.B) {
 func BenchmarkCreate10kB(t *testing.B) {
 	createFiles(t, t.N, 10*1024)
 }
+
+// BenchmarkReaddir lists a directory with 10000 files, a third of them
+// with long names.
+func BenchmarkReaddir(b *testing.B) {
+	dir := test_helpers.DefaultPlainDir + "/" + b.Name()
+	if err := os.Mkdir(dir, 0700); err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 10000; i++ {
+		n := fmt.Sprintf("%s/%05d", dir, i)
+		if i%3 == 0 {
+			n += strings.Repeat("x", 200)
+		}
+		if err := os.WriteFile(n, nil, 0600); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := os.ReadDir(dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
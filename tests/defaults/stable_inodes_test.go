@@ -0,0 +1,94 @@
+package defaults
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestStableInodes checks that "-stable-inodes" reports the same inode
+// numbers after a remount, also for hard links.
+func TestStableInodes(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	names := []string{"", "/dir", "/dir/file", "/link"}
+	inos := func() []uint64 {
+		var out []uint64
+		for _, n := range names {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(pDir+n, &st); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, st.Ino)
+		}
+		return out
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-stable-inodes")
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pDir+"/dir/file", []byte("x"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(pDir+"/dir/file", pDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	before := inos()
+	test_helpers.UnmountPanic(pDir)
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-stable-inodes")
+	defer test_helpers.UnmountPanic(pDir)
+	after := inos()
+	for i := range names {
+		if before[i] != after[i] {
+			t.Errorf("%q: inode number changed from %#x to %#x", names[i], before[i], after[i])
+		}
+	}
+	if after[2] != after[3] {
+		t.Errorf("hard links have different inode numbers: %#x %#x", after[2], after[3])
+	}
+	// The numbers must come from the file handles, not from the spill
+	// pool, whose numbers may happen to repeat across mounts
+	cDirEnc := onlyEntry(t, cDir, true)
+	cFile := onlyEntry(t, cDirEnc, false)
+	for i, p := range map[int]string{1: cDirEnc, 2: cFile} {
+		handle, err := syscallcompat.FileHandle(unix.AT_FDCWD, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := inomap.New(0).TranslateHandle(handle, inomap.QIno{})
+		if after[i] != want {
+			t.Errorf("%q: inode number %#x, want %#x from the file handle", names[i], after[i], want)
+		}
+	}
+}
+
+// onlyEntry returns the path of the only encrypted directory ("dir") or
+// regular file in the ciphertext directory "cDir"
+func onlyEntry(t *testing.T, cDir string, dir bool) string {
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, e := range entries {
+		n := e.Name()
+		if strings.HasPrefix(n, "gocryptfs.") || n == configfile.MetaDirName || e.IsDir() != dir {
+			continue
+		}
+		found = append(found, filepath.Join(cDir, n))
+	}
+	if len(found) != 1 {
+		t.Fatalf("%s: want one entry, have %v", cDir, found)
+	}
+	return found[0]
+}
@@ -0,0 +1,97 @@
+package defaults
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestTrash deletes files on a "-trash" mount and restores them through the
+// control socket.
+func TestTrash(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test", "-trash", "7d")
+	defer test_helpers.UnmountPanic(pDir)
+
+	long := strings.Repeat("x", 200)
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"dir/file", long} {
+		if err := os.WriteFile(pDir+"/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(pDir + "/" + n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The trash itself is invisible
+	entries, err := os.ReadDir(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("want only dir, have %d entries", len(entries))
+	}
+
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashList: true})
+	if resp.ErrNo != 0 || len(resp.Trash) != 2 {
+		t.Fatalf("TrashList: %+v", resp)
+	}
+	if resp.Trash[0].Path != "dir/file" || resp.Trash[1].Path != long {
+		t.Errorf("wrong paths: %+v", resp.Trash)
+	}
+	// Restore by path and by ID
+	for _, ref := range []string{"dir/file", resp.Trash[1].ID} {
+		resp2 := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashRestore: ref})
+		if resp2.ErrNo != 0 {
+			t.Fatalf("TrashRestore %q: %+v", ref, resp2)
+		}
+		content, err := os.ReadFile(pDir + "/" + resp2.Result)
+		if err != nil || string(content) != resp2.Result {
+			t.Errorf("%q: content %q, %v", ref, content, err)
+		}
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashRestore: "dir/file"})
+	if resp.ErrNo != int32(syscall.ENOENT) {
+		t.Errorf("restoring twice: %+v", resp)
+	}
+	resp = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{TrashList: true})
+	if len(resp.Trash) != 0 {
+		t.Errorf("trash not empty: %+v", resp.Trash)
+	}
+}
+
+// TestTrashPurge checks that files are purged from the trash after the
+// retention period.
+func TestTrashPurge(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-trash", "1s")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := os.WriteFile(pDir+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	trash := cDir + "/.gocryptfs.trash"
+	entries, err := os.ReadDir(trash)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("trash: %v %v", entries, err)
+	}
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if entries, _ = os.ReadDir(trash); len(entries) == 0 {
+			return
+		}
+	}
+	t.Errorf("trash was not purged: %v", entries)
+}
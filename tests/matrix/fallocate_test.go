@@ -1,6 +1,7 @@
 package matrix
 
 import (
+	"bytes"
 	"os"
 	"runtime"
 	"syscall"
@@ -179,3 +180,39 @@ func TestFallocate(t *testing.T) {
 		t.Skipf("backing fs is not ext4 or tmpfs, skipped some disk-usage checks\n")
 	}
 }
+
+const FALLOC_FL_ZERO_RANGE = 0x10
+
+// TestFallocateZeroRange zeroes a range that starts and ends in partial
+// blocks, like VM managers do when they discard guest blocks
+func TestFallocateZeroRange(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skipf("OSX does not support fallocate")
+	}
+	fn := test_helpers.DefaultPlainDir + "/" + t.Name()
+	want := make([]byte, 20000)
+	for i := range want {
+		want[i] = byte(i)
+	}
+	if err := os.WriteFile(fn, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	err = syscallcompat.Fallocate(int(file.Fd()), FALLOC_FL_ZERO_RANGE, 3000, 18000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want[:3000], make([]byte, 18000)...)
+	test_helpers.VerifySize(t, fn, 21000)
+	have, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch")
+	}
+}
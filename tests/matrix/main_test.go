@@ -61,6 +61,7 @@ func TestMain(m *testing.M) {
 		{false, "auto", false, false, []string{"-serialize_reads"}},
 		{false, "auto", false, false, []string{"-sharedstorage"}},
 		{false, "auto", false, false, []string{"-deterministic-names"}},
+		{false, "false", false, false, []string{"-cipher", "optimized"}},
 		// Test xchacha with and without openssl
 		{false, "true", false, true, []string{"-xchacha"}},
 		{false, "false", false, true, []string{"-xchacha"}},
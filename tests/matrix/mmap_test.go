@@ -0,0 +1,143 @@
+//go:build linux
+
+package matrix
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestMmapPatch patches a file through a writable shared mapping, like
+// binary patching tools do, across a block boundary and in the last,
+// incomplete block.
+func TestMmapPatch(t *testing.T) {
+	fn := filepath.Join(test_helpers.DefaultPlainDir, t.Name())
+	want := bytes.Repeat([]byte("0123456789abcdef"), 700)
+	if err := os.WriteFile(fn, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	m, err := unix.Mmap(int(f.Fd()), 0, len(want), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, off := range []int{4090, 8000, len(want) - 3} {
+		copy(m[off:], "XYZ")
+		copy(want[off:], "XYZ")
+	}
+	if err = unix.Msync(m, unix.MS_SYNC); err != nil {
+		t.Error(err)
+	}
+	if err = unix.Munmap(m); err != nil {
+		t.Fatal(err)
+	}
+	have, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch after msync")
+	}
+	// Read the ciphertext again, bypassing the page cache of the mount
+	dropPageCache(t, fn)
+	if have, err = os.ReadFile(fn); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(have, want) {
+		t.Error("content mismatch after dropping the page cache")
+	}
+}
+
+// dropPageCache drops the clean pages of "fn" from the page cache, so the
+// next read has to decrypt the ciphertext
+func dropPageCache(t *testing.T, fn string) {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = unix.Fadvise(int(f.Fd()), 0, 0, unix.FADV_DONTNEED); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMmapShm maps a file twice and grows it, like SQLite does with the
+// "-shm" file in WAL mode
+func TestMmapShm(t *testing.T) {
+	fn := filepath.Join(test_helpers.DefaultPlainDir, t.Name())
+	f1, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	const size = 32768
+	if err = f1.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	m1, err := unix.Mmap(int(f1.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(m1)
+	m2, err := unix.Mmap(int(f2.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Munmap(m2)
+	copy(m1[100:], "written through m1")
+	copy(m2[20000:], "written through m2")
+	if string(m2[100:118]) != "written through m1" || string(m1[20000:20018]) != "written through m2" {
+		t.Error("mappings are not coherent")
+	}
+	if err = unix.Msync(m1, unix.MS_SYNC); err != nil {
+		t.Error(err)
+	}
+	if err = unix.Msync(m2, unix.MS_SYNC); err != nil {
+		t.Error(err)
+	}
+	dropPageCache(t, fn)
+	buf := make([]byte, 18)
+	if _, err = f1.ReadAt(buf, 20000); err != nil || string(buf) != "written through m2" {
+		t.Errorf("have %q, %v", buf, err)
+	}
+}
+
+// TestSqliteWAL runs the sqlite3 command-line tool in WAL mode, which keeps
+// the "-shm" file mapped, if it is installed
+func TestSqliteWAL(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 not installed")
+	}
+	db := filepath.Join(test_helpers.DefaultPlainDir, t.Name()+".db")
+	sql := "PRAGMA journal_mode=WAL;" +
+		"CREATE TABLE t(i INTEGER, s TEXT);" +
+		"WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x+1 FROM c WHERE x<5000) " +
+		"INSERT INTO t SELECT x, hex(randomblob(50)) FROM c;" +
+		"UPDATE t SET s='updated' WHERE i%7=0;"
+	if out, err := exec.Command("sqlite3", db, sql).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	out, err := exec.Command("sqlite3", db, "PRAGMA integrity_check; SELECT count(*) FROM t WHERE s='updated';").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if have := strings.TrimSpace(string(out)); have != "ok\n714" {
+		t.Errorf("have %q", have)
+	}
+}
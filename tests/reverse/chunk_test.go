@@ -0,0 +1,96 @@
+package reverse_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestChunkSize checks that the chunks of a "-chunk-size" mount add up to
+// the normal ciphertext, and that "-join-chunks" restores it.
+func TestChunkSize(t *testing.T) {
+	if plaintextnames {
+		t.Skip("-chunk-size does not work with -plaintextnames")
+	}
+	// 2.5 MiB gives two chunks of 1 MiB and a short one
+	content := bytes.Repeat([]byte("0123456789"), 262144)
+	if err := os.WriteFile(dirA+"/chunktest", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dirA + "/chunktest")
+	mnt := dirA + ".chunked"
+	test_helpers.MountOrFatal(t, dirA, mnt, "-reverse", "-extpass", "echo test", "-chunk-size", "1")
+	defer test_helpers.UnmountPanic(mnt)
+
+	entries, err := os.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var base string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".chunk.2") {
+			base = strings.TrimSuffix(e.Name(), ".chunk.2")
+		}
+		if strings.HasSuffix(e.Name(), ".chunk.3") {
+			t.Errorf("unexpected chunk %q", e.Name())
+		}
+	}
+	if base == "" {
+		t.Fatalf("no chunks found")
+	}
+	want, err := os.ReadFile(filepath.Join(dirB, base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []byte
+	for _, n := range []string{base, base + ".chunk.1", base + ".chunk.2"} {
+		c, err := os.ReadFile(filepath.Join(mnt, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(filepath.Join(mnt, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() != int64(len(c)) {
+			t.Errorf("%s: stat size %d, read %d bytes", n, fi.Size(), len(c))
+		}
+		have = append(have, c...)
+	}
+	if !bytes.Equal(have, want) {
+		t.Fatalf("concatenated chunks differ from the ciphertext: have %d bytes, want %d", len(have), len(want))
+	}
+
+	// Restore a copy with -join-chunks
+	copyDir := t.TempDir()
+	for _, n := range []string{base, base + ".chunk.1", base + ".chunk.2"} {
+		c, err := os.ReadFile(filepath.Join(mnt, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(copyDir, n), c, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-join-chunks", copyDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	have, err = os.ReadFile(filepath.Join(copyDir, base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("-join-chunks result differs from the ciphertext")
+	}
+	if _, err = os.Stat(filepath.Join(copyDir, base+".chunk.1")); !os.IsNotExist(err) {
+		t.Errorf("chunk was not removed: %v", err)
+	}
+}
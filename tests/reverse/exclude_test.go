@@ -4,7 +4,10 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
@@ -196,3 +199,55 @@ func TestExcludeAllOnlyDir1(t *testing.T) {
 	}
 	doTestExcludeTestFs(t, "-exclude-wildcard", patterns, tree)
 }
+
+// TestExcludeFromReload checks that the -exclude-from file is re-read on
+// SIGHUP.
+func TestExcludeFromReload(t *testing.T) {
+	excludeFile := test_helpers.TmpDir + "/TestExcludeFromReload.exclude"
+	if err := os.WriteFile(excludeFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backingDir, mnt, sock := newReverseFS([]string{"-exclude-from", excludeFile})
+	defer test_helpers.UnmountPanic(mnt)
+	for _, f := range []string{"secret", "public"} {
+		if err := os.WriteFile(backingDir+"/"+f, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cSecret := ctlsockEncryptPath(t, sock, "secret")
+	cPublic := ctlsockEncryptPath(t, sock, "public")
+	if test_helpers.VerifyExistence(t, mnt+"/"+cSecret) || !test_helpers.VerifyExistence(t, mnt+"/"+cPublic) {
+		t.Fatal("wrong initial state")
+	}
+	if err := os.WriteFile(excludeFile, []byte("public\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(test_helpers.MountInfo[mnt].Pid, syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	// The directory listing is not cached, so it changes as soon as the
+	// signal has been handled
+	for i := 0; ; i++ {
+		entries, err := os.ReadDir(mnt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		listing := strings.Join(names, "/")
+		if strings.Contains(listing, cSecret) && !strings.Contains(listing, cPublic) {
+			break
+		}
+		if i == 30 {
+			t.Fatal("exclusion patterns were not reloaded")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Wait for the kernel to drop the cached entries
+	time.Sleep(1100 * time.Millisecond)
+	if !test_helpers.VerifyExistence(t, mnt+"/"+cSecret) || test_helpers.VerifyExistence(t, mnt+"/"+cPublic) {
+		t.Error("lookups still use the old patterns")
+	}
+}
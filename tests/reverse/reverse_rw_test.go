@@ -0,0 +1,109 @@
+package reverse_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestReverseRW mounts a "-reverse-rw" view forward and checks that changes
+// made through the forward mount end up in the plaintext directory.
+func TestReverseRW(t *testing.T) {
+	backingDir, mntDir, _ := newReverseFS([]string{"-reverse-rw"})
+	defer test_helpers.UnmountPanic(mntDir)
+	fwd := mntDir + ".fwd"
+	test_helpers.MountOrFatal(t, mntDir, fwd, "-extpass", "echo test", "-noprealloc")
+	defer test_helpers.UnmountPanic(fwd)
+
+	// Several blocks and a short last block
+	content := bytes.Repeat([]byte("0123456789abcdef"), 1000)
+	if err := os.WriteFile(fwd+"/file", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	have, err := os.ReadFile(backingDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Errorf("content mismatch: have %d bytes, want %d", len(have), len(content))
+	}
+	if err = os.Truncate(fwd+"/file", 4096); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(backingDir + "/file"); err != nil || fi.Size() != 4096 {
+		t.Errorf("truncate: %v %v", fi, err)
+	}
+	if err = os.Rename(fwd+"/file", fwd+"/file2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(backingDir + "/file2"); err != nil {
+		t.Error(err)
+	}
+	if err = os.Symlink("target", fwd+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink(backingDir + "/link"); err != nil || target != "target" {
+		t.Errorf("symlink: %q %v", target, err)
+	}
+	// A forward mount writes a random gocryptfs.diriv into new directories,
+	// which cannot work as reverse mode derives the IV from the path
+	if plaintextnames || deterministic_names {
+		if err = os.Mkdir(fwd+"/dir", 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(fwd+"/dir/file", content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.RemoveAll(fwd + "/dir"); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, n := range []string{"file2", "link"} {
+		if err = os.Remove(fwd + "/" + n); err != nil {
+			t.Error(err)
+		}
+	}
+	entries, err := os.ReadDir(backingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != ".gocryptfs.reverse.conf" {
+			t.Errorf("left over: %q", e.Name())
+		}
+	}
+}
+
+// TestReverseRWGarbage checks that ciphertext that does not decrypt is
+// rejected.
+func TestReverseRWGarbage(t *testing.T) {
+	if plaintextnames {
+		t.Skip()
+	}
+	backingDir, mntDir, _ := newReverseFS([]string{"-reverse-rw", "-wpanic=false"})
+	defer test_helpers.UnmountPanic(mntDir)
+	if err := os.WriteFile(backingDir+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(mntDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() || e.Name() == "gocryptfs.conf" || e.Name() == "gocryptfs.diriv" {
+			continue
+		}
+		p := mntDir + "/" + e.Name()
+		c, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Flip a bit in the data block
+		c[len(c)-1] ^= 1
+		if err = os.WriteFile(p, c, 0600); err == nil {
+			t.Errorf("corrupt ciphertext was accepted")
+		}
+	}
+}
@@ -2,6 +2,7 @@ package test_helpers
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -371,13 +372,13 @@ func Du(t *testing.T, fd int) (nBytes int64) {
 // QueryCtlSock sends a request to the control socket at "socketPath" and
 // returns the response.
 func QueryCtlSock(t *testing.T, socketPath string, req ctlsock.RequestStruct) ctlsock.ResponseStruct {
-	c, err := ctlsock.New(socketPath)
+	c, err := ctlsock.Connect(context.Background(), socketPath)
 	if err != nil {
 		// Connecting to the socket failed already. This is fatal.
 		t.Fatal(err)
 	}
 	defer c.Close()
-	resp, err := c.Query(&req)
+	resp, err := c.Do(context.Background(), &req)
 	if err != nil {
 		// If we got a response, try to extract it. This is not fatal here
 		// as the tests may expect error responses.
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// parseThrottle parses the "-throttle" setting: "on", "off", or
+// ATTEMPTS/DURATION like "10/1h". Returns nil for "off".
+func parseThrottle(s string) (*configfile.ThrottleParams, error) {
+	switch s {
+	case "off":
+		return nil, nil
+	case "on":
+		return &configfile.ThrottleParams{}, nil
+	}
+	n, d, ok := strings.Cut(s, "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid value %q, want on, off or ATTEMPTS/DURATION", s)
+	}
+	attempts, err := strconv.Atoi(n)
+	if err != nil || attempts < 1 {
+		return nil, fmt.Errorf("invalid number of attempts %q", n)
+	}
+	window, err := parseRetention(d)
+	if err != nil {
+		return nil, err
+	}
+	if window.Seconds() < 1 {
+		return nil, fmt.Errorf("lockout %v is shorter than a second", window)
+	}
+	return &configfile.ThrottleParams{LockoutAttempts: attempts, LockoutSeconds: int(window.Seconds())}, nil
+}
+
+// changeThrottle implements "-throttle"
+func changeThrottle(args *argContainer) {
+	masterkey, confFile, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	confFile.SetThrottle(args._throttle)
+	if err = confFile.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	if args._throttle == nil {
+		tlog.Info.Printf(tlog.ColorGreen + "Unlock attempt throttling disabled." + tlog.ColorReset)
+		return
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Unlock attempt throttling enabled: %s."+tlog.ColorReset, args._throttle)
+}
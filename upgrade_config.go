@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// upgradeConfig implements "-upgrade-config".
+// Does not return (calls os.Exit both on success and on error).
+func upgradeConfig(args *argContainer) {
+	if args.masterkey != "" || args.zerokey {
+		tlog.Fatal.Printf("-upgrade-config needs the password and does not work with -masterkey or -zerokey")
+		os.Exit(exitcodes.Usage)
+	}
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		exitcodes.Exit(err)
+	}
+	from := cf.SchemaVersion()
+	if len(cf.PendingMigrations()) == 0 {
+		tlog.Info.Printf("%s already has config file version %d, nothing to do.", args.config, from)
+		os.Exit(0)
+	}
+	leaveUpstream(args, cf, "-upgrade-config")
+	pw, err := readConfigPassword(args, cf)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	tlog.Info.Println("Decrypting master key")
+	masterkey, err := cf.DecryptMasterKey(pw)
+	if err != nil {
+		tlog.Fatal.Println(err)
+		exitcodes.Exit(err)
+	}
+	applied, err := cf.Upgrade(&configfile.UpgradeArgs{
+		Masterkey: masterkey,
+		Password:  pw,
+		// Backup copies only make sense in the CIPHERDIR
+		ConfigHMAC: !args.reverse && !args._configCustom,
+	})
+	for i := range pw {
+		pw[i] = 0
+	}
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-upgrade-config: %v", err)
+		os.Exit(exitcodes.Other)
+	}
+	err = cf.WriteFile()
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.WriteConf)
+	}
+	for _, m := range applied {
+		tlog.Info.Printf("  %s", m)
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Config file upgraded from version %d to %d."+tlog.ColorReset,
+		from, cf.SchemaVersion())
+	os.Exit(0)
+}
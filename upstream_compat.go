@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// leaveUpstream is called before the operation "op" adds feature flags that
+// upstream gocryptfs v2.x does not know to the filesystem "cf". If upstream
+// can mount the filesystem now, it cannot afterwards: this is an error with
+// "-upstream-compat", and a warning otherwise.
+// Calls os.Exit on error.
+func leaveUpstream(args *argContainer, cf *configfile.ConfFile, op string) {
+	if cf.UpstreamCompatible() != nil {
+		// Nothing to lose
+		return
+	}
+	if args.upstream_compat {
+		tlog.Fatal.Printf("-upstream-compat: %s would make this filesystem unmountable by upstream gocryptfs v2.x", op)
+		os.Exit(exitcodes.Upstream)
+	}
+	tlog.Warn.Printf("%s: upstream gocryptfs v2.x will no longer be able to mount this filesystem", op)
+}
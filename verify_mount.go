@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/dedup"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+const (
+	// verifyQuick checks a random sample of the files
+	verifyQuick = "quick"
+	// verifyFull checks all files
+	verifyFull = "full"
+	// verifyQuickSample is the number of files that verifyQuick checks
+	verifyQuickSample = 100
+)
+
+// mountVerifier implements "-verify-on-mount"
+type mountVerifier struct {
+	cipherdir string
+	cEnc      *contentenc.ContentEnc
+	nt        *nametransform.NameTransform
+	// dirIV is set if the directories have a gocryptfs.diriv file
+	dirIV bool
+	// dedupStore is set for filesystems with the Dedup feature flag, whose
+	// files can be recipes
+	dedupStore *dedup.Store
+	// damaged is the number of damaged files and directories
+	damaged int
+}
+
+// verifyOnMount checks CIPHERDIR before it is mounted: gocryptfs.diriv of
+// every directory, and the header and the first block of a random sample
+// of the files (mode verifyQuick) or of all files (verifyFull). The config
+// file has already been checked when it was unlocked. Returns an error with
+// exit code VerifyFailed if something is damaged.
+func verifyOnMount(args *argContainer, cEnc *contentenc.ContentEnc, nt *nametransform.NameTransform,
+	dirIV bool, dedupStore *dedup.Store) error {
+	v := mountVerifier{
+		cipherdir:  args.cipherdir,
+		cEnc:       cEnc,
+		nt:         nt,
+		dirIV:      dirIV,
+		dedupStore: dedupStore,
+	}
+	t0 := time.Now()
+	dirs, files := v.walk()
+	all := len(files)
+	if args.verify_on_mount == verifyQuick && len(files) > verifyQuickSample {
+		r := rand.New(rand.NewSource(time.Now().UnixNano()))
+		r.Shuffle(len(files), func(i, j int) { files[i], files[j] = files[j], files[i] })
+		files = files[:verifyQuickSample]
+	}
+	for _, path := range files {
+		if err := v.file(path); err != nil {
+			v.report(path, err)
+		}
+	}
+	if v.damaged > 0 {
+		return fatalErr(exitcodes.VerifyFailed, "-verify-on-mount: %d damaged files or directories in %s", v.damaged, args.cipherdir)
+	}
+	tlog.Info.Printf("-verify-on-mount: %d directories and %d of %d files are intact (%v)",
+		dirs, len(files), all, time.Since(t0).Round(time.Millisecond))
+	return nil
+}
+
+func (v *mountVerifier) report(path string, err error) {
+	tlog.Warn.Printf("-verify-on-mount: %s: %v", path, err)
+	v.damaged++
+}
+
+// walk checks the directories in CIPHERDIR and returns their number and the
+// files that hold file content
+func (v *mountVerifier) walk() (dirs int, files []string) {
+	filepath.WalkDir(v.cipherdir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			v.report(path, err)
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if filepath.Dir(path) == v.cipherdir && isSpecialDir(name) {
+				return filepath.SkipDir
+			}
+			dirs++
+			if err := v.dir(path); err != nil {
+				v.report(path, err)
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && nametransform.IsContentName(name) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return dirs, files
+}
+
+// dir checks gocryptfs.diriv of the directory "path"
+func (v *mountVerifier) dir(path string) error {
+	if !v.dirIV {
+		return nil
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	cName := nametransform.RootDirCName
+	if path != v.cipherdir {
+		cName = filepath.Base(path)
+	}
+	if _, err = v.nt.VerifyDirIVAt(fd, cName); err != nil {
+		return fmt.Errorf("%s: %v", nametransform.DirIVFilename, err)
+	}
+	return nil
+}
+
+// file checks the header and the first block of the file "path"
+func (v *mountVerifier) file(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(st.Size())
+	if size == 0 {
+		return nil
+	}
+	if v.dedupStore != nil && dedup.IsRecipeSize(v.cEnc, size) {
+		buf := make([]byte, size)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			return err
+		}
+		if _, ok := dedup.RecipeSize(buf); ok {
+			_, err = v.dedupStore.ParseRecipe(buf)
+			return err
+		}
+	}
+	headerLen := v.cEnc.HeaderLen()
+	if size < headerLen {
+		return fmt.Errorf("truncated header: %d bytes", size)
+	}
+	n := headerLen + v.cEnc.CipherBS()
+	if size < n {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := f.ReadAt(buf, 0); err != nil {
+		return err
+	}
+	h, cEnc, err := v.cEnc.OpenHeader(buf[:headerLen])
+	if err != nil {
+		return err
+	}
+	if _, err = cEnc.DecryptBlock(buf[headerLen:], 0, h.ID); err != nil {
+		return fmt.Errorf("block 0: %v", err)
+	}
+	return nil
+}
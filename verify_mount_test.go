@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+func newTestVerifier(t *testing.T) *mountVerifier {
+	cCore := cryptocore.New(make([]byte, cryptocore.KeyLen), cryptocore.BackendGoGCM, 128, true)
+	return &mountVerifier{
+		cipherdir: t.TempDir(),
+		cEnc:      contentenc.New(cCore, contentenc.DefaultBS),
+		nt:        nametransform.New(cCore.EMECipher, true, 0, true, nil, false, nil),
+		dirIV:     true,
+	}
+}
+
+// writeEncrypted creates the ciphertext file "path" with one block of
+// content
+func (v *mountVerifier) writeEncrypted(t *testing.T, path string) {
+	h := contentenc.RandomHeader()
+	data := append(h.Pack(), v.cEnc.EncryptBlock([]byte("hello"), 0, h.ID)...)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mkdirDirIV creates the directory "path" with a gocryptfs.diriv file
+func mkdirDirIV(t *testing.T, path string) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	if err := nametransform.WriteDirIVAt(fd); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyOnMount(t *testing.T) {
+	v := newTestVerifier(t)
+	dir := v.cipherdir
+	mkdirDirIV(t, dir)
+	mkdirDirIV(t, filepath.Join(dir, "d"))
+	v.writeEncrypted(t, filepath.Join(dir, "f"))
+	v.writeEncrypted(t, filepath.Join(dir, "d", "g"))
+	if err := os.WriteFile(filepath.Join(dir, "empty"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	dirs, files := v.walk()
+	if dirs != 2 || len(files) != 3 || v.damaged != 0 {
+		t.Fatalf("dirs=%d files=%v damaged=%d", dirs, files, v.damaged)
+	}
+	for _, f := range files {
+		if err := v.file(f); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+
+	tlog.Warn.Enabled = false
+	defer func() { tlog.Warn.Enabled = true }()
+	// Flip a bit in the first block
+	f := filepath.Join(dir, "d", "g")
+	data, _ := os.ReadFile(f)
+	data[len(data)-1] ^= 1
+	os.WriteFile(f, data, 0600)
+	if err := v.file(f); err == nil {
+		t.Error("damaged block not detected")
+	}
+	// Truncate the header
+	os.WriteFile(f, data[:5], 0600)
+	if err := v.file(f); err == nil {
+		t.Error("truncated header not detected")
+	}
+	// Lose a gocryptfs.diriv
+	os.Remove(filepath.Join(dir, "d", nametransform.DirIVFilename))
+	v.walk()
+	if v.damaged != 1 {
+		t.Errorf("missing %s: damaged=%d", nametransform.DirIVFilename, v.damaged)
+	}
+}
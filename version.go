@@ -35,6 +35,11 @@ var raceDetector bool
 // printVersion prints a version string like this:
 // gocryptfs v1.7-32-gcf99cfd; go-fuse v1.0.0-174-g22a9cb9; 2019-05-12 go1.12 linux/amd64
 func printVersion() {
+	fmt.Println(versionString())
+}
+
+// versionString returns the version string that printVersion prints
+func versionString() string {
 	var tagsSlice []string
 	if stupidgcm.BuiltWithoutOpenssl {
 		tagsSlice = append(tagsSlice, "without_openssl")
@@ -47,7 +52,7 @@ func printVersion() {
 	if raceDetector {
 		built += " -race"
 	}
-	fmt.Printf("%s %s%s; go-fuse %s; %s %s/%s\n",
+	return fmt.Sprintf("%s %s%s; go-fuse %s; %s %s/%s",
 		tlog.ProgramName, GitVersion, tags, GitVersionFuse, built,
 		runtime.GOOS, runtime.GOARCH)
 }